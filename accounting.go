@@ -0,0 +1,223 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	logging "github.com/op/go-logging"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AccountingTag is the tag of the control records by which a forward output
+// tells the next forwarder how many records it has sent with each tag, so
+// that the records lost between them are counted.  The input consumes them
+// instead of passing them on.
+const AccountingTag = "__fluentd_forwarder.accounting"
+
+// AccountingSenderKey is the key of the option of the forward messages that
+// carries the ID of the output accounting for their records.
+const AccountingSenderKey = "fluentd_forwarder_sender"
+
+// accountingSenderTimeout is how long the accounts of a sender are kept
+// since it was last heard from.
+const accountingSenderTimeout = time.Hour
+
+var (
+	inputLostRecords       = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_input_lost_records_total", "Number of the records the previous forwarder sent but not received.", "listener"))
+	inputDuplicatedRecords = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_input_duplicated_records_total", "Number of the records received more times than the previous forwarder sent them.", "listener"))
+)
+
+// deliveryAccountant counts the records an output writes to its buffer by
+// the tags, and makes the control record carrying the counts in every
+// interval.  As the control record is buffered after the records it counts,
+// it arrives after them unless they are lost.
+type deliveryAccountant struct {
+	sender   string
+	interval time.Duration
+	seq      uint64
+	counts   map[string]int64
+	lastAt   time.Time
+	now      func() time.Time
+}
+
+func (accountant *deliveryAccountant) option() map[string]interface{} {
+	return map[string]interface{}{AccountingSenderKey: accountant.sender}
+}
+
+func (accountant *deliveryAccountant) count(tag string, records int) {
+	accountant.counts[tag] += int64(records)
+}
+
+// control returns the control record if the interval has passed since the
+// last one and some records have been counted since.
+func (accountant *deliveryAccountant) control() (FluentRecordSet, bool) {
+	now := accountant.now()
+	if len(accountant.counts) == 0 || now.Sub(accountant.lastAt) < accountant.interval {
+		return FluentRecordSet{}, false
+	}
+	accountant.seq += 1
+	counts := make(map[string]interface{}, len(accountant.counts))
+	for tag, n := range accountant.counts {
+		counts[tag] = n
+	}
+	accountant.counts = make(map[string]int64)
+	accountant.lastAt = now
+	return FluentRecordSet{
+		Tag: AccountingTag,
+		Records: []TinyFluentRecord{
+			{
+				Timestamp: uint64(now.Unix()),
+				Data: map[string]interface{}{
+					"sender": accountant.sender,
+					"seq":    accountant.seq,
+					"counts": counts,
+				},
+			},
+		},
+	}, true
+}
+
+func newDeliveryAccountant(interval time.Duration) *deliveryAccountant {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &deliveryAccountant{
+		sender:   hex.EncodeToString(id),
+		interval: interval,
+		seq:      0,
+		counts:   make(map[string]int64),
+		lastAt:   time.Now(),
+		now:      time.Now,
+	}
+}
+
+// accountingSender returns the ID of the sender in the option of a forward
+// message, or "" if it has none.
+func accountingSender(option interface{}) string {
+	m, ok := option.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	switch v := m[AccountingSenderKey].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+type senderAccount struct {
+	seq      uint64
+	counts   map[string]int64
+	lastSeen time.Time
+}
+
+// lossAccounting counts the records an input receives from each sender by
+// the tags, and compares the counts with those in the control records of
+// the sender.
+type lossAccounting struct {
+	logger     *logging.Logger
+	listener   string
+	mtx        sync.Mutex
+	senders    map[string]*senderAccount
+	lost       *Counter
+	duplicated *Counter
+	now        func() time.Time
+}
+
+// received accounts for the record sets from the sender and returns them
+// without the control records.
+func (accounting *lossAccounting) received(sender string, recordSets []FluentRecordSet) []FluentRecordSet {
+	accounting.mtx.Lock()
+	defer accounting.mtx.Unlock()
+	account, ok := accounting.senders[sender]
+	if !ok {
+		account = &senderAccount{counts: make(map[string]int64)}
+		accounting.senders[sender] = account
+	}
+	account.lastSeen = accounting.now()
+	retval := recordSets[:0]
+	for _, recordSet := range recordSets {
+		if recordSet.Tag != AccountingTag {
+			account.counts[recordSet.Tag] += int64(len(recordSet.Records))
+			retval = append(retval, recordSet)
+			continue
+		}
+		for _, record := range recordSet.Records {
+			accounting.reconcile(sender, account, record.Data)
+		}
+	}
+	return retval
+}
+
+func (accounting *lossAccounting) reconcile(sender string, account *senderAccount, data map[string]interface{}) {
+	seq, _ := toFloat64(data["seq"])
+	sent, _ := data["counts"].(map[string]interface{})
+	received := account.counts
+	account.counts = make(map[string]int64)
+	previousSeq := account.seq
+	account.seq = uint64(seq)
+	if previousSeq != 0 && uint64(seq) != previousSeq+1 {
+		// the counts of the intervals in between are unknown
+		accounting.logger.Warningf("%s: missed the accounts %d to %d from %s; the losses in between are not counted", accounting.listener, previousSeq+1, uint64(seq)-1, sender)
+		return
+	}
+	tags := make([]string, 0, len(sent)+len(received))
+	for tag := range sent {
+		tags = append(tags, tag)
+	}
+	for tag := range received {
+		if _, ok := sent[tag]; !ok {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		n, _ := toFloat64(sent[tag])
+		diff := int64(n) - received[tag]
+		if diff > 0 {
+			accounting.lost.Add(float64(diff))
+			accounting.logger.Warningf("%s: %d of the %d records tagged %s sent by %s are lost", accounting.listener, diff, int64(n), LogTag(tag), sender)
+		} else if diff < 0 {
+			accounting.duplicated.Add(float64(-diff))
+			accounting.logger.Warningf("%s: %d of the %d records tagged %s sent by %s are duplicated", accounting.listener, -diff, int64(n), LogTag(tag), sender)
+		}
+	}
+	// forget the senders gone
+	for id, account := range accounting.senders {
+		if accounting.now().Sub(account.lastSeen) > accountingSenderTimeout {
+			delete(accounting.senders, id)
+		}
+	}
+}
+
+func newLossAccounting(logger *logging.Logger, listener string) *lossAccounting {
+	return &lossAccounting{
+		logger:     logger,
+		listener:   listener,
+		mtx:        sync.Mutex{},
+		senders:    make(map[string]*senderAccount),
+		lost:       inputLostRecords.With(listener),
+		duplicated: inputDuplicatedRecords.With(listener),
+		now:        time.Now,
+	}
+}
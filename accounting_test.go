@@ -0,0 +1,185 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+type syncRecordingPort struct {
+	mtx        sync.Mutex
+	recordSets []FluentRecordSet
+}
+
+func (port *syncRecordingPort) Emit(recordSets []FluentRecordSet) error {
+	port.mtx.Lock()
+	defer port.mtx.Unlock()
+	port.recordSets = append(port.recordSets, CopyRecordSets(recordSets)...)
+	return nil
+}
+
+func accountingControl(seq uint64, counts map[string]interface{}) FluentRecordSet {
+	return FluentRecordSet{
+		Tag: AccountingTag,
+		Records: []TinyFluentRecord{
+			{Timestamp: 0, Data: map[string]interface{}{"sender": "a", "seq": seq, "counts": counts}},
+		},
+	}
+}
+
+func Test_DeliveryAccountant(t *testing.T) {
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	accountant := newDeliveryAccountant(time.Minute)
+	accountant.lastAt = now
+	accountant.now = func() time.Time { return now }
+	if _, ok := accountant.control(); ok {
+		t.Fatal("a control record was made with nothing counted")
+	}
+	accountant.count("a", 2)
+	accountant.count("b", 1)
+	accountant.count("a", 3)
+	if _, ok := accountant.control(); ok {
+		t.Fatal("a control record was made before the interval passed")
+	}
+	now = now.Add(time.Minute)
+	control, ok := accountant.control()
+	if !ok || control.Tag != AccountingTag || len(control.Records) != 1 {
+		t.Fatalf("%+v", control)
+	}
+	data := control.Records[0].Data
+	counts := data["counts"].(map[string]interface{})
+	if data["sender"] != accountant.sender || data["seq"] != uint64(1) || len(counts) != 2 || counts["a"] != int64(5) || counts["b"] != int64(1) {
+		t.Fatalf("%+v", data)
+	}
+	now = now.Add(time.Minute)
+	if _, ok := accountant.control(); ok {
+		t.Fatal("a control record was made with nothing counted since the last one")
+	}
+	if accountingSender(accountant.option()) != accountant.sender {
+		t.Fail()
+	}
+}
+
+func Test_LossAccounting(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("accounting")
+	accounting := newLossAccounting(logger, "test-accounting")
+	records := func(n int) []TinyFluentRecord {
+		return make([]TinyFluentRecord, n)
+	}
+	result := accounting.received("a", []FluentRecordSet{
+		{Tag: "x", Records: records(3)},
+		{Tag: "y", Records: records(1)},
+	})
+	if len(result) != 2 {
+		t.Fatalf("%+v", result)
+	}
+	// 2 records of x are lost
+	result = accounting.received("a", []FluentRecordSet{accountingControl(1, map[string]interface{}{"x": int64(5), "y": int64(1)})})
+	if len(result) != 0 || accounting.lost.Value() != 2 || accounting.duplicated.Value() != 0 {
+		t.Fatalf("%+v %f %f", result, accounting.lost.Value(), accounting.duplicated.Value())
+	}
+	// a record of x is received twice, and the control record follows the
+	// records in the same message
+	result = accounting.received("a", []FluentRecordSet{
+		{Tag: "x", Records: records(4)},
+		accountingControl(2, map[string]interface{}{"x": uint64(3)}),
+	})
+	if len(result) != 1 || result[0].Tag != "x" || accounting.lost.Value() != 2 || accounting.duplicated.Value() != 1 {
+		t.Fatalf("%+v %f %f", result, accounting.lost.Value(), accounting.duplicated.Value())
+	}
+	// the control record 3 is lost, so the counts cannot be compared
+	accounting.received("a", []FluentRecordSet{{Tag: "x", Records: records(1)}})
+	accounting.received("a", []FluentRecordSet{accountingControl(4, map[string]interface{}{"x": int64(9)})})
+	if accounting.lost.Value() != 2 || accounting.duplicated.Value() != 1 {
+		t.Fatalf("%f %f", accounting.lost.Value(), accounting.duplicated.Value())
+	}
+	// the senders are accounted separately
+	accounting.received("b", []FluentRecordSet{{Tag: "x", Records: records(1)}})
+	accounting.received("a", []FluentRecordSet{{Tag: "x", Records: records(2)}})
+	accounting.received("a", []FluentRecordSet{accountingControl(5, map[string]interface{}{"x": int64(2)})})
+	if accounting.lost.Value() != 2 || accounting.duplicated.Value() != 1 {
+		t.Fatalf("%f %f", accounting.lost.Value(), accounting.duplicated.Value())
+	}
+}
+
+func Test_Accounting_Forward(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("accounting")
+	tempDir, err := ioutil.TempDir("", "accounting")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+	port := &syncRecordingPort{}
+	input, err := NewForwardInput(logger, "127.0.0.1:0", port)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	input.Start()
+	defer func() {
+		input.Stop()
+		input.WaitForShutdown()
+	}()
+	output, err := NewForwardOutput(logger, input.listener.Addr().String(), 10*time.Millisecond, time.Second, time.Second, 10*time.Millisecond, 0, tempDir+"/*.buf", 16777216, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// a control record follows every set of records
+	output.EnableAccounting(0)
+	output.Start()
+	defer func() {
+		output.Stop()
+		output.WaitForShutdown()
+	}()
+	err = output.Emit([]FluentRecordSet{
+		{Tag: "x", Records: []TinyFluentRecord{{Timestamp: 1388534400, Data: map[string]interface{}{"a": 1}}, {Timestamp: 1388534401, Data: map[string]interface{}{"a": 2}}}},
+		{Tag: "y", Records: []TinyFluentRecord{{Timestamp: 1388534402, Data: map[string]interface{}{"a": 3}}}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	seq := func() uint64 {
+		input.accounting.mtx.Lock()
+		defer input.accounting.mtx.Unlock()
+		account, ok := input.accounting.senders[output.accountant.sender]
+		if !ok {
+			return 0
+		}
+		return account.seq
+	}
+	for deadline := time.Now().Add(5 * time.Second); seq() < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the control records did not arrive")
+		}
+	}
+	port.mtx.Lock()
+	defer port.mtx.Unlock()
+	if tags := tagsOf(port.recordSets); len(tags) != 3 || tags[0] != "x" || tags[1] != "x" || tags[2] != "y" {
+		t.Fatalf("%+v", tags)
+	}
+	if input.accounting.lost.Value() != 0 || input.accounting.duplicated.Value() != 0 {
+		t.Fail()
+	}
+}
@@ -0,0 +1,373 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// AdminOutputsPath is the path under which the admin API serves the outputs
+// added at runtime.
+const AdminOutputsPath = "/api/admin/outputs"
+
+// The outputs added at runtime are given the labels of this prefix and
+// the name, which the configuration cannot define.
+const AdminLabelPrefix = "admin:"
+
+var adminOutputNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// AdminOutput is an output added at runtime, to which a copy of the records
+// of the tags matching Match is sent unless paused.
+type AdminOutput struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type"`
+	Match  string            `json:"match"`
+	Params map[string]string `json:"params"`
+	Paused bool              `json:"paused"`
+}
+
+// sections returns the output of its own label and, unless paused, the copy
+// filter taken first in the default label.  The output of a paused one
+// still delivers what it has buffered.
+func (output *AdminOutput) sections() []*ConfigElement {
+	label := AdminLabelPrefix + output.Name
+	retval := make([]*ConfigElement, 0, 2)
+	if !output.Paused {
+		filter := NewConfigElement("filter", label)
+		filter.Set("type", "copy")
+		filter.Set("match", output.Match)
+		filter.Set("to-label", label)
+		retval = append(retval, filter)
+	}
+	section := NewConfigElement("output", label)
+	keys := make([]string, 0, len(output.Params))
+	for key := range output.Params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		section.Set(key, output.Params[key])
+	}
+	section.Set("type", output.Type)
+	section.Set("label", label)
+	section.Unset("match")
+	return append(retval, section)
+}
+
+func (output *AdminOutput) redacted() AdminOutput {
+	retval := *output
+	retval.Params = make(map[string]string, len(output.Params))
+	for key, value := range output.Params {
+		retval.Params[key] = redactConfigValue(key, value)
+	}
+	return retval
+}
+
+// AdminHandler serves the admin API, which adds the outputs the records
+// are copied to, pauses, resumes and removes them at runtime, to those who
+// present the token as the bearer token.  The pipeline is reloaded from
+// the sections of the configuration along with the outputs for each
+// change, which is reverted if the pipeline fails to be built.  The
+// outputs are not kept across restarts.
+type AdminHandler struct {
+	logger   *logging.Logger
+	token    string
+	pipeline *ReloadablePipeline
+	mtx      sync.Mutex
+	sections []*ConfigElement
+	outputs  []*AdminOutput
+}
+
+// apply reloads the pipeline with the outputs and takes them if it
+// succeeds.  It has to be called with the lock held.
+func (handler *AdminHandler) apply(sections []*ConfigElement, outputs []*AdminOutput) error {
+	merged := make([]*ConfigElement, 0, len(sections)+len(outputs)*2)
+	// the copies are taken before the filters of the configuration
+	for _, output := range outputs {
+		merged = append(merged, output.sections()...)
+	}
+	merged = append(merged, sections...)
+	err := handler.pipeline.Reload(merged)
+	if err != nil {
+		return err
+	}
+	handler.sections = sections
+	handler.outputs = outputs
+	return nil
+}
+
+// Reload reloads the pipeline from the sections of the configuration along
+// with the outputs added at runtime.
+func (handler *AdminHandler) Reload(sections []*ConfigElement) error {
+	handler.mtx.Lock()
+	defer handler.mtx.Unlock()
+	return handler.apply(sections, handler.outputs)
+}
+
+// Outputs returns the outputs added at runtime, with the secrets of their
+// parameters redacted.
+func (handler *AdminHandler) Outputs() []AdminOutput {
+	handler.mtx.Lock()
+	defer handler.mtx.Unlock()
+	retval := make([]AdminOutput, 0, len(handler.outputs))
+	for _, output := range handler.outputs {
+		retval = append(retval, output.redacted())
+	}
+	return retval
+}
+
+func (handler *AdminHandler) index(name string) int {
+	for i, output := range handler.outputs {
+		if output.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Put adds the output, or replaces the one of the same name.
+func (handler *AdminHandler) Put(output AdminOutput) error {
+	if !adminOutputNamePattern.MatchString(output.Name) {
+		return errors.New(fmt.Sprintf("invalid output name: %s", output.Name))
+	}
+	if output.Type == "" {
+		return errors.New("type is not specified")
+	}
+	if output.Match == "" {
+		return errors.New("match is not specified")
+	}
+	_, err := NewTagMatcher(output.Match)
+	if err != nil {
+		return err
+	}
+	for key := range output.Params {
+		switch normalizeConfigKey(key) {
+		case "type", "label", "match":
+			return errors.New(fmt.Sprintf("%s cannot be given as a parameter", key))
+		}
+	}
+	handler.mtx.Lock()
+	defer handler.mtx.Unlock()
+	outputs := make([]*AdminOutput, 0, len(handler.outputs)+1)
+	outputs = append(outputs, handler.outputs...)
+	if i := handler.index(output.Name); i >= 0 {
+		outputs[i] = &output
+	} else {
+		outputs = append(outputs, &output)
+	}
+	err = handler.apply(handler.sections, outputs)
+	if err != nil {
+		return err
+	}
+	handler.logger.Noticef("Output %s%s added by the admin API, copying %s", AdminLabelPrefix, output.Name, output.Match)
+	return nil
+}
+
+// SetPaused pauses or resumes copying the records to the output, and
+// returns false if there is no such output.
+func (handler *AdminHandler) SetPaused(name string, paused bool) (bool, error) {
+	handler.mtx.Lock()
+	defer handler.mtx.Unlock()
+	i := handler.index(name)
+	if i < 0 {
+		return false, nil
+	}
+	outputs := make([]*AdminOutput, 0, len(handler.outputs))
+	outputs = append(outputs, handler.outputs...)
+	output := *outputs[i]
+	output.Paused = paused
+	outputs[i] = &output
+	err := handler.apply(handler.sections, outputs)
+	if err != nil {
+		return true, err
+	}
+	handler.logger.Noticef("Output %s%s %s by the admin API", AdminLabelPrefix, name, map[bool]string{true: "paused", false: "resumed"}[paused])
+	return true, nil
+}
+
+// Remove removes the output, and returns false if there is no such output.
+func (handler *AdminHandler) Remove(name string) (bool, error) {
+	handler.mtx.Lock()
+	defer handler.mtx.Unlock()
+	i := handler.index(name)
+	if i < 0 {
+		return false, nil
+	}
+	outputs := make([]*AdminOutput, 0, len(handler.outputs))
+	outputs = append(outputs, handler.outputs[:i]...)
+	outputs = append(outputs, handler.outputs[i+1:]...)
+	err := handler.apply(handler.sections, outputs)
+	if err != nil {
+		return true, err
+	}
+	handler.logger.Noticef("Output %s%s removed by the admin API", AdminLabelPrefix, name)
+	return true, nil
+}
+
+// adminAuthorized tells whether the request presents the token as the
+// bearer token, which no request does if the token is empty.
+func adminAuthorized(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+func (handler *AdminHandler) authorized(r *http.Request) bool {
+	return adminAuthorized(r, handler.token)
+}
+
+// RequireAdminToken returns a handler passing the requests on to handler,
+// except that the ones by a method other than GET and HEAD, which change
+// something, have to present the token of the admin API as the bearer
+// token.  They are all refused if the token is empty.
+func RequireAdminToken(token string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" && !checkAdminToken(w, r, token) {
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// RequireAdminTokenAlways is like RequireAdminToken except that every
+// request has to present the token, for the handlers revealing what
+// only the administrators may see even by GET.
+func RequireAdminTokenAlways(token string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !checkAdminToken(w, r, token) {
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// checkAdminToken tells whether the request presents the token, and
+// responds with the error otherwise.
+func checkAdminToken(w http.ResponseWriter, r *http.Request, token string) bool {
+	if token == "" {
+		http.Error(w, "the admin token is not configured", http.StatusForbidden)
+		return false
+	}
+	if !adminAuthorized(r, token) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="fluentd-forwarder"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (handler *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="fluentd-forwarder"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, AdminOutputsPath), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "":
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"outputs": handler.Outputs()})
+	case len(parts) == 1:
+		handler.serveOutput(w, r, parts[0])
+	case len(parts) == 2 && (parts[1] == "pause" || parts[1] == "resume"):
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		found, err := handler.SetPaused(parts[0], parts[1] == "pause")
+		handler.respond(w, parts[0], found, err)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (handler *AdminHandler) serveOutput(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case "PUT", "POST":
+		output := AdminOutput{}
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&output)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		output.Name = name
+		output.Paused = false
+		err = handler.Put(output)
+		handler.respond(w, name, true, err)
+	case "DELETE":
+		found, err := handler.Remove(name)
+		if found && err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		handler.respond(w, name, found, err)
+	default:
+		w.Header().Set("Allow", "PUT, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// respond answers the output after the change, or why it failed.
+func (handler *AdminHandler) respond(w http.ResponseWriter, name string, found bool, err error) {
+	if !found {
+		http.Error(w, fmt.Sprintf("output %s is not found", name), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, output := range handler.Outputs() {
+		if output.Name == name {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(output)
+			return
+		}
+	}
+}
+
+// NewAdminHandler creates an AdminHandler of the token, which reloads the
+// pipeline built from the sections.
+func NewAdminHandler(logger *logging.Logger, token string, pipeline *ReloadablePipeline, sections []*ConfigElement) *AdminHandler {
+	return &AdminHandler{
+		logger:   logger,
+		token:    token,
+		pipeline: pipeline,
+		sections: sections,
+		outputs:  make([]*AdminOutput, 0),
+	}
+}
@@ -0,0 +1,216 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"encoding/json"
+	logging "github.com/op/go-logging"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_AdminHandler(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("admin")
+	sections, err := ReadConfig("test.conf", []byte(`
+[output "main"]
+type = test-recording
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pipeline, err := NewReloadablePipeline(logger, sections, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pipeline.Start()
+	handler := NewAdminHandler(logger, "secret", pipeline, sections)
+	request := func(method string, path string, token string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	emit := func(tag string) {
+		err := pipeline.Head().Emit([]FluentRecordSet{{Tag: tag, Records: []TinyFluentRecord{{Timestamp: 0, Data: map[string]interface{}{"a": "b"}}}}})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if w := request("GET", AdminOutputsPath, token, ""); w.Code != http.StatusUnauthorized {
+			t.Logf("%s: %d", token, w.Code)
+			t.Fail()
+		}
+	}
+
+	w := request("PUT", AdminOutputsPath+"/debug", "secret", `{"type":"test-recording","match":"app.**","params":{"password":"x"}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%d %s", w.Code, w.Body.String())
+	}
+	main := recordingOutputs["main"]
+	debug := recordingOutputs["admin:debug"]
+	if debug == nil {
+		t.Fatal("the output is not created")
+	}
+	emit("app.x")
+	emit("other")
+	if len(main.recordSets) != 2 || len(debug.recordSets) != 1 || debug.recordSets[0].Tag != "app.x" {
+		t.Logf("%+v %+v", main.recordSets, debug.recordSets)
+		t.Fail()
+	}
+
+	w = request("GET", AdminOutputsPath, "secret", "")
+	listed := struct {
+		Outputs []AdminOutput `json:"outputs"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(listed.Outputs) != 1 || listed.Outputs[0].Name != "debug" || listed.Outputs[0].Params["password"] != "xxxxx" {
+		t.Logf("%s", w.Body.String())
+		t.Fail()
+	}
+
+	// paused, nothing more is copied while the output is kept
+	if w := request("POST", AdminOutputsPath+"/debug/pause", "secret", ""); w.Code != http.StatusOK {
+		t.Fatalf("%d %s", w.Code, w.Body.String())
+	}
+	emit("app.y")
+	if recordingOutputs["admin:debug"] != debug || len(debug.recordSets) != 1 {
+		t.Fail()
+	}
+	if w := request("POST", AdminOutputsPath+"/debug/resume", "secret", ""); w.Code != http.StatusOK {
+		t.Fatalf("%d %s", w.Code, w.Body.String())
+	}
+	emit("app.z")
+	if len(debug.recordSets) != 2 {
+		t.Fail()
+	}
+
+	// the outputs survive reloading the configuration
+	err = handler.Reload(sections)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	emit("app.w")
+	if len(debug.recordSets) != 3 {
+		t.Fail()
+	}
+
+	// a failing change is reverted
+	if w := request("PUT", AdminOutputsPath+"/broken", "secret", `{"type":"nonexistent","match":"**"}`); w.Code != http.StatusBadRequest {
+		t.Logf("%d %s", w.Code, w.Body.String())
+		t.Fail()
+	}
+	for _, body := range []string{`{"type":"test-recording"}`, `{"type":"test-recording","match":"**","params":{"label":"x"}}`, `{`} {
+		if w := request("PUT", AdminOutputsPath+"/invalid", "secret", body); w.Code != http.StatusBadRequest {
+			t.Logf("%s: %d", body, w.Code)
+			t.Fail()
+		}
+	}
+	if len(handler.Outputs()) != 1 {
+		t.Fail()
+	}
+
+	if w := request("DELETE", AdminOutputsPath+"/debug", "secret", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("%d %s", w.Code, w.Body.String())
+	}
+	emit("app.v")
+	if len(debug.recordSets) != 3 || len(pipeline.Outputs()) != 1 {
+		t.Fail()
+	}
+	if w := request("DELETE", AdminOutputsPath+"/debug", "secret", ""); w.Code != http.StatusNotFound {
+		t.Fail()
+	}
+	if w := request("POST", AdminOutputsPath+"/debug/pause", "secret", ""); w.Code != http.StatusNotFound {
+		t.Fail()
+	}
+	pipeline.Stop()
+}
+
+func Test_RequireAdminToken(t *testing.T) {
+	served := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served += 1
+	})
+	for _, c := range []struct {
+		token  string
+		method string
+		auth   string
+		status int
+	}{
+		{"secret", "GET", "", http.StatusOK},
+		{"secret", "HEAD", "", http.StatusOK},
+		{"secret", "POST", "", http.StatusUnauthorized},
+		{"secret", "DELETE", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "PUT", "secret", http.StatusUnauthorized},
+		{"secret", "POST", "Bearer secret", http.StatusOK},
+		{"", "GET", "", http.StatusOK},
+		{"", "POST", "Bearer ", http.StatusForbidden},
+	} {
+		served = 0
+		r := httptest.NewRequest(c.method, "/api/flush", nil)
+		if c.auth != "" {
+			r.Header.Set("Authorization", c.auth)
+		}
+		w := httptest.NewRecorder()
+		RequireAdminToken(c.token, next).ServeHTTP(w, r)
+		if w.Code != c.status || (served == 1) != (c.status == http.StatusOK) {
+			t.Errorf("%+v: %d, served %d", c, w.Code, served)
+		}
+	}
+}
+
+func Test_RequireAdminTokenAlways(t *testing.T) {
+	served := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served += 1
+	})
+	for _, c := range []struct {
+		token  string
+		method string
+		auth   string
+		status int
+	}{
+		{"secret", "GET", "", http.StatusUnauthorized},
+		{"secret", "HEAD", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "GET", "Bearer secret", http.StatusOK},
+		{"secret", "POST", "Bearer secret", http.StatusOK},
+		{"", "GET", "", http.StatusForbidden},
+		{"", "GET", "Bearer ", http.StatusForbidden},
+	} {
+		served = 0
+		r := httptest.NewRequest(c.method, "/api/diagnostics", nil)
+		if c.auth != "" {
+			r.Header.Set("Authorization", c.auth)
+		}
+		w := httptest.NewRecorder()
+		RequireAdminTokenAlways(c.token, next).ServeHTTP(w, r)
+		if w.Code != c.status || (served == 1) != (c.status == http.StatusOK) {
+			t.Errorf("%+v: %d, served %d", c, w.Code, served)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// The events of the audit log
+const (
+	AuditAccept = "accept"
+	AuditClose  = "close"
+)
+
+// AuditEvent is an entry of the audit log of the connections to an input.
+// The forward input accepts the connections without TLS or authentication,
+// so TLSSubject is empty and Auth is "none" for it.
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	Listener   string    `json:"listener"`
+	RemoteAddr string    `json:"remote_addr"`
+	TLSSubject string    `json:"tls_subject,omitempty"`
+	Auth       string    `json:"auth"`
+	// why the connection was closed
+	Reason string `json:"reason,omitempty"`
+	// what was received through the connection until closed
+	Records int64 `json:"records,omitempty"`
+	Bytes   int64 `json:"bytes,omitempty"`
+}
+
+// AuditLog records the connections to the inputs as lines of JSON objects
+// into a writer, or as records of a tag into a port, or both.
+type AuditLog struct {
+	mtx    sync.Mutex
+	writer io.Writer
+	port   Port
+	tag    string
+}
+
+// DefaultAuditLog is the audit log of the built-in inputs; nil disables the
+// audit log.
+var DefaultAuditLog *AuditLog
+
+// Record records the event.  It does nothing to a nil AuditLog.
+func (auditLog *AuditLog) Record(event AuditEvent) error {
+	if auditLog == nil {
+		return nil
+	}
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if auditLog.writer != nil {
+		auditLog.mtx.Lock()
+		_, err = auditLog.writer.Write(append(b, '\n'))
+		auditLog.mtx.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if auditLog.port != nil {
+		data := make(map[string]interface{})
+		err = json.Unmarshal(b, &data)
+		if err != nil {
+			return err
+		}
+		return auditLog.port.Emit([]FluentRecordSet{
+			{
+				Tag:     auditLog.tag,
+				Records: []TinyFluentRecord{{Timestamp: uint64(event.Time.Unix()), Data: data}},
+			},
+		})
+	}
+	return nil
+}
+
+// NewAuditLog creates an AuditLog writing to the writer and emitting the
+// records tagged tag to the port; either may be nil.
+func NewAuditLog(writer io.Writer, port Port, tag string) *AuditLog {
+	return &AuditLog{
+		mtx:    sync.Mutex{},
+		writer: writer,
+		port:   port,
+		tag:    tag,
+	}
+}
@@ -0,0 +1,83 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"encoding/json"
+	logging "github.com/op/go-logging"
+	"github.com/ugorji/go/codec"
+	"net"
+	"strings"
+	"testing"
+)
+
+func Test_AuditLog(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("audit")
+	log := bytes.Buffer{}
+	auditPort := &recordingPort{}
+	DefaultAuditLog = NewAuditLog(&log, auditPort, "audit")
+	defer func() {
+		DefaultAuditLog = nil
+	}()
+	input, err := NewForwardInput(logger, "127.0.0.1:0", &recordingPort{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	input.Start()
+	conn, err := net.Dial("tcp", input.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	buffer := bytes.Buffer{}
+	codec.NewEncoder(&buffer, &codec.MsgpackHandle{}).Encode([]interface{}{[]byte("a"), float64(1), map[string]interface{}{"message": "hello"}})
+	_, err = conn.Write(buffer.Bytes())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	conn.Close()
+	input.Stop()
+	input.WaitForShutdown()
+
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected audit log: %s", log.String())
+	}
+	events := make([]AuditEvent, len(lines))
+	for i, line := range lines {
+		err := json.Unmarshal([]byte(line), &events[i])
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if events[i].RemoteAddr != conn.LocalAddr().String() || events[i].Auth != "none" {
+			t.Errorf("unexpected event: %s", line)
+		}
+	}
+	if events[0].Event != AuditAccept || events[1].Event != AuditClose {
+		t.Fail()
+	}
+	// the connection may also have been closed by the shutdown
+	if events[1].Reason != "closed by the client" && events[1].Reason != "shutting down" {
+		t.Errorf("unexpected reason: %s", events[1].Reason)
+	}
+	if len(auditPort.recordSets) != 2 || auditPort.recordSets[1].Tag != "audit" || auditPort.recordSets[1].Records[0].Data["event"] != AuditClose {
+		t.Fail()
+	}
+}
@@ -0,0 +1,362 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/ugorji/go/codec"
+	"math/rand"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BenchOptions tells RunBench what to send, and how fast.
+type BenchOptions struct {
+	// the host:port of the forward input
+	Address string
+	Tag     string
+	// one of the ProtocolMode constants
+	Mode string
+	// records per second over all the connections, or 0 to send as fast
+	// as the server takes them
+	Rate     int
+	Duration time.Duration
+	// records per message, but for ProtocolModeMessage
+	BatchSize int
+	// approximate size of a record in bytes
+	RecordSize  int
+	Connections int
+	// requests an ack for every message, which is waited for before
+	// sending the next one
+	Ack bool
+	// for a message to be written, and acked if requested
+	Timeout time.Duration
+}
+
+// BenchResult is what RunBench has sent.
+type BenchResult struct {
+	Records  int64
+	Messages int64
+	Bytes    int64
+	Errors   int64
+	Elapsed  time.Duration
+	// how long each message took to be written, or to be acked if acks
+	// were requested, in the ascending order
+	Latencies []time.Duration
+}
+
+// Percentile returns the latency below which the ratio p of the messages
+// have been sent.
+func (result *BenchResult) Percentile(p float64) time.Duration {
+	if len(result.Latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(result.Latencies))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(result.Latencies) {
+		i = len(result.Latencies) - 1
+	}
+	return result.Latencies[i]
+}
+
+// The values the records of the benchmark are made of, so that they look
+// like access logs.
+var (
+	benchHosts      = []string{"web-1", "web-2", "web-3", "api-1", "api-2"}
+	benchMethods    = []string{"GET", "GET", "GET", "POST", "PUT", "DELETE"}
+	benchPaths      = []string{"/", "/index.html", "/api/v1/users", "/api/v1/orders", "/static/app.js", "/login"}
+	benchStatuses   = []uint64{200, 200, 200, 200, 201, 204, 301, 304, 400, 404, 500}
+	benchUserAgents = []string{
+		"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Safari/605.1.15",
+		"curl/8.4.0",
+	}
+	benchWords = strings.Fields("the quick brown fox jumps over a lazy dog while request handled upstream cache miss retry timeout user session")
+)
+
+// newBenchRecord makes a record like an access log of about the size,
+// padding its message with words.
+func newBenchRecord(rnd *rand.Rand, size int) map[string]interface{} {
+	method := benchMethods[rnd.Intn(len(benchMethods))]
+	path := benchPaths[rnd.Intn(len(benchPaths))]
+	record := map[string]interface{}{
+		"host":       benchHosts[rnd.Intn(len(benchHosts))],
+		"remote":     fmt.Sprintf("10.%d.%d.%d", rnd.Intn(256), rnd.Intn(256), rnd.Intn(256)),
+		"method":     method,
+		"path":       path,
+		"code":       benchStatuses[rnd.Intn(len(benchStatuses))],
+		"size":       uint64(rnd.Intn(65536)),
+		"agent":      benchUserAgents[rnd.Intn(len(benchUserAgents))],
+		"request_id": fmt.Sprintf("%016x", rnd.Int63()),
+	}
+	message := bytes.Buffer{}
+	message.WriteString(method + " " + path)
+	// the fields above take about 200 bytes in msgpack
+	for message.Len() < size-200 {
+		message.WriteByte(' ')
+		message.WriteString(benchWords[rnd.Intn(len(benchWords))])
+	}
+	record["message"] = message.String()
+	return record
+}
+
+// benchConnection sends the messages over a connection.
+type benchConnection struct {
+	options BenchOptions
+	codec   *codec.MsgpackHandle
+	rnd     *rand.Rand
+	conn    net.Conn
+	dec     *codec.Decoder
+	result  BenchResult
+}
+
+// message encodes a message of the records in the mode, with the chunk id
+// requesting the ack unless empty.
+func (c *benchConnection) message(records []TinyFluentRecord, chunk string) ([]byte, error) {
+	buf := bytes.Buffer{}
+	enc := codec.NewEncoder(&buf, c.codec)
+	option := map[string]interface{}{}
+	if chunk != "" {
+		option["chunk"] = chunk
+	}
+	v := []interface{}(nil)
+	switch c.options.Mode {
+	case ProtocolModeMessage:
+		v = []interface{}{c.options.Tag, records[0].Timestamp, records[0].Data}
+	case ProtocolModeForward:
+		v = []interface{}{c.options.Tag, records}
+	case ProtocolModePackedForward, ProtocolModeCompressedPackedForward:
+		entries := bytes.Buffer{}
+		entriesEnc := codec.NewEncoder(&entries, c.codec)
+		for _, record := range records {
+			err := entriesEnc.Encode(record)
+			if err != nil {
+				return nil, err
+			}
+		}
+		option["size"] = uint64(len(records))
+		packed := entries.Bytes()
+		if c.options.Mode == ProtocolModeCompressedPackedForward {
+			compressed := bytes.Buffer{}
+			writer := gzip.NewWriter(&compressed)
+			writer.Write(packed)
+			err := writer.Close()
+			if err != nil {
+				return nil, err
+			}
+			packed = compressed.Bytes()
+			option["compressed"] = "gzip"
+		}
+		v = []interface{}{c.options.Tag, packed}
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown mode: %s", c.options.Mode))
+	}
+	if len(option) > 0 {
+		v = append(v, option)
+	}
+	err := enc.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *benchConnection) connect() error {
+	if c.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", c.options.Address, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.dec = codec.NewDecoder(conn, c.codec)
+	return nil
+}
+
+func (c *benchConnection) disconnect() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// send sends a message of the records, and waits for the ack if requested.
+func (c *benchConnection) send(records []TinyFluentRecord) error {
+	chunk := ""
+	if c.options.Ack {
+		id := make([]byte, 16)
+		c.rnd.Read(id)
+		chunk = base64.StdEncoding.EncodeToString(id)
+	}
+	buf, err := c.message(records, chunk)
+	if err != nil {
+		return err
+	}
+	err = c.connect()
+	if err != nil {
+		return err
+	}
+	startTime := time.Now()
+	c.conn.SetWriteDeadline(startTime.Add(c.options.Timeout))
+	_, err = c.conn.Write(buf)
+	if err != nil {
+		c.disconnect()
+		return err
+	}
+	if chunk != "" {
+		c.conn.SetReadDeadline(time.Now().Add(c.options.Timeout))
+		response := map[string]interface{}{}
+		err = c.dec.Decode(&response)
+		if err != nil {
+			c.disconnect()
+			return errors.New(fmt.Sprintf("no ack for the chunk %s: %s", chunk, err.Error()))
+		}
+		ack := ""
+		switch v := response["ack"].(type) {
+		case []byte:
+			ack = string(v)
+		case string:
+			ack = v
+		}
+		if ack != chunk {
+			c.disconnect()
+			return errors.New(fmt.Sprintf("the ack %q does not match the chunk %s", ack, chunk))
+		}
+	}
+	c.result.Latencies = append(c.result.Latencies, time.Now().Sub(startTime))
+	c.result.Records += int64(len(records))
+	c.result.Messages += 1
+	c.result.Bytes += int64(len(buf))
+	return nil
+}
+
+// run sends the messages until the deadline, at the rate of records per
+// second unless it is 0.  The records are made beforehand, so that making
+// them does not count in the rate.
+func (c *benchConnection) run(startTime time.Time, deadline time.Time, rate float64) {
+	batchSize := c.options.BatchSize
+	if c.options.Mode == ProtocolModeMessage {
+		batchSize = 1
+	}
+	pool := make([]map[string]interface{}, 1024)
+	for i := range pool {
+		pool[i] = newBenchRecord(c.rnd, c.options.RecordSize)
+	}
+	records := make([]TinyFluentRecord, batchSize)
+	sent := 0
+	for {
+		now := time.Now()
+		if !now.Before(deadline) {
+			break
+		}
+		if rate > 0 {
+			next := startTime.Add(time.Duration(float64(sent) / rate * float64(time.Second)))
+			if next.After(deadline) {
+				break
+			}
+			if next.After(now) {
+				time.Sleep(next.Sub(now))
+			}
+		}
+		timestamp := uint64(time.Now().Unix())
+		for i := range records {
+			records[i] = TinyFluentRecord{Timestamp: timestamp, Data: pool[c.rnd.Intn(len(pool))]}
+		}
+		err := c.send(records)
+		if err != nil {
+			c.result.Errors += 1
+			// not to spin on a server refusing the connections
+			time.Sleep(100 * time.Millisecond)
+		}
+		sent += batchSize
+	}
+	c.disconnect()
+}
+
+// RunBench sends the records generated as the options tell to a forward
+// input, and returns what it has sent.  It fails if any of the connections
+// cannot be made at first; the errors occurring afterwards are counted in
+// the result, and the connections are made again.
+func RunBench(options BenchOptions) (*BenchResult, error) {
+	switch options.Mode {
+	case ProtocolModeMessage, ProtocolModeForward, ProtocolModePackedForward, ProtocolModeCompressedPackedForward:
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown mode: %s", options.Mode))
+	}
+	if options.Connections < 1 {
+		options.Connections = 1
+	}
+	if options.BatchSize < 1 {
+		options.BatchSize = 1
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = 10 * time.Second
+	}
+	_codec := codec.MsgpackHandle{}
+	_codec.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	_codec.RawToString = false
+	_codec.StructToArray = true
+	conns := make([]*benchConnection, options.Connections)
+	for i := range conns {
+		conns[i] = &benchConnection{
+			options: options,
+			codec:   &_codec,
+			rnd:     rand.New(rand.NewSource(time.Now().UnixNano() + int64(i))),
+		}
+		err := conns[i].connect()
+		if err != nil {
+			for _, c := range conns[:i] {
+				c.disconnect()
+			}
+			return nil, err
+		}
+	}
+	rate := float64(options.Rate) / float64(options.Connections)
+	startTime := time.Now()
+	deadline := startTime.Add(options.Duration)
+	wg := sync.WaitGroup{}
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *benchConnection) {
+			defer wg.Done()
+			c.run(startTime, deadline, rate)
+		}(c)
+	}
+	wg.Wait()
+	retval := &BenchResult{Elapsed: time.Now().Sub(startTime)}
+	for _, c := range conns {
+		retval.Records += c.result.Records
+		retval.Messages += c.result.Messages
+		retval.Bytes += c.result.Bytes
+		retval.Errors += c.result.Errors
+		retval.Latencies = append(retval.Latencies, c.result.Latencies...)
+	}
+	sort.Slice(retval.Latencies, func(i, j int) bool { return retval.Latencies[i] < retval.Latencies[j] })
+	return retval, nil
+}
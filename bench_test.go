@@ -0,0 +1,209 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"github.com/ugorji/go/codec"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_RunBench(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("input")
+	for _, mode := range []string{ProtocolModeMessage, ProtocolModeForward, ProtocolModePackedForward} {
+		port := &syncRecordingPort{}
+		input, err := NewForwardInput(logger, "127.0.0.1:0", port)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		input.Start()
+		result, err := RunBench(BenchOptions{
+			Address:     input.listener.Addr().String(),
+			Tag:         "bench",
+			Mode:        mode,
+			Rate:        1000,
+			Duration:    200 * time.Millisecond,
+			BatchSize:   10,
+			RecordSize:  512,
+			Connections: 2,
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if result.Errors != 0 || result.Records == 0 || int64(len(result.Latencies)) != result.Messages {
+			t.Errorf("%s: %+v", mode, result)
+		}
+		// 1000 records per second for 0.2 seconds
+		if result.Records > 220 {
+			t.Errorf("%s: %d records sent", mode, result.Records)
+		}
+		records := 0
+		for deadline := time.Now().Add(5 * time.Second); int64(records) < result.Records; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: %d records of %d arrived", mode, records, result.Records)
+			}
+			port.mtx.Lock()
+			records = recordCount(port.recordSets)
+			port.mtx.Unlock()
+		}
+		recordSet := port.recordSets[0]
+		size := bytes.Buffer{}
+		codec.NewEncoder(&size, &codec.MsgpackHandle{}).Encode(recordSet.Records[0].Data)
+		if recordSet.Tag != "bench" || recordSet.Records[0].Data["method"] == nil || size.Len() < 400 || size.Len() > 600 {
+			t.Errorf("%s: %+v (%d bytes)", mode, recordSet, size.Len())
+		}
+		input.Stop()
+		input.WaitForShutdown()
+	}
+}
+
+func Test_RunBench_Ack(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer listener.Close()
+	received := make(chan int, 1000)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		handle := &codec.MsgpackHandle{}
+		handle.MapType = reflect.TypeOf(map[string]interface{}(nil))
+		dec := codec.NewDecoder(conn, handle)
+		enc := codec.NewEncoder(conn, handle)
+		for {
+			v := []interface{}{}
+			if dec.Decode(&v) != nil {
+				return
+			}
+			option := v[2].(map[string]interface{})
+			reader, err := gzip.NewReader(bytes.NewReader(v[1].([]byte)))
+			if err != nil {
+				t.Error(err.Error())
+				return
+			}
+			entries, _ := ioutil.ReadAll(reader)
+			entryReader := bytes.NewReader(entries)
+			entryDec := codec.NewDecoder(entryReader, handle)
+			n := 0
+			for ; entryReader.Len() > 0; n++ {
+				entry := []interface{}{}
+				if entryDec.Decode(&entry) != nil {
+					break
+				}
+			}
+			if string(option["compressed"].([]byte)) != "gzip" || fmt.Sprint(option["size"]) != fmt.Sprint(n) {
+				t.Errorf("%+v with %d entries", option, n)
+			}
+			received <- n
+			enc.Encode(map[string]interface{}{"ack": string(option["chunk"].([]byte))})
+		}
+	}()
+	result, err := RunBench(BenchOptions{
+		Address:    listener.Addr().String(),
+		Tag:        "bench",
+		Mode:       ProtocolModeCompressedPackedForward,
+		Duration:   100 * time.Millisecond,
+		BatchSize:  5,
+		RecordSize: 256,
+		Ack:        true,
+		Timeout:    time.Second,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if result.Errors != 0 || result.Messages == 0 || result.Records != result.Messages*5 || int64(len(received)) != result.Messages {
+		t.Errorf("%+v with %d messages received", result, len(received))
+	}
+}
+
+func Test_RunBench_AckTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// never acks
+			go ioutil.ReadAll(conn)
+		}
+	}()
+	result, err := RunBench(BenchOptions{
+		Address:  listener.Addr().String(),
+		Tag:      "bench",
+		Mode:     ProtocolModeForward,
+		Duration: 300 * time.Millisecond,
+		Ack:      true,
+		Timeout:  50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if result.Errors == 0 || result.Messages != 0 {
+		t.Errorf("%+v", result)
+	}
+}
+
+func Test_RunBench_Refused(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	_, err = RunBench(BenchOptions{Address: addr, Mode: ProtocolModeForward, Duration: time.Second})
+	if err == nil {
+		t.Error("no error")
+	}
+	_, err = RunBench(BenchOptions{Address: addr, Mode: "json", Duration: time.Second})
+	if err == nil || err.Error() != "unknown mode: json" {
+		t.Errorf("%v", err)
+	}
+}
+
+func Test_BenchResult_Percentile(t *testing.T) {
+	result := &BenchResult{}
+	if result.Percentile(0.5) != 0 {
+		t.Error(result.Percentile(0.5))
+	}
+	for i := 1; i <= 100; i++ {
+		result.Latencies = append(result.Latencies, time.Duration(i)*time.Millisecond)
+	}
+	for p, expected := range map[float64]time.Duration{0: time.Millisecond, 0.5: 50 * time.Millisecond, 0.99: 99 * time.Millisecond, 1: 100 * time.Millisecond} {
+		if result.Percentile(p) != expected {
+			t.Errorf("%g: %s", p, result.Percentile(p))
+		}
+	}
+}
@@ -0,0 +1,198 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/ugorji/go/codec"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// QuarantineSuffix is appended to the path of a chunk file to name the file
+// the corrupt part of the chunk is moved to.
+const QuarantineSuffix = ".corrupt"
+
+var (
+	bufferRecoveredChunks   = mustGaugeVec(DefaultMetrics.NewGaugeVec("fluentd_forwarder_buffer_recovered_chunks", "Number of the chunks recovered from the buffer when it was opened.", "buffer"))
+	bufferRecoveredBytes    = mustGaugeVec(DefaultMetrics.NewGaugeVec("fluentd_forwarder_buffer_recovered_bytes", "Size of the chunks recovered from the buffer when it was opened.", "buffer"))
+	bufferQuarantinedBytes  = mustGaugeVec(DefaultMetrics.NewGaugeVec("fluentd_forwarder_buffer_quarantined_bytes", "Size of the corrupt parts of the chunks moved out of the buffer when it was opened.", "buffer"))
+	bufferRecoveryDurations = mustGaugeVec(DefaultMetrics.NewGaugeVec("fluentd_forwarder_buffer_recovery_seconds", "Time spent recovering the chunks of the buffer when it was opened.", "buffer"))
+)
+
+// BufferRecovery reports what was left in a buffer when it was opened,
+// which is on startup unless the output has been added since.
+type BufferRecovery struct {
+	Path string `json:"path"`
+	// the chunks found and their size without the corrupt parts
+	Chunks int   `json:"chunks"`
+	Bytes  int64 `json:"bytes"`
+	// the chunks that don't decode to the end, such as the one being
+	// written when the process crashed, and the size of the parts from
+	// where they stop decoding, which are moved to the quarantine files
+	CorruptChunks    int       `json:"corrupt_chunks"`
+	QuarantinedBytes int64     `json:"quarantined_bytes"`
+	QuarantineFiles  []string  `json:"quarantine_files"`
+	RecoveredAt      time.Time `json:"recovered_at"`
+	Duration         float64   `json:"duration_seconds"`
+}
+
+// validChunkLength returns the length of the longest part from the start of
+// the data that decodes to whole msgpack values.
+func validChunkLength(data []byte) int64 {
+	handle := &codec.MsgpackHandle{}
+	handle.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	handle.RawToString = false
+	reader := bytes.NewReader(data)
+	dec := codec.NewDecoder(reader, handle)
+	valid := int64(0)
+	for reader.Len() > 0 { // codec.Decoder doesn't return EOF.
+		v := interface{}(nil)
+		err := dec.Decode(&v)
+		if err != nil {
+			break
+		}
+		valid = int64(len(data) - reader.Len())
+	}
+	return valid
+}
+
+// recoverChunk cuts off the part of the chunk from where it stops decoding
+// and appends it to the quarantine file of the chunk.  It returns the size
+// of the part, or 0 if the chunk is intact.
+func recoverChunk(chunk *FileJournalChunk, fileMode os.FileMode) (int64, error) {
+	data, err := ioutil.ReadFile(chunk.Path)
+	if err != nil {
+		return 0, err
+	}
+	valid := validChunkLength(data)
+	if valid == int64(len(data)) {
+		chunk.Size = valid
+		return 0, nil
+	}
+	file, err := os.OpenFile(chunk.Path+QuarantineSuffix, os.O_WRONLY|os.O_CREATE|os.O_APPEND, fileMode)
+	if err != nil {
+		return 0, err
+	}
+	_, err = file.Write(data[valid:])
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	err = os.Truncate(chunk.Path, valid)
+	if err != nil {
+		return 0, err
+	}
+	chunk.Size = valid
+	return int64(len(data)) - valid, nil
+}
+
+// recoverJournals checks the chunks of the journals found in the buffer,
+// moving their corrupt parts to the quarantine files.
+func recoverJournals(path string, journals map[string]*FileJournal, fileMode os.FileMode) (BufferRecovery, error) {
+	startedAt := time.Now()
+	report := BufferRecovery{
+		Path:            path,
+		QuarantineFiles: make([]string, 0),
+		RecoveredAt:     startedAt,
+	}
+	for _, journal := range journals {
+		for chunk := journal.chunks.first; chunk != nil; chunk = chunk.head.next {
+			quarantined, err := recoverChunk(chunk, fileMode)
+			if err != nil {
+				return report, err
+			}
+			report.Chunks += 1
+			report.Bytes += chunk.Size
+			if quarantined > 0 {
+				report.CorruptChunks += 1
+				report.QuarantinedBytes += quarantined
+				report.QuarantineFiles = append(report.QuarantineFiles, chunk.Path+QuarantineSuffix)
+			}
+		}
+	}
+	sort.Strings(report.QuarantineFiles)
+	report.Duration = time.Since(startedAt).Seconds()
+	return report, nil
+}
+
+// BufferRecoveries keeps the recovery report of each buffer opened by the
+// process, and serves them as JSON on GET.
+type BufferRecoveries struct {
+	mtx     sync.Mutex
+	reports map[string]BufferRecovery
+}
+
+// DefaultBufferRecoveries keeps the reports of the buffers of the outputs.
+var DefaultBufferRecoveries = NewBufferRecoveries()
+
+// add keeps the report unless the buffer has been opened before, as the
+// first one is of the chunks left by the previous process.
+func (recoveries *BufferRecoveries) add(report BufferRecovery) {
+	recoveries.mtx.Lock()
+	defer recoveries.mtx.Unlock()
+	if _, ok := recoveries.reports[report.Path]; ok {
+		return
+	}
+	recoveries.reports[report.Path] = report
+	bufferRecoveredChunks.With(report.Path).Set(float64(report.Chunks))
+	bufferRecoveredBytes.With(report.Path).Set(float64(report.Bytes))
+	bufferQuarantinedBytes.With(report.Path).Set(float64(report.QuarantinedBytes))
+	bufferRecoveryDurations.With(report.Path).Set(report.Duration)
+}
+
+// Reports returns the reports by the paths of the buffers.
+func (recoveries *BufferRecoveries) Reports() []BufferRecovery {
+	recoveries.mtx.Lock()
+	defer recoveries.mtx.Unlock()
+	retval := make([]BufferRecovery, 0, len(recoveries.reports))
+	for _, report := range recoveries.reports {
+		retval = append(retval, report)
+	}
+	sort.Slice(retval, func(i, j int) bool { return retval[i].Path < retval[j].Path })
+	return retval
+}
+
+func (recoveries *BufferRecoveries) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"buffers": recoveries.Reports()})
+}
+
+func NewBufferRecoveries() *BufferRecoveries {
+	return &BufferRecoveries{
+		mtx:     sync.Mutex{},
+		reports: make(map[string]BufferRecovery),
+	}
+}
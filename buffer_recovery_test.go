@@ -0,0 +1,149 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"encoding/json"
+	logging "github.com/op/go-logging"
+	"github.com/ugorji/go/codec"
+	"io/ioutil"
+	"math/rand"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_validChunkLength(t *testing.T) {
+	buf := bytes.Buffer{}
+	encoder := codec.NewEncoder(&buf, &codec.MsgpackHandle{})
+	for _, v := range []interface{}{[]interface{}{"test.a", 1}, map[string]interface{}{"b": "c"}} {
+		if err := encoder.Encode(v); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	valid := buf.Len()
+	if validChunkLength(buf.Bytes()) != int64(valid) {
+		t.Fail()
+	}
+	// a string of 3 bytes cut off in the middle
+	buf.Write([]byte{0x92, 0xa3, 'd'})
+	if validChunkLength(buf.Bytes()) != int64(valid) {
+		t.Fail()
+	}
+	if validChunkLength([]byte{0xc1}) != 0 {
+		t.Fail()
+	}
+}
+
+func Test_FileJournalGroup_Recovery(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("journal")
+	tempDir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	newFactory := func() *FileJournalGroupFactory {
+		return NewFileJournalGroupFactory(
+			logger,
+			rand.NewSource(0),
+			func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) },
+			".log",
+			os.FileMode(0644),
+			1024,
+		)
+	}
+	path := filepath.Join(tempDir, "test")
+	journalGroup, err := newFactory().GetJournalGroup(path, &DummyWorker{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if recovery := journalGroup.Recovery(); recovery.Chunks != 0 || recovery.Bytes != 0 {
+		t.Fail()
+	}
+	journal := journalGroup.GetFileJournal("key")
+	err = journal.Write([]byte{0x92, 0xa1, 'a', 0x01})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// the write cut off by a crash
+	err = journal.Write([]byte{0x92, 0xa3, 'b'})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	chunkPath := journal.chunks.first.Path
+	journalGroup.Dispose()
+
+	journalGroup, err = newFactory().GetJournalGroup(path, &DummyWorker{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer journalGroup.Dispose()
+	recovery := journalGroup.Recovery()
+	if recovery.Chunks != 1 || recovery.Bytes != 4 || recovery.CorruptChunks != 1 || recovery.QuarantinedBytes != 3 {
+		t.Fatalf("unexpected report: %+v", recovery)
+	}
+	if len(recovery.QuarantineFiles) != 1 || recovery.QuarantineFiles[0] != chunkPath+QuarantineSuffix {
+		t.Fail()
+	}
+	quarantined, err := ioutil.ReadFile(chunkPath + QuarantineSuffix)
+	if err != nil || !bytes.Equal(quarantined, []byte{0x92, 0xa3, 'b'}) {
+		t.Fail()
+	}
+	// the records are appended after the intact part
+	err = journalGroup.GetFileJournal("key").Write([]byte{0x01})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := ioutil.ReadFile(chunkPath)
+	if err != nil || !bytes.Equal(data, []byte{0x92, 0xa1, 'a', 0x01, 0x01}) {
+		t.Fail()
+	}
+	if validChunkLength(data) != int64(len(data)) {
+		t.Fail()
+	}
+}
+
+func Test_BufferRecoveries(t *testing.T) {
+	recoveries := NewBufferRecoveries()
+	recoveries.add(BufferRecovery{Path: "b", Chunks: 2})
+	recoveries.add(BufferRecovery{Path: "a", Chunks: 1})
+	// the buffer opened again by reloading
+	recoveries.add(BufferRecovery{Path: "b", Chunks: 0})
+	server := httptest.NewServer(recoveries)
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	body := struct {
+		Buffers []BufferRecovery `json:"buffers"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(body.Buffers) != 2 || body.Buffers[0].Path != "a" || body.Buffers[1].Path != "b" || body.Buffers[1].Chunks != 2 {
+		t.Fail()
+	}
+}
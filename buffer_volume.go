@@ -0,0 +1,134 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Mount is a filesystem mounted in the mount namespace of the process.
+type Mount struct {
+	Point  string
+	FSType string
+	Source string
+}
+
+// unescapeMountField decodes the octal escapes of the spaces and the like
+// in a field of mountinfo.
+func unescapeMountField(field string) string {
+	if !strings.Contains(field, "\\") {
+		return field
+	}
+	buf := make([]byte, 0, len(field))
+	for i := 0; i < len(field); i += 1 {
+		if field[i] == '\\' && i+4 <= len(field) {
+			if c, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				buf = append(buf, byte(c))
+				i += 3
+				continue
+			}
+		}
+		buf = append(buf, field[i])
+	}
+	return string(buf)
+}
+
+// parseMountInfo parses the contents of /proc/PID/mountinfo.
+func parseMountInfo(src string) ([]Mount, error) {
+	mounts := make([]Mount, 0)
+	for _, line := range strings.Split(src, "\n") {
+		if line == "" {
+			continue
+		}
+		// the optional fields end with a single hyphen
+		i := strings.Index(line, " - ")
+		if i < 0 {
+			return nil, errors.New("malformed mountinfo: " + line)
+		}
+		fields, rest := strings.Fields(line[:i]), strings.Fields(line[i+3:])
+		if len(fields) < 5 || len(rest) < 2 {
+			return nil, errors.New("malformed mountinfo: " + line)
+		}
+		mounts = append(mounts, Mount{
+			Point:  unescapeMountField(fields[4]),
+			FSType: rest[0],
+			Source: unescapeMountField(rest[1]),
+		})
+	}
+	return mounts, nil
+}
+
+// ReadMounts reads the filesystems mounted from /proc/self/mountinfo, which
+// only Linux has.
+func ReadMounts() ([]Mount, error) {
+	b, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	return parseMountInfo(string(b))
+}
+
+// mountOf returns the mount the path is on, which is the last one mounted
+// on the longest of its ancestors.
+func mountOf(mounts []Mount, path string) (Mount, bool) {
+	retval, found := Mount{}, false
+	for _, mount := range mounts {
+		point := mount.Point
+		if point != "/" && path != point && !strings.HasPrefix(path, point+"/") {
+			continue
+		}
+		if !found || len(point) >= len(retval.Point) {
+			retval, found = mount, true
+		}
+	}
+	return retval, found
+}
+
+// CheckBufferVolumes checks that the directories of the buffers are on the
+// volumes of the pod rather than the writable layer of the container, which
+// is discarded when the container is restarted.  The buffers on tmpfs, as
+// of an emptyDir of the medium Memory, are warned about, as they take the
+// memory of the container.
+func CheckBufferVolumes(mounts []Mount, dirs []string) *ConfigCheck {
+	check := &ConfigCheck{Errors: make([]string, 0), Warnings: make([]string, 0)}
+	for _, dir := range dirs {
+		path, err := filepath.Abs(nearestDirectory(dir))
+		if err != nil {
+			continue
+		}
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			path = resolved
+		}
+		mount, ok := mountOf(mounts, path)
+		if !ok {
+			continue
+		}
+		switch mount.FSType {
+		case "overlay", "aufs":
+			check.errorf(nil, "%s is on the writable layer of the container, where the buffers are lost when the container is restarted; mount an emptyDir or a PersistentVolumeClaim on it", dir)
+		case "tmpfs":
+			check.warnf(nil, "%s is on tmpfs, as an emptyDir of the medium Memory is, where the buffers take the memory of the container", dir)
+		}
+	}
+	return check
+}
@@ -0,0 +1,55 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"testing"
+)
+
+func Test_CheckBufferVolumes(t *testing.T) {
+	mounts, err := parseMountInfo(`1100 1000 0:120 / / rw,relatime master:500 - overlay overlay rw,lowerdir=/var/lib/containerd/l1,upperdir=/var/lib/containerd/u1
+1101 1100 0:121 / /proc rw,nosuid - proc proc rw
+1102 1100 8:1 /var/lib/kubelet/pods/x/volumes/kubernetes.io~empty-dir/buffer /var/lib/fluentd-forwarder rw,relatime - ext4 /dev/sda1 rw
+1103 1100 0:122 / /var/lib/fluentd-forwarder/memory rw - tmpfs tmpfs rw
+1104 1100 8:1 /data /mnt/with\040space rw - xfs /dev/sdb1 rw
+`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(mounts) != 5 || mounts[4].Point != "/mnt/with space" || mounts[2].FSType != "ext4" {
+		t.Fatalf("%+v", mounts)
+	}
+	for path, expected := range map[string]string{
+		"/var/lib/fluentd-forwarder/forward":    "ext4",
+		"/var/lib/fluentd-forwarder/memory/td":  "tmpfs",
+		"/var/lib/fluentd-forwarder-other/data": "overlay",
+		"/mnt/with space/buffer":                "xfs",
+	} {
+		if mount, ok := mountOf(mounts, path); !ok || mount.FSType != expected {
+			t.Errorf("%s: %+v", path, mount)
+		}
+	}
+	check := CheckBufferVolumes(mounts, []string{"/nonexistent/buffer"})
+	if len(check.Errors) != 1 || len(check.Warnings) != 0 {
+		t.Errorf("%+v", check)
+	}
+	if _, err := parseMountInfo("1 2 3:4 / /"); err == nil {
+		t.Fail()
+	}
+}
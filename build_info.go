@@ -0,0 +1,359 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProtocolFeatures are the parts of the forward protocol the forwarder
+// speaks.
+type ProtocolFeatures struct {
+	Modes      []string `json:"modes"`
+	Encodings  []string `json:"encodings"`
+	Extensions []string `json:"extensions"`
+}
+
+// SupportedProtocolFeatures are the modes the forward input accepts, the
+// encodings it decodes and the extensions beyond the protocol.
+var SupportedProtocolFeatures = ProtocolFeatures{
+	Modes:      []string{"message", "forward", "packed_forward"},
+	Encodings:  []string{ForwardProtocolMsgpack, ForwardProtocolJSON},
+	Extensions: []string{"delivery_accounting"},
+}
+
+// ReleaseCheck is the result of the last check against the release
+// metadata.
+type ReleaseCheck struct {
+	URL             string `json:"url"`
+	LatestVersion   string `json:"latest_version"`
+	UpdateAvailable bool   `json:"update_available"`
+	CheckedAt       string `json:"checked_at"`
+	Error           string `json:"error,omitempty"`
+}
+
+// BuildInfo describes the executable: the version and the commit it was
+// built from, the plugins compiled in and the protocol features.
+type BuildInfo struct {
+	Version     string              `json:"version"`
+	Revision    string              `json:"revision"`
+	Modified    bool                `json:"modified"`
+	CommittedAt string              `json:"committed_at"`
+	BuiltAt     string              `json:"built_at"`
+	GoVersion   string              `json:"go_version"`
+	Platform    string              `json:"platform"`
+	Plugins     map[string][]string `json:"plugins"`
+	Protocol    ProtocolFeatures    `json:"protocol"`
+	// nil unless the release metadata is checked
+	Release *ReleaseCheck `json:"release,omitempty"`
+}
+
+// NewBuildInfo creates the BuildInfo of the running executable.  version,
+// revision and builtAt are the ones given on linking, if any; the version
+// and the revision the go command records take their place otherwise.
+func NewBuildInfo(version string, revision string, builtAt string) BuildInfo {
+	info := BuildInfo{
+		Version:   version,
+		Revision:  revision,
+		BuiltAt:   builtAt,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Plugins:   RegisteredPlugins(),
+		Protocol:  SupportedProtocolFeatures,
+	}
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && buildInfo.Main.Version != "" && buildInfo.Main.Version != "(devel)" {
+			info.Version = buildInfo.Main.Version
+		}
+		vcsRevision := ""
+		for _, setting := range buildInfo.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				vcsRevision = setting.Value
+			case "vcs.time":
+				info.CommittedAt = setting.Value
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+		if info.Revision == "" {
+			info.Revision = vcsRevision
+		}
+	}
+	if info.Version == "" {
+		info.Version = "unknown"
+	}
+	return info
+}
+
+// parseVersion splits a version like v1.2.3-rc.1 into the numbers of the
+// release and the pre-release suffix.
+func parseVersion(version string) ([]int, string, bool) {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if i := strings.IndexByte(version, '+'); i >= 0 {
+		version = version[:i]
+	}
+	preRelease := ""
+	if i := strings.IndexByte(version, '-'); i >= 0 {
+		version, preRelease = version[:i], version[i+1:]
+	}
+	numbers := make([]int, 0, 3)
+	for _, part := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, "", false
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers, preRelease, true
+}
+
+// CompareVersions compares two versions in the form of semantic
+// versioning, optionally prefixed with "v", returning -1, 0 or 1 as a is
+// older than, the same as or newer than b.  A pre-release is older than
+// the release itself.
+func CompareVersions(a string, b string) (int, error) {
+	aNumbers, aPreRelease, ok := parseVersion(a)
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("invalid version: %s", a))
+	}
+	bNumbers, bPreRelease, ok := parseVersion(b)
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("invalid version: %s", b))
+	}
+	for i := 0; i < len(aNumbers) || i < len(bNumbers); i++ {
+		aNumber, bNumber := 0, 0
+		if i < len(aNumbers) {
+			aNumber = aNumbers[i]
+		}
+		if i < len(bNumbers) {
+			bNumber = bNumbers[i]
+		}
+		if aNumber < bNumber {
+			return -1, nil
+		} else if aNumber > bNumber {
+			return 1, nil
+		}
+	}
+	switch {
+	case aPreRelease == bPreRelease:
+		return 0, nil
+	case aPreRelease == "":
+		return 1, nil
+	case bPreRelease == "":
+		return -1, nil
+	case aPreRelease < bPreRelease:
+		return -1, nil
+	}
+	return 1, nil
+}
+
+// FetchLatestRelease fetches the release metadata at url, a JSON object
+// holding the version of the latest release in "version", or in
+// "tag_name" as the releases API of GitHub does.
+func FetchLatestRelease(client *http.Client, url string) (string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		ioutil.ReadAll(resp.Body)
+		return "", errors.New(fmt.Sprintf("%s responded with %s", url, resp.Status))
+	}
+	metadata := struct {
+		Version string `json:"version"`
+		TagName string `json:"tag_name"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&metadata)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("%s: %s", url, err.Error()))
+	}
+	if metadata.Version != "" {
+		return metadata.Version, nil
+	}
+	if metadata.TagName != "" {
+		return metadata.TagName, nil
+	}
+	return "", errors.New(fmt.Sprintf("%s: no version in the release metadata", url))
+}
+
+var (
+	buildInfoGauge = mustGaugeVec(DefaultMetrics.NewGaugeVec(
+		"fluentd_forwarder_build_info",
+		"Always 1, labeled by the version, the revision and the Go version of the executable",
+		"version", "revision", "go_version",
+	))
+	updateAvailable = mustGaugeVec(DefaultMetrics.NewGaugeVec(
+		"fluentd_forwarder_update_available",
+		"1 if the release metadata names a version newer than the running one",
+	))
+)
+
+// VersionReporter serves the BuildInfo as JSON and, given the URL of the
+// release metadata, checks in every interval whether a newer version has
+// been released, logging it when one has.
+type VersionReporter struct {
+	logger         *logging.Logger
+	info           BuildInfo
+	url            string
+	interval       time.Duration
+	client         *http.Client
+	mtx            sync.Mutex
+	release        *ReleaseCheck
+	wg             sync.WaitGroup
+	shutdownChan   chan struct{}
+	isShuttingDown uintptr
+}
+
+// Info returns the BuildInfo with the result of the last release check.
+func (reporter *VersionReporter) Info() BuildInfo {
+	info := reporter.info
+	reporter.mtx.Lock()
+	if reporter.release != nil {
+		release := *reporter.release
+		info.Release = &release
+	}
+	reporter.mtx.Unlock()
+	return info
+}
+
+// Check fetches the release metadata and compares the latest version with
+// the running one.
+func (reporter *VersionReporter) Check() ReleaseCheck {
+	check := ReleaseCheck{
+		URL:       reporter.url,
+		CheckedAt: time.Now().Format(time.RFC3339),
+	}
+	latest, err := FetchLatestRelease(reporter.client, reporter.url)
+	if err == nil {
+		check.LatestVersion = latest
+		result := 0
+		result, err = CompareVersions(reporter.info.Version, latest)
+		check.UpdateAvailable = err == nil && result < 0
+	}
+	if err != nil {
+		check.Error = err.Error()
+	}
+	return check
+}
+
+func (reporter *VersionReporter) check() {
+	check := reporter.Check()
+	reporter.mtx.Lock()
+	previous := reporter.release
+	reporter.release = &check
+	reporter.mtx.Unlock()
+	if check.Error != "" {
+		reporter.logger.Warningf("%s: failed to check the latest release: %s", LogComponent(reporter.String()), check.Error)
+		return
+	}
+	if check.UpdateAvailable {
+		updateAvailable.With().Set(1)
+		if previous == nil || previous.LatestVersion != check.LatestVersion {
+			reporter.logger.Noticef("%s: version %s has been released; running %s", LogComponent(reporter.String()), check.LatestVersion, reporter.info.Version)
+		}
+	} else {
+		updateAvailable.With().Set(0)
+	}
+}
+
+func (reporter *VersionReporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reporter.Info())
+}
+
+func (reporter *VersionReporter) String() string {
+	return "release-check"
+}
+
+// Start starts checking the release metadata if the URL is given.
+func (reporter *VersionReporter) Start() {
+	if reporter.url == "" {
+		return
+	}
+	reporter.wg.Add(1)
+	go func() {
+		defer reporter.wg.Done()
+		reporter.check()
+		if reporter.interval <= 0 {
+			<-reporter.shutdownChan
+			return
+		}
+		ticker := time.NewTicker(reporter.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				reporter.check()
+			case <-reporter.shutdownChan:
+				return
+			}
+		}
+	}()
+}
+
+func (reporter *VersionReporter) Stop() {
+	if atomic.CompareAndSwapUintptr(&reporter.isShuttingDown, 0, 1) {
+		reporter.shutdownChan <- struct{}{}
+	}
+}
+
+func (reporter *VersionReporter) WaitForShutdown() {
+	reporter.wg.Wait()
+}
+
+// NewVersionReporter creates a VersionReporter of info checking the
+// release metadata at url every interval, or only on starting if interval
+// is 0; url may be empty not to check.
+func NewVersionReporter(logger *logging.Logger, info BuildInfo, url string, interval time.Duration) (*VersionReporter, error) {
+	if interval < 0 {
+		return nil, errors.New("release check interval must not be negative")
+	}
+	buildInfoGauge.With(info.Version, info.Revision, info.GoVersion).Set(1)
+	return &VersionReporter{
+		logger:         logger,
+		info:           info,
+		url:            url,
+		interval:       interval,
+		client:         &http.Client{Timeout: 10 * time.Second},
+		mtx:            sync.Mutex{},
+		release:        nil,
+		wg:             sync.WaitGroup{},
+		shutdownChan:   make(chan struct{}, 1),
+		isShuttingDown: 0,
+	}, nil
+}
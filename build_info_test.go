@@ -0,0 +1,119 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"encoding/json"
+	logging "github.com/op/go-logging"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_CompareVersions(t *testing.T) {
+	cases := []struct {
+		a      string
+		b      string
+		result int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"v1.2.3", "1.2.3", 0},
+		{"1.2.3", "1.2.10", -1},
+		{"1.10.0", "1.9.9", 1},
+		{"1.2", "1.2.0", 0},
+		{"1.2.3-rc.1", "1.2.3", -1},
+		{"1.2.3", "1.2.3-rc.1", 1},
+		{"1.2.3-rc.1", "1.2.3-rc.2", -1},
+		{"1.2.3+build.5", "1.2.3", 0},
+	}
+	for _, c := range cases {
+		result, err := CompareVersions(c.a, c.b)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if result != c.result {
+			t.Errorf("%s vs %s: expected %d, got %d", c.a, c.b, c.result, result)
+		}
+	}
+	_, err := CompareVersions("unknown", "1.0.0")
+	if err == nil {
+		t.Error("expected an error comparing an invalid version")
+	}
+}
+
+func Test_VersionReporter(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("version")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"tag_name": "v1.3.0", "name": "1.3.0"}`))
+	}))
+	defer server.Close()
+	info := NewBuildInfo("1.2.0", "0123abc", "2024-01-02T03:04:05Z")
+	if info.Version != "1.2.0" || info.Revision != "0123abc" {
+		t.Fatalf("unexpected build info: %+v", info)
+	}
+	reporter, err := NewVersionReporter(logger, info, server.URL, time.Hour)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if reporter.Info().Release != nil {
+		t.Error("expected no release check before checking")
+	}
+	reporter.check()
+	release := reporter.Info().Release
+	if release == nil || release.LatestVersion != "v1.3.0" || !release.UpdateAvailable || release.Error != "" {
+		t.Fatalf("unexpected release check: %+v", release)
+	}
+
+	w := httptest.NewRecorder()
+	reporter.ServeHTTP(w, httptest.NewRequest("GET", "/api/version", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	result := BuildInfo{}
+	err = json.Unmarshal(w.Body.Bytes(), &result)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if result.Version != "1.2.0" || result.BuiltAt != "2024-01-02T03:04:05Z" || result.Release == nil || !result.Release.UpdateAvailable {
+		t.Errorf("unexpected response: %s", w.Body.String())
+	}
+	if len(result.Plugins["output"]) == 0 {
+		t.Errorf("expected the registered outputs: %s", w.Body.String())
+	}
+}
+
+func Test_VersionReporter_Failure(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("version")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	defer server.Close()
+	reporter, err := NewVersionReporter(logger, NewBuildInfo("1.2.0", "", ""), server.URL, time.Hour)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	reporter.check()
+	release := reporter.Info().Release
+	if release == nil || release.Error == "" || release.UpdateAvailable {
+		t.Errorf("expected the check to fail: %+v", release)
+	}
+}
@@ -0,0 +1,170 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// CgroupLimits are the limits the cgroup of the process puts on it, each of
+// which is 0 if unlimited.
+type CgroupLimits struct {
+	// the number of the CPUs the process may use, which may be fractional
+	CPUs float64
+	// the bytes of the memory the process may use
+	Memory int64
+}
+
+// cgroupV1Unlimited is above the memory limit cgroup v1 reports for none,
+// which is the largest page-aligned int64.
+const cgroupV1Unlimited = int64(1) << 60
+
+// readCgroupFile reads the file of the cgroup in the hierarchy mounted on
+// root, falling back on the root of the hierarchy, which is the cgroup of
+// the process in a container with its own cgroup namespace.
+func readCgroupFile(root string, path string, name string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(root, path, name))
+	if err != nil {
+		b, err = ioutil.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// readCgroupV2Limits reads cpu.max and memory.max of the unified hierarchy.
+func readCgroupV2Limits(root string, path string) CgroupLimits {
+	limits := CgroupLimits{}
+	if s, err := readCgroupFile(root, path, "cpu.max"); err == nil {
+		fields := strings.Fields(s)
+		if len(fields) == 2 && fields[0] != "max" {
+			quota, err1 := strconv.ParseFloat(fields[0], 64)
+			period, err2 := strconv.ParseFloat(fields[1], 64)
+			if err1 == nil && err2 == nil && quota > 0 && period > 0 {
+				limits.CPUs = quota / period
+			}
+		}
+	}
+	if s, err := readCgroupFile(root, path, "memory.max"); err == nil && s != "max" {
+		if v, err := strconv.ParseInt(s, 10, 64); err == nil && v > 0 {
+			limits.Memory = v
+		}
+	}
+	return limits
+}
+
+// cgroupV1Hierarchy is the hierarchy of a cgroup v1 controller, mounted
+// under the root by the names of the controllers in it like cpu,cpuacct,
+// and the path of the cgroup of the process in it.
+type cgroupV1Hierarchy struct {
+	mount string
+	path  string
+}
+
+// readCgroupV1Limits reads the CFS quota of the cpu controller and the
+// memory limit of the memory controller.
+func readCgroupV1Limits(root string, controllers map[string]cgroupV1Hierarchy) CgroupLimits {
+	limits := CgroupLimits{}
+	if hierarchy, ok := controllers["cpu"]; ok {
+		quota, err1 := readCgroupFile(filepath.Join(root, hierarchy.mount), hierarchy.path, "cpu.cfs_quota_us")
+		period, err2 := readCgroupFile(filepath.Join(root, hierarchy.mount), hierarchy.path, "cpu.cfs_period_us")
+		if err1 == nil && err2 == nil {
+			quota, err1 := strconv.ParseFloat(quota, 64)
+			period, err2 := strconv.ParseFloat(period, 64)
+			if err1 == nil && err2 == nil && quota > 0 && period > 0 {
+				limits.CPUs = quota / period
+			}
+		}
+	}
+	if hierarchy, ok := controllers["memory"]; ok {
+		if s, err := readCgroupFile(filepath.Join(root, hierarchy.mount), hierarchy.path, "memory.limit_in_bytes"); err == nil {
+			if v, err := strconv.ParseInt(s, 10, 64); err == nil && v > 0 && v < cgroupV1Unlimited {
+				limits.Memory = v
+			}
+		}
+	}
+	return limits
+}
+
+// readCgroupLimits reads the limits of the cgroup given as the content of
+// /proc/self/cgroup from the hierarchies mounted under root.
+func readCgroupLimits(root string, procCgroup string) (CgroupLimits, error) {
+	controllers := make(map[string]cgroupV1Hierarchy)
+	for _, line := range strings.Split(procCgroup, "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[0] == "0" && fields[1] == "" {
+			if _, err := ioutil.ReadFile(filepath.Join(root, "cgroup.controllers")); err == nil {
+				return readCgroupV2Limits(root, fields[2]), nil
+			}
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			controllers[controller] = cgroupV1Hierarchy{mount: fields[1], path: fields[2]}
+		}
+	}
+	if len(controllers) == 0 {
+		return CgroupLimits{}, errors.New("no cgroup found")
+	}
+	return readCgroupV1Limits(root, controllers), nil
+}
+
+// ReadCgroupLimits reads the CPU and the memory limits of the cgroup of the
+// process, of either cgroup v1 or v2 mounted on /sys/fs/cgroup.
+func ReadCgroupLimits() (CgroupLimits, error) {
+	b, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return CgroupLimits{}, err
+	}
+	return readCgroupLimits("/sys/fs/cgroup", string(b))
+}
+
+// BufferMemoryEstimate estimates the memory the outputs of the sections may
+// take for their buffers at most: a chunk each for the forward outputs, and
+// as many as the parallelism for the td ones, which they hold while flushing.
+// The outputs of the other types are not counted.
+func BufferMemoryEstimate(sections []*ConfigElement) int64 {
+	retval := int64(0)
+	for _, section := range sections {
+		if section.Name != "output" {
+			continue
+		}
+		chunkLimit, err := section.GetInt64("buffer-chunk-limit", 16777216)
+		if err != nil {
+			continue
+		}
+		switch section.Get("type", "") {
+		case "forward":
+			retval += chunkLimit
+		case "td":
+			parallelism, err := section.GetInt("parallelism", 1)
+			if err == nil {
+				retval += chunkLimit * int64(parallelism)
+			}
+		}
+	}
+	return retval
+}
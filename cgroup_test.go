@@ -0,0 +1,111 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeCgroupFiles(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
+
+func Test_ReadCgroupLimits(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+	v2 := filepath.Join(tempDir, "v2")
+	writeCgroupFiles(t, v2, map[string]string{
+		"cgroup.controllers":                "cpu memory\n",
+		"system.slice/forwarder/cpu.max":    "150000 100000\n",
+		"system.slice/forwarder/memory.max": "536870912\n",
+		"cpu.max":                           "max 100000\n",
+		"memory.max":                        "max\n",
+	})
+	v1 := filepath.Join(tempDir, "v1")
+	writeCgroupFiles(t, v1, map[string]string{
+		"cpu,cpuacct/cpu.cfs_quota_us":     "200000\n",
+		"cpu,cpuacct/cpu.cfs_period_us":    "100000\n",
+		"memory/memory.limit_in_bytes":     "9223372036854771712\n",
+		"memory/pod/memory.limit_in_bytes": "1073741824\n",
+	})
+	cases := []struct {
+		root       string
+		procCgroup string
+		expected   CgroupLimits
+	}{
+		{v2, "0::/system.slice/forwarder\n", CgroupLimits{CPUs: 1.5, Memory: 536870912}},
+		// in a cgroup namespace
+		{v2, "0::/\n", CgroupLimits{}},
+		{v2, "0::/elsewhere\n", CgroupLimits{}},
+		{v1, "12:memory:/\n4:cpu,cpuacct:/\n1:name=systemd:/\n", CgroupLimits{CPUs: 2}},
+		{v1, "12:memory:/pod\n4:cpu,cpuacct:/pod\n", CgroupLimits{CPUs: 2, Memory: 1073741824}},
+	}
+	for _, c := range cases {
+		limits, err := readCgroupLimits(c.root, c.procCgroup)
+		if err != nil {
+			t.Errorf("%q: %s", c.procCgroup, err.Error())
+		} else if limits != c.expected {
+			t.Errorf("%q: expected %+v, got %+v", c.procCgroup, c.expected, limits)
+		}
+	}
+	if _, err := readCgroupLimits(tempDir, ""); err == nil {
+		t.Error("no cgroup is taken as unlimited")
+	}
+}
+
+func Test_BufferMemoryEstimate(t *testing.T) {
+	sections, err := ReadConfig("test.conf", []byte(`
+[output "a"]
+type = forward
+
+[output "b"]
+type = td
+buffer-chunk-limit = 1048576
+parallelism = 4
+
+[output "c"]
+type = unknown
+buffer-chunk-limit = 1048576
+
+[filter "d"]
+type = fields
+buffer-chunk-limit = 1048576
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if estimate := BufferMemoryEstimate(sections); estimate != 16777216+4*1048576 {
+		t.Errorf("unexpected estimate: %d", estimate)
+	}
+}
@@ -0,0 +1,139 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"sync"
+	"time"
+)
+
+// DefaultCoalesceSize is the size in bytes of the record sets in a batch at
+// which it is passed on unless coalesce-size is given.
+const DefaultCoalesceSize = 1048576
+
+// coalescingKey tells the record sets whose records are coalesced into one.
+type coalescingKey struct {
+	tag   string
+	trace SpanContext
+}
+
+// CoalescingPort is a BatchingPort that coalesces the record sets given by
+// EmitBatched into a batch, in which the records of the same tag are put
+// together in a record set, until the batch reaches the size or the
+// interval passes, so that the many small record sets of the chatty senders
+// cost the next Port, and the buffer of the output behind it, one emit a
+// batch.  The batches are passed on in the order the record sets are given,
+// and a failed one is logged and counted as dropped.
+type CoalescingPort struct {
+	logger   *logging.Logger
+	next     Port
+	interval time.Duration
+	size     int64
+	batches  *Counter
+	// held while a batch is passed on, to keep the batches in order
+	flushMtx sync.Mutex
+	mtx      sync.Mutex
+	pending  []FluentRecordSet
+	index    map[coalescingKey]int
+	// the size of the record sets pending, as told by EmitBatched
+	pendingSize int64
+	timer       *time.Timer
+}
+
+var inputCoalescedBatches = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_input_coalesced_batches_total", "Number of the batches coalesced from the record sets received.", "listener"))
+
+// NewCoalescingPort returns a CoalescingPort passing the batches on to
+// next, counted in the metrics as the ones of the listener.
+func NewCoalescingPort(logger *logging.Logger, listener string, next Port, interval time.Duration, size int64) *CoalescingPort {
+	return &CoalescingPort{
+		logger:   logger,
+		next:     next,
+		interval: interval,
+		size:     size,
+		batches:  inputCoalescedBatches.With(listener),
+		index:    make(map[coalescingKey]int),
+	}
+}
+
+// EmitBatched adds the record sets of the size to the batch, and passes the
+// batch on if it has reached the size, returning the error of the batch.
+func (port *CoalescingPort) EmitBatched(recordSets []FluentRecordSet, size int64) error {
+	port.mtx.Lock()
+	for _, recordSet := range recordSets {
+		key := coalescingKey{tag: recordSet.Tag, trace: recordSet.Trace}
+		i, ok := port.index[key]
+		if !ok {
+			// kept past EmitBatched, and appended to by the following ones
+			port.index[key] = len(port.pending)
+			port.pending = append(port.pending, copyRecordSet(recordSet))
+			continue
+		}
+		port.pending[i].Records = append(port.pending[i].Records, recordSet.Records...)
+	}
+	port.pendingSize += size
+	full := port.pendingSize >= port.size
+	if !full && port.timer == nil && len(port.pending) > 0 {
+		port.timer = time.AfterFunc(port.interval, func() { port.Flush() })
+	}
+	port.mtx.Unlock()
+	if full {
+		return port.Flush()
+	}
+	return nil
+}
+
+// Emit passes the record sets on right after the batch.
+func (port *CoalescingPort) Emit(recordSets []FluentRecordSet) error {
+	port.flushMtx.Lock()
+	defer port.flushMtx.Unlock()
+	port.flushLocked()
+	return port.next.Emit(recordSets)
+}
+
+// Flush passes the batch on at once.
+func (port *CoalescingPort) Flush() error {
+	port.flushMtx.Lock()
+	defer port.flushMtx.Unlock()
+	return port.flushLocked()
+}
+
+func (port *CoalescingPort) flushLocked() error {
+	port.mtx.Lock()
+	batch := port.pending
+	port.pending = nil
+	port.index = make(map[coalescingKey]int)
+	port.pendingSize = 0
+	if port.timer != nil {
+		port.timer.Stop()
+		port.timer = nil
+	}
+	port.mtx.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+	port.batches.Inc()
+	err := port.next.Emit(batch)
+	if err != nil {
+		countDropped(DropEmitError, recordCount(batch))
+		port.logger.Errorf("Failed to pass on the batch of %d records: %s", recordCount(batch), err.Error())
+	}
+	releaseRecordSets(batch)
+	return err
+}
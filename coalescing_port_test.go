@@ -0,0 +1,119 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	logging "github.com/op/go-logging"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// batchRecordingPort records the batches emitted to it, failing them if err
+// is set.
+type batchRecordingPort struct {
+	mtx     sync.Mutex
+	batches [][]FluentRecordSet
+	err     error
+}
+
+func (port *batchRecordingPort) Emit(recordSets []FluentRecordSet) error {
+	port.mtx.Lock()
+	defer port.mtx.Unlock()
+	port.batches = append(port.batches, CopyRecordSets(recordSets))
+	return port.err
+}
+
+func (port *batchRecordingPort) Batches() [][]FluentRecordSet {
+	port.mtx.Lock()
+	defer port.mtx.Unlock()
+	return port.batches
+}
+
+func Test_CoalescingPort(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("coalescing")
+	next := &batchRecordingPort{}
+	port := NewCoalescingPort(logger, "test-coalescing", next, time.Hour, 100)
+	record := func(n int) TinyFluentRecord {
+		return TinyFluentRecord{Timestamp: 1388534400, Data: map[string]interface{}{"n": n}}
+	}
+	records := []TinyFluentRecord{record(0), record(1)}
+	for i, recordSet := range []FluentRecordSet{
+		{Tag: "a", Records: records[:1]},
+		{Tag: "b", Records: []TinyFluentRecord{record(2)}},
+		{Tag: "a", Records: []TinyFluentRecord{record(3)}},
+	} {
+		if err := port.EmitBatched([]FluentRecordSet{recordSet}, 40); err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(next.Batches()) != i/2 {
+			t.Fatalf("%d: %+v", i, next.Batches())
+		}
+	}
+	// coalesced by the tag, leaving the records of the sender alone
+	expected := []FluentRecordSet{
+		{Tag: "a", Records: []TinyFluentRecord{record(0), record(3)}},
+		{Tag: "b", Records: []TinyFluentRecord{record(2)}},
+	}
+	if !reflect.DeepEqual(next.Batches()[0], expected) {
+		t.Errorf("%+v", next.Batches())
+	}
+	if records[1].Data["n"] != 1 {
+		t.Errorf("%+v", records)
+	}
+
+	// passed on after the batch
+	port.EmitBatched([]FluentRecordSet{{Tag: "c", Records: []TinyFluentRecord{record(4)}}}, 40)
+	port.Emit([]FluentRecordSet{{Tag: "d", Records: []TinyFluentRecord{record(5)}}})
+	batches := next.Batches()
+	if len(batches) != 3 || batches[1][0].Tag != "c" || batches[2][0].Tag != "d" {
+		t.Errorf("%+v", batches)
+	}
+	if port.Flush() != nil || len(next.Batches()) != 3 {
+		t.Errorf("%+v", next.Batches())
+	}
+
+	// the error of the batch is returned to the one filling it
+	next.err = errors.New("failed")
+	port.EmitBatched([]FluentRecordSet{{Tag: "a", Records: []TinyFluentRecord{record(6)}}}, 60)
+	if err := port.EmitBatched([]FluentRecordSet{{Tag: "a", Records: []TinyFluentRecord{record(7)}}}, 60); err != next.err {
+		t.Errorf("%v", err)
+	}
+}
+
+func Test_CoalescingPort_Interval(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("coalescing")
+	next := &batchRecordingPort{}
+	port := NewCoalescingPort(logger, "test-coalescing", next, 10*time.Millisecond, 100)
+	for i := 0; i < 3; i += 1 {
+		port.EmitBatched([]FluentRecordSet{{Tag: "a", Records: []TinyFluentRecord{{Timestamp: 1388534400}}}}, 1)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(next.Batches()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the batch was not passed on")
+		}
+	}
+	if batches := next.Batches(); len(batches) != 1 || recordCount(batches[0]) != 3 {
+		t.Errorf("%+v", batches)
+	}
+}
@@ -0,0 +1,294 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/gcfg.v1/scanner"
+	"gopkg.in/gcfg.v1/token"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigElement is a section of the configuration, such as
+// [filter "drop-debug"], holding the parameters in the order of appearance.
+type ConfigElement struct {
+	Name     string
+	Arg      string
+	Params   map[string][]string
+	Keys     []string
+	Elements []*ConfigElement
+}
+
+func normalizeConfigKey(key string) string {
+	return strings.Replace(strings.ToLower(key), "_", "-", -1)
+}
+
+func (elem *ConfigElement) String() string {
+	if elem.Arg != "" {
+		return fmt.Sprintf("%s \"%s\"", elem.Name, elem.Arg)
+	}
+	return elem.Name
+}
+
+func (elem *ConfigElement) Add(key string, value string) {
+	key = normalizeConfigKey(key)
+	values, ok := elem.Params[key]
+	if !ok {
+		elem.Keys = append(elem.Keys, key)
+	}
+	elem.Params[key] = append(values, value)
+}
+
+func (elem *ConfigElement) Set(key string, value string) {
+	key = normalizeConfigKey(key)
+	if _, ok := elem.Params[key]; !ok {
+		elem.Keys = append(elem.Keys, key)
+	}
+	elem.Params[key] = []string{value}
+}
+
+// Unset removes all the values of the key.
+func (elem *ConfigElement) Unset(key string) {
+	key = normalizeConfigKey(key)
+	if _, ok := elem.Params[key]; !ok {
+		return
+	}
+	delete(elem.Params, key)
+	for i, k := range elem.Keys {
+		if k == key {
+			elem.Keys = append(elem.Keys[:i:i], elem.Keys[i+1:]...)
+			break
+		}
+	}
+}
+
+func (elem *ConfigElement) Has(key string) bool {
+	_, ok := elem.Params[normalizeConfigKey(key)]
+	return ok
+}
+
+func (elem *ConfigElement) GetAll(key string) []string {
+	return elem.Params[normalizeConfigKey(key)]
+}
+
+func (elem *ConfigElement) Get(key string, defaultValue string) string {
+	values := elem.Params[normalizeConfigKey(key)]
+	if len(values) == 0 {
+		return defaultValue
+	}
+	return values[len(values)-1]
+}
+
+// GetList returns the comma-separated items of all the values of the key.
+func (elem *ConfigElement) GetList(key string) []string {
+	retval := make([]string, 0)
+	for _, value := range elem.GetAll(key) {
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if item != "" {
+				retval = append(retval, item)
+			}
+		}
+	}
+	return retval
+}
+
+func (elem *ConfigElement) GetInt(key string, defaultValue int) (int, error) {
+	v, err := elem.GetInt64(key, int64(defaultValue))
+	return int(v), err
+}
+
+func (elem *ConfigElement) GetInt64(key string, defaultValue int64) (int64, error) {
+	s := elem.Get(key, "")
+	if s == "" {
+		return defaultValue, nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return defaultValue, errors.New(fmt.Sprintf("%s: invalid integer value for %s: %s", elem.String(), key, s))
+	}
+	return v, nil
+}
+
+func (elem *ConfigElement) GetFloat(key string, defaultValue float64) (float64, error) {
+	s := elem.Get(key, "")
+	if s == "" {
+		return defaultValue, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return defaultValue, errors.New(fmt.Sprintf("%s: invalid number for %s: %s", elem.String(), key, s))
+	}
+	return v, nil
+}
+
+func (elem *ConfigElement) GetBool(key string, defaultValue bool) (bool, error) {
+	s := elem.Get(key, "")
+	if s == "" {
+		return defaultValue, nil
+	}
+	switch strings.ToLower(s) {
+	case "true", "yes", "on", "1":
+		return true, nil
+	case "false", "no", "off", "0":
+		return false, nil
+	}
+	return defaultValue, errors.New(fmt.Sprintf("%s: invalid boolean value for %s: %s", elem.String(), key, s))
+}
+
+func (elem *ConfigElement) GetDuration(key string, defaultValue time.Duration) (time.Duration, error) {
+	s := elem.Get(key, "")
+	if s == "" {
+		return defaultValue, nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return defaultValue, errors.New(fmt.Sprintf("%s: invalid duration for %s: %s", elem.String(), key, s))
+	}
+	return v, nil
+}
+
+func NewConfigElement(name string, arg string) *ConfigElement {
+	return &ConfigElement{
+		Name:     name,
+		Arg:      arg,
+		Params:   make(map[string][]string),
+		Keys:     make([]string, 0),
+		Elements: make([]*ConfigElement, 0),
+	}
+}
+
+var configUnescape = map[rune]rune{'\\': '\\', '"': '"', 'n': '\n', 't': '\t'}
+
+// the scanner has already rejected malformed literals, so this never fails
+func unquoteConfigValue(s string) string {
+	u, q, esc := make([]rune, 0, len(s)), false, false
+	for _, c := range s {
+		if esc {
+			uc, ok := configUnescape[c]
+			if ok {
+				u = append(u, uc)
+			}
+			esc = false
+			continue
+		}
+		switch c {
+		case '"':
+			q = !q
+		case '\\':
+			esc = true
+		default:
+			u = append(u, c)
+		}
+	}
+	return string(u)
+}
+
+// ReadConfig parses an INI-style configuration (the syntax gcfg accepts)
+// into sections without requiring the set of sections and variables to be
+// known in advance, so that plugins can take arbitrary parameters.
+func ReadConfig(filename string, src []byte) ([]*ConfigElement, error) {
+	src = bytes.TrimPrefix(src, []byte("\ufeff"))
+	fset := token.NewFileSet()
+	file := fset.AddFile(filename, fset.Base(), len(src))
+	errs := scanner.ErrorList{}
+	s := scanner.Scanner{}
+	s.Init(file, src, func(p token.Position, m string) { errs.Add(p, m) }, 0)
+	retval := make([]*ConfigElement, 0)
+	elem := (*ConfigElement)(nil)
+	pos, tok, lit := s.Scan()
+	errorAt := func(msg string) error {
+		return errors.New(fmt.Sprintf("%s: %s", fset.Position(pos), msg))
+	}
+	for {
+		if errs.Len() > 0 {
+			return nil, errs.Err()
+		}
+		switch tok {
+		case token.EOF:
+			return retval, nil
+		case token.EOL, token.COMMENT:
+			pos, tok, lit = s.Scan()
+		case token.LBRACK:
+			pos, tok, lit = s.Scan()
+			if tok != token.IDENT {
+				return nil, errorAt("expected section name")
+			}
+			name := strings.ToLower(lit)
+			arg := ""
+			pos, tok, lit = s.Scan()
+			if tok == token.STRING {
+				arg = unquoteConfigValue(lit)
+				if arg == "" {
+					return nil, errorAt("empty subsection name")
+				}
+				pos, tok, lit = s.Scan()
+			}
+			if tok != token.RBRACK {
+				return nil, errorAt("expected right bracket")
+			}
+			pos, tok, lit = s.Scan()
+			if tok != token.EOL && tok != token.EOF && tok != token.COMMENT {
+				return nil, errorAt("expected EOL, EOF, or comment")
+			}
+			elem = NewConfigElement(name, arg)
+			retval = append(retval, elem)
+		case token.IDENT:
+			if elem == nil {
+				return nil, errorAt("expected section header")
+			}
+			key := lit
+			value := ""
+			pos, tok, lit = s.Scan()
+			if tok != token.EOF && tok != token.EOL && tok != token.COMMENT {
+				if tok != token.ASSIGN {
+					return nil, errorAt("expected '='")
+				}
+				pos, tok, lit = s.Scan()
+				if tok != token.STRING {
+					return nil, errorAt("expected value")
+				}
+				value = unquoteConfigValue(lit)
+				pos, tok, lit = s.Scan()
+				if tok != token.EOL && tok != token.EOF && tok != token.COMMENT {
+					return nil, errorAt("expected EOL, EOF, or comment")
+				}
+			} else {
+				// a blank variable is a boolean flag that is turned on
+				value = "true"
+			}
+			elem.Add(key, value)
+		default:
+			return nil, errorAt("expected section header or variable declaration")
+		}
+	}
+}
+
+func ReadConfigFile(filename string) ([]*ConfigElement, error) {
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(filename, src)
+}
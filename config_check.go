@@ -0,0 +1,327 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// lookupHost resolves the host names while checking a configuration; it is
+// replaced in the tests.
+var lookupHost = net.LookupHost
+
+// ConfigCheck holds the errors, with which the configuration cannot be
+// run, and the warnings found by checking it.
+type ConfigCheck struct {
+	filename string
+	Errors   []string
+	Warnings []string
+}
+
+func (check *ConfigCheck) errorf(section *ConfigElement, format string, args ...interface{}) {
+	check.Errors = append(check.Errors, check.locate(section, fmt.Sprintf(format, args...)))
+}
+
+func (check *ConfigCheck) warnf(section *ConfigElement, format string, args ...interface{}) {
+	check.Warnings = append(check.Warnings, check.locate(section, fmt.Sprintf(format, args...)))
+}
+
+// locate prefixes the message with the file and the section, unless the
+// message already names the section.
+func (check *ConfigCheck) locate(section *ConfigElement, msg string) string {
+	if section != nil && !strings.HasPrefix(msg, section.String()+":") {
+		msg = section.String() + ": " + msg
+	}
+	if check.filename != "" {
+		msg = check.filename + ": " + msg
+	}
+	return msg
+}
+
+func (check *ConfigCheck) OK() bool {
+	return len(check.Errors) == 0
+}
+
+// CheckHost resolves the host of the address, which may be given as a URL
+// or as host:port.
+func CheckHost(addr string) error {
+	if strings.Contains(addr, "//") {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return err
+		}
+		addr = u.Host
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		return nil
+	}
+	_, err = lookupHost(host)
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot resolve %s: %s", host, err.Error()))
+	}
+	return nil
+}
+
+// CheckListenAddress checks the address to listen on without listening.
+func CheckListenAddress(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return err
+	}
+	return CheckHost(addr)
+}
+
+// CheckBufferPath checks that the buffer files can be created on the path,
+// which may have "*" in it.
+func CheckBufferPath(path string) error {
+	if i := strings.Index(path, "*"); i >= 0 {
+		path = path[:i]
+	} else {
+		path += "."
+	}
+	dirname, _ := filepath.Split(path)
+	if dirname == "" {
+		dirname = "."
+	}
+	finfo, err := os.Stat(dirname)
+	if err != nil {
+		return err
+	}
+	if !finfo.IsDir() {
+		return errors.New(fmt.Sprintf("%s is not a directory", dirname))
+	}
+	f, err := ioutil.TempFile(dirname, ".fluentd-forwarder-check")
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s is not writable: %s", dirname, err.Error()))
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// CheckCACerts checks that the file holds CA certificates in PEM.
+func CheckCACerts(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(b) {
+		return errors.New(fmt.Sprintf("no valid certificate found in %s", path))
+	}
+	return nil
+}
+
+func (check *ConfigCheck) checkFiles(section *ConfigElement) {
+	for _, key := range section.Keys {
+		path := section.Get(key, "")
+		switch {
+		case path == "":
+		case key == "ca-certs" || key == "ca-file":
+			if err := CheckCACerts(path); err != nil {
+				check.errorf(section, "%s: %s", key, err.Error())
+			}
+		case strings.HasSuffix(key, "-file"):
+			if _, err := ioutil.ReadFile(path); err != nil {
+				check.errorf(section, "%s: %s", key, err.Error())
+			}
+		}
+	}
+}
+
+func (check *ConfigCheck) checkInput(section *ConfigElement, labels map[string]bool) {
+	typ, err := pluginType(section)
+	if err != nil {
+		check.errorf(section, "%s", err.Error())
+		return
+	}
+	registry.mtx.Lock()
+	_, ok := registry.inputs[typ]
+	registry.mtx.Unlock()
+	if !ok {
+		check.errorf(section, "unknown input type: %s", typ)
+	}
+	if name := section.Get("label", ""); !labels[name] {
+		check.errorf(section, "label %s is not defined", name)
+	}
+	if typ == "forward" {
+		if err := CheckListenAddress(section.Get("listen-on", DefaultForwardListenOn)); err != nil {
+			check.errorf(section, "listen-on: %s", err.Error())
+		}
+		if err := CheckForwardProtocol(section.Get("protocol", ForwardProtocolAuto)); err != nil {
+			check.errorf(section, "protocol: %s", err.Error())
+		}
+		if _, err := section.GetDuration("coalesce-interval", 0); err != nil {
+			check.errorf(section, "%s", err.Error())
+		}
+		if size, err := section.GetInt64("coalesce-size", DefaultCoalesceSize); err != nil {
+			check.errorf(section, "%s", err.Error())
+		} else if size <= 0 {
+			check.errorf(section, "coalesce-size must be positive")
+		}
+		if _, err := socketOptionsFromConfig(section, DefaultSocketOptions); err != nil {
+			check.errorf(section, "%s", err.Error())
+		}
+		if size, err := section.GetInt("max-message-size", DefaultMaxMessageSize); err != nil {
+			check.errorf(section, "%s", err.Error())
+		} else if size < 0 {
+			check.errorf(section, "max-message-size may not be negative")
+		}
+	}
+}
+
+func (check *ConfigCheck) checkOutput(logger *logging.Logger, section *ConfigElement) {
+	failed := len(check.Errors)
+	check.checkFiles(section)
+	if to := section.Get("to", ""); to != "" {
+		if err := CheckHost(to); err != nil {
+			check.errorf(section, "to: %s", err.Error())
+		}
+	}
+	if path := section.Get("buffer-path", ""); path != "" {
+		if err := CheckBufferPath(path); err != nil {
+			check.errorf(section, "buffer-path: %s", err.Error())
+		}
+	}
+	if len(check.Errors) > failed {
+		return
+	}
+	// the outputs neither connect nor write until started
+	if _, err := NewOutput(logger, section); err != nil {
+		check.errorf(section, "%s", err.Error())
+	}
+}
+
+// checkRoutes warns of the records no output takes and of the outputs and
+// the labels no record reaches.
+func (check *ConfigCheck) checkRoutes(sections []*ConfigElement, hasDefaultOutput bool) {
+	sentTo := map[string]bool{"": true, ErrorLabel: true}
+	for _, section := range sections {
+		switch section.Name {
+		case "input":
+			sentTo[section.Get("label", "")] = true
+		case "filter":
+			for _, key := range []string{"to-label", "overflow-label"} {
+				if section.Has(key) {
+					sentTo[section.Get(key, "")] = true
+				}
+			}
+		}
+	}
+	for _, name := range labelNames(sections) {
+		label := &LabelPort{name: name}
+		if !sentTo[name] {
+			check.warnf(nil, "%s is not sent any records", label.String())
+		}
+		catchAll := (*ConfigElement)(nil)
+		patterns := make([]string, 0)
+		for _, section := range sections {
+			if section.Name != "output" || section.Get("label", "") != name {
+				continue
+			}
+			if catchAll != nil {
+				check.warnf(section, "unreachable, as %s before it takes all the records", catchAll.String())
+				continue
+			}
+			pattern := section.Get("match", "**")
+			patterns = append(patterns, pattern)
+			if section.Has("where") {
+				continue
+			}
+			for _, alternative := range strings.Fields(pattern) {
+				if alternative == "**" {
+					catchAll = section
+				}
+			}
+		}
+		if catchAll == nil && !(name == "" && hasDefaultOutput) {
+			if len(patterns) == 0 {
+				check.warnf(nil, "%s: all the records are discarded, as it has no output", label.String())
+			} else {
+				check.warnf(nil, "%s: the records of the tags matching none of %s are discarded", label.String(), strings.Join(patterns, ", "))
+			}
+		}
+	}
+}
+
+// CheckConfig checks the input, filter and output sections read from the
+// file without listening on anything or sending any records;
+// hasDefaultOutput tells whether the default label ends in the output given
+// by the command line.  The host names are resolved, the files named by the
+// parameters ending in "-file" are read, the buffer directories are checked
+// for writability, and the filters are created as they would be.
+func CheckConfig(logger *logging.Logger, filename string, sections []*ConfigElement, hasDefaultOutput bool) *ConfigCheck {
+	check := &ConfigCheck{
+		filename: filename,
+		Errors:   make([]string, 0),
+		Warnings: make([]string, 0),
+	}
+	labels := make(map[string]bool)
+	for _, name := range labelNames(sections) {
+		labels[name] = true
+	}
+	for _, section := range sections {
+		switch section.Name {
+		case "input":
+			check.checkFiles(section)
+			check.checkInput(section, labels)
+		case "output":
+			check.checkOutput(logger, section)
+		default:
+			check.checkFiles(section)
+		}
+	}
+	// builds the labels and the filters with stand-ins for the outputs
+	// checked above
+	defaultOutput := (Output)(nil)
+	if hasDefaultOutput {
+		defaultOutput = checkedOutput("default")
+	}
+	_, err := buildPipeline(logger, sections, defaultOutput, func(logger *logging.Logger, key string, section *ConfigElement) (Output, error) {
+		return checkedOutput(key), nil
+	})
+	if err != nil {
+		check.Errors = append(check.Errors, check.locate(nil, err.Error()))
+	}
+	check.checkRoutes(sections, hasDefaultOutput)
+	return check
+}
+
+// checkedOutput stands in for an output while checking a configuration.
+type checkedOutput string
+
+func (output checkedOutput) Emit(recordSets []FluentRecordSet) error { return nil }
+func (output checkedOutput) String() string                          { return "output:" + string(output) }
+func (output checkedOutput) Start()                                  {}
+func (output checkedOutput) Stop()                                   {}
+func (output checkedOutput) WaitForShutdown()                        {}
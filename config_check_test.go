@@ -0,0 +1,146 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_CheckConfig(t *testing.T) {
+	defer func(f func(string) ([]string, error)) { lookupHost = f }(lookupHost)
+	lookupHost = func(host string) ([]string, error) {
+		if host == "collector.example.com" {
+			return []string{"192.0.2.1"}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	logger := logging.MustGetLogger("fluentd-forwarder")
+	check := func(src string, hasDefaultOutput bool) *ConfigCheck {
+		sections, err := ReadConfig("test.conf", []byte(strings.Replace(src, "DIR", dir, -1)))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return CheckConfig(logger, "test.conf", sections, hasDefaultOutput)
+	}
+
+	result := check(`
+[input "in"]
+type = forward
+listen-on = 127.0.0.1:24224
+[output "out"]
+type = forward
+to = collector.example.com:24224
+buffer-path = DIR/out.*.buf
+`, false)
+	if !result.OK() || len(result.Warnings) != 0 {
+		t.Fatalf("unexpected problems: %v %v", result.Errors, result.Warnings)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Fatalf("files left in the buffer directory: %v", files)
+	}
+
+	result = check(`
+[input "in"]
+type = forward
+listen-on = 127.0.0.1:http-no-such-port
+label = nowhere
+[output "out"]
+type = forward
+to = unknown.invalid:24224
+buffer-path = DIR/missing/out.*.buf
+[output "tls"]
+type = td
+to = https://collector.example.com/
+api-key = key
+buffer-path = DIR/td.*.buf
+ca-certs = DIR/missing.pem
+`, false)
+	expected := []string{
+		`test.conf: output "tls": ca-certs: `,
+		`test.conf: input "in": label nowhere is not defined`,
+		`test.conf: input "in": listen-on: `,
+		`test.conf: output "out": to: cannot resolve unknown.invalid: no such host`,
+		`test.conf: output "out": buffer-path: `,
+	}
+	if len(result.Errors) != len(expected) {
+		t.Errorf("unexpected errors: %v", result.Errors)
+	}
+	for _, prefix := range expected {
+		found := false
+		for _, msg := range result.Errors {
+			found = found || strings.HasPrefix(msg, prefix)
+		}
+		if !found {
+			t.Errorf("no error starting with %q in %v", prefix, result.Errors)
+		}
+	}
+
+	result = check(`
+[filter "broken"]
+type = no-such-filter
+`, true)
+	if result.OK() || !strings.HasPrefix(result.Errors[0], "test.conf: filter \"broken\": unknown filter type") {
+		t.Fatalf("unexpected errors: %v", result.Errors)
+	}
+
+	result = check(`
+[output "a"]
+type = test-recording
+match = a.**
+[output "b"]
+type = test-recording
+match = a.** b.**
+label = other
+[output "c"]
+type = test-recording
+label = other
+[output "d"]
+type = test-recording
+match = c.**
+label = other
+`, false)
+	warnings := []string{
+		"test.conf: label:default: the records of the tags matching none of a.** are discarded",
+		"test.conf: label:other is not sent any records",
+		`test.conf: output "d": unreachable, as output "c" before it takes all the records`,
+	}
+	if !result.OK() || strings.Join(result.Warnings, "\n") != strings.Join(warnings, "\n") {
+		t.Fatalf("unexpected problems: %v %v", result.Errors, result.Warnings)
+	}
+	// the default output takes the rest
+	result = check(`
+[output "a"]
+type = test-recording
+match = a.**
+`, true)
+	if !result.OK() || len(result.Warnings) != 0 {
+		t.Fatalf("unexpected problems: %v %v", result.Errors, result.Warnings)
+	}
+}
@@ -0,0 +1,187 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// EncryptedValuePrefix starts a configuration value encrypted by the
+// configuration key, followed by the ciphertext in base64.
+const EncryptedValuePrefix = "enc:"
+
+// ConfigKeySize is the size of the configuration key, with which the values
+// are encrypted by AES-256-GCM.
+const ConfigKeySize = 32
+
+// the source of the configuration key encrypted by AWS KMS
+const ConfigKeySourceAWSKMS = "aws-kms"
+
+func configKeyCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != ConfigKeySize {
+		return nil, errors.New(fmt.Sprintf("the configuration key must be %d bytes, not %d", ConfigKeySize, len(key)))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// GenerateConfigKey generates a random configuration key.
+func GenerateConfigKey() ([]byte, error) {
+	key := make([]byte, ConfigKeySize)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// EncryptConfigValue encrypts the value by the key, returning it prefixed
+// with EncryptedValuePrefix to be written in the configuration.
+func EncryptConfigValue(key []byte, value string) (string, error) {
+	aead, err := configKeyCipher(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+	return EncryptedValuePrefix + base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(value), nil)), nil
+}
+
+// DecryptConfigValue decrypts the ciphertext in base64 following
+// EncryptedValuePrefix by the key.
+func DecryptConfigValue(key []byte, ciphertext string) (string, error) {
+	aead, err := configKeyCipher(key)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(ciphertext))
+	if err != nil {
+		return "", errors.New("the encrypted value is not in base64")
+	}
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return "", errors.New("the encrypted value is too short")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("failed to decrypt the value; the key may be wrong")
+	}
+	return string(plaintext), nil
+}
+
+// decryptAWSKMSKey decrypts the data key encrypted by AWS KMS, which is
+// read in base64 from the file, with the credentials in AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN in AWS_REGION.
+func decryptAWSKMSKey(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: the encrypted key is not in base64", path))
+	}
+	region := ""
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region == "" {
+			region, _ = lookupEnv(name)
+		}
+	}
+	if region == "" {
+		return nil, errors.New("the region is not known; set AWS_REGION")
+	}
+	accessKey, secretKey, err := awsCredentials()
+	if err != nil {
+		return nil, err
+	}
+	endpoint, _ := lookupEnv("AWS_ENDPOINT_URL_KMS")
+	if endpoint == "" {
+		endpoint = "https://kms." + region + ".amazonaws.com/"
+	}
+	body, _ := json.Marshal(map[string][]byte{"CiphertextBlob": blob})
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService.Decrypt")
+	if token, _ := lookupEnv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	signAWSRequest(req, body, "kms", region, accessKey, secretKey, time.Now())
+	resp := struct {
+		Plaintext []byte `json:"Plaintext"`
+	}{}
+	err = secretRequest(req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
+
+// LoadConfigKey loads the configuration key given as SOURCE:REFERENCE: a
+// key in base64 read from any source of the secrets, such as
+// file:/etc/fluentd-forwarder/config.key, or aws-kms:PATH to decrypt the
+// data key in the file by AWS KMS.
+func LoadConfigKey(secrets *Secrets, spec string) ([]byte, error) {
+	i := strings.Index(spec, ":")
+	if i < 0 {
+		return nil, errors.New(fmt.Sprintf("the configuration key is not given as SOURCE:REFERENCE: %s", spec))
+	}
+	source, ref := spec[:i], spec[i+1:]
+	key, err := ([]byte)(nil), (error)(nil)
+	if source == ConfigKeySourceAWSKMS {
+		key, err = decryptAWSKMSKey(ref)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to decrypt the configuration key by AWS KMS: %s", err.Error()))
+		}
+	} else {
+		encoded := ""
+		encoded, err = secrets.fetchSecret(source, ref)
+		if err != nil {
+			return nil, err
+		}
+		key, err = base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("the configuration key in %s is not in base64", spec))
+		}
+	}
+	_, err = configKeyCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
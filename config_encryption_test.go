@@ -0,0 +1,148 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_EncryptConfigValue(t *testing.T) {
+	key, err := GenerateConfigKey()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	encrypted, err := EncryptConfigValue(key, "shared-key")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.HasPrefix(encrypted, EncryptedValuePrefix) || strings.Contains(encrypted, "shared-key") {
+		t.Fatalf("unexpected encrypted value: %s", encrypted)
+	}
+	value, err := DecryptConfigValue(key, strings.TrimPrefix(encrypted, EncryptedValuePrefix))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if value != "shared-key" {
+		t.Errorf("unexpected value: %s", value)
+	}
+	otherKey, _ := GenerateConfigKey()
+	_, err = DecryptConfigValue(otherKey, strings.TrimPrefix(encrypted, EncryptedValuePrefix))
+	if err == nil {
+		t.Error("expected an error decrypting by another key")
+	}
+	_, err = EncryptConfigValue(key[:16], "shared-key")
+	if err == nil {
+		t.Error("expected an error encrypting by a short key")
+	}
+}
+
+func Test_ParseConfig_Encrypted(t *testing.T) {
+	defer func(secrets *Secrets) { DefaultSecrets = secrets }(DefaultSecrets)
+	DefaultSecrets = NewSecrets()
+	dir, err := ioutil.TempDir("", "config_key")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	key, _ := GenerateConfigKey()
+	keyFile := filepath.Join(dir, "config.key")
+	ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+	encrypted, _ := EncryptConfigValue(key, "a${b}")
+	src := []byte("[output \"forward\"]\nshared-key = " + encrypted + "\n")
+
+	_, err = ParseConfig("test.conf", src)
+	if err == nil || err.Error() != `test.conf: output "forward": shared-key: no configuration key is given to decrypt the value` {
+		t.Errorf("unexpected error: %v", err)
+	}
+	loaded, err := LoadConfigKey(DefaultSecrets, "file:"+keyFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = DefaultSecrets.SetConfigKey(loaded)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sections, err := ParseConfig("test.conf", src)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if v := sections[0].Get("shared-key", ""); v != "a${b}" {
+		t.Errorf("unexpected value: %s", v)
+	}
+	if v := DefaultSecrets.Redact("shared-key = a${b}"); v != "shared-key = xxxxx" {
+		t.Errorf("the decrypted value is not redacted: %s", v)
+	}
+	changed, err := DefaultSecrets.Refresh()
+	if changed || err != nil {
+		t.Errorf("unexpected refresh: %v, %v", changed, err)
+	}
+	_, err = LoadConfigKey(DefaultSecrets, keyFile)
+	if err == nil {
+		t.Error("expected an error loading the key without the source")
+	}
+}
+
+func Test_LoadConfigKey_AWSKMS(t *testing.T) {
+	defer func(f func(string) (string, bool)) { lookupEnv = f }(lookupEnv)
+	key, _ := GenerateConfigKey()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := struct {
+			CiphertextBlob []byte `json:"CiphertextBlob"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.Header.Get("X-Amz-Target") != "TrentService.Decrypt" || !strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/kms/aws4_request") || string(req.CiphertextBlob) != "wrapped" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string][]byte{"Plaintext": key})
+	}))
+	defer server.Close()
+	env := map[string]string{
+		"AWS_REGION":            "eu-west-1",
+		"AWS_ACCESS_KEY_ID":     "AKID",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+		"AWS_ENDPOINT_URL_KMS":  server.URL + "/",
+	}
+	lookupEnv = func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	dir, err := ioutil.TempDir("", "config_key")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	blobFile := filepath.Join(dir, "config.key.enc")
+	ioutil.WriteFile(blobFile, []byte(base64.StdEncoding.EncodeToString([]byte("wrapped"))), 0600)
+	loaded, err := LoadConfigKey(NewSecrets(), "aws-kms:"+blobFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(loaded) != string(key) {
+		t.Error("unexpected key")
+	}
+}
@@ -0,0 +1,104 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// lookupEnv looks up the environment variables substituted into the
+// configuration; it is replaced in the tests.
+var lookupEnv = os.LookupEnv
+
+var envReferenceRegexp = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-[^}]*)?\}`)
+
+// ExpandEnv replaces ${NAME} in the value with the environment variable,
+// or with the fallback following ":-" in ${NAME:-fallback} if the variable
+// is unset or empty.  "$${" is left as "${".  The placeholders of the tag
+// templates, ${tag}, ${tag_parts[N]} and ${fields.KEY}, are left as they
+// are.
+func ExpandEnv(value string) (string, error) {
+	err := (error)(nil)
+	retval := envReferenceRegexp.ReplaceAllStringFunc(value, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		m := envReferenceRegexp.FindStringSubmatch(ref)
+		name, fallback := m[1], m[2]
+		if name == "tag" && fallback == "" {
+			return ref
+		}
+		v, ok := lookupEnv(name)
+		if fallback != "" {
+			if v == "" {
+				return fallback[2:]
+			}
+			return v
+		}
+		if !ok && err == nil {
+			err = errors.New(fmt.Sprintf("environment variable %s is not set", name))
+		}
+		return v
+	})
+	if err != nil {
+		return "", err
+	}
+	return retval, nil
+}
+
+// expandConfigEnv decrypts the encrypted values and substitutes the secrets
+// and the environment variables into the others in the parameters of the
+// sections.
+func expandConfigEnv(filename string, sections []*ConfigElement) error {
+	for _, section := range sections {
+		for _, key := range section.Keys {
+			values := section.Params[key]
+			for i, value := range values {
+				if strings.HasPrefix(value, EncryptedValuePrefix) {
+					decrypted, err := DefaultSecrets.Decrypt(value)
+					if err != nil {
+						return errors.New(fmt.Sprintf("%s: %s: %s: %s", filename, section.String(), key, err.Error()))
+					}
+					values[i] = decrypted
+					continue
+				}
+				if !strings.Contains(value, "${") {
+					continue
+				}
+				expanded, err := DefaultSecrets.Expand(value)
+				if err == nil {
+					expanded, err = ExpandEnv(expanded)
+				}
+				if err != nil {
+					return errors.New(fmt.Sprintf("%s: %s: %s: %s", filename, section.String(), key, err.Error()))
+				}
+				values[i] = expanded
+			}
+		}
+		err := expandConfigEnv(filename, section.Elements)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_ExpandEnv(t *testing.T) {
+	defer func(f func(string) (string, bool)) { lookupEnv = f }(lookupEnv)
+	env := map[string]string{"HOST": "collector", "PORT": "24224", "EMPTY": "", "tag": "x"}
+	lookupEnv = func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	cases := []struct {
+		value    string
+		expected string
+	}{
+		{"${HOST}:${PORT}", "collector:24224"},
+		{"${MISSING:-localhost}:${PORT:-1}", "localhost:24224"},
+		{"${EMPTY:-fallback}", "fallback"},
+		{"${EMPTY}", ""},
+		{"${MISSING:-}", ""},
+		{"$${HOST} ${HOST}", "${HOST} collector"},
+		{"${tag}.${tag_parts[0]}.${fields.a.b}.${$.a}", "${tag}.${tag_parts[0]}.${fields.a.b}.${$.a}"},
+		{"$HOST {HOST}", "$HOST {HOST}"},
+	}
+	for _, c := range cases {
+		actual, err := ExpandEnv(c.value)
+		if err != nil {
+			t.Errorf("%s: %s", c.value, err.Error())
+		} else if actual != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.value, c.expected, actual)
+		}
+	}
+	_, err := ExpandEnv("${HOST}:${MISSING}")
+	if err == nil || err.Error() != "environment variable MISSING is not set" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	sections, err := ParseConfig("test.conf", []byte(`
+[output "out"]
+type = forward
+to = ${HOST}:${PORT}
+add-tag-prefix = ${MISSING:-default}
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if sections[0].Get("to", "") != "collector:24224" || sections[0].Get("add-tag-prefix", "") != "default" {
+		t.Errorf("unexpected sections: %s", configSummary(sections))
+	}
+	_, err = ParseConfig("test.yaml", []byte("settings:\n  to: ${MISSING}\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "test.yaml: fluentd-forwarder: to: environment variable MISSING") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
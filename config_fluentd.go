@@ -0,0 +1,422 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// IsFluentdConfig tells whether the configuration is written in the syntax
+// of fluentd rather than in the INI format, by whether the first directive
+// is a section like <source> or @include.
+func IsFluentdConfig(src []byte) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimPrefix(src, []byte("\ufeff"))))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		return line[0] == '<' || strings.HasPrefix(line, "@include")
+	}
+	return false
+}
+
+type fluentdConfigParser struct {
+	filename string
+	lines    []string
+	// the number of the lines read so far
+	n int
+}
+
+func (parser *fluentdConfigParser) errorAt(format string, args ...interface{}) error {
+	return errors.New(fmt.Sprintf("%s:%d: %s", parser.filename, parser.n, fmt.Sprintf(format, args...)))
+}
+
+var fluentdEscapes = map[byte]byte{'\\': '\\', '"': '"', 'n': '\n', 't': '\t', 'r': '\r', '#': '#'}
+
+// value reads the value starting with s, which is quoted or not, and may
+// continue on the following lines if it is an array or a hash.
+func (parser *fluentdConfigParser) value(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		u := make([]byte, 0, len(s))
+		for i := 1; i < len(s); i += 1 {
+			switch s[i] {
+			case '"':
+				if rest := strings.TrimSpace(s[i+1:]); rest != "" && rest[0] != '#' {
+					return "", parser.errorAt("unexpected %s after the quoted value", rest)
+				}
+				return string(u), nil
+			case '\\':
+				i += 1
+				if i < len(s) {
+					if c, ok := fluentdEscapes[s[i]]; ok {
+						u = append(u, c)
+					} else {
+						u = append(u, '\\', s[i])
+					}
+				}
+			default:
+				u = append(u, s[i])
+			}
+		}
+		return "", parser.errorAt("unterminated quoted value")
+	case strings.HasPrefix(s, "'"):
+		i := strings.IndexByte(s[1:], '\'')
+		if i < 0 {
+			return "", parser.errorAt("unterminated quoted value")
+		}
+		return s[1 : i+1], nil
+	case strings.HasPrefix(s, "[") || strings.HasPrefix(s, "{"):
+		// a JSON array or hash, which may span multiple lines
+		value := s
+		for depth := bracketDepth(value); depth > 0; depth = bracketDepth(value) {
+			if parser.n >= len(parser.lines) {
+				return "", parser.errorAt("unterminated %c", s[0])
+			}
+			value += "\n" + parser.lines[parser.n]
+			parser.n += 1
+		}
+		return value, nil
+	}
+	// a comment starts with # following a space
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s), nil
+}
+
+// bracketDepth returns the number of the brackets and braces left open,
+// ignoring the ones in strings.
+func bracketDepth(s string) int {
+	depth, quoted, escaped := 0, false, false
+	for _, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = quoted
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '[' || c == '{':
+			depth += 1
+		case c == ']' || c == '}':
+			depth -= 1
+		}
+	}
+	return depth
+}
+
+// section reads the parameters and the subsections of the section until it
+// is closed, or until the end if the section is the root.
+func (parser *fluentdConfigParser) section(elem *ConfigElement, root bool) error {
+	for parser.n < len(parser.lines) {
+		line := strings.TrimSpace(parser.lines[parser.n])
+		parser.n += 1
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if strings.HasPrefix(line, "</") {
+			if root || !strings.HasSuffix(line, ">") || strings.TrimSpace(line[2:len(line)-1]) != elem.Name {
+				return parser.errorAt("unexpected %s", line)
+			}
+			return nil
+		}
+		if strings.HasPrefix(line, "<") {
+			if !strings.HasSuffix(line, ">") {
+				return parser.errorAt("expected > at the end of %s", line)
+			}
+			fields := strings.SplitN(strings.TrimSpace(line[1:len(line)-1]), " ", 2)
+			if fields[0] == "" {
+				return parser.errorAt("expected section name")
+			}
+			arg := ""
+			if len(fields) > 1 {
+				arg = strings.TrimSpace(fields[1])
+			}
+			child := NewConfigElement(fields[0], arg)
+			err := parser.section(child, false)
+			if err != nil {
+				return err
+			}
+			elem.Elements = append(elem.Elements, child)
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		key := fields[0]
+		if key == "@include" {
+			if !root {
+				return parser.errorAt("@include is only allowed at the top level")
+			}
+			if len(fields) < 2 || strings.TrimSpace(fields[1]) == "" {
+				return parser.errorAt("@include without a path")
+			}
+			elem.Elements = append(elem.Elements, NewConfigElement("include", strings.TrimSpace(fields[1])))
+			continue
+		}
+		value := ""
+		if len(fields) > 1 {
+			v, err := parser.value(strings.TrimSpace(fields[1]))
+			if err != nil {
+				return err
+			}
+			value = v
+		}
+		if root {
+			return parser.errorAt("parameter %s outside a section", key)
+		}
+		elem.Add(key, value)
+	}
+	if !root {
+		return parser.errorAt("%s is not closed", elem.String())
+	}
+	return nil
+}
+
+var fluentdTimeRegexp = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)([smhd]?)$`)
+
+// fluentdTime converts a time value of fluentd, such as 60, 1.5m or 1d, to
+// one time.ParseDuration accepts, leaving the others as they are.
+func fluentdTime(s string) string {
+	m := fluentdTimeRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return s
+	}
+	switch m[2] {
+	case "", "s":
+		return m[1] + "s"
+	case "d":
+		v, _ := strconv.ParseFloat(m[1], 64)
+		return strconv.FormatFloat(v*24, 'f', -1, 64) + "h"
+	}
+	return m[1] + m[2]
+}
+
+var fluentdSizeRegexp = regexp.MustCompile(`^([0-9]+)([kKmMgGtT]?)$`)
+
+// fluentdSize converts a size value of fluentd, such as 8m, to the number of
+// bytes, leaving the others as they are.
+func fluentdSize(s string) string {
+	m := fluentdSizeRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return s
+	}
+	v, _ := strconv.ParseInt(m[1], 10, 64)
+	shift := strings.Index("kmgt", strings.ToLower(m[2])) + 1
+	if m[2] == "" {
+		shift = 0
+	}
+	return strconv.FormatInt(v<<(10*uint(shift)), 10)
+}
+
+// fluentdBufferParams are the parameters of <buffer> named differently in
+// the outputs of this forwarder, or ignored if renamed to "".
+var fluentdBufferParams = map[string]string{
+	"@type":            "",
+	"path":             "buffer-path",
+	"chunk-limit-size": "buffer-chunk-limit",
+	"retry-wait":       "retry-interval",
+}
+
+// copyFluentdParams copies the parameters, converting the fluentd-specific
+// ones and the time and the size values.
+func copyFluentdParams(dst *ConfigElement, src *ConfigElement, aliases map[string]string) {
+	for _, key := range src.Keys {
+		name := key
+		switch key {
+		case "@type":
+			name = "type"
+		case "@label":
+			name = "label"
+		case "@id", "@log-level":
+			continue
+		}
+		if alias, ok := aliases[key]; ok {
+			if alias == "" {
+				continue
+			}
+			name = alias
+		}
+		for _, value := range src.GetAll(key) {
+			switch {
+			case strings.HasSuffix(name, "-interval") || strings.HasSuffix(name, "-timeout"):
+				value = fluentdTime(value)
+			case name == "buffer-chunk-limit" || strings.HasSuffix(name, "-size"):
+				value = fluentdSize(value)
+			case name == "log-level" && value == "warn":
+				value = "warning"
+			}
+			dst.Add(name, value)
+		}
+	}
+}
+
+// fluentdSectionName names a section by its @id, or by the argument of the
+// directive if it has none.
+func fluentdSectionName(directive *ConfigElement, defaultName string) string {
+	if id := directive.Get("@id", ""); id != "" {
+		return id
+	}
+	if directive.Arg != "" {
+		return directive.Arg
+	}
+	return defaultName
+}
+
+func translateFluentdSource(directive *ConfigElement) (*ConfigElement, error) {
+	section := NewConfigElement("input", fluentdSectionName(directive, directive.Get("@type", "")))
+	copyFluentdParams(section, directive, nil)
+	if section.Get("type", "") == "forward" {
+		bind := directive.Get("bind", "0.0.0.0")
+		port := directive.Get("port", "24224")
+		section.Set("listen-on", bind+":"+port)
+	}
+	for _, child := range directive.Elements {
+		return nil, errors.New(fmt.Sprintf("%s: unsupported section: <%s>", section.String(), child.Name))
+	}
+	return section, nil
+}
+
+func translateFluentdMatch(directive *ConfigElement, label string) (*ConfigElement, error) {
+	section := NewConfigElement("output", fluentdSectionName(directive, "**"))
+	section.Set("match", directive.Arg)
+	copyFluentdParams(section, directive, nil)
+	servers := 0
+	for _, child := range directive.Elements {
+		switch child.Name {
+		case "buffer":
+			copyFluentdParams(section, child, fluentdBufferParams)
+		case "server":
+			servers += 1
+			if servers > 1 {
+				return nil, errors.New(fmt.Sprintf("%s: only one <server> is supported", section.String()))
+			}
+			host := child.Get("host", "")
+			if host == "" {
+				return nil, errors.New(fmt.Sprintf("%s: host of <server> is not specified", section.String()))
+			}
+			section.Set("to", host+":"+child.Get("port", "24224"))
+		default:
+			return nil, errors.New(fmt.Sprintf("%s: unsupported section: <%s>", section.String(), child.Name))
+		}
+	}
+	if label != "" {
+		section.Set("label", label)
+	}
+	return section, nil
+}
+
+func translateFluentdFilter(directive *ConfigElement, label string) (*ConfigElement, error) {
+	section := NewConfigElement("filter", fluentdSectionName(directive, "**"))
+	section.Set("match", directive.Arg)
+	copyFluentdParams(section, directive, nil)
+	for _, child := range directive.Elements {
+		return nil, errors.New(fmt.Sprintf("%s: unsupported section: <%s>", section.String(), child.Name))
+	}
+	if label != "" {
+		section.Set("label", label)
+	}
+	return section, nil
+}
+
+// translateFluentdDirectives converts the <filter> and <match> directives,
+// in the label if not empty.
+func translateFluentdDirectives(directives []*ConfigElement, label string) ([]*ConfigElement, error) {
+	retval := make([]*ConfigElement, 0, len(directives))
+	for _, directive := range directives {
+		section := (*ConfigElement)(nil)
+		err := (error)(nil)
+		switch directive.Name {
+		case "match":
+			section, err = translateFluentdMatch(directive, label)
+		case "filter":
+			section, err = translateFluentdFilter(directive, label)
+		default:
+			err = errors.New(fmt.Sprintf("<%s> is not allowed in label %s", directive.Name, label))
+		}
+		if err != nil {
+			return nil, err
+		}
+		retval = append(retval, section)
+	}
+	return retval, nil
+}
+
+// ReadFluentdConfig parses a configuration written in the syntax of fluentd
+// into the sections of this forwarder: <system> into the fluentd-forwarder
+// section, <source> into input sections, and <filter> and <match> into
+// filter and output sections in the same order, labeled by the <label>
+// they are in.  @type, @label and @id are taken for type, label and the
+// name of the section, and the parameters of <buffer> and <server> of an
+// output are merged into it.  @include is left as an include section.
+func ReadFluentdConfig(filename string, src []byte) ([]*ConfigElement, error) {
+	src = bytes.TrimPrefix(src, []byte("\ufeff"))
+	parser := &fluentdConfigParser{
+		filename: filename,
+		lines:    strings.Split(strings.Replace(string(src), "\r\n", "\n", -1), "\n"),
+		n:        0,
+	}
+	root := NewConfigElement("", "")
+	err := parser.section(root, true)
+	if err != nil {
+		return nil, err
+	}
+	retval := make([]*ConfigElement, 0, len(root.Elements))
+	for _, directive := range root.Elements {
+		switch directive.Name {
+		case "system":
+			section := NewConfigElement("fluentd-forwarder", "")
+			copyFluentdParams(section, directive, nil)
+			retval = append(retval, section)
+		case "source":
+			section, err := translateFluentdSource(directive)
+			if err != nil {
+				return nil, err
+			}
+			retval = append(retval, section)
+		case "match", "filter":
+			sections, err := translateFluentdDirectives([]*ConfigElement{directive}, "")
+			if err != nil {
+				return nil, err
+			}
+			retval = append(retval, sections...)
+		case "include":
+			retval = append(retval, directive)
+		case "label":
+			if directive.Arg == "" {
+				return nil, errors.New(fmt.Sprintf("%s: <label> without a name", filename))
+			}
+			sections, err := translateFluentdDirectives(directive.Elements, directive.Arg)
+			if err != nil {
+				return nil, err
+			}
+			retval = append(retval, sections...)
+		default:
+			return nil, errors.New(fmt.Sprintf("%s: unknown directive: <%s>", filename, directive.Name))
+		}
+	}
+	return retval, nil
+}
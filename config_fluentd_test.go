@@ -0,0 +1,142 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"reflect"
+	"testing"
+)
+
+func Test_IsFluentdConfig(t *testing.T) {
+	if !IsFluentdConfig([]byte("# fluentd\n\n<source>\n</source>\n")) || !IsFluentdConfig([]byte("@include conf.d/*.conf\n")) {
+		t.Fail()
+	}
+	if IsFluentdConfig([]byte("; forwarder\n[fluentd-forwarder]\nto = fluent://remote.local:24224\n")) || IsFluentdConfig([]byte("")) {
+		t.Fail()
+	}
+}
+
+func Test_ReadFluentdConfig(t *testing.T) {
+	sections, err := ReadFluentdConfig("fluent.conf", []byte(`
+# comments and blank lines are skipped
+<system>
+  log_level warn
+</system>
+
+<source>
+  @type forward
+  port 24225
+  @label @APP
+</source>
+
+<filter app.**>
+  @type fields
+  remove debug_info # trailing comment
+</filter>
+
+<label @APP>
+  <match app.access app.error.**>
+    @type forward
+    @id aggregator
+    <server>
+      host aggregator.local
+    </server>
+    <buffer>
+      @type file
+      path /var/lib/fluentd-forwarder/aggregator
+      flush_interval 60
+      chunk_limit_size 8m
+      retry_wait 1.5m
+    </buffer>
+  </match>
+  <match **>
+    @type test-recording
+    message "hello \"world\"\n"
+    fields ["a",
+            "b"]
+  </match>
+</label>
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	summary := configSummary(sections)
+	expected := []string{
+		`fluentd-forwarder log-level=warning`,
+		`input "forward" type=forward port=24225 label=@APP listen-on=0.0.0.0:24225`,
+		`filter "app.**" match=app.** type=fields remove=debug_info`,
+		`output "aggregator" match=app.access app.error.** type=forward to=aggregator.local:24224 buffer-path=/var/lib/fluentd-forwarder/aggregator flush-interval=60s buffer-chunk-limit=8388608 retry-interval=1.5m label=@APP`,
+		"output \"**\" match=** type=test-recording message=hello \"world\"\n fields=[\"a\",\n            \"b\"] label=@APP",
+	}
+	if !reflect.DeepEqual(summary, expected) {
+		for _, s := range summary {
+			t.Log(s)
+		}
+		t.FailNow()
+	}
+	// the pipeline is built without the default output, discarding the
+	// records sent to the default label
+	logging.InitForTesting(logging.NOTICE)
+	pipeline, err := BuildPipeline(logging.MustGetLogger("fluentd-config"), []*ConfigElement{sections[2], sections[4]}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := pipeline.Label("@APP"); err != nil || len(pipeline.Outputs) != 1 {
+		t.Fail()
+	}
+	err = pipeline.Head().Emit([]FluentRecordSet{{Tag: "app.access", Records: []TinyFluentRecord{{Timestamp: 0, Data: map[string]interface{}{}}}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func Test_ReadFluentdConfig_Errors(t *testing.T) {
+	cases := []struct {
+		src string
+		err string
+	}{
+		{"<source>\n  @type forward\n", "fluent.conf:3: source is not closed"},
+		{"<match **>\n</source>\n", "fluent.conf:2: unexpected </source>"},
+		{"<match **>\n  @include conf.d/*.conf\n</match>\n", "fluent.conf:2: @include is only allowed at the top level"},
+		{"<match **>\n  message \"hello\n</match>\n", "fluent.conf:2: unterminated quoted value"},
+		{"<match **>\n  @type forward\n  <server>\n    host a\n  </server>\n  <server>\n    host b\n  </server>\n</match>\n", `output "**": only one <server> is supported`},
+		{"<worker 0>\n</worker>\n", "fluent.conf: unknown directive: <worker>"},
+		{"<label @A>\n  <source>\n  </source>\n</label>\n", "<source> is not allowed in label @A"},
+	}
+	for _, c := range cases {
+		_, err := ReadFluentdConfig("fluent.conf", []byte(c.src))
+		if err == nil || err.Error() != c.err {
+			t.Errorf("%q: expected %s, got %v", c.src, c.err, err)
+		}
+	}
+}
+
+func Test_FluentdTimeAndSize(t *testing.T) {
+	for s, expected := range map[string]string{"60": "60s", "1.5m": "1.5m", "1d": "24h", "0.5d": "12h", "10s": "10s", "1h30m": "1h30m"} {
+		if v := fluentdTime(s); v != expected {
+			t.Errorf("%s: expected %s, got %s", s, expected, v)
+		}
+	}
+	for s, expected := range map[string]string{"1024": "1024", "8m": "8388608", "1k": "1024", "1G": "1073741824", "8mb": "8mb"} {
+		if v := fluentdSize(s); v != expected {
+			t.Errorf("%s: expected %s, got %s", s, expected, v)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// includedConfigFiles returns the files the pattern of an include section
+// matches, relative to the directory of the including file, which has to be
+// local then.  A directory stands for the files in it, the hidden files are
+// skipped, and the files are sorted by the path so that they are merged in a
+// deterministic order.
+func includedConfigFiles(filename string, pattern string) ([]string, error) {
+	if !filepath.IsAbs(pattern) {
+		if IsRemoteConfig(filename) {
+			return nil, errors.New("a remote configuration can only include the files by the absolute paths")
+		}
+		pattern = filepath.Join(filepath.Dir(filename), pattern)
+	}
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		_, err := os.Stat(pattern)
+		return nil, err
+	}
+	sort.Strings(paths)
+	retval := make([]string, 0, len(paths))
+	for _, path := range paths {
+		// hidden unless asked for, as the shells do
+		if strings.HasPrefix(filepath.Base(path), ".") && !strings.HasPrefix(filepath.Base(pattern), ".") {
+			continue
+		}
+		finfo, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !finfo.IsDir() {
+			retval = append(retval, path)
+			continue
+		}
+		finfos, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		// sorted by the name
+		for _, finfo := range finfos {
+			if finfo.IsDir() || strings.HasPrefix(finfo.Name(), ".") {
+				continue
+			}
+			retval = append(retval, filepath.Join(path, finfo.Name()))
+		}
+	}
+	return retval, nil
+}
+
+// expandConfigIncludes replaces the include sections with the sections of
+// the files they match, each read in the format of its own; including
+// holds the absolute paths of the files being read, so as not to loop.
+func expandConfigIncludes(filename string, sections []*ConfigElement, including []string) ([]*ConfigElement, error) {
+	retval := make([]*ConfigElement, 0, len(sections))
+	for _, section := range sections {
+		if section.Name != "include" {
+			retval = append(retval, section)
+			continue
+		}
+		if section.Arg == "" || len(section.Keys) > 0 {
+			return nil, errors.New(fmt.Sprintf("%s: %s: include takes only the path of the files", filename, section.String()))
+		}
+		paths, err := includedConfigFiles(filename, section.Arg)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s: %s", filename, section.String(), err.Error()))
+		}
+		for _, path := range paths {
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range including {
+				if p == abs {
+					return nil, errors.New(fmt.Sprintf("%s: %s: %s includes itself", filename, section.String(), path))
+				}
+			}
+			src, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("%s: %s: %s", filename, section.String(), err.Error()))
+			}
+			included, err := parseConfig(path, src)
+			if err != nil {
+				return nil, err
+			}
+			included, err = expandConfigIncludes(path, included, append(including, abs))
+			if err != nil {
+				return nil, err
+			}
+			retval = append(retval, included...)
+		}
+	}
+	return retval, nil
+}
@@ -0,0 +1,111 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_ConfigInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "include")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string, src string) string {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte(src), 0644)
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return path
+	}
+	write("conf.d/20-b.conf", "[output \"b\"]\ntype = test-recording\nmatch = b.**\n")
+	write("conf.d/10-a.yaml", "outputs:\n  - name: a\n    type: test-recording\n    match: a.**\n")
+	write("conf.d/ignored.txt", "")
+	write("conf.d/.hidden.conf", "broken")
+	write("apps/x.conf", "<match x.**>\n  @type test-recording\n</match>\n")
+	write("apps/sub/y.conf", "broken")
+	read := func(name string) ([]*ConfigElement, error) {
+		path := filepath.Join(dir, name)
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return ParseConfig(path, src)
+	}
+
+	write("main.conf", `
+[include "conf.d/*.conf"]
+[include "conf.d/*.yaml"]
+[include "apps"]
+[output "all"]
+type = test-recording
+`)
+	sections, err := read("main.conf")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	names := make([]string, 0)
+	for _, section := range sections {
+		names = append(names, section.String())
+	}
+	if strings.Join(names, ", ") != `output "b", output "a", output "x.**", output "all"` {
+		t.Fatalf("unexpected sections: %v", names)
+	}
+
+	write("main.conf", "<match all>\n  @type test-recording\n</match>\n@include conf.d/*.conf\n")
+	sections, err = read("main.conf")
+	if err != nil || len(sections) != 2 || sections[1].Arg != "b" {
+		t.Fatalf("unexpected sections: %v, %v", sections, err)
+	}
+	write("main.yaml", "include: [conf.d/*.yaml]\noutputs:\n  - name: all\n    type: test-recording\n")
+	sections, err = read("main.yaml")
+	if err != nil || len(sections) != 2 || sections[0].Arg != "a" {
+		t.Fatalf("unexpected sections: %v, %v", sections, err)
+	}
+	write("main.conf", "[include \"conf.d/*.none\"]\n")
+	sections, err = read("main.conf")
+	if err != nil || len(sections) != 0 {
+		t.Fatalf("unexpected sections: %v, %v", sections, err)
+	}
+
+	write("loop.conf", "[include \"loop.conf\"]\n")
+	_, err = read("loop.conf")
+	if err == nil || !strings.HasSuffix(err.Error(), "loop.conf includes itself") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	write("main.conf", "[include \"missing.conf\"]\n")
+	_, err = read("main.conf")
+	if err == nil || !strings.Contains(err.Error(), `main.conf: include "missing.conf": `) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	write("main.conf", "[include \"apps/sub/y.conf\"]\n")
+	_, err = read("main.conf")
+	if err == nil || !strings.HasPrefix(err.Error(), filepath.Join(dir, "apps/sub/y.conf")+":1:") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
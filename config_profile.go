@@ -0,0 +1,174 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+)
+
+// The parameters of the sections of a profile telling how to merge them,
+// which are not merged themselves.
+const (
+	// removes the section from the base configuration
+	ProfileRemoveKey = "profile-remove"
+	// removes the parameters listed from the section
+	ProfileUnsetKey = "profile-unset"
+)
+
+var profileNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// profileFileName inserts the profile before the extension of the name.
+func profileFileName(name string, profile string) string {
+	ext := path.Ext(name)
+	return name[:len(name)-len(ext)] + "." + profile + ext
+}
+
+// ProfileConfigLocation returns the location of the configuration of the
+// profile overriding the configuration at the location, which is the file
+// or the last element of the path of the URL with the profile inserted
+// before the extension: forwarder.prod.cfg for forwarder.cfg in the prod
+// profile.
+func ProfileConfigLocation(location string, profile string) (string, error) {
+	if !profileNameRegexp.MatchString(profile) {
+		return "", errors.New(fmt.Sprintf("invalid profile name: %s", profile))
+	}
+	if !IsRemoteConfig(location) {
+		dir, name := filepath.Split(location)
+		return dir + profileFileName(name, profile), nil
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	dir, name := path.Split(u.Path)
+	if name == "" {
+		return "", errors.New(fmt.Sprintf("%s: no name to derive the location of the profile from", RedactConfigLocation(location)))
+	}
+	u.Path = dir + profileFileName(name, profile)
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+func copyConfigElement(elem *ConfigElement) *ConfigElement {
+	retval := NewConfigElement(elem.Name, elem.Arg)
+	for _, key := range elem.Keys {
+		retval.Keys = append(retval.Keys, key)
+		retval.Params[key] = append([]string(nil), elem.Params[key]...)
+	}
+	retval.Elements = append(retval.Elements, elem.Elements...)
+	return retval
+}
+
+// MergeConfigProfile returns the sections of the configuration overridden
+// by the sections of a profile, leaving both as they are.  The sections are
+// identified by the kind and the name, as [output "ticket"], and a section
+// of the profile replaces all the values of each of its parameters in the
+// section of the same identity, keeping the rest of the parameters and the
+// position of the section.  The parameters of a section appearing more than
+// once, as the fluentd-forwarder section of the included files, are taken
+// out of all but the first of them.  profile-remove = true removes the
+// section, profile-unset lists the parameters to remove from it, and the
+// sections of the profile not in the configuration are added after the
+// others in their order.
+func MergeConfigProfile(sections []*ConfigElement, overrides []*ConfigElement) ([]*ConfigElement, error) {
+	retval := make([]*ConfigElement, 0, len(sections)+len(overrides))
+	for _, section := range sections {
+		retval = append(retval, copyConfigElement(section))
+	}
+	for _, override := range overrides {
+		matched := make([]*ConfigElement, 0, 1)
+		for _, section := range retval {
+			if section.Name == override.Name && section.Arg == override.Arg {
+				matched = append(matched, section)
+			}
+		}
+		remove, err := override.GetBool(ProfileRemoveKey, false)
+		if err != nil {
+			return nil, err
+		}
+		if remove {
+			if len(override.Keys) > 1 {
+				return nil, errors.New(fmt.Sprintf("%s: %s takes no other parameter", override.String(), ProfileRemoveKey))
+			}
+			if len(matched) == 0 {
+				return nil, errors.New(fmt.Sprintf("%s: no such section to remove", override.String()))
+			}
+			kept := retval[:0]
+			for _, section := range retval {
+				if section.Name != override.Name || section.Arg != override.Arg {
+					kept = append(kept, section)
+				}
+			}
+			retval = kept
+			continue
+		}
+		unset := override.GetList(ProfileUnsetKey)
+		if len(matched) == 0 {
+			if len(unset) > 0 {
+				return nil, errors.New(fmt.Sprintf("%s: no such section to unset the parameters of", override.String()))
+			}
+			section := copyConfigElement(override)
+			section.Unset(ProfileRemoveKey)
+			retval = append(retval, section)
+			continue
+		}
+		for _, key := range unset {
+			for _, section := range matched {
+				section.Unset(key)
+			}
+		}
+		for _, key := range override.Keys {
+			if key == ProfileRemoveKey || key == ProfileUnsetKey {
+				continue
+			}
+			for _, section := range matched[1:] {
+				section.Unset(key)
+			}
+			section := matched[0]
+			if _, ok := section.Params[key]; !ok {
+				section.Keys = append(section.Keys, key)
+			}
+			section.Params[key] = append([]string(nil), override.Params[key]...)
+		}
+	}
+	return retval, nil
+}
+
+// ReadConfigProfile reads the configuration of the profile overriding the
+// configuration at the location, and merges it into the sections.
+func ReadConfigProfile(location string, profile string, sections []*ConfigElement) ([]*ConfigElement, error) {
+	profileLocation, err := ProfileConfigLocation(location, profile)
+	if err != nil {
+		return nil, err
+	}
+	src, err := ReadConfigSource(profileLocation)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("profile %s: %s", profile, err.Error()))
+	}
+	overrides, err := ParseConfig(RedactConfigLocation(profileLocation), src)
+	if err != nil {
+		return nil, err
+	}
+	return MergeConfigProfile(sections, overrides)
+}
@@ -0,0 +1,162 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// formatSections formats the sections with their parameters in order.
+func formatSections(sections []*ConfigElement) string {
+	lines := make([]string, 0)
+	for _, section := range sections {
+		params := make([]string, 0)
+		for _, key := range section.Keys {
+			params = append(params, key+"="+strings.Join(section.GetAll(key), "|"))
+		}
+		lines = append(lines, section.String()+" "+strings.Join(params, " "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func Test_MergeConfigProfile(t *testing.T) {
+	base, err := ParseConfig("base.cfg", []byte(`
+[fluentd-forwarder]
+log-level = INFO
+plugin = a.so
+[filter "drop"]
+type = grep
+match = **
+exclude = level ^debug$
+[output "main"]
+type = forward
+to = fluent://dev-collector:24224
+flush-interval = 5s
+tag-substitute = ^a b
+tag-substitute = ^c d
+[output "debug"]
+type = stdout
+[fluentd-forwarder]
+plugin = b.so
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	baseFormatted := formatSections(base)
+	overrides, err := ParseConfig("base.prod.cfg", []byte(`
+[output "main"]
+to = fluent://collector:24224
+tag-substitute = ^x y
+profile-unset = flush-interval
+[output "debug"]
+profile-remove = true
+[fluentd-forwarder]
+log-level = WARNING
+plugin = c.so
+[output "archive"]
+type = forward
+to = fluent://archive:24224
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	merged, err := MergeConfigProfile(base, overrides)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := `fluentd-forwarder log-level=WARNING plugin=c.so
+filter "drop" type=grep match=** exclude=level ^debug$
+output "main" type=forward to=fluent://collector:24224 tag-substitute=^x y
+fluentd-forwarder 
+output "archive" type=forward to=fluent://archive:24224`
+	if formatSections(merged) != expected {
+		t.Errorf("%s", formatSections(merged))
+	}
+	// the base is left as it is
+	if formatSections(base) != baseFormatted {
+		t.Errorf("%s", formatSections(base))
+	}
+	for _, src := range []string{
+		"[output \"none\"]\nprofile-remove = true\n",
+		"[output \"main\"]\nprofile-remove = true\nto = x\n",
+		"[output \"none\"]\nprofile-unset = to\n",
+		"[output \"main\"]\nprofile-remove = maybe\n",
+	} {
+		overrides, err := ParseConfig("base.prod.cfg", []byte(src))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_, err = MergeConfigProfile(base, overrides)
+		if err == nil {
+			t.Errorf("no error: %s", src)
+		}
+	}
+}
+
+func Test_ReadConfigProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profile")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "forwarder.cfg")
+	base, err := ParseConfig(path, []byte("[output \"main\"]\ntype = forward\nto = fluent://dev:24224\n"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = ReadConfigProfile(path, "staging", base)
+	if err == nil || !strings.Contains(err.Error(), "profile staging") {
+		t.Errorf("%v", err)
+	}
+	_, err = ReadConfigProfile(path, "../prod", base)
+	if err == nil || err.Error() != "invalid profile name: ../prod" {
+		t.Errorf("%v", err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "forwarder.prod.cfg"), []byte("[output \"main\"]\nto = fluent://prod:24224\n"), 0644)
+	merged, err := ReadConfigProfile(path, "prod", base)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if formatSections(merged) != `output "main" type=forward to=fluent://prod:24224` {
+		t.Errorf("%s", formatSections(merged))
+	}
+}
+
+func Test_ProfileConfigLocation(t *testing.T) {
+	for location, expected := range map[string]string{
+		"forwarder.cfg":                                 "forwarder.prod.cfg",
+		"/etc/fluentd-forwarder/forwarder.yaml":         "/etc/fluentd-forwarder/forwarder.prod.yaml",
+		"/etc/fluentd-forwarder.d/forwarder":            "/etc/fluentd-forwarder.d/forwarder.prod",
+		"https://config.example.com/forwarder.toml?v=1": "https://config.example.com/forwarder.prod.toml?v=1",
+		"consul://127.0.0.1:8500/forwarder/config":      "consul://127.0.0.1:8500/forwarder/config.prod",
+	} {
+		actual, err := ProfileConfigLocation(location, "prod")
+		if err != nil || actual != expected {
+			t.Errorf("%s: %s %v", location, actual, err)
+		}
+	}
+	_, err := ProfileConfigLocation("https://config.example.com/", "prod")
+	if err == nil {
+		t.Error("no error")
+	}
+}
@@ -0,0 +1,272 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var remoteConfigClient = &http.Client{Timeout: 30 * time.Second}
+
+// IsRemoteConfig tells whether the configuration is to be fetched from a
+// URL rather than read from a file: http:// and https:// for a web server,
+// etcd:// and etcd+https:// for a key of etcd, and consul:// and
+// consul+https:// for a key of the KV store of Consul.
+func IsRemoteConfig(location string) bool {
+	for _, prefix := range []string{"http://", "https://", "etcd://", "etcd+https://", "consul://", "consul+https://"} {
+		if strings.HasPrefix(location, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteConfigRequest(req *http.Request) ([]byte, error) {
+	resp, err := remoteConfigClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(body))))
+	}
+	return body, nil
+}
+
+// remoteConfigEndpoint returns the URL of the path on the server of the
+// location, over HTTPS if the scheme ends in "+https".
+func remoteConfigEndpoint(u *url.URL, path string) *url.URL {
+	scheme := "http"
+	if strings.HasSuffix(u.Scheme, "+https") {
+		scheme = "https"
+	}
+	return &url.URL{Scheme: scheme, Host: u.Host, Path: path}
+}
+
+func etcdRequest(u *url.URL, path string, token string, body interface{}, v interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", remoteConfigEndpoint(u, path).String(), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := remoteConfigRequest(req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(resp, v)
+}
+
+// fetchEtcdConfig fetches the value of the key through the JSON gateway of
+// etcd v3, authenticating as the user of the URL if any.
+func fetchEtcdConfig(u *url.URL) ([]byte, error) {
+	token := ""
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth := struct {
+			Token string `json:"token"`
+		}{}
+		err := etcdRequest(u, "/v3/auth/authenticate", "", map[string]string{"name": u.User.Username(), "password": password}, &auth)
+		if err != nil {
+			return nil, err
+		}
+		token = auth.Token
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	result := struct {
+		Kvs []struct {
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}{}
+	err := etcdRequest(u, "/v3/kv/range", token, map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(key))}, &result)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Kvs) == 0 {
+		return nil, errors.New(fmt.Sprintf("etcd has no key %s", key))
+	}
+	return base64.StdEncoding.DecodeString(result.Kvs[0].Value)
+}
+
+// fetchConsulConfig fetches the value of the key from the KV store of
+// Consul, with the token in CONSUL_HTTP_TOKEN if set.  The query of the URL,
+// such as dc=DATACENTER, is passed on.
+func fetchConsulConfig(u *url.URL) ([]byte, error) {
+	endpoint := remoteConfigEndpoint(u, "/v1/kv/"+strings.TrimPrefix(u.Path, "/"))
+	query := u.Query()
+	query.Set("raw", "")
+	endpoint.RawQuery = query.Encode()
+	req, err := http.NewRequest("GET", endpoint.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	return remoteConfigRequest(req)
+}
+
+// FetchRemoteConfig fetches the configuration from the location, for which
+// IsRemoteConfig holds.
+func FetchRemoteConfig(location string) ([]byte, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		req, err := http.NewRequest("GET", location, nil)
+		if err != nil {
+			return nil, err
+		}
+		return remoteConfigRequest(req)
+	case "etcd", "etcd+https":
+		return fetchEtcdConfig(u)
+	case "consul", "consul+https":
+		return fetchConsulConfig(u)
+	}
+	return nil, errors.New(fmt.Sprintf("unsupported configuration location: %s", location))
+}
+
+// RedactConfigLocation removes the credentials from the location of the
+// configuration, so that it can be logged and reported in the errors.
+func RedactConfigLocation(location string) string {
+	return redactConfigValue("config", location)
+}
+
+// ReadConfigSource reads the configuration from the file, or fetches it if
+// it is remote.
+func ReadConfigSource(location string) ([]byte, error) {
+	if IsRemoteConfig(location) {
+		src, err := FetchRemoteConfig(location)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s", RedactConfigLocation(location), err.Error()))
+		}
+		return src, nil
+	}
+	return ioutil.ReadFile(location)
+}
+
+// ConfigPoller fetches the remote configuration periodically, calling
+// changed when its checksum differs from the last one fetched so that the
+// configuration is reloaded.  The configuration is fetched once on start to
+// take the checksum of the one in effect.
+type ConfigPoller struct {
+	logger         *logging.Logger
+	location       string
+	interval       time.Duration
+	changed        func()
+	checksum       [sha256.Size]byte
+	hasChecksum    bool
+	wg             sync.WaitGroup
+	shutdownChan   chan struct{}
+	isShuttingDown uintptr
+}
+
+func (poller *ConfigPoller) String() string {
+	return "config-poller"
+}
+
+// poll fetches the configuration and tells whether it has changed.  The
+// failures are only logged, keeping the configuration in effect.
+func (poller *ConfigPoller) poll() bool {
+	src, err := FetchRemoteConfig(poller.location)
+	if err != nil {
+		poller.logger.Errorf("%s: failed to fetch %s: %s", LogComponent(poller.String()), RedactConfigLocation(poller.location), LogError(err))
+		return false
+	}
+	checksum := sha256.Sum256(src)
+	changed := poller.hasChecksum && checksum != poller.checksum
+	poller.checksum = checksum
+	poller.hasChecksum = true
+	return changed
+}
+
+func (poller *ConfigPoller) Start() {
+	poller.wg.Add(1)
+	go func() {
+		defer poller.wg.Done()
+		poller.poll()
+		ticker := time.NewTicker(poller.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if poller.poll() {
+					poller.logger.Noticef("%s has changed; reloading the configuration", RedactConfigLocation(poller.location))
+					poller.changed()
+				}
+			case <-poller.shutdownChan:
+				return
+			}
+		}
+	}()
+}
+
+func (poller *ConfigPoller) Stop() {
+	if atomic.CompareAndSwapUintptr(&poller.isShuttingDown, 0, 1) {
+		poller.shutdownChan <- struct{}{}
+	}
+}
+
+func (poller *ConfigPoller) WaitForShutdown() {
+	poller.wg.Wait()
+}
+
+func NewConfigPoller(logger *logging.Logger, location string, interval time.Duration, changed func()) (*ConfigPoller, error) {
+	if !IsRemoteConfig(location) {
+		return nil, errors.New(fmt.Sprintf("%s is not a remote configuration", location))
+	}
+	if interval <= 0 {
+		return nil, errors.New("config poll interval must be positive")
+	}
+	return &ConfigPoller{
+		logger:         logger,
+		location:       location,
+		interval:       interval,
+		changed:        changed,
+		wg:             sync.WaitGroup{},
+		shutdownChan:   make(chan struct{}, 1),
+		isShuttingDown: 0,
+	}, nil
+}
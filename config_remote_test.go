@@ -0,0 +1,145 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	logging "github.com/op/go-logging"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_FetchRemoteConfig(t *testing.T) {
+	const src = "[output \"out\"]\ntype = forward\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/forwarder.cfg":
+			w.Write([]byte(src))
+		case r.URL.Path == "/v3/auth/authenticate":
+			auth := map[string]string{}
+			json.NewDecoder(r.Body).Decode(&auth)
+			if auth["name"] != "root" || auth["password"] != "pass" {
+				http.Error(w, "authentication failed", http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"token": "abc"})
+		case r.URL.Path == "/v3/kv/range":
+			if r.Header.Get("Authorization") != "abc" {
+				http.Error(w, "user name is empty", http.StatusUnauthorized)
+				return
+			}
+			req := map[string]string{}
+			json.NewDecoder(r.Body).Decode(&req)
+			key, _ := base64.StdEncoding.DecodeString(req["key"])
+			if string(key) != "forwarder/config" {
+				json.NewEncoder(w).Encode(map[string]interface{}{})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"kvs": []map[string]string{{"value": base64.StdEncoding.EncodeToString([]byte(src))}}})
+		case r.URL.Path == "/v1/kv/forwarder/config":
+			if _, ok := r.URL.Query()["raw"]; !ok || r.URL.Query().Get("dc") != "dc1" {
+				http.Error(w, "bad query", http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(src))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	for _, location := range []string{
+		server.URL + "/forwarder.cfg",
+		"etcd://root:pass@" + host + "/forwarder/config",
+		"consul://" + host + "/forwarder/config?dc=dc1",
+	} {
+		if !IsRemoteConfig(location) {
+			t.Errorf("%s is not taken as remote", location)
+		}
+		b, err := ReadConfigSource(location)
+		if err != nil {
+			t.Errorf("%s: %s", location, err.Error())
+		} else if string(b) != src {
+			t.Errorf("%s: unexpected configuration: %q", location, string(b))
+		}
+	}
+	for _, location := range []string{
+		server.URL + "/missing.cfg",
+		"etcd://root:wrong@" + host + "/forwarder/config",
+		"etcd://root:pass@" + host + "/missing",
+	} {
+		_, err := ReadConfigSource(location)
+		if err == nil {
+			t.Errorf("%s: fetched", location)
+		} else if strings.Contains(err.Error(), "wrong") {
+			t.Errorf("the password is in the error: %s", err.Error())
+		}
+	}
+	if IsRemoteConfig("/etc/fluentd-forwarder.cfg") {
+		t.Fail()
+	}
+	_, err := ParseConfig(server.URL+"/forwarder.cfg", []byte("[include \"conf.d/*.cfg\"]\n"))
+	if err == nil {
+		t.Error("a remote configuration includes the files relative to it")
+	}
+}
+
+func Test_ConfigPoller(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("config")
+	version := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&version) < 0 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte{byte('0' + atomic.LoadInt32(&version))})
+	}))
+	defer server.Close()
+	changes := make(chan struct{}, 10)
+	poller, err := NewConfigPoller(logger, server.URL, time.Hour, func() { changes <- struct{}{} })
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if poller.poll() {
+		t.Error("the first fetch is taken as a change")
+	}
+	if poller.poll() {
+		t.Error("the same configuration is taken as a change")
+	}
+	atomic.StoreInt32(&version, -1)
+	if poller.poll() {
+		t.Error("a failed fetch is taken as a change")
+	}
+	atomic.StoreInt32(&version, 1)
+	if !poller.poll() {
+		t.Error("the change is not detected")
+	}
+	if poller.poll() {
+		t.Error("the change is detected twice")
+	}
+	if _, err := NewConfigPoller(logger, "/etc/fluentd-forwarder.cfg", time.Minute, nil); err == nil {
+		t.Error("a local file is polled")
+	}
+}
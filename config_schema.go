@@ -0,0 +1,309 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"strconv"
+)
+
+// The types of the parameters, each of which may also be given as a string
+// referring to an environment variable or a secret.
+const (
+	ParamString   = "string"
+	ParamInteger  = "integer"
+	ParamNumber   = "number"
+	ParamBoolean  = "boolean"
+	ParamDuration = "duration"
+	// comma-separated values, or a list of them
+	ParamList = "list"
+)
+
+// ConfigSchemaID identifies the schema ConfigSchema returns.
+const ConfigSchemaID = "https://github.com/fluent/fluentd-forwarder/config.schema.json"
+
+// ParamSchema describes a parameter of a component or a setting.  Default
+// is the default value as written in the configuration, and Repeated tells
+// whether the parameter may be given more than once.
+type ParamSchema struct {
+	Name        string
+	Type        string
+	Description string
+	Default     string
+	Enum        []string
+	Required    bool
+	Repeated    bool
+}
+
+// the parameters every output takes
+var outputParams = []ParamSchema{
+	{Name: "remove-tag-prefix", Type: ParamString, Description: "prefix removed from the tags"},
+	{Name: "tag-substitute", Type: ParamString, Description: "/REGEXP/REPLACEMENT/ applied to the tags", Repeated: true},
+	{Name: "add-tag-prefix", Type: ParamString, Description: "prefix added to the tags"},
+	{Name: "time-key", Type: ParamString, Description: "field the time of the records is stored in"},
+	{Name: "time-format", Type: ParamString, Description: "epoch, epoch-millis, rfc3339, a strftime pattern or a Go layout of the time stored in time-key", Default: TimeFormatRFC3339},
+	{Name: "timezone", Type: ParamString, Description: "timezone of the time stored in time-key, such as Asia/Tokyo or +09:00", Default: "UTC"},
+}
+
+// the definitions of the types of the parameters, referred to as
+// #/$defs/TYPE
+func paramTypeDefinitions() map[string]interface{} {
+	reference := map[string]interface{}{"$ref": "#/$defs/reference"}
+	return map[string]interface{}{
+		"reference": map[string]interface{}{
+			"description": "${NAME} or ${NAME:-fallback} replaced with the environment variable, or a secret such as ${file:PATH}",
+			"type":        "string",
+			"pattern":     `\$\{`,
+		},
+		ParamString: map[string]interface{}{"type": "string"},
+		ParamInteger: map[string]interface{}{
+			"anyOf": []interface{}{
+				map[string]interface{}{"type": "integer"},
+				map[string]interface{}{"type": "string", "pattern": `^[+-]?[0-9]+$`},
+				reference,
+			},
+		},
+		ParamNumber: map[string]interface{}{
+			"anyOf": []interface{}{
+				map[string]interface{}{"type": "number"},
+				map[string]interface{}{"type": "string", "pattern": `^[+-]?([0-9]+(\.[0-9]*)?|\.[0-9]+)([eE][+-]?[0-9]+)?$`},
+				reference,
+			},
+		},
+		ParamBoolean: map[string]interface{}{
+			"anyOf": []interface{}{
+				map[string]interface{}{"type": "boolean"},
+				map[string]interface{}{"enum": []interface{}{0, 1, "true", "yes", "on", "1", "false", "no", "off", "0"}},
+				reference,
+			},
+		},
+		ParamDuration: map[string]interface{}{
+			"description": "duration such as 300ms, 10s or 1h30m",
+			"anyOf": []interface{}{
+				map[string]interface{}{"const": 0},
+				map[string]interface{}{"type": "string", "pattern": `^[+-]?(0|(([0-9]+(\.[0-9]*)?|\.[0-9]+)(ns|us|µs|μs|ms|s|m|h))+)$`},
+				reference,
+			},
+		},
+		ParamList: map[string]interface{}{
+			"anyOf": []interface{}{
+				map[string]interface{}{"type": "string"},
+				map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+			},
+		},
+	}
+}
+
+// defaultValue returns the default in the type of the parameter, or in the
+// string as written if it does not parse.
+func (param *ParamSchema) defaultValue() interface{} {
+	switch param.Type {
+	case ParamInteger:
+		if v, err := strconv.ParseInt(param.Default, 10, 64); err == nil {
+			return v
+		}
+	case ParamNumber:
+		if v, err := strconv.ParseFloat(param.Default, 64); err == nil {
+			return v
+		}
+	case ParamBoolean:
+		if v, err := strconv.ParseBool(param.Default); err == nil {
+			return v
+		}
+	}
+	return param.Default
+}
+
+func (param *ParamSchema) schema() map[string]interface{} {
+	retval := map[string]interface{}{}
+	if param.Type == "" || param.Type == ParamString {
+		retval["type"] = "string"
+	} else {
+		retval["$ref"] = "#/$defs/" + param.Type
+	}
+	if len(param.Enum) > 0 {
+		enum := make([]interface{}, 0, len(param.Enum))
+		for _, v := range param.Enum {
+			enum = append(enum, v)
+		}
+		delete(retval, "type")
+		delete(retval, "$ref")
+		retval["anyOf"] = []interface{}{
+			map[string]interface{}{"enum": enum},
+			map[string]interface{}{"$ref": "#/$defs/reference"},
+		}
+	}
+	if param.Repeated {
+		retval = map[string]interface{}{
+			"anyOf": []interface{}{retval, map[string]interface{}{"type": "array", "items": retval}},
+		}
+	}
+	if param.Description != "" {
+		retval["description"] = param.Description
+	}
+	if param.Default != "" {
+		retval["default"] = param.defaultValue()
+	}
+	return retval
+}
+
+// paramsSchema returns the schema of a map of the parameters, which takes
+// no others.
+func paramsSchema(params []ParamSchema) map[string]interface{} {
+	properties := make(map[string]interface{}, len(params))
+	required := make([]interface{}, 0)
+	for _, param := range params {
+		properties[param.Name] = param.schema()
+		if param.Required {
+			required = append(required, param.Name)
+		}
+	}
+	retval := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		retval["required"] = required
+	}
+	return retval
+}
+
+// sectionSchema returns the schema of a listener, a filter or an output in
+// YAML and TOML, whose params are checked by the parameters of its type if
+// registered.
+func sectionSchema(kind string, types []string, params map[string][]ParamSchema) map[string]interface{} {
+	enum := make([]interface{}, 0, len(types))
+	for _, typ := range types {
+		enum = append(enum, typ)
+	}
+	properties := map[string]interface{}{
+		"name":   map[string]interface{}{"type": "string", "minLength": 1, "description": "name of the " + kind},
+		"type":   map[string]interface{}{"enum": enum, "description": "type of the " + kind},
+		"label":  map[string]interface{}{"type": "string", "description": "label the " + kind + " belongs to"},
+		"params": map[string]interface{}{"type": "object", "description": "parameters specific to the type"},
+	}
+	switch kind {
+	case "listener":
+		properties["listen-on"] = map[string]interface{}{"type": "string", "description": "address to listen on"}
+	case "filter", "output":
+		where := ParamSchema{Name: "where", Type: ParamString, Description: "condition the events have to satisfy, such as level == error", Repeated: true}
+		properties["match"] = map[string]interface{}{"type": "string", "description": "pattern of the tags of the events taken", "default": "**"}
+		properties["where"] = where.schema()
+	}
+	if kind == "output" {
+		properties["to"] = map[string]interface{}{"type": "string", "description": "destination"}
+		properties["buffer"] = paramsSchema([]ParamSchema{
+			{Name: "path", Type: ParamString, Description: "path of the buffer, as buffer-path"},
+			{Name: "chunk-limit", Type: ParamInteger, Description: "size of a chunk in bytes, as buffer-chunk-limit"},
+			{Name: "flush-interval", Type: ParamDuration, Description: "interval in which the buffer is flushed"},
+			{Name: "flush-timeout", Type: ParamDuration, Description: "time within which the flush of a chunk has to complete"},
+			{Name: "retry-interval", Type: ParamDuration, Description: "interval in which a failed flush is retried"},
+		})
+	}
+	conditions := make([]interface{}, 0, len(params))
+	for _, typ := range types {
+		typeParams, ok := params[typ]
+		if !ok {
+			continue
+		}
+		if kind == "output" {
+			typeParams = append(append([]ParamSchema{}, typeParams...), outputParams...)
+		}
+		conditions = append(conditions, map[string]interface{}{
+			"if": map[string]interface{}{
+				"properties": map[string]interface{}{"type": map[string]interface{}{"const": typ}},
+				"required":   []interface{}{"type"},
+			},
+			"then": map[string]interface{}{
+				"properties": map[string]interface{}{"params": paramsSchema(typeParams)},
+			},
+		})
+	}
+	retval := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             []interface{}{"name", "type"},
+		"additionalProperties": false,
+	}
+	if len(conditions) > 0 {
+		retval["allOf"] = conditions
+	}
+	return retval
+}
+
+// registeredTypes returns the names of the components of the kind
+// registered either by their factories or by their parameters, such as the
+// filters the pipeline makes itself.
+func registeredTypes(factories []string, params map[string][]ParamSchema) []string {
+	types := make(map[string]struct{})
+	for _, name := range factories {
+		types[name] = struct{}{}
+	}
+	for name := range params {
+		types[name] = struct{}{}
+	}
+	return sortedKeys(types)
+}
+
+// ConfigSchema returns the JSON Schema of the configuration in YAML and
+// TOML, with the settings given and the parameters of the components
+// registered so far, including the ones of the plugins loaded.
+func ConfigSchema(settings []ParamSchema) map[string]interface{} {
+	plugins := RegisteredPlugins()
+	registry.mtx.Lock()
+	params := make(map[string]map[string][]ParamSchema, len(registry.params))
+	for kind, m := range registry.params {
+		params[kind] = make(map[string][]ParamSchema, len(m))
+		for name, p := range m {
+			params[kind][name] = p
+		}
+	}
+	registry.mtx.Unlock()
+	list := func(kind string, pluginKind string) map[string]interface{} {
+		return map[string]interface{}{
+			"type":  "array",
+			"items": sectionSchema(kind, registeredTypes(plugins[pluginKind], params[pluginKind]), params[pluginKind]),
+		}
+	}
+	return map[string]interface{}{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"$id":     ConfigSchemaID,
+		"title":   "fluentd-forwarder configuration",
+		"type":    "object",
+		"properties": map[string]interface{}{
+			"settings": paramsSchema(settings),
+			"include": map[string]interface{}{
+				"description": "paths of the files, or the glob patterns, whose sections are included",
+				"anyOf": []interface{}{
+					map[string]interface{}{"type": "string"},
+					map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+				},
+			},
+			"listeners": list("listener", "input"),
+			"filters":   list("filter", "filter"),
+			"outputs":   list("output", "output"),
+			"pipelines": map[string]interface{}{
+				"type":  "array",
+				"items": paramsSchema(append([]ParamSchema{{Name: "name", Type: ParamString, Description: "name of the pipeline", Required: true}}, pipelineParams...)),
+			},
+		},
+		"additionalProperties": false,
+		"$defs":                paramTypeDefinitions(),
+	}
+}
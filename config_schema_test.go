@@ -0,0 +1,143 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"encoding/json"
+	logging "github.com/op/go-logging"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"gopkg.in/yaml.v3"
+	"strings"
+	"testing"
+)
+
+func Test_ConfigSchema(t *testing.T) {
+	b, err := json.Marshal(ConfigSchema([]ParamSchema{
+		{Name: "log-level", Type: ParamString},
+		{Name: "workers", Type: ParamInteger, Default: "1"},
+	}))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	schema, err := jsonschema.CompileString(ConfigSchemaID, string(b))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	validate := func(src string) error {
+		config := make(map[string]interface{})
+		err := yaml.Unmarshal([]byte(src), &config)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		// in the types of JSON
+		b, err := json.Marshal(config)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		v := (interface{})(nil)
+		err = dec.Decode(&v)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return schema.Validate(v)
+	}
+
+	valid := `
+settings:
+  log-level: INFO
+  workers: 2
+include: conf.d/*.yaml
+listeners:
+  - name: forward
+    type: forward
+    listen-on: 0.0.0.0:24224
+    params:
+      protocol: json
+filters:
+  - name: dedup
+    type: dedup
+    match: app.**
+    where: [level == error, exists message]
+    params:
+      keys: [message, host]
+      window: 1m30s
+      max-entries: ${DEDUP_ENTRIES:-1000}
+  - name: errors
+    type: relabel
+    params:
+      to-label: errors
+  - name: unknown-params
+    type: test-filter-without-params
+    params:
+      anything: 1
+outputs:
+  - name: upstream
+    type: forward
+    to: aggregator:24224
+    buffer:
+      path: /var/lib/fluentd-forwarder/upstream
+      chunk-limit: 8388608
+      flush-interval: 10s
+    params:
+      write-timeout: "0"
+      tag-substitute:
+        - /^app\./svc./
+`
+	if err := validate(valid); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, invalid := range []string{
+		"settings:\n  unknown: 1\n",
+		"settings:\n  workers: two\n",
+		"listeners:\n  - name: forward\n    type: forward\n    params:\n      protocol: xml\n",
+		"filters:\n  - type: dedup\n",
+		"filters:\n  - name: dedup\n    type: nonexistent\n",
+		"filters:\n  - name: dedup\n    type: dedup\n    params:\n      window: 30 seconds\n",
+		"filters:\n  - name: dedup\n    type: dedup\n    params:\n      unknown: 1\n",
+		"filters:\n  - name: retag\n    type: retag\n    params:\n      missing: x\n",
+		"filters:\n  - name: split\n    type: split\n    params:\n      key: items\n      keep-parent: maybe\n",
+		"outputs:\n  - name: upstream\n    type: forward\n    buffer:\n      size: 1\n",
+		"outputs:\n  - name: upstream\n    type: forward\n    params:\n      buffer-chunk-limit: 8m\n",
+		"listener:\n  - name: forward\n",
+	} {
+		if err := validate(invalid); err == nil {
+			t.Logf("%s", invalid)
+			t.Fail()
+		}
+	}
+}
+
+func Test_RegisterFilterParams_Twice(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(r.(string), "registered twice") {
+			t.Fail()
+		}
+	}()
+	RegisterFilterParams("dedup")
+}
+
+func init() {
+	RegisterFilter("test-filter-without-params", func(logger *logging.Logger, config *ConfigElement, next Port) (Filter, error) {
+		return nil, nil
+	})
+}
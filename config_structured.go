@@ -0,0 +1,327 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The formats of the configuration files.
+const (
+	ConfigFormatINI     = "ini"
+	ConfigFormatFluentd = "fluentd"
+	ConfigFormatYAML    = "yaml"
+	ConfigFormatTOML    = "toml"
+)
+
+// ConfigFormat tells the format of the configuration by the extension of the
+// file name for YAML and TOML, or by the content for the others.
+func ConfigFormat(filename string, src []byte) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return ConfigFormatYAML
+	case ".toml":
+		return ConfigFormatTOML
+	}
+	if IsFluentdConfig(src) {
+		return ConfigFormatFluentd
+	}
+	return ConfigFormatINI
+}
+
+// parseConfig parses the configuration in the format ConfigFormat tells and
+// substitutes the secrets and the environment variables into the values.
+func parseConfig(filename string, src []byte) ([]*ConfigElement, error) {
+	sections := ([]*ConfigElement)(nil)
+	err := (error)(nil)
+	switch ConfigFormat(filename, src) {
+	case ConfigFormatYAML:
+		sections, err = ReadYAMLConfig(filename, src)
+	case ConfigFormatTOML:
+		sections, err = ReadTOMLConfig(filename, src)
+	case ConfigFormatFluentd:
+		sections, err = ReadFluentdConfig(filename, src)
+	default:
+		sections, err = ReadConfig(filename, src)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = expandConfigEnv(filename, sections)
+	if err != nil {
+		return nil, err
+	}
+	return sections, nil
+}
+
+// ParseConfig parses the configuration in the format ConfigFormat tells,
+// substituting the secrets and the environment variables into the values,
+// and replaces the include sections with the sections of the files they
+// match.
+func ParseConfig(filename string, src []byte) ([]*ConfigElement, error) {
+	sections, err := parseConfig(filename, src)
+	if err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	return expandConfigIncludes(filename, sections, []string{abs})
+}
+
+// structuredSectionKeys are the keys each kind of the sections takes in
+// YAML and TOML, besides the parameters of the plugin given in params.
+var structuredSectionKeys = map[string][]string{
+	"listeners": {"name", "type", "listen-on", "label", "params"},
+	"filters":   {"name", "type", "match", "where", "label", "params"},
+	"outputs":   {"name", "type", "match", "where", "label", "to", "buffer", "params"},
+	"pipelines": {"name", "label", "buffer-limit", "max-connections"},
+}
+
+// structuredSectionNames are the names of the sections of the kinds.
+var structuredSectionNames = map[string]string{
+	"listeners": "input",
+	"filters":   "filter",
+	"outputs":   "output",
+	"pipelines": "pipeline",
+}
+
+// structuredBufferKeys maps the keys of the buffer of an output to the
+// parameters of the output.
+var structuredBufferKeys = map[string]string{
+	"path":           "buffer-path",
+	"chunk-limit":    "buffer-chunk-limit",
+	"flush-interval": "flush-interval",
+	"flush-timeout":  "flush-timeout",
+	"retry-interval": "retry-interval",
+}
+
+// addStructuredValue adds a scalar value, or each of a list of them.
+func addStructuredValue(elem *ConfigElement, key string, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		elem.Add(key, "")
+	case string, bool, int, int64, uint64, float64:
+		elem.Add(key, fmt.Sprint(v))
+	case []interface{}:
+		for _, item := range v {
+			switch item.(type) {
+			case []interface{}, map[string]interface{}:
+				return errors.New(fmt.Sprintf("%s: %s has to be a scalar or a list of scalars", elem.String(), key))
+			}
+			err := addStructuredValue(elem, key, item)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New(fmt.Sprintf("%s: %s has to be a scalar or a list of scalars", elem.String(), key))
+	}
+	return nil
+}
+
+// structuredMap returns the value as a map, which TOML and YAML decode
+// into differently.
+func structuredMap(value interface{}) (map[string]interface{}, bool) {
+	m, ok := value.(map[string]interface{})
+	return m, ok
+}
+
+// structuredList returns the value as a list of maps.
+func structuredList(value interface{}) ([]map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case []map[string]interface{}:
+		return v, true
+	case []interface{}:
+		retval := make([]map[string]interface{}, 0, len(v))
+		for _, item := range v {
+			m, ok := structuredMap(item)
+			if !ok {
+				return nil, false
+			}
+			retval = append(retval, m)
+		}
+		return retval, true
+	}
+	return nil, false
+}
+
+func sortedMapKeys(m map[string]interface{}) []string {
+	retval := make([]string, 0, len(m))
+	for k := range m {
+		retval = append(retval, k)
+	}
+	sort.Strings(retval)
+	return retval
+}
+
+func structuredSection(filename string, kind string, i int, item map[string]interface{}) (*ConfigElement, error) {
+	where := fmt.Sprintf("%s: %s[%d]", filename, kind, i)
+	name, _ := item["name"].(string)
+	if name == "" {
+		return nil, errors.New(fmt.Sprintf("%s: name is not specified", where))
+	}
+	section := NewConfigElement(structuredSectionNames[kind], name)
+	for _, key := range sortedMapKeys(item) {
+		known := false
+		for _, k := range structuredSectionKeys[kind] {
+			known = known || k == key
+		}
+		if !known {
+			return nil, errors.New(fmt.Sprintf("%s: unknown key: %s", where, key))
+		}
+		switch key {
+		case "name":
+		case "params":
+			params, ok := structuredMap(item[key])
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("%s: params has to be a map", where))
+			}
+			for _, param := range sortedMapKeys(params) {
+				err := addStructuredValue(section, param, params[param])
+				if err != nil {
+					return nil, err
+				}
+			}
+		case "buffer":
+			buffer, ok := structuredMap(item[key])
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("%s: buffer has to be a map", where))
+			}
+			for _, bufferKey := range sortedMapKeys(buffer) {
+				param, ok := structuredBufferKeys[bufferKey]
+				if !ok {
+					return nil, errors.New(fmt.Sprintf("%s: unknown key: buffer.%s", where, bufferKey))
+				}
+				err := addStructuredValue(section, param, buffer[bufferKey])
+				if err != nil {
+					return nil, err
+				}
+			}
+		default:
+			err := addStructuredValue(section, key, item[key])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return section, nil
+}
+
+// structuredConfigSections converts the decoded configuration into the
+// sections, checking that no key is unknown.
+func structuredConfigSections(filename string, config map[string]interface{}) ([]*ConfigElement, error) {
+	retval := make([]*ConfigElement, 0)
+	for _, key := range sortedMapKeys(config) {
+		if _, ok := structuredSectionKeys[key]; !ok && key != "settings" && key != "include" {
+			return nil, errors.New(fmt.Sprintf("%s: unknown key: %s", filename, key))
+		}
+	}
+	if value, ok := config["settings"]; ok {
+		settings, ok := structuredMap(value)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("%s: settings has to be a map", filename))
+		}
+		section := NewConfigElement("fluentd-forwarder", "")
+		for _, key := range sortedMapKeys(settings) {
+			err := addStructuredValue(section, key, settings[key])
+			if err != nil {
+				return nil, err
+			}
+		}
+		retval = append(retval, section)
+	}
+	// the included sections come before the ones of the file, so that the
+	// routes dropped in take precedence over the catch-all ones
+	if value, ok := config["include"]; ok {
+		patterns := make([]string, 0)
+		switch v := value.(type) {
+		case string:
+			patterns = append(patterns, v)
+		case []interface{}:
+			for _, item := range v {
+				pattern, ok := item.(string)
+				if !ok {
+					return nil, errors.New(fmt.Sprintf("%s: include has to be a path or a list of paths", filename))
+				}
+				patterns = append(patterns, pattern)
+			}
+		default:
+			return nil, errors.New(fmt.Sprintf("%s: include has to be a path or a list of paths", filename))
+		}
+		for _, pattern := range patterns {
+			retval = append(retval, NewConfigElement("include", pattern))
+		}
+	}
+	// in the order of the pipeline
+	for _, kind := range []string{"listeners", "filters", "outputs", "pipelines"} {
+		value, ok := config[kind]
+		if !ok {
+			continue
+		}
+		items, ok := structuredList(value)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("%s: %s has to be a list of maps", filename, kind))
+		}
+		names := make(map[string]struct{})
+		for i, item := range items {
+			section, err := structuredSection(filename, kind, i, item)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := names[section.Arg]; ok {
+				return nil, errors.New(fmt.Sprintf("%s: %s[%d]: duplicate name: %s", filename, kind, i, section.Arg))
+			}
+			names[section.Arg] = struct{}{}
+			retval = append(retval, section)
+		}
+	}
+	return retval, nil
+}
+
+// ReadYAMLConfig reads the configuration in YAML, which consists of
+// settings, the map of the command-line options, and the lists of the
+// listeners, the filters and the outputs.  The keys of each of them are
+// checked, and the parameters specific to its type go in params.
+func ReadYAMLConfig(filename string, src []byte) ([]*ConfigElement, error) {
+	config := make(map[string]interface{})
+	err := yaml.Unmarshal(src, &config)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", filename, err.Error()))
+	}
+	return structuredConfigSections(filename, config)
+}
+
+// ReadTOMLConfig reads the configuration in TOML, which is structured the
+// same as the one in YAML.
+func ReadTOMLConfig(filename string, src []byte) ([]*ConfigElement, error) {
+	config := make(map[string]interface{})
+	_, err := toml.Decode(string(src), &config)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", filename, err.Error()))
+	}
+	return structuredConfigSections(filename, config)
+}
@@ -0,0 +1,146 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func configSummary(sections []*ConfigElement) []string {
+	retval := make([]string, 0)
+	for _, section := range sections {
+		params := make([]string, 0)
+		for _, key := range section.Keys {
+			params = append(params, key+"="+strings.Join(section.GetAll(key), "|"))
+		}
+		retval = append(retval, section.String()+" "+strings.Join(params, " "))
+	}
+	return retval
+}
+
+func Test_ReadStructuredConfig(t *testing.T) {
+	yamlSections, err := ParseConfig("forwarder.yaml", []byte(`
+settings:
+  log-level: WARNING
+  flush-interval: 10s
+listeners:
+  - name: app
+    listen-on: 127.0.0.1:24225
+    type: forward
+    label: app
+filters:
+  - name: drop-debug
+    type: fields
+    label: app
+    params:
+      remove: [debug_info, trace]
+outputs:
+  - name: aggregator
+    type: forward
+    label: app
+    match: app.**
+    where:
+      - level == ERROR
+    to: aggregator.local:24224
+    buffer:
+      path: /var/lib/fluentd-forwarder/aggregator
+      chunk-limit: 8388608
+    params:
+      accounting-interval: 1m
+      metadata: null
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tomlSections, err := ParseConfig("forwarder.toml", []byte(`
+[settings]
+log-level = "WARNING"
+flush-interval = "10s"
+
+[[listeners]]
+name = "app"
+listen-on = "127.0.0.1:24225"
+type = "forward"
+label = "app"
+
+[[filters]]
+name = "drop-debug"
+type = "fields"
+label = "app"
+params = { remove = ["debug_info", "trace"] }
+
+[[outputs]]
+name = "aggregator"
+type = "forward"
+label = "app"
+match = "app.**"
+where = ["level == ERROR"]
+to = "aggregator.local:24224"
+
+[outputs.buffer]
+path = "/var/lib/fluentd-forwarder/aggregator"
+chunk-limit = 8388608
+
+[outputs.params]
+accounting-interval = "1m"
+metadata = ""
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := []string{
+		`fluentd-forwarder flush-interval=10s log-level=WARNING`,
+		`input "app" label=app listen-on=127.0.0.1:24225 type=forward`,
+		`filter "drop-debug" label=app remove=debug_info|trace type=fields`,
+		`output "aggregator" buffer-chunk-limit=8388608 buffer-path=/var/lib/fluentd-forwarder/aggregator label=app match=app.** accounting-interval=1m metadata= to=aggregator.local:24224 type=forward where=level == ERROR`,
+	}
+	for _, summary := range [][]string{configSummary(yamlSections), configSummary(tomlSections)} {
+		if !reflect.DeepEqual(summary, expected) {
+			for _, s := range summary {
+				t.Log(s)
+			}
+			t.Fail()
+		}
+	}
+}
+
+func Test_ReadStructuredConfig_Errors(t *testing.T) {
+	cases := []struct {
+		filename string
+		src      string
+		err      string
+	}{
+		{"a.yaml", "listener:\n  - name: a\n", "a.yaml: unknown key: listener"},
+		{"a.yaml", "outputs:\n  - name: a\n    buffer-path: /tmp\n", "a.yaml: outputs[0]: unknown key: buffer-path"},
+		{"a.yaml", "outputs:\n  - name: a\n    buffer:\n      size: 1\n", "a.yaml: outputs[0]: unknown key: buffer.size"},
+		{"a.yaml", "filters:\n  - type: fields\n", "a.yaml: filters[0]: name is not specified"},
+		{"a.yaml", "filters:\n  - name: a\n  - name: a\n", "a.yaml: filters[1]: duplicate name: a"},
+		{"a.yaml", "filters:\n  - name: a\n    params:\n      remove:\n        a: b\n", `filter "a": remove has to be a scalar or a list of scalars`},
+		{"a.toml", "[outputs]\nname = \"a\"\n", "a.toml: outputs has to be a list of maps"},
+		{"a.toml", "[[listeners]]\nname = \"a\"\nport = 24224\n", "a.toml: listeners[0]: unknown key: port"},
+	}
+	for _, c := range cases {
+		_, err := ParseConfig(c.filename, []byte(c.src))
+		if err == nil || err.Error() != c.err {
+			t.Errorf("%q: expected %s, got %v", c.src, c.err, err)
+		}
+	}
+}
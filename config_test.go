@@ -0,0 +1,146 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ReadConfig(t *testing.T) {
+	sections, err := ReadConfig("test.conf", []byte("\ufeff"+`; a comment
+[fluentd-forwarder]
+Flush-Interval = 10s
+
+# another comment
+[Filter "drop debug"]
+type = fields
+remove = debug_info
+remove = "trace, span"
+separator = "a \"quoted\"\tvalue\n"
+enabled
+[output]
+type = forward ; trailing comment
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(sections) != 3 {
+		t.Fatalf("%+v", sections)
+	}
+	settings, filter, output := sections[0], sections[1], sections[2]
+	if settings.Name != "fluentd-forwarder" || settings.Arg != "" || settings.Get("flush-interval", "") != "10s" {
+		t.Errorf("%+v", settings)
+	}
+	// the names of the sections and the keys are case-insensitive
+	if filter.Name != "filter" || filter.Arg != "drop debug" || filter.String() != `filter "drop debug"` {
+		t.Errorf("%+v", filter)
+	}
+	if !reflect.DeepEqual(filter.Keys, []string{"type", "remove", "separator", "enabled"}) {
+		t.Errorf("%+v", filter.Keys)
+	}
+	if !reflect.DeepEqual(filter.GetAll("remove"), []string{"debug_info", "trace, span"}) || filter.Get("remove", "") != "trace, span" {
+		t.Errorf("%+v", filter.Params)
+	}
+	if !reflect.DeepEqual(filter.GetList("remove"), []string{"debug_info", "trace", "span"}) {
+		t.Errorf("%+v", filter.GetList("remove"))
+	}
+	if filter.Get("separator", "") != "a \"quoted\"\tvalue\n" {
+		t.Errorf("%q", filter.Get("separator", ""))
+	}
+	// a blank variable is turned on
+	if enabled, err := filter.GetBool("enabled", false); err != nil || !enabled {
+		t.Errorf("%v %v", enabled, err)
+	}
+	if output.Name != "output" || output.String() != "output" || output.Get("type", "") != "forward" {
+		t.Errorf("%+v", output)
+	}
+	if output.Get("missing", "default") != "default" || output.Has("missing") {
+		t.Errorf("%+v", output)
+	}
+}
+
+func Test_ReadConfig_Errors(t *testing.T) {
+	for src, message := range map[string]string{
+		"type = forward\n":             "expected section header",
+		"[output\n":                    "expected right bracket",
+		"[output \"\"]\n":              "empty subsection name",
+		"[]\n":                         "expected section name",
+		"[output] type\n":              "expected EOL, EOF, or comment",
+		"[output]\ntype forward\n":     "expected '='",
+		"[output]\ntype = \"forward\n": "test.conf:2",
+	} {
+		_, err := ReadConfig("test.conf", []byte(src))
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%q: %v", src, err)
+		}
+	}
+}
+
+func Test_ConfigElement_Values(t *testing.T) {
+	section := NewConfigElement("output", "kafka")
+	section.Set("count", "3")
+	section.Set("ratio", "0.5")
+	section.Set("on", "yes")
+	section.Set("interval", "1m")
+	section.Set("bad", "x")
+	if v, err := section.GetInt("count", 0); err != nil || v != 3 {
+		t.Errorf("%v %v", v, err)
+	}
+	if v, err := section.GetInt("missing", 7); err != nil || v != 7 {
+		t.Errorf("%v %v", v, err)
+	}
+	if v, err := section.GetFloat("ratio", 0); err != nil || v != 0.5 {
+		t.Errorf("%v %v", v, err)
+	}
+	if v, err := section.GetBool("on", false); err != nil || !v {
+		t.Errorf("%v %v", v, err)
+	}
+	if v, err := section.GetDuration("interval", 0); err != nil || v != time.Minute {
+		t.Errorf("%v %v", v, err)
+	}
+	// the default is returned along with the error naming the section
+	if v, err := section.GetInt("bad", 1); err == nil || v != 1 || !strings.Contains(err.Error(), `output "kafka": invalid integer value for bad: x`) {
+		t.Errorf("%v %v", v, err)
+	}
+	if _, err := section.GetBool("bad", false); err == nil {
+		t.Fail()
+	}
+	if _, err := section.GetDuration("bad", 0); err == nil {
+		t.Fail()
+	}
+	// Set replaces the values added, and the keys are case-insensitive with
+	// _ standing for -
+	section.Add("count", "4")
+	section.Set("Count", "5")
+	section.Set("flush_interval", "1s")
+	if section.Get("flush-interval", "") != "1s" {
+		t.Errorf("%+v", section.Params)
+	}
+	section.Unset("flush-interval")
+	if !reflect.DeepEqual(section.GetAll("count"), []string{"5"}) {
+		t.Errorf("%+v", section.GetAll("count"))
+	}
+	section.Unset("count")
+	if section.Has("count") || !reflect.DeepEqual(section.Keys, []string{"ratio", "on", "interval", "bad"}) {
+		t.Errorf("%+v", section.Keys)
+	}
+}
@@ -0,0 +1,90 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// ConnectionStats is the state of a connection from a client to an input.
+type ConnectionStats struct {
+	Listener     string    `json:"listener"`
+	RemoteAddr   string    `json:"remote_addr"`
+	ConnectedAt  time.Time `json:"connected_at"`
+	LastActivity time.Time `json:"last_activity"`
+	Records      int64     `json:"records"`
+	Bytes        int64     `json:"bytes"`
+	DecodeErrors int64     `json:"decode_errors"`
+	// the protocol mode of the first message, or "" if none has arrived
+	Mode string `json:"mode"`
+}
+
+// ConnectionReportingInput is an input that lists the connections it
+// handles and closes them on request.
+type ConnectionReportingInput interface {
+	Worker
+	Connections() []ConnectionStats
+	// CloseConnection closes the connection from the address and returns
+	// whether there was one.
+	CloseConnection(remoteAddr string) bool
+}
+
+// ConnectionsHandler lists the connections to the inputs on GET, and closes
+// the one from the address given by "remote_addr" on DELETE.
+type ConnectionsHandler struct {
+	inputs func() []Worker
+}
+
+func (handler *ConnectionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+		connections := make([]ConnectionStats, 0)
+		for _, input := range handler.inputs() {
+			if input, ok := input.(ConnectionReportingInput); ok {
+				connections = append(connections, input.Connections()...)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"connections": connections})
+	case "DELETE":
+		remoteAddr := r.FormValue("remote_addr")
+		if remoteAddr == "" {
+			http.Error(w, "remote_addr is not specified", http.StatusBadRequest)
+			return
+		}
+		for _, input := range handler.inputs() {
+			if input, ok := input.(ConnectionReportingInput); ok && input.CloseConnection(remoteAddr) {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		http.Error(w, "no connection from "+remoteAddr, http.StatusNotFound)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// NewConnectionsHandler creates a ConnectionsHandler; inputs returns the
+// inputs, which may change by reloading.
+func NewConnectionsHandler(inputs func() []Worker) *ConnectionsHandler {
+	return &ConnectionsHandler{inputs: inputs}
+}
@@ -0,0 +1,116 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"encoding/json"
+	logging "github.com/op/go-logging"
+	"github.com/ugorji/go/codec"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_ConnectionsHandler(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("connections")
+	input, err := NewForwardInput(logger, "127.0.0.1:0", &recordingPort{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	input.Start()
+	defer func() {
+		input.Stop()
+		input.WaitForShutdown()
+	}()
+	conn, err := net.Dial("tcp", input.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	buffer := bytes.Buffer{}
+	codec.NewEncoder(&buffer, &codec.MsgpackHandle{}).Encode([]interface{}{[]byte("a"), float64(1), map[string]interface{}{"message": "hello"}})
+	_, err = conn.Write(buffer.Bytes())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	handler := NewConnectionsHandler(func() []Worker { return []Worker{input} })
+	result := struct {
+		Connections []ConnectionStats `json:"connections"`
+	}{}
+	for i := 0; i < 100; i += 1 {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/connections", nil))
+		err = json.Unmarshal(recorder.Body.Bytes(), &result)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(result.Connections) == 1 && result.Connections[0].Records == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(result.Connections) != 1 {
+		t.Fatalf("expected 1 connection, got %d", len(result.Connections))
+	}
+	stats := result.Connections[0]
+	if stats.RemoteAddr != conn.LocalAddr().String() || stats.Records != 1 || stats.Bytes != int64(buffer.Len()) || stats.DecodeErrors != 0 || stats.Mode != ProtocolModeMessage {
+		t.Logf("%+v", stats)
+		t.Fail()
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("DELETE", "/api/connections?remote_addr=127.0.0.1:1", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fail()
+	}
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("DELETE", "/api/connections?remote_addr="+stats.RemoteAddr, nil))
+	if recorder.Code != http.StatusNoContent {
+		t.Fail()
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func Test_ProtocolMode(t *testing.T) {
+	entry := []interface{}{uint64(1388534400), map[string]interface{}{"message": "hello"}}
+	cases := []struct {
+		v    []interface{}
+		mode string
+	}{
+		{[]interface{}{[]byte("a"), uint64(1388534400), map[string]interface{}{}}, ProtocolModeMessage},
+		{[]interface{}{[]byte("a"), float64(1388534400), map[string]interface{}{}}, ProtocolModeMessage},
+		{[]interface{}{[]byte("a"), []interface{}{entry}, nil}, ProtocolModeForward},
+		{[]interface{}{[]byte("a"), []byte{}, nil}, ProtocolModePackedForward},
+		{[]interface{}{[]byte("a"), []byte{}, map[string]interface{}{"size": uint64(1)}}, ProtocolModePackedForward},
+		{[]interface{}{[]byte("a"), []byte{}, map[string]interface{}{"compressed": []byte("gzip")}}, ProtocolModeCompressedPackedForward},
+		{[]interface{}{[]byte("a"), "a", nil}, ""},
+	}
+	for _, c := range cases {
+		if mode := protocolMode(c.v); mode != c.mode {
+			t.Errorf("%+v: expected %s, got %s", c.v, c.mode, mode)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_DebugHandler(t *testing.T) {
+	server := httptest.NewServer(NewDebugHandler())
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/debug/vars")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	vars := map[string]interface{}{}
+	err = json.NewDecoder(resp.Body).Decode(&vars)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, ok := vars["metrics"]; !ok {
+		t.Fail()
+	}
+	if _, ok := vars["memstats"]; !ok {
+		t.Fail()
+	}
+	resp, err = http.Get(server.URL + "/debug/pprof/goroutine?debug=1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fail()
+	}
+}
@@ -0,0 +1,103 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"runtime"
+	"sync"
+)
+
+// decodeJob is a message read by a connection, which is decoded by the
+// decode pool if it is in msgpack, or has been decoded on reading if in
+// JSON.  done is closed once the records are decoded.
+type decodeJob struct {
+	frame      []byte
+	mode       string
+	recordSets []FluentRecordSet
+	option     interface{}
+	err        error
+	// the bytes the message takes on the connection
+	size       int64
+	recordSize *Histogram
+	done       chan struct{}
+}
+
+// DecodePool decodes the messages in msgpack read by the connections of
+// the forward inputs by a fixed number of workers, so that a connection
+// reads its next message while the last one is decoded and the decoding of
+// the many connections takes no more CPUs than the workers.
+type DecodePool struct {
+	workers int
+	jobs    chan *decodeJob
+	busy    *Gauge
+	once    sync.Once
+}
+
+var inputDecodeBusyWorkers = mustGaugeVec(DefaultMetrics.NewGaugeVec("fluentd_forwarder_input_decode_busy_workers", "Number of the workers of the decode pool decoding a message.")).With()
+
+// DefaultDecodePool is the decode pool of the forward inputs created
+// afterwards.
+var DefaultDecodePool = NewDecodePool(0)
+
+// NewDecodePool returns a decode pool of the workers, or of as many as
+// GOMAXPROCS if workers is 0 or less.  The workers are started on the first
+// message.
+func NewDecodePool(workers int) *DecodePool {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	return &DecodePool{
+		workers: workers,
+		jobs:    make(chan *decodeJob, workers),
+		busy:    inputDecodeBusyWorkers,
+	}
+}
+
+// Workers returns the number of the workers.
+func (pool *DecodePool) Workers() int {
+	return pool.workers
+}
+
+func (pool *DecodePool) start() {
+	for i := 0; i < pool.workers; i += 1 {
+		go func() {
+			reader := newMsgpackDataReader()
+			entries := reader.entriesReader()
+			for job := range pool.jobs {
+				pool.busy.Inc()
+				reader.reset(job.frame)
+				job.mode, job.recordSets, job.option, job.err = decodeMsgpackMessage(reader, entries, job.recordSize)
+				// the records hold none of the bytes of the frame
+				putFrame(job.frame)
+				job.frame = nil
+				reader.reset(nil)
+				entries.reset(nil)
+				pool.busy.Dec()
+				close(job.done)
+			}
+		}()
+	}
+}
+
+// decode queues the message to be decoded, waiting while the workers are
+// all busy and as many are queued.
+func (pool *DecodePool) decode(job *decodeJob) {
+	pool.once.Do(pool.start)
+	pool.jobs <- job
+}
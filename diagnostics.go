@@ -0,0 +1,251 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"time"
+)
+
+// Diagnostics collects the state of the forwarder into an archive for the
+// support: the stacks of the goroutines, the state of the outputs and their
+// buffers, the connections to the inputs, the metrics and the
+// configuration, from which the secrets are removed.
+type Diagnostics struct {
+	logger  *logging.Logger
+	inputs  func() []Worker
+	outputs func() []Output
+	config  func() []*ConfigElement
+	dir     string
+}
+
+// diagnosticsOutput is the state of an output in the archive.
+type diagnosticsOutput struct {
+	Output string       `json:"output"`
+	Health OutputHealth `json:"health"`
+	Plugin *PluginInfo  `json:"plugin,omitempty"`
+}
+
+// isSecretConfigKey tells whether the value of the key is a secret.
+func isSecretConfigKey(key string) bool {
+	for _, suffix := range []string{"api-key", "apikey", "password", "secret", "token"} {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactConfigValue removes the secrets from the value of the key, such
+// as the user information of a URL and the secrets read from the sources.
+func redactConfigValue(key string, value string) string {
+	if isSecretConfigKey(key) {
+		return "xxxxx"
+	}
+	if strings.Contains(value, "//") {
+		u, err := url.Parse(value)
+		if err == nil && u.User != nil {
+			u.User = url.User("xxxxx")
+			value = u.String()
+		}
+	}
+	return DefaultSecrets.Redact(value)
+}
+
+// WriteConfig writes the sections in the syntax of the configuration file
+// with the secrets removed.
+func WriteConfig(w io.Writer, sections []*ConfigElement) error {
+	buf := bufio.NewWriter(w)
+	for i, section := range sections {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		if section.Arg != "" {
+			fmt.Fprintf(buf, "[%s %q]\n", section.Name, section.Arg)
+		} else {
+			fmt.Fprintf(buf, "[%s]\n", section.Name)
+		}
+		for _, key := range section.Keys {
+			for _, value := range section.GetAll(key) {
+				fmt.Fprintf(buf, "%s = %q\n", key, redactConfigValue(key, value))
+			}
+		}
+	}
+	return buf.Flush()
+}
+
+func (diagnostics *Diagnostics) writeOutputs(w io.Writer) error {
+	outputs := make([]diagnosticsOutput, 0)
+	for _, output := range diagnostics.outputs() {
+		entry := diagnosticsOutput{Output: output.String()}
+		if output, ok := output.(HealthReportingOutput); ok {
+			entry.Health = output.Health()
+		}
+		if output, ok := output.(PluginInfoReporter); ok {
+			info := output.PluginInfo()
+			entry.Plugin = &info
+		}
+		outputs = append(outputs, entry)
+	}
+	return writeIndentedJSON(w, outputs)
+}
+
+func (diagnostics *Diagnostics) writeConnections(w io.Writer) error {
+	connections := make([]ConnectionStats, 0)
+	for _, input := range diagnostics.inputs() {
+		if input, ok := input.(ConnectionReportingInput); ok {
+			connections = append(connections, input.Connections()...)
+		}
+	}
+	return writeIndentedJSON(w, connections)
+}
+
+func writeRuntime(w io.Writer) error {
+	memStats := runtime.MemStats{}
+	runtime.ReadMemStats(&memStats)
+	return writeIndentedJSON(w, map[string]interface{}{
+		"go_version":    runtime.Version(),
+		"num_cpu":       runtime.NumCPU(),
+		"num_goroutine": runtime.NumGoroutine(),
+		"gomaxprocs":    runtime.GOMAXPROCS(0),
+		"mem_stats":     memStats,
+	})
+}
+
+func writeIndentedJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// WriteArchive writes the diagnostics as a gzipped tarball.
+func (diagnostics *Diagnostics) WriteArchive(w io.Writer) error {
+	now := time.Now()
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+	files := []struct {
+		name  string
+		write func(w io.Writer) error
+	}{
+		{"goroutines.txt", func(w io.Writer) error { return pprof.Lookup("goroutine").WriteTo(w, 2) }},
+		{"runtime.json", writeRuntime},
+		{"outputs.json", diagnostics.writeOutputs},
+		{"connections.json", diagnostics.writeConnections},
+		{"recovery.json", func(w io.Writer) error { return writeIndentedJSON(w, DefaultBufferRecoveries.Reports()) }},
+		{"metrics.txt", func(w io.Writer) error { return DefaultMetrics.WriteText(bufio.NewWriter(w)) }},
+		{"config.txt", func(w io.Writer) error { return WriteConfig(w, diagnostics.config()) }},
+	}
+	for _, file := range files {
+		buf := bytes.Buffer{}
+		err := file.write(&buf)
+		if err != nil {
+			// the rest is still worth collecting
+			buf.Reset()
+			fmt.Fprintf(&buf, "failed to collect %s: %s\n", file.name, err.Error())
+		}
+		err = tarWriter.WriteHeader(&tar.Header{
+			Name:    file.name,
+			Mode:    0600,
+			Size:    int64(buf.Len()),
+			ModTime: now,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tarWriter.Write(buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	err := tarWriter.Close()
+	if err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
+
+func diagnosticsFileName(now time.Time) string {
+	return "fluentd-forwarder-diagnostics-" + now.Format("20060102-150405") + ".tar.gz"
+}
+
+// Dump writes the archive into the directory and returns its path.
+func (diagnostics *Diagnostics) Dump() (string, error) {
+	path := filepath.Join(diagnostics.dir, diagnosticsFileName(time.Now()))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.FileMode(0600))
+	if err != nil {
+		return "", err
+	}
+	err = diagnostics.WriteArchive(f)
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return "", err
+	}
+	err = f.Close()
+	if err != nil {
+		return "", err
+	}
+	diagnostics.logger.Noticef("Diagnostics written to %s", path)
+	return path, nil
+}
+
+func (diagnostics *Diagnostics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+diagnosticsFileName(time.Now())+"\"")
+	err := diagnostics.WriteArchive(w)
+	if err != nil {
+		diagnostics.logger.Errorf("Failed to write the diagnostics: %s", LogError(err))
+	}
+}
+
+// NewDiagnostics creates a Diagnostics that dumps the archives into dir;
+// inputs and outputs return the inputs and the outputs, which may change by
+// reloading, and config returns the configuration in effect, which may
+// change likewise.
+func NewDiagnostics(logger *logging.Logger, inputs func() []Worker, outputs func() []Output, config func() []*ConfigElement, dir string) *Diagnostics {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return &Diagnostics{
+		logger:  logger,
+		inputs:  inputs,
+		outputs: outputs,
+		config:  config,
+		dir:     dir,
+	}
+}
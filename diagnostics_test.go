@@ -0,0 +1,126 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	logging "github.com/op/go-logging"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_WriteConfig(t *testing.T) {
+	settings := NewConfigElement("fluentd-forwarder", "")
+	settings.Set("to", "td+https://APIKEY@api.treasuredata.com/db/table")
+	settings.Set("listen-on", "127.0.0.1:24224")
+	output := NewConfigElement("output", "td")
+	output.Set("api-key", "APIKEY")
+	buf := bytes.Buffer{}
+	err := WriteConfig(&buf, []*ConfigElement{settings, output})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := `[fluentd-forwarder]
+to = "td+https://xxxxx@api.treasuredata.com/db/table"
+listen-on = "127.0.0.1:24224"
+
+[output "td"]
+api-key = "xxxxx"
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected config: %s", buf.String())
+	}
+	sections, err := ReadConfig("diagnostics", buf.Bytes())
+	if err != nil || len(sections) != 2 || sections[0].Get("listen-on", "") != "127.0.0.1:24224" {
+		t.Fail()
+	}
+}
+
+func Test_Diagnostics(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("diagnostics")
+	tempDir, err := ioutil.TempDir("", "diagnostics")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+	output := &healthReportingOutput{health: OutputHealth{Name: "127.0.0.1:24224", BufferedBytes: 100}}
+	// the configuration is taken when the archive is written, as reloading
+	// replaces it
+	config := []*ConfigElement{NewConfigElement("output", "")}
+	diagnostics := NewDiagnostics(logger, func() []Worker { return nil }, func() []Output { return []Output{output} }, func() []*ConfigElement { return config }, tempDir)
+	reloaded := NewConfigElement("output", "")
+	reloaded.Set("type", "reloaded")
+	config = []*ConfigElement{reloaded}
+	path, err := diagnostics.Dump()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Close()
+	gzipReader, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	files := make(map[string]string)
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		content, _ := ioutil.ReadAll(tarReader)
+		files[header.Name] = string(content)
+	}
+	for _, name := range []string{"goroutines.txt", "runtime.json", "outputs.json", "connections.json", "recovery.json", "metrics.txt", "config.txt"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("%s is missing", name)
+		}
+	}
+	if !strings.Contains(files["goroutines.txt"], "Test_Diagnostics") || !strings.Contains(files["outputs.json"], `"BufferedBytes": 100`) {
+		t.Fail()
+	}
+	if !strings.Contains(files["config.txt"], "reloaded") {
+		t.Errorf("unexpected config: %s", files["config.txt"])
+	}
+
+	w := httptest.NewRecorder()
+	diagnostics.ServeHTTP(w, httptest.NewRequest("POST", "/api/diagnostics", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("%d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	diagnostics.ServeHTTP(w, httptest.NewRequest("GET", "/api/diagnostics", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/gzip" {
+		t.Errorf("%d", w.Code)
+	}
+}
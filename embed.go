@@ -0,0 +1,173 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"context"
+	logging "github.com/op/go-logging"
+	"strconv"
+	"time"
+)
+
+// Logger is what an application embedding the components logs them with,
+// in place of go-logging.  NOTICE is logged as Infof, and CRITICAL as
+// Errorf.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// loggerBackend hands the records of go-logging to a Logger.
+type loggerBackend struct {
+	logger Logger
+}
+
+func (backend *loggerBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	switch {
+	case level <= logging.ERROR:
+		backend.logger.Errorf("%s", rec.Message())
+	case level == logging.WARNING:
+		backend.logger.Warnf("%s", rec.Message())
+	case level == logging.DEBUG:
+		backend.logger.Debugf("%s", rec.Message())
+	default:
+		backend.logger.Infof("%s", rec.Message())
+	}
+	return nil
+}
+
+// NewLoggerAdapter returns the go-logging logger of the module writing to
+// the Logger at all the levels, leaving it to filter them.
+func NewLoggerAdapter(module string, logger Logger) *logging.Logger {
+	retval, _ := logging.GetLogger(module)
+	retval.SetBackend(logging.AddModuleLevel(&loggerBackend{logger}))
+	return retval
+}
+
+// embedding is what the Options tell about a component to create.
+type embedding struct {
+	logger *logging.Logger
+	config *ConfigElement
+}
+
+// Option configures a component created by NewEmbeddedInput or
+// NewEmbeddedOutput.
+type Option func(*embedding)
+
+// WithLogger logs the component with the logger, which is go-logging of
+// the module fluentd-forwarder otherwise.
+func WithLogger(logger Logger) Option {
+	return func(e *embedding) {
+		e.logger = NewLoggerAdapter("fluentd-forwarder", logger)
+	}
+}
+
+// WithGoLogging logs the component with the go-logging logger.
+func WithGoLogging(logger *logging.Logger) Option {
+	return func(e *embedding) {
+		e.logger = logger
+	}
+}
+
+// WithParam sets the parameter of the component as the configuration file
+// does in its section, which the other Options are the shorthands of.
+// Given more than once, the parameter takes all the values.
+func WithParam(key string, value string) Option {
+	return func(e *embedding) {
+		e.config.Add(key, value)
+	}
+}
+
+// WithListenOn sets the address a forward input listens on.
+func WithListenOn(addr string) Option {
+	return WithParam("listen-on", addr)
+}
+
+// WithTo sets the destination of an output, such as fluent://HOST:PORT for
+// a forward output.
+func WithTo(to string) Option {
+	return WithParam("to", to)
+}
+
+// WithBufferPath sets the path of the buffer of an output.
+func WithBufferPath(path string) Option {
+	return WithParam("buffer-path", path)
+}
+
+// WithBufferChunkLimit sets the size of the chunks of the buffer of an
+// output.
+func WithBufferChunkLimit(size int64) Option {
+	return WithParam("buffer-chunk-limit", strconv.FormatInt(size, 10))
+}
+
+// WithFlushInterval sets the interval in which an output flushes its
+// buffer.
+func WithFlushInterval(interval time.Duration) Option {
+	return WithParam("flush-interval", interval.String())
+}
+
+// WithRetryInterval sets the interval in which an output retries to
+// connect.
+func WithRetryInterval(interval time.Duration) Option {
+	return WithParam("retry-interval", interval.String())
+}
+
+func newEmbedding(kind string, typ string, opts []Option) *embedding {
+	e := &embedding{
+		logger: logging.MustGetLogger("fluentd-forwarder"),
+		config: NewConfigElement(kind, typ),
+	}
+	e.config.Set("type", typ)
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// NewEmbeddedInput creates an input of the type, such as "forward", which
+// emits the records it receives to the port.
+func NewEmbeddedInput(typ string, port Port, opts ...Option) (Worker, error) {
+	e := newEmbedding("input", typ, opts)
+	return NewInput(e.logger, e.config, port)
+}
+
+// NewEmbeddedOutput creates an output of the type, such as "forward" or
+// "td".
+func NewEmbeddedOutput(typ string, opts ...Option) (Output, error) {
+	e := newEmbedding("output", typ, opts)
+	return NewOutput(e.logger, e.config)
+}
+
+// Run starts the workers in order and runs them until the context is done,
+// then stops them in the reverse order, so that the inputs given after the
+// outputs they emit to stop first, and returns the error of the context
+// once all of them have shut down.
+func Run(ctx context.Context, workers ...Worker) error {
+	for _, worker := range workers {
+		worker.Start()
+	}
+	<-ctx.Done()
+	for i := len(workers) - 1; i >= 0; i-- {
+		workers[i].Stop()
+		workers[i].WaitForShutdown()
+	}
+	return ctx.Err()
+}
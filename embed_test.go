@@ -0,0 +1,139 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingLogger struct {
+	mtx      sync.Mutex
+	messages []string
+}
+
+func (logger *recordingLogger) log(level string, format string, args ...interface{}) {
+	logger.mtx.Lock()
+	defer logger.mtx.Unlock()
+	logger.messages = append(logger.messages, level+": "+fmt.Sprintf(format, args...))
+}
+
+func (logger *recordingLogger) Debugf(format string, args ...interface{}) {
+	logger.log("debug", format, args...)
+}
+
+func (logger *recordingLogger) Infof(format string, args ...interface{}) {
+	logger.log("info", format, args...)
+}
+
+func (logger *recordingLogger) Warnf(format string, args ...interface{}) {
+	logger.log("warn", format, args...)
+}
+
+func (logger *recordingLogger) Errorf(format string, args ...interface{}) {
+	logger.log("error", format, args...)
+}
+
+func (logger *recordingLogger) has(message string) bool {
+	logger.mtx.Lock()
+	defer logger.mtx.Unlock()
+	for _, m := range logger.messages {
+		if m == message {
+			return true
+		}
+	}
+	return false
+}
+
+func Test_Embedding(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "embed")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+	logger := &recordingLogger{}
+	port := &syncRecordingPort{}
+	input, err := NewEmbeddedInput("forward", port, WithListenOn("127.0.0.1:0"), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	output, err := NewEmbeddedOutput("forward",
+		WithTo("fluent://"+input.(*ForwardInput).listener.Addr().String()),
+		WithBufferPath(filepath.Join(tempDir, "buffer")),
+		WithFlushInterval(50*time.Millisecond),
+		WithLogger(logger),
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(ctx, input, output)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); !logger.has("info: Spooler started"); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the output did not start")
+		}
+	}
+	err = output.Emit([]FluentRecordSet{{Tag: "embedded", Records: []TinyFluentRecord{{Timestamp: 1388534400, Data: map[string]interface{}{"message": "hello"}}}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		port.mtx.Lock()
+		n := len(port.recordSets)
+		port.mtx.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the record did not arrive")
+		}
+	}
+	if port.recordSets[0].Tag != "embedded" || port.recordSets[0].Records[0].Data["message"] != "hello" {
+		t.Errorf("%+v", port.recordSets)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("%v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return")
+	}
+	if !logger.has("info: Spooler ended") {
+		t.Errorf("%s", strings.Join(logger.messages, "\n"))
+	}
+}
+
+func Test_Embedding_UnknownType(t *testing.T) {
+	_, err := NewEmbeddedOutput("none")
+	if err == nil || err.Error() != `output "none": unknown output type: none` {
+		t.Errorf("%v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	fluentd_forwarder "github.com/fluent/fluentd-forwarder"
+	logging "github.com/op/go-logging"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// The share of the memory limit of the cgroup taken as the soft memory limit
+// of the Go runtime, leaving the rest to the memory not managed by it.
+const cgroupMemoryLimitRatio = 0.9
+
+// applyCgroupLimits sets GOMAXPROCS and the soft memory limit of the runtime
+// to the share of a process in the limits of the cgroup, unless GOMAXPROCS
+// and GOMEMLIMIT are set, and returns false if the buffers of the outputs
+// are estimated not to fit in the memory and -cgroup-limits is strict.
+func applyCgroupLimits(logger *logging.Logger, params *FluentdForwarderParams) bool {
+	limits, err := fluentd_forwarder.ReadCgroupLimits()
+	if err != nil {
+		logger.Debugf("No cgroup limit applied: %s", err.Error())
+		return true
+	}
+	// the workers share the limits of the cgroup
+	processes := 1
+	if params.Workers > 1 {
+		processes = params.Workers
+	}
+	if limits.CPUs > 0 && os.Getenv("GOMAXPROCS") == "" {
+		procs := int(math.Ceil(limits.CPUs / float64(processes)))
+		runtime.GOMAXPROCS(procs)
+		logger.Infof("GOMAXPROCS set to %d by the CPU limit of the cgroup (%g)", procs, limits.CPUs)
+	}
+	if limits.Memory == 0 {
+		return true
+	}
+	memory := limits.Memory / int64(processes)
+	estimate := fluentd_forwarder.BufferMemoryEstimate(params.ConfigSections)
+	if !params.FluentdConfig {
+		switch params.OutputType {
+		case "fluent":
+			estimate += params.MaxJournalChunkSize
+		case "td":
+			estimate += params.MaxJournalChunkSize * int64(params.Parallelism)
+		}
+	}
+	if estimate >= memory {
+		if params.CgroupLimits == StrictnessStrict {
+			Error("the buffers of the outputs may take %d bytes, which the memory limit of the cgroup (%d bytes for each process) cannot afford; lower the buffer chunk limits", estimate, memory)
+			return false
+		}
+		logger.Warningf("The buffers of the outputs may take %d bytes, which the memory limit of the cgroup (%d bytes for each process) cannot afford; lower the buffer chunk limits", estimate, memory)
+	} else if estimate > memory/2 {
+		logger.Warningf("The buffers of the outputs may take %d bytes, more than half the memory limit of the cgroup (%d bytes for each process)", estimate, memory)
+	}
+	if os.Getenv("GOMEMLIMIT") == "" {
+		softLimit := int64(float64(memory) * cgroupMemoryLimitRatio)
+		debug.SetMemoryLimit(softLimit)
+		logger.Infof("Soft memory limit set to %d bytes by the memory limit of the cgroup (%d bytes)", softLimit, limits.Memory)
+	}
+	return true
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	fluentd_forwarder "github.com/fluent/fluentd-forwarder"
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultAdminURL is where the subcommands talking to a running forwarder
+// find its HTTP endpoints unless told otherwise.
+const defaultAdminURL = "http://127.0.0.1:24231"
+
+// command is a subcommand, named by the first argument.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+// commands are the subcommands; the forwarder runs if none is given.
+var commands []command
+
+func init() {
+	commands = []command{
+		{"version", "show the version and how the executable was built", runVersion},
+		{"check", "check the configuration given by the options as -dry-run does", runCheck},
+		{"init", "ask a few questions and write a configuration to start with", runInit},
+		{"encrypt", "encrypt a value of the configuration by the configuration key", runEncrypt},
+		{"schema", "write the JSON Schema of the configuration in YAML and TOML", runSchema},
+		{"routes", "show the filters and the outputs the records of a tag reach", runRoutes},
+		{"flush", "make a running forwarder flush its buffers", runFlush},
+		{"stats", "show the metrics of a running forwarder", runStats},
+		{"bench", "send generated records to a forward input and measure the throughput", runBench},
+		{"replay", "send the records in the chunks of a buffer to a forward input", runReplay},
+		{"top", "show the state of a running forwarder in the terminal", runTop},
+		{"service", "install or uninstall the Windows service", runServiceCommand},
+	}
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// usage writes the usage of the executable, listing the subcommands before
+// the options of the forwarder.
+func usage(flagSet *flag.FlagSet) {
+	os.Stderr.WriteString("usage: " + progName + " [options]\n       " + progName + " COMMAND [arguments]\n\ncommands:\n")
+	for _, command := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", command.name, command.summary)
+	}
+	os.Stderr.WriteString("\noptions:\n")
+	flagSet.PrintDefaults()
+}
+
+// adminURL returns the URL of the path on the forwarder serving its HTTP
+// endpoints at target, which may be given as host:port.  A target with a
+// path of its own is taken as it is.
+func adminURL(target string, path string) (string, error) {
+	if target == "" {
+		target = defaultAdminURL
+	}
+	if !strings.Contains(target, "//") {
+		target = "http://" + target
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = path
+	}
+	return u.String(), nil
+}
+
+// runVersion runs the version subcommand, which also checks the latest
+// release given by -release-url.
+func runVersion(args []string) int {
+	asJSON := false
+	releaseURL := ""
+	flagSet := flag.NewFlagSet(progName+" version", flag.ExitOnError)
+	flagSet.BoolVar(&asJSON, "json", false, "write the build information in JSON")
+	flagSet.StringVar(&releaseURL, "release-url", "", "URL of the JSON metadata of the latest release to check the version against")
+	flagSet.Parse(args)
+	info := fluentd_forwarder.NewBuildInfo(progVersion, progRevision, progBuildDate)
+	if releaseURL != "" {
+		reporter, err := fluentd_forwarder.NewVersionReporter(logging.MustGetLogger("fluentd-forwarder"), info, releaseURL, 0)
+		if err != nil {
+			Error("%s", err.Error())
+			return 1
+		}
+		release := reporter.Check()
+		info.Release = &release
+	}
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(info)
+		return 0
+	}
+	fmt.Fprintf(os.Stdout, "%s version %s\n", progName, info.Version)
+	if info.Revision != "" {
+		revision := info.Revision
+		if info.Modified {
+			revision += " (modified)"
+		}
+		fmt.Fprintf(os.Stdout, "  revision: %s\n", revision)
+	}
+	if info.CommittedAt != "" {
+		fmt.Fprintf(os.Stdout, "  committed at: %s\n", info.CommittedAt)
+	}
+	if info.BuiltAt != "" {
+		fmt.Fprintf(os.Stdout, "  built at: %s\n", info.BuiltAt)
+	}
+	fmt.Fprintf(os.Stdout, "  go: %s %s\n", info.GoVersion, info.Platform)
+	if info.Release != nil {
+		switch {
+		case info.Release.Error != "":
+			fmt.Fprintf(os.Stdout, "  latest release: unknown (%s)\n", info.Release.Error)
+		case info.Release.UpdateAvailable:
+			fmt.Fprintf(os.Stdout, "  latest release: %s (update available)\n", info.Release.LatestVersion)
+		default:
+			fmt.Fprintf(os.Stdout, "  latest release: %s\n", info.Release.LatestVersion)
+		}
+	}
+	return 0
+}
+
+// runCheck runs the check subcommand, which takes the options of the
+// forwarder.
+func runCheck(args []string) int {
+	params := ParseArgs(args)
+	if !ValidateParams(params) {
+		return 1
+	}
+	return runDryRun(params)
+}
+
+// runEncrypt runs the encrypt subcommand, which encrypts the value read
+// from the standard input, so that it is not left in the history of the
+// shell, by the key given by -config-key, or generates a key.
+func runEncrypt(args []string) int {
+	configKey := ""
+	generateKey := false
+	flagSet := flag.NewFlagSet(progName+" encrypt", flag.ExitOnError)
+	flagSet.StringVar(&configKey, "config-key", os.Getenv(configKeyEnv), "configuration key given as SOURCE:REFERENCE, as the option of the forwarder. "+configKeyEnv+" if unspecified")
+	flagSet.BoolVar(&generateKey, "generate-key", false, "write a new configuration key in base64 instead")
+	flagSet.Usage = func() {
+		os.Stderr.WriteString("usage: " + progName + " encrypt -config-key SOURCE:REFERENCE < VALUE\n       " + progName + " encrypt -generate-key > KEY\n")
+		flagSet.PrintDefaults()
+	}
+	flagSet.Parse(args)
+	if generateKey {
+		key, err := fluentd_forwarder.GenerateConfigKey()
+		if err != nil {
+			Error("%s", err.Error())
+			return 1
+		}
+		fmt.Fprintln(os.Stdout, base64.StdEncoding.EncodeToString(key))
+		return 0
+	}
+	if configKey == "" {
+		flagSet.Usage()
+		return 2
+	}
+	key, err := fluentd_forwarder.LoadConfigKey(fluentd_forwarder.DefaultSecrets, configKey)
+	if err != nil {
+		Error("-config-key: %s", err.Error())
+		return 1
+	}
+	value, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	encrypted, err := fluentd_forwarder.EncryptConfigValue(key, strings.TrimRight(string(value), "\r\n"))
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	fmt.Fprintln(os.Stdout, encrypted)
+	return 0
+}
+
+// runRoutes runs the routes subcommand, which takes the tag followed by the
+// options of the forwarder.
+func runRoutes(args []string) int {
+	label := ""
+	flagSet := flag.NewFlagSet(progName+" routes", flag.ExitOnError)
+	flagSet.StringVar(&label, "label", "", "label the records are sent to. the default label if unspecified")
+	flagSet.Usage = func() {
+		os.Stderr.WriteString("usage: " + progName + " routes [-label LABEL] TAG [options]\n")
+		flagSet.PrintDefaults()
+	}
+	flagSet.Parse(args)
+	if flagSet.NArg() == 0 {
+		flagSet.Usage()
+		return 2
+	}
+	tag := flagSet.Arg(0)
+	params := ParseArgs(flagSet.Args()[1:])
+	steps, err := fluentd_forwarder.RouteTag(params.ConfigSections, !params.FluentdConfig, label, tag)
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	taken := false
+	for _, step := range steps {
+		fmt.Fprintln(os.Stdout, step.String())
+		if step.IsOutput && !step.Conditional {
+			taken = true
+		}
+	}
+	if !taken {
+		fmt.Fprintln(os.Stdout, "the records no output takes are discarded")
+	}
+	return 0
+}
+
+// runFlush runs the flush subcommand, which makes the forwarder serving its
+// HTTP endpoints at the URL given as the argument flush its buffers, with the
+// token of its admin API.
+func runFlush(args []string) int {
+	adminTokenFile := ""
+	flagSet := flag.NewFlagSet(progName+" flush", flag.ExitOnError)
+	flagSet.StringVar(&adminTokenFile, "admin-token-file", "", "path of the file holding the bearer token the forwarder was given by -admin-token-file")
+	flagSet.Usage = func() {
+		os.Stderr.WriteString("usage: " + progName + " flush -admin-token-file FILE [" + defaultAdminURL + "]\n")
+		flagSet.PrintDefaults()
+	}
+	flagSet.Parse(args)
+	target, err := adminURL(flagSet.Arg(0), "/api/flush")
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	req, err := http.NewRequest("POST", target, nil)
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	if adminTokenFile != "" {
+		b, err := ioutil.ReadFile(adminTokenFile)
+		if err != nil {
+			Error("%s", err.Error())
+			return 1
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(b)))
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		Error("%s responded with %s", target, resp.Status)
+		return 1
+	}
+	result := struct {
+		Flushed []string `json:"flushed"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	if len(result.Flushed) == 0 {
+		fmt.Fprintln(os.Stdout, "no output has a buffer to flush")
+	}
+	for _, name := range result.Flushed {
+		fmt.Fprintf(os.Stdout, "flushing %s\n", name)
+	}
+	return 0
+}
+
+// runStats runs the stats subcommand, which shows the metrics of the
+// forwarder serving its HTTP endpoints at the URL given as the argument.
+func runStats(args []string) int {
+	name := ""
+	flagSet := flag.NewFlagSet(progName+" stats", flag.ExitOnError)
+	flagSet.StringVar(&name, "name", "", "show only the metrics whose names contain the string")
+	flagSet.Usage = func() {
+		os.Stderr.WriteString("usage: " + progName + " stats [options] [" + defaultAdminURL + "]\n")
+		flagSet.PrintDefaults()
+	}
+	flagSet.Parse(args)
+	target, err := adminURL(flagSet.Arg(0), "/metrics")
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(target)
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		Error("%s responded with %s", target, resp.Status)
+		return 1
+	}
+	metrics, err := fluentd_forwarder.ParseMetricsText(resp.Body)
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	lines := make([]string, 0, len(metrics))
+	for metric, values := range metrics {
+		if !strings.Contains(metric, name) {
+			continue
+		}
+		for labels, v := range values {
+			lines = append(lines, metric+labels+" "+strconv.FormatFloat(v, 'f', -1, 64))
+		}
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		fmt.Fprintln(os.Stdout, line)
+	}
+	return 0
+}
+
+// runBench runs the bench subcommand, which sends the records generated as
+// told by the options to the forward input at the address given as the
+// argument, and reports the throughput and the latency.
+func runBench(args []string) int {
+	options := fluentd_forwarder.BenchOptions{}
+	flagSet := flag.NewFlagSet(progName+" bench", flag.ExitOnError)
+	flagSet.StringVar(&options.Tag, "tag", "bench", "tag of the records")
+	flagSet.StringVar(&options.Mode, "mode", fluentd_forwarder.ProtocolModePackedForward, "mode of the forward protocol: message, forward, packed_forward or compressed_packed_forward")
+	flagSet.IntVar(&options.Rate, "rate", 0, "records per second to send over all the connections. as many as the server takes if 0")
+	flagSet.DurationVar(&options.Duration, "duration", 10*time.Second, "how long to send the records for")
+	flagSet.IntVar(&options.BatchSize, "batch-size", 100, "records in a message, but for the message mode")
+	flagSet.IntVar(&options.RecordSize, "record-size", 256, "approximate size of a record in bytes")
+	flagSet.IntVar(&options.Connections, "connections", 1, "connections to send the records over")
+	flagSet.BoolVar(&options.Ack, "ack", false, "request an ack for every message and wait for it before sending the next one")
+	flagSet.DurationVar(&options.Timeout, "timeout", 10*time.Second, "for a message to be written, and acked with -ack")
+	flagSet.Usage = func() {
+		os.Stderr.WriteString("usage: " + progName + " bench [options] [127.0.0.1:24224]\n")
+		flagSet.PrintDefaults()
+	}
+	flagSet.Parse(args)
+	options.Address = flagSet.Arg(0)
+	if i := strings.Index(options.Address, "//"); i >= 0 {
+		options.Address = options.Address[i+2:]
+	}
+	if options.Address == "" {
+		options.Address = "127.0.0.1:24224"
+	}
+	result, err := fluentd_forwarder.RunBench(options)
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	seconds := result.Elapsed.Seconds()
+	fmt.Fprintf(os.Stdout, "sent %d records in %d messages (%d bytes) over %d connections in %.2fs\n", result.Records, result.Messages, result.Bytes, options.Connections, seconds)
+	fmt.Fprintf(os.Stdout, "throughput: %.0f records/s, %.0f messages/s, %.2f MB/s\n", float64(result.Records)/seconds, float64(result.Messages)/seconds, float64(result.Bytes)/seconds/1000000)
+	latency := "write latency"
+	if options.Ack {
+		latency = "ack latency"
+	}
+	fmt.Fprintf(os.Stdout, "%s: p50 %s, p90 %s, p99 %s, p99.9 %s, max %s\n", latency, result.Percentile(0.5), result.Percentile(0.9), result.Percentile(0.99), result.Percentile(0.999), result.Percentile(1))
+	if result.Errors > 0 {
+		fmt.Fprintf(os.Stdout, "errors: %d\n", result.Errors)
+		return 1
+	}
+	return 0
+}
+
+// runReplay runs the replay subcommand, which sends the records in the
+// chunks at the paths given as the arguments, or in the buffers of which
+// they are the buffer paths, to the forward input given by -to.
+func runReplay(args []string) int {
+	to := ""
+	rate := 0
+	batchSize := 0
+	timeout := time.Duration(0)
+	removePrefix := ""
+	substitutions := StringsValue{}
+	addPrefix := ""
+	remove := false
+	dryRun := false
+	flagSet := flag.NewFlagSet(progName+" replay", flag.ExitOnError)
+	flagSet.StringVar(&to, "to", "fluent://127.0.0.1:24224", "host and port of the forward input to send the records to")
+	flagSet.IntVar(&rate, "rate", 0, "records per second to send. as many as the input takes if 0")
+	flagSet.IntVar(&batchSize, "batch-size", 1000, "records in a message")
+	flagSet.DurationVar(&timeout, "timeout", 10*time.Second, "for the connection to be made and each message to be written")
+	flagSet.StringVar(&removePrefix, "remove-tag-prefix", "", "prefix to remove from the tags")
+	flagSet.Var(&substitutions, "tag-substitute", "regexp and the replacement, separated by a space, to substitute the matches in the tags with. may be given more than once")
+	flagSet.StringVar(&addPrefix, "add-tag-prefix", "", "prefix to add to the tags")
+	flagSet.BoolVar(&remove, "remove", false, "remove each chunk once all its records have been sent")
+	flagSet.BoolVar(&dryRun, "dry-run", false, "show the chunks and the records in them without sending them")
+	flagSet.Usage = func() {
+		os.Stderr.WriteString("usage: " + progName + " replay [options] CHUNK_OR_BUFFER_PATH...\n")
+		flagSet.PrintDefaults()
+	}
+	flagSet.Parse(args)
+	if flagSet.NArg() == 0 {
+		flagSet.Usage()
+		return 2
+	}
+	if i := strings.Index(to, "//"); i >= 0 {
+		to = to[i+2:]
+	}
+	rewriter, err := fluentd_forwarder.NewTagRewriter(removePrefix, substitutions, addPrefix)
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	logger := logging.MustGetLogger("fluentd-forwarder")
+	chunks := make([]fluentd_forwarder.ReplayChunkFile, 0)
+	for _, path := range flagSet.Args() {
+		found, err := fluentd_forwarder.FindReplayChunkFiles(logger, path)
+		if err != nil {
+			Error("%s", err.Error())
+			return 1
+		}
+		chunks = append(chunks, found...)
+	}
+	replayer := fluentd_forwarder.NewReplayer(to, rewriter, rate, batchSize, timeout)
+	defer replayer.Close()
+	total := 0
+	for _, chunk := range chunks {
+		recordSets, err := fluentd_forwarder.ReadReplayChunk(chunk)
+		if err != nil {
+			Error("%s", err.Error())
+			return 1
+		}
+		records := 0
+		for _, recordSet := range recordSets {
+			records += len(recordSet.Records)
+		}
+		if dryRun {
+			fmt.Fprintf(os.Stdout, "%s: %d records\n", chunk.Path, records)
+			total += records
+			continue
+		}
+		sent, err := replayer.Replay(recordSets)
+		total += sent
+		if err != nil {
+			Error("%s: %d of %d records sent: %s", chunk.Path, sent, records, err.Error())
+			fmt.Fprintf(os.Stdout, "%d records sent\n", total)
+			return 1
+		}
+		fmt.Fprintf(os.Stdout, "%s: %d records sent\n", chunk.Path, sent)
+		if remove {
+			err := os.Remove(chunk.Path)
+			if err != nil {
+				Error("%s", err.Error())
+				return 1
+			}
+		}
+	}
+	if dryRun {
+		fmt.Fprintf(os.Stdout, "%d records in %d chunks\n", total, len(chunks))
+	} else {
+		fmt.Fprintf(os.Stdout, "%d records sent\n", total)
+	}
+	return 0
+}
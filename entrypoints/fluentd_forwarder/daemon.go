@@ -0,0 +1,104 @@
+//go:build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// daemonEnv tells the process started by -daemon that the pipe on the file
+// descriptor 3 leads to the process that started it, which waits for it to
+// be ready.
+const daemonEnv = "FLUENTD_FORWARDER_DAEMON"
+
+// daemonReadyMarker is written to the pipe when the daemon is ready.  The
+// errors before that are written to the pipe as well, so that the starting
+// process prints them.
+const daemonReadyMarker = "\x00"
+
+// daemonPipe is the pipe to the starting process, or nil.
+var daemonPipe *os.File
+
+func init() {
+	if os.Getenv(daemonEnv) == "" {
+		return
+	}
+	os.Unsetenv(daemonEnv)
+	syscall.CloseOnExec(firstListenFD)
+	daemonPipe = os.NewFile(uintptr(firstListenFD), "daemon")
+	errorOutput = daemonPipe
+}
+
+// isDaemon returns whether this is the process started by -daemon.
+func isDaemon() bool {
+	return daemonPipe != nil
+}
+
+// daemonize starts the forwarder again in the background, detached from
+// the terminal in a session of its own, and returns the exit status once it
+// is ready or has failed to start.
+func daemonize() int {
+	executable, err := os.Executable()
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	defer devNull.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	defer r.Close()
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdin = devNull
+	cmd.Stdout = devNull
+	cmd.Stderr = devNull
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	cmd.Process.Release()
+	// read until the marker or the end of the pipe, by which it has
+	// exited
+	output, _ := ioutil.ReadAll(r)
+	if n := len(output); n > 0 && string(output[n-1:]) == daemonReadyMarker {
+		os.Stderr.Write(output[:n-1])
+		return 0
+	}
+	os.Stderr.Write(output)
+	Error("Failed to start the daemon")
+	return 1
+}
+
+// daemonReady tells the process started by -daemon that this is ready,
+// and lets it exit.  The errors are written to the standard error, which is
+// the null device, from then on.
+func daemonReady() {
+	if daemonPipe == nil {
+		return
+	}
+	errorOutput = os.Stderr
+	daemonPipe.WriteString(daemonReadyMarker)
+	daemonPipe.Close()
+	daemonPipe = nil
+}
+
+// processExists returns whether the process of the pid is running.
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+)
+
+func isDaemon() bool {
+	return false
+}
+
+// daemonize fails, as Windows runs a background process as a service.
+func daemonize() int {
+	Error("-daemon is not supported on Windows; run as a Windows service instead")
+	return 1
+}
+
+func daemonReady() {
+}
+
+// processExists returns whether the process of the pid is running.
+func processExists(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
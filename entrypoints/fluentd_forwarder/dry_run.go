@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	fluentd_forwarder "github.com/fluent/fluentd-forwarder"
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// runDryRun checks the configuration given by the command line and the
+// configuration file without listening on anything or sending any records,
+// and returns the exit status; non-zero if any error is found.
+func runDryRun(params *FluentdForwarderParams) int {
+	backend := logging.AddModuleLevel(logging.NewLogBackend(os.Stderr, "[fluentd-forwarder] ", log.Ldate|log.Ltime))
+	backend.SetLevel(logging.WARNING, "")
+	logging.SetBackend(backend)
+	logger := logging.MustGetLogger("fluentd-forwarder")
+	for _, path := range params.Plugins {
+		err := fluentd_forwarder.LoadPlugin(logger, path)
+		if err != nil {
+			Error("%s", err.Error())
+			return 1
+		}
+	}
+
+	errs := make([]string, 0)
+	checkSetting := func(key string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("-%s: %s", key, err.Error()))
+		}
+	}
+	hasDefaultOutput := false
+	if !params.FluentdConfig {
+		checkSetting("listen-on", fluentd_forwarder.CheckListenAddress(params.ListenOn))
+		switch params.OutputType {
+		case "fluent", "td":
+			hasDefaultOutput = true
+			checkSetting("to", fluentd_forwarder.CheckHost(params.ForwardTo))
+			checkSetting("buffer-path", fluentd_forwarder.CheckBufferPath(params.JournalGroupPath))
+			if params.OutputType == "td" && params.SslCACertBundleFile != "" {
+				checkSetting("ca-certs", fluentd_forwarder.CheckCACerts(params.SslCACertBundleFile))
+			}
+		default:
+			hasDefaultOutput = true
+			if !fluentd_forwarder.HasOutput(params.OutputType) {
+				checkSetting("to", fmt.Errorf("unknown output type: %s", params.OutputType))
+			}
+		}
+	}
+	for key, addr := range map[string]string{"http-listen-on": params.HTTPListenOn, "debug-listen-on": params.DebugListenOn} {
+		if addr != "" {
+			checkSetting(key, fluentd_forwarder.CheckListenAddress(addr))
+		}
+	}
+	if params.AdminTokenFile != "" {
+		_, err := ioutil.ReadFile(params.AdminTokenFile)
+		checkSetting("admin-token-file", err)
+	}
+	if params.StatsDAddress != "" {
+		checkSetting("statsd-address", fluentd_forwarder.CheckHost(params.StatsDAddress))
+	}
+
+	check := fluentd_forwarder.CheckConfig(logger, fluentd_forwarder.RedactConfigLocation(params.ConfigFile), params.ConfigSections, hasDefaultOutput)
+	for _, msg := range check.Warnings {
+		fmt.Fprintf(os.Stderr, "%s: warning: %s\n", progName, msg)
+	}
+	errs = append(errs, check.Errors...)
+	if params.Preflight != StrictnessOff {
+		check = fluentd_forwarder.CheckSystemLimits(systemRequirements(params))
+		warnings := check.Warnings
+		// they would not keep the forwarder from starting
+		if params.Preflight != StrictnessStrict {
+			warnings = append(warnings, check.Errors...)
+		} else {
+			errs = append(errs, check.Errors...)
+		}
+		for _, msg := range warnings {
+			fmt.Fprintf(os.Stderr, "%s: warning: %s\n", progName, msg)
+		}
+	}
+	if params.Kubernetes {
+		mounts, err := fluentd_forwarder.ReadMounts()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: warning: failed to check the volumes of the buffers: %s\n", progName, err.Error())
+		} else {
+			check = fluentd_forwarder.CheckBufferVolumes(mounts, bufferDirectories(params))
+			for _, msg := range check.Warnings {
+				fmt.Fprintf(os.Stderr, "%s: warning: %s\n", progName, msg)
+			}
+			errs = append(errs, check.Errors...)
+		}
+	}
+	for _, msg := range errs {
+		Error("%s", msg)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	fmt.Fprintf(os.Stdout, "%s: configuration OK\n", progName)
+	return 0
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	fluentd_forwarder "github.com/fluent/fluentd-forwarder"
+	logging "github.com/op/go-logging"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// prompter asks the questions of init, reading the answers line by line
+// from in, which may be a pipe; the default is taken for an empty answer
+// and for the ones missing at the end of the input.
+type prompter struct {
+	in       *bufio.Reader
+	out      io.Writer
+	defaults bool
+}
+
+func (p *prompter) ask(question string, defaultValue string, check func(string) error) string {
+	for {
+		if p.defaults {
+			return defaultValue
+		}
+		if defaultValue != "" {
+			fmt.Fprintf(p.out, "%s [%s]: ", question, defaultValue)
+		} else {
+			fmt.Fprintf(p.out, "%s: ", question)
+		}
+		line, err := p.in.ReadString('\n')
+		if err != nil {
+			fmt.Fprintln(p.out)
+			p.defaults = true
+		}
+		answer := strings.TrimSpace(line)
+		if answer == "" {
+			answer = defaultValue
+		}
+		if check == nil {
+			return answer
+		}
+		if err := check(answer); err != nil {
+			if p.defaults {
+				return answer
+			}
+			fmt.Fprintf(p.out, "  %s\n", err.Error())
+			continue
+		}
+		return answer
+	}
+}
+
+func (p *prompter) confirm(question string, defaultValue bool) bool {
+	answer := p.ask(question+" (y/n)", map[bool]string{true: "y", false: "n"}[defaultValue], func(answer string) error {
+		switch strings.ToLower(answer) {
+		case "y", "yes", "n", "no":
+			return nil
+		}
+		return fmt.Errorf("answer y or n")
+	})
+	return strings.HasPrefix(strings.ToLower(answer), "y")
+}
+
+func checkAddress(answer string) error {
+	_, port, err := net.SplitHostPort(answer)
+	if err != nil {
+		return fmt.Errorf("give the address as host:port")
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port: %s", port)
+	}
+	return nil
+}
+
+func checkOptionalAddress(answer string) error {
+	if answer == "" {
+		return nil
+	}
+	return checkAddress(answer)
+}
+
+func checkNotEmpty(answer string) error {
+	if answer == "" {
+		return fmt.Errorf("an answer is required")
+	}
+	return nil
+}
+
+// iniValue quotes the value if the INI format would take it otherwise.
+func iniValue(value string) string {
+	if value != strings.TrimSpace(value) || strings.ContainsAny(value, "#;\"\\\n\t") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// initUpstream is an upstream taking the events whose tags match the
+// pattern, or the rest of the events if there is no pattern.
+type initUpstream struct {
+	name    string
+	pattern string
+	to      string
+}
+
+// initConfig holds the answers of init.
+type initConfig struct {
+	listenOn     string
+	destination  string
+	upstreams    []initUpstream
+	tdHost       string
+	tls          bool
+	caCerts      string
+	database     string
+	table        string
+	apiKey       string
+	bufferDir    string
+	httpListenOn string
+}
+
+// askInitConfig asks the questions of init.
+func askInitConfig(p *prompter) *initConfig {
+	config := &initConfig{}
+	config.listenOn = p.ask("Address to receive the events by the forward protocol on", "127.0.0.1:24224", checkAddress)
+	config.destination = p.ask("Destination of the events: forward to fluentd or another forwarder, or td for Treasure Data", "forward", func(answer string) error {
+		if answer != "forward" && answer != "td" {
+			return fmt.Errorf("answer forward or td")
+		}
+		return nil
+	})
+	if config.destination == "forward" {
+		config.upstreams = append(config.upstreams, initUpstream{
+			name: "default",
+			to:   p.ask("Upstream to forward the events to", "127.0.0.1:24225", checkAddress),
+		})
+		for {
+			pattern := p.ask("Tag pattern of the events to forward to another upstream, such as app.** (empty if none)", "", nil)
+			if pattern == "" {
+				break
+			}
+			config.upstreams = append(config.upstreams, initUpstream{
+				name:    fmt.Sprintf("upstream-%d", len(config.upstreams)),
+				pattern: pattern,
+				to:      p.ask("Upstream to forward the events tagged "+pattern+" to", "", checkAddress),
+			})
+		}
+		if !p.defaults {
+			fmt.Fprintln(p.out, "  The forward protocol is sent in plain text; forward to an upstream on a trusted network or over a tunnel.")
+		}
+	} else {
+		config.tdHost = p.ask("Host of the API of Treasure Data", "api.treasuredata.com", checkNotEmpty)
+		config.tls = p.confirm("Connect by TLS", true)
+		if config.tls {
+			config.caCerts = p.ask("CA certificate bundle (empty for the ones of the system)", "", func(answer string) error {
+				if answer == "" {
+					return nil
+				}
+				return fluentd_forwarder.CheckCACerts(answer)
+			})
+		}
+		config.database = p.ask("Database", "", checkNotEmpty)
+		config.table = p.ask("Table", "", checkNotEmpty)
+		config.apiKey = p.ask("API key (empty to read it from the environment variable TD_API_KEY)", "", nil)
+		if config.apiKey == "" {
+			config.apiKey = "${TD_API_KEY}"
+		}
+	}
+	config.bufferDir = p.ask("Directory of the buffers", "/var/lib/fluentd-forwarder", checkNotEmpty)
+	config.httpListenOn = p.ask("Address to serve the metrics and the health checks on (empty not to serve them)", "127.0.0.1:24231", checkOptionalAddress)
+	return config
+}
+
+// write writes the configuration in the INI format; configKey encrypts
+// the destination of Treasure Data holding the API key if given.
+func (config *initConfig) write(w io.Writer, configKey []byte) error {
+	fmt.Fprintf(w, "; generated by %s init; see the README for the settings\n", filepath.Base(progName))
+	fmt.Fprintf(w, "[fluentd-forwarder]\n")
+	fmt.Fprintf(w, "listen-on = %s\n", iniValue(config.listenOn))
+	if config.destination == "forward" {
+		fmt.Fprintf(w, "to = %s\n", iniValue("fluent://"+config.upstreams[0].to))
+	} else {
+		scheme := "td+http"
+		if config.tls {
+			scheme = "td+https"
+		}
+		to := scheme + "://" + config.apiKey + "@" + config.tdHost + "/" + config.database + "/" + config.table
+		if configKey != nil && config.apiKey != "${TD_API_KEY}" {
+			fmt.Fprintf(w, "; %s with the API key, encrypted by the configuration key\n", scheme+"://"+config.tdHost+"/"+config.database+"/"+config.table)
+			encrypted, err := fluentd_forwarder.EncryptConfigValue(configKey, to)
+			if err != nil {
+				return err
+			}
+			to = encrypted
+		}
+		fmt.Fprintf(w, "to = %s\n", iniValue(to))
+		if config.caCerts != "" {
+			fmt.Fprintf(w, "ca-certs = %s\n", iniValue(config.caCerts))
+		}
+	}
+	fmt.Fprintf(w, "buffer-path = %s\n", iniValue(filepath.Join(config.bufferDir, "default")))
+	fmt.Fprintf(w, "; a flush stuck on a half-open connection is given up and retried\n")
+	fmt.Fprintf(w, "flush-timeout = 1m\n")
+	fmt.Fprintf(w, "; the buffers are drained for this long on SIGTERM before exiting\n")
+	fmt.Fprintf(w, "shutdown-timeout = 30s\n")
+	if config.httpListenOn != "" {
+		fmt.Fprintf(w, "; /metrics, /healthz and /readyz\n")
+		fmt.Fprintf(w, "http-listen-on = %s\n", iniValue(config.httpListenOn))
+		fmt.Fprintf(w, "; an output with more than this many bytes buffered fails /readyz\n")
+		fmt.Fprintf(w, "buffer-watermark = 1073741824\n")
+	}
+	if len(config.upstreams) > 1 {
+		for _, upstream := range config.upstreams[1:] {
+			fmt.Fprintf(w, "\n[output \"%s\"]\n", upstream.name)
+			fmt.Fprintf(w, "type = forward\n")
+			fmt.Fprintf(w, "match = %s\n", iniValue(upstream.pattern))
+			fmt.Fprintf(w, "to = %s\n", iniValue(upstream.to))
+			fmt.Fprintf(w, "buffer-path = %s\n", iniValue(filepath.Join(config.bufferDir, upstream.name)))
+			fmt.Fprintf(w, "flush-timeout = 1m\n")
+		}
+	}
+	return nil
+}
+
+// standIn returns the configuration with the upstreams on the loopback and
+// the buffers in bufferDir, which is checked without the hosts and the
+// directories, which may not be ready yet.
+func (config *initConfig) standIn(bufferDir string) *initConfig {
+	retval := *config
+	retval.bufferDir = bufferDir
+	retval.upstreams = make([]initUpstream, 0, len(config.upstreams))
+	for _, upstream := range config.upstreams {
+		_, port, _ := net.SplitHostPort(upstream.to)
+		upstream.to = net.JoinHostPort("127.0.0.1", port)
+		retval.upstreams = append(retval.upstreams, upstream)
+	}
+	return &retval
+}
+
+// runInit runs the init subcommand, which asks a few questions and writes a
+// configuration to start with, checked as check does but for the
+// directories of the buffers and the hosts, which may not be ready yet.
+func runInit(args []string) int {
+	output := ""
+	force := false
+	defaults := false
+	configKey := ""
+	flagSet := flag.NewFlagSet(progName+" init", flag.ExitOnError)
+	flagSet.StringVar(&output, "o", "", "file to write the configuration to. the standard output if unspecified")
+	flagSet.BoolVar(&force, "force", false, "overwrite the file given by -o")
+	flagSet.BoolVar(&defaults, "defaults", false, "take the defaults without asking")
+	flagSet.StringVar(&configKey, "config-key", os.Getenv(configKeyEnv), "configuration key given as SOURCE:REFERENCE by which the API key is encrypted. "+configKeyEnv+" if unspecified")
+	flagSet.Parse(args)
+	if output != "" && !force {
+		if _, err := os.Stat(output); err == nil {
+			Error("%s exists; give -force to overwrite it", output)
+			return 1
+		}
+	}
+	key := ([]byte)(nil)
+	if configKey != "" {
+		err := (error)(nil)
+		key, err = fluentd_forwarder.LoadConfigKey(fluentd_forwarder.DefaultSecrets, configKey)
+		if err != nil {
+			Error("-config-key: %s", err.Error())
+			return 1
+		}
+	}
+	p := &prompter{in: bufio.NewReader(os.Stdin), out: os.Stderr, defaults: defaults}
+	config := askInitConfig(p)
+	buf := &bytes.Buffer{}
+	err := config.write(buf, key)
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+
+	filename := output
+	if filename == "" {
+		filename = "fluentd-forwarder.cfg"
+	}
+	bufferDir, err := ioutil.TempDir("", "fluentd-forwarder-init")
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	defer os.RemoveAll(bufferDir)
+	standIn := &bytes.Buffer{}
+	config.standIn(bufferDir).write(standIn, key)
+	// the variables and the encrypted values are left unexpanded
+	sections, err := fluentd_forwarder.ReadConfig(filename, standIn.Bytes())
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	backend := logging.AddModuleLevel(logging.NewLogBackend(os.Stderr, "[fluentd-forwarder] ", log.Ldate|log.Ltime))
+	backend.SetLevel(logging.WARNING, "")
+	logging.SetBackend(backend)
+	check := fluentd_forwarder.CheckConfig(logging.MustGetLogger("fluentd-forwarder"), filename, sections, true)
+	for _, msg := range check.Warnings {
+		fmt.Fprintf(os.Stderr, "%s: warning: %s\n", progName, msg)
+	}
+	if len(check.Errors) > 0 {
+		for _, msg := range check.Errors {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", progName, msg)
+		}
+		return 1
+	}
+
+	if output == "" {
+		os.Stdout.Write(buf.Bytes())
+		return 0
+	}
+	err = ioutil.WriteFile(output, buf.Bytes(), 0600)
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %s.  Create %s and run `%s check -config %s` on the host before starting.\n", output, config.bufferDir, filepath.Base(progName), output)
+	return 0
+}
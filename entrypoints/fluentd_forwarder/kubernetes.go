@@ -0,0 +1,35 @@
+package main
+
+import (
+	fluentd_forwarder "github.com/fluent/fluentd-forwarder"
+	logging "github.com/op/go-logging"
+	"strings"
+)
+
+// bufferDirectories returns the directories of the buffers of the outputs.
+func bufferDirectories(params *FluentdForwarderParams) []string {
+	dirs := make([]string, 0)
+	for dir := range systemRequirements(params).BufferSpace {
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// checkBufferVolumes checks that the buffers are on the volumes of the pod,
+// logging the warnings, and returns false if they would be lost with the
+// container.
+func checkBufferVolumes(logger *logging.Logger, params *FluentdForwarderParams) bool {
+	mounts, err := fluentd_forwarder.ReadMounts()
+	if err != nil {
+		logger.Warningf("Failed to check the volumes of the buffers: %s", err.Error())
+		return true
+	}
+	check := fluentd_forwarder.CheckBufferVolumes(mounts, bufferDirectories(params))
+	for _, msg := range check.Warnings {
+		logger.Warning(strings.ToUpper(msg[:1]) + msg[1:])
+	}
+	for _, msg := range check.Errors {
+		Error("%s", msg)
+	}
+	return check.OK()
+}
@@ -8,16 +8,17 @@ import (
 	strftime "github.com/jehiah/go-strftime"
 	ioextras "github.com/moriyoshi/go-ioextras"
 	logging "github.com/op/go-logging"
-	gcfg "gopkg.in/gcfg.v1"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
-	"reflect"
 	"runtime/pprof"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -26,31 +27,107 @@ type FluentdForwarderParams struct {
 	ConnectionTimeout   time.Duration
 	WriteTimeout        time.Duration
 	FlushInterval       time.Duration
+	FlushTimeout        time.Duration
+	AccountingInterval  time.Duration
 	Parallelism         int
+	Workers             int
+	Supervise           bool
+	RestartLimit        int
+	RestartWindow       time.Duration
 	JournalGroupPath    string
 	MaxJournalChunkSize int64
+	BufferWatermark     int64
+	FlushDeadline       time.Duration
+	BufferAgeDeadline   time.Duration
+	TagMetricsLimit     int
+	DecodeWorkers       int
+	CoalesceInterval    time.Duration
+	CoalesceSize        int64
+	SocketOptions       fluentd_forwarder.SocketOptions
+	MaxMessageSize      int
+	TagMetricsDepth     int
+	OTLPEndpoint        string
+	TraceSampleRatio    float64
 	ListenOn            string
+	ListenProtocol      string
+	HTTPListenOn        string
+	AdminTokenFile      string
+	DebugListenOn       string
+	StatsDAddress       string
+	StatsDFormat        string
+	StatsDPrefix        string
+	StatsDInterval      time.Duration
 	OutputType          string
 	ForwardTo           string
 	LogLevel            logging.Level
 	LogFile             string
+	LogRotateSize       int64
+	LogRotateInterval   time.Duration
+	LogRotateKeep       int
+	LogRotateCompress   bool
+	LogSampleInterval   time.Duration
+	LogSampleBurst      int
+	AuditLogFile        string
+	AuditTag            string
+	LogFormat           string
+	InternalEventsLevel string
 	DatabaseName        string
 	TableName           string
 	ApiKey              string
 	Ssl                 bool
 	SslCACertBundleFile string
 	CPUProfileFile      string
+	DiagnosticsDir      string
+	StatusFile          string
+	StatusInterval      time.Duration
+	ReleaseURL          string
+	ReleaseInterval     time.Duration
+	SecretRefresh       time.Duration
+	ConfigPollInterval  time.Duration
+	CgroupLimits        StrictnessValue
+	Preflight           StrictnessValue
+	Kubernetes          bool
+	TerminationGrace    time.Duration
+	ShutdownTimeout     time.Duration
+	Daemon              bool
+	PIDFile             string
+	User                string
+	Group               string
+	Chroot              string
 	Metadata            string
+	Plugins             []string
+	Settings            *fluentd_forwarder.ConfigElement
+	ConfigFile          string
+	Profile             string
+	// the settings in the configuration file, against which the ones read
+	// on reloading are compared
+	ConfigSettings *fluentd_forwarder.ConfigElement
+	ConfigSections []*fluentd_forwarder.ConfigElement
+	// whether the configuration file is written in the syntax of fluentd,
+	// in which case the inputs and the outputs are only the ones declared
+	FluentdConfig bool
+	DryRun        bool
+	// the options, of which the settings of the configuration are
+	FlagSet *flag.FlagSet
 }
 
-type PortWorker interface {
-	fluentd_forwarder.Port
-	fluentd_forwarder.Worker
+// the levels of fluentd by which the internal events are tagged
+var internalEventsLevels = map[string]logging.Level{
+	"debug": logging.DEBUG,
+	"info":  logging.INFO,
+	"warn":  logging.WARNING,
+	"error": logging.ERROR,
+	"fatal": logging.CRITICAL,
 }
 
 var progName = os.Args[0]
 var progVersion string
 
+// progRevision and progBuildDate are given on linking by -ldflags "-X
+// main.progRevision=... -X main.progBuildDate=...", as progVersion is.
+var progRevision string
+var progBuildDate string
+
 func MustParseDuration(s string) time.Duration {
 	d, err := time.ParseDuration(s)
 	if err != nil {
@@ -59,10 +136,12 @@ func MustParseDuration(s string) time.Duration {
 	return d
 }
 
+// errorOutput is where Error writes, the event log when run as a Windows
+// service.
+var errorOutput io.Writer = os.Stderr
+
 func Error(fmtStr string, args ...interface{}) {
-	fmt.Fprint(os.Stderr, progName, ": ")
-	fmt.Fprintf(os.Stderr, fmtStr, args...)
-	fmt.Fprint(os.Stderr, "\n")
+	fmt.Fprintf(errorOutput, "%s: %s\n", progName, fmt.Sprintf(fmtStr, args...))
 }
 
 type LogLevelValue logging.Level
@@ -77,87 +156,373 @@ func (v *LogLevelValue) Set(s string) error {
 	return err
 }
 
-func updateFlagsByConfig(configFile string, flagSet *flag.FlagSet) error {
-	config := struct {
-		Fluentd_Forwarder struct {
-			Retry_interval     string `retry-interval`
-			Conn_timeout       string `conn-timeout`
-			Write_timeout      string `write-timeout`
-			Flush_interval     string `flush-interval`
-			Listen_on          string `listen-on`
-			To                 string `to`
-			Buffer_path        string `buffer-path`
-			Buffer_chunk_limit string `buffer-chunk-limit`
-			Log_level          string `log-level`
-			Ca_certs           string `ca-certs`
-			Cpuprofile         string `cpuprofile`
-			Log_file           string `log-file`
-		}
-	}{}
-	err := gcfg.ReadFileInto(&config, configFile)
+type StringsValue []string
+
+func (v *StringsValue) String() string {
+	return strings.Join(*v, ",")
+}
+
+func (v *StringsValue) Set(s string) error {
+	*v = append(*v, s)
+	return nil
+}
+
+// StrictnessValue is a check that is skipped (false), only warns (true) or
+// refuses to start (strict) if something falls short.  Like a boolean flag,
+// it may be given without a value.
+type StrictnessValue int
+
+const (
+	StrictnessOff StrictnessValue = iota
+	StrictnessWarn
+	StrictnessStrict
+)
+
+func (v *StrictnessValue) String() string {
+	switch *v {
+	case StrictnessOff:
+		return "false"
+	case StrictnessStrict:
+		return "strict"
+	}
+	return "true"
+}
+
+func (v *StrictnessValue) Set(s string) error {
+	if s == "strict" {
+		*v = StrictnessStrict
+		return nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("expected true, false or strict")
+	}
+	*v = StrictnessOff
+	if b {
+		*v = StrictnessWarn
+	}
+	return nil
+}
+
+func (v *StrictnessValue) IsBoolFlag() bool {
+	return true
+}
+
+// profileEnv is the environment variable giving the profile unless -profile
+// does.
+const profileEnv = "FLUENTD_FORWARDER_PROFILE"
+
+// configKeyEnv is the environment variable giving the configuration key
+// unless -config-key does.
+const configKeyEnv = "FLUENTD_FORWARDER_CONFIG_KEY"
+
+// loadConfigKey loads the key decrypting the encrypted values of the
+// configuration given as SOURCE:REFERENCE.
+func loadConfigKey(spec string) error {
+	key, err := fluentd_forwarder.LoadConfigKey(fluentd_forwarder.DefaultSecrets, spec)
+	if err != nil {
+		return fmt.Errorf("-config-key: %s", err.Error())
+	}
+	return fluentd_forwarder.DefaultSecrets.SetConfigKey(key)
+}
+
+// readConfigFile reads the configuration file, or fetches it if given by a
+// URL, overridden by the configuration of the profile unless it is empty,
+// returning its format, the fluentd-forwarder section, which is empty if
+// absent, and the other sections.
+func readConfigFile(configFile string, profile string) (string, *fluentd_forwarder.ConfigElement, []*fluentd_forwarder.ConfigElement, error) {
+	src, err := fluentd_forwarder.ReadConfigSource(configFile)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	// without the credentials in the messages
+	configFile = fluentd_forwarder.RedactConfigLocation(configFile)
+	format := fluentd_forwarder.ConfigFormat(configFile, src)
+	sections, err := fluentd_forwarder.ParseConfig(configFile, src)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if profile != "" {
+		sections, err = fluentd_forwarder.ReadConfigProfile(configFile, profile, sections)
+		if err != nil {
+			return "", nil, nil, err
+		}
+	}
+	settings := fluentd_forwarder.NewConfigElement("fluentd-forwarder", "")
+	retval := make([]*fluentd_forwarder.ConfigElement, 0, len(sections))
+	for _, section := range sections {
+		switch section.Name {
+		case "fluentd-forwarder":
+			for _, key := range section.Keys {
+				for _, v := range section.GetAll(key) {
+					settings.Add(key, v)
+				}
+			}
+		case "input", "filter", "output", "pipeline":
+			retval = append(retval, section)
+		default:
+			return "", nil, nil, fmt.Errorf("%s: unknown section: %s", configFile, section.String())
+		}
+	}
+	if workerID >= 0 {
+		adjustWorkerSections(retval)
+	}
+	return format, settings, retval, nil
+}
+
+func updateFlagsByConfig(configFile string, profile string, flagSet *flag.FlagSet) (*fluentd_forwarder.ConfigElement, []*fluentd_forwarder.ConfigElement, bool, error) {
+	format, settings, sections, err := readConfigFile(configFile, profile)
 	if err != nil {
-		return err
-	}
-	r := reflect.ValueOf(config.Fluentd_Forwarder)
-	rt := r.Type()
-	for i, l := 0, rt.NumField(); i < l; i += 1 {
-		f := rt.Field(i)
-		fv := r.Field(i)
-		v := fv.String()
-		if v != "" {
-			err := flagSet.Set(string(f.Tag), v)
+		return nil, nil, false, err
+	}
+	for _, key := range settings.Keys {
+		if key == "config" || key == "profile" || key == "config-key" || flagSet.Lookup(key) == nil {
+			return nil, nil, false, fmt.Errorf("%s: unknown setting: %s", fluentd_forwarder.RedactConfigLocation(configFile), key)
+		}
+		for _, v := range settings.GetAll(key) {
+			if v == "" {
+				continue
+			}
+			err := flagSet.Set(key, v)
 			if err != nil {
-				return err
+				return nil, nil, false, err
 			}
 		}
 	}
-	return nil
+	return settings, sections, format == fluentd_forwarder.ConfigFormatFluentd, nil
 }
 
-func ParseArgs() *FluentdForwarderParams {
+// changedSettings returns the keys of the settings that differ between the
+// fluentd-forwarder sections, which take effect only on restart.
+func changedSettings(a *fluentd_forwarder.ConfigElement, b *fluentd_forwarder.ConfigElement) []string {
+	retval := make([]string, 0)
+	for _, key := range a.Keys {
+		if strings.Join(a.GetAll(key), "\x00") != strings.Join(b.GetAll(key), "\x00") {
+			retval = append(retval, key)
+		}
+	}
+	for _, key := range b.Keys {
+		if _, ok := a.Params[key]; !ok {
+			retval = append(retval, key)
+		}
+	}
+	return retval
+}
+
+func ParseArgs(args []string) *FluentdForwarderParams {
 	configFile := ""
+	profile := ""
+	configKey := ""
 	retryInterval := (time.Duration)(0)
 	connectionTimeout := (time.Duration)(0)
 	writeTimeout := (time.Duration)(0)
 	flushInterval := (time.Duration)(0)
+	flushTimeout := (time.Duration)(0)
+	accountingInterval := (time.Duration)(0)
 	parallelism := 0
+	workers := 1
+	supervise := false
+	restartLimit := 0
+	restartWindow := (time.Duration)(0)
 	listenOn := ""
+	listenProtocol := ""
+	httpListenOn := ""
+	adminTokenFile := ""
+	debugListenOn := ""
+	statsDAddress := ""
+	statsDFormat := "statsd"
+	statsDPrefix := ""
+	statsDInterval := (time.Duration)(0)
 	forwardTo := ""
 	journalGroupPath := ""
 	maxJournalChunkSize := int64(16777216)
+	bufferWatermark := int64(0)
+	flushDeadline := (time.Duration)(0)
+	bufferAgeDeadline := (time.Duration)(0)
+	tagMetricsLimit := 100
+	decodeWorkers := 0
+	coalesceInterval := (time.Duration)(0)
+	coalesceSize := int64(0)
+	socketOptions := fluentd_forwarder.DefaultSocketOptions
+	maxMessageSize := 0
+	tagMetricsDepth := 0
+	otlpEndpoint := ""
+	traceSampleRatio := 0.0
 	logLevel := LogLevelValue(logging.INFO)
 	sslCACertBundleFile := ""
 	cpuProfileFile := ""
+	diagnosticsDir := ""
+	statusFile := ""
+	statusInterval := (time.Duration)(0)
+	releaseURL := ""
+	releaseInterval := (time.Duration)(0)
+	secretRefreshInterval := (time.Duration)(0)
+	configPollInterval := (time.Duration)(0)
+	cgroupLimits := StrictnessWarn
+	preflight := StrictnessWarn
+	kubernetes := false
+	terminationGrace := (time.Duration)(0)
+	shutdownTimeout := (time.Duration)(0)
 	logFile := ""
+	logRotateSize := int64(0)
+	logRotateInterval := (time.Duration)(0)
+	logRotateKeep := 0
+	logRotateCompress := false
+	logSampleInterval := (time.Duration)(0)
+	logSampleBurst := 1
+	auditLogFile := ""
+	auditTag := ""
+	logFormat := "text"
+	internalEventsLevel := ""
 	metadata := ""
+	plugins := StringsValue{}
+	configSections := []*fluentd_forwarder.ConfigElement{}
+	fluentdConfig := false
+	configSettings := fluentd_forwarder.NewConfigElement("fluentd-forwarder", "")
+	dryRun := false
+	daemon := false
+	pidFile := ""
+	userName := ""
+	groupName := ""
+	chroot := ""
 
 	flagSet := flag.NewFlagSet(progName, flag.ExitOnError)
 
-	flagSet.StringVar(&configFile, "config", "", "configuration file")
+	flagSet.StringVar(&configFile, "config", "", "configuration file, or the http://, https://, etcd:// or consul:// URL from which it is fetched")
+	flagSet.StringVar(&profile, "profile", os.Getenv(profileEnv), "profile, such as prod, whose configuration overrides -config: the file, or the last element of the path of the URL, with the profile inserted before the extension. "+profileEnv+" if unspecified")
+	flagSet.StringVar(&configKey, "config-key", os.Getenv(configKeyEnv), "key decrypting the values of the configuration written as enc:CIPHERTEXT, given as SOURCE:REFERENCE: the key in base64 read from a source of the secrets, such as file:/etc/fluentd-forwarder/config.key, or aws-kms:PATH to decrypt the data key in the file by AWS KMS. "+configKeyEnv+" if unspecified")
 	flagSet.DurationVar(&retryInterval, "retry-interval", 0, "retry interval in which connection is tried against the remote agent")
 	flagSet.DurationVar(&connectionTimeout, "conn-timeout", MustParseDuration("10s"), "connection timeout")
 	flagSet.DurationVar(&writeTimeout, "write-timeout", MustParseDuration("10s"), "write timeout on wire")
 	flagSet.DurationVar(&flushInterval, "flush-interval", MustParseDuration("5s"), "flush interval in which the events are forwareded to the remote agent")
+	flagSet.DurationVar(&flushTimeout, "flush-timeout", 0, "time after which the flush of a chunk is abandoned and the chunk is left to be sent again. unlimited if 0")
+	flagSet.DurationVar(&accountingInterval, "accounting-interval", 0, "interval in which the forwarder tells the next one how many events it has sent so that the lost ones are counted. the next one has to be a fluentd-forwarder. disabled if 0")
 	flagSet.IntVar(&parallelism, "parallelism", 1, "Number of chunks to submit at once (for td output)")
+	flagSet.IntVar(&workers, "workers", 1, "number of the worker processes accepting on the same listening sockets, each with its own buffers in the workerN subdirectory of the buffer directories")
+	flagSet.BoolVar(&supervise, "supervise", false, "run the forwarder in a worker process under a supervisor, which restarts it when it crashes. implied by -workers greater than 1")
+	flagSet.IntVar(&restartLimit, "restart-limit", 5, "number of the restarts of a worker within -restart-window, after which the supervisor stops and exits with the status 3. never gives up if 0")
+	flagSet.DurationVar(&restartWindow, "restart-window", MustParseDuration("10m"), "period within which the restarts of a worker are counted against -restart-limit")
 	flagSet.StringVar(&listenOn, "listen-on", "127.0.0.1:24224", "interface address and port on which the forwarder listens")
+	flagSet.StringVar(&listenProtocol, "listen-protocol", "auto", "protocol in which the forwarder takes the messages on -listen-on: msgpack, json, or auto to detect it on each connection")
+	flagSet.IntVar(&decodeWorkers, "decode-workers", 0, "number of the workers decoding the messages received in msgpack, apart from the connections reading them. GOMAXPROCS if 0")
+	flagSet.DurationVar(&coalesceInterval, "coalesce-interval", 0, "time for which the record sets received on -listen-on are coalesced into a batch before they are buffered, so that the many small messages of the chatty senders are buffered at once. not coalesced if 0")
+	flagSet.Int64Var(&coalesceSize, "coalesce-size", fluentd_forwarder.DefaultCoalesceSize, "size in bytes of the messages coalesced into a batch, at which the batch is buffered without waiting for -coalesce-interval")
+	flagSet.IntVar(&maxMessageSize, "max-message-size", fluentd_forwarder.DefaultMaxMessageSize, "size in bytes of a message in msgpack taken on -listen-on at most, beyond which the connection is closed. unlimited if 0")
+	flagSet.IntVar(&socketOptions.ReadBufferSize, "read-buffer-size", fluentd_forwarder.DefaultReadBufferSize, "size in bytes of the buffer through which each connection to -listen-on is read")
+	flagSet.IntVar(&socketOptions.ReceiveBufferSize, "socket-receive-buffer", 0, "SO_RCVBUF in bytes of the connections of the forward inputs and outputs. the one of the system if 0")
+	flagSet.IntVar(&socketOptions.SendBufferSize, "socket-send-buffer", 0, "SO_SNDBUF in bytes of the connections of the forward inputs and outputs. the one of the system if 0")
+	flagSet.BoolVar(&socketOptions.NoDelay, "tcp-nodelay", true, "set TCP_NODELAY to the connections of the forward inputs and outputs")
+	flagSet.StringVar(&httpListenOn, "http-listen-on", "", "interface address and port on which the HTTP endpoints such as /metrics are served. disabled if unspecified")
+	flagSet.StringVar(&adminTokenFile, "admin-token-file", "", "path of the file holding the bearer token of the admin API served on -http-listen-on, which adds outputs at runtime and is required to change the log levels, trace, close connections and flush over HTTP and to download the diagnostics. disabled if unspecified")
+	flagSet.IntVar(&tagMetricsLimit, "tag-metrics-limit", 100, "maximum number of the tags counted separately in the metrics. the rest are counted as __other__, and none is counted if 0")
+	flagSet.IntVar(&tagMetricsDepth, "tag-metrics-depth", 0, "number of the leading parts of a tag by which the metrics are counted. the whole tag if 0")
+	flagSet.StringVar(&otlpEndpoint, "otlp-endpoint", "", "URL of the OTLP/HTTP endpoint to which the traces are exported, like http://127.0.0.1:4318/v1/traces. disabled if unspecified")
+	flagSet.Float64Var(&traceSampleRatio, "trace-sample-ratio", 0, "ratio of the messages for which a trace is started when not propagated from the sender")
+	flagSet.StringVar(&debugListenOn, "debug-listen-on", "", "interface address and port on which pprof and expvar are served. disabled if unspecified")
+	flagSet.StringVar(&statsDAddress, "statsd-address", "", "host and port of the StatsD server to which the metrics are pushed over UDP. disabled if unspecified")
+	flagSet.StringVar(&statsDFormat, "statsd-format", "statsd", "format in which the metrics are pushed; statsd or dogstatsd")
+	flagSet.StringVar(&statsDPrefix, "statsd-prefix", "", "prefix of the names of the metrics pushed to StatsD")
+	flagSet.DurationVar(&statsDInterval, "statsd-interval", MustParseDuration("10s"), "interval in which the metrics are pushed to StatsD")
 	flagSet.StringVar(&forwardTo, "to", "fluent://127.0.0.1:24225", "host and port to which the events are forwarded")
 	flagSet.StringVar(&journalGroupPath, "buffer-path", "*", "directory / path on which buffer files are created. * may be used within the path to indicate the prefix or suffix like var/pre*suf")
 	flagSet.Int64Var(&maxJournalChunkSize, "buffer-chunk-limit", 16777216, "Maximum size of a buffer chunk")
+	flagSet.Int64Var(&bufferWatermark, "buffer-watermark", 0, "size of the buffer of an output above which /readyz fails. unchecked if 0")
+	flagSet.DurationVar(&flushDeadline, "flush-deadline", 0, "time within which a flush of an output has to complete, or the output is reported stuck. unchecked if 0")
+	flagSet.DurationVar(&bufferAgeDeadline, "buffer-age-deadline", 0, "time within which the records buffered by an output have to be delivered, or the output is reported stuck. unchecked if 0")
 	flagSet.Var(&logLevel, "log-level", "log level (defaults to INFO)")
 	flagSet.StringVar(&sslCACertBundleFile, "ca-certs", "", "path to SSL CA certificate bundle file")
+	flagSet.Var(&cgroupLimits, "cgroup-limits", "set GOMAXPROCS and the soft memory limit by the CPU and the memory limits of the cgroup unless GOMAXPROCS and GOMEMLIMIT are set, warning if the buffers of the outputs do not fit in the memory, or refusing to start if strict")
+	flagSet.Var(&preflight, "preflight", "check the limit of the open files and the free space of the directories of the buffers before starting, warning if they fall short, or refusing to start if strict")
+	flagSet.BoolVar(&kubernetes, "kubernetes", false, "run as a pod of Kubernetes: fail /readyz until the recovered buffers are flushed, drain the outputs on SIGTERM within the termination grace period and refuse to start if the buffers are on the writable layer of the container")
+	flagSet.DurationVar(&terminationGrace, "termination-grace-period", MustParseDuration("30s"), "terminationGracePeriodSeconds of the pod, within which the outputs are drained on SIGTERM in the Kubernetes mode")
+	flagSet.DurationVar(&shutdownTimeout, "shutdown-timeout", 0, "time within which the forwarder shuts down on SIGTERM or SIGINT, draining the outputs first and reporting what is abandoned when it runs out. defaults to -termination-grace-period in the Kubernetes mode, unlimited otherwise")
 	flagSet.StringVar(&cpuProfileFile, "cpuprofile", "", "write CPU profile to file")
+	flagSet.StringVar(&statusFile, "status-file", "", "path of the JSON file to which the status of the forwarder is written periodically. disabled if unspecified")
+	flagSet.DurationVar(&statusInterval, "status-interval", MustParseDuration("10s"), "interval in which the status file is written")
+	flagSet.StringVar(&releaseURL, "release-url", "", "URL of the JSON metadata of the latest release, holding its version in \"version\" or \"tag_name\", against which the running version is checked. not checked if unspecified")
+	flagSet.DurationVar(&releaseInterval, "release-check-interval", MustParseDuration("24h"), "interval in which the latest release is checked. checked only on startup if 0")
+	flagSet.DurationVar(&secretRefreshInterval, "secret-refresh-interval", MustParseDuration("5m"), "interval in which the secrets referred to by the configuration file are fetched again, reloading the configuration if any has changed. not refreshed if 0")
+	flagSet.DurationVar(&configPollInterval, "config-poll-interval", MustParseDuration("1m"), "interval in which the configuration given by a URL is fetched again, reloading it if it has changed. not polled if 0")
+	flagSet.StringVar(&diagnosticsDir, "diagnostics-dir", "", "directory into which the diagnostics are written on SIGQUIT. the temporary directory if unspecified")
 	flagSet.StringVar(&logFile, "log-file", "", "path of the log file. log will be written to stderr if unspecified")
+	flagSet.Int64Var(&logRotateSize, "log-rotate-size", 0, "size of the log file in bytes above which it is rotated. not rotated by the size if 0")
+	flagSet.DurationVar(&logRotateInterval, "log-rotate-interval", 0, "interval in which the log file is rotated, like 24h. not rotated by time if 0")
+	flagSet.IntVar(&logRotateKeep, "log-rotate-keep", 0, "number of the rotated log files kept. all of them are kept if 0")
+	flagSet.BoolVar(&logRotateCompress, "log-rotate-compress", false, "compress the rotated log files with gzip")
+	flagSet.DurationVar(&logSampleInterval, "log-sample-interval", 0, "interval in which the same warning or error is logged at most -log-sample-burst times, followed by the number of the suppressed ones. not sampled if 0")
+	flagSet.IntVar(&logSampleBurst, "log-sample-burst", 1, "number of the same warnings or errors logged in every -log-sample-interval")
+	flagSet.StringVar(&auditLogFile, "audit-log", "", "path of the file to which the connections to the inputs are recorded. not recorded in a file if unspecified")
+	flagSet.StringVar(&auditTag, "audit-tag", "", "tag with which the connections to the inputs are emitted into the pipeline. not emitted if unspecified")
+	flagSet.StringVar(&logFormat, "log-format", "text", "format of the log; text or json")
+	flagSet.StringVar(&internalEventsLevel, "internal-events-level", "", "level of the log at or above which the log is also emitted into the pipeline tagged fluent.LEVEL; debug, info, warn, error or fatal. disabled if unspecified")
 	flagSet.StringVar(&metadata, "metadata", "", "set addtional data into record")
-	flagSet.Parse(os.Args[1:])
+	flagSet.Var(&plugins, "plugin", "path to a Go plugin (.so) to load. may be specified more than once")
+	flagSet.BoolVar(&daemon, "daemon", false, "run in the background, detached from the terminal, once started up. requires -log-file")
+	flagSet.StringVar(&pidFile, "pid-file", "", "file to write the pid to, which is refused if it has the pid of a process still running and removed on exit")
+	flagSet.StringVar(&userName, "user", "", "user, by the name or the uid, to run as once the inputs are listening, so that they can listen on the privileged ports. the user is not changed if unspecified")
+	flagSet.StringVar(&groupName, "group", "", "group, by the name or the gid, to run as once the inputs are listening. the primary group of -user if unspecified")
+	flagSet.StringVar(&chroot, "chroot", "", "directory to change the root directory to once the inputs are listening, in which the paths of the buffers and the other files are taken. not changed if unspecified")
+	flagSet.BoolVar(&dryRun, "dry-run", false, "check the configuration, resolving the hosts and checking the files and the buffer directories, and exit without listening on anything")
+	flagSet.Usage = func() { usage(flagSet) }
+	flagSet.Parse(args)
+
+	if configKey != "" {
+		err := loadConfigKey(configKey)
+		if err != nil {
+			Error("%s", err.Error())
+			os.Exit(1)
+		}
+	}
 
 	if configFile != "" {
-		err := updateFlagsByConfig(configFile, flagSet)
+		err := (error)(nil)
+		configSettings, configSections, fluentdConfig, err = updateFlagsByConfig(configFile, profile, flagSet)
 		if err != nil {
 			Error("%s", err.Error())
 			os.Exit(1)
 		}
 	}
 
+	settings := fluentd_forwarder.NewConfigElement("fluentd-forwarder", "")
+	flagSet.VisitAll(func(f *flag.Flag) {
+		settings.Set(f.Name, f.Value.String())
+	})
+
+	if logFormat != "text" && logFormat != "json" {
+		Error("Invalid log format: %s", logFormat)
+		os.Exit(1)
+	}
+
+	if _, ok := internalEventsLevels[internalEventsLevel]; !ok && internalEventsLevel != "" {
+		Error("Invalid internal events level: %s", internalEventsLevel)
+		os.Exit(1)
+	}
+
+	if err := fluentd_forwarder.CheckForwardProtocol(listenProtocol); err != nil {
+		Error("-listen-protocol: %s", err.Error())
+		os.Exit(1)
+	}
+
+	if coalesceSize <= 0 {
+		Error("-coalesce-size must be positive")
+		os.Exit(1)
+	}
+
+	if maxMessageSize < 0 {
+		Error("-max-message-size may not be negative")
+		os.Exit(1)
+	}
+
+	if err := socketOptions.Check(); err != nil {
+		Error("-%s", err.Error())
+		os.Exit(1)
+	}
+
+	if traceSampleRatio < 0 || traceSampleRatio > 1 {
+		Error("Trace sample ratio must be between 0 and 1")
+		os.Exit(1)
+	}
+
 	ssl := false
 	outputType := ""
 	databaseName := "*"
@@ -190,6 +555,10 @@ func ParseArgs() *FluentdForwarderParams {
 			if len(p) > 2 {
 				tableName = p[2]
 			}
+		default:
+			// may be provided by a plugin, which is checked once loaded
+			outputType = u.Scheme
+			settings.Set("type", u.Scheme)
 		}
 	} else {
 		outputType = "fluent"
@@ -202,13 +571,30 @@ func ParseArgs() *FluentdForwarderParams {
 			forwardTo += ":24224"
 		}
 	}
+	if kubernetes && shutdownTimeout == 0 {
+		shutdownTimeout = terminationGrace
+	}
 	return &FluentdForwarderParams{
 		RetryInterval:       retryInterval,
 		ConnectionTimeout:   connectionTimeout,
 		WriteTimeout:        writeTimeout,
 		FlushInterval:       flushInterval,
+		FlushTimeout:        flushTimeout,
+		AccountingInterval:  accountingInterval,
 		Parallelism:         parallelism,
+		Workers:             workers,
+		Supervise:           supervise,
+		RestartLimit:        restartLimit,
+		RestartWindow:       restartWindow,
 		ListenOn:            listenOn,
+		ListenProtocol:      listenProtocol,
+		HTTPListenOn:        httpListenOn,
+		AdminTokenFile:      adminTokenFile,
+		DebugListenOn:       debugListenOn,
+		StatsDAddress:       statsDAddress,
+		StatsDFormat:        statsDFormat,
+		StatsDPrefix:        statsDPrefix,
+		StatsDInterval:      statsDInterval,
 		OutputType:          outputType,
 		ForwardTo:           forwardTo,
 		Ssl:                 ssl,
@@ -217,15 +603,67 @@ func ParseArgs() *FluentdForwarderParams {
 		ApiKey:              apiKey,
 		JournalGroupPath:    journalGroupPath,
 		MaxJournalChunkSize: maxJournalChunkSize,
+		BufferWatermark:     bufferWatermark,
+		FlushDeadline:       flushDeadline,
+		BufferAgeDeadline:   bufferAgeDeadline,
+		TagMetricsLimit:     tagMetricsLimit,
+		DecodeWorkers:       decodeWorkers,
+		CoalesceInterval:    coalesceInterval,
+		CoalesceSize:        coalesceSize,
+		SocketOptions:       socketOptions,
+		MaxMessageSize:      maxMessageSize,
+		TagMetricsDepth:     tagMetricsDepth,
+		OTLPEndpoint:        otlpEndpoint,
+		TraceSampleRatio:    traceSampleRatio,
 		LogLevel:            logging.Level(logLevel),
 		LogFile:             logFile,
+		LogRotateSize:       logRotateSize,
+		LogRotateInterval:   logRotateInterval,
+		LogRotateKeep:       logRotateKeep,
+		LogRotateCompress:   logRotateCompress,
+		LogSampleInterval:   logSampleInterval,
+		LogSampleBurst:      logSampleBurst,
+		AuditLogFile:        auditLogFile,
+		AuditTag:            auditTag,
+		LogFormat:           logFormat,
+		InternalEventsLevel: internalEventsLevel,
 		SslCACertBundleFile: sslCACertBundleFile,
 		CPUProfileFile:      cpuProfileFile,
+		DiagnosticsDir:      diagnosticsDir,
+		StatusFile:          statusFile,
+		StatusInterval:      statusInterval,
+		ReleaseURL:          releaseURL,
+		ReleaseInterval:     releaseInterval,
+		SecretRefresh:       secretRefreshInterval,
+		ConfigPollInterval:  configPollInterval,
+		CgroupLimits:        cgroupLimits,
+		Preflight:           preflight,
+		Kubernetes:          kubernetes,
+		TerminationGrace:    terminationGrace,
+		ShutdownTimeout:     shutdownTimeout,
+		Daemon:              daemon,
+		PIDFile:             pidFile,
+		User:                userName,
+		Group:               groupName,
+		Chroot:              chroot,
 		Metadata:            metadata,
+		Plugins:             plugins,
+		Settings:            settings,
+		ConfigFile:          configFile,
+		Profile:             profile,
+		ConfigSettings:      configSettings,
+		ConfigSections:      configSections,
+		FluentdConfig:       fluentdConfig,
+		DryRun:              dryRun,
+		FlagSet:             flagSet,
 	}
 }
 
 func ValidateParams(params *FluentdForwarderParams) bool {
+	if (params.LogRotateSize != 0 || params.LogRotateInterval != 0 || params.LogRotateKeep != 0 || params.LogRotateCompress) && (params.LogFile == "" || strings.ContainsRune(params.LogFile, '%')) {
+		Error("Log rotation requires a log file without format specifications")
+		return false
+	}
 	if params.RetryInterval < 0 {
 		Error("Retry interval may not be negative")
 		return false
@@ -242,6 +680,22 @@ func ValidateParams(params *FluentdForwarderParams) bool {
 		Error("Flush interval must be greater than or equal to 100ms")
 		return false
 	}
+	if params.Workers < 1 {
+		Error("Number of workers must be positive")
+		return false
+	}
+	if params.Daemon && params.LogFile == "" {
+		Error("Daemon requires a log file")
+		return false
+	}
+	if params.RestartLimit < 0 {
+		Error("Restart limit may not be negative")
+		return false
+	}
+	if params.RestartWindow <= 0 {
+		Error("Restart window must be positive")
+		return false
+	}
 	switch params.OutputType {
 	case "fluent":
 		if params.RetryInterval == 0 {
@@ -261,12 +715,37 @@ func ValidateParams(params *FluentdForwarderParams) bool {
 }
 
 func main() {
-	params := ParseArgs()
+	if len(os.Args) > 1 {
+		if command := findCommand(os.Args[1]); command != nil {
+			os.Exit(command.run(os.Args[2:]))
+		}
+	}
+	params := ParseArgs(os.Args[1:])
 	if !ValidateParams(params) {
 		os.Exit(1)
 	}
+	if params.DryRun {
+		os.Exit(runDryRun(params))
+	}
+	if params.Daemon && !isDaemon() && workerID < 0 && upgradedFrom < 0 {
+		os.Exit(daemonize())
+	}
+	if workerID >= 0 {
+		adjustWorkerParams(params)
+	}
+	inheritListeners()
 	logWriter := (io.Writer)(nil)
-	if params.LogFile != "" {
+	logFile := (*fluentd_forwarder.RotatingFile)(nil)
+	if params.LogFile != "" && !strings.ContainsRune(params.LogFile, '%') {
+		err := (error)(nil)
+		logFile, err = fluentd_forwarder.NewRotatingFile(params.LogFile, params.LogRotateSize, params.LogRotateInterval, params.LogRotateKeep, params.LogRotateCompress)
+		if err != nil {
+			Error("%s", err.Error())
+			os.Exit(1)
+		}
+		logWriter = logFile
+		defer logFile.Close()
+	} else if params.LogFile != "" {
 		logWriter = ioextras.NewStaticRotatingWriter(
 			func(_ interface{}) (string, error) {
 				path := strftime.Format(params.LogFile, time.Now())
@@ -285,15 +764,112 @@ func main() {
 	} else {
 		logWriter = os.Stderr
 	}
-	logBackend := logging.NewLogBackend(logWriter, "[fluentd-forwarder] ", log.Ldate|log.Ltime|log.Lmicroseconds)
-	logging.SetBackend(logBackend)
+	logBackend := (logging.Backend)(nil)
+	if params.LogFormat == "json" {
+		logBackend = fluentd_forwarder.NewJSONLogBackend(logWriter)
+	} else {
+		prefix := "[fluentd-forwarder] "
+		if workerID >= 0 {
+			prefix = fmt.Sprintf("[fluentd-forwarder#%d] ", workerID)
+		}
+		logBackend = logging.NewLogBackend(logWriter, prefix, log.Ldate|log.Ltime|log.Lmicroseconds)
+	}
+	if params.LogFile == "" && isWindowsService() {
+		// nobody sees the standard error of a service
+		eventLogBackend, err := newEventLogBackend()
+		if err != nil {
+			Error("%s", err.Error())
+			os.Exit(1)
+		}
+		logBackend = eventLogBackend
+	}
+	internalEvents := (*fluentd_forwarder.InternalEventEmitter)(nil)
+	if params.InternalEventsLevel != "" {
+		internalEvents = fluentd_forwarder.NewInternalEventEmitter(logBackend, internalEventsLevels[params.InternalEventsLevel])
+		logBackend = internalEvents
+	}
+	logSampler := (*fluentd_forwarder.LogSampler)(nil)
+	if params.LogSampleInterval > 0 {
+		err := (error)(nil)
+		logSampler, err = fluentd_forwarder.NewLogSampler(logBackend, params.LogSampleInterval, params.LogSampleBurst)
+		if err != nil {
+			Error("%s", err.Error())
+			os.Exit(1)
+		}
+		logBackend = logSampler
+		// samples from the first message on
+		logSampler.Start()
+	}
+	logLevels := fluentd_forwarder.NewLogLevels(logBackend)
+	logging.SetBackend(logLevels)
+	// the levels of the components can be changed separately at runtime
 	logger := logging.MustGetLogger("fluentd-forwarder")
-	logging.SetLevel(params.LogLevel, "fluentd-forwarder")
+	inputLogger := logging.MustGetLogger("fluentd-forwarder.input")
+	pipelineLogger := logging.MustGetLogger("fluentd-forwarder.pipeline")
+	for _, module := range []string{logger.Module, inputLogger.Module, pipelineLogger.Module} {
+		logLevels.SetLevel(params.LogLevel, module)
+	}
+	// logs at DEBUG only while the records are traced by /api/trace
+	fluentd_forwarder.DefaultRecordTracer = fluentd_forwarder.NewRecordTracer(logging.MustGetLogger("fluentd-forwarder.trace"), logLevels)
 	if progVersion != "" {
 		logger.Infof("Version %s starting...", progVersion)
 	}
+	if params.CgroupLimits != StrictnessOff && !applyCgroupLimits(logger, params) {
+		os.Exit(1)
+	}
+	// the workers share the limits checked by the supervisor
+	if params.Preflight != StrictnessOff && workerID < 0 && !checkSystemLimits(logger, params) {
+		os.Exit(1)
+	}
+	if params.Kubernetes && workerID < 0 && !checkBufferVolumes(logger, params) {
+		os.Exit(1)
+	}
+	if upgradedFrom > 0 {
+		waitForUpgrade(logger)
+	}
+	if params.PIDFile != "" && workerID < 0 {
+		err := writePIDFile(params.PIDFile)
+		if err != nil {
+			Error("%s", err.Error())
+			os.Exit(1)
+		}
+		defer removePIDFile(params.PIDFile)
+	}
+	if (params.Workers > 1 || params.Supervise) && workerID < 0 {
+		status := runSupervisor(logger, params, logWriter)
+		if params.PIDFile != "" {
+			removePIDFile(params.PIDFile)
+		}
+		os.Exit(status)
+	}
+	// the supervisor stays privileged to listen for the workers it restarts
+	if params.User != "" || params.Group != "" || params.Chroot != "" {
+		err := dropPrivileges(logger, params)
+		if err != nil {
+			Error("%s", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	fluentd_forwarder.DefaultTagMetrics.SetLimits(params.TagMetricsLimit, params.TagMetricsDepth)
+	fluentd_forwarder.DefaultDecodePool = fluentd_forwarder.NewDecodePool(params.DecodeWorkers)
+	fluentd_forwarder.DefaultSocketOptions = params.SocketOptions
 
 	workerSet := fluentd_forwarder.NewWorkerSet()
+	if logSampler != nil {
+		workerSet.Add(logSampler)
+	}
+
+	if params.OTLPEndpoint != "" {
+		fluentd_forwarder.DefaultTracer = fluentd_forwarder.NewTracer(
+			logger,
+			fluentd_forwarder.NewOTLPExporter(params.OTLPEndpoint, "fluentd-forwarder", MustParseDuration("10s")),
+			params.TraceSampleRatio,
+			MustParseDuration("5s"),
+		)
+		workerSet.Add(fluentd_forwarder.DefaultTracer)
+		fluentd_forwarder.DefaultTracer.Start()
+	}
 
 	if params.CPUProfileFile != "" {
 		f, err := os.Create(params.CPUProfileFile)
@@ -305,17 +881,32 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	output := (PortWorker)(nil)
+	for _, path := range params.Plugins {
+		err := fluentd_forwarder.LoadPlugin(logger, path)
+		if err != nil {
+			Error("%s", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	output := (fluentd_forwarder.Output)(nil)
 	err := (error)(nil)
-	switch params.OutputType {
+	outputType := params.OutputType
+	if params.FluentdConfig {
+		outputType = ""
+	}
+	switch outputType {
+	case "":
+		// the events no <match> matches are discarded as fluentd does
 	case "fluent":
 		output, err = fluentd_forwarder.NewForwardOutput(
-			logger,
+			pipelineLogger,
 			params.ForwardTo,
 			params.RetryInterval,
 			params.ConnectionTimeout,
 			params.WriteTimeout,
 			params.FlushInterval,
+			params.FlushTimeout,
 			params.JournalGroupPath,
 			params.MaxJournalChunkSize,
 			params.Metadata,
@@ -335,11 +926,12 @@ func main() {
 			}
 		}
 		output, err = fluentd_forwarder.NewTDOutput(
-			logger,
+			pipelineLogger,
 			params.ForwardTo,
 			params.ConnectionTimeout,
 			params.WriteTimeout,
 			params.FlushInterval,
+			params.FlushTimeout,
 			params.Parallelism,
 			params.JournalGroupPath,
 			params.MaxJournalChunkSize,
@@ -352,26 +944,408 @@ func main() {
 			"", // TODO:http-proxy
 			params.Metadata,
 		)
+	default:
+		if !fluentd_forwarder.HasOutput(params.OutputType) {
+			Error("Invalid output specifier")
+			os.Exit(1)
+		}
+		output, err = fluentd_forwarder.NewOutput(pipelineLogger, params.Settings)
+	}
+	if err != nil {
+		Error("%s", err.Error())
+		return
+	}
+	if forwardOutput, ok := output.(*fluentd_forwarder.ForwardOutput); ok && params.AccountingInterval > 0 {
+		forwardOutput.EnableAccounting(params.AccountingInterval)
+	}
+	if output != nil {
+		workerSet.Add(output)
+	}
+
+	pipeline, err := fluentd_forwarder.NewReloadablePipeline(pipelineLogger, params.ConfigSections, output)
+	if err != nil {
+		Error("%s", err.Error())
+		return
+	}
+	workerSet.Add(pipeline)
+	// the outputs added by the admin API are kept on reloading
+	adminHandler := (*fluentd_forwarder.AdminHandler)(nil)
+	// the endpoints changing something take the token as well, and are
+	// refused without it
+	adminToken := ""
+	if params.AdminTokenFile != "" {
+		if params.HTTPListenOn == "" {
+			Error("-admin-token-file requires -http-listen-on")
+			return
+		}
+		b, err := ioutil.ReadFile(params.AdminTokenFile)
+		if err != nil {
+			Error("%s", err.Error())
+			return
+		}
+		token := strings.TrimSpace(string(b))
+		if token == "" {
+			Error("%s: the admin token is empty", params.AdminTokenFile)
+			return
+		}
+		adminToken = token
+		adminHandler = fluentd_forwarder.NewAdminHandler(pipelineLogger, token, pipeline, params.ConfigSections)
+	}
+	if internalEvents != nil {
+		internalEvents.SetPort(pipeline.Head())
+		workerSet.Add(internalEvents)
+	}
+
+	if params.AuditLogFile != "" || params.AuditTag != "" {
+		auditWriter := (io.Writer)(nil)
+		if params.AuditLogFile != "" {
+			f, err := os.OpenFile(params.AuditLogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, os.FileMode(0600))
+			if err != nil {
+				Error("%s", err.Error())
+				return
+			}
+			defer f.Close()
+			auditWriter = f
+		}
+		auditPort := (fluentd_forwarder.Port)(nil)
+		if params.AuditTag != "" {
+			auditPort = pipeline.Head()
+		}
+		fluentd_forwarder.DefaultAuditLog = fluentd_forwarder.NewAuditLog(auditWriter, auditPort, params.AuditTag)
+	}
+
+	input := (fluentd_forwarder.Worker)(nil)
+	if !params.FluentdConfig {
+		input_, err := fluentd_forwarder.NewForwardInput(inputLogger, params.ListenOn, pipeline.Head())
+		if err != nil {
+			Error(err.Error())
+			return
+		}
+		input_.SetProtocol(params.ListenProtocol)
+		input_.SetMaxMessageSize(params.MaxMessageSize)
+		if params.CoalesceInterval > 0 {
+			input_.SetCoalescing(params.CoalesceInterval, params.CoalesceSize)
+		}
+		input = input_
+		workerSet.Add(input)
 	}
+	inputSet, err := fluentd_forwarder.NewInputSet(inputLogger, params.ConfigSections, pipeline.Label)
 	if err != nil {
 		Error("%s", err.Error())
 		return
 	}
-	workerSet.Add(output)
-	input, err := fluentd_forwarder.NewForwardInput(logger, params.ListenOn, output)
+	workerSet.Add(inputSet)
+	inputs := func() []fluentd_forwarder.Worker {
+		if input == nil {
+			return inputSet.Inputs()
+		}
+		return append([]fluentd_forwarder.Worker{input}, inputSet.Inputs()...)
+	}
+
+	allOutputs := func() []fluentd_forwarder.Output {
+		if output == nil {
+			return pipeline.Outputs()
+		}
+		return append([]fluentd_forwarder.Output{output}, pipeline.Outputs()...)
+	}
+	watchdog := (*fluentd_forwarder.OutputWatchdog)(nil)
+	if params.FlushDeadline > 0 || params.BufferAgeDeadline > 0 {
+		watchdog = fluentd_forwarder.NewOutputWatchdog(logger, allOutputs, params.FlushDeadline, params.BufferAgeDeadline, MustParseDuration("1s"))
+		workerSet.Add(watchdog)
+	}
+
+	statusFile := (*fluentd_forwarder.StatusFile)(nil)
+	if params.StatusFile != "" {
+		statusFile, err = fluentd_forwarder.NewStatusFile(logger, params.StatusFile, allOutputs, params.StatusInterval)
+		if err != nil {
+			Error("%s", err.Error())
+			return
+		}
+		workerSet.Add(statusFile)
+	}
+
+	versionReporter, err := fluentd_forwarder.NewVersionReporter(logger, fluentd_forwarder.NewBuildInfo(progVersion, progRevision, progBuildDate), params.ReleaseURL, params.ReleaseInterval)
 	if err != nil {
-		Error(err.Error())
+		Error("%s", err.Error())
 		return
 	}
-	workerSet.Add(input)
+	if params.ReleaseURL != "" {
+		workerSet.Add(versionReporter)
+	}
+
+	// the sections in effect, which reloading replaces; the settings are
+	// kept until a restart
+	configMtx := sync.Mutex{}
+	configInEffect := append([]*fluentd_forwarder.ConfigElement{params.Settings}, params.ConfigSections...)
+	config := func() []*fluentd_forwarder.ConfigElement {
+		configMtx.Lock()
+		defer configMtx.Unlock()
+		return configInEffect
+	}
+	diagnostics := fluentd_forwarder.NewDiagnostics(logger, inputs, allOutputs, config, params.DiagnosticsDir)
 
-	signalHandler := NewSignalHandler(workerSet)
-	input.Start()
-	output.Start()
+	httpServer := (*fluentd_forwarder.HTTPServer)(nil)
+	if params.HTTPListenOn != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", fluentd_forwarder.DefaultMetrics)
+		mux.Handle("/log-level", fluentd_forwarder.RequireAdminToken(adminToken, logLevels))
+		health := fluentd_forwarder.NewHealthChecker(inputs, allOutputs, params.BufferWatermark)
+		if params.Kubernetes {
+			health.GateOnRecovery(time.Now())
+		}
+		mux.HandleFunc("/healthz", health.ServeLive)
+		mux.HandleFunc("/readyz", health.ServeReady)
+		mux.Handle("/api/diagnostics", fluentd_forwarder.RequireAdminTokenAlways(adminToken, diagnostics))
+		mux.Handle("/api/trace", fluentd_forwarder.RequireAdminToken(adminToken, fluentd_forwarder.DefaultRecordTracer))
+		mux.Handle("/api/connections", fluentd_forwarder.RequireAdminToken(adminToken, fluentd_forwarder.NewConnectionsHandler(inputs)))
+		mux.Handle("/api/flush", fluentd_forwarder.RequireAdminToken(adminToken, fluentd_forwarder.NewFlushHandler(allOutputs)))
+		mux.Handle("/api/recovery", fluentd_forwarder.DefaultBufferRecoveries)
+		mux.Handle("/api/version", versionReporter)
+		mux.Handle("/api/plugins.json", fluentd_forwarder.NewMonitorAgent(func() []fluentd_forwarder.Worker {
+			workers := inputs()
+			for _, output_ := range allOutputs() {
+				workers = append(workers, output_)
+			}
+			return workers
+		}))
+		if adminHandler != nil {
+			mux.Handle(fluentd_forwarder.AdminOutputsPath, adminHandler)
+			mux.Handle(fluentd_forwarder.AdminOutputsPath+"/", adminHandler)
+		}
+		httpServer, err = fluentd_forwarder.NewHTTPServer(logger, params.HTTPListenOn, mux)
+		if err != nil {
+			Error("%s", err.Error())
+			return
+		}
+		workerSet.Add(httpServer)
+	}
+	debugServer := (*fluentd_forwarder.HTTPServer)(nil)
+	if params.DebugListenOn != "" {
+		debugServer, err = fluentd_forwarder.NewHTTPServer(logger, params.DebugListenOn, fluentd_forwarder.NewDebugHandler())
+		if err != nil {
+			Error("%s", err.Error())
+			return
+		}
+		workerSet.Add(debugServer)
+	}
+	statsDEmitter := (*fluentd_forwarder.StatsDEmitter)(nil)
+	if params.StatsDAddress != "" {
+		statsDEmitter, err = fluentd_forwarder.NewStatsDEmitter(logger, fluentd_forwarder.DefaultMetrics, params.StatsDAddress, params.StatsDFormat, params.StatsDPrefix, params.StatsDInterval)
+		if err != nil {
+			Error("%s", err.Error())
+			return
+		}
+		workerSet.Add(statsDEmitter)
+	}
+
+	// reloads on SIGHUP and when the secrets or the remote configuration
+	// have changed
+	reloadMtx := sync.Mutex{}
+	reload := func() {
+		reloadMtx.Lock()
+		defer reloadMtx.Unlock()
+		if params.ConfigFile == "" {
+			logger.Notice("No configuration file to reload")
+			return
+		}
+		_, settings, sections, err := readConfigFile(params.ConfigFile, params.Profile)
+		if err != nil {
+			logger.Errorf("Failed to reload the configuration; keeping the current one: %s", err.Error())
+			return
+		}
+		changed := changedSettings(params.ConfigSettings, settings)
+		if len(changed) > 0 {
+			logger.Warningf("Changes to the settings require a restart: %s", strings.Join(changed, ", "))
+		}
+		pipelineSections := make([]*fluentd_forwarder.ConfigElement, 0, len(sections))
+		for _, section := range sections {
+			if section.Name != "input" {
+				pipelineSections = append(pipelineSections, section)
+			}
+		}
+		if adminHandler != nil {
+			err = adminHandler.Reload(pipelineSections)
+		} else {
+			err = pipeline.Reload(pipelineSections)
+		}
+		if err != nil {
+			logger.Errorf("Failed to reload the configuration; keeping the current one: %s", err.Error())
+			return
+		}
+		configMtx.Lock()
+		configInEffect = append([]*fluentd_forwarder.ConfigElement{params.Settings}, sections...)
+		configMtx.Unlock()
+		err = inputSet.Reload(sections)
+		if err != nil {
+			logger.Errorf("Failed to reconfigure the inputs: %s", err.Error())
+		}
+	}
+	secretRefresher := (*fluentd_forwarder.SecretRefresher)(nil)
+	if params.ConfigFile != "" && params.SecretRefresh > 0 {
+		secretRefresher, err = fluentd_forwarder.NewSecretRefresher(logger, fluentd_forwarder.DefaultSecrets, params.SecretRefresh, reload)
+		if err != nil {
+			Error("%s", err.Error())
+			return
+		}
+		workerSet.Add(secretRefresher)
+	}
+	// polls the configuration of the profile as well
+	configPollers := make([]*fluentd_forwarder.ConfigPoller, 0, 2)
+	if fluentd_forwarder.IsRemoteConfig(params.ConfigFile) && params.ConfigPollInterval > 0 {
+		locations := []string{params.ConfigFile}
+		if params.Profile != "" {
+			location, err := fluentd_forwarder.ProfileConfigLocation(params.ConfigFile, params.Profile)
+			if err != nil {
+				Error("%s", err.Error())
+				return
+			}
+			locations = append(locations, location)
+		}
+		for _, location := range locations {
+			configPoller, err := fluentd_forwarder.NewConfigPoller(logger, location, params.ConfigPollInterval, reload)
+			if err != nil {
+				Error("%s", err.Error())
+				return
+			}
+			workerSet.Add(configPoller)
+			configPollers = append(configPollers, configPoller)
+		}
+	}
+
+	// the workers leave the notifications to the supervisor
+	systemdNotifier := (*fluentd_forwarder.SystemdNotifier)(nil)
+	if socket := os.Getenv("NOTIFY_SOCKET"); socket != "" && workerID < 0 {
+		systemdNotifier = fluentd_forwarder.NewSystemdNotifier(logger, socket, fluentd_forwarder.SystemdWatchdogInterval(), fluentd_forwarder.NewHealthChecker(inputs, allOutputs, 0).Live)
+		workerSet.Add(systemdNotifier)
+	}
+
+	signalHandler := NewSignalHandler(workerSet, reload, func() {
+		// logrotate sends SIGUSR2 after renaming the log file
+		if logFile != nil {
+			err := logFile.Reopen()
+			if err != nil {
+				Error("Failed to reopen the log file: %s", err.Error())
+				return
+			}
+			logger.Notice("Reopened the log file")
+			return
+		}
+		if logLevels.ToggleDebug() {
+			logger.Notice("Debug logging enabled")
+		} else {
+			logger.Notice("Debug logging disabled")
+		}
+	}, func() {
+		_, err := diagnostics.Dump()
+		if err != nil {
+			logger.Errorf("Failed to write the diagnostics: %s", err.Error())
+		}
+	}, func() bool {
+		if workerID >= 0 {
+			logger.Warning("Ignoring the upgrade of a worker; upgrade the supervisor instead")
+			return false
+		}
+		addrs := make([]string, 0)
+		files := make([]*os.File, 0)
+		defer func() {
+			for _, file := range files {
+				file.Close()
+			}
+		}()
+		for _, worker := range inputs() {
+			forwardInput, ok := worker.(*fluentd_forwarder.ForwardInput)
+			if !ok {
+				continue
+			}
+			addr, file, err := forwardInput.ListenerFile()
+			if err != nil {
+				logger.Errorf("Failed to upgrade: %s", err.Error())
+				return false
+			}
+			addrs = append(addrs, addr)
+			files = append(files, file)
+		}
+		pid, err := startUpgrade(logger, addrs, files)
+		if err != nil {
+			logger.Errorf("Failed to upgrade; keeping on running: %s", err.Error())
+			return false
+		}
+		if systemdNotifier != nil {
+			systemdNotifier.MainPID(pid)
+		}
+		if params.PIDFile != "" {
+			err := replacePIDFile(params.PIDFile, pid)
+			if err != nil {
+				logger.Errorf("Failed to write the pid file: %s", err.Error())
+			}
+		}
+		return true
+	}, func() {
+		// the spoolers log the chunks flushed once done
+		flushed := fluentd_forwarder.FlushOutputs(allOutputs())
+		logger.Noticef("Flushing the buffers of %d outputs", len(flushed))
+	})
+	shutdown := (*shutdown)(nil)
+	if params.ShutdownTimeout > 0 {
+		drainedInputs := []fluentd_forwarder.Worker{inputSet}
+		if input != nil {
+			drainedInputs = append(drainedInputs, input)
+		}
+		shutdown = newShutdown(logger, params.ShutdownTimeout, drainedInputs, inputs, allOutputs)
+		signalHandler.Drain = func() {
+			// the inputs held back by the buffer-limit of a pipeline stop
+			// only once let through
+			pipeline.OpenGates()
+			shutdown.begin()
+		}
+	}
+	if input != nil {
+		input.Start()
+	}
+	inputSet.Start()
+	pipeline.Start()
+	if output != nil {
+		output.Start()
+	}
+	if internalEvents != nil {
+		internalEvents.Start()
+	}
+	if watchdog != nil {
+		watchdog.Start()
+	}
+	if statusFile != nil {
+		statusFile.Start()
+	}
+	if params.ReleaseURL != "" {
+		versionReporter.Start()
+	}
+	if httpServer != nil {
+		httpServer.Start()
+	}
+	if debugServer != nil {
+		debugServer.Start()
+	}
+	if statsDEmitter != nil {
+		statsDEmitter.Start()
+	}
+	if secretRefresher != nil {
+		secretRefresher.Start()
+	}
+	for _, configPoller := range configPollers {
+		configPoller.Start()
+	}
 	signalHandler.Start()
+	if systemdNotifier != nil {
+		systemdNotifier.Start()
+		systemdNotifier.Ready()
+	}
+	daemonReady()
 
-	for _, worker := range workerSet.Slice() {
-		worker.WaitForShutdown()
+	if shutdown != nil {
+		shutdown.wait(workerSet)
+	} else {
+		workerSet.WaitForShutdown(time.Time{})
 	}
 	logger.Notice("Shutting down...")
+	signalHandler.Close()
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readPIDFile returns the pid written in the file, or 0 if there is none.
+func readPIDFile(path string) (int, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		// not what this would have written; taken as stale
+		return 0, nil
+	}
+	return pid, nil
+}
+
+// writePIDFile writes the pid of this process to the file, unless another
+// process still running has written its own.  A file left by one which has
+// exited without removing it is overwritten.
+func writePIDFile(path string) error {
+	pid, err := readPIDFile(path)
+	if err != nil {
+		return err
+	}
+	if pid > 0 && pid != os.Getpid() && processExists(pid) {
+		return fmt.Errorf("%s: already running as pid %d", path, pid)
+	}
+	return replacePIDFile(path, os.Getpid())
+}
+
+// replacePIDFile writes the pid to the file, as the process upgraded does
+// with the pid of the new one.
+func replacePIDFile(path string, pid int) error {
+	tmpPath := path + ".tmp"
+	err := ioutil.WriteFile(tmpPath, []byte(strconv.Itoa(pid)+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// removePIDFile removes the file if it is still of this process.
+func removePIDFile(path string) {
+	pid, err := readPIDFile(path)
+	if err == nil && pid == os.Getpid() {
+		os.Remove(path)
+	}
+}
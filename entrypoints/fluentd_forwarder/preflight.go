@@ -0,0 +1,45 @@
+package main
+
+import (
+	fluentd_forwarder "github.com/fluent/fluentd-forwarder"
+	logging "github.com/op/go-logging"
+	"strings"
+)
+
+// systemRequirements estimates what the inputs and the outputs of the
+// command line and the configuration need of the system.
+func systemRequirements(params *FluentdForwarderParams) *fluentd_forwarder.SystemRequirements {
+	requirements := fluentd_forwarder.EstimateSystemRequirements(params.ConfigSections)
+	for _, addr := range []string{params.HTTPListenOn, params.DebugListenOn} {
+		if addr != "" {
+			requirements.AddListener()
+		}
+	}
+	if !params.FluentdConfig {
+		requirements.AddListener()
+		requirements.AddOutput(params.OutputType, params.JournalGroupPath, params.MaxJournalChunkSize, params.Parallelism)
+	}
+	return requirements
+}
+
+// checkSystemLimits checks the limit of the open files and the free space
+// for the buffers, logging the warnings, and returns false if the forwarder
+// would fail for them and -preflight is strict; otherwise they are logged
+// as the warnings as well.
+func checkSystemLimits(logger *logging.Logger, params *FluentdForwarderParams) bool {
+	check := fluentd_forwarder.CheckSystemLimits(systemRequirements(params))
+	warnings := check.Warnings
+	if params.Preflight != StrictnessStrict {
+		warnings = append(warnings, check.Errors...)
+	}
+	for _, msg := range warnings {
+		logger.Warning(strings.ToUpper(msg[:1]) + msg[1:])
+	}
+	if params.Preflight != StrictnessStrict {
+		return true
+	}
+	for _, msg := range check.Errors {
+		Error("%s", msg)
+	}
+	return check.OK()
+}
@@ -0,0 +1,134 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	fluentd_forwarder "github.com/fluent/fluentd-forwarder"
+	logging "github.com/op/go-logging"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// lookupUser returns the uid, the primary gid and the supplementary gids of
+// the user given by the name or the uid.
+func lookupUser(name string) (int, int, []int, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		if _, err_ := strconv.Atoi(name); err_ != nil {
+			return 0, 0, nil, err
+		}
+		u, err = user.LookupId(name)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	gids := make([]int, 0)
+	groupIds, err := u.GroupIds()
+	if err == nil {
+		for _, v := range groupIds {
+			if id, err := strconv.Atoi(v); err == nil {
+				gids = append(gids, id)
+			}
+		}
+	}
+	return uid, gid, gids, nil
+}
+
+// lookupGroup returns the gid of the group given by the name or the gid.
+func lookupGroup(name string) (int, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		if _, err_ := strconv.Atoi(name); err_ != nil {
+			return 0, err
+		}
+		g, err = user.LookupGroupId(name)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// dropPrivileges listens on the addresses of the inputs, which may be of
+// the privileged ports, and then changes the root directory to -chroot and
+// the user and the group to -user and -group, so that the rest runs
+// unprivileged.  The sockets are taken by the inputs as the inherited ones,
+// including the ones created again by reloading.  The users and the groups
+// are looked up before changing the root directory, which need not have
+// the files of them.
+func dropPrivileges(logger *logging.Logger, params *FluentdForwarderParams) error {
+	uid, gid, gids := os.Getuid(), os.Getgid(), []int(nil)
+	if params.User != "" {
+		err := (error)(nil)
+		uid, gid, gids, err = lookupUser(params.User)
+		if err != nil {
+			return fmt.Errorf("-user: %s", err.Error())
+		}
+	}
+	if params.Group != "" {
+		err := (error)(nil)
+		gid, err = lookupGroup(params.Group)
+		if err != nil {
+			return fmt.Errorf("-group: %s", err.Error())
+		}
+		if params.User == "" {
+			gids = []int{gid}
+		}
+	}
+	for _, addr := range listenAddresses(params) {
+		if fluentd_forwarder.InheritedListener(addr) != nil {
+			continue
+		}
+		listener, err := fluentd_forwarder.ListenTCP(addr)
+		if err != nil {
+			return err
+		}
+		file, err := listener.File()
+		listener.Close()
+		if err != nil {
+			return err
+		}
+		fluentd_forwarder.InheritListener(addr, file)
+	}
+	if params.Chroot != "" {
+		err := syscall.Chroot(params.Chroot)
+		if err != nil {
+			return fmt.Errorf("-chroot: %s", err.Error())
+		}
+		err = os.Chdir("/")
+		if err != nil {
+			return fmt.Errorf("-chroot: %s", err.Error())
+		}
+	}
+	// already dropped, as by the process started by an upgrade
+	if os.Geteuid() == uid && os.Getegid() == gid {
+		return nil
+	}
+	if gids != nil {
+		err := syscall.Setgroups(gids)
+		if err != nil {
+			return fmt.Errorf("failed to set the supplementary groups: %s", err.Error())
+		}
+	}
+	err := syscall.Setgid(gid)
+	if err != nil {
+		return fmt.Errorf("failed to change the group to %d: %s", gid, err.Error())
+	}
+	err = syscall.Setuid(uid)
+	if err != nil {
+		return fmt.Errorf("failed to change the user to %d: %s", uid, err.Error())
+	}
+	logger.Noticef("Running as uid %d and gid %d", uid, gid)
+	return nil
+}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"errors"
+	logging "github.com/op/go-logging"
+)
+
+// dropPrivileges fails, as a Windows service is given its account by the
+// service control manager instead.
+func dropPrivileges(logger *logging.Logger, params *FluentdForwarderParams) error {
+	return errors.New("-user, -group and -chroot are not supported on Windows; give the service an account instead")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	fluentd_forwarder "github.com/fluent/fluentd-forwarder"
+	logging "github.com/op/go-logging"
+	"log"
+	"os"
+	"time"
+)
+
+// settingsSchema describes the options, which the settings of the
+// configuration give but -config, -profile and -config-key.
+func settingsSchema(flagSet *flag.FlagSet) []fluentd_forwarder.ParamSchema {
+	retval := make([]fluentd_forwarder.ParamSchema, 0)
+	flagSet.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "profile" || f.Name == "config-key" {
+			return
+		}
+		param := fluentd_forwarder.ParamSchema{
+			Name:        f.Name,
+			Type:        fluentd_forwarder.ParamString,
+			Description: f.Usage,
+			Default:     f.DefValue,
+		}
+		if getter, ok := f.Value.(flag.Getter); ok {
+			switch getter.Get().(type) {
+			case bool:
+				param.Type = fluentd_forwarder.ParamBoolean
+			case int, int64, uint, uint64:
+				param.Type = fluentd_forwarder.ParamInteger
+			case float64:
+				param.Type = fluentd_forwarder.ParamNumber
+			case time.Duration:
+				param.Type = fluentd_forwarder.ParamDuration
+			}
+		}
+		if _, ok := f.Value.(*StringsValue); ok {
+			param.Repeated = true
+		}
+		retval = append(retval, param)
+	})
+	return retval
+}
+
+// runSchema runs the schema subcommand, which writes the JSON Schema of the
+// configuration in YAML and TOML, including the components of the plugins
+// given by -plugin.
+func runSchema(args []string) int {
+	params := ParseArgs(args)
+	backend := logging.AddModuleLevel(logging.NewLogBackend(os.Stderr, "[fluentd-forwarder] ", log.Ldate|log.Ltime))
+	backend.SetLevel(logging.WARNING, "")
+	logging.SetBackend(backend)
+	logger := logging.MustGetLogger("fluentd-forwarder")
+	for _, path := range params.Plugins {
+		err := fluentd_forwarder.LoadPlugin(logger, path)
+		if err != nil {
+			Error("%s", err.Error())
+			return 1
+		}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(fluentd_forwarder.ConfigSchema(settingsSchema(params.FlagSet)))
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	logging "github.com/op/go-logging"
+)
+
+func isWindowsService() bool {
+	return false
+}
+
+func newEventLogBackend() (logging.Backend, error) {
+	return nil, errors.New("the event log is only available on Windows")
+}
+
+func runServiceCommand(args []string) int {
+	Error("Windows services are not supported on this platform")
+	return 1
+}
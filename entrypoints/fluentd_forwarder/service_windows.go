@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	logging "github.com/op/go-logging"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// serviceName is the name of the Windows service and the source of its
+// events in the event log.
+const serviceName = "fluentd-forwarder"
+
+// The status of the service is reported in this interval while the
+// forwarder drains, so that the service control manager waits for it.
+const serviceStopCheckInterval = time.Second
+
+var runningAsService = false
+
+func init() {
+	runningAsService, _ = svc.IsWindowsService()
+	if !runningAsService {
+		return
+	}
+	// nobody sees the standard error of a service
+	elog, err := eventlog.Open(serviceName)
+	if err == nil {
+		errorOutput = &eventLogWriter{elog}
+	}
+}
+
+func isWindowsService() bool {
+	return runningAsService
+}
+
+// eventLogWriter writes each message to the event log as an error.
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (writer *eventLogWriter) Write(p []byte) (int, error) {
+	err := writer.elog.Error(1, strings.TrimRight(string(p), "\n"))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// eventLogBackend is the logging backend writing to the event log, at
+// the error, the warning or the information level by the level of the
+// messages.
+type eventLogBackend struct {
+	elog *eventlog.Log
+}
+
+func (backend *eventLogBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	msg := rec.Formatted(calldepth + 1)
+	switch {
+	case level <= logging.ERROR:
+		return backend.elog.Error(1, msg)
+	case level == logging.WARNING:
+		return backend.elog.Warning(1, msg)
+	default:
+		return backend.elog.Info(1, msg)
+	}
+}
+
+func newEventLogBackend() (logging.Backend, error) {
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLogBackend{elog}, nil
+}
+
+// serviceHandler answers the service control manager for the forwarder.
+type serviceHandler struct {
+	handler *SignalHandler
+}
+
+func (service *serviceHandler) Execute(args []string, r <-chan svc.ChangeRequest, s chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange
+	s <- svc.Status{State: svc.Running, Accepts: accepts}
+	for {
+		select {
+		case req := <-r:
+			switch req.Cmd {
+			case svc.Interrogate:
+				s <- req.CurrentStatus
+			case svc.ParamChange:
+				service.handler.Reload()
+			case svc.Stop, svc.Shutdown:
+				service.stop(s)
+				return false, 0
+			}
+		case <-service.handler.doneChan:
+			// stopped without being told to, which the service
+			// control manager takes as a failure
+			return true, 1
+		}
+	}
+}
+
+// stop stops the forwarder as on the interrupt, and waits for it to drain,
+// telling the service control manager that it is still stopping.
+func (service *serviceHandler) stop(s chan<- svc.Status) {
+	checkPoint := uint32(1)
+	s <- svc.Status{State: svc.StopPending, CheckPoint: checkPoint, WaitHint: uint32(3 * serviceStopCheckInterval / time.Millisecond)}
+	select {
+	case service.handler.signalChan <- os.Interrupt:
+	default:
+	}
+	ticker := time.NewTicker(serviceStopCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			checkPoint += 1
+			s <- svc.Status{State: svc.StopPending, CheckPoint: checkPoint, WaitHint: uint32(3 * serviceStopCheckInterval / time.Millisecond)}
+		case <-service.handler.doneChan:
+			return
+		}
+	}
+}
+
+// runService runs the forwarder as the service until it has stopped.
+func runService(handler *SignalHandler) {
+	defer close(handler.serviceDoneChan)
+	err := svc.Run(serviceName, &serviceHandler{handler})
+	if err != nil {
+		Error("%s", err.Error())
+	}
+}
+
+// installService installs the service running the executable with the
+// arguments, after checking them as -dry-run does, which restarts it when
+// it crashes.
+func installService(args []string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	check := exec.Command(executable, append([]string{"-dry-run"}, args...)...)
+	check.Stdout = os.Stdout
+	check.Stderr = os.Stderr
+	err = check.Run()
+	if err != nil {
+		return fmt.Errorf("the configuration check failed: %s", err.Error())
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", serviceName)
+	}
+	s, err = m.CreateService(serviceName, executable, mgr.Config{
+		DisplayName: "Fluentd Forwarder",
+		Description: "Forwards the events received in the fluentd forward protocol",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	err = s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: time.Minute},
+	}, uint32((24 * time.Hour).Seconds()))
+	if err == nil {
+		err = s.SetRecoveryActionsOnNonCrashFailures(true)
+	}
+	if err == nil {
+		err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+	}
+	if err != nil {
+		s.Delete()
+		return err
+	}
+	return nil
+}
+
+// uninstallService removes the service and its event source.
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+	err = s.Delete()
+	if err != nil {
+		return err
+	}
+	return eventlog.Remove(serviceName)
+}
+
+// runServiceCommand runs the service subcommand, which installs or
+// uninstalls the Windows service.
+func runServiceCommand(args []string) int {
+	usage := func() int {
+		os.Stderr.WriteString("usage: " + progName + " service install [options]\n       " + progName + " service uninstall\n")
+		return 2
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+	err := (error)(nil)
+	switch args[0] {
+	case "install":
+		err = installService(args[1:])
+	case "uninstall":
+		err = uninstallService()
+	default:
+		return usage()
+	}
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	return 0
+}
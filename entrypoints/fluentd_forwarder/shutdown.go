@@ -0,0 +1,115 @@
+package main
+
+import (
+	fluentd_forwarder "github.com/fluent/fluentd-forwarder"
+	logging "github.com/op/go-logging"
+	"sync"
+	"time"
+)
+
+// the part of the shutdown timeout left for the workers to stop after
+// draining the outputs, such as before the kubelet kills the forwarder at
+// the end of the termination grace period
+const stopMargin = 5 * time.Second
+
+// shutdown stops the forwarder within the timeout from when it begins: it
+// stops the inputs, flushes the outputs until nothing is left buffered or
+// the margin to stop the workers is reached, and once the timeout runs out,
+// reports what it abandons and lets the forwarder exit.
+type shutdown struct {
+	logger  *logging.Logger
+	timeout time.Duration
+	// the inputs stopped before draining
+	drainedInputs []fluentd_forwarder.Worker
+	inputs        func() []fluentd_forwarder.Worker
+	outputs       func() []fluentd_forwarder.Output
+	once          sync.Once
+	begun         chan struct{}
+	deadline      time.Time
+}
+
+// drainDeadline returns when to give up draining the outputs.
+func (s *shutdown) drainDeadline() time.Time {
+	if s.timeout > 2*stopMargin {
+		return s.deadline.Add(-stopMargin)
+	}
+	return s.deadline.Add(-s.timeout / 2)
+}
+
+// begin starts the clock and drains the outputs.  It is called before the
+// workers are told to stop.
+func (s *shutdown) begin() {
+	s.once.Do(func() {
+		s.deadline = time.Now().Add(s.timeout)
+		close(s.begun)
+	})
+	s.logger.Noticef("Draining the outputs before shutting down within %s...", s.timeout)
+	for _, input := range s.drainedInputs {
+		input.Stop()
+	}
+	for _, input := range s.drainedInputs {
+		input.WaitForShutdown()
+	}
+	buffered := fluentd_forwarder.DrainOutputs(s.outputs, s.drainDeadline(), time.Second)
+	if buffered == 0 {
+		s.logger.Notice("Drained the outputs")
+		return
+	}
+	for _, output := range s.outputs() {
+		health, ok := output.(fluentd_forwarder.HealthReportingOutput)
+		if !ok || health.Health().BufferedBytes == 0 {
+			continue
+		}
+		chunks := int64(0)
+		if info, ok := output.(fluentd_forwarder.PluginInfoReporter); ok {
+			chunks = info.PluginInfo().BufferQueueLength
+		}
+		s.logger.Warningf("Leaving %d chunks (%d bytes) undelivered in the buffer of %s", chunks, health.Health().BufferedBytes, health.Health().Name)
+	}
+	s.logger.Warningf("Shutting down with %d bytes left in the buffers", buffered)
+}
+
+// wait waits for the workers to shut down, until the timeout runs out once
+// the shutdown has begun.  It reports the workers still running and the
+// connections still open then.
+func (s *shutdown) wait(workers *fluentd_forwarder.WorkerSet) {
+	stopped := make(chan struct{})
+	go func() {
+		workers.WaitForShutdown(time.Time{})
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return
+	case <-s.begun:
+	}
+	running := workers.WaitForShutdown(s.deadline)
+	if len(running) == 0 {
+		return
+	}
+	connections := 0
+	for _, input := range s.inputs() {
+		if input, ok := input.(fluentd_forwarder.ConnectionReportingInput); ok {
+			for _, conn := range input.Connections() {
+				s.logger.Warningf("Abandoning the connection from %s to %s, which has sent %d records", conn.RemoteAddr, conn.Listener, conn.Records)
+				connections += 1
+			}
+		}
+	}
+	for _, worker := range running {
+		s.logger.Warningf("Abandoning %s, which has not stopped", worker.String())
+	}
+	s.logger.Errorf("Failed to shut down within %s; abandoning %d workers and %d connections", s.timeout, len(running), connections)
+}
+
+func newShutdown(logger *logging.Logger, timeout time.Duration, drainedInputs []fluentd_forwarder.Worker, inputs func() []fluentd_forwarder.Worker, outputs func() []fluentd_forwarder.Output) *shutdown {
+	return &shutdown{
+		logger:        logger,
+		timeout:       timeout,
+		drainedInputs: drainedInputs,
+		inputs:        inputs,
+		outputs:       outputs,
+		once:          sync.Once{},
+		begun:         make(chan struct{}),
+	}
+}
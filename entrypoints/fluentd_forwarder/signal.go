@@ -1,29 +1,81 @@
+//go:build !windows
+
 package main
 
 import (
 	fluentd_forwarder "github.com/fluent/fluentd-forwarder"
 	"os"
 	"os/signal"
+	"syscall"
 )
 
+// upgradeSignal makes the forwarder hand its listening sockets over to a
+// new process of the executable and exit.  SIGUSR2 is taken by the debug
+// logging and the reopening of the log file.
+const upgradeSignal = syscall.SIGTTIN
+
 type SignalHandler struct {
-	Workers    *fluentd_forwarder.WorkerSet
-	signalChan chan os.Signal
+	Workers     *fluentd_forwarder.WorkerSet
+	Reload      func()
+	ToggleDebug func()
+	Diagnose    func()
+	Upgrade     func() bool
+	Flush       func()
+	Drain       func()
+	signalChan  chan os.Signal
 }
 
 func (handler *SignalHandler) Start() {
-	signal.Notify(handler.signalChan, os.Kill, os.Interrupt)
+	signal.Notify(handler.signalChan, os.Kill, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGQUIT, upgradeSignal)
 	go func() {
-		<-handler.signalChan
+		for sig := range handler.signalChan {
+			if sig == syscall.SIGHUP {
+				handler.Reload()
+				continue
+			}
+			if sig == syscall.SIGUSR1 {
+				handler.Flush()
+				continue
+			}
+			if sig == syscall.SIGUSR2 {
+				handler.ToggleDebug()
+				continue
+			}
+			if sig == syscall.SIGQUIT {
+				handler.Diagnose()
+				continue
+			}
+			if sig == upgradeSignal {
+				if handler.Upgrade() {
+					break
+				}
+				continue
+			}
+			break
+		}
+		if handler.Drain != nil {
+			handler.Drain()
+		}
 		for _, worker := range handler.Workers.Slice() {
 			worker.Stop()
 		}
 	}()
 }
 
-func NewSignalHandler(workerSet *fluentd_forwarder.WorkerSet) *SignalHandler {
+// Close stops handling the signals.
+func (handler *SignalHandler) Close() {
+	signal.Stop(handler.signalChan)
+}
+
+func NewSignalHandler(workerSet *fluentd_forwarder.WorkerSet, reload func(), toggleDebug func(), diagnose func(), upgrade func() bool, flush func()) *SignalHandler {
 	return &SignalHandler{
 		workerSet,
+		reload,
+		toggleDebug,
+		diagnose,
+		upgrade,
+		flush,
+		nil,
 		make(chan os.Signal, 1),
 	}
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	fluentd_forwarder "github.com/fluent/fluentd-forwarder"
+	"os"
+	"os/signal"
+)
+
+// SignalHandler stops the forwarder on the interrupt, which is the only
+// signal Windows delivers, and on the stop of the service when run as a
+// Windows service, on whose parameter change the configuration is reloaded
+// as on SIGHUP elsewhere.  ToggleDebug, Diagnose, Upgrade and Flush are
+// not triggered on Windows.
+type SignalHandler struct {
+	Workers     *fluentd_forwarder.WorkerSet
+	Reload      func()
+	ToggleDebug func()
+	Diagnose    func()
+	Upgrade     func() bool
+	Flush       func()
+	Drain       func()
+	signalChan  chan os.Signal
+	// closed when the forwarder has stopped
+	doneChan chan struct{}
+	// closed when the service has reported it has stopped
+	serviceDoneChan chan struct{}
+}
+
+func (handler *SignalHandler) Start() {
+	signal.Notify(handler.signalChan, os.Interrupt)
+	go func() {
+		<-handler.signalChan
+		if handler.Drain != nil {
+			handler.Drain()
+		}
+		for _, worker := range handler.Workers.Slice() {
+			worker.Stop()
+		}
+	}()
+	if isWindowsService() {
+		handler.serviceDoneChan = make(chan struct{})
+		go runService(handler)
+	}
+}
+
+// Close stops handling the signals, and reports the stop to the service
+// control manager when run as a service.
+func (handler *SignalHandler) Close() {
+	signal.Stop(handler.signalChan)
+	close(handler.doneChan)
+	if handler.serviceDoneChan != nil {
+		<-handler.serviceDoneChan
+	}
+}
+
+func NewSignalHandler(workerSet *fluentd_forwarder.WorkerSet, reload func(), toggleDebug func(), diagnose func(), upgrade func() bool, flush func()) *SignalHandler {
+	return &SignalHandler{
+		workerSet,
+		reload,
+		toggleDebug,
+		diagnose,
+		upgrade,
+		flush,
+		nil,
+		make(chan os.Signal, 1),
+		make(chan struct{}),
+		nil,
+	}
+}
@@ -0,0 +1,229 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	fluentd_forwarder "github.com/fluent/fluentd-forwarder"
+	logging "github.com/op/go-logging"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// restartDelay returns the delay before restarting a worker which has
+// crashed the number of times within -restart-window.
+func restartDelay(crashes int) time.Duration {
+	delay := minRestartDelay
+	for i := 1; i < crashes && delay < maxRestartDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRestartDelay {
+		delay = maxRestartDelay
+	}
+	return delay
+}
+
+// workerExit is the exit of a worker process.
+type workerExit struct {
+	id  int
+	err error
+}
+
+// runSupervisor listens on the addresses of the inputs and runs the worker
+// processes accepting on the sockets, which it passes to them.  The signals
+// are relayed to the workers, but upgradeSignal, on which the sockets are
+// handed over to the new supervisor and the workers are stopped.  A worker exiting unexpectedly is restarted
+// with backoff once it has exited, so that no two share its buffers, and
+// all of them are stopped when one crashes more than -restart-limit times
+// within -restart-window, with the status exitCrashLoop.
+func runSupervisor(logger *logging.Logger, params *FluentdForwarderParams, logWriter io.Writer) int {
+	executable, err := os.Executable()
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	addrs := listenAddresses(params)
+	files := make([]*os.File, 0, len(addrs))
+	for _, addr := range addrs {
+		listener, err := fluentd_forwarder.ListenTCP(addr)
+		if err != nil {
+			Error("%s", err.Error())
+			return 1
+		}
+		file, err := listener.File()
+		if err != nil {
+			Error("%s", err.Error())
+			return 1
+		}
+		listener.Close()
+		files = append(files, file)
+	}
+
+	// reports the supervisor itself, which is pinging the watchdog while
+	// it runs the workers
+	systemdNotifier := (*fluentd_forwarder.SystemdNotifier)(nil)
+	if socket := os.Getenv("NOTIFY_SOCKET"); socket != "" {
+		systemdNotifier = fluentd_forwarder.NewSystemdNotifier(logger, socket, fluentd_forwarder.SystemdWatchdogInterval(), func() error { return nil })
+		systemdNotifier.Start()
+		defer systemdNotifier.WaitForShutdown()
+		defer systemdNotifier.Stop()
+	}
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGQUIT, upgradeSignal)
+	exitChan := make(chan workerExit, params.Workers)
+	restartChan := make(chan int, params.Workers)
+	processes := make([]*os.Process, params.Workers)
+	timers := make([]*time.Timer, params.Workers)
+	restarts := make([]int, params.Workers)
+	crashes := make([][]time.Time, params.Workers)
+	running := 0
+	pending := 0
+	start := func(i int) error {
+		cmd := exec.Command(executable, os.Args[1:]...)
+		cmd.Env = append(
+			os.Environ(),
+			fmt.Sprintf("%s=%d", workerIDEnv, i),
+			fmt.Sprintf("%s=%d", workerCountEnv, params.Workers),
+			fmt.Sprintf("%s=%d", workerRestartsEnv, restarts[i]),
+			listenFDsEnv+"="+strings.Join(addrs, ","),
+		)
+		cmd.ExtraFiles = files
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = logWriter
+		err := cmd.Start()
+		if err != nil {
+			return err
+		}
+		logger.Noticef("Started worker %d (pid %d)", i, cmd.Process.Pid)
+		processes[i] = cmd.Process
+		running += 1
+		go func() {
+			exitChan <- workerExit{i, cmd.Wait()}
+		}()
+		return nil
+	}
+	stop := func() {
+		if systemdNotifier != nil {
+			systemdNotifier.Stop()
+		}
+		for i, process := range processes {
+			if process != nil {
+				process.Signal(os.Interrupt)
+			}
+			if timers[i] != nil && timers[i].Stop() {
+				timers[i] = nil
+				pending -= 1
+			}
+		}
+	}
+
+	status := 0
+	isStopping := false
+	for i := 0; i < params.Workers; i++ {
+		err := start(i)
+		if err != nil {
+			logger.Errorf("Failed to start worker %d: %s", i, err.Error())
+			status = 1
+			isStopping = true
+			stop()
+			break
+		}
+	}
+	if !isStopping {
+		if systemdNotifier != nil {
+			systemdNotifier.Ready()
+		}
+		daemonReady()
+	}
+	for running > 0 || pending > 0 {
+		select {
+		case sig := <-signalChan:
+			switch sig {
+			case syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGQUIT:
+				for _, process := range processes {
+					if process != nil {
+						process.Signal(sig)
+					}
+				}
+			case upgradeSignal:
+				if isStopping {
+					break
+				}
+				pid, err := startUpgrade(logger, addrs, files)
+				if err != nil {
+					logger.Errorf("Failed to upgrade; keeping on running: %s", err.Error())
+					break
+				}
+				if systemdNotifier != nil {
+					systemdNotifier.MainPID(pid)
+				}
+				if params.PIDFile != "" {
+					err := replacePIDFile(params.PIDFile, pid)
+					if err != nil {
+						logger.Errorf("Failed to write the pid file: %s", err.Error())
+					}
+				}
+				isStopping = true
+				stop()
+			default:
+				isStopping = true
+				stop()
+			}
+		case exit := <-exitChan:
+			running -= 1
+			processes[exit.id] = nil
+			if exit.err != nil {
+				logger.Errorf("Worker %d exited: %s", exit.id, exit.err.Error())
+			} else {
+				logger.Noticef("Worker %d exited", exit.id)
+			}
+			if isStopping {
+				break
+			}
+			now := time.Now()
+			recent := make([]time.Time, 0, len(crashes[exit.id])+1)
+			for _, t := range crashes[exit.id] {
+				if now.Sub(t) < params.RestartWindow {
+					recent = append(recent, t)
+				}
+			}
+			crashes[exit.id] = append(recent, now)
+			if params.RestartLimit > 0 && len(recent) >= params.RestartLimit {
+				logger.Criticalf("Worker %d is crash looping, having been restarted %d times within %s; stopping the workers", exit.id, len(recent), params.RestartWindow)
+				status = exitCrashLoop
+				isStopping = true
+				stop()
+				break
+			}
+			delay := restartDelay(len(crashes[exit.id]))
+			logger.Warningf("Restarting worker %d in %s", exit.id, delay)
+			i := exit.id
+			pending += 1
+			timers[i] = time.AfterFunc(delay, func() {
+				restartChan <- i
+			})
+		case i := <-restartChan:
+			pending -= 1
+			timers[i] = nil
+			if isStopping {
+				break
+			}
+			restarts[i] += 1
+			err := start(i)
+			if err != nil {
+				logger.Errorf("Failed to restart worker %d: %s", i, err.Error())
+				status = 1
+				isStopping = true
+				stop()
+			}
+		}
+	}
+	logger.Notice("Shutting down...")
+	return status
+}
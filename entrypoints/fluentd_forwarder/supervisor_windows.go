@@ -0,0 +1,13 @@
+package main
+
+import (
+	logging "github.com/op/go-logging"
+	"io"
+)
+
+// runSupervisor fails, as the worker processes cannot take the listening
+// sockets over on Windows.
+func runSupervisor(logger *logging.Logger, params *FluentdForwarderParams, logWriter io.Writer) int {
+	Error("-workers and -supervise are not supported on Windows; run as a Windows service to be restarted on a crash")
+	return 1
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	fluentd_forwarder "github.com/fluent/fluentd-forwarder"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// runTop runs the top subcommand, which shows the state of the forwarder
+// serving its HTTP endpoints at the URL given as the argument.
+func runTop(args []string) int {
+	interval := (time.Duration)(0)
+	maxTags := 0
+	flagSet := flag.NewFlagSet(progName+" top", flag.ExitOnError)
+	flagSet.DurationVar(&interval, "interval", MustParseDuration("2s"), "refresh interval")
+	flagSet.IntVar(&maxTags, "tags", 20, "number of the busiest tags to show")
+	flagSet.Usage = func() {
+		os.Stderr.WriteString("usage: " + progName + " top [options] [" + defaultAdminURL + "]\n")
+		flagSet.PrintDefaults()
+	}
+	flagSet.Parse(args)
+	target, err := adminURL(flagSet.Arg(0), "/metrics")
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	stopChan := make(chan struct{})
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt)
+	go func() {
+		<-signalChan
+		close(stopChan)
+	}()
+	err = fluentd_forwarder.NewTop(target, interval, maxTags, os.Stdout).Run(stopChan)
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	return 0
+}
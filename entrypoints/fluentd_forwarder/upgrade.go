@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	fluentd_forwarder "github.com/fluent/fluentd-forwarder"
+	logging "github.com/op/go-logging"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// upgradeEnv tells the new process the pid of the one upgraded, for which
+// it waits to exit before opening the buffers.
+const upgradeEnv = "FLUENTD_FORWARDER_UPGRADE_FROM"
+
+// upgradedFrom is the pid of the process upgraded, or -1 if not upgrading.
+var upgradedFrom = -1
+
+func init() {
+	if v := os.Getenv(upgradeEnv); v != "" {
+		pid, err := strconv.Atoi(v)
+		if err == nil && pid > 0 {
+			upgradedFrom = pid
+		}
+	}
+	// not to be passed on to the workers
+	os.Unsetenv(upgradeEnv)
+}
+
+// inheritListeners takes the listening sockets passed from the file
+// descriptor 3 on by the supervisor or the process upgraded.
+func inheritListeners() {
+	v := os.Getenv(listenFDsEnv)
+	if v == "" {
+		return
+	}
+	for i, addr := range strings.Split(v, ",") {
+		fluentd_forwarder.InheritListener(addr, os.NewFile(uintptr(firstListenFD+i), addr))
+	}
+	os.Unsetenv(listenFDsEnv)
+}
+
+// waitForUpgrade waits for the process upgraded to exit, which is the
+// parent until then, so that no two processes share the buffers.  The
+// connections made in the meantime wait in the backlog of the sockets.
+func waitForUpgrade(logger *logging.Logger) {
+	if os.Getppid() != upgradedFrom {
+		return
+	}
+	logger.Noticef("Waiting for the previous process (pid %d) to exit", upgradedFrom)
+	for os.Getppid() == upgradedFrom {
+		time.Sleep(100 * time.Millisecond)
+	}
+	logger.Notice("The previous process has exited")
+}
+
+// startUpgrade checks the configuration with the executable, which may have
+// been replaced, and starts a new process of it taking over the listening
+// sockets of the files, and returns its pid.  The caller stops accepting
+// and exits once it has returned without an error.
+func startUpgrade(logger *logging.Logger, addrs []string, files []*os.File) (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	check := exec.Command(executable, append([]string{"-dry-run"}, os.Args[1:]...)...)
+	// the errors are written to the standard error
+	check.Stderr = os.Stderr
+	err = check.Run()
+	if err != nil {
+		return 0, fmt.Errorf("the configuration check failed: %s", err.Error())
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", upgradeEnv, os.Getpid()), listenFDsEnv+"="+strings.Join(addrs, ","))
+	cmd.ExtraFiles = files
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	if err != nil {
+		return 0, err
+	}
+	logger.Noticef("Started the new process (pid %d); handing over %d listening sockets", cmd.Process.Pid, len(files))
+	// not waited for, so as to leave it running after this process exits
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+	return pid, nil
+}
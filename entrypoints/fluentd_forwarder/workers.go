@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	fluentd_forwarder "github.com/fluent/fluentd-forwarder"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The environment variables by which the supervisor tells a worker process
+// its number, the number of the workers, how many times it has been
+// restarted, and the addresses of the listening sockets passed from the
+// file descriptor 3 on.
+const (
+	workerIDEnv       = "FLUENTD_FORWARDER_WORKER_ID"
+	workerCountEnv    = "FLUENTD_FORWARDER_WORKERS"
+	workerRestartsEnv = "FLUENTD_FORWARDER_RESTARTS"
+	listenFDsEnv      = "FLUENTD_FORWARDER_LISTEN_FDS"
+	firstListenFD     = 3
+)
+
+// exitCrashLoop is the exit status of the supervisor giving up on a worker
+// restarted more than -restart-limit times within -restart-window.
+const exitCrashLoop = 3
+
+// The delay before restarting a crashed worker, which doubles with every
+// restart within -restart-window up to maxRestartDelay.
+const (
+	minRestartDelay = time.Second
+	maxRestartDelay = time.Minute
+)
+
+// workerID is the number of this worker process, or -1 if not a worker.
+var workerID = -1
+
+// workerCount is the number of the worker processes run by the supervisor.
+var workerCount = 0
+
+func init() {
+	if v := os.Getenv(workerIDEnv); v != "" {
+		id, err := strconv.Atoi(v)
+		if err == nil && id >= 0 {
+			workerID = id
+		}
+	}
+	if workerID < 0 {
+		return
+	}
+	workerCount, _ = strconv.Atoi(os.Getenv(workerCountEnv))
+	// the worker counts the restarts of its predecessors, as the
+	// supervisor serves no metrics by itself
+	restarts, _ := strconv.Atoi(os.Getenv(workerRestartsEnv))
+	workerRestarts, err := fluentd_forwarder.DefaultMetrics.NewCounterVec("fluentd_forwarder_worker_restarts_total", "Number of the times the supervisor has restarted the worker after it crashed.")
+	if err == nil {
+		workerRestarts.With().Add(float64(restarts))
+	}
+}
+
+// workerBufferPath returns the buffer path of the worker, in the workerN
+// subdirectory of the directory of the path, which is created if absent.
+func workerBufferPath(path string) string {
+	dirname, basename := filepath.Split(path)
+	dirname = filepath.Join(dirname, fmt.Sprintf("worker%d", workerID))
+	os.MkdirAll(dirname, 0755)
+	return filepath.Join(dirname, basename)
+}
+
+// workerListenOn shifts the port by the number of the worker, so that the
+// HTTP endpoints of the workers are served side by side.
+func workerListenOn(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return addr
+	}
+	return net.JoinHostPort(host, strconv.Itoa(n+workerID))
+}
+
+// workerFilePath inserts the number of the worker before the extension.
+func workerFilePath(path string) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.worker%d%s", strings.TrimSuffix(path, ext), workerID, ext)
+}
+
+// adjustWorkerSections gives the outputs of the worker their own buffers.
+// The sole worker of -supervise keeps the buffers as they are.
+func adjustWorkerSections(sections []*fluentd_forwarder.ConfigElement) {
+	if workerCount < 2 {
+		return
+	}
+	for _, section := range sections {
+		if section.Name == "output" && section.Has("buffer-path") {
+			section.Set("buffer-path", workerBufferPath(section.Get("buffer-path", "")))
+		}
+	}
+}
+
+// adjustWorkerParams makes the settings of the worker process its own.  The
+// log is written to the standard error, which the supervisor writes to its
+// log.
+func adjustWorkerParams(params *FluentdForwarderParams) {
+	if workerCount > 1 {
+		params.JournalGroupPath = workerBufferPath(params.JournalGroupPath)
+		if params.HTTPListenOn != "" {
+			params.HTTPListenOn = workerListenOn(params.HTTPListenOn)
+		}
+		if params.DebugListenOn != "" {
+			params.DebugListenOn = workerListenOn(params.DebugListenOn)
+		}
+		if params.StatusFile != "" {
+			params.StatusFile = workerFilePath(params.StatusFile)
+		}
+		if params.CPUProfileFile != "" {
+			params.CPUProfileFile = workerFilePath(params.CPUProfileFile)
+		}
+	}
+	params.LogFile = ""
+}
+
+// listenAddresses returns the addresses the inputs listen on.
+func listenAddresses(params *FluentdForwarderParams) []string {
+	retval := make([]string, 0)
+	if !params.FluentdConfig {
+		retval = append(retval, params.ListenOn)
+	}
+	for _, section := range params.ConfigSections {
+		if addr, ok := fluentd_forwarder.InputListenAddress(section); ok {
+			retval = append(retval, addr)
+		}
+	}
+	return retval
+}
@@ -0,0 +1,88 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+)
+
+// ErrorLabel is the label that receives the records failing in the filters
+// or the outputs if the configuration defines it, like @ERROR of fluentd.
+const ErrorLabel = "@ERROR"
+
+// ErrorKey is where the error message and the stage it occurred at are
+// stored in the records sent to the error label.
+const ErrorKey = "__error"
+
+// ErrorPort hands the failed records to the error label, or logs and drops
+// them if label is nil.
+type ErrorPort struct {
+	logger *logging.Logger
+	label  Port
+}
+
+// Report sends the records that failed at the stage, such as a filter or
+// an output.
+func (port *ErrorPort) Report(stage string, errs RecordErrors) {
+	if len(errs) == 0 {
+		return
+	}
+	errorRecords.With(stage).Add(float64(len(errs)))
+	for _, e := range errs {
+		DefaultRecordTracer.Tracef(e.Tag, "%s: failed: %s", stage, e.Err.Error())
+	}
+	if port.label == nil {
+		countDropped(DropError, len(errs))
+		for _, e := range errs {
+			port.logger.Errorf("%s: dropped a record with tag %s: %s", LogComponent(stage), LogTag(e.Tag), LogError(e.Err))
+		}
+		return
+	}
+	recordSets := make([]FluentRecordSet, 0)
+	for _, e := range errs {
+		e.Record.Data[ErrorKey] = map[string]interface{}{
+			"message": e.Err.Error(),
+			"stage":   stage,
+		}
+		recordSets = appendRecord(recordSets, e.Tag, e.Record)
+	}
+	err := port.label.Emit(recordSets)
+	if err != nil {
+		countDropped(DropError, len(errs))
+		port.logger.Errorf("%s: failed to emit %d records to %s: %s", LogComponent(stage), len(errs), ErrorLabel, LogError(err))
+	}
+}
+
+// ReportAll sends all the records as failed with the same error.
+func (port *ErrorPort) ReportAll(stage string, recordSets []FluentRecordSet, err error) {
+	errs := make(RecordErrors, 0)
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			errs = append(errs, RecordError{Tag: recordSet.Tag, Record: record, Err: err})
+		}
+	}
+	port.Report(stage, errs)
+}
+
+func NewErrorPort(logger *logging.Logger, label Port) *ErrorPort {
+	return &ErrorPort{
+		logger: logger,
+		label:  label,
+	}
+}
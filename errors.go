@@ -34,3 +34,33 @@ func (e Errors) Error() string {
 	}
 	return string(buf)
 }
+
+// RecordError is a record that failed at some stage of the pipeline.
+type RecordError struct {
+	Tag    string
+	Record TinyFluentRecord
+	Err    error
+}
+
+// RecordErrors is returned by a filter along with the records that passed
+// when some of the records failed; the failed ones are not included in the
+// result.
+type RecordErrors []RecordError
+
+func (e RecordErrors) Error() string {
+	errs := make(Errors, 0, len(e))
+	for _, e_ := range e {
+		errs = append(errs, e_.Err)
+	}
+	return errs.Error()
+}
+
+// FlushTimeoutError is returned by an output when it abandons the flush of
+// a chunk for taking too long.
+type FlushTimeoutError struct {
+	Message string
+}
+
+func (e *FlushTimeoutError) Error() string {
+	return e.Message
+}
@@ -86,6 +86,7 @@ type FileJournalGroup struct {
 	pathPrefix string
 	pathSuffix string
 	journals   map[string]*FileJournal
+	recovery   BufferRecovery
 	mtx        sync.Mutex
 }
 
@@ -285,7 +286,7 @@ func (journal *FileJournal) notifyFlushListeners(chunk *FileJournalChunk) {
 	for _, listener := range journal.flushListeners {
 		err := listener.ChunkFlushed(journal.newChunkWrapper(chunk))
 		if err != nil {
-			journal.group.logger.Errorf("error occurred during notifying flush event: %s", err.Error())
+			journal.group.logger.Errorf("error occurred during notifying flush event: %s", LogError(err))
 		}
 	}
 }
@@ -295,7 +296,7 @@ func (journal *FileJournal) notifyNewChunkListeners(chunk *FileJournalChunk) {
 	for _, listener := range journal.newChunkListeners {
 		err := listener.NewChunkCreated(journal.newChunkWrapper(chunk))
 		if err != nil {
-			journal.group.logger.Errorf("error occurred during notifying flush event: %s", err.Error())
+			journal.group.logger.Errorf("error occurred during notifying flush event: %s", LogError(err))
 		}
 	}
 }
@@ -563,6 +564,16 @@ func (journal *FileJournal) Write(data []byte) error {
 	return nil
 }
 
+func (journal *FileJournal) Usage() (int, int64) {
+	journal.chunks.mtx.Lock()
+	defer journal.chunks.mtx.Unlock()
+	size := int64(0)
+	for chunk := journal.chunks.first; chunk != nil; chunk = chunk.head.next {
+		size += atomic.LoadInt64(&chunk.Size)
+	}
+	return journal.chunks.count, size
+}
+
 func (journal *FileJournal) TailChunk() JournalChunk {
 	retval := (*FileJournalChunkWrapper)(nil)
 	{
@@ -601,6 +612,12 @@ func (journalGroup *FileJournalGroup) Dispose() error {
 	return nil
 }
 
+// Recovery returns the report of the chunks found when the group was
+// created.
+func (journalGroup *FileJournalGroup) Recovery() BufferRecovery {
+	return journalGroup.recovery
+}
+
 func (journalGroup *FileJournalGroup) GetFileJournal(key string) *FileJournal {
 	journalGroup.mtx.Lock()
 	defer journalGroup.mtx.Unlock()
@@ -753,7 +770,11 @@ func scanJournals(logger *logging.Logger, pathPrefix string, pathSuffix string)
 		}
 		for _, finfo := range files_ {
 			file := finfo.Name()
-			if !strings.HasSuffix(file, pathSuffix) {
+			// the files of the other buffers in the same directory
+			if !strings.HasPrefix(file, basename) || !strings.HasSuffix(file, pathSuffix) || len(file) < len(basename)+len(pathSuffix) {
+				continue
+			}
+			if strings.HasSuffix(file, QuarantineSuffix) {
 				continue
 			}
 			variablePortion := file[len(basename) : len(file)-len(pathSuffix)]
@@ -831,6 +852,10 @@ func (factory *FileJournalGroupFactory) GetJournalGroup(path string, worker Work
 	if err != nil {
 		return nil, err
 	}
+	recovery, err := recoverJournals(path, journals, factory.defaultFileMode)
+	if err != nil {
+		return nil, err
+	}
 
 	journalGroup := &FileJournalGroup{
 		factory:    factory,
@@ -843,6 +868,7 @@ func (factory *FileJournalGroupFactory) GetJournalGroup(path string, worker Work
 		pathPrefix: pathPrefix,
 		pathSuffix: pathSuffix,
 		journals:   journals,
+		recovery:   recovery,
 		mtx:        sync.Mutex{},
 	}
 	for _, journal := range journals {
@@ -866,6 +892,13 @@ func (factory *FileJournalGroupFactory) GetJournalGroup(path string, worker Work
 		journal.writer = file
 	}
 	factory.logger.Infof("Path %s is designated to Worker %s", path, worker.String())
+	if recovery.Bytes > 0 || recovery.QuarantinedBytes > 0 {
+		factory.logger.Noticef("Recovered %d chunks (%d bytes) from %s in %.3fs", recovery.Chunks, recovery.Bytes, path, recovery.Duration)
+	}
+	if recovery.QuarantinedBytes > 0 {
+		factory.logger.Warningf("Moved the corrupt parts of %d chunks (%d bytes) of %s to %s", recovery.CorruptChunks, recovery.QuarantinedBytes, path, strings.Join(recovery.QuarantineFiles, ", "))
+	}
+	DefaultBufferRecoveries.add(recovery)
 	factory.paths[path] = journalGroup
 	return journalGroup, nil
 }
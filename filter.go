@@ -0,0 +1,118 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+// appendRecord appends a record to the record sets, extending the last one
+// if it has the same tag.
+func appendRecord(recordSets []FluentRecordSet, tag string, record TinyFluentRecord) []FluentRecordSet {
+	if n := len(recordSets); n > 0 && recordSets[n-1].Tag == tag {
+		recordSets[n-1].Records = append(recordSets[n-1].Records, record)
+		return recordSets
+	}
+	return append(recordSets, FluentRecordSet{
+		Tag:     tag,
+		Records: []TinyFluentRecord{record},
+	})
+}
+
+// FilterPort applies a Filter to the records that the matcher selects and
+// passes everything on to the next Port, keeping the order.  The records
+// the filter fails on are reported to errors; the error is returned instead
+// if errors is nil.
+type FilterPort struct {
+	filter  Filter
+	matcher *RecordMatcher
+	next    Port
+	errors  *ErrorPort
+}
+
+func (port *FilterPort) Emit(recordSets []FluentRecordSet) error {
+	retval := make([]FluentRecordSet, 0, len(recordSets))
+	matched := make([]FluentRecordSet, 0, len(recordSets))
+	flush := func() error {
+		if len(matched) == 0 {
+			return nil
+		}
+		DefaultRecordTracer.TraceRecordSets(matched, "%s: applied", port.filter.String())
+		filtered, err := port.filter.Filter(matched)
+		if err != nil {
+			if port.errors == nil {
+				return err
+			}
+			if errs, ok := err.(RecordErrors); ok {
+				port.errors.Report(port.filter.String(), errs)
+			} else {
+				port.errors.ReportAll(port.filter.String(), matched, err)
+				filtered = nil
+			}
+		}
+		DefaultRecordTracer.TraceRecordSets(filtered, "%s: passed", port.filter.String())
+		retval = append(retval, filtered...)
+		// the filter may hold on to the slice it was given
+		matched = make([]FluentRecordSet, 0, len(recordSets))
+		return nil
+	}
+	for _, recordSet := range recordSets {
+		if port.matcher == nil || (port.matcher.MatchTag(recordSet.Tag) && !port.matcher.HasPredicates()) {
+			matched = append(matched, recordSet)
+			continue
+		}
+		if !port.matcher.MatchTag(recordSet.Tag) {
+			err := flush()
+			if err != nil {
+				return err
+			}
+			retval = append(retval, recordSet)
+			continue
+		}
+		for _, record := range recordSet.Records {
+			if port.matcher.MatchRecord(record.Data) {
+				matched = appendRecord(matched, recordSet.Tag, record)
+				continue
+			}
+			err := flush()
+			if err != nil {
+				return err
+			}
+			retval = appendRecord(retval, recordSet.Tag, record)
+		}
+	}
+	err := flush()
+	if err != nil {
+		return err
+	}
+	if len(retval) == 0 {
+		return nil
+	}
+	inheritTrace(retval, recordSets)
+	return port.next.Emit(retval)
+}
+
+func (port *FilterPort) String() string {
+	return port.filter.String()
+}
+
+func NewFilterPort(filter Filter, matcher *RecordMatcher, next Port, errors *ErrorPort) *FilterPort {
+	return &FilterPort{
+		filter:  filter,
+		matcher: matcher,
+		next:    next,
+		errors:  errors,
+	}
+}
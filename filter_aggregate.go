@@ -0,0 +1,382 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The numbers of the groups in a window and of the values of a field in a
+// group kept for the percentiles unless configured.
+const (
+	defaultAggregateMaxGroups = 10000
+	defaultAggregateMaxValues = 10000
+)
+
+var aggregateOverflowRecords = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_aggregate_overflow_records_total", "Number of the records left out of the summaries for the groups beyond max-groups of the window.", "filter"))
+
+type aggregateField struct {
+	count int64
+	sum   float64
+	min   float64
+	max   float64
+	// a uniform sample of the values once there are more than max-values
+	values []float64
+}
+
+type aggregateGroup struct {
+	tag    string
+	keys   map[string]interface{}
+	count  int64
+	fields map[string]*aggregateField
+}
+
+// AggregateFilter consumes the records and emits a summary record for each
+// combination of the tag and the values of the groupBy keys at the end of
+// every tumbling window: the number of the records and the sum, minimum,
+// maximum, average and percentiles of each of the fields.  The percentiles
+// are estimated from a sample of the values once a group has more than
+// maxValues of them, and the records of the groups beyond maxGroups are left
+// out of the window.
+type AggregateFilter struct {
+	logger         *logging.Logger
+	name           string
+	tag            string
+	groupBy        []*RecordAccessor
+	fields         []*RecordAccessor
+	percentiles    []float64
+	window         time.Duration
+	maxGroups      int
+	maxValues      int
+	rand           *rand.Rand
+	timeGetter     func() time.Time
+	next           Port
+	mtx            sync.Mutex
+	windowStart    time.Time
+	groups         map[string]*aggregateGroup
+	order          []string
+	overflow       int64
+	overflowCount  *Counter
+	isShuttingDown uintptr
+	shutdownChan   chan struct{}
+	wg             sync.WaitGroup
+}
+
+func groupValueString(v interface{}) string {
+	switch v_ := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v_
+	case []byte:
+		return string(v_)
+	}
+	return fmt.Sprint(v)
+}
+
+func (filter *AggregateFilter) groupKey(tag string, data map[string]interface{}) string {
+	parts := make([]string, 0, len(filter.groupBy)+1)
+	parts = append(parts, tag)
+	for _, key := range filter.groupBy {
+		v, _ := key.Get(data)
+		parts = append(parts, groupValueString(v))
+	}
+	return strings.Join(parts, "\x00")
+}
+
+func (filter *AggregateFilter) add(tag string, data map[string]interface{}) {
+	key := filter.groupKey(tag, data)
+	group, ok := filter.groups[key]
+	if !ok {
+		if filter.maxGroups > 0 && len(filter.groups) >= filter.maxGroups {
+			filter.overflow += 1
+			filter.overflowCount.Inc()
+			return
+		}
+		keys := make(map[string]interface{}, len(filter.groupBy))
+		for _, k := range filter.groupBy {
+			if v, ok := k.Get(data); ok {
+				keys[k.String()] = v
+			}
+		}
+		group = &aggregateGroup{
+			tag:    tag,
+			keys:   keys,
+			count:  0,
+			fields: make(map[string]*aggregateField),
+		}
+		filter.groups[key] = group
+		filter.order = append(filter.order, key)
+	}
+	group.count += 1
+	for _, accessor := range filter.fields {
+		v, _ := accessor.Get(data)
+		value, ok := toFloat64(v)
+		if !ok {
+			continue
+		}
+		name := accessor.Name()
+		field, ok := group.fields[name]
+		if !ok {
+			field = &aggregateField{count: 0, sum: 0, min: value, max: value, values: nil}
+			group.fields[name] = field
+		}
+		field.count += 1
+		field.sum += value
+		field.min = math.Min(field.min, value)
+		field.max = math.Max(field.max, value)
+		if len(filter.percentiles) > 0 {
+			if filter.maxValues <= 0 || len(field.values) < filter.maxValues {
+				field.values = append(field.values, value)
+			} else if i := filter.rand.Int63n(field.count); i < int64(filter.maxValues) {
+				// reservoir sampling
+				field.values[i] = value
+			}
+		}
+	}
+}
+
+// percentile returns the nearest-rank percentile of the sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func formatPercentile(p float64) string {
+	return "p" + strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "_", 1)
+}
+
+func (filter *AggregateFilter) summarize(group *aggregateGroup, windowStart time.Time) TinyFluentRecord {
+	data := make(map[string]interface{}, len(group.keys)+1+len(group.fields)*(4+len(filter.percentiles)))
+	for _, k := range filter.groupBy {
+		if v, ok := group.keys[k.String()]; ok {
+			k.Set(data, v)
+		}
+	}
+	data["count"] = group.count
+	for name, field := range group.fields {
+		data[name+".sum"] = field.sum
+		data[name+".min"] = field.min
+		data[name+".max"] = field.max
+		data[name+".avg"] = field.sum / float64(field.count)
+		if len(field.values) > 0 {
+			sort.Float64s(field.values)
+			for _, p := range filter.percentiles {
+				data[name+"."+formatPercentile(p)] = percentile(field.values, p)
+			}
+		}
+	}
+	return TinyFluentRecord{
+		Timestamp: uint64(windowStart.Unix()),
+		Data:      data,
+	}
+}
+
+// rotate must be called with the lock held.  It returns the summaries of the
+// window that has been closed, if any.
+func (filter *AggregateFilter) rotate(windowStart time.Time) []FluentRecordSet {
+	if !windowStart.After(filter.windowStart) {
+		return nil
+	}
+	retval := make([]FluentRecordSet, 0)
+	for _, key := range filter.order {
+		group := filter.groups[key]
+		tag := filter.tag
+		if tag == "" {
+			tag = group.tag
+		}
+		retval = appendRecord(retval, tag, filter.summarize(group, filter.windowStart))
+	}
+	if filter.overflow > 0 {
+		filter.logger.Warningf("%s: %d records left out of the summaries of the window at %s for more than %d groups", LogComponent(filter.String()), filter.overflow, filter.windowStart.Format(time.RFC3339), filter.maxGroups)
+	}
+	filter.windowStart = windowStart
+	filter.groups = make(map[string]*aggregateGroup)
+	filter.order = make([]string, 0)
+	filter.overflow = 0
+	return retval
+}
+
+func (filter *AggregateFilter) Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error) {
+	filter.mtx.Lock()
+	defer filter.mtx.Unlock()
+	retval := filter.rotate(filter.timeGetter().Truncate(filter.window))
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			filter.add(recordSet.Tag, record.Data)
+		}
+	}
+	return retval, nil
+}
+
+func (filter *AggregateFilter) flush(windowStart time.Time) {
+	filter.mtx.Lock()
+	summaries := filter.rotate(windowStart)
+	filter.mtx.Unlock()
+	if len(summaries) == 0 {
+		return
+	}
+	err := filter.next.Emit(summaries)
+	if err != nil {
+		filter.logger.Errorf("%s: failed to emit the summaries: %s", LogComponent(filter.String()), LogError(err))
+	}
+}
+
+func (filter *AggregateFilter) String() string {
+	return "filter:" + filter.name
+}
+
+// SetLimits sets the number of the groups in a window and of the values of
+// a field in a group kept for the percentiles; unlimited if 0.
+func (filter *AggregateFilter) SetLimits(maxGroups int, maxValues int) {
+	filter.maxGroups = maxGroups
+	filter.maxValues = maxValues
+}
+
+func (filter *AggregateFilter) Start() {
+	filter.wg.Add(1)
+	go func() {
+		defer filter.wg.Done()
+		for {
+			now := filter.timeGetter()
+			timer := time.NewTimer(now.Truncate(filter.window).Add(filter.window).Sub(now))
+			select {
+			case <-filter.shutdownChan:
+				timer.Stop()
+				// emit what has been aggregated so far
+				filter.flush(filter.timeGetter().Truncate(filter.window).Add(filter.window))
+				return
+			case <-timer.C:
+				filter.flush(filter.timeGetter().Truncate(filter.window))
+			}
+		}
+	}()
+}
+
+func (filter *AggregateFilter) Stop() {
+	if atomic.CompareAndSwapUintptr(&filter.isShuttingDown, uintptr(0), uintptr(1)) {
+		filter.shutdownChan <- struct{}{}
+	}
+}
+
+func (filter *AggregateFilter) WaitForShutdown() {
+	filter.wg.Wait()
+}
+
+func NewAggregateFilter(logger *logging.Logger, name string, tag string, groupBy []*RecordAccessor, fields []*RecordAccessor, percentiles []float64, window time.Duration, timeGetter func() time.Time, next Port) *AggregateFilter {
+	return &AggregateFilter{
+		logger:         logger,
+		name:           name,
+		tag:            tag,
+		groupBy:        groupBy,
+		fields:         fields,
+		percentiles:    percentiles,
+		window:         window,
+		maxGroups:      defaultAggregateMaxGroups,
+		maxValues:      defaultAggregateMaxValues,
+		rand:           rand.New(rand.NewSource(time.Now().UnixNano())),
+		timeGetter:     timeGetter,
+		next:           next,
+		mtx:            sync.Mutex{},
+		windowStart:    timeGetter().Truncate(window),
+		groups:         make(map[string]*aggregateGroup),
+		order:          make([]string, 0),
+		overflow:       0,
+		overflowCount:  aggregateOverflowRecords.With("filter:" + name),
+		isShuttingDown: uintptr(0),
+		shutdownChan:   make(chan struct{}, 1),
+		wg:             sync.WaitGroup{},
+	}
+}
+
+func newAggregateFilterFromConfig(logger *logging.Logger, config *ConfigElement, next Port) (Filter, error) {
+	window, err := config.GetDuration("window", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	if window <= 0 {
+		return nil, errors.New(fmt.Sprintf("%s: window must be positive", config.String()))
+	}
+	percentiles := make([]float64, 0)
+	for _, item := range config.GetList("percentiles") {
+		p, err := strconv.ParseFloat(item, 64)
+		if err != nil || p <= 0 || p > 100 {
+			return nil, errors.New(fmt.Sprintf("%s: invalid percentile: %s", config.String(), item))
+		}
+		percentiles = append(percentiles, p)
+	}
+	groupBy, err := recordAccessorsFromConfig(config, "group-by")
+	if err != nil {
+		return nil, err
+	}
+	fields, err := recordAccessorsFromConfig(config, "fields")
+	if err != nil {
+		return nil, err
+	}
+	maxGroups, err := config.GetInt("max-groups", defaultAggregateMaxGroups)
+	if err != nil {
+		return nil, err
+	}
+	maxValues, err := config.GetInt("max-values", defaultAggregateMaxValues)
+	if err != nil {
+		return nil, err
+	}
+	if maxGroups < 0 || maxValues < 0 {
+		return nil, errors.New(fmt.Sprintf("%s: max-groups and max-values must not be negative", config.String()))
+	}
+	filter := NewAggregateFilter(
+		logger,
+		config.Arg,
+		config.Get("tag", ""),
+		groupBy,
+		fields,
+		percentiles,
+		window,
+		time.Now,
+		next,
+	)
+	filter.SetLimits(maxGroups, maxValues)
+	return filter, nil
+}
+
+func init() {
+	RegisterFilter("aggregate", newAggregateFilterFromConfig)
+	RegisterFilterParams("aggregate",
+		ParamSchema{Name: "group-by", Type: ParamList, Description: "variables by whose values the events are summarized"},
+		ParamSchema{Name: "fields", Type: ParamList, Description: "numeric variables summarized"},
+		ParamSchema{Name: "percentiles", Type: ParamList, Description: "percentiles of the fields summarized"},
+		ParamSchema{Name: "window", Type: ParamDuration, Description: "interval of the summaries, aligned to the wall clock", Default: "1m"},
+		ParamSchema{Name: "tag", Type: ParamString, Description: "tag of the summaries; the original tag if unspecified"},
+		ParamSchema{Name: "max-groups", Type: ParamInteger, Description: "number of the groups in a window, beyond which the records of the new groups are left out; unlimited if 0", Default: "10000"},
+		ParamSchema{Name: "max-values", Type: ParamInteger, Description: "number of the values of a field in a group kept for the percentiles, beyond which they are estimated from a sample; unlimited if 0", Default: "10000"},
+	)
+}
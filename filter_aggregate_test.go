@@ -0,0 +1,124 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"testing"
+	"time"
+)
+
+func Test_AggregateFilter(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("aggregate")
+	now := time.Date(2014, 1, 1, 0, 0, 10, 0, time.UTC)
+	filter := NewAggregateFilter(logger, "test", "summary", mustRecordAccessors("service"), mustRecordAccessors("latency"), []float64{50, 90}, time.Minute, func() time.Time { return now }, nil)
+	records := make([]TinyFluentRecord, 0)
+	for i := 1; i <= 10; i += 1 {
+		records = append(records, TinyFluentRecord{Timestamp: 0, Data: map[string]interface{}{"service": "a", "latency": int64(i)}})
+	}
+	records = append(records, TinyFluentRecord{Timestamp: 0, Data: map[string]interface{}{"service": []byte("b"), "latency": "0.5"}})
+	result, _ := filter.Filter([]FluentRecordSet{{Tag: "test", Records: records}})
+	if len(result) != 0 {
+		t.Logf("%+v", result)
+		t.Fail()
+	}
+	now = now.Add(time.Minute)
+	result, _ = filter.Filter([]FluentRecordSet{})
+	if len(result) != 1 || result[0].Tag != "summary" || len(result[0].Records) != 2 {
+		t.Fatalf("%+v", result)
+	}
+	a := result[0].Records[0]
+	if a.Timestamp != uint64(time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC).Unix()) {
+		t.Logf("%d", a.Timestamp)
+		t.Fail()
+	}
+	expected := map[string]interface{}{
+		"service":     "a",
+		"count":       int64(10),
+		"latency.sum": float64(55),
+		"latency.min": float64(1),
+		"latency.max": float64(10),
+		"latency.avg": float64(5.5),
+		"latency.p50": float64(5),
+		"latency.p90": float64(9),
+	}
+	for k, v := range expected {
+		if a.Data[k] != v {
+			t.Logf("%s: %v != %v", k, a.Data[k], v)
+			t.Fail()
+		}
+	}
+	b := result[0].Records[1]
+	if string(b.Data["service"].([]byte)) != "b" || b.Data["count"] != int64(1) || b.Data["latency.sum"] != float64(0.5) {
+		t.Logf("%+v", b)
+		t.Fail()
+	}
+	result, _ = filter.Filter([]FluentRecordSet{})
+	if len(result) != 0 {
+		t.Logf("%+v", result)
+		t.Fail()
+	}
+}
+
+func Test_AggregateFilter_Limits(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("aggregate")
+	now := time.Date(2014, 1, 1, 0, 0, 10, 0, time.UTC)
+	filter := NewAggregateFilter(logger, "limits", "", mustRecordAccessors("service"), mustRecordAccessors("latency"), []float64{50}, time.Minute, func() time.Time { return now }, nil)
+	filter.SetLimits(2, 100)
+	overflow := filter.overflowCount.Value()
+	records := make([]TinyFluentRecord, 0)
+	for i := 1; i <= 1000; i += 1 {
+		records = append(records, TinyFluentRecord{Timestamp: 0, Data: map[string]interface{}{"service": "a", "latency": int64(i)}})
+	}
+	// c is the third group
+	for _, service := range []string{"b", "c", "c", "b"} {
+		records = append(records, TinyFluentRecord{Timestamp: 0, Data: map[string]interface{}{"service": service, "latency": int64(1)}})
+	}
+	filter.Filter([]FluentRecordSet{{Tag: "test", Records: records}})
+	if len(filter.groups) != 2 || filter.overflow != 2 || filter.overflowCount.Value()-overflow != 2 {
+		t.Fatalf("%d groups, %d overflow", len(filter.groups), filter.overflow)
+	}
+	if n := len(filter.groups[filter.order[0]].fields["latency"].values); n != 100 {
+		t.Errorf("%d values kept", n)
+	}
+
+	now = now.Add(time.Minute)
+	result, _ := filter.Filter([]FluentRecordSet{})
+	if len(result) != 1 || len(result[0].Records) != 2 {
+		t.Fatalf("%+v", result)
+	}
+	a := result[0].Records[0].Data
+	// the sample estimates the percentiles, whereas the rest stays exact
+	if a["count"] != int64(1000) || a["latency.sum"] != float64(500500) || a["latency.min"] != float64(1) || a["latency.max"] != float64(1000) {
+		t.Errorf("%+v", a)
+	}
+	if p50 := a["latency.p50"].(float64); p50 < 300 || p50 > 700 {
+		t.Errorf("p50: %g", p50)
+	}
+	if b := result[0].Records[1].Data; b["service"] != "b" || b["count"] != int64(2) {
+		t.Errorf("%+v", b)
+	}
+	// the next window takes the groups left out again
+	filter.Filter([]FluentRecordSet{{Tag: "test", Records: records[1000:]}})
+	if _, ok := filter.groups[filter.groupKey("test", map[string]interface{}{"service": "c"})]; !ok || len(filter.groups) != 2 || filter.overflow != 0 {
+		t.Errorf("%d groups, %d overflow", len(filter.groups), filter.overflow)
+	}
+}
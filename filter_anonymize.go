@@ -0,0 +1,221 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"hash"
+	"os"
+	"sync"
+	"time"
+)
+
+// HMACKey is the secret of an AnonymizeFilter along with a short identifier
+// derived from it, which tells the consumers which key a hash was made with.
+type HMACKey struct {
+	Secret []byte
+	ID     string
+}
+
+func NewHMACKey(secret []byte) *HMACKey {
+	sum := sha256.Sum256(secret)
+	return &HMACKey{
+		Secret: secret,
+		ID:     hex.EncodeToString(sum[:4]),
+	}
+}
+
+// AnonymizeFilter replaces the values of the fields with the hex-encoded
+// HMAC of them, so that the same identifier always maps to the same hash
+// while the key stays the same.  The key is read from keyFile, which is
+// checked for updates every reloadInterval so that it can be rotated without
+// a restart.
+type AnonymizeFilter struct {
+	logger         *logging.Logger
+	name           string
+	fields         []*RecordAccessor
+	hashFunc       func() hash.Hash
+	keyIDField     *RecordAccessor
+	keyFile        string
+	reloadInterval time.Duration
+	timeGetter     func() time.Time
+	mtx            sync.Mutex
+	key            *HMACKey
+	keyModTime     time.Time
+	checkedAt      time.Time
+}
+
+func readHMACKey(path string) (*HMACKey, time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	secret, err := readKeyFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(secret) == 0 {
+		return nil, time.Time{}, errors.New(fmt.Sprintf("%s is empty", path))
+	}
+	return NewHMACKey(secret), info.ModTime(), nil
+}
+
+// currentKey returns the key, reloading it if the file has been updated.
+// The previous key keeps being used if the new one cannot be read.
+func (filter *AnonymizeFilter) currentKey() *HMACKey {
+	filter.mtx.Lock()
+	defer filter.mtx.Unlock()
+	if filter.keyFile == "" {
+		return filter.key
+	}
+	now := filter.timeGetter()
+	if now.Sub(filter.checkedAt) < filter.reloadInterval {
+		return filter.key
+	}
+	filter.checkedAt = now
+	info, err := os.Stat(filter.keyFile)
+	if err != nil {
+		filter.logger.Errorf("%s: %s", LogComponent(filter.String()), LogError(err))
+		return filter.key
+	}
+	if info.ModTime().Equal(filter.keyModTime) {
+		return filter.key
+	}
+	key, modTime, err := readHMACKey(filter.keyFile)
+	if err != nil {
+		filter.logger.Errorf("%s: failed to reload the key: %s", LogComponent(filter.String()), LogError(err))
+		return filter.key
+	}
+	if key.ID != filter.key.ID {
+		filter.logger.Noticef("%s: key rotated from %s to %s", LogComponent(filter.String()), filter.key.ID, key.ID)
+	}
+	filter.key = key
+	filter.keyModTime = modTime
+	return key
+}
+
+func (filter *AnonymizeFilter) Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error) {
+	key := filter.currentKey()
+	mac := hmac.New(filter.hashFunc, key.Secret)
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			anonymized := false
+			for _, field := range filter.fields {
+				v, ok := field.Get(record.Data)
+				if !ok || v == nil {
+					continue
+				}
+				mac.Reset()
+				switch v_ := v.(type) {
+				case []byte:
+					mac.Write(v_)
+				default:
+					mac.Write([]byte(groupValueString(v)))
+				}
+				field.Set(record.Data, hex.EncodeToString(mac.Sum(nil)))
+				anonymized = true
+			}
+			if anonymized && filter.keyIDField != nil {
+				filter.keyIDField.Set(record.Data, key.ID)
+			}
+		}
+	}
+	return recordSets, nil
+}
+
+func (filter *AnonymizeFilter) String() string {
+	return "filter:" + filter.name
+}
+
+// NewAnonymizeFilter creates a filter that hashes with the given key, which
+// is reloaded from keyFile unless it is empty.  The key ID is not stored if
+// keyIDField is nil.
+func NewAnonymizeFilter(logger *logging.Logger, name string, fields []*RecordAccessor, hashFunc func() hash.Hash, keyIDField *RecordAccessor, key *HMACKey, keyFile string, reloadInterval time.Duration, timeGetter func() time.Time) *AnonymizeFilter {
+	return &AnonymizeFilter{
+		logger:         logger,
+		name:           name,
+		fields:         fields,
+		hashFunc:       hashFunc,
+		keyIDField:     keyIDField,
+		keyFile:        keyFile,
+		reloadInterval: reloadInterval,
+		timeGetter:     timeGetter,
+		mtx:            sync.Mutex{},
+		key:            key,
+		checkedAt:      timeGetter(),
+	}
+}
+
+func newAnonymizeFilterFromConfig(logger *logging.Logger, config *ConfigElement, next Port) (Filter, error) {
+	fields, err := recordAccessorsFromConfig(config, "fields")
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, errors.New(fmt.Sprintf("%s: fields is not specified", config.String()))
+	}
+	hashFunc := (func() hash.Hash)(nil)
+	switch algorithm := config.Get("algorithm", "sha256"); algorithm {
+	case "sha256":
+		hashFunc = sha256.New
+	case "sha512":
+		hashFunc = sha512.New
+	default:
+		return nil, errors.New(fmt.Sprintf("%s: unsupported algorithm: %s", config.String(), algorithm))
+	}
+	keyFile := config.Get("key-file", "")
+	if keyFile == "" {
+		return nil, errors.New(fmt.Sprintf("%s: key-file is not specified", config.String()))
+	}
+	key, modTime, err := readHMACKey(keyFile)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", config.String(), err.Error()))
+	}
+	reloadInterval, err := config.GetDuration("key-reload-interval", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	keyIDField := (*RecordAccessor)(nil)
+	if config.Get("key-id-field", "hmac_key_id") != "" {
+		keyIDField, err = recordAccessorFromConfig(config, "key-id-field", "hmac_key_id")
+		if err != nil {
+			return nil, err
+		}
+	}
+	filter := NewAnonymizeFilter(logger, config.Arg, fields, hashFunc, keyIDField, key, keyFile, reloadInterval, time.Now)
+	filter.keyModTime = modTime
+	return filter, nil
+}
+
+func init() {
+	RegisterFilter("anonymize", newAnonymizeFilterFromConfig)
+	RegisterFilterParams("anonymize",
+		ParamSchema{Name: "fields", Type: ParamList, Description: "variables replaced with their HMAC", Required: true},
+		ParamSchema{Name: "key-file", Type: ParamString, Description: "file of the key of the HMAC", Required: true},
+		ParamSchema{Name: "algorithm", Type: ParamString, Description: "hash of the HMAC", Default: "sha256", Enum: []string{"sha256", "sha512"}},
+		ParamSchema{Name: "key-reload-interval", Type: ParamDuration, Description: "interval in which the key file is checked for updates", Default: "1m"},
+		ParamSchema{Name: "key-id-field", Type: ParamString, Description: "variable the identifier of the key is stored in; not stored if empty", Default: "hmac_key_id"},
+	)
+}
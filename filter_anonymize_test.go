@@ -0,0 +1,88 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_AnonymizeFilter(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("anonymize")
+	dir, err := ioutil.TempDir("", "anonymize")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key")
+	err = ioutil.WriteFile(keyFile, []byte("secret1"), 0600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	key, modTime, err := readHMACKey(keyFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	now := time.Unix(1000, 0)
+	filter := NewAnonymizeFilter(logger, "anon", mustRecordAccessors("user_id", "ip"), sha256.New, mustRecordAccessor("hmac_key_id"), key, keyFile, time.Minute, func() time.Time { return now })
+	filter.keyModTime = modTime
+	expected := func(secret string, value string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(value))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	anonymize := func() map[string]interface{} {
+		data := map[string]interface{}{"user_id": int64(42), "ip": []byte("10.0.0.1"), "path": "/"}
+		_, err := filter.Filter([]FluentRecordSet{{Tag: "access", Records: []TinyFluentRecord{{Timestamp: 0, Data: data}}}})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return data
+	}
+	data := anonymize()
+	if data["user_id"] != expected("secret1", "42") || data["ip"] != expected("secret1", "10.0.0.1") || data["path"] != "/" || data["hmac_key_id"] != key.ID {
+		t.Logf("%+v", data)
+		t.Fail()
+	}
+
+	// rotate the key; it is picked up once the reload interval has passed
+	err = ioutil.WriteFile(keyFile, []byte("secret2"), 0600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	os.Chtimes(keyFile, modTime.Add(time.Second), modTime.Add(time.Second))
+	if data := anonymize(); data["ip"] != expected("secret1", "10.0.0.1") {
+		t.Logf("%+v", data)
+		t.Fail()
+	}
+	now = now.Add(time.Minute)
+	data = anonymize()
+	if data["ip"] != expected("secret2", "10.0.0.1") || data["hmac_key_id"] != NewHMACKey([]byte("secret2")).ID {
+		t.Logf("%+v", data)
+		t.Fail()
+	}
+}
@@ -0,0 +1,256 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What to do with a field whose value cannot be converted.
+const (
+	CastKeep        = "keep"
+	CastNull        = "null"
+	CastRemoveField = "remove"
+	CastDropRecord  = "drop"
+)
+
+type FieldCast struct {
+	Key     *RecordAccessor
+	Type    string
+	OnError string
+}
+
+// CastFilter converts the fields of the records to the declared types:
+// integer, float, bool, string or time (the seconds since the epoch, parsed
+// from a string in timeFormat if not a number).
+type CastFilter struct {
+	logger     *logging.Logger
+	name       string
+	casts      []FieldCast
+	timeFormat string
+}
+
+func castToInteger(v interface{}) (interface{}, bool) {
+	switch v_ := v.(type) {
+	case int64:
+		return v_, true
+	case uint64:
+		if v_ > math.MaxInt64 {
+			return nil, false
+		}
+		return int64(v_), true
+	case string, []byte:
+		s := strings.TrimSpace(groupValueString(v_))
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err == nil {
+			return i, true
+		}
+	case bool:
+		return nil, false
+	}
+	f, ok := toFloat64(v)
+	if !ok || f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return nil, false
+	}
+	return int64(f), true
+}
+
+func castToFloat(v interface{}) (interface{}, bool) {
+	if s, ok := v.(string); ok {
+		v = strings.TrimSpace(s)
+	} else if b, ok := v.([]byte); ok {
+		v = strings.TrimSpace(string(b))
+	}
+	f, ok := toFloat64(v)
+	if !ok {
+		return nil, false
+	}
+	return f, true
+}
+
+func castToBool(v interface{}) (interface{}, bool) {
+	switch v_ := v.(type) {
+	case bool:
+		return v_, true
+	case string, []byte:
+		switch strings.ToLower(strings.TrimSpace(groupValueString(v_))) {
+		case "true", "yes", "on", "1":
+			return true, true
+		case "false", "no", "off", "0", "":
+			return false, true
+		}
+		return nil, false
+	}
+	f, ok := toFloat64(v)
+	if !ok {
+		return nil, false
+	}
+	return f != 0, true
+}
+
+func castToString(v interface{}) (interface{}, bool) {
+	switch v_ := v.(type) {
+	case string:
+		return v_, true
+	case []byte:
+		return string(v_), true
+	case bool, int64, uint64, int:
+		return fmt.Sprint(v_), true
+	case float64:
+		return strconv.FormatFloat(v_, 'f', -1, 64), true
+	case float32:
+		return strconv.FormatFloat(float64(v_), 'f', -1, 32), true
+	}
+	return nil, false
+}
+
+func (filter *CastFilter) castToTime(v interface{}) (interface{}, bool) {
+	switch v.(type) {
+	case string, []byte:
+		s := strings.TrimSpace(groupValueString(v))
+		t, err := time.Parse(filter.timeFormat, s)
+		if err == nil {
+			return t.Unix(), true
+		}
+	}
+	return castToInteger(v)
+}
+
+func (filter *CastFilter) cast(typ string, v interface{}) (interface{}, bool) {
+	switch typ {
+	case "integer":
+		return castToInteger(v)
+	case "float":
+		return castToFloat(v)
+	case "bool":
+		return castToBool(v)
+	case "string":
+		return castToString(v)
+	case "time":
+		return filter.castToTime(v)
+	}
+	return nil, false
+}
+
+// castRecord returns an error if the record should be dropped.
+func (filter *CastFilter) castRecord(data map[string]interface{}) error {
+	for _, fieldCast := range filter.casts {
+		v, ok := fieldCast.Key.Get(data)
+		if !ok || v == nil {
+			continue
+		}
+		converted, ok := filter.cast(fieldCast.Type, v)
+		if ok {
+			fieldCast.Key.Set(data, converted)
+			continue
+		}
+		filter.logger.Debugf("%s: cannot convert %s (%v) to %s", LogComponent(filter.String()), fieldCast.Key, v, fieldCast.Type)
+		switch fieldCast.OnError {
+		case CastNull:
+			fieldCast.Key.Set(data, nil)
+		case CastRemoveField:
+			fieldCast.Key.Delete(data)
+		case CastDropRecord:
+			return errors.New(fmt.Sprintf("cannot convert %s (%v) to %s", fieldCast.Key, v, fieldCast.Type))
+		}
+	}
+	return nil
+}
+
+func (filter *CastFilter) Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error) {
+	retval := make([]FluentRecordSet, 0, len(recordSets))
+	errs := make(RecordErrors, 0)
+	for _, recordSet := range recordSets {
+		records := make([]TinyFluentRecord, 0, len(recordSet.Records))
+		for _, record := range recordSet.Records {
+			err := filter.castRecord(record.Data)
+			if err != nil {
+				errs = append(errs, RecordError{Tag: recordSet.Tag, Record: record, Err: err})
+				continue
+			}
+			records = append(records, record)
+		}
+		if len(records) > 0 {
+			retval = append(retval, FluentRecordSet{Tag: recordSet.Tag, Records: records})
+		}
+	}
+	if len(errs) > 0 {
+		return retval, errs
+	}
+	return retval, nil
+}
+
+func (filter *CastFilter) String() string {
+	return "filter:" + filter.name
+}
+
+func NewCastFilter(logger *logging.Logger, name string, casts []FieldCast, timeFormat string) *CastFilter {
+	return &CastFilter{
+		logger:     logger,
+		name:       name,
+		casts:      casts,
+		timeFormat: timeFormat,
+	}
+}
+
+func newCastFilterFromConfig(logger *logging.Logger, config *ConfigElement, next Port) (Filter, error) {
+	defaultOnError := config.Get("on-error", CastKeep)
+	casts := make([]FieldCast, 0)
+	for _, value := range config.GetAll("field") {
+		fields := strings.Fields(value)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, errors.New(fmt.Sprintf("%s: field must be given as \"name type [on-error]\": %s", config.String(), value))
+		}
+		key, err := NewRecordAccessor(fields[0])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: field: %s", config.String(), err.Error()))
+		}
+		fieldCast := FieldCast{Key: key, Type: fields[1], OnError: defaultOnError}
+		if len(fields) == 3 {
+			fieldCast.OnError = fields[2]
+		}
+		switch fieldCast.Type {
+		case "integer", "float", "bool", "string", "time":
+		default:
+			return nil, errors.New(fmt.Sprintf("%s: unknown type: %s", config.String(), fieldCast.Type))
+		}
+		switch fieldCast.OnError {
+		case CastKeep, CastNull, CastRemoveField, CastDropRecord:
+		default:
+			return nil, errors.New(fmt.Sprintf("%s: on-error must be one of keep, null, remove or drop: %s", config.String(), fieldCast.OnError))
+		}
+		casts = append(casts, fieldCast)
+	}
+	return NewCastFilter(logger, config.Arg, casts, config.Get("time-format", time.RFC3339)), nil
+}
+
+func init() {
+	RegisterFilter("cast", newCastFilterFromConfig)
+	RegisterFilterParams("cast",
+		ParamSchema{Name: "field", Type: ParamString, Description: "\"NAME TYPE [ON-ERROR]\" converting the variable to integer, float, bool, string or time", Repeated: true},
+		ParamSchema{Name: "on-error", Type: ParamString, Description: "what is done with a value that cannot be converted", Default: "keep", Enum: []string{"keep", "null", "remove", "drop"}},
+		ParamSchema{Name: "time-format", Type: ParamString, Description: "Go time layout of the time values", Default: "2006-01-02T15:04:05Z07:00"},
+	)
+}
@@ -0,0 +1,81 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_CastFilter(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("cast")
+	filter := NewCastFilter(logger, "test", []FieldCast{
+		{Key: mustRecordAccessor("status"), Type: "integer", OnError: CastKeep},
+		{Key: mustRecordAccessor("latency"), Type: "float", OnError: CastNull},
+		{Key: mustRecordAccessor("cached"), Type: "bool", OnError: CastRemoveField},
+		{Key: mustRecordAccessor("code"), Type: "string", OnError: CastKeep},
+		{Key: mustRecordAccessor("at"), Type: "time", OnError: CastKeep},
+		{Key: mustRecordAccessor("required"), Type: "integer", OnError: CastDropRecord},
+	}, time.RFC3339)
+	records := []TinyFluentRecord{
+		{Timestamp: 0, Data: map[string]interface{}{
+			"status":  []byte("200"),
+			"latency": "0.25",
+			"cached":  "yes",
+			"code":    int64(404),
+			"at":      "2014-01-01T00:00:00Z",
+		}},
+		{Timestamp: 0, Data: map[string]interface{}{
+			"status":  "OK",
+			"latency": "fast",
+			"cached":  "maybe",
+			"at":      float64(1388534400),
+		}},
+		{Timestamp: 0, Data: map[string]interface{}{
+			"required": "none",
+		}},
+	}
+	result, _ := filter.Filter([]FluentRecordSet{{Tag: "test", Records: records}})
+	if len(result) != 1 || len(result[0].Records) != 2 {
+		t.Fatalf("%+v", result)
+	}
+	expected := []map[string]interface{}{
+		{
+			"status":  int64(200),
+			"latency": float64(0.25),
+			"cached":  true,
+			"code":    "404",
+			"at":      int64(1388534400),
+		},
+		{
+			"status":  "OK",
+			"latency": nil,
+			"at":      int64(1388534400),
+		},
+	}
+	for i, record := range result[0].Records {
+		if !reflect.DeepEqual(record.Data, expected[i]) {
+			t.Logf("%+v", record.Data)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,289 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type concatBuffer struct {
+	tag    string
+	record TinyFluentRecord
+	// empty after the lines were emitted for the limits, until the next
+	// continuation line, whose record takes the place of the first line
+	lines []string
+	// the bytes of the lines joined by the separator
+	size     int
+	lastSeen time.Time
+}
+
+// ConcatFilter joins the lines following the one that matches startRegexp
+// (typically the continuation lines of a stack trace) into a single record
+// per stream, which is identified by the tag and the values of the
+// streamKeys.  A record is held until the next start line of the same
+// stream comes or no line has come for flushInterval, or until it has
+// maxLines lines or maxBytes bytes, after which the continuation lines
+// that follow are joined into the next record.
+type ConcatFilter struct {
+	logger         *logging.Logger
+	name           string
+	key            *RecordAccessor
+	streamKeys     []*RecordAccessor
+	startRegexp    *regexp.Regexp
+	separator      string
+	flushInterval  time.Duration
+	maxLines       int
+	maxBytes       int
+	timeGetter     func() time.Time
+	next           Port
+	mtx            sync.Mutex
+	buffers        map[string]*concatBuffer
+	isShuttingDown uintptr
+	shutdownChan   chan struct{}
+	wg             sync.WaitGroup
+}
+
+func (filter *ConcatFilter) streamKey(tag string, data map[string]interface{}) string {
+	parts := make([]string, 0, len(filter.streamKeys)+1)
+	parts = append(parts, tag)
+	for _, key := range filter.streamKeys {
+		v, _ := key.Get(data)
+		parts = append(parts, groupValueString(v))
+	}
+	return strings.Join(parts, "\x00")
+}
+
+func (buffer *concatBuffer) append(line string, separator string) {
+	if len(buffer.lines) > 0 {
+		buffer.size += len(separator)
+	}
+	buffer.lines = append(buffer.lines, line)
+	buffer.size += len(line)
+}
+
+// full tells whether the buffer has reached either of the limits.
+func (filter *ConcatFilter) full(buffer *concatBuffer) bool {
+	return (filter.maxLines > 0 && len(buffer.lines) >= filter.maxLines) || (filter.maxBytes > 0 && buffer.size >= filter.maxBytes)
+}
+
+func (buffer *concatBuffer) concat(key *RecordAccessor, separator string) TinyFluentRecord {
+	key.Set(buffer.record.Data, strings.Join(buffer.lines, separator))
+	return buffer.record
+}
+
+func (filter *ConcatFilter) Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error) {
+	now := filter.timeGetter()
+	filter.mtx.Lock()
+	defer filter.mtx.Unlock()
+	retval := make([]FluentRecordSet, 0, len(recordSets))
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			value, ok := filter.key.Get(record.Data)
+			if !ok {
+				retval = appendRecord(retval, recordSet.Tag, record)
+				continue
+			}
+			line := groupValueString(value)
+			key := filter.streamKey(recordSet.Tag, record.Data)
+			buffer, buffered := filter.buffers[key]
+			if filter.startRegexp.MatchString(line) {
+				if buffered && len(buffer.lines) > 0 {
+					retval = appendRecord(retval, buffer.tag, buffer.concat(filter.key, filter.separator))
+				}
+				buffer = &concatBuffer{tag: recordSet.Tag, record: record}
+				filter.buffers[key] = buffer
+			} else if buffered {
+				if len(buffer.lines) == 0 {
+					buffer.tag = recordSet.Tag
+					buffer.record = record
+				}
+			} else {
+				// a continuation line without the first line
+				retval = appendRecord(retval, recordSet.Tag, record)
+				continue
+			}
+			buffer.append(line, filter.separator)
+			buffer.lastSeen = now
+			if filter.full(buffer) {
+				retval = appendRecord(retval, buffer.tag, buffer.concat(filter.key, filter.separator))
+				filter.buffers[key] = &concatBuffer{tag: buffer.tag, lastSeen: now}
+			}
+		}
+	}
+	return retval, nil
+}
+
+// flush emits the records that have not been continued since the deadline,
+// or all of them if the deadline is zero.
+func (filter *ConcatFilter) flush(deadline time.Time) {
+	filter.mtx.Lock()
+	expired := make([]*concatBuffer, 0)
+	for key, buffer := range filter.buffers {
+		if deadline.IsZero() || buffer.lastSeen.Before(deadline) {
+			if len(buffer.lines) > 0 {
+				expired = append(expired, buffer)
+			}
+			delete(filter.buffers, key)
+		}
+	}
+	filter.mtx.Unlock()
+	if len(expired) == 0 {
+		return
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].record.Timestamp < expired[j].record.Timestamp
+	})
+	recordSets := make([]FluentRecordSet, 0, len(expired))
+	for _, buffer := range expired {
+		recordSets = appendRecord(recordSets, buffer.tag, buffer.concat(filter.key, filter.separator))
+	}
+	err := filter.next.Emit(recordSets)
+	if err != nil {
+		filter.logger.Errorf("%s: failed to emit the concatenated records: %s", LogComponent(filter.String()), LogError(err))
+	}
+}
+
+func (filter *ConcatFilter) String() string {
+	return "filter:" + filter.name
+}
+
+// SetLimits sets the number of the lines and the bytes of a record at
+// which it is emitted without waiting for the rest; unlimited if 0.
+func (filter *ConcatFilter) SetLimits(maxLines int, maxBytes int) {
+	filter.maxLines = maxLines
+	filter.maxBytes = maxBytes
+}
+
+func (filter *ConcatFilter) Start() {
+	filter.wg.Add(1)
+	go func() {
+		defer filter.wg.Done()
+		ticker := time.NewTicker(filter.flushInterval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-filter.shutdownChan:
+				filter.flush(time.Time{})
+				return
+			case <-ticker.C:
+				filter.flush(filter.timeGetter().Add(-filter.flushInterval))
+			}
+		}
+	}()
+}
+
+func (filter *ConcatFilter) Stop() {
+	if atomic.CompareAndSwapUintptr(&filter.isShuttingDown, uintptr(0), uintptr(1)) {
+		filter.shutdownChan <- struct{}{}
+	}
+}
+
+func (filter *ConcatFilter) WaitForShutdown() {
+	filter.wg.Wait()
+}
+
+func NewConcatFilter(logger *logging.Logger, name string, key *RecordAccessor, streamKeys []*RecordAccessor, startRegexp *regexp.Regexp, separator string, flushInterval time.Duration, timeGetter func() time.Time, next Port) *ConcatFilter {
+	return &ConcatFilter{
+		logger:         logger,
+		name:           name,
+		key:            key,
+		streamKeys:     streamKeys,
+		startRegexp:    startRegexp,
+		separator:      separator,
+		flushInterval:  flushInterval,
+		timeGetter:     timeGetter,
+		next:           next,
+		mtx:            sync.Mutex{},
+		buffers:        make(map[string]*concatBuffer),
+		isShuttingDown: uintptr(0),
+		shutdownChan:   make(chan struct{}, 1),
+		wg:             sync.WaitGroup{},
+	}
+}
+
+func newConcatFilterFromConfig(logger *logging.Logger, config *ConfigElement, next Port) (Filter, error) {
+	pattern := config.Get("multiline-start-regexp", "")
+	if pattern == "" {
+		return nil, errors.New(fmt.Sprintf("%s: multiline-start-regexp is not specified", config.String()))
+	}
+	startRegexp, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", config.String(), err.Error()))
+	}
+	flushInterval, err := config.GetDuration("flush-interval", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if flushInterval <= 0 {
+		return nil, errors.New(fmt.Sprintf("%s: flush-interval must be positive", config.String()))
+	}
+	key, err := recordAccessorFromConfig(config, "key", "message")
+	if err != nil {
+		return nil, err
+	}
+	streamKeys, err := recordAccessorsFromConfig(config, "stream-identity-key")
+	if err != nil {
+		return nil, err
+	}
+	maxLines, err := config.GetInt("max-lines", 0)
+	if err != nil {
+		return nil, err
+	}
+	maxBytes, err := config.GetInt("max-bytes", 0)
+	if err != nil {
+		return nil, err
+	}
+	if maxLines < 0 || maxBytes < 0 {
+		return nil, errors.New(fmt.Sprintf("%s: max-lines and max-bytes must not be negative", config.String()))
+	}
+	filter := NewConcatFilter(
+		logger,
+		config.Arg,
+		key,
+		streamKeys,
+		startRegexp,
+		config.Get("separator", "\n"),
+		flushInterval,
+		time.Now,
+		next,
+	)
+	filter.SetLimits(maxLines, maxBytes)
+	return filter, nil
+}
+
+func init() {
+	RegisterFilter("concat", newConcatFilterFromConfig)
+	RegisterFilterParams("concat",
+		ParamSchema{Name: "key", Type: ParamString, Description: "variable holding the line", Default: "message"},
+		ParamSchema{Name: "multiline-start-regexp", Type: ParamString, Description: "regular expression matching the first line of a message", Required: true},
+		ParamSchema{Name: "separator", Type: ParamString, Description: "separator of the lines joined", Default: "\n"},
+		ParamSchema{Name: "flush-interval", Type: ParamDuration, Description: "time after which a message no more lines have come to is emitted", Default: "5s"},
+		ParamSchema{Name: "stream-identity-key", Type: ParamList, Description: "variables identifying a stream besides the tag"},
+		ParamSchema{Name: "max-lines", Type: ParamInteger, Description: "number of the lines at which a message is emitted without waiting for the rest; unlimited if 0", Default: "0"},
+		ParamSchema{Name: "max-bytes", Type: ParamInteger, Description: "size in bytes at which a message is emitted without waiting for the rest; unlimited if 0", Default: "0"},
+	)
+}
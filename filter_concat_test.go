@@ -0,0 +1,137 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"regexp"
+	"testing"
+	"time"
+)
+
+type recordingPort struct {
+	recordSets []FluentRecordSet
+}
+
+func (port *recordingPort) Emit(recordSets []FluentRecordSet) error {
+	port.recordSets = append(port.recordSets, CopyRecordSets(recordSets)...)
+	return nil
+}
+
+func Test_ConcatFilter(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("concat")
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	next := &recordingPort{}
+	filter := NewConcatFilter(logger, "test", mustRecordAccessor("message"), mustRecordAccessors("container"), regexp.MustCompile(`^\S`), "\n", 5*time.Second, func() time.Time { return now }, next)
+	line := func(ts uint64, container string, message string) TinyFluentRecord {
+		return TinyFluentRecord{Timestamp: ts, Data: map[string]interface{}{"container": container, "message": []byte(message)}}
+	}
+	result, _ := filter.Filter([]FluentRecordSet{
+		{
+			Tag: "test",
+			Records: []TinyFluentRecord{
+				line(1, "a", "Exception"),
+				line(2, "b", "  orphan"),
+				line(3, "a", "  at foo"),
+				line(4, "b", "Error"),
+				line(5, "a", "  at bar"),
+				line(6, "a", "next"),
+			},
+		},
+	})
+	if len(result) != 1 || len(result[0].Records) != 2 {
+		t.Fatalf("%+v", result)
+	}
+	if string(result[0].Records[0].Data["message"].([]byte)) != "  orphan" {
+		t.Logf("%+v", result[0].Records[0])
+		t.Fail()
+	}
+	if result[0].Records[1].Timestamp != 1 || result[0].Records[1].Data["message"] != "Exception\n  at foo\n  at bar" {
+		t.Logf("%+v", result[0].Records[1])
+		t.Fail()
+	}
+	now = now.Add(3 * time.Second)
+	filter.Filter([]FluentRecordSet{{Tag: "test", Records: []TinyFluentRecord{line(7, "b", "  at baz")}}})
+	now = now.Add(3 * time.Second)
+	filter.flush(now.Add(-5 * time.Second))
+	if len(next.recordSets) != 1 || len(next.recordSets[0].Records) != 1 || next.recordSets[0].Records[0].Data["message"] != "next" {
+		t.Fatalf("%+v", next.recordSets)
+	}
+	filter.flush(time.Time{})
+	if len(next.recordSets) != 2 || next.recordSets[1].Records[0].Data["message"] != "Error\n  at baz" {
+		t.Fatalf("%+v", next.recordSets)
+	}
+}
+
+func Test_ConcatFilter_Limits(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("concat")
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	line := func(ts uint64, message string) TinyFluentRecord {
+		return TinyFluentRecord{Timestamp: ts, Data: map[string]interface{}{"message": message}}
+	}
+	for _, c := range []struct {
+		maxLines int
+		maxBytes int
+	}{
+		{3, 0},
+		// "Exception\n  at 1\n  at 2" is 23 bytes
+		{0, 20},
+	} {
+		next := &recordingPort{}
+		filter := NewConcatFilter(logger, "test", mustRecordAccessor("message"), nil, regexp.MustCompile(`^\S`), "\n", 5*time.Second, func() time.Time { return now }, next)
+		filter.SetLimits(c.maxLines, c.maxBytes)
+		result, _ := filter.Filter([]FluentRecordSet{{
+			Tag: "test",
+			Records: []TinyFluentRecord{
+				line(1, "Exception"),
+				line(2, "  at 1"),
+				line(3, "  at 2"),
+				line(4, "  at 3"),
+				line(5, "  at 4"),
+			},
+		}})
+		if len(result) != 1 || len(result[0].Records) != 1 || result[0].Records[0].Timestamp != 1 || result[0].Records[0].Data["message"] != "Exception\n  at 1\n  at 2" {
+			t.Fatalf("%+v: %+v", c, result)
+		}
+		// the rest of the lines are joined into the next record
+		result, _ = filter.Filter([]FluentRecordSet{{Tag: "test", Records: []TinyFluentRecord{line(6, "next")}}})
+		if len(result) != 1 || len(result[0].Records) != 1 || result[0].Records[0].Timestamp != 4 || result[0].Records[0].Data["message"] != "  at 3\n  at 4" {
+			t.Fatalf("%+v: %+v", c, result)
+		}
+		filter.flush(time.Time{})
+		if len(next.recordSets) != 1 || next.recordSets[0].Records[0].Data["message"] != "next" {
+			t.Errorf("%+v: %+v", c, next.recordSets)
+		}
+	}
+
+	// emitted right after the limits, nothing is left to be flushed
+	next := &recordingPort{}
+	filter := NewConcatFilter(logger, "test", mustRecordAccessor("message"), nil, regexp.MustCompile(`^\S`), "\n", 5*time.Second, func() time.Time { return now }, next)
+	filter.SetLimits(2, 0)
+	result, _ := filter.Filter([]FluentRecordSet{{Tag: "test", Records: []TinyFluentRecord{line(1, "Exception"), line(2, "  at 1")}}})
+	if len(result) != 1 || result[0].Records[0].Data["message"] != "Exception\n  at 1" {
+		t.Fatalf("%+v", result)
+	}
+	filter.flush(time.Time{})
+	if len(next.recordSets) != 0 {
+		t.Errorf("%+v", next.recordSets)
+	}
+}
@@ -0,0 +1,78 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+)
+
+// CopyFilter passes the records through untouched and sends a copy of each
+// of them to a label, so that the label receives the records as well as the
+// rest of the pipeline.
+type CopyFilter struct {
+	logger *logging.Logger
+	name   string
+	label  Port
+}
+
+func (filter *CopyFilter) Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error) {
+	copied := make([]FluentRecordSet, 0, len(recordSets))
+	for _, recordSet := range recordSets {
+		records := make([]TinyFluentRecord, 0, len(recordSet.Records))
+		for _, record := range recordSet.Records {
+			records = append(records, TinyFluentRecord{Timestamp: record.Timestamp, Data: copyValue(record.Data).(map[string]interface{})})
+		}
+		copied = append(copied, FluentRecordSet{Tag: recordSet.Tag, Records: records, Trace: recordSet.Trace})
+	}
+	if len(copied) > 0 {
+		err := filter.label.Emit(copied)
+		if err != nil {
+			filter.logger.Errorf("%s: %s", LogComponent(filter.String()), LogError(err))
+		}
+	}
+	return recordSets, nil
+}
+
+func (filter *CopyFilter) String() string {
+	return "filter:" + filter.name
+}
+
+func NewCopyFilter(logger *logging.Logger, name string, label Port) *CopyFilter {
+	return &CopyFilter{
+		logger: logger,
+		name:   name,
+		label:  label,
+	}
+}
+
+func newCopyFilterFromConfig(logger *logging.Logger, config *ConfigElement, label Port) (Filter, error) {
+	if label == nil {
+		return nil, errors.New(fmt.Sprintf("%s: to-label is not specified", config.String()))
+	}
+	return NewCopyFilter(logger, config.Arg, label), nil
+}
+
+// the pipeline creates the copy filters itself, as they refer to the labels
+func init() {
+	RegisterFilterParams("copy",
+		ParamSchema{Name: "to-label", Type: ParamString, Description: "label a copy of the events is sent to", Required: true},
+	)
+}
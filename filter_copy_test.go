@@ -0,0 +1,68 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"testing"
+)
+
+func Test_CopyFilter(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("copy")
+	label := &recordingPort{}
+	filter := NewCopyFilter(logger, "copy", label)
+	records := []TinyFluentRecord{
+		{Timestamp: 1, Data: map[string]interface{}{"nested": map[string]interface{}{"a": "b"}}},
+		{Timestamp: 2, Data: map[string]interface{}{"n": int64(2)}},
+	}
+	result, err := filter.Filter([]FluentRecordSet{{Tag: "app", Records: records}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(result) != 1 || len(result[0].Records) != 2 {
+		t.Logf("%+v", result)
+		t.Fail()
+	}
+	if len(label.recordSets) != 1 || label.recordSets[0].Tag != "app" || len(label.recordSets[0].Records) != 2 {
+		t.Fatalf("%+v", label.recordSets)
+	}
+	copied := label.recordSets[0].Records
+	if copied[1].Timestamp != 2 || copied[1].Data["n"] != int64(2) {
+		t.Logf("%+v", copied[1])
+		t.Fail()
+	}
+	// the copy is independent of the record passed on
+	copied[0].Data["nested"].(map[string]interface{})["a"] = "c"
+	if records[0].Data["nested"].(map[string]interface{})["a"] != "b" {
+		t.Logf("%+v", records[0].Data)
+		t.Fail()
+	}
+}
+
+func Test_CopyFilter_RequiresLabel(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("copy")
+	config := NewConfigElement("filter", "copy")
+	config.Set("type", "copy")
+	_, err := newCopyFilterFromConfig(logger, config, nil)
+	if err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,231 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"hash"
+	"hash/fnv"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+var dedupDroppedRecords = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_dedup_dropped_records_total", "Number of the records dropped as duplicates.", "filter"))
+
+type dedupEntry struct {
+	key    uint64
+	seenAt time.Time
+}
+
+// DedupFilter drops the records identical to one that has passed within the
+// window.  Only the given keys are compared if any, otherwise the whole
+// record is.  At most maxEntries records are remembered; the oldest ones are
+// forgotten first.
+type DedupFilter struct {
+	logger     *logging.Logger
+	name       string
+	keys       []*RecordAccessor
+	window     time.Duration
+	maxEntries int
+	timeGetter func() time.Time
+	mtx        sync.Mutex
+	entries    map[uint64]*list.Element
+	queue      *list.List // the front is the newest
+	dropped    *Counter
+}
+
+// writeCanonicalValue writes the value to the hash in a form that doesn't
+// depend on the iteration order of the maps.
+func writeCanonicalValue(h hash.Hash64, v interface{}) {
+	buf := [9]byte{}
+	switch v_ := v.(type) {
+	case nil:
+		h.Write([]byte{'n'})
+	case bool:
+		if v_ {
+			h.Write([]byte{'t'})
+		} else {
+			h.Write([]byte{'f'})
+		}
+	case string:
+		buf[0] = 's'
+		binary.BigEndian.PutUint64(buf[1:], uint64(len(v_)))
+		h.Write(buf[:])
+		h.Write([]byte(v_))
+	case []byte:
+		// strings may come as either form depending on the sender
+		buf[0] = 's'
+		binary.BigEndian.PutUint64(buf[1:], uint64(len(v_)))
+		h.Write(buf[:])
+		h.Write(v_)
+	case uint64:
+		buf[0] = 'u'
+		binary.BigEndian.PutUint64(buf[1:], v_)
+		h.Write(buf[:])
+	case int64:
+		buf[0] = 'i'
+		binary.BigEndian.PutUint64(buf[1:], uint64(v_))
+		h.Write(buf[:])
+	case float64:
+		buf[0] = 'd'
+		binary.BigEndian.PutUint64(buf[1:], math.Float64bits(v_))
+		h.Write(buf[:])
+	case []interface{}:
+		buf[0] = 'a'
+		binary.BigEndian.PutUint64(buf[1:], uint64(len(v_)))
+		h.Write(buf[:])
+		for _, e := range v_ {
+			writeCanonicalValue(h, e)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v_))
+		for k := range v_ {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf[0] = 'm'
+		binary.BigEndian.PutUint64(buf[1:], uint64(len(keys)))
+		h.Write(buf[:])
+		for _, k := range keys {
+			writeCanonicalValue(h, k)
+			writeCanonicalValue(h, v_[k])
+		}
+	default:
+		h.Write([]byte(fmt.Sprintf("?%T:%v", v, v)))
+	}
+}
+
+// hashRecord computes the identity of a record from its tag and either the
+// given keys or the whole record.
+func hashRecord(tag string, data map[string]interface{}, keys []*RecordAccessor) uint64 {
+	h := fnv.New64a()
+	writeCanonicalValue(h, tag)
+	if len(keys) == 0 {
+		writeCanonicalValue(h, data)
+	} else {
+		for _, key := range keys {
+			v, _ := key.Get(data)
+			writeCanonicalValue(h, v)
+		}
+	}
+	return h.Sum64()
+}
+
+// expire must be called with the lock held
+func (filter *DedupFilter) expire(now time.Time) {
+	for {
+		elem := filter.queue.Back()
+		if elem == nil {
+			break
+		}
+		entry := elem.Value.(*dedupEntry)
+		if now.Sub(entry.seenAt) < filter.window && filter.queue.Len() <= filter.maxEntries {
+			break
+		}
+		filter.queue.Remove(elem)
+		delete(filter.entries, entry.key)
+	}
+}
+
+func (filter *DedupFilter) isDuplicate(tag string, data map[string]interface{}) bool {
+	key := hashRecord(tag, data, filter.keys)
+	now := filter.timeGetter()
+	filter.mtx.Lock()
+	defer filter.mtx.Unlock()
+	filter.expire(now)
+	if _, exists := filter.entries[key]; exists {
+		return true
+	}
+	filter.entries[key] = filter.queue.PushFront(&dedupEntry{key: key, seenAt: now})
+	filter.expire(now)
+	return false
+}
+
+func (filter *DedupFilter) Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error) {
+	retval := make([]FluentRecordSet, 0, len(recordSets))
+	for _, recordSet := range recordSets {
+		records := make([]TinyFluentRecord, 0, len(recordSet.Records))
+		for _, record := range recordSet.Records {
+			if !filter.isDuplicate(recordSet.Tag, record.Data) {
+				records = append(records, record)
+			}
+		}
+		if len(records) < len(recordSet.Records) {
+			filter.dropped.Add(float64(len(recordSet.Records) - len(records)))
+			filter.logger.Debugf("%s: dropped %d duplicate records with tag %s", LogComponent(filter.String()), len(recordSet.Records)-len(records), LogTag(recordSet.Tag))
+		}
+		if len(records) > 0 {
+			retval = append(retval, FluentRecordSet{Tag: recordSet.Tag, Records: records})
+		}
+	}
+	return retval, nil
+}
+
+func (filter *DedupFilter) String() string {
+	return "filter:" + filter.name
+}
+
+func NewDedupFilter(logger *logging.Logger, name string, keys []*RecordAccessor, window time.Duration, maxEntries int, timeGetter func() time.Time) *DedupFilter {
+	return &DedupFilter{
+		logger:     logger,
+		name:       name,
+		keys:       keys,
+		window:     window,
+		maxEntries: maxEntries,
+		timeGetter: timeGetter,
+		mtx:        sync.Mutex{},
+		entries:    make(map[uint64]*list.Element),
+		queue:      list.New(),
+		dropped:    dedupDroppedRecords.With("filter:" + name),
+	}
+}
+
+func newDedupFilterFromConfig(logger *logging.Logger, config *ConfigElement, next Port) (Filter, error) {
+	window, err := config.GetDuration("window", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	maxEntries, err := config.GetInt("max-entries", 10000)
+	if err != nil {
+		return nil, err
+	}
+	if maxEntries <= 0 {
+		return nil, errors.New(fmt.Sprintf("%s: max-entries must be positive", config.String()))
+	}
+	keys, err := recordAccessorsFromConfig(config, "keys")
+	if err != nil {
+		return nil, err
+	}
+	return NewDedupFilter(logger, config.Arg, keys, window, maxEntries, time.Now), nil
+}
+
+func init() {
+	RegisterFilter("dedup", newDedupFilterFromConfig)
+	RegisterFilterParams("dedup",
+		ParamSchema{Name: "keys", Type: ParamList, Description: "variables compared besides the tag; the whole record if unspecified"},
+		ParamSchema{Name: "window", Type: ParamDuration, Description: "time within which the identical events are dropped", Default: "10s"},
+		ParamSchema{Name: "max-entries", Type: ParamInteger, Description: "number of the events remembered", Default: "10000"},
+	)
+}
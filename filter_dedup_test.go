@@ -0,0 +1,103 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"testing"
+	"time"
+)
+
+func countRecords(recordSets []FluentRecordSet) int {
+	n := 0
+	for _, recordSet := range recordSets {
+		n += len(recordSet.Records)
+	}
+	return n
+}
+
+func Test_DedupFilter(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("dedup")
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	filter := NewDedupFilter(logger, "test", nil, 10*time.Second, 100, func() time.Time { return now })
+	dropped := filter.dropped.Value()
+	recordSets := []FluentRecordSet{
+		{
+			Tag: "test",
+			Records: []TinyFluentRecord{
+				{Timestamp: 1, Data: map[string]interface{}{"message": "a", "n": map[string]interface{}{"x": "1", "y": "2"}}},
+				{Timestamp: 2, Data: map[string]interface{}{"message": "a", "n": map[string]interface{}{"y": "2", "x": "1"}}},
+				{Timestamp: 3, Data: map[string]interface{}{"message": []byte("a"), "n": map[string]interface{}{"x": "1", "y": "2"}}},
+				{Timestamp: 4, Data: map[string]interface{}{"message": "b"}},
+			},
+		},
+		{
+			Tag: "another",
+			Records: []TinyFluentRecord{
+				{Timestamp: 5, Data: map[string]interface{}{"message": "b"}},
+			},
+		},
+	}
+	result, _ := filter.Filter(recordSets)
+	if countRecords(result) != 3 {
+		t.Logf("%+v", result)
+		t.Fail()
+	}
+	now = now.Add(5 * time.Second)
+	result, _ = filter.Filter(recordSets)
+	if countRecords(result) != 0 {
+		t.Logf("%+v", result)
+		t.Fail()
+	}
+	if v := filter.dropped.Value() - dropped; v != 7 {
+		t.Errorf("%g dropped", v)
+	}
+	now = now.Add(5 * time.Second)
+	result, _ = filter.Filter(recordSets)
+	if countRecords(result) != 3 {
+		t.Logf("%+v", result)
+		t.Fail()
+	}
+}
+
+func Test_DedupFilter_Keys(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("dedup")
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	filter := NewDedupFilter(logger, "test", mustRecordAccessors("message"), 10*time.Second, 2, func() time.Time { return now })
+	recordSets := []FluentRecordSet{
+		{
+			Tag: "test",
+			Records: []TinyFluentRecord{
+				{Timestamp: 1, Data: map[string]interface{}{"message": "a", "host": "x"}},
+				{Timestamp: 2, Data: map[string]interface{}{"message": "a", "host": "y"}},
+				{Timestamp: 3, Data: map[string]interface{}{"message": "b"}},
+				{Timestamp: 4, Data: map[string]interface{}{"message": "c"}},
+				// "a" has been evicted as only two entries are kept
+				{Timestamp: 5, Data: map[string]interface{}{"message": "a"}},
+			},
+		},
+	}
+	result, _ := filter.Filter(recordSets)
+	if countRecords(result) != 4 {
+		t.Logf("%+v", result)
+		t.Fail()
+	}
+}
@@ -0,0 +1,210 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The environment variables usually given the fields of the pod by the
+// downward API of Kubernetes.
+var DefaultDownwardAPIEnv = []string{"NODE_NAME", "POD_NAME", "POD_NAMESPACE"}
+
+// parseDownwardAPIFile parses the labels or the annotations of a pod
+// written by the downward API, which are lines of key="value" with the
+// value quoted as in Go.
+func parseDownwardAPIFile(src string) (map[string]interface{}, error) {
+	retval := make(map[string]interface{})
+	for _, line := range strings.Split(src, "\n") {
+		if line == "" {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, errors.New(fmt.Sprintf("malformed line: %s", line))
+		}
+		value, err := strconv.Unquote(line[i+1:])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("malformed value: %s", line))
+		}
+		retval[line[:i]] = value
+	}
+	return retval, nil
+}
+
+// downwardAPIFile is a file of the downward API, which the kubelet updates
+// as the labels or the annotations of the pod change.
+type downwardAPIFile struct {
+	path    string
+	modTime time.Time
+	values  map[string]interface{}
+}
+
+func (file *downwardAPIFile) read() error {
+	info, err := os.Stat(file.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(file.modTime) && file.values != nil {
+		return nil
+	}
+	b, err := ioutil.ReadFile(file.path)
+	if err != nil {
+		return err
+	}
+	values, err := parseDownwardAPIFile(string(b))
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s: %s", file.path, err.Error()))
+	}
+	file.values = values
+	file.modTime = info.ModTime()
+	return nil
+}
+
+// DownwardAPIFilter stores what the downward API of Kubernetes tells of
+// the pod of the forwarder into the records under key: the environment
+// variables given, named in lower case, and the labels and the annotations
+// read from the files of a downwardAPI volume, which are checked for
+// updates every reloadInterval.
+type DownwardAPIFilter struct {
+	logger         *logging.Logger
+	name           string
+	key            *RecordAccessor
+	env            map[string]interface{}
+	files          map[string]*downwardAPIFile
+	reloadInterval time.Duration
+	timeGetter     func() time.Time
+	mtx            sync.Mutex
+	checkedAt      time.Time
+	metadata       map[string]interface{}
+}
+
+// currentMetadata returns the metadata, reloading the files if they have
+// been updated.  The previous contents are kept if a file cannot be read.
+func (filter *DownwardAPIFilter) currentMetadata() map[string]interface{} {
+	filter.mtx.Lock()
+	defer filter.mtx.Unlock()
+	now := filter.timeGetter()
+	if filter.metadata != nil && now.Sub(filter.checkedAt) < filter.reloadInterval {
+		return filter.metadata
+	}
+	filter.checkedAt = now
+	metadata := make(map[string]interface{}, len(filter.env)+len(filter.files))
+	for name, value := range filter.env {
+		metadata[name] = value
+	}
+	for name, file := range filter.files {
+		err := file.read()
+		if err != nil {
+			filter.logger.Errorf("%s: %s", LogComponent(filter.String()), LogError(err))
+		}
+		if file.values != nil {
+			metadata[name] = file.values
+		}
+	}
+	filter.metadata = metadata
+	return metadata
+}
+
+func (filter *DownwardAPIFilter) Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error) {
+	metadata := filter.currentMetadata()
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			filter.key.Set(record.Data, copyValue(metadata))
+		}
+	}
+	return recordSets, nil
+}
+
+func (filter *DownwardAPIFilter) String() string {
+	return "filter:" + filter.name
+}
+
+// NewDownwardAPIFilter creates a filter storing the environment variables
+// of env and the labels and the annotations read from labelsFile and
+// annotationsFile, unless they are empty.
+func NewDownwardAPIFilter(logger *logging.Logger, name string, key *RecordAccessor, env []string, labelsFile string, annotationsFile string, reloadInterval time.Duration, timeGetter func() time.Time) (*DownwardAPIFilter, error) {
+	filter := &DownwardAPIFilter{
+		logger:         logger,
+		name:           name,
+		key:            key,
+		env:            make(map[string]interface{}, len(env)),
+		files:          make(map[string]*downwardAPIFile, 2),
+		reloadInterval: reloadInterval,
+		timeGetter:     timeGetter,
+		mtx:            sync.Mutex{},
+	}
+	for _, name := range env {
+		if value, ok := os.LookupEnv(name); ok {
+			filter.env[strings.ToLower(name)] = value
+		}
+	}
+	for name, path := range map[string]string{"labels": labelsFile, "annotations": annotationsFile} {
+		if path == "" {
+			continue
+		}
+		file := &downwardAPIFile{path: path}
+		err := file.read()
+		if err != nil {
+			return nil, err
+		}
+		filter.files[name] = file
+	}
+	filter.currentMetadata()
+	return filter, nil
+}
+
+func newDownwardAPIFilterFromConfig(logger *logging.Logger, config *ConfigElement, next Port) (Filter, error) {
+	key, err := recordAccessorFromConfig(config, "key", "forwarder")
+	if err != nil {
+		return nil, err
+	}
+	env := DefaultDownwardAPIEnv
+	if config.Has("env") {
+		env = config.GetList("env")
+	}
+	reloadInterval, err := config.GetDuration("reload-interval", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := NewDownwardAPIFilter(logger, config.Arg, key, env, config.Get("labels-file", "/etc/podinfo/labels"), config.Get("annotations-file", ""), reloadInterval, time.Now)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", config.String(), err.Error()))
+	}
+	return filter, nil
+}
+
+func init() {
+	RegisterFilter("downward-api", newDownwardAPIFilterFromConfig)
+	RegisterFilterParams("downward-api",
+		ParamSchema{Name: "key", Type: ParamString, Description: "variable the metadata of the pod is stored in", Default: "forwarder"},
+		ParamSchema{Name: "env", Type: ParamList, Description: "environment variables added, named in lower case", Default: "NODE_NAME, POD_NAME, POD_NAMESPACE"},
+		ParamSchema{Name: "labels-file", Type: ParamString, Description: "file of the labels of the downwardAPI volume; the labels are left out if empty", Default: "/etc/podinfo/labels"},
+		ParamSchema{Name: "annotations-file", Type: ParamString, Description: "file of the annotations of the downwardAPI volume"},
+		ParamSchema{Name: "reload-interval", Type: ParamDuration, Description: "interval in which the files are checked for updates", Default: "1m"},
+	)
+}
@@ -0,0 +1,116 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_parseDownwardAPIFile(t *testing.T) {
+	values, err := parseDownwardAPIFile("app=\"web\"\npod-template-hash=\"5d8f\\\"x\"\n")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(values, map[string]interface{}{"app": "web", "pod-template-hash": "5d8f\"x"}) {
+		t.Logf("%+v", values)
+		t.Fail()
+	}
+	for _, src := range []string{"app", "app=web"} {
+		if _, err := parseDownwardAPIFile(src); err == nil {
+			t.Logf("%s", src)
+			t.Fail()
+		}
+	}
+}
+
+func Test_DownwardAPIFilter(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("downward-api")
+	dir, err := ioutil.TempDir("", "downward-api")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	labelsFile := filepath.Join(dir, "labels")
+	err = ioutil.WriteFile(labelsFile, []byte("app=\"web\"\n"), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	os.Setenv("FLUENTD_FORWARDER_TEST_POD_NAME", "web-1")
+	defer os.Unsetenv("FLUENTD_FORWARDER_TEST_POD_NAME")
+	now := time.Unix(1000, 0)
+	filter, err := NewDownwardAPIFilter(logger, "pod", mustRecordAccessor("pod"), []string{"FLUENTD_FORWARDER_TEST_POD_NAME", "FLUENTD_FORWARDER_TEST_UNSET"}, labelsFile, "", time.Minute, func() time.Time { return now })
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	filterRecord := func() map[string]interface{} {
+		data := map[string]interface{}{"message": "hello"}
+		_, err := filter.Filter([]FluentRecordSet{{Tag: "app", Records: []TinyFluentRecord{{Timestamp: 0, Data: data}}}})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return data
+	}
+	expected := map[string]interface{}{
+		"message": "hello",
+		"pod": map[string]interface{}{
+			"fluentd_forwarder_test_pod_name": "web-1",
+			"labels":                          map[string]interface{}{"app": "web"},
+		},
+	}
+	if data := filterRecord(); !reflect.DeepEqual(data, expected) {
+		t.Logf("%+v", data)
+		t.Fail()
+	}
+
+	// the labels updated are picked up once the reload interval has passed
+	err = ioutil.WriteFile(labelsFile, []byte("app=\"api\"\n"), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	os.Chtimes(labelsFile, time.Unix(2000, 0), time.Unix(2000, 0))
+	if data := filterRecord(); !reflect.DeepEqual(data, expected) {
+		t.Logf("%+v", data)
+		t.Fail()
+	}
+	now = now.Add(time.Minute)
+	expected["pod"].(map[string]interface{})["labels"] = map[string]interface{}{"app": "api"}
+	if data := filterRecord(); !reflect.DeepEqual(data, expected) {
+		t.Logf("%+v", data)
+		t.Fail()
+	}
+
+	// the records do not share the metadata
+	data := filterRecord()
+	data["pod"].(map[string]interface{})["labels"].(map[string]interface{})["app"] = "changed"
+	if data := filterRecord(); !reflect.DeepEqual(data, expected) {
+		t.Logf("%+v", data)
+		t.Fail()
+	}
+
+	if _, err := NewDownwardAPIFilter(logger, "pod", mustRecordAccessor("pod"), nil, filepath.Join(dir, "missing"), "", time.Minute, time.Now); err == nil {
+		t.Fail()
+	}
+}
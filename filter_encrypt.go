@@ -0,0 +1,302 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+const (
+	EncryptionAlgorithmRSA = "RSA-OAEP-256+A256GCM"
+	EncryptionAlgorithmKMS = "KMS+A256GCM"
+)
+
+// DataKeyProvider supplies the key the fields are encrypted with, along with
+// the same key encrypted so that only the final consumer can decrypt it.
+type DataKeyProvider interface {
+	DataKey() (key []byte, encryptedKey []byte, err error)
+	Algorithm() string
+}
+
+// RSADataKeyProvider generates a random data key every rotationInterval and
+// encrypts it with the RSA public key.
+type RSADataKeyProvider struct {
+	publicKey        *rsa.PublicKey
+	rotationInterval time.Duration
+	timeGetter       func() time.Time
+	mtx              sync.Mutex
+	key              []byte
+	encryptedKey     []byte
+	generatedAt      time.Time
+}
+
+func (provider *RSADataKeyProvider) DataKey() ([]byte, []byte, error) {
+	provider.mtx.Lock()
+	defer provider.mtx.Unlock()
+	now := provider.timeGetter()
+	if provider.key != nil && now.Sub(provider.generatedAt) < provider.rotationInterval {
+		return provider.key, provider.encryptedKey, nil
+	}
+	key := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, provider.publicKey, key, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	provider.key = key
+	provider.encryptedKey = encryptedKey
+	provider.generatedAt = now
+	return key, encryptedKey, nil
+}
+
+func (provider *RSADataKeyProvider) Algorithm() string {
+	return EncryptionAlgorithmRSA
+}
+
+func NewRSADataKeyProvider(publicKey *rsa.PublicKey, rotationInterval time.Duration, timeGetter func() time.Time) *RSADataKeyProvider {
+	return &RSADataKeyProvider{
+		publicKey:        publicKey,
+		rotationInterval: rotationInterval,
+		timeGetter:       timeGetter,
+		mtx:              sync.Mutex{},
+		key:              nil,
+		encryptedKey:     nil,
+	}
+}
+
+// StaticDataKeyProvider uses a data key issued by a KMS (e.g. by the
+// GenerateDataKey API of AWS KMS) and the ciphertext of it.
+type StaticDataKeyProvider struct {
+	key          []byte
+	encryptedKey []byte
+}
+
+func (provider *StaticDataKeyProvider) DataKey() ([]byte, []byte, error) {
+	return provider.key, provider.encryptedKey, nil
+}
+
+func (provider *StaticDataKeyProvider) Algorithm() string {
+	return EncryptionAlgorithmKMS
+}
+
+func NewStaticDataKeyProvider(key []byte, encryptedKey []byte) (*StaticDataKeyProvider, error) {
+	if len(key) != 32 {
+		return nil, errors.New(fmt.Sprintf("data key must be 32 bytes long, got %d bytes", len(key)))
+	}
+	return &StaticDataKeyProvider{
+		key:          key,
+		encryptedKey: encryptedKey,
+	}, nil
+}
+
+// EncryptFilter replaces the values of the fields with the base64-encoded
+// nonce followed by the AES-256-GCM ciphertext of their JSON representation,
+// using the field name (the keys joined with dots if nested) as the
+// additional data.  The encrypted data key is
+// attached to the record under keyField.
+type EncryptFilter struct {
+	logger      *logging.Logger
+	name        string
+	fields      []*RecordAccessor
+	keyField    *RecordAccessor
+	keyProvider DataKeyProvider
+}
+
+func encryptField(aead cipher.AEAD, field string, v interface{}) (string, error) {
+	plaintext, err := json.Marshal(toJSONValue(v))
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, []byte(field))), nil
+}
+
+func (filter *EncryptFilter) Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error) {
+	key, encryptedKey, err := filter.keyProvider.DataKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	keyInfo := map[string]interface{}{
+		"algorithm": filter.keyProvider.Algorithm(),
+		"key":       base64.StdEncoding.EncodeToString(encryptedKey),
+	}
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			encrypted := false
+			for _, field := range filter.fields {
+				v, ok := field.Get(record.Data)
+				if !ok {
+					continue
+				}
+				ciphertext, err := encryptField(aead, field.Name(), v)
+				if err != nil {
+					// never let the plaintext through
+					filter.logger.Errorf("%s: failed to encrypt %s: %s", LogComponent(filter.String()), field.String(), LogError(err))
+					field.Delete(record.Data)
+					continue
+				}
+				field.Set(record.Data, ciphertext)
+				encrypted = true
+			}
+			if encrypted {
+				filter.keyField.Set(record.Data, keyInfo)
+			}
+		}
+	}
+	return recordSets, nil
+}
+
+func (filter *EncryptFilter) String() string {
+	return "filter:" + filter.name
+}
+
+func NewEncryptFilter(logger *logging.Logger, name string, fields []*RecordAccessor, keyField *RecordAccessor, keyProvider DataKeyProvider) *EncryptFilter {
+	return &EncryptFilter{
+		logger:      logger,
+		name:        name,
+		fields:      fields,
+		keyField:    keyField,
+		keyProvider: keyProvider,
+	}
+}
+
+func readRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New(fmt.Sprintf("no PEM data found in %s", path))
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%s is not an RSA public key", path))
+	}
+	return rsaPub, nil
+}
+
+// readKeyFile reads a binary key, which may also be given in base64.
+func readKeyFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err == nil {
+		return decoded, nil
+	}
+	return data, nil
+}
+
+func newEncryptFilterFromConfig(logger *logging.Logger, config *ConfigElement, next Port) (Filter, error) {
+	fields, err := recordAccessorsFromConfig(config, "fields")
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, errors.New(fmt.Sprintf("%s: fields is not specified", config.String()))
+	}
+	keyProvider := (DataKeyProvider)(nil)
+	if path := config.Get("public-key", ""); path != "" {
+		publicKey, err := readRSAPublicKey(path)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s", config.String(), err.Error()))
+		}
+		rotationInterval, err := config.GetDuration("key-rotation-interval", time.Hour)
+		if err != nil {
+			return nil, err
+		}
+		keyProvider = NewRSADataKeyProvider(publicKey, rotationInterval, time.Now)
+	} else if path := config.Get("data-key-file", ""); path != "" {
+		key, err := readKeyFile(path)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s", config.String(), err.Error()))
+		}
+		encryptedKeyPath := config.Get("encrypted-data-key-file", "")
+		if encryptedKeyPath == "" {
+			return nil, errors.New(fmt.Sprintf("%s: encrypted-data-key-file is not specified", config.String()))
+		}
+		encryptedKey, err := readKeyFile(encryptedKeyPath)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s", config.String(), err.Error()))
+		}
+		keyProvider, err = NewStaticDataKeyProvider(key, encryptedKey)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s", config.String(), err.Error()))
+		}
+	} else {
+		return nil, errors.New(fmt.Sprintf("%s: either public-key or data-key-file must be specified", config.String()))
+	}
+	keyField, err := recordAccessorFromConfig(config, "key-field", "encryption_key")
+	if err != nil {
+		return nil, err
+	}
+	return NewEncryptFilter(logger, config.Arg, fields, keyField, keyProvider), nil
+}
+
+func init() {
+	RegisterFilter("encrypt", newEncryptFilterFromConfig)
+	RegisterFilterParams("encrypt",
+		ParamSchema{Name: "fields", Type: ParamList, Description: "variables encrypted", Required: true},
+		ParamSchema{Name: "key-field", Type: ParamString, Description: "variable the encrypted data key is stored in", Default: "encryption_key"},
+		ParamSchema{Name: "public-key", Type: ParamString, Description: "file of the PEM-encoded RSA public key the data keys are encrypted with"},
+		ParamSchema{Name: "key-rotation-interval", Type: ParamDuration, Description: "interval in which the data key is generated with public-key", Default: "1h"},
+		ParamSchema{Name: "data-key-file", Type: ParamString, Description: "file of the data key issued by a KMS"},
+		ParamSchema{Name: "encrypted-data-key-file", Type: ParamString, Description: "file of the data key encrypted by the KMS"},
+	)
+}
@@ -0,0 +1,88 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	logging "github.com/op/go-logging"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_EncryptFilter(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("encrypt")
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	provider := NewRSADataKeyProvider(&privateKey.PublicKey, time.Hour, time.Now)
+	filter := NewEncryptFilter(logger, "test", mustRecordAccessors("email", "card"), mustRecordAccessor("encryption_key"), provider)
+	data := map[string]interface{}{
+		"email":   []byte("user@example.com"),
+		"card":    map[string]interface{}{"number": "4111111111111111", "cvv": int64(123)},
+		"message": "hello",
+	}
+	result, _ := filter.Filter([]FluentRecordSet{{Tag: "test", Records: []TinyFluentRecord{{Timestamp: 0, Data: data}}}})
+	data = result[0].Records[0].Data
+	if data["message"] != "hello" {
+		t.Logf("%+v", data)
+		t.Fail()
+	}
+	keyInfo := data["encryption_key"].(map[string]interface{})
+	if keyInfo["algorithm"] != EncryptionAlgorithmRSA {
+		t.Logf("%+v", keyInfo)
+		t.Fail()
+	}
+	encryptedKey, _ := base64.StdEncoding.DecodeString(keyInfo["key"].(string))
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, encryptedKey, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	decrypt := func(field string) interface{} {
+		ciphertext, _ := base64.StdEncoding.DecodeString(data[field].(string))
+		plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], []byte(field))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		v := (interface{})(nil)
+		json.Unmarshal(plaintext, &v)
+		return v
+	}
+	if decrypt("email") != "user@example.com" {
+		t.Fail()
+	}
+	if !reflect.DeepEqual(decrypt("card"), map[string]interface{}{"number": "4111111111111111", "cvv": float64(123)}) {
+		t.Fail()
+	}
+	// the field name is authenticated
+	ciphertext, _ := base64.StdEncoding.DecodeString(data["email"].(string))
+	if _, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], []byte("card")); err == nil {
+		t.Fail()
+	}
+}
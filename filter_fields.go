@@ -0,0 +1,97 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+)
+
+// FieldsFilter removes the fields of the records not in keep, if it is not
+// empty, and then the ones in remove.  The maps containing the nested fields
+// to keep are kept only with those fields.
+type FieldsFilter struct {
+	logger *logging.Logger
+	name   string
+	keep   []*RecordAccessor
+	remove []*RecordAccessor
+}
+
+func (filter *FieldsFilter) Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error) {
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			if len(filter.keep) > 0 {
+				kept := make(map[string]interface{}, len(filter.keep))
+				for _, accessor := range filter.keep {
+					if v, ok := accessor.Get(record.Data); ok {
+						accessor.Set(kept, v)
+					}
+				}
+				for k := range record.Data {
+					if v, ok := kept[k]; ok {
+						record.Data[k] = v
+					} else {
+						delete(record.Data, k)
+					}
+				}
+			}
+			for _, accessor := range filter.remove {
+				accessor.Delete(record.Data)
+			}
+		}
+	}
+	return recordSets, nil
+}
+
+func (filter *FieldsFilter) String() string {
+	return "filter:" + filter.name
+}
+
+func NewFieldsFilter(logger *logging.Logger, name string, keep []*RecordAccessor, remove []*RecordAccessor) *FieldsFilter {
+	return &FieldsFilter{
+		logger: logger,
+		name:   name,
+		keep:   keep,
+		remove: remove,
+	}
+}
+
+func newFieldsFilterFromConfig(logger *logging.Logger, config *ConfigElement, next Port) (Filter, error) {
+	keep, err := recordAccessorsFromConfig(config, "keep")
+	if err != nil {
+		return nil, err
+	}
+	remove, err := recordAccessorsFromConfig(config, "remove")
+	if err != nil {
+		return nil, err
+	}
+	if len(keep) == 0 && len(remove) == 0 {
+		return nil, errors.New(fmt.Sprintf("%s: either keep or remove must be specified", config.String()))
+	}
+	return NewFieldsFilter(logger, config.Arg, keep, remove), nil
+}
+
+func init() {
+	RegisterFilter("fields", newFieldsFilterFromConfig)
+	RegisterFilterParams("fields",
+		ParamSchema{Name: "keep", Type: ParamList, Description: "variables kept"},
+		ParamSchema{Name: "remove", Type: ParamList, Description: "variables removed"},
+	)
+}
@@ -0,0 +1,59 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"reflect"
+	"testing"
+)
+
+func Test_FieldsFilter(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("fields")
+	data := func() map[string]interface{} {
+		return map[string]interface{}{"message": "a", "host": "b", "debug": "c", "trace": "d"}
+	}
+	cases := []struct {
+		keep     []string
+		remove   []string
+		expected map[string]interface{}
+	}{
+		{[]string{"message", "host", "missing"}, nil, map[string]interface{}{"message": "a", "host": "b"}},
+		{nil, []string{"debug", "trace"}, map[string]interface{}{"message": "a", "host": "b"}},
+		{[]string{"message", "host"}, []string{"host"}, map[string]interface{}{"message": "a"}},
+	}
+	for i, c := range cases {
+		filter := NewFieldsFilter(logger, "test", mustRecordAccessors(c.keep...), mustRecordAccessors(c.remove...))
+		result, _ := filter.Filter([]FluentRecordSet{{Tag: "test", Records: []TinyFluentRecord{{Timestamp: 0, Data: data()}}}})
+		if !reflect.DeepEqual(result[0].Records[0].Data, c.expected) {
+			t.Logf("%d: %+v", i, result[0].Records[0].Data)
+			t.Fail()
+		}
+	}
+
+	// only the kept fields of a nested map survive
+	filter := NewFieldsFilter(logger, "test", mustRecordAccessors("$.kubernetes.pod", "message"), mustRecordAccessors("$.kubernetes.labels"))
+	nested := map[string]interface{}{"message": "a", "kubernetes": map[string]interface{}{"pod": "p", "labels": "l", "node": "n"}}
+	filter.Filter([]FluentRecordSet{{Tag: "test", Records: []TinyFluentRecord{{Timestamp: 0, Data: nested}}}})
+	if !reflect.DeepEqual(nested, map[string]interface{}{"message": "a", "kubernetes": map[string]interface{}{"pod": "p"}}) {
+		t.Logf("%+v", nested)
+		t.Fail()
+	}
+}
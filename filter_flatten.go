@@ -0,0 +1,137 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"sort"
+	"strings"
+)
+
+// FlattenFilter either flattens the nested maps of the records into the
+// keys joined by the separator ({"a": {"b": 1}} to {"a.b": 1}) or does the
+// reverse.  At most maxDepth levels are flattened or nested if maxDepth is
+// positive.
+type FlattenFilter struct {
+	logger    *logging.Logger
+	name      string
+	nest      bool
+	separator string
+	maxDepth  int
+}
+
+func (filter *FlattenFilter) flattenInto(dst map[string]interface{}, prefix string, src map[string]interface{}, depth int) {
+	for k, v := range src {
+		m, ok := v.(map[string]interface{})
+		if ok && len(m) > 0 && (filter.maxDepth <= 0 || depth < filter.maxDepth) {
+			filter.flattenInto(dst, prefix+k+filter.separator, m, depth+1)
+		} else {
+			dst[prefix+k] = v
+		}
+	}
+}
+
+func (filter *FlattenFilter) flatten(data map[string]interface{}) map[string]interface{} {
+	retval := make(map[string]interface{}, len(data))
+	filter.flattenInto(retval, "", data, 0)
+	return retval
+}
+
+func (filter *FlattenFilter) nestRecord(data map[string]interface{}) map[string]interface{} {
+	retval := make(map[string]interface{}, len(data))
+	nested := make([]string, 0)
+	for k, v := range data {
+		if strings.Contains(k, filter.separator) {
+			nested = append(nested, k)
+		} else {
+			retval[k] = v
+		}
+	}
+	// process the keys in a fixed order so conflicts resolve the same way
+	sort.Strings(nested)
+	for _, k := range nested {
+		n := -1
+		if filter.maxDepth > 0 {
+			n = filter.maxDepth + 1
+		}
+		if !setPath(retval, strings.SplitN(k, filter.separator, n), data[k]) {
+			// a value on the way is not a map; leave it flat
+			retval[k] = data[k]
+		}
+	}
+	return retval
+}
+
+func (filter *FlattenFilter) Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error) {
+	for _, recordSet := range recordSets {
+		for i, record := range recordSet.Records {
+			if filter.nest {
+				recordSet.Records[i].Data = filter.nestRecord(record.Data)
+			} else {
+				recordSet.Records[i].Data = filter.flatten(record.Data)
+			}
+		}
+	}
+	return recordSets, nil
+}
+
+func (filter *FlattenFilter) String() string {
+	return "filter:" + filter.name
+}
+
+func NewFlattenFilter(logger *logging.Logger, name string, nest bool, separator string, maxDepth int) *FlattenFilter {
+	return &FlattenFilter{
+		logger:    logger,
+		name:      name,
+		nest:      nest,
+		separator: separator,
+		maxDepth:  maxDepth,
+	}
+}
+
+func newFlattenFilterFromConfig(logger *logging.Logger, config *ConfigElement, next Port) (Filter, error) {
+	nest := false
+	switch mode := config.Get("mode", "flatten"); mode {
+	case "flatten":
+	case "nest":
+		nest = true
+	default:
+		return nil, errors.New(fmt.Sprintf("%s: mode must be either flatten or nest: %s", config.String(), mode))
+	}
+	separator := config.Get("separator", ".")
+	if separator == "" {
+		return nil, errors.New(fmt.Sprintf("%s: separator must not be empty", config.String()))
+	}
+	maxDepth, err := config.GetInt("max-depth", 0)
+	if err != nil {
+		return nil, err
+	}
+	return NewFlattenFilter(logger, config.Arg, nest, separator, maxDepth), nil
+}
+
+func init() {
+	RegisterFilter("flatten", newFlattenFilterFromConfig)
+	RegisterFilterParams("flatten",
+		ParamSchema{Name: "mode", Type: ParamString, Description: "whether the nested maps are flattened or the variables nested", Default: "flatten", Enum: []string{"flatten", "nest"}},
+		ParamSchema{Name: "separator", Type: ParamString, Description: "separator of the keys", Default: "."},
+		ParamSchema{Name: "max-depth", Type: ParamInteger, Description: "number of the levels flattened or nested; unlimited if 0", Default: "0"},
+	)
+}
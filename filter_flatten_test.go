@@ -0,0 +1,59 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"reflect"
+	"testing"
+)
+
+func Test_FlattenFilter(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("flatten")
+	nested := func() map[string]interface{} {
+		return map[string]interface{}{
+			"a": map[string]interface{}{
+				"b": map[string]interface{}{"c": int64(1)},
+				"d": "x",
+			},
+			"e": []interface{}{"y"},
+		}
+	}
+	cases := []struct {
+		nest     bool
+		maxDepth int
+		input    map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{false, 0, nested(), map[string]interface{}{"a.b.c": int64(1), "a.d": "x", "e": []interface{}{"y"}}},
+		{false, 1, nested(), map[string]interface{}{"a.b": map[string]interface{}{"c": int64(1)}, "a.d": "x", "e": []interface{}{"y"}}},
+		{true, 0, map[string]interface{}{"a.b.c": int64(1), "a.d": "x", "e": []interface{}{"y"}}, nested()},
+		{true, 1, map[string]interface{}{"a.b.c": int64(1), "a.d": "x"}, map[string]interface{}{"a": map[string]interface{}{"b.c": int64(1), "d": "x"}}},
+		{true, 0, map[string]interface{}{"a": "x", "a.b": "y"}, map[string]interface{}{"a": "x", "a.b": "y"}},
+	}
+	for i, c := range cases {
+		filter := NewFlattenFilter(logger, "test", c.nest, ".", c.maxDepth)
+		result, _ := filter.Filter([]FluentRecordSet{{Tag: "test", Records: []TinyFluentRecord{{Timestamp: 0, Data: c.input}}}})
+		if !reflect.DeepEqual(result[0].Records[0].Data, c.expected) {
+			t.Logf("%d: %+v", i, result[0].Records[0].Data)
+			t.Fail()
+		}
+	}
+}
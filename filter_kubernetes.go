@@ -0,0 +1,629 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The number of the pods fetched at once on demand; the pods of the records
+// seen while as many are being fetched are fetched on a later record.
+const kubernetesMaxFetches = 4
+
+// The interval in which the expired pods are forgotten, or cacheTTL if
+// shorter.
+const kubernetesExpireInterval = time.Minute
+
+// The tag given to the container logs by in_tail in the usual Kubernetes
+// setup, e.g. kube.var.log.containers.web-1_default_app-<container id>.log
+const DefaultKubernetesTagRegexp = `(?:^|\.)containers\.(?P<pod_name>[a-z0-9](?:[-a-z0-9]*[a-z0-9])?(?:\.[a-z0-9](?:[-a-z0-9]*[a-z0-9])?)*)_(?P<namespace>[^_.]+)_(?P<container_name>.+)-(?P<container_id>[a-z0-9]{64})\.log$`
+
+type kubernetesContainerStatus struct {
+	Name        string `json:"name"`
+	ContainerID string `json:"containerID"`
+}
+
+type kubernetesPod struct {
+	Metadata struct {
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace"`
+		UID             string            `json:"uid"`
+		Labels          map[string]string `json:"labels"`
+		Annotations     map[string]string `json:"annotations"`
+		ResourceVersion string            `json:"resourceVersion"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+	Status struct {
+		ContainerStatuses     []kubernetesContainerStatus `json:"containerStatuses"`
+		InitContainerStatuses []kubernetesContainerStatus `json:"initContainerStatuses"`
+	} `json:"status"`
+}
+
+type kubernetesPodList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []kubernetesPod `json:"items"`
+}
+
+type kubernetesWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type kubernetesPodEntry struct {
+	pod *kubernetesPod
+	// the entry is forgotten after expiresAt unless it is zero, which means
+	// the pod is kept up to date by the watch
+	expiresAt time.Time
+}
+
+// KubernetesMetadataFilter adds the metadata of the pod that produced each
+// record, which is identified by the tag (see DefaultKubernetesTagRegexp) or
+// by the container ID or the pod UID in the record.  The pods are cached and
+// kept up to date by watching the API server; the ones not covered by the
+// watch are fetched in the background on the first record, which passes on
+// without the metadata until the pod is fetched, and cached for cacheTTL,
+// as are the pods that could not be fetched.
+type KubernetesMetadataFilter struct {
+	logger             *logging.Logger
+	name               string
+	apiURL             string
+	bearerTokenFile    string
+	client             *http.Client
+	watchClient        *http.Client
+	nodeName           string
+	tagRegexp          *regexp.Regexp
+	containerIDKey     *RecordAccessor
+	podUIDKey          *RecordAccessor
+	key                *RecordAccessor
+	includeLabels      bool
+	includeAnnotations bool
+	cacheTTL           time.Duration
+	retryInterval      time.Duration
+	timeGetter         func() time.Time
+	mtx                sync.Mutex
+	byName             map[string]*kubernetesPodEntry
+	byUID              map[string]*kubernetesPodEntry
+	byContainerID      map[string]*kubernetesPodEntry
+	misses             map[string]time.Time
+	fetching           map[string]bool
+	fetches            chan struct{}
+	ctx                context.Context
+	cancel             context.CancelFunc
+	wg                 sync.WaitGroup
+}
+
+// trimContainerID strips the runtime prefix such as docker://
+func trimContainerID(id string) string {
+	if i := strings.Index(id, "://"); i >= 0 {
+		return id[i+3:]
+	}
+	return id
+}
+
+func (filter *KubernetesMetadataFilter) newRequest(ctx context.Context, path string, query url.Values) (*http.Request, error) {
+	u := filter.apiURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if filter.bearerTokenFile != "" {
+		// read every time as the token is rotated
+		token, err := ioutil.ReadFile(filter.bearerTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	return req, nil
+}
+
+func (filter *KubernetesMetadataFilter) get(ctx context.Context, client *http.Client, path string, query url.Values) (*http.Response, error) {
+	req, err := filter.newRequest(ctx, path, query)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return resp, errors.New(fmt.Sprintf("GET %s: %s", path, resp.Status))
+	}
+	return resp, nil
+}
+
+func (filter *KubernetesMetadataFilter) podQuery() url.Values {
+	query := url.Values{}
+	if filter.nodeName != "" {
+		query.Set("fieldSelector", "spec.nodeName="+filter.nodeName)
+	}
+	return query
+}
+
+// store must be called with the lock held
+func (filter *KubernetesMetadataFilter) store(pod *kubernetesPod, expiresAt time.Time) {
+	entry := &kubernetesPodEntry{pod: pod, expiresAt: expiresAt}
+	name := pod.Metadata.Namespace + "/" + pod.Metadata.Name
+	filter.byName[name] = entry
+	delete(filter.misses, name)
+	if pod.Metadata.UID != "" {
+		filter.byUID[pod.Metadata.UID] = entry
+	}
+	for _, statuses := range [][]kubernetesContainerStatus{pod.Status.ContainerStatuses, pod.Status.InitContainerStatuses} {
+		for _, status := range statuses {
+			if status.ContainerID != "" {
+				filter.byContainerID[trimContainerID(status.ContainerID)] = entry
+			}
+		}
+	}
+}
+
+// expire must be called with the lock held
+func (filter *KubernetesMetadataFilter) expire(now time.Time) {
+	for _, m := range []map[string]*kubernetesPodEntry{filter.byName, filter.byUID, filter.byContainerID} {
+		for k, entry := range m {
+			if !entry.expiresAt.IsZero() && now.After(entry.expiresAt) {
+				delete(m, k)
+			}
+		}
+	}
+	for k, expiresAt := range filter.misses {
+		if now.After(expiresAt) {
+			delete(filter.misses, k)
+		}
+	}
+}
+
+func (filter *KubernetesMetadataFilter) list(ctx context.Context) (string, error) {
+	resp, err := filter.get(ctx, filter.client, "/api/v1/pods", filter.podQuery())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	podList := kubernetesPodList{}
+	err = json.NewDecoder(resp.Body).Decode(&podList)
+	if err != nil {
+		return "", err
+	}
+	filter.mtx.Lock()
+	defer filter.mtx.Unlock()
+	// the pods that have gone while not watching are kept for a while for
+	// their last logs
+	expiresAt := filter.timeGetter().Add(filter.cacheTTL)
+	for _, m := range []map[string]*kubernetesPodEntry{filter.byName, filter.byUID, filter.byContainerID} {
+		for _, entry := range m {
+			if entry.expiresAt.IsZero() {
+				entry.expiresAt = expiresAt
+			}
+		}
+	}
+	for i := range podList.Items {
+		filter.store(&podList.Items[i], time.Time{})
+	}
+	filter.logger.Infof("%s: listed %d pods", LogComponent(filter.String()), len(podList.Items))
+	return podList.Metadata.ResourceVersion, nil
+}
+
+func (filter *KubernetesMetadataFilter) watch(ctx context.Context, resourceVersion string) error {
+	query := filter.podQuery()
+	query.Set("watch", "true")
+	query.Set("resourceVersion", resourceVersion)
+	resp, err := filter.get(ctx, filter.watchClient, "/api/v1/pods", query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		event := kubernetesWatchEvent{}
+		err := decoder.Decode(&event)
+		if err != nil {
+			return err
+		}
+		if event.Type == "ERROR" {
+			return errors.New(fmt.Sprintf("watch error: %s", string(event.Object)))
+		}
+		pod := &kubernetesPod{}
+		err = json.Unmarshal(event.Object, pod)
+		if err != nil {
+			return err
+		}
+		filter.mtx.Lock()
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			filter.store(pod, time.Time{})
+		case "DELETED":
+			filter.store(pod, filter.timeGetter().Add(filter.cacheTTL))
+		}
+		filter.mtx.Unlock()
+	}
+}
+
+func (filter *KubernetesMetadataFilter) fetch(namespace string, name string) {
+	pod := &kubernetesPod{}
+	resp, err := filter.get(filter.ctx, filter.client, "/api/v1/namespaces/"+url.PathEscape(namespace)+"/pods/"+url.PathEscape(name), nil)
+	if err == nil {
+		err = json.NewDecoder(resp.Body).Decode(pod)
+		resp.Body.Close()
+	}
+	filter.mtx.Lock()
+	defer filter.mtx.Unlock()
+	if filter.ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		filter.logger.Debugf("%s: %s", LogComponent(filter.String()), LogError(err))
+		filter.misses[namespace+"/"+name] = filter.timeGetter().Add(filter.cacheTTL)
+		return
+	}
+	filter.store(pod, filter.timeGetter().Add(filter.cacheTTL))
+}
+
+// queueFetch fetches the pod in the background unless it is being fetched
+// or has failed to be within cacheTTL, and the filter has not been stopped.
+// It must be called with the lock held.
+func (filter *KubernetesMetadataFilter) queueFetch(namespace string, name string) {
+	key := namespace + "/" + name
+	if filter.fetching[key] || filter.ctx.Err() != nil {
+		return
+	}
+	if expiresAt, ok := filter.misses[key]; ok {
+		if !filter.timeGetter().After(expiresAt) {
+			return
+		}
+		delete(filter.misses, key)
+	}
+	select {
+	case filter.fetches <- struct{}{}:
+	default:
+		return
+	}
+	filter.fetching[key] = true
+	filter.wg.Add(1)
+	go func() {
+		defer filter.wg.Done()
+		filter.fetch(namespace, name)
+		filter.mtx.Lock()
+		delete(filter.fetching, key)
+		filter.mtx.Unlock()
+		<-filter.fetches
+	}()
+}
+
+// lookup finds the pod of the record along with the container name and ID
+// if they are known.
+func (filter *KubernetesMetadataFilter) lookup(tag string, data map[string]interface{}) (*kubernetesPod, string, string) {
+	namespace, podName, containerName, containerID := "", "", "", ""
+	if filter.tagRegexp != nil {
+		if m := filter.tagRegexp.FindStringSubmatch(tag); m != nil {
+			for i, group := range filter.tagRegexp.SubexpNames() {
+				switch group {
+				case "namespace":
+					namespace = m[i]
+				case "pod_name":
+					podName = m[i]
+				case "container_name":
+					containerName = m[i]
+				case "container_id":
+					containerID = m[i]
+				}
+			}
+		}
+	}
+	if v, ok := filter.containerIDKey.Get(data); ok && containerID == "" {
+		containerID = trimContainerID(groupValueString(v))
+	}
+	podUID := ""
+	if v, ok := filter.podUIDKey.Get(data); ok {
+		podUID = groupValueString(v)
+	}
+	filter.mtx.Lock()
+	entry := (*kubernetesPodEntry)(nil)
+	if containerID != "" {
+		entry = filter.byContainerID[containerID]
+	}
+	if entry == nil && podUID != "" {
+		entry = filter.byUID[podUID]
+	}
+	if entry == nil && podName != "" {
+		entry = filter.byName[namespace+"/"+podName]
+		if entry == nil {
+			filter.queueFetch(namespace, podName)
+		}
+	}
+	filter.mtx.Unlock()
+	if entry == nil {
+		return nil, containerName, containerID
+	}
+	if containerName == "" && containerID != "" {
+		for _, status := range entry.pod.Status.ContainerStatuses {
+			if trimContainerID(status.ContainerID) == containerID {
+				containerName = status.Name
+			}
+		}
+	}
+	return entry.pod, containerName, containerID
+}
+
+func (filter *KubernetesMetadataFilter) metadata(pod *kubernetesPod, containerName string, containerID string) map[string]interface{} {
+	retval := map[string]interface{}{
+		"namespace_name": pod.Metadata.Namespace,
+		"pod_name":       pod.Metadata.Name,
+		"pod_id":         pod.Metadata.UID,
+		"host":           pod.Spec.NodeName,
+	}
+	if containerName != "" {
+		retval["container_name"] = containerName
+	}
+	if containerID != "" {
+		retval["container_id"] = containerID
+	}
+	// copied for every record as the later filters may modify them
+	if filter.includeLabels && len(pod.Metadata.Labels) > 0 {
+		labels := make(map[string]interface{}, len(pod.Metadata.Labels))
+		for k, v := range pod.Metadata.Labels {
+			labels[k] = v
+		}
+		retval["labels"] = labels
+	}
+	if filter.includeAnnotations && len(pod.Metadata.Annotations) > 0 {
+		annotations := make(map[string]interface{}, len(pod.Metadata.Annotations))
+		for k, v := range pod.Metadata.Annotations {
+			annotations[k] = v
+		}
+		retval["annotations"] = annotations
+	}
+	return retval
+}
+
+func (filter *KubernetesMetadataFilter) Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error) {
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			pod, containerName, containerID := filter.lookup(recordSet.Tag, record.Data)
+			if pod == nil {
+				continue
+			}
+			filter.key.Set(record.Data, filter.metadata(pod, containerName, containerID))
+		}
+	}
+	return recordSets, nil
+}
+
+func (filter *KubernetesMetadataFilter) String() string {
+	return "filter:" + filter.name
+}
+
+func (filter *KubernetesMetadataFilter) Start() {
+	ctx := filter.ctx
+	filter.wg.Add(2)
+	go func() {
+		defer filter.wg.Done()
+		interval := kubernetesExpireInterval
+		if filter.cacheTTL > 0 && filter.cacheTTL < interval {
+			interval = filter.cacheTTL
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				filter.mtx.Lock()
+				filter.expire(filter.timeGetter())
+				filter.mtx.Unlock()
+			}
+		}
+	}()
+	go func() {
+		defer filter.wg.Done()
+		for {
+			resourceVersion, err := filter.list(ctx)
+			if err == nil {
+				err = filter.watch(ctx, resourceVersion)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				filter.logger.Errorf("%s: %s", LogComponent(filter.String()), LogError(err))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(filter.retryInterval):
+			}
+		}
+	}()
+}
+
+func (filter *KubernetesMetadataFilter) Stop() {
+	// no fetch is queued after the lock is released
+	filter.mtx.Lock()
+	defer filter.mtx.Unlock()
+	filter.cancel()
+}
+
+func (filter *KubernetesMetadataFilter) WaitForShutdown() {
+	filter.wg.Wait()
+}
+
+func NewKubernetesMetadataFilter(logger *logging.Logger, name string, apiURL string, bearerTokenFile string, tlsConfig *tls.Config, nodeName string, tagRegexp *regexp.Regexp, containerIDKey *RecordAccessor, podUIDKey *RecordAccessor, key *RecordAccessor, includeLabels bool, includeAnnotations bool, cacheTTL time.Duration, retryInterval time.Duration) *KubernetesMetadataFilter {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &KubernetesMetadataFilter{
+		logger:             logger,
+		name:               name,
+		apiURL:             strings.TrimSuffix(apiURL, "/"),
+		bearerTokenFile:    bearerTokenFile,
+		client:             &http.Client{Transport: transport, Timeout: 10 * time.Second},
+		watchClient:        &http.Client{Transport: transport},
+		nodeName:           nodeName,
+		tagRegexp:          tagRegexp,
+		containerIDKey:     containerIDKey,
+		podUIDKey:          podUIDKey,
+		key:                key,
+		includeLabels:      includeLabels,
+		includeAnnotations: includeAnnotations,
+		cacheTTL:           cacheTTL,
+		retryInterval:      retryInterval,
+		timeGetter:         time.Now,
+		mtx:                sync.Mutex{},
+		byName:             make(map[string]*kubernetesPodEntry),
+		byUID:              make(map[string]*kubernetesPodEntry),
+		byContainerID:      make(map[string]*kubernetesPodEntry),
+		misses:             make(map[string]time.Time),
+		fetching:           make(map[string]bool),
+		fetches:            make(chan struct{}, kubernetesMaxFetches),
+		ctx:                ctx,
+		cancel:             cancel,
+		wg:                 sync.WaitGroup{},
+	}
+}
+
+func newKubernetesMetadataFilterFromConfig(logger *logging.Logger, config *ConfigElement, next Port) (Filter, error) {
+	defaultURL := ""
+	if host := os.Getenv("KUBERNETES_SERVICE_HOST"); host != "" {
+		defaultURL = "https://" + net.JoinHostPort(host, os.Getenv("KUBERNETES_SERVICE_PORT"))
+	}
+	apiURL := config.Get("kubernetes-url", defaultURL)
+	if apiURL == "" {
+		return nil, errors.New(fmt.Sprintf("%s: kubernetes-url is not specified and not running in a cluster", config.String()))
+	}
+	insecureSkipVerify, err := config.GetBool("insecure-skip-verify", false)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	caFile := config.Get("ca-file", "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt")
+	if pem, err := ioutil.ReadFile(caFile); err == nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New(fmt.Sprintf("%s: no certificates found in %s", config.String(), caFile))
+		}
+		tlsConfig.RootCAs = pool
+	} else if config.Has("ca-file") {
+		return nil, errors.New(fmt.Sprintf("%s: %s", config.String(), err.Error()))
+	}
+	bearerTokenFile := config.Get("bearer-token-file", "/var/run/secrets/kubernetes.io/serviceaccount/token")
+	if _, err := os.Stat(bearerTokenFile); err != nil {
+		if config.Has("bearer-token-file") {
+			return nil, errors.New(fmt.Sprintf("%s: %s", config.String(), err.Error()))
+		}
+		bearerTokenFile = ""
+	}
+	tagRegexp, err := regexp.Compile(config.Get("tag-regexp", DefaultKubernetesTagRegexp))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", config.String(), err.Error()))
+	}
+	includeLabels, err := config.GetBool("include-labels", true)
+	if err != nil {
+		return nil, err
+	}
+	includeAnnotations, err := config.GetBool("include-annotations", true)
+	if err != nil {
+		return nil, err
+	}
+	cacheTTL, err := config.GetDuration("cache-ttl", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	retryInterval, err := config.GetDuration("retry-interval", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	containerIDKey, err := recordAccessorFromConfig(config, "container-id-key", "container_id")
+	if err != nil {
+		return nil, err
+	}
+	podUIDKey, err := recordAccessorFromConfig(config, "pod-uid-key", "pod_uid")
+	if err != nil {
+		return nil, err
+	}
+	key, err := recordAccessorFromConfig(config, "key", "kubernetes")
+	if err != nil {
+		return nil, err
+	}
+	return NewKubernetesMetadataFilter(
+		logger,
+		config.Arg,
+		apiURL,
+		bearerTokenFile,
+		tlsConfig,
+		config.Get("node-name", os.Getenv("NODE_NAME")),
+		tagRegexp,
+		containerIDKey,
+		podUIDKey,
+		key,
+		includeLabels,
+		includeAnnotations,
+		cacheTTL,
+		retryInterval,
+	), nil
+}
+
+func init() {
+	RegisterFilter("kubernetes-metadata", newKubernetesMetadataFilterFromConfig)
+	RegisterFilterParams("kubernetes-metadata",
+		ParamSchema{Name: "key", Type: ParamString, Description: "variable the metadata of the pod is stored in", Default: "kubernetes"},
+		ParamSchema{Name: "tag-regexp", Type: ParamString, Description: "regular expression extracting pod_name, namespace, container_name and container_id from the tag"},
+		ParamSchema{Name: "container-id-key", Type: ParamString, Description: "variable holding the container ID", Default: "container_id"},
+		ParamSchema{Name: "pod-uid-key", Type: ParamString, Description: "variable holding the UID of the pod", Default: "pod_uid"},
+		ParamSchema{Name: "node-name", Type: ParamString, Description: "node whose pods are watched; $NODE_NAME if unspecified, all the nodes if empty"},
+		ParamSchema{Name: "include-labels", Type: ParamBoolean, Description: "whether the labels are added", Default: "true"},
+		ParamSchema{Name: "include-annotations", Type: ParamBoolean, Description: "whether the annotations are added", Default: "true"},
+		ParamSchema{Name: "cache-ttl", Type: ParamDuration, Description: "time for which the pods are cached", Default: "1h"},
+		ParamSchema{Name: "retry-interval", Type: ParamDuration, Description: "interval in which a failed watch is retried", Default: "5s"},
+		ParamSchema{Name: "kubernetes-url", Type: ParamString, Description: "URL of the API server; the one of the cluster if unspecified"},
+		ParamSchema{Name: "bearer-token-file", Type: ParamString, Description: "file holding the bearer token", Default: "/var/run/secrets/kubernetes.io/serviceaccount/token"},
+		ParamSchema{Name: "ca-file", Type: ParamString, Description: "file holding the CA certificate of the API server", Default: "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"},
+		ParamSchema{Name: "insecure-skip-verify", Type: ParamBoolean, Description: "whether the certificate of the API server is left unverified", Default: "false"},
+	)
+}
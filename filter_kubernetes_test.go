@@ -0,0 +1,254 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"context"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testContainerID = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func testPodJSON(namespace, name, uid, containerID string) string {
+	return fmt.Sprintf(`{"metadata":{"name":%q,"namespace":%q,"uid":%q,"labels":{"app":"web"},"annotations":{"note":"x"}},"spec":{"nodeName":"node-1"},"status":{"containerStatuses":[{"name":"app","containerID":"docker://%s"}]}}`, name, namespace, uid, containerID)
+}
+
+// waitForKubernetesFetches waits until the pods being fetched in the
+// background are fetched.
+func waitForKubernetesFetches(t *testing.T, filter *KubernetesMetadataFilter) {
+	for i := 0; i < 500; i += 1 {
+		filter.mtx.Lock()
+		n := len(filter.fetching)
+		filter.mtx.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("the pods are not fetched")
+}
+
+func Test_KubernetesMetadataFilter(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("kubernetes")
+	fetched := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/pods":
+			if r.URL.Query().Get("fieldSelector") != "spec.nodeName=node-1" {
+				t.Logf("%s", r.URL.String())
+				t.Fail()
+			}
+			fmt.Fprintf(w, `{"metadata":{"resourceVersion":"10"},"items":[%s]}`, testPodJSON("default", "web-1", "uid-1", testContainerID))
+		case "/api/v1/namespaces/other/pods/batch-1":
+			fetched += 1
+			fmt.Fprint(w, testPodJSON("other", "batch-1", "uid-2", strings.Repeat("f", 64)))
+		default:
+			fetched += 1
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	filter := NewKubernetesMetadataFilter(logger, "test", server.URL, "", nil, "node-1", regexp.MustCompile(DefaultKubernetesTagRegexp), mustRecordAccessor("container_id"), mustRecordAccessor("pod_uid"), mustRecordAccessor("kubernetes"), true, false, time.Hour, time.Second)
+	_, err := filter.list(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	recordSets := []FluentRecordSet{
+		{
+			Tag: "kube.var.log.containers.web-1_default_app-" + testContainerID + ".log",
+			Records: []TinyFluentRecord{
+				{Timestamp: 0, Data: map[string]interface{}{"log": "a"}},
+			},
+		},
+		{
+			Tag: "app",
+			Records: []TinyFluentRecord{
+				{Timestamp: 0, Data: map[string]interface{}{"pod_uid": []byte("uid-1")}},
+				{Timestamp: 0, Data: map[string]interface{}{"container_id": "containerd://" + testContainerID}},
+				{Timestamp: 0, Data: map[string]interface{}{"pod_uid": "unknown"}},
+			},
+		},
+		{
+			Tag: "kube.var.log.containers.batch-1_other_job-" + strings.Repeat("f", 64) + ".log",
+			Records: []TinyFluentRecord{
+				{Timestamp: 0, Data: map[string]interface{}{"log": "b"}},
+				{Timestamp: 0, Data: map[string]interface{}{"log": "c"}},
+			},
+		},
+		{
+			Tag: "kube.var.log.containers.gone-1_other_job-" + strings.Repeat("e", 64) + ".log",
+			Records: []TinyFluentRecord{
+				{Timestamp: 0, Data: map[string]interface{}{"log": "d"}},
+				{Timestamp: 0, Data: map[string]interface{}{"log": "e"}},
+			},
+		},
+	}
+	result, _ := filter.Filter(recordSets)
+	// the pods not listed pass on without the metadata until fetched
+	for _, recordSet := range result[2:] {
+		for _, record := range recordSet.Records {
+			if _, ok := record.Data["kubernetes"]; ok {
+				t.Logf("%+v", record.Data)
+				t.Fail()
+			}
+		}
+	}
+	waitForKubernetesFetches(t, filter)
+	rest, _ := filter.Filter(recordSets[2:])
+	result = append(result[0:2], rest...)
+	for _, record := range append(result[0].Records, result[1].Records[0:2]...) {
+		metadata, ok := record.Data["kubernetes"].(map[string]interface{})
+		if !ok || metadata["pod_name"] != "web-1" || metadata["namespace_name"] != "default" || metadata["host"] != "node-1" || metadata["labels"].(map[string]interface{})["app"] != "web" {
+			t.Logf("%+v", record.Data)
+			t.Fail()
+			continue
+		}
+		if _, ok := metadata["annotations"]; ok {
+			t.Logf("%+v", metadata)
+			t.Fail()
+		}
+	}
+	if metadata := result[0].Records[0].Data["kubernetes"].(map[string]interface{}); metadata["container_name"] != "app" || metadata["container_id"] != testContainerID {
+		t.Logf("%+v", metadata)
+		t.Fail()
+	}
+	if _, ok := result[1].Records[2].Data["kubernetes"]; ok {
+		t.Logf("%+v", result[1].Records[2].Data)
+		t.Fail()
+	}
+	for _, record := range result[2].Records {
+		if metadata, ok := record.Data["kubernetes"].(map[string]interface{}); !ok || metadata["pod_name"] != "batch-1" || metadata["container_name"] != "job" {
+			t.Logf("%+v", record.Data)
+			t.Fail()
+		}
+	}
+	for _, record := range result[3].Records {
+		if _, ok := record.Data["kubernetes"]; ok {
+			t.Logf("%+v", record.Data)
+			t.Fail()
+		}
+	}
+	// one for batch-1 and one for gone-1, thanks to the cache
+	if fetched != 2 {
+		t.Logf("%d", fetched)
+		t.Fail()
+	}
+}
+
+func Test_KubernetesMetadataFilter_MissTTL(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("kubernetes")
+	fetched := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched += 1
+		if fetched < 2 {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, testPodJSON("other", "batch-1", "uid-2", strings.Repeat("f", 64)))
+	}))
+	defer server.Close()
+	filter := NewKubernetesMetadataFilter(logger, "test", server.URL, "", nil, "node-1", regexp.MustCompile(DefaultKubernetesTagRegexp), mustRecordAccessor("container_id"), mustRecordAccessor("pod_uid"), mustRecordAccessor("kubernetes"), true, false, time.Minute, time.Second)
+	start := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	filter.timeGetter = func() time.Time { return now }
+	tag := "kube.var.log.containers.batch-1_other_job-" + strings.Repeat("f", 64) + ".log"
+	filterRecord := func() map[string]interface{} {
+		data := map[string]interface{}{"log": "a"}
+		filter.Filter([]FluentRecordSet{{Tag: tag, Records: []TinyFluentRecord{{Timestamp: 0, Data: data}}}})
+		waitForKubernetesFetches(t, filter)
+		return data
+	}
+	// missed, and not tried again within the TTL
+	for _, elapsed := range []time.Duration{0, 30 * time.Second, time.Minute} {
+		now = start.Add(elapsed)
+		if data := filterRecord(); data["kubernetes"] != nil || fetched != 1 {
+			t.Errorf("%s: %d: %+v", elapsed, fetched, data)
+		}
+	}
+	// fetched again once the TTL has passed, and found on the next record
+	now = start.Add(time.Minute + time.Second)
+	filterRecord()
+	if data := filterRecord(); data["kubernetes"] == nil || fetched != 2 {
+		t.Errorf("%d: %+v", fetched, data)
+	}
+	filter.mtx.Lock()
+	filter.expire(now.Add(2 * time.Minute))
+	if len(filter.misses) != 0 || len(filter.byName) != 0 {
+		t.Errorf("%+v %+v", filter.misses, filter.byName)
+	}
+	filter.mtx.Unlock()
+}
+
+func Test_KubernetesMetadataFilter_Stop(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("kubernetes")
+	started := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the fetch hangs until it is cancelled
+		started <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	filter := NewKubernetesMetadataFilter(logger, "test", server.URL, "", nil, "node-1", regexp.MustCompile(DefaultKubernetesTagRegexp), mustRecordAccessor("container_id"), mustRecordAccessor("pod_uid"), mustRecordAccessor("kubernetes"), true, false, time.Hour, time.Second)
+	recordSets := []FluentRecordSet{
+		{
+			Tag: "kube.var.log.containers.batch-1_other_job-" + strings.Repeat("f", 64) + ".log",
+			Records: []TinyFluentRecord{
+				{Timestamp: 0, Data: map[string]interface{}{"log": "a"}},
+			},
+		},
+	}
+	filter.Filter(recordSets)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the pod is not fetched")
+	}
+	filter.Stop()
+	done := make(chan struct{})
+	go func() {
+		filter.WaitForShutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the fetch is not cancelled")
+	}
+	filter.mtx.Lock()
+	defer filter.mtx.Unlock()
+	// the cancelled fetch is not taken as a miss
+	if len(filter.fetching) != 0 || len(filter.misses) != 0 {
+		t.Errorf("%+v %+v", filter.fetching, filter.misses)
+	}
+	// and no fetch is queued after stopping
+	filter.queueFetch("other", "batch-2")
+	if len(filter.fetching) != 0 || len(started) != 0 {
+		t.Errorf("%+v", filter.fetching)
+	}
+}
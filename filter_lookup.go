@@ -0,0 +1,404 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LookupTable maps the keys to the fields to be added to the records.
+type LookupTable map[string]map[string]interface{}
+
+// LookupSource loads a lookup table.  Load returns a nil table if the table
+// has not changed since the last time.
+type LookupSource interface {
+	String() string
+	Load() (LookupTable, error)
+}
+
+// ParseLookupTable reads a table in either format:
+//
+// csv: the first row names the columns; the column named keyColumn, or the
+// first one if it is empty, holds the keys.
+//
+// json: either an object of the keys to the objects of the fields, or an
+// array of objects each of which has the key in the field named keyColumn.
+func ParseLookupTable(data []byte, format string, keyColumn string) (LookupTable, error) {
+	table := make(LookupTable)
+	switch format {
+	case "csv":
+		reader := csv.NewReader(bytes.NewReader(data))
+		header, err := reader.Read()
+		if err != nil {
+			return nil, err
+		}
+		keyIndex := 0
+		if keyColumn != "" {
+			keyIndex = -1
+			for i, column := range header {
+				if column == keyColumn {
+					keyIndex = i
+				}
+			}
+			if keyIndex < 0 {
+				return nil, errors.New(fmt.Sprintf("no such column: %s", keyColumn))
+			}
+		}
+		for {
+			row, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			fields := make(map[string]interface{}, len(header)-1)
+			for i, column := range header {
+				if i != keyIndex {
+					fields[column] = row[i]
+				}
+			}
+			table[row[keyIndex]] = fields
+		}
+	case "json":
+		var v interface{}
+		err := json.Unmarshal(data, &v)
+		if err != nil {
+			return nil, err
+		}
+		switch v_ := v.(type) {
+		case map[string]interface{}:
+			for key, entry := range v_ {
+				fields, ok := entry.(map[string]interface{})
+				if !ok {
+					return nil, errors.New(fmt.Sprintf("the entry of %s is not an object", key))
+				}
+				table[key] = fields
+			}
+		case []interface{}:
+			if keyColumn == "" {
+				return nil, errors.New("the key field is not specified for an array")
+			}
+			for i, entry := range v_ {
+				fields, ok := entry.(map[string]interface{})
+				if !ok {
+					return nil, errors.New(fmt.Sprintf("entry #%d is not an object", i))
+				}
+				key, ok := fields[keyColumn]
+				if !ok {
+					return nil, errors.New(fmt.Sprintf("entry #%d has no %s", i, keyColumn))
+				}
+				delete(fields, keyColumn)
+				table[groupValueString(key)] = fields
+			}
+		default:
+			return nil, errors.New("neither an object nor an array")
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported format: %s", format))
+	}
+	return table, nil
+}
+
+// FileLookupSource reads the table from a file, which is read again only
+// when it is modified.
+type FileLookupSource struct {
+	path      string
+	format    string
+	keyColumn string
+	modTime   time.Time
+}
+
+func (source *FileLookupSource) String() string {
+	return source.path
+}
+
+func (source *FileLookupSource) Load() (LookupTable, error) {
+	info, err := os.Stat(source.path)
+	if err != nil {
+		return nil, err
+	}
+	if info.ModTime().Equal(source.modTime) {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(source.path)
+	if err != nil {
+		return nil, err
+	}
+	table, err := ParseLookupTable(data, source.format, source.keyColumn)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", source.path, err.Error()))
+	}
+	source.modTime = info.ModTime()
+	return table, nil
+}
+
+func NewFileLookupSource(path string, format string, keyColumn string) *FileLookupSource {
+	return &FileLookupSource{
+		path:      path,
+		format:    format,
+		keyColumn: keyColumn,
+	}
+}
+
+// HTTPLookupSource fetches the table from a URL, which is fetched again
+// only when the ETag changes.
+type HTTPLookupSource struct {
+	url       string
+	format    string
+	keyColumn string
+	client    *http.Client
+	etag      string
+}
+
+func (source *HTTPLookupSource) String() string {
+	return source.url
+}
+
+func (source *HTTPLookupSource) Load() (LookupTable, error) {
+	req, err := http.NewRequest("GET", source.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if source.etag != "" {
+		req.Header.Set("If-None-Match", source.etag)
+	}
+	resp, err := source.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("GET %s: %s", source.url, resp.Status))
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	table, err := ParseLookupTable(data, source.format, source.keyColumn)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", source.url, err.Error()))
+	}
+	source.etag = resp.Header.Get("ETag")
+	return table, nil
+}
+
+func NewHTTPLookupSource(url string, format string, keyColumn string, timeout time.Duration) *HTTPLookupSource {
+	return &HTTPLookupSource{
+		url:       url,
+		format:    format,
+		keyColumn: keyColumn,
+		client:    &http.Client{Timeout: timeout},
+	}
+}
+
+// LookupFilter adds the fields of the entry of the lookup table that the
+// value of key refers to, e.g. the team owning an instance ID.  The fields
+// are added to the record itself, or to the map at outKey unless it is nil.
+// The table is loaded again every refreshInterval; the current one stays if
+// that fails.
+type LookupFilter struct {
+	logger          *logging.Logger
+	name            string
+	key             *RecordAccessor
+	outKey          *RecordAccessor
+	source          LookupSource
+	refreshInterval time.Duration
+	table           atomic.Value
+	isShuttingDown  uintptr
+	shutdownChan    chan struct{}
+	wg              sync.WaitGroup
+}
+
+func (filter *LookupFilter) Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error) {
+	table := filter.table.Load().(LookupTable)
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			v, ok := filter.key.Get(record.Data)
+			if !ok {
+				continue
+			}
+			fields, ok := table[groupValueString(v)]
+			if !ok {
+				continue
+			}
+			// copied for every record as the later filters may modify them
+			if filter.outKey != nil {
+				filter.outKey.Set(record.Data, copyValue(fields))
+				continue
+			}
+			for k, v := range fields {
+				record.Data[k] = copyValue(v)
+			}
+		}
+	}
+	return recordSets, nil
+}
+
+func (filter *LookupFilter) refresh() error {
+	table, err := filter.source.Load()
+	if err != nil {
+		return err
+	}
+	if table != nil {
+		filter.table.Store(table)
+		filter.logger.Infof("%s: loaded %d entries from %s", LogComponent(filter.String()), len(table), filter.source.String())
+	}
+	return nil
+}
+
+func (filter *LookupFilter) String() string {
+	return "filter:" + filter.name
+}
+
+func (filter *LookupFilter) Start() {
+	filter.wg.Add(1)
+	go func() {
+		defer filter.wg.Done()
+		ticker := time.NewTicker(filter.refreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-filter.shutdownChan:
+				return
+			case <-ticker.C:
+				err := filter.refresh()
+				if err != nil {
+					filter.logger.Errorf("%s: failed to refresh the table: %s", LogComponent(filter.String()), LogError(err))
+				}
+			}
+		}
+	}()
+}
+
+func (filter *LookupFilter) Stop() {
+	if atomic.CompareAndSwapUintptr(&filter.isShuttingDown, uintptr(0), uintptr(1)) {
+		filter.shutdownChan <- struct{}{}
+	}
+}
+
+func (filter *LookupFilter) WaitForShutdown() {
+	filter.wg.Wait()
+}
+
+// NewLookupFilter creates a filter and loads the table from the source for
+// the first time.
+func NewLookupFilter(logger *logging.Logger, name string, key *RecordAccessor, outKey *RecordAccessor, source LookupSource, refreshInterval time.Duration) (*LookupFilter, error) {
+	filter := &LookupFilter{
+		logger:          logger,
+		name:            name,
+		key:             key,
+		outKey:          outKey,
+		source:          source,
+		refreshInterval: refreshInterval,
+		table:           atomic.Value{},
+		isShuttingDown:  uintptr(0),
+		shutdownChan:    make(chan struct{}, 1),
+		wg:              sync.WaitGroup{},
+	}
+	filter.table.Store(make(LookupTable))
+	err := filter.refresh()
+	if err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+func newLookupFilterFromConfig(logger *logging.Logger, config *ConfigElement, next Port) (Filter, error) {
+	if !config.Has("key") {
+		return nil, errors.New(fmt.Sprintf("%s: key is not specified", config.String()))
+	}
+	key, err := recordAccessorFromConfig(config, "key", "")
+	if err != nil {
+		return nil, err
+	}
+	outKey := (*RecordAccessor)(nil)
+	if config.Has("out-key") {
+		outKey, err = recordAccessorFromConfig(config, "out-key", "")
+		if err != nil {
+			return nil, err
+		}
+	}
+	path := config.Get("path", "")
+	url := config.Get("url", "")
+	if (path == "") == (url == "") {
+		return nil, errors.New(fmt.Sprintf("%s: either path or url must be specified", config.String()))
+	}
+	format := config.Get("format", "")
+	if format == "" {
+		format = strings.TrimPrefix(filepath.Ext(path+url), ".")
+	}
+	if format != "csv" && format != "json" {
+		return nil, errors.New(fmt.Sprintf("%s: format must be either csv or json: %s", config.String(), format))
+	}
+	keyColumn := config.Get("lookup-key", "")
+	refreshInterval, err := config.GetDuration("refresh-interval", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	if refreshInterval <= 0 {
+		return nil, errors.New(fmt.Sprintf("%s: refresh-interval must be positive", config.String()))
+	}
+	source := (LookupSource)(nil)
+	if path != "" {
+		source = NewFileLookupSource(path, format, keyColumn)
+	} else {
+		timeout, err := config.GetDuration("timeout", 10*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		source = NewHTTPLookupSource(url, format, keyColumn, timeout)
+	}
+	filter, err := NewLookupFilter(logger, config.Arg, key, outKey, source, refreshInterval)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", config.String(), err.Error()))
+	}
+	return filter, nil
+}
+
+func init() {
+	RegisterFilter("lookup", newLookupFilterFromConfig)
+	RegisterFilterParams("lookup",
+		ParamSchema{Name: "key", Type: ParamString, Description: "variable holding the key looked up", Required: true},
+		ParamSchema{Name: "path", Type: ParamString, Description: "file of the table"},
+		ParamSchema{Name: "url", Type: ParamString, Description: "URL the table is fetched from"},
+		ParamSchema{Name: "format", Type: ParamString, Description: "format of the table; told by the extension if unspecified", Enum: []string{"csv", "json"}},
+		ParamSchema{Name: "lookup-key", Type: ParamString, Description: "column or field holding the keys"},
+		ParamSchema{Name: "out-key", Type: ParamString, Description: "variable the fields are stored in; the record itself if unspecified"},
+		ParamSchema{Name: "refresh-interval", Type: ParamDuration, Description: "interval in which the table is loaded again", Default: "5m"},
+		ParamSchema{Name: "timeout", Type: ParamDuration, Description: "timeout of fetching the URL", Default: "10s"},
+	)
+}
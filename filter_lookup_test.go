@@ -0,0 +1,143 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_ParseLookupTable(t *testing.T) {
+	cases := []struct {
+		data      string
+		format    string
+		keyColumn string
+	}{
+		{"instance_id,team,owner\ni-1,web,alice\ni-2,db,bob\n", "csv", ""},
+		{"team,instance_id,owner\nweb,i-1,alice\ndb,i-2,bob\n", "csv", "instance_id"},
+		{`{"i-1":{"team":"web","owner":"alice"},"i-2":{"team":"db","owner":"bob"}}`, "json", ""},
+		{`[{"id":"i-1","team":"web","owner":"alice"},{"id":"i-2","team":"db","owner":"bob"}]`, "json", "id"},
+	}
+	for _, c := range cases {
+		table, err := ParseLookupTable([]byte(c.data), c.format, c.keyColumn)
+		if err != nil {
+			t.Logf("%s: %s", c.data, err.Error())
+			t.Fail()
+			continue
+		}
+		if len(table) != 2 || len(table["i-1"]) != 2 || table["i-1"]["team"] != "web" || table["i-2"]["owner"] != "bob" {
+			t.Logf("%s: %+v", c.data, table)
+			t.Fail()
+		}
+	}
+	for _, c := range []struct{ data, format, keyColumn string }{
+		{"a,b\n1,2\n", "csv", "c"},
+		{`[{"id":"i-1"}]`, "json", ""},
+		{`{"i-1":"web"}`, "json", ""},
+		{`"x"`, "json", ""},
+	} {
+		if _, err := ParseLookupTable([]byte(c.data), c.format, c.keyColumn); err == nil {
+			t.Logf("%s", c.data)
+			t.Fail()
+		}
+	}
+}
+
+func Test_LookupFilter_File(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("lookup")
+	dir, err := ioutil.TempDir("", "lookup")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "teams.csv")
+	ioutil.WriteFile(path, []byte("instance_id,team\ni-1,web\n"), 0644)
+	filter, err := NewLookupFilter(logger, "test", mustRecordAccessor("instance_id"), nil, NewFileLookupSource(path, "csv", ""), time.Minute)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	records := func() []FluentRecordSet {
+		return []FluentRecordSet{{Tag: "test", Records: []TinyFluentRecord{
+			{Timestamp: 0, Data: map[string]interface{}{"instance_id": []byte("i-1")}},
+			{Timestamp: 0, Data: map[string]interface{}{"instance_id": "i-9"}},
+		}}}
+	}
+	result, _ := filter.Filter(records())
+	if result[0].Records[0].Data["team"] != "web" {
+		t.Logf("%+v", result)
+		t.Fail()
+	}
+	if _, ok := result[0].Records[1].Data["team"]; ok {
+		t.Fail()
+	}
+
+	// reloaded when modified, while an unreadable table is ignored
+	ioutil.WriteFile(path, []byte("instance_id,team\ni-1,api\n"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	if err := filter.refresh(); err != nil {
+		t.Fatal(err.Error())
+	}
+	os.Remove(path)
+	if err := filter.refresh(); err == nil {
+		t.Fail()
+	}
+	result, _ = filter.Filter(records())
+	if result[0].Records[0].Data["team"] != "api" {
+		t.Logf("%+v", result)
+		t.Fail()
+	}
+}
+
+func Test_LookupFilter_HTTP(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("lookup")
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests += 1
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"i-1":{"team":"web","tags":["a"]}}`))
+	}))
+	defer server.Close()
+	filter, err := NewLookupFilter(logger, "test", mustRecordAccessor("instance_id"), mustRecordAccessor("$.owner.info"), NewHTTPLookupSource(server.URL, "json", "", time.Second), time.Minute)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := filter.refresh(); err != nil || requests != 2 {
+		t.Fail()
+	}
+	result, _ := filter.Filter([]FluentRecordSet{{Tag: "test", Records: []TinyFluentRecord{
+		{Timestamp: 0, Data: map[string]interface{}{"instance_id": "i-1"}},
+	}}})
+	v, _ := mustRecordAccessor("$.owner.info.team").Get(result[0].Records[0].Data)
+	if v != "web" {
+		t.Logf("%+v", result)
+		t.Fail()
+	}
+}
@@ -0,0 +1,351 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MetricCounter   = "counter"
+	MetricHistogram = "histogram"
+)
+
+var DefaultHistogramBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricSeries holds the values for a combination of the labels, both in
+// total and as of the last emission.
+type metricSeries struct {
+	labels      map[string]interface{}
+	value       float64 // the sum of the increments of a counter
+	count       uint64
+	sum         float64
+	buckets     []uint64 // the number of the values up to each bound
+	lastValue   float64
+	lastCount   uint64
+	lastSum     float64
+	lastBuckets []uint64
+	counter     *Counter
+	histogram   *Histogram
+}
+
+// MetricsFilter derives a counter or a histogram from the records passing
+// through it, which it leaves untouched.  A counter is incremented by the
+// value of valueKey, or by one if it is nil; a histogram observes the value
+// of valueKey.  The series are distinguished by the values of the labels,
+// and the changes in each of them are emitted as a record every interval.
+// The metric is also exposed through the registry unless it is nil.
+type MetricsFilter struct {
+	logger         *logging.Logger
+	name           string
+	metricName     string
+	kind           string
+	labels         []*RecordAccessor
+	valueKey       *RecordAccessor
+	buckets        []float64
+	tag            string
+	interval       time.Duration
+	next           Port
+	counterVec     *CounterVec
+	histogramVec   *HistogramVec
+	mtx            sync.Mutex
+	series         map[string]*metricSeries
+	order          []string
+	isShuttingDown uintptr
+	shutdownChan   chan struct{}
+	wg             sync.WaitGroup
+}
+
+func (filter *MetricsFilter) observe(data map[string]interface{}) {
+	value := 1.0
+	if filter.valueKey != nil {
+		v, _ := filter.valueKey.Get(data)
+		f, ok := toFloat64(v)
+		if !ok {
+			return
+		}
+		value = f
+	}
+	parts := make([]string, 0, len(filter.labels))
+	for _, label := range filter.labels {
+		v, _ := label.Get(data)
+		parts = append(parts, groupValueString(v))
+	}
+	key := strings.Join(parts, "\x00")
+	series, ok := filter.series[key]
+	if !ok {
+		labels := make(map[string]interface{}, len(filter.labels))
+		for i, label := range filter.labels {
+			labels[label.Name()] = parts[i]
+		}
+		series = &metricSeries{
+			labels:      labels,
+			buckets:     make([]uint64, len(filter.buckets)),
+			lastBuckets: make([]uint64, len(filter.buckets)),
+		}
+		if filter.counterVec != nil {
+			series.counter = filter.counterVec.With(parts...)
+		}
+		if filter.histogramVec != nil {
+			series.histogram = filter.histogramVec.With(parts...)
+		}
+		filter.series[key] = series
+		filter.order = append(filter.order, key)
+	}
+	if filter.kind == MetricCounter {
+		series.value += value
+		if series.counter != nil {
+			series.counter.Add(value)
+		}
+		return
+	}
+	if series.histogram != nil {
+		series.histogram.Observe(value)
+	}
+	series.count += 1
+	series.sum += value
+	for i, bound := range filter.buckets {
+		if value <= bound {
+			series.buckets[i] += 1
+		}
+	}
+}
+
+func (filter *MetricsFilter) Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error) {
+	filter.mtx.Lock()
+	defer filter.mtx.Unlock()
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			filter.observe(record.Data)
+		}
+	}
+	return recordSets, nil
+}
+
+func formatBucketBound(bound float64) string {
+	if math.IsInf(bound, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(bound, 'g', -1, 64)
+}
+
+// collect returns the records for the series that have changed since the
+// last time.  It must be called with the lock held.
+func (filter *MetricsFilter) collect(now time.Time) []FluentRecordSet {
+	retval := make([]FluentRecordSet, 0)
+	for _, key := range filter.order {
+		series := filter.series[key]
+		data := map[string]interface{}{
+			"name":   filter.metricName,
+			"labels": series.labels,
+		}
+		if filter.kind == MetricCounter {
+			if series.value == series.lastValue {
+				continue
+			}
+			data["value"] = series.value - series.lastValue
+			series.lastValue = series.value
+		} else {
+			if series.count == series.lastCount {
+				continue
+			}
+			buckets := make(map[string]interface{}, len(filter.buckets)+1)
+			for i, bound := range filter.buckets {
+				buckets[formatBucketBound(bound)] = series.buckets[i] - series.lastBuckets[i]
+				series.lastBuckets[i] = series.buckets[i]
+			}
+			buckets["+Inf"] = series.count - series.lastCount
+			data["count"] = series.count - series.lastCount
+			data["sum"] = series.sum - series.lastSum
+			data["buckets"] = buckets
+			series.lastCount = series.count
+			series.lastSum = series.sum
+		}
+		retval = appendRecord(retval, filter.tag, TinyFluentRecord{Timestamp: uint64(now.Unix()), Data: data})
+	}
+	return retval
+}
+
+func (filter *MetricsFilter) flush() {
+	filter.mtx.Lock()
+	recordSets := filter.collect(time.Now())
+	filter.mtx.Unlock()
+	if len(recordSets) == 0 {
+		return
+	}
+	err := filter.next.Emit(recordSets)
+	if err != nil {
+		filter.logger.Errorf("%s: failed to emit the metrics: %s", LogComponent(filter.String()), LogError(err))
+	}
+}
+
+func (filter *MetricsFilter) String() string {
+	return "filter:" + filter.name
+}
+
+func (filter *MetricsFilter) Start() {
+	filter.wg.Add(1)
+	go func() {
+		defer filter.wg.Done()
+		ticker := time.NewTicker(filter.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-filter.shutdownChan:
+				filter.flush()
+				return
+			case <-ticker.C:
+				filter.flush()
+			}
+		}
+	}()
+}
+
+func (filter *MetricsFilter) Stop() {
+	if atomic.CompareAndSwapUintptr(&filter.isShuttingDown, uintptr(0), uintptr(1)) {
+		filter.shutdownChan <- struct{}{}
+	}
+}
+
+func (filter *MetricsFilter) WaitForShutdown() {
+	filter.wg.Wait()
+}
+
+func NewMetricsFilter(logger *logging.Logger, name string, metricName string, kind string, labels []*RecordAccessor, valueKey *RecordAccessor, buckets []float64, tag string, interval time.Duration, registry *MetricsRegistry, next Port) (*MetricsFilter, error) {
+	filter := &MetricsFilter{
+		logger:         logger,
+		name:           name,
+		metricName:     metricName,
+		kind:           kind,
+		labels:         labels,
+		valueKey:       valueKey,
+		buckets:        buckets,
+		tag:            tag,
+		interval:       interval,
+		next:           next,
+		mtx:            sync.Mutex{},
+		series:         make(map[string]*metricSeries),
+		order:          make([]string, 0),
+		isShuttingDown: uintptr(0),
+		shutdownChan:   make(chan struct{}, 1),
+		wg:             sync.WaitGroup{},
+	}
+	if registry == nil {
+		return filter, nil
+	}
+	labelNames := make([]string, 0, len(labels))
+	for _, label := range labels {
+		labelNames = append(labelNames, SanitizeMetricLabelName(label.Name()))
+	}
+	help := fmt.Sprintf("Derived by %s.", filter.String())
+	err := (error)(nil)
+	if kind == MetricCounter {
+		filter.counterVec, err = registry.NewCounterVec(metricName, help, labelNames...)
+	} else {
+		filter.histogramVec, err = registry.NewHistogramVec(metricName, help, buckets, labelNames...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+func newMetricsFilterFromConfig(logger *logging.Logger, config *ConfigElement, next Port) (Filter, error) {
+	metricName := config.Get("metric", config.Arg)
+	if metricName == "" {
+		return nil, errors.New(fmt.Sprintf("%s: metric is not specified", config.String()))
+	}
+	kind := config.Get("kind", MetricCounter)
+	valueKey := (*RecordAccessor)(nil)
+	if config.Has("value-key") {
+		accessor, err := recordAccessorFromConfig(config, "value-key", "")
+		if err != nil {
+			return nil, err
+		}
+		valueKey = accessor
+	}
+	buckets := make([]float64, 0)
+	switch kind {
+	case MetricCounter:
+	case MetricHistogram:
+		if valueKey == nil {
+			return nil, errors.New(fmt.Sprintf("%s: value-key is required for a histogram", config.String()))
+		}
+		for _, item := range config.GetList("buckets") {
+			bound, err := strconv.ParseFloat(item, 64)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("%s: invalid bucket: %s", config.String(), item))
+			}
+			buckets = append(buckets, bound)
+		}
+		if len(buckets) == 0 {
+			buckets = append(buckets, DefaultHistogramBuckets...)
+		}
+		sort.Float64s(buckets)
+	default:
+		return nil, errors.New(fmt.Sprintf("%s: kind must be either counter or histogram: %s", config.String(), kind))
+	}
+	labels, err := recordAccessorsFromConfig(config, "labels")
+	if err != nil {
+		return nil, err
+	}
+	interval, err := config.GetDuration("interval", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		return nil, errors.New(fmt.Sprintf("%s: interval must be positive", config.String()))
+	}
+	expose, err := config.GetBool("expose", true)
+	if err != nil {
+		return nil, err
+	}
+	registry := (*MetricsRegistry)(nil)
+	if expose {
+		registry = DefaultMetrics
+	}
+	filter, err := NewMetricsFilter(logger, config.Arg, metricName, kind, labels, valueKey, buckets, config.Get("tag", "metrics"), interval, registry, next)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", config.String(), err.Error()))
+	}
+	return filter, nil
+}
+
+func init() {
+	RegisterFilter("metrics", newMetricsFilterFromConfig)
+	RegisterFilterParams("metrics",
+		ParamSchema{Name: "metric", Type: ParamString, Description: "name of the metric; the name of the section if unspecified"},
+		ParamSchema{Name: "kind", Type: ParamString, Description: "kind of the metric", Default: "counter", Enum: []string{"counter", "histogram"}},
+		ParamSchema{Name: "value-key", Type: ParamString, Description: "variable holding the value; one if unspecified for a counter"},
+		ParamSchema{Name: "labels", Type: ParamList, Description: "variables by whose values the series are distinguished"},
+		ParamSchema{Name: "buckets", Type: ParamList, Description: "upper bounds of the buckets of a histogram", Default: "0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10"},
+		ParamSchema{Name: "interval", Type: ParamDuration, Description: "interval in which the changes are emitted", Default: "1m"},
+		ParamSchema{Name: "tag", Type: ParamString, Description: "tag of the events emitted", Default: "metrics"},
+		ParamSchema{Name: "expose", Type: ParamBoolean, Description: "whether the metric is served at /metrics", Default: "true"},
+	)
+}
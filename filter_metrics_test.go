@@ -0,0 +1,76 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"testing"
+	"time"
+)
+
+func Test_MetricsFilter(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("metrics")
+	record := func(service string, latency float64) TinyFluentRecord {
+		return TinyFluentRecord{Timestamp: 0, Data: map[string]interface{}{"service": []byte(service), "latency": latency}}
+	}
+	input := []FluentRecordSet{{Tag: "access", Records: []TinyFluentRecord{
+		record("web", 0.05), record("api", 0.3), record("web", 2), record("web", 0.01),
+	}}}
+
+	registry := NewMetricsRegistry()
+	counter, err := NewMetricsFilter(logger, "c", "requests", MetricCounter, mustRecordAccessors("service"), nil, nil, "metrics", time.Minute, registry, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	result, _ := counter.Filter(input)
+	if len(result[0].Records) != 4 {
+		t.Fail()
+	}
+	collected := counter.collect(time.Unix(60, 0))
+	if len(collected) != 1 || len(collected[0].Records) != 2 {
+		t.Fatalf("%+v", collected)
+	}
+	web := collected[0].Records[0].Data
+	if web["value"] != 3.0 || web["labels"].(map[string]interface{})["service"] != "web" || web["name"] != "requests" {
+		t.Logf("%+v", web)
+		t.Fail()
+	}
+	// only the changes are emitted
+	counter.Filter([]FluentRecordSet{{Tag: "access", Records: []TinyFluentRecord{record("api", 1)}}})
+	collected = counter.collect(time.Unix(120, 0))
+	if len(collected[0].Records) != 1 || collected[0].Records[0].Data["value"] != 1.0 {
+		t.Logf("%+v", collected)
+		t.Fail()
+	}
+
+	if v := registry.families["requests"].metrics["web"].value(); v != 3.0 {
+		t.Logf("%v", v)
+		t.Fail()
+	}
+
+	histogram, _ := NewMetricsFilter(logger, "h", "latency", MetricHistogram, nil, mustRecordAccessor("latency"), []float64{0.1, 1}, "metrics", time.Minute, nil, nil)
+	histogram.Filter(input)
+	data := histogram.collect(time.Unix(60, 0))[0].Records[0].Data
+	buckets := data["buckets"].(map[string]interface{})
+	if data["count"] != uint64(4) || buckets["0.1"] != uint64(2) || buckets["1"] != uint64(3) || buckets["+Inf"] != uint64(4) {
+		t.Logf("%+v", data)
+		t.Fail()
+	}
+}
@@ -0,0 +1,212 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"regexp"
+	"strings"
+)
+
+type KeyRename struct {
+	From string
+	To   string
+}
+
+type KeyRegexpRename struct {
+	Regexp      *regexp.Regexp
+	Replacement string
+}
+
+type KeyMove struct {
+	From *RecordAccessor
+	To   *RecordAccessor
+}
+
+// RenameFilter renames the top-level keys of the records, first the exact
+// ones, then the ones matching the regexps (the replacement may refer to the
+// submatches as in regexp.ReplaceAllString), and finally moves the values
+// between nested locations.  The dots a replacement writes separate the
+// keys of a nested location, so that "^kubernetes_" replaced with "k8s."
+// moves kubernetes_pod_name to pod_name in k8s, while the dots of the key
+// renamed are kept in the keys.
+type RenameFilter struct {
+	logger  *logging.Logger
+	name    string
+	renames []KeyRename
+	regexps []KeyRegexpRename
+	moves   []KeyMove
+}
+
+// renamePath applies the regexps in turn to the key, and returns the path
+// it is renamed to, in which the dots of the key are escaped and the ones
+// written by the replacements are not.
+func (filter *RenameFilter) renamePath(key string) string {
+	path := escapePathKey(key)
+	for _, rename := range filter.regexps {
+		name, starts := unescapePath(path)
+		matches := rename.Regexp.FindAllStringSubmatchIndex(name, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		renamed := make([]byte, 0, len(path))
+		last := 0
+		for _, match := range matches {
+			// the submatches are expanded from the path, escaped
+			submatches := make([]int, len(match))
+			for i, pos := range match {
+				submatches[i] = pos
+				if pos >= 0 {
+					submatches[i] = starts[pos]
+				}
+			}
+			renamed = append(renamed, path[starts[last]:starts[match[0]]]...)
+			renamed = rename.Regexp.ExpandString(renamed, rename.Replacement, path, submatches)
+			last = match[1]
+		}
+		path = string(append(renamed, path[starts[last]:]...))
+	}
+	return path
+}
+
+func (filter *RenameFilter) rename(data map[string]interface{}) {
+	for _, rename := range filter.renames {
+		if v, ok := data[rename.From]; ok {
+			delete(data, rename.From)
+			data[rename.To] = v
+		}
+	}
+	if len(filter.regexps) > 0 {
+		keys := make([]string, 0, len(data))
+		for key := range data {
+			keys = append(keys, key)
+		}
+		for _, key := range keys {
+			path := splitPath(filter.renamePath(key))
+			if len(path) == 1 && path[0] == key {
+				continue
+			}
+			v := data[key]
+			delete(data, key)
+			if !setPath(data, path, v) {
+				filter.logger.Debugf("%s: cannot rename %s to %s", LogComponent(filter.String()), key, strings.Join(path, "."))
+				data[key] = v
+			}
+		}
+	}
+	for _, move := range filter.moves {
+		v, ok := move.From.Get(data)
+		if !ok {
+			continue
+		}
+		if !move.To.Set(data, v) {
+			filter.logger.Debugf("%s: cannot move %s to %s", LogComponent(filter.String()), move.From.String(), move.To.String())
+			continue
+		}
+		move.From.Delete(data)
+	}
+}
+
+func (filter *RenameFilter) Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error) {
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			filter.rename(record.Data)
+		}
+	}
+	return recordSets, nil
+}
+
+func (filter *RenameFilter) String() string {
+	return "filter:" + filter.name
+}
+
+func NewRenameFilter(logger *logging.Logger, name string, renames []KeyRename, regexps []KeyRegexpRename, moves []KeyMove) *RenameFilter {
+	return &RenameFilter{
+		logger:  logger,
+		name:    name,
+		renames: renames,
+		regexps: regexps,
+		moves:   moves,
+	}
+}
+
+// parseRenamePairs splits each of the values of the key into the source and
+// the destination separated by whitespace.
+func parseRenamePairs(config *ConfigElement, key string) ([][2]string, error) {
+	retval := make([][2]string, 0)
+	for _, value := range config.GetAll(key) {
+		fields := strings.Fields(value)
+		if len(fields) != 2 {
+			return nil, errors.New(fmt.Sprintf("%s: %s must be a pair of names separated by whitespace: %s", config.String(), key, value))
+		}
+		retval = append(retval, [2]string{fields[0], fields[1]})
+	}
+	return retval, nil
+}
+
+func newRenameFilterFromConfig(logger *logging.Logger, config *ConfigElement, next Port) (Filter, error) {
+	pairs, err := parseRenamePairs(config, "rename")
+	if err != nil {
+		return nil, err
+	}
+	renames := make([]KeyRename, 0, len(pairs))
+	for _, pair := range pairs {
+		renames = append(renames, KeyRename{From: pair[0], To: pair[1]})
+	}
+	pairs, err = parseRenamePairs(config, "rename-regexp")
+	if err != nil {
+		return nil, err
+	}
+	regexps := make([]KeyRegexpRename, 0, len(pairs))
+	for _, pair := range pairs {
+		re, err := regexp.Compile(pair[0])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s", config.String(), err.Error()))
+		}
+		regexps = append(regexps, KeyRegexpRename{Regexp: re, Replacement: pair[1]})
+	}
+	pairs, err = parseRenamePairs(config, "move")
+	if err != nil {
+		return nil, err
+	}
+	moves := make([]KeyMove, 0, len(pairs))
+	for _, pair := range pairs {
+		from, err := NewDottedRecordAccessor(pair[0])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: move: %s", config.String(), err.Error()))
+		}
+		to, err := NewDottedRecordAccessor(pair[1])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: move: %s", config.String(), err.Error()))
+		}
+		moves = append(moves, KeyMove{From: from, To: to})
+	}
+	return NewRenameFilter(logger, config.Arg, renames, regexps, moves), nil
+}
+
+func init() {
+	RegisterFilter("rename", newRenameFilterFromConfig)
+	RegisterFilterParams("rename",
+		ParamSchema{Name: "rename", Type: ParamString, Description: "\"FROM TO\" renaming a top-level variable", Repeated: true},
+		ParamSchema{Name: "rename-regexp", Type: ParamString, Description: "\"REGEXP REPLACEMENT\" renaming the top-level variables matching the regular expression", Repeated: true},
+		ParamSchema{Name: "move", Type: ParamString, Description: "\"FROM TO\" moving a value between dot-separated paths", Repeated: true},
+	)
+}
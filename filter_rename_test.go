@@ -0,0 +1,62 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"reflect"
+	"testing"
+)
+
+func Test_RenameFilter(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("rename")
+	config := NewConfigElement("filter", "test")
+	config.Add("rename", "msg message")
+	config.Add("rename-regexp", "^kubernetes_ k8s.")
+	config.Add("move", "http.status status")
+	config.Add("move", "level severity.name")
+	config.Add("move", "missing.name other")
+	filter, err := newRenameFilterFromConfig(logger, config, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data := map[string]interface{}{
+		"msg":                 "hello",
+		"kubernetes_pod":      "web-1",
+		"kubernetes_host":     "node-1",
+		"kubernetes_app.name": "web",
+		"http":                map[string]interface{}{"status": int64(200), "method": "GET"},
+		"level":               "info",
+	}
+	filter.Filter([]FluentRecordSet{{Tag: "test", Records: []TinyFluentRecord{{Timestamp: 0, Data: data}}}})
+	expected := map[string]interface{}{
+		"message": "hello",
+		// the dots of the replacement nest the keys, and the ones of the
+		// keys renamed are kept
+		"k8s":      map[string]interface{}{"pod": "web-1", "host": "node-1", "app.name": "web"},
+		"http":     map[string]interface{}{"method": "GET"},
+		"status":   int64(200),
+		"severity": map[string]interface{}{"name": "info"},
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Logf("%+v", data)
+		t.Fail()
+	}
+}
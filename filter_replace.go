@@ -0,0 +1,113 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"regexp"
+)
+
+type ReplaceRule struct {
+	Regexp      *regexp.Regexp
+	Replacement string
+}
+
+// ReplaceFilter applies the rules in order to the string values of the keys.
+// The replacement may refer to the submatches as in regexp.ReplaceAllString.
+type ReplaceFilter struct {
+	logger *logging.Logger
+	name   string
+	keys   []*RecordAccessor
+	rules  []ReplaceRule
+}
+
+func (filter *ReplaceFilter) Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error) {
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			for _, key := range filter.keys {
+				s := ""
+				v, _ := key.Get(record.Data)
+				switch v := v.(type) {
+				case string:
+					s = v
+				case []byte:
+					s = string(v)
+				default:
+					continue
+				}
+				for _, rule := range filter.rules {
+					s = rule.Regexp.ReplaceAllString(s, rule.Replacement)
+				}
+				key.Set(record.Data, s)
+			}
+		}
+	}
+	return recordSets, nil
+}
+
+func (filter *ReplaceFilter) String() string {
+	return "filter:" + filter.name
+}
+
+func NewReplaceFilter(logger *logging.Logger, name string, keys []*RecordAccessor, rules []ReplaceRule) *ReplaceFilter {
+	return &ReplaceFilter{
+		logger: logger,
+		name:   name,
+		keys:   keys,
+		rules:  rules,
+	}
+}
+
+func newReplaceFilterFromConfig(logger *logging.Logger, config *ConfigElement, next Port) (Filter, error) {
+	keys, err := recordAccessorsFromConfig(config, "keys")
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New(fmt.Sprintf("%s: keys is not specified", config.String()))
+	}
+	patterns := config.GetAll("pattern")
+	replacements := config.GetAll("replacement")
+	if len(patterns) == 0 {
+		return nil, errors.New(fmt.Sprintf("%s: pattern is not specified", config.String()))
+	}
+	if len(patterns) != len(replacements) {
+		return nil, errors.New(fmt.Sprintf("%s: every pattern must be followed by a replacement", config.String()))
+	}
+	rules := make([]ReplaceRule, 0, len(patterns))
+	for i, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s", config.String(), err.Error()))
+		}
+		rules = append(rules, ReplaceRule{Regexp: re, Replacement: replacements[i]})
+	}
+	return NewReplaceFilter(logger, config.Arg, keys, rules), nil
+}
+
+func init() {
+	RegisterFilter("replace", newReplaceFilterFromConfig)
+	RegisterFilterParams("replace",
+		ParamSchema{Name: "keys", Type: ParamList, Description: "variables whose string values are replaced", Required: true},
+		ParamSchema{Name: "pattern", Type: ParamString, Description: "regular expression replaced, followed by its replacement", Required: true, Repeated: true},
+		ParamSchema{Name: "replacement", Type: ParamString, Description: "replacement of the preceding pattern", Repeated: true},
+	)
+}
@@ -0,0 +1,55 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"testing"
+)
+
+func Test_ReplaceFilter(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("replace")
+	configs, err := ReadConfig("test.conf", []byte(`
+[filter "test"]
+type = replace
+keys = message, path
+pattern = "\\x1b\\[[0-9;]*m"
+replacement = ""
+pattern = [0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}
+replacement = <uuid>
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	filter, err := NewFilter(logger, configs[0], nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data := map[string]interface{}{
+		"message": []byte("\x1b[31mfailed\x1b[0m for 123e4567-e89b-12d3-a456-426614174000"),
+		"path":    "/users/123e4567-e89b-12d3-a456-426614174000/edit",
+		"status":  int64(500),
+	}
+	filter.Filter([]FluentRecordSet{{Tag: "test", Records: []TinyFluentRecord{{Timestamp: 0, Data: data}}}})
+	if data["message"] != "failed for <uuid>" || data["path"] != "/users/<uuid>/edit" || data["status"] != int64(500) {
+		t.Logf("%+v", data)
+		t.Fail()
+	}
+}
@@ -0,0 +1,83 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+)
+
+// RetagFilter gives the records the tag made from the template, so that the
+// filters that follow see the new tag.  The placeholders that cannot be
+// resolved are replaced with missing, or the record keeps its tag if
+// missing is empty.
+type RetagFilter struct {
+	logger   *logging.Logger
+	name     string
+	template *TagTemplate
+	missing  string
+}
+
+func (filter *RetagFilter) Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error) {
+	retval := make([]FluentRecordSet, 0, len(recordSets))
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			tag, resolved := filter.template.Expand(recordSet.Tag, record.Data, filter.missing)
+			if !resolved && filter.missing == "" {
+				tag = recordSet.Tag
+			}
+			retval = appendRecord(retval, tag, record)
+		}
+	}
+	return retval, nil
+}
+
+func (filter *RetagFilter) String() string {
+	return "filter:" + filter.name
+}
+
+func NewRetagFilter(logger *logging.Logger, name string, template *TagTemplate, missing string) *RetagFilter {
+	return &RetagFilter{
+		logger:   logger,
+		name:     name,
+		template: template,
+		missing:  missing,
+	}
+}
+
+func newRetagFilterFromConfig(logger *logging.Logger, config *ConfigElement, next Port) (Filter, error) {
+	tag := config.Get("tag", "")
+	if tag == "" {
+		return nil, errors.New(fmt.Sprintf("%s: tag is not specified", config.String()))
+	}
+	template, err := NewTagTemplate(tag)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", config.String(), err.Error()))
+	}
+	return NewRetagFilter(logger, config.Arg, template, config.Get("missing", "unknown")), nil
+}
+
+func init() {
+	RegisterFilter("retag", newRetagFilterFromConfig)
+	RegisterFilterParams("retag",
+		ParamSchema{Name: "tag", Type: ParamString, Description: "template of the tag", Required: true},
+		ParamSchema{Name: "missing", Type: ParamString, Description: "replacement of the placeholders that cannot be resolved; the tag is kept if empty", Default: "unknown"},
+	)
+}
@@ -0,0 +1,122 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"testing"
+)
+
+func Test_RetagFilter(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("retag")
+	template, err := NewTagTemplate("app.${fields.service}.${tag_parts[-1]}")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	records := []FluentRecordSet{{Tag: "docker.web", Records: []TinyFluentRecord{
+		{Timestamp: 1, Data: map[string]interface{}{"service": "api"}},
+		{Timestamp: 2, Data: map[string]interface{}{"service": []byte("db")}},
+		{Timestamp: 3, Data: map[string]interface{}{"level": "info"}},
+		{Timestamp: 4, Data: map[string]interface{}{"service": "api"}},
+	}}}
+	for missing, expected := range map[string][]string{
+		"unknown": {"app.api.web", "app.db.web", "app.unknown.web", "app.api.web"},
+		// the tag is kept
+		"": {"app.api.web", "app.db.web", "docker.web", "app.api.web"},
+	} {
+		filter := NewRetagFilter(logger, "retag", template, missing)
+		result, err := filter.Filter(records)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		tags := tagsOf(result)
+		if len(tags) != len(expected) {
+			t.Fatalf("%q: %+v", missing, tags)
+		}
+		for i, tag := range tags {
+			if tag != expected[i] {
+				t.Errorf("%q: %+v", missing, tags)
+				break
+			}
+		}
+		// in the order received, split where the tag changes
+		if len(result) != 4 || result[3].Records[0].Timestamp != 4 {
+			t.Errorf("%q: %+v", missing, result)
+		}
+	}
+}
+
+func Test_RetagFilter_Routing(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("pipeline")
+	sections, err := ReadConfig("test.conf", []byte(`
+[filter "route-by-service"]
+type = retag
+match = docker.**
+tag = app.${fields.service}
+
+[filter "strip"]
+type = fields
+match = app.api
+remove = debug
+
+[output "api"]
+type = test-recording
+match = app.api
+
+[output "unrouted"]
+type = test-recording
+match = app.unknown
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defaultOutput := &recordingOutput{name: "default"}
+	pipeline, err := BuildPipeline(logger, sections, defaultOutput)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = pipeline.Head().Emit([]FluentRecordSet{
+		{Tag: "docker.web", Records: []TinyFluentRecord{
+			{Timestamp: 1, Data: map[string]interface{}{"service": "api", "debug": "x"}},
+			{Timestamp: 2, Data: map[string]interface{}{"debug": "x"}},
+			{Timestamp: 3, Data: map[string]interface{}{"service": "db"}},
+		}},
+		// not matched by the filter
+		{Tag: "app.api", Records: []TinyFluentRecord{{Timestamp: 4, Data: map[string]interface{}{"service": "db"}}}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// the filters and the outputs after the retag see the new tag
+	api := recordingOutputs["api"].recordSets
+	if tags := tagsOf(api); len(tags) != 2 || api[0].Records[0].Timestamp != 1 || api[1].Records[0].Timestamp != 4 {
+		t.Fatalf("%+v", api)
+	}
+	if _, ok := api[0].Records[0].Data["debug"]; ok {
+		t.Errorf("%+v", api[0].Records[0])
+	}
+	if unrouted := recordingOutputs["unrouted"].recordSets; len(unrouted) != 1 || unrouted[0].Records[0].Timestamp != 2 {
+		t.Errorf("%+v", unrouted)
+	}
+	if tags := tagsOf(defaultOutput.recordSets); len(tags) != 1 || tags[0] != "app.db" {
+		t.Errorf("%+v", tags)
+	}
+}
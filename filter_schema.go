@@ -0,0 +1,167 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"strings"
+)
+
+// SchemaFilter validates the records against a JSON Schema.  The invalid
+// records are given the tag prefixed with errorTagPrefix, so that they can
+// be routed elsewhere, and the reason in errorKey, or are reported as errors
+// if errorTagPrefix is empty.
+type SchemaFilter struct {
+	logger         *logging.Logger
+	name           string
+	schema         *jsonschema.Schema
+	errorTagPrefix string
+	errorKey       *RecordAccessor
+}
+
+// toJSONValue converts a record to what encoding/json would have decoded.
+func toJSONValue(v interface{}) interface{} {
+	switch v_ := v.(type) {
+	case []byte:
+		return string(v_)
+	case []interface{}:
+		retval := make([]interface{}, len(v_))
+		for i, e := range v_ {
+			retval[i] = toJSONValue(e)
+		}
+		return retval
+	case map[string]interface{}:
+		retval := make(map[string]interface{}, len(v_))
+		for k, e := range v_ {
+			retval[k] = toJSONValue(e)
+		}
+		return retval
+	case map[interface{}]interface{}:
+		retval := make(map[string]interface{}, len(v_))
+		for k, e := range v_ {
+			retval[groupValueString(k)] = toJSONValue(e)
+		}
+		return retval
+	}
+	return v
+}
+
+// validationMessages collects the innermost errors, which tell what is
+// actually wrong.
+func validationMessages(ve *jsonschema.ValidationError, messages []string) []string {
+	if len(ve.Causes) == 0 {
+		location := ve.InstanceLocation
+		if location == "" {
+			location = "/"
+		}
+		return append(messages, location+": "+ve.Message)
+	}
+	for _, cause := range ve.Causes {
+		messages = validationMessages(cause, messages)
+	}
+	return messages
+}
+
+func (filter *SchemaFilter) validate(data map[string]interface{}) string {
+	err := filter.schema.Validate(toJSONValue(data))
+	if err == nil {
+		return ""
+	}
+	if ve, ok := err.(*jsonschema.ValidationError); ok {
+		return strings.Join(validationMessages(ve, nil), "; ")
+	}
+	return err.Error()
+}
+
+func (filter *SchemaFilter) Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error) {
+	retval := make([]FluentRecordSet, 0, len(recordSets))
+	errs := make(RecordErrors, 0)
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			message := filter.validate(record.Data)
+			if message == "" {
+				retval = appendRecord(retval, recordSet.Tag, record)
+				continue
+			}
+			filter.logger.Debugf("%s: invalid record with tag %s: %s", LogComponent(filter.String()), LogTag(recordSet.Tag), message)
+			if filter.errorTagPrefix == "" {
+				errs = append(errs, RecordError{Tag: recordSet.Tag, Record: record, Err: errors.New(message)})
+				continue
+			}
+			filter.errorKey.Set(record.Data, message)
+			retval = appendRecord(retval, filter.errorTagPrefix+recordSet.Tag, record)
+		}
+	}
+	if len(errs) > 0 {
+		return retval, errs
+	}
+	return retval, nil
+}
+
+func (filter *SchemaFilter) String() string {
+	return "filter:" + filter.name
+}
+
+func NewSchemaFilter(logger *logging.Logger, name string, schema *jsonschema.Schema, errorTagPrefix string, errorKey *RecordAccessor) *SchemaFilter {
+	return &SchemaFilter{
+		logger:         logger,
+		name:           name,
+		schema:         schema,
+		errorTagPrefix: errorTagPrefix,
+		errorKey:       errorKey,
+	}
+}
+
+func newSchemaFilterFromConfig(logger *logging.Logger, config *ConfigElement, next Port) (Filter, error) {
+	path := config.Get("schema", "")
+	if path == "" {
+		return nil, errors.New(fmt.Sprintf("%s: schema is not specified", config.String()))
+	}
+	schema, err := jsonschema.Compile(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", config.String(), err.Error()))
+	}
+	errorTagPrefix := config.Get("error-tag-prefix", "invalid.")
+	onInvalid := config.Get("on-invalid", "retag")
+	switch onInvalid {
+	case "retag":
+	case "drop":
+		errorTagPrefix = ""
+	default:
+		return nil, errors.New(fmt.Sprintf("%s: on-invalid must be either retag or drop: %s", config.String(), onInvalid))
+	}
+	errorKey, err := recordAccessorFromConfig(config, "error-key", "validation_error")
+	if err != nil {
+		return nil, err
+	}
+	return NewSchemaFilter(logger, config.Arg, schema, errorTagPrefix, errorKey), nil
+}
+
+func init() {
+	RegisterFilter("schema", newSchemaFilterFromConfig)
+	RegisterFilterParams("schema",
+		ParamSchema{Name: "schema", Type: ParamString, Description: "file of the JSON Schema the events are validated against", Required: true},
+		ParamSchema{Name: "on-invalid", Type: ParamString, Description: "whether the invalid events are retagged or sent to @ERROR", Default: "retag", Enum: []string{"retag", "drop"}},
+		ParamSchema{Name: "error-tag-prefix", Type: ParamString, Description: "prefix prepended to the tags of the invalid events", Default: "invalid."},
+		ParamSchema{Name: "error-key", Type: ParamString, Description: "variable the reason is stored in", Default: "validation_error"},
+	)
+}
@@ -0,0 +1,70 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"testing"
+)
+
+func Test_SchemaFilter(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("schema")
+	schema, err := jsonschema.CompileString("schema.json", `{
+		"type": "object",
+		"required": ["message", "status"],
+		"properties": {
+			"message": {"type": "string"},
+			"status": {"type": "integer", "minimum": 100},
+			"tags": {"type": "array", "items": {"type": "string"}}
+		}
+	}`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	filter := NewSchemaFilter(logger, "test", schema, "invalid.", mustRecordAccessor("validation_error"))
+	result, _ := filter.Filter([]FluentRecordSet{
+		{
+			Tag: "app",
+			Records: []TinyFluentRecord{
+				{Timestamp: 1, Data: map[string]interface{}{"message": []byte("ok"), "status": int64(200), "tags": []interface{}{[]byte("a")}}},
+				{Timestamp: 2, Data: map[string]interface{}{"message": "bad", "status": uint64(99)}},
+				{Timestamp: 3, Data: map[string]interface{}{"message": "ok", "status": uint64(200)}},
+			},
+		},
+	})
+	if len(result) != 3 || result[0].Tag != "app" || result[1].Tag != "invalid.app" || result[2].Tag != "app" {
+		t.Fatalf("%+v", result)
+	}
+	if message := result[1].Records[0].Data["validation_error"]; message != "/status: must be >= 100 but found 99" {
+		t.Logf("%v", message)
+		t.Fail()
+	}
+	filter = NewSchemaFilter(logger, "test", schema, "", mustRecordAccessor("validation_error"))
+	result, err = filter.Filter([]FluentRecordSet{{Tag: "app", Records: []TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{}}}}})
+	if len(result) != 0 {
+		t.Logf("%+v", result)
+		t.Fail()
+	}
+	if errs, ok := err.(RecordErrors); !ok || len(errs) != 1 || errs[0].Tag != "app" {
+		t.Logf("%+v", err)
+		t.Fail()
+	}
+}
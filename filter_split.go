@@ -0,0 +1,112 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+)
+
+// SplitFilter turns a record holding an array in key into a record per
+// element.  The elements that are maps are merged into the record, and the
+// others are stored in key.  The other fields of the original record are
+// copied to each of the records if keepParent is true.
+type SplitFilter struct {
+	logger     *logging.Logger
+	name       string
+	key        *RecordAccessor
+	keepParent bool
+}
+
+func (filter *SplitFilter) split(record TinyFluentRecord, elements []interface{}) []TinyFluentRecord {
+	retval := make([]TinyFluentRecord, 0, len(elements))
+	for _, element := range elements {
+		data := make(map[string]interface{})
+		if filter.keepParent {
+			data = copyValue(record.Data).(map[string]interface{})
+			filter.key.Delete(data)
+		}
+		if m, ok := element.(map[string]interface{}); ok {
+			for k, v := range m {
+				data[k] = v
+			}
+		} else {
+			filter.key.Set(data, element)
+		}
+		retval = append(retval, TinyFluentRecord{Timestamp: record.Timestamp, Data: data})
+	}
+	return retval
+}
+
+func (filter *SplitFilter) Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error) {
+	retval := make([]FluentRecordSet, 0, len(recordSets))
+	for _, recordSet := range recordSets {
+		records := make([]TinyFluentRecord, 0, len(recordSet.Records))
+		for _, record := range recordSet.Records {
+			v, _ := filter.key.Get(record.Data)
+			elements, ok := v.([]interface{})
+			if !ok {
+				records = append(records, record)
+				continue
+			}
+			records = append(records, filter.split(record, elements)...)
+		}
+		if len(records) > 0 {
+			retval = append(retval, FluentRecordSet{Tag: recordSet.Tag, Records: records})
+		}
+	}
+	return retval, nil
+}
+
+func (filter *SplitFilter) String() string {
+	return "filter:" + filter.name
+}
+
+func NewSplitFilter(logger *logging.Logger, name string, key *RecordAccessor, keepParent bool) *SplitFilter {
+	return &SplitFilter{
+		logger:     logger,
+		name:       name,
+		key:        key,
+		keepParent: keepParent,
+	}
+}
+
+func newSplitFilterFromConfig(logger *logging.Logger, config *ConfigElement, next Port) (Filter, error) {
+	if config.Get("key", "") == "" {
+		return nil, errors.New(fmt.Sprintf("%s: key is not specified", config.String()))
+	}
+	key, err := recordAccessorFromConfig(config, "key", "")
+	if err != nil {
+		return nil, err
+	}
+	keepParent, err := config.GetBool("keep-parent", true)
+	if err != nil {
+		return nil, err
+	}
+	return NewSplitFilter(logger, config.Arg, key, keepParent), nil
+}
+
+func init() {
+	RegisterFilter("split", newSplitFilterFromConfig)
+	RegisterFilterParams("split",
+		ParamSchema{Name: "key", Type: ParamString, Description: "variable holding the array split", Required: true},
+		ParamSchema{Name: "keep-parent", Type: ParamBoolean, Description: "whether the other variables are copied to each event", Default: "true"},
+	)
+}
@@ -0,0 +1,65 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"reflect"
+	"testing"
+)
+
+func Test_SplitFilter(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("split")
+	input := func() []FluentRecordSet {
+		return []FluentRecordSet{
+			{
+				Tag: "test",
+				Records: []TinyFluentRecord{
+					{Timestamp: 1, Data: map[string]interface{}{"host": "a", "events": []interface{}{
+						map[string]interface{}{"message": "x", "host": "b"},
+						"y",
+					}}},
+					{Timestamp: 2, Data: map[string]interface{}{"host": "c", "events": []interface{}{}}},
+					{Timestamp: 3, Data: map[string]interface{}{"host": "d"}},
+				},
+			},
+		}
+	}
+	result, _ := NewSplitFilter(logger, "test", mustRecordAccessor("events"), true).Filter(input())
+	expected := []TinyFluentRecord{
+		{Timestamp: 1, Data: map[string]interface{}{"message": "x", "host": "b"}},
+		{Timestamp: 1, Data: map[string]interface{}{"host": "a", "events": "y"}},
+		{Timestamp: 3, Data: map[string]interface{}{"host": "d"}},
+	}
+	if len(result) != 1 || !reflect.DeepEqual(result[0].Records, expected) {
+		t.Logf("%+v", result)
+		t.Fail()
+	}
+	result, _ = NewSplitFilter(logger, "test", mustRecordAccessor("events"), false).Filter(input())
+	expected = []TinyFluentRecord{
+		{Timestamp: 1, Data: map[string]interface{}{"message": "x", "host": "b"}},
+		{Timestamp: 1, Data: map[string]interface{}{"events": "y"}},
+		{Timestamp: 3, Data: map[string]interface{}{"host": "d"}},
+	}
+	if len(result) != 1 || !reflect.DeepEqual(result[0].Records, expected) {
+		t.Logf("%+v", result)
+		t.Fail()
+	}
+}
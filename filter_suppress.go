@@ -0,0 +1,214 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type suppressState struct {
+	tag        string
+	startedAt  time.Time
+	passed     int
+	suppressed int64
+	last       TinyFluentRecord
+}
+
+// SuppressFilter lets through the first threshold records of a burst of
+// identical ones, which are those having the same tag and values of the keys
+// (or the same contents if no key is given) within interval from the first
+// one.  The rest are held back, and the last of them is emitted with the
+// number of the suppressed records in countKey once the interval is over,
+// like "last message repeated N times" of syslog.
+type SuppressFilter struct {
+	logger         *logging.Logger
+	name           string
+	keys           []*RecordAccessor
+	interval       time.Duration
+	threshold      int
+	countKey       *RecordAccessor
+	timeGetter     func() time.Time
+	next           Port
+	mtx            sync.Mutex
+	states         map[uint64]*suppressState
+	isShuttingDown uintptr
+	shutdownChan   chan struct{}
+	wg             sync.WaitGroup
+}
+
+func (filter *SuppressFilter) summarize(state *suppressState) TinyFluentRecord {
+	filter.countKey.Set(state.last.Data, state.suppressed)
+	return state.last
+}
+
+func (filter *SuppressFilter) Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error) {
+	now := filter.timeGetter()
+	filter.mtx.Lock()
+	defer filter.mtx.Unlock()
+	retval := make([]FluentRecordSet, 0, len(recordSets))
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			key := hashRecord(recordSet.Tag, record.Data, filter.keys)
+			state, ok := filter.states[key]
+			if ok && now.Sub(state.startedAt) < filter.interval {
+				if state.passed < filter.threshold {
+					state.passed += 1
+					retval = appendRecord(retval, recordSet.Tag, record)
+				} else {
+					state.suppressed += 1
+					state.last = record
+				}
+				continue
+			}
+			if ok && state.suppressed > 0 {
+				retval = appendRecord(retval, state.tag, filter.summarize(state))
+			}
+			filter.states[key] = &suppressState{
+				tag:        recordSet.Tag,
+				startedAt:  now,
+				passed:     1,
+				suppressed: 0,
+			}
+			retval = appendRecord(retval, recordSet.Tag, record)
+		}
+	}
+	return retval, nil
+}
+
+// flush emits the summaries of the bursts that began before the deadline and
+// forgets them, or does so for all of them if the deadline is zero.
+func (filter *SuppressFilter) flush(deadline time.Time) {
+	filter.mtx.Lock()
+	expired := make([]*suppressState, 0)
+	for key, state := range filter.states {
+		if deadline.IsZero() || state.startedAt.Before(deadline) {
+			if state.suppressed > 0 {
+				expired = append(expired, state)
+			}
+			delete(filter.states, key)
+		}
+	}
+	filter.mtx.Unlock()
+	if len(expired) == 0 {
+		return
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].last.Timestamp < expired[j].last.Timestamp
+	})
+	recordSets := make([]FluentRecordSet, 0, len(expired))
+	for _, state := range expired {
+		recordSets = appendRecord(recordSets, state.tag, filter.summarize(state))
+	}
+	err := filter.next.Emit(recordSets)
+	if err != nil {
+		filter.logger.Errorf("%s: failed to emit the summaries: %s", LogComponent(filter.String()), LogError(err))
+	}
+}
+
+func (filter *SuppressFilter) String() string {
+	return "filter:" + filter.name
+}
+
+func (filter *SuppressFilter) Start() {
+	filter.wg.Add(1)
+	go func() {
+		defer filter.wg.Done()
+		ticker := time.NewTicker(filter.interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-filter.shutdownChan:
+				filter.flush(time.Time{})
+				return
+			case <-ticker.C:
+				filter.flush(filter.timeGetter().Add(-filter.interval))
+			}
+		}
+	}()
+}
+
+func (filter *SuppressFilter) Stop() {
+	if atomic.CompareAndSwapUintptr(&filter.isShuttingDown, uintptr(0), uintptr(1)) {
+		filter.shutdownChan <- struct{}{}
+	}
+}
+
+func (filter *SuppressFilter) WaitForShutdown() {
+	filter.wg.Wait()
+}
+
+func NewSuppressFilter(logger *logging.Logger, name string, keys []*RecordAccessor, interval time.Duration, threshold int, countKey *RecordAccessor, timeGetter func() time.Time, next Port) *SuppressFilter {
+	return &SuppressFilter{
+		logger:         logger,
+		name:           name,
+		keys:           keys,
+		interval:       interval,
+		threshold:      threshold,
+		countKey:       countKey,
+		timeGetter:     timeGetter,
+		next:           next,
+		mtx:            sync.Mutex{},
+		states:         make(map[uint64]*suppressState),
+		isShuttingDown: uintptr(0),
+		shutdownChan:   make(chan struct{}, 1),
+		wg:             sync.WaitGroup{},
+	}
+}
+
+func newSuppressFilterFromConfig(logger *logging.Logger, config *ConfigElement, next Port) (Filter, error) {
+	keys, err := recordAccessorsFromConfig(config, "keys")
+	if err != nil {
+		return nil, err
+	}
+	interval, err := config.GetDuration("interval", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		return nil, errors.New(fmt.Sprintf("%s: interval must be positive", config.String()))
+	}
+	threshold, err := config.GetInt("threshold", 3)
+	if err != nil {
+		return nil, err
+	}
+	if threshold <= 0 {
+		return nil, errors.New(fmt.Sprintf("%s: threshold must be positive", config.String()))
+	}
+	countKey, err := recordAccessorFromConfig(config, "count-key", "repeat_count")
+	if err != nil {
+		return nil, err
+	}
+	return NewSuppressFilter(logger, config.Arg, keys, interval, threshold, countKey, time.Now, next), nil
+}
+
+func init() {
+	RegisterFilter("suppress", newSuppressFilterFromConfig)
+	RegisterFilterParams("suppress",
+		ParamSchema{Name: "keys", Type: ParamList, Description: "variables compared besides the tag; the whole record if unspecified"},
+		ParamSchema{Name: "interval", Type: ParamDuration, Description: "time within which the identical events are suppressed", Default: "10s"},
+		ParamSchema{Name: "threshold", Type: ParamInteger, Description: "number of the identical events passed in an interval", Default: "3"},
+		ParamSchema{Name: "count-key", Type: ParamString, Description: "variable the number of the suppressed events is stored in", Default: "repeat_count"},
+	)
+}
@@ -0,0 +1,62 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"testing"
+	"time"
+)
+
+func Test_SuppressFilter(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("suppress")
+	now := time.Unix(1000, 0)
+	next := &recordingPort{}
+	filter := NewSuppressFilter(logger, "test", mustRecordAccessors("message"), 10*time.Second, 2, mustRecordAccessor("repeat_count"), func() time.Time { return now }, next)
+	record := func(ts uint64, message string) TinyFluentRecord {
+		return TinyFluentRecord{Timestamp: ts, Data: map[string]interface{}{"message": message}}
+	}
+	result, _ := filter.Filter([]FluentRecordSet{{Tag: "app", Records: []TinyFluentRecord{
+		record(1, "crash"), record(2, "crash"), record(3, "crash"), record(4, "other"), record(5, "crash"),
+	}}})
+	if n := len(result[0].Records); n != 3 {
+		t.Logf("%+v", result)
+		t.Fail()
+	}
+
+	// the burst is over; a new record gets the summary out first
+	now = now.Add(10 * time.Second)
+	result, _ = filter.Filter([]FluentRecordSet{{Tag: "app", Records: []TinyFluentRecord{record(6, "crash")}}})
+	if len(result) != 1 || len(result[0].Records) != 2 {
+		t.Fatalf("%+v", result)
+	}
+	summary := result[0].Records[0]
+	if summary.Timestamp != 5 || summary.Data["repeat_count"] != int64(2) {
+		t.Logf("%+v", summary)
+		t.Fail()
+	}
+
+	filter.Filter([]FluentRecordSet{{Tag: "app", Records: []TinyFluentRecord{record(7, "crash"), record(8, "crash")}}})
+	filter.flush(time.Time{})
+	if len(next.recordSets) != 1 || next.recordSets[0].Records[0].Data["repeat_count"] != int64(1) {
+		t.Logf("%+v", next.recordSets)
+		t.Fail()
+	}
+}
@@ -0,0 +1,112 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"sync/atomic"
+	"time"
+)
+
+// TapFilter passes the records through untouched and, for every Nth of
+// them, logs it or sends a copy of it to a label along with when it passed
+// and how long after the timestamp of the record.
+type TapFilter struct {
+	logger     *logging.Logger
+	name       string
+	every      uint64
+	label      Port
+	timeGetter func() time.Time
+	count      uint64
+}
+
+func (filter *TapFilter) tap(tag string, record TinyFluentRecord, now time.Time) TinyFluentRecord {
+	lag := now.Sub(time.Unix(int64(record.Timestamp), 0))
+	if filter.label == nil {
+		filter.logger.Infof("%s: tag=%s time=%d lag=%s record=%v", LogComponent(filter.String()), tag, record.Timestamp, lag.String(), record.Data)
+		return record
+	}
+	data := copyValue(record.Data).(map[string]interface{})
+	data["tap"] = map[string]interface{}{
+		"point":   filter.name,
+		"seen_at": float64(now.UnixNano()) / 1e9,
+		"lag":     lag.Seconds(),
+	}
+	return TinyFluentRecord{Timestamp: record.Timestamp, Data: data}
+}
+
+func (filter *TapFilter) Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error) {
+	now := filter.timeGetter()
+	tapped := make([]FluentRecordSet, 0)
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			if atomic.AddUint64(&filter.count, 1)%filter.every != 0 {
+				continue
+			}
+			record = filter.tap(recordSet.Tag, record, now)
+			if filter.label != nil {
+				tapped = appendRecord(tapped, recordSet.Tag, record)
+			}
+		}
+	}
+	if len(tapped) > 0 {
+		err := filter.label.Emit(tapped)
+		if err != nil {
+			filter.logger.Errorf("%s: %s", LogComponent(filter.String()), LogError(err))
+		}
+	}
+	return recordSets, nil
+}
+
+func (filter *TapFilter) String() string {
+	return "filter:" + filter.name
+}
+
+// NewTapFilter creates a tap which logs the records if label is nil.
+func NewTapFilter(logger *logging.Logger, name string, every uint64, label Port, timeGetter func() time.Time) *TapFilter {
+	return &TapFilter{
+		logger:     logger,
+		name:       name,
+		every:      every,
+		label:      label,
+		timeGetter: timeGetter,
+		count:      0,
+	}
+}
+
+func newTapFilterFromConfig(logger *logging.Logger, config *ConfigElement, label Port) (Filter, error) {
+	every, err := config.GetInt64("every", 100)
+	if err != nil {
+		return nil, err
+	}
+	if every <= 0 {
+		return nil, errors.New(fmt.Sprintf("%s: every must be positive", config.String()))
+	}
+	return NewTapFilter(logger, config.Arg, uint64(every), label, time.Now), nil
+}
+
+// the pipeline creates the taps itself, as they may refer to the labels
+func init() {
+	RegisterFilterParams("tap",
+		ParamSchema{Name: "every", Type: ParamInteger, Description: "interval in the events of the ones tapped", Default: "100"},
+		ParamSchema{Name: "to-label", Type: ParamString, Description: "label a copy of the events tapped is sent to; logged if unspecified"},
+	)
+}
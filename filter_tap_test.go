@@ -0,0 +1,64 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"testing"
+	"time"
+)
+
+func Test_TapFilter(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("tap")
+	label := &recordingPort{}
+	now := time.Unix(1000, 0)
+	filter := NewTapFilter(logger, "tap", 2, label, func() time.Time { return now })
+	records := make([]TinyFluentRecord, 0)
+	for i := 0; i < 5; i += 1 {
+		records = append(records, TinyFluentRecord{Timestamp: 998, Data: map[string]interface{}{"n": int64(i), "nested": map[string]interface{}{"a": "b"}}})
+	}
+	result, err := filter.Filter([]FluentRecordSet{{Tag: "app", Records: records}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(result) != 1 || len(result[0].Records) != 5 {
+		t.Logf("%+v", result)
+		t.Fail()
+	}
+	if len(label.recordSets) != 1 || len(label.recordSets[0].Records) != 2 {
+		t.Fatalf("%+v", label.recordSets)
+	}
+	tapped := label.recordSets[0].Records[0].Data
+	if tapped["n"] != int64(1) {
+		t.Logf("%+v", tapped)
+		t.Fail()
+	}
+	info := tapped["tap"].(map[string]interface{})
+	if info["point"] != "tap" || info["lag"] != 2.0 || info["seen_at"] != 1000.0 {
+		t.Logf("%+v", info)
+		t.Fail()
+	}
+	// the copy is independent of the record passed on
+	tapped["nested"].(map[string]interface{})["a"] = "c"
+	if _, ok := records[1].Data["tap"]; ok || records[1].Data["nested"].(map[string]interface{})["a"] != "b" {
+		t.Logf("%+v", records[1].Data)
+		t.Fail()
+	}
+}
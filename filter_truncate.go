@@ -0,0 +1,190 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"github.com/ugorji/go/codec"
+	"reflect"
+	"unicode/utf8"
+)
+
+type countingWriter struct {
+	n int64
+}
+
+func (writer *countingWriter) Write(p []byte) (int, error) {
+	writer.n += int64(len(p))
+	return len(p), nil
+}
+
+// TruncateFilter keeps the records within maxSize bytes when serialized as
+// an entry of the forward protocol.  The fields of an oversized record are
+// truncated in the given order, marking the record with markerKey, and the
+// records that still don't fit are sent to the overflow port, or reported as
+// errors if there is none.
+type TruncateFilter struct {
+	logger    *logging.Logger
+	name      string
+	maxSize   int64
+	fields    []*RecordAccessor
+	markerKey *RecordAccessor
+	overflow  Port
+	codec     *codec.MsgpackHandle
+}
+
+func (filter *TruncateFilter) size(tag string, record TinyFluentRecord) int64 {
+	writer := countingWriter{}
+	err := codec.NewEncoder(&writer, filter.codec).Encode([]interface{}{tag, record.Timestamp, record.Data})
+	if err != nil {
+		// cannot be forwarded anyway
+		return -1
+	}
+	return writer.n
+}
+
+// truncateString cuts off excess bytes from the end of the string, or a few
+// more so as not to split a UTF-8 sequence.
+func truncateString(s string, excess int64) string {
+	n := int64(len(s)) - excess
+	if n <= 0 {
+		return ""
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n -= 1
+	}
+	return s[:n]
+}
+
+// truncate returns false if the record cannot be made to fit.
+func (filter *TruncateFilter) truncate(tag string, record TinyFluentRecord, size int64) bool {
+	truncated := false
+	for _, field := range filter.fields {
+		for size > filter.maxSize {
+			s := ""
+			v, _ := field.Get(record.Data)
+			switch v := v.(type) {
+			case string:
+				s = v
+			case []byte:
+				s = string(v)
+			}
+			if s == "" {
+				break
+			}
+			if !truncated {
+				filter.markerKey.Set(record.Data, true)
+				truncated = true
+				size = filter.size(tag, record)
+				continue
+			}
+			field.Set(record.Data, truncateString(s, size-filter.maxSize))
+			size = filter.size(tag, record)
+		}
+	}
+	return size >= 0 && size <= filter.maxSize
+}
+
+func (filter *TruncateFilter) Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error) {
+	retval := make([]FluentRecordSet, 0, len(recordSets))
+	overflown := make([]FluentRecordSet, 0)
+	errs := make(RecordErrors, 0)
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			size := filter.size(recordSet.Tag, record)
+			if size >= 0 && size <= filter.maxSize {
+				retval = appendRecord(retval, recordSet.Tag, record)
+				continue
+			}
+			if filter.overflow != nil && len(filter.fields) == 0 {
+				overflown = appendRecord(overflown, recordSet.Tag, record)
+				continue
+			}
+			if filter.truncate(recordSet.Tag, record, size) {
+				retval = appendRecord(retval, recordSet.Tag, record)
+			} else if filter.overflow != nil {
+				overflown = appendRecord(overflown, recordSet.Tag, record)
+			} else {
+				errs = append(errs, RecordError{Tag: recordSet.Tag, Record: record, Err: errors.New(fmt.Sprintf("record exceeds %d bytes", filter.maxSize))})
+			}
+		}
+	}
+	if len(overflown) > 0 {
+		err := filter.overflow.Emit(overflown)
+		if err != nil {
+			filter.logger.Errorf("%s: %s", LogComponent(filter.String()), LogError(err))
+		}
+	}
+	if len(errs) > 0 {
+		return retval, errs
+	}
+	return retval, nil
+}
+
+func (filter *TruncateFilter) String() string {
+	return "filter:" + filter.name
+}
+
+func NewTruncateFilter(logger *logging.Logger, name string, maxSize int64, fields []*RecordAccessor, markerKey *RecordAccessor, overflow Port) *TruncateFilter {
+	_codec := codec.MsgpackHandle{}
+	_codec.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	_codec.RawToString = false
+	_codec.WriteExt = true
+	return &TruncateFilter{
+		logger:    logger,
+		name:      name,
+		maxSize:   maxSize,
+		fields:    fields,
+		markerKey: markerKey,
+		overflow:  overflow,
+		codec:     &_codec,
+	}
+}
+
+func newTruncateFilterFromConfig(logger *logging.Logger, config *ConfigElement, overflow Port) (Filter, error) {
+	maxSize, err := config.GetInt64("max-size", 0)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize <= 0 {
+		return nil, errors.New(fmt.Sprintf("%s: max-size must be positive", config.String()))
+	}
+	fields, err := recordAccessorsFromConfig(config, "fields")
+	if err != nil {
+		return nil, err
+	}
+	markerKey, err := recordAccessorFromConfig(config, "marker-key", "__truncated")
+	if err != nil {
+		return nil, err
+	}
+	return NewTruncateFilter(logger, config.Arg, maxSize, fields, markerKey, overflow), nil
+}
+
+// the pipeline creates the truncate filters itself, as they may refer to
+// the labels
+func init() {
+	RegisterFilterParams("truncate",
+		ParamSchema{Name: "max-size", Type: ParamInteger, Description: "size in bytes the events are kept within", Required: true},
+		ParamSchema{Name: "fields", Type: ParamList, Description: "string variables truncated in the order"},
+		ParamSchema{Name: "marker-key", Type: ParamString, Description: "variable set to true in the events truncated", Default: "__truncated"},
+		ParamSchema{Name: "overflow-label", Type: ParamString, Description: "label the events that do not fit are sent to; @ERROR if unspecified"},
+	)
+}
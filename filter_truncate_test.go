@@ -0,0 +1,61 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func Test_TruncateFilter(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("truncate")
+	overflow := &recordingPort{}
+	filter := NewTruncateFilter(logger, "truncate", 200, mustRecordAccessors("message"), mustRecordAccessor("__truncated"), overflow)
+	small := TinyFluentRecord{Timestamp: 0, Data: map[string]interface{}{"message": "hello"}}
+	large := TinyFluentRecord{Timestamp: 0, Data: map[string]interface{}{"message": []byte(strings.Repeat("あ", 100))}}
+	unfit := TinyFluentRecord{Timestamp: 0, Data: map[string]interface{}{"message": "x", "other": strings.Repeat("x", 300)}}
+	result, err := filter.Filter([]FluentRecordSet{{Tag: "app", Records: []TinyFluentRecord{small, large, unfit}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(result) != 1 || len(result[0].Records) != 2 {
+		t.Fatalf("%+v", result)
+	}
+	if result[0].Records[0].Data["message"] != "hello" {
+		t.Logf("%+v", result[0].Records[0].Data)
+		t.Fail()
+	}
+	truncated := result[0].Records[1]
+	message, ok := truncated.Data["message"].(string)
+	if !ok || !utf8.ValidString(message) || len(message) == 0 || truncated.Data["__truncated"] != true {
+		t.Logf("%+v", truncated.Data)
+		t.Fail()
+	}
+	if size := filter.size("app", truncated); size > 200 || size < 190 {
+		t.Logf("%d", size)
+		t.Fail()
+	}
+	if len(overflow.recordSets) != 1 || len(overflow.recordSets[0].Records) != 1 {
+		t.Logf("%+v", overflow.recordSets)
+		t.Fail()
+	}
+}
@@ -0,0 +1,170 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"github.com/ua-parser/uap-go/uaparser"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+)
+
+// UserAgentFilter parses the user-agent string in key with the regexes of
+// uap-core and stores the browser, the OS and the device it names in a map
+// under outKey.
+type UserAgentFilter struct {
+	logger    *logging.Logger
+	name      string
+	key       *RecordAccessor
+	outKey    *RecordAccessor
+	deleteKey bool
+	parser    *uaparser.Parser
+}
+
+func joinVersion(parts ...string) string {
+	retval := ""
+	for _, part := range parts {
+		if part == "" {
+			break
+		}
+		if retval != "" {
+			retval += "."
+		}
+		retval += part
+	}
+	return retval
+}
+
+func (filter *UserAgentFilter) parse(userAgent string) map[string]interface{} {
+	client := filter.parser.Parse(userAgent)
+	return map[string]interface{}{
+		"browser": map[string]interface{}{
+			"family":  client.UserAgent.Family,
+			"major":   client.UserAgent.Major,
+			"minor":   client.UserAgent.Minor,
+			"patch":   client.UserAgent.Patch,
+			"version": joinVersion(client.UserAgent.Major, client.UserAgent.Minor, client.UserAgent.Patch),
+		},
+		"os": map[string]interface{}{
+			"family":  client.Os.Family,
+			"major":   client.Os.Major,
+			"minor":   client.Os.Minor,
+			"patch":   client.Os.Patch,
+			"version": joinVersion(client.Os.Major, client.Os.Minor, client.Os.Patch, client.Os.PatchMinor),
+		},
+		"device": map[string]interface{}{
+			"family": client.Device.Family,
+			"brand":  client.Device.Brand,
+			"model":  client.Device.Model,
+		},
+	}
+}
+
+func (filter *UserAgentFilter) Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error) {
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			userAgent := ""
+			v, _ := filter.key.Get(record.Data)
+			switch v := v.(type) {
+			case string:
+				userAgent = v
+			case []byte:
+				userAgent = string(v)
+			default:
+				continue
+			}
+			if filter.deleteKey {
+				filter.key.Delete(record.Data)
+			}
+			filter.outKey.Set(record.Data, filter.parse(userAgent))
+		}
+	}
+	return recordSets, nil
+}
+
+func (filter *UserAgentFilter) String() string {
+	return "filter:" + filter.name
+}
+
+func NewUserAgentFilter(logger *logging.Logger, name string, key *RecordAccessor, outKey *RecordAccessor, deleteKey bool, parser *uaparser.Parser) *UserAgentFilter {
+	return &UserAgentFilter{
+		logger:    logger,
+		name:      name,
+		key:       key,
+		outKey:    outKey,
+		deleteKey: deleteKey,
+		parser:    parser,
+	}
+}
+
+// newUserAgentParser creates a parser with the regexes embedded in uap-go,
+// or with the ones read from a regexes.yaml of uap-core if the path is given.
+func newUserAgentParser(regexesPath string, cacheSize int) (*uaparser.Parser, error) {
+	options := []uaparser.Option{uaparser.WithCacheSize(cacheSize)}
+	if regexesPath != "" {
+		data, err := ioutil.ReadFile(regexesPath)
+		if err != nil {
+			return nil, err
+		}
+		definitions := uaparser.RegexDefinitions{}
+		err = yaml.Unmarshal(data, &definitions)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to parse %s: %s", regexesPath, err.Error()))
+		}
+		options = append(options, uaparser.WithRegexDefinitions(definitions))
+	}
+	return uaparser.New(options...)
+}
+
+func newUserAgentFilterFromConfig(logger *logging.Logger, config *ConfigElement, next Port) (Filter, error) {
+	deleteKey, err := config.GetBool("delete-key", false)
+	if err != nil {
+		return nil, err
+	}
+	cacheSize, err := config.GetInt("cache-size", 1024)
+	if err != nil {
+		return nil, err
+	}
+	parser, err := newUserAgentParser(config.Get("regexes", ""), cacheSize)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", config.String(), err.Error()))
+	}
+	key, err := recordAccessorFromConfig(config, "key", "user_agent")
+	if err != nil {
+		return nil, err
+	}
+	outKey, err := recordAccessorFromConfig(config, "out-key", "ua")
+	if err != nil {
+		return nil, err
+	}
+	return NewUserAgentFilter(logger, config.Arg, key, outKey, deleteKey, parser), nil
+}
+
+func init() {
+	RegisterFilter("useragent", newUserAgentFilterFromConfig)
+	RegisterFilterParams("useragent",
+		ParamSchema{Name: "key", Type: ParamString, Description: "variable holding the user-agent string", Default: "user_agent"},
+		ParamSchema{Name: "out-key", Type: ParamString, Description: "variable the result is stored in", Default: "ua"},
+		ParamSchema{Name: "regexes", Type: ParamString, Description: "regexes.yaml of uap-core; the built-in one if unspecified"},
+		ParamSchema{Name: "cache-size", Type: ParamInteger, Description: "number of the user agents cached", Default: "1024"},
+		ParamSchema{Name: "delete-key", Type: ParamBoolean, Description: "whether the original string is removed", Default: "false"},
+	)
+}
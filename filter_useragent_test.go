@@ -0,0 +1,55 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"testing"
+)
+
+func Test_UserAgentFilter(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("useragent")
+	parser, err := newUserAgentParser("", 16)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	filter := NewUserAgentFilter(logger, "ua", mustRecordAccessor("user_agent"), mustRecordAccessor("ua"), true, parser)
+	data := map[string]interface{}{
+		"user_agent": []byte("Mozilla/5.0 (iPhone; CPU iPhone OS 16_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.5 Mobile/15E148 Safari/604.1"),
+	}
+	_, err = filter.Filter([]FluentRecordSet{{Tag: "access", Records: []TinyFluentRecord{{Timestamp: 0, Data: data}}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, ok := data["user_agent"]; ok {
+		t.Fail()
+	}
+	ua, ok := data["ua"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("%+v", data)
+	}
+	browser := ua["browser"].(map[string]interface{})
+	os := ua["os"].(map[string]interface{})
+	device := ua["device"].(map[string]interface{})
+	if browser["family"] != "Mobile Safari" || browser["version"] != "16.5" || os["family"] != "iOS" || os["major"] != "16" || device["brand"] != "Apple" || device["family"] != "iPhone" {
+		t.Logf("%+v", ua)
+		t.Fail()
+	}
+}
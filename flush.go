@@ -0,0 +1,87 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// FlushOutputs tells the outputs that can flush at once to do so, and
+// returns the names of the ones told, by which their metrics are labeled if
+// they report their health.  The flushes are carried out by the spoolers
+// afterwards.
+func FlushOutputs(outputs []Output) []string {
+	flushed := make([]string, 0, len(outputs))
+	for _, output := range outputs {
+		if output, ok := output.(FlushableOutput); ok {
+			output.FlushNow()
+			name := output.String()
+			if output, ok := output.(HealthReportingOutput); ok {
+				name = output.Health().Name
+			}
+			flushed = append(flushed, name)
+		}
+	}
+	return flushed
+}
+
+// DrainOutputs flushes the outputs every interval until none of those that
+// report their health has anything buffered, or until the deadline, and
+// returns the bytes left buffered.  The inputs should have been stopped so
+// that nothing more is buffered.
+func DrainOutputs(outputs func() []Output, deadline time.Time, interval time.Duration) int64 {
+	for {
+		FlushOutputs(outputs())
+		time.Sleep(interval)
+		buffered := int64(0)
+		for _, output := range outputs() {
+			if output, ok := output.(HealthReportingOutput); ok {
+				buffered += output.Health().BufferedBytes
+			}
+		}
+		if buffered == 0 || !time.Now().Before(deadline) {
+			return buffered
+		}
+	}
+}
+
+// FlushHandler flushes the buffers of the outputs on POST, answering the
+// names of the outputs told to flush.
+type FlushHandler struct {
+	outputs func() []Output
+}
+
+func (handler *FlushHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flushed := FlushOutputs(handler.outputs())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"flushed": flushed})
+}
+
+// NewFlushHandler creates a FlushHandler; outputs returns the outputs to
+// flush, which may change by reloading.
+func NewFlushHandler(outputs func() []Output) *FlushHandler {
+	return &FlushHandler{outputs: outputs}
+}
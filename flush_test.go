@@ -0,0 +1,121 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_FlushHandler(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("flush")
+	tempDir, err := ioutil.TempDir("", "flush")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer listener.Close()
+	received := make(chan int, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		n, _ := conn.Read(make([]byte, 4096))
+		received <- n
+	}()
+	// never flushed by the interval within the test
+	output, err := NewForwardOutput(logger, listener.Addr().String(), 10*time.Millisecond, time.Second, time.Second, time.Hour, 0, tempDir+"/*.buf", 16777216, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	output.Start()
+	defer func() {
+		output.Stop()
+		output.WaitForShutdown()
+	}()
+	err = output.Emit([]FluentRecordSet{{Tag: "test", Records: []TinyFluentRecord{{Timestamp: 0, Data: map[string]interface{}{"a": "b"}}}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	handler := NewFlushHandler(func() []Output { return []Output{output, &healthReportingOutput{}} })
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/flush", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status: %d", recorder.Code)
+	}
+	timeout := time.After(5 * time.Second)
+	for {
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/api/flush", nil))
+		if recorder.Code != http.StatusOK || recorder.Body.String() != "{\"flushed\":[\""+listener.Addr().String()+"\"]}\n" {
+			t.Fatalf("unexpected response: %d %s", recorder.Code, recorder.Body.String())
+		}
+		select {
+		case n := <-received:
+			if n == 0 {
+				t.Fail()
+			}
+			return
+		case <-timeout:
+			t.Fatal("the buffer was not flushed")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// drainingOutput sends a chunk of its buffer on each flush.
+type drainingOutput struct {
+	healthReportingOutput
+	chunkSize int64
+}
+
+func (output *drainingOutput) FlushNow() {
+	output.health.BufferedBytes -= output.chunkSize
+	if output.health.BufferedBytes < 0 {
+		output.health.BufferedBytes = 0
+	}
+}
+
+func Test_DrainOutputs(t *testing.T) {
+	output := &drainingOutput{healthReportingOutput{health: OutputHealth{BufferedBytes: 300}}, 100}
+	outputs := func() []Output { return []Output{output} }
+	left := DrainOutputs(outputs, time.Now().Add(time.Minute), time.Millisecond)
+	if left != 0 || output.health.BufferedBytes != 0 {
+		t.Errorf("%d", left)
+	}
+	// gives up at the deadline
+	output = &drainingOutput{healthReportingOutput{health: OutputHealth{BufferedBytes: 300}}, 0}
+	left = DrainOutputs(outputs, time.Now().Add(20*time.Millisecond), time.Millisecond)
+	if left != 300 {
+		t.Errorf("%d", left)
+	}
+}
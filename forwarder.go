@@ -21,6 +21,7 @@ package fluentd_forwarder
 import (
 	"fmt"
 	"io"
+	"time"
 )
 
 type FluentRecord struct {
@@ -37,8 +38,16 @@ type TinyFluentRecord struct {
 type FluentRecordSet struct {
 	Tag     string
 	Records []TinyFluentRecord
+	// the span the records were received in if traced; the ports keep it
+	// for the record sets derived from the ones they are given
+	Trace SpanContext
 }
 
+// Port takes the record sets passed on by the inputs and the filters.  The
+// slice of the record sets and the slices of their records belong to the
+// caller, which may reuse them once Emit returns; a Port keeping them past
+// Emit, such as an output passing them to its own goroutine, keeps a copy
+// made by CopyRecordSets.  The data of the records may be kept.
 type Port interface {
 	Emit(recordSets []FluentRecordSet) error
 }
@@ -50,6 +59,83 @@ type Worker interface {
 	WaitForShutdown()
 }
 
+type Output interface {
+	Port
+	Worker
+}
+
+// ErrorReportingOutput is an Output that reports the records it fails to
+// serialize to the ErrorPort instead of dropping them.  The port may be
+// replaced while the output is running.
+type ErrorReportingOutput interface {
+	Output
+	SetErrorPort(port *ErrorPort)
+}
+
+// OutputHealth is the state of an output checked for the readiness.
+type OutputHealth struct {
+	// the name the metrics of the output are labeled with
+	Name string
+	// whether the last attempt to send to the destination succeeded
+	IsUpstreamUp  bool
+	BufferedBytes int64
+	// when the flush in progress started; zero if none is
+	FlushStartedAt time.Time
+	// when the oldest of the records not delivered yet were received; zero
+	// if there is none
+	OldestBufferedAt time.Time
+	// when the last successful flush completed; zero if none has
+	LastFlushedAt time.Time
+}
+
+// HealthReportingOutput is an Output that reports its state for the
+// readiness check.
+type HealthReportingOutput interface {
+	Output
+	Health() OutputHealth
+}
+
+// FlushableOutput is an Output that can be told to flush its buffer at once
+// rather than at the next flush interval.
+type FlushableOutput interface {
+	Output
+	FlushNow()
+}
+
+// HealthReportingInput is an input that can tell whether it is accepting
+// the connections.
+type HealthReportingInput interface {
+	Worker
+	IsListening() bool
+}
+
+// ConnectionAdmittingPort is a Port that limits the connections of the
+// inputs sending to it; release is called once the connection admitted is
+// closed.
+type ConnectionAdmittingPort interface {
+	Port
+	AdmitConnection() (release func(), ok bool)
+}
+
+// BatchingPort is a Port that takes the record sets to be passed on in
+// batches, coalesced by their size in bytes and by time; EmitBatched
+// returns the error of the batch passed on, if any, and Flush passes on the
+// batch at once.
+type BatchingPort interface {
+	Port
+	EmitBatched(recordSets []FluentRecordSet, size int64) error
+	Flush() error
+}
+
+// Filter transforms the record sets on their way to the next Port.
+// A filter may return more or fewer record sets than it was given.  A
+// filter that fails on some of the records returns RecordErrors for them
+// along with the rest.
+type Filter interface {
+	String() string
+	Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error)
+}
+
 type Disposable interface {
 	Dispose() error
 }
@@ -78,6 +164,8 @@ type Journal interface {
 	AddNewChunkListener(JournalChunkListener)
 	AddFlushListener(JournalChunkListener)
 	Flush(func(JournalChunk) interface{}) error
+	// Usage returns the number and the total size of the chunks
+	Usage() (int, int64)
 }
 
 type JournalGroup interface {
@@ -0,0 +1,135 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// HealthChecker answers the liveness and readiness probes.  The process is
+// live while all the inputs are listening, and ready while it is live, none
+// of the outputs has more than bufferWatermark bytes buffered, and at least
+// one of them could send the last time it tried.  A bufferWatermark of 0
+// disables the check of the buffers.
+type HealthChecker struct {
+	recovered       uintptr // accessed atomically
+	inputs          func() []Worker
+	outputs         func() []Output
+	bufferWatermark int64
+	// when the outputs started, by which they have to have flushed before
+	// getting ready; zero if not gated
+	recoverySince time.Time
+}
+
+// GateOnRecovery makes the process not ready until every output that has
+// anything buffered has flushed since the time, by which the chunks
+// recovered from the buffers have been delivered.  Once they all have, the
+// outputs no longer gate the readiness but by the watermark, including the
+// ones added by reloading.
+func (checker *HealthChecker) GateOnRecovery(since time.Time) {
+	checker.recoverySince = since
+}
+
+func (checker *HealthChecker) checkRecovery() error {
+	if checker.recoverySince.IsZero() || atomic.LoadUintptr(&checker.recovered) != 0 {
+		return nil
+	}
+	for _, output := range checker.outputs() {
+		output, ok := output.(HealthReportingOutput)
+		if !ok {
+			continue
+		}
+		if health := output.Health(); health.BufferedBytes > 0 && health.LastFlushedAt.Before(checker.recoverySince) {
+			return errors.New(fmt.Sprintf("%s has not flushed the buffer recovered on startup yet", output.String()))
+		}
+	}
+	atomic.StoreUintptr(&checker.recovered, 1)
+	return nil
+}
+
+func (checker *HealthChecker) Live() error {
+	for _, input := range checker.inputs() {
+		if input, ok := input.(HealthReportingInput); ok && !input.IsListening() {
+			return errors.New(fmt.Sprintf("%s is not listening", input.String()))
+		}
+	}
+	return nil
+}
+
+func (checker *HealthChecker) Ready() error {
+	err := checker.Live()
+	if err != nil {
+		return err
+	}
+	err = checker.checkRecovery()
+	if err != nil {
+		return err
+	}
+	checked, up := 0, 0
+	for _, output := range checker.outputs() {
+		output, ok := output.(HealthReportingOutput)
+		if !ok {
+			continue
+		}
+		health := output.Health()
+		if checker.bufferWatermark > 0 && health.BufferedBytes > checker.bufferWatermark {
+			return errors.New(fmt.Sprintf("%s has %d bytes buffered, more than %d", output.String(), health.BufferedBytes, checker.bufferWatermark))
+		}
+		checked += 1
+		if health.IsUpstreamUp {
+			up += 1
+		}
+	}
+	if checked > 0 && up == 0 {
+		return errors.New("no output can reach its destination")
+	}
+	return nil
+}
+
+func serveHealth(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (checker *HealthChecker) ServeLive(w http.ResponseWriter, r *http.Request) {
+	serveHealth(w, checker.Live())
+}
+
+func (checker *HealthChecker) ServeReady(w http.ResponseWriter, r *http.Request) {
+	serveHealth(w, checker.Ready())
+}
+
+// NewHealthChecker creates a HealthChecker; inputs and outputs return the
+// inputs and the outputs to check, which may change by reloading.
+func NewHealthChecker(inputs func() []Worker, outputs func() []Output, bufferWatermark int64) *HealthChecker {
+	return &HealthChecker{
+		inputs:          inputs,
+		outputs:         outputs,
+		bufferWatermark: bufferWatermark,
+	}
+}
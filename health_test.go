@@ -0,0 +1,107 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type healthReportingOutput struct {
+	recordingPort
+	health OutputHealth
+}
+
+func (output *healthReportingOutput) String() string       { return "output" }
+func (output *healthReportingOutput) Start()               {}
+func (output *healthReportingOutput) Stop()                {}
+func (output *healthReportingOutput) WaitForShutdown()     {}
+func (output *healthReportingOutput) Health() OutputHealth { return output.health }
+
+func Test_HealthChecker(t *testing.T) {
+	a := &healthReportingOutput{health: OutputHealth{IsUpstreamUp: true, BufferedBytes: 100}}
+	b := &healthReportingOutput{health: OutputHealth{IsUpstreamUp: false, BufferedBytes: 0}}
+	checker := NewHealthChecker(func() []Worker { return nil }, func() []Output { return []Output{a, b} }, 1000)
+	if checker.Live() != nil || checker.Ready() != nil {
+		t.Fail()
+	}
+	a.health.BufferedBytes = 1001
+	if checker.Ready() == nil {
+		t.Fail()
+	}
+	a.health = OutputHealth{IsUpstreamUp: false, BufferedBytes: 0}
+	if checker.Ready() == nil {
+		t.Fail()
+	}
+	recorder := httptest.NewRecorder()
+	checker.ServeReady(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fail()
+	}
+	recorder = httptest.NewRecorder()
+	checker.ServeLive(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fail()
+	}
+}
+
+func Test_HealthChecker_Input(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("health")
+	input, err := NewForwardInput(logger, "127.0.0.1:0", &recordingPort{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	checker := NewHealthChecker(func() []Worker { return []Worker{input} }, func() []Output { return nil }, 0)
+	input.Start()
+	if checker.Live() != nil {
+		t.Fail()
+	}
+	input.Stop()
+	input.WaitForShutdown()
+	if checker.Live() == nil {
+		t.Fail()
+	}
+}
+
+func Test_HealthChecker_GateOnRecovery(t *testing.T) {
+	started := time.Unix(1000, 0)
+	a := &healthReportingOutput{health: OutputHealth{IsUpstreamUp: true, BufferedBytes: 100}}
+	b := &healthReportingOutput{health: OutputHealth{IsUpstreamUp: true, BufferedBytes: 100, LastFlushedAt: started.Add(time.Second)}}
+	// nothing to recover
+	c := &healthReportingOutput{health: OutputHealth{IsUpstreamUp: true}}
+	outputs := []Output{a, b, c}
+	checker := NewHealthChecker(func() []Worker { return nil }, func() []Output { return outputs }, 0)
+	checker.GateOnRecovery(started)
+	if checker.Live() != nil || checker.Ready() == nil {
+		t.Fail()
+	}
+	a.health.LastFlushedAt = started.Add(2 * time.Second)
+	if checker.Ready() != nil {
+		t.Fail()
+	}
+	// the outputs added afterwards are not gated
+	outputs = append(outputs, &healthReportingOutput{health: OutputHealth{IsUpstreamUp: true, BufferedBytes: 100}})
+	if checker.Ready() != nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,88 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"context"
+	logging "github.com/op/go-logging"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HTTPServer serves the endpoints for monitoring and administering the
+// forwarder, such as /metrics.
+type HTTPServer struct {
+	logger   *logging.Logger
+	bind     string
+	listener net.Listener
+	server   *http.Server
+	wg       sync.WaitGroup
+}
+
+func (server *HTTPServer) String() string {
+	return "http:" + server.bind
+}
+
+func (server *HTTPServer) Start() {
+	server.wg.Add(1)
+	go func() {
+		defer server.wg.Done()
+		server.logger.Noticef("Serving HTTP on %s", server.listener.Addr().String())
+		err := server.server.Serve(server.listener)
+		if err != nil && err != http.ErrServerClosed {
+			server.logger.Errorf("%s: %s", LogComponent(server.String()), LogError(err))
+		}
+	}()
+}
+
+func (server *HTTPServer) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := server.server.Shutdown(ctx)
+	if err != nil {
+		server.logger.Errorf("%s: %s", LogComponent(server.String()), LogError(err))
+	}
+}
+
+func (server *HTTPServer) WaitForShutdown() {
+	server.wg.Wait()
+}
+
+// Addr returns the address actually listened on.
+func (server *HTTPServer) Addr() net.Addr {
+	return server.listener.Addr()
+}
+
+// NewHTTPServer starts listening on bind so that an address in use is
+// reported at once.
+func NewHTTPServer(logger *logging.Logger, bind string, handler http.Handler) (*HTTPServer, error) {
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		return nil, err
+	}
+	return &HTTPServer{
+		logger:   logger,
+		bind:     bind,
+		listener: listener,
+		server:   &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second},
+		wg:       sync.WaitGroup{},
+	}, nil
+}
@@ -20,39 +20,190 @@ package fluentd_forwarder
 
 import (
 	"bufio"
-	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	logging "github.com/op/go-logging"
-	"github.com/ugorji/go/codec"
 	"io"
 	"net"
-	"reflect"
+	"os"
+	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// forwardReadAhead is the number of the messages a connection reads ahead
+// of the one being passed on.
+const forwardReadAhead = 2
+
 type forwardClient struct {
-	input  *ForwardInput
-	logger *logging.Logger
-	conn   *net.TCPConn
-	codec  *codec.MsgpackHandle
-	dec    *codec.Decoder
+	records      int64 // accessed atomically, as are the following two
+	decodeErrors int64
+	lastActivity int64 // in UnixNano
+	connectedAt  time.Time
+	input        *ForwardInput
+	logger       *logging.Logger
+	conn         *net.TCPConn
+	// the shard of the counters the connection adds to, so that the
+	// connections do not contend on them
+	shard uint32
+	// frames the messages in msgpack for the decode pool
+	msgpack *msgpackReader
+	// the messages read ahead, and closed once done with them
+	messages chan *decodeJob
+	handled  chan struct{}
+	// the protocol of the connection, which is detected on the first
+	// message if auto, and the decoder of the messages in JSON
+	protocol string
+	jsonDec  *json.Decoder
+	reader   *countingReader
+	buffer   *bufio.Reader
+	// the bytes of the messages decoded so far
+	consumed int64
+	// why the forwarder closed the connection, if it did
+	closeReason atomic.Value // string
+	// the protocol mode of the first message
+	mode atomic.Value // string
+	// the counter of the records for the mode of the last message
+	lastMode    string
+	modeRecords *Counter
+	// releases the connection admitted by the port
+	release func()
 }
 
+// DefaultMaxMessageSize is the size in bytes of a message in msgpack the
+// forward inputs take at most unless max-message-size is given.
+const DefaultMaxMessageSize = 33554432
+
 type ForwardInput struct {
-	entries        int64 // This variable must be on 64-bit alignment. Otherwise atomic.AddInt64 will cause a crash on ARM and x86-32
+	nextShard      uint32 // the shard of the counters given to the next connection
+	metrics        forwardInputMetrics
+	tagMetrics     *TagMetrics
+	accounting     *lossAccounting
+	decodePool     *DecodePool
 	port           Port
+	batching       BatchingPort
 	logger         *logging.Logger
 	bind           string
 	listener       *net.TCPListener
-	codec          *codec.MsgpackHandle
-	clientsMtx     sync.Mutex
-	clients        map[*net.TCPConn]*forwardClient
+	protocol       string
+	socketOptions  SocketOptions
+	maxMessageSize int
+	// the connections being handled, each added and removed by the
+	// goroutine handling it; *net.TCPConn to *forwardClient
+	clients        sync.Map
 	wg             sync.WaitGroup
 	acceptChan     chan *net.TCPConn
 	shutdownChan   chan struct{}
 	isShuttingDown uintptr
+	isListening    uintptr
+}
+
+type forwardInputMetrics struct {
+	records     *Counter
+	bytes       *Counter
+	connections *Counter
+	openConns   *Gauge
+	emits       *Counter
+	emitErrors  *Counter
+	recordSize  *Histogram
+	chunkSize   *Histogram
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	n       int64 // accessed atomically; kept first for the 64-bit alignment
+	reader  io.Reader
+	counter *Counter
+	shard   uint32
+}
+
+func (reader *countingReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	if n > 0 {
+		reader.counter.AddShard(reader.shard, float64(n))
+		atomic.AddInt64(&reader.n, int64(n))
+	}
+	return n, err
+}
+
+// The modes of the forward protocol in which the messages are sent, which
+// label fluentd_forwarder_input_mode_connections_total and
+// fluentd_forwarder_input_mode_records_total.
+const (
+	// [tag, time, record]
+	ProtocolModeMessage = "message"
+	// [tag, [[time, record], ...]]
+	ProtocolModeForward = "forward"
+	// [tag, msgpack stream of [time, record]]
+	ProtocolModePackedForward = "packed_forward"
+	// [tag, gzipped msgpack stream, {"compressed": "gzip"}], which is not
+	// supported
+	ProtocolModeCompressedPackedForward = "compressed_packed_forward"
+)
+
+// protocolMode returns the mode of the forward protocol in which the
+// message is sent, or "" if unknown.
+func protocolMode(v []interface{}) string {
+	switch v[1].(type) {
+	case uint64, float64:
+		return ProtocolModeMessage
+	case []interface{}:
+		return ProtocolModeForward
+	case []byte:
+		if len(v) > 2 {
+			if option, ok := v[2].(map[string]interface{}); ok && option["compressed"] != nil {
+				return ProtocolModeCompressedPackedForward
+			}
+		}
+		return ProtocolModePackedForward
+	}
+	return ""
+}
+
+// The protocols in which the forward input takes the messages.
+const (
+	// detected on each connection by the first byte, as a message in JSON
+	// starts with "[", which cannot start one in msgpack
+	ForwardProtocolAuto    = "auto"
+	ForwardProtocolMsgpack = "msgpack"
+	ForwardProtocolJSON    = "json"
+)
+
+// CheckForwardProtocol checks the protocol of the forward input.
+func CheckForwardProtocol(protocol string) error {
+	switch protocol {
+	case ForwardProtocolAuto, ForwardProtocolMsgpack, ForwardProtocolJSON:
+		return nil
+	}
+	return errors.New(fmt.Sprintf("unknown protocol: %s", protocol))
+}
+
+// normalizeJSONValue turns the value decoded from JSON into what would be
+// decoded from msgpack: the non-negative integers into uint64, the
+// negative ones into int64 and the rest of the numbers into float64.
+func normalizeJSONValue(v interface{}) interface{} {
+	switch v_ := v.(type) {
+	case json.Number:
+		if u, err := strconv.ParseUint(v_.String(), 10, 64); err == nil {
+			return u
+		}
+		if i, err := strconv.ParseInt(v_.String(), 10, 64); err == nil {
+			return i
+		}
+		f, _ := v_.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range v_ {
+			v_[k] = normalizeJSONValue(e)
+		}
+	case []interface{}:
+		for i, e := range v_ {
+			v_[i] = normalizeJSONValue(e)
+		}
+	}
+	return v
 }
 
 type EntryCountTopic struct{}
@@ -87,7 +238,6 @@ func (c *forwardClient) decodeRecordSet(tag []byte, entries []interface{}) (Flue
 		if !ok {
 			return FluentRecordSet{}, errors.New("Failed to decode data field")
 		}
-		coerceInPlace(data)
 		records[i] = TinyFluentRecord{
 			Timestamp: timestamp,
 			Data:      data,
@@ -99,26 +249,82 @@ func (c *forwardClient) decodeRecordSet(tag []byte, entries []interface{}) (Flue
 	}, nil
 }
 
-func (c *forwardClient) decodeEntries() ([]FluentRecordSet, error) {
-	v := []interface{}{nil, nil, nil}
-	err := c.dec.Decode(&v)
+// detectProtocol tells the protocol of the connection by its first byte
+// if it is auto.
+func (c *forwardClient) detectProtocol() error {
+	if c.protocol != ForwardProtocolAuto {
+		return nil
+	}
+	b, err := c.buffer.Peek(1)
+	if err != nil {
+		return err
+	}
+	c.protocol = ForwardProtocolMsgpack
+	if b[0] == '[' {
+		c.protocol = ForwardProtocolJSON
+	}
+	return nil
+}
+
+// decodeJSONMessage decodes the next message in JSON into what the codec
+// would decode from msgpack.
+func (c *forwardClient) decodeJSONMessage() ([]interface{}, error) {
+	if c.jsonDec == nil {
+		c.jsonDec = json.NewDecoder(c.buffer)
+		c.jsonDec.UseNumber()
+	}
+	v := []interface{}{}
+	err := c.jsonDec.Decode(&v)
 	if err != nil {
 		return nil, err
 	}
+	normalizeJSONValue(v)
+	// the tag is decoded from msgpack as the bytes
+	if len(v) > 0 {
+		if tag, ok := v[0].(string); ok {
+			v[0] = []byte(tag)
+		}
+	}
+	return v, nil
+}
+
+// offset returns the number of the bytes of the messages decoded so far.
+func (c *forwardClient) offset() int64 {
+	if c.jsonDec != nil {
+		return c.jsonDec.InputOffset()
+	}
+	return atomic.LoadInt64(&c.reader.n) - int64(c.buffer.Buffered())
+}
+
+// decodeJSONEntries decodes the records of the next message in JSON, and
+// returns them along with the mode and the option of the message.
+func (c *forwardClient) decodeJSONEntries() (string, []FluentRecordSet, interface{}, error) {
+	v, err := c.decodeJSONMessage()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if len(v) < 2 {
+		return "", nil, nil, errors.New("Unexpected payload format")
+	}
 	tag, ok := v[0].([]byte)
 	if !ok {
-		return nil, errors.New("Failed to decode tag field")
+		return "", nil, nil, errors.New("Failed to decode tag field")
+	}
+	mode := protocolMode(v)
+	if mode == ProtocolModeMessage && len(v) < 3 {
+		return "", nil, nil, errors.New("Failed to decode data field")
 	}
 
 	var retval []FluentRecordSet
+	// the option of the forward modes
+	option := interface{}(nil)
 	switch timestamp_or_entries := v[1].(type) {
 	case uint64:
 		timestamp := timestamp_or_entries
 		data, ok := v[2].(map[string]interface{})
 		if !ok {
-			return nil, errors.New("Failed to decode data field")
+			return "", nil, nil, errors.New("Failed to decode data field")
 		}
-		coerceInPlace(data)
 		retval = []FluentRecordSet{
 			{
 				Tag: string(tag), // XXX: byte => rune
@@ -134,7 +340,7 @@ func (c *forwardClient) decodeEntries() ([]FluentRecordSet, error) {
 		timestamp := uint64(timestamp_or_entries)
 		data, ok := v[2].(map[string]interface{})
 		if !ok {
-			return nil, errors.New("Failed to decode data field")
+			return "", nil, nil, errors.New("Failed to decode data field")
 		}
 		retval = []FluentRecordSet{
 			{
@@ -148,54 +354,270 @@ func (c *forwardClient) decodeEntries() ([]FluentRecordSet, error) {
 			},
 		}
 	case []interface{}:
-		if !ok {
-			return nil, errors.New("Unexpected payload format")
-		}
 		recordSet, err := c.decodeRecordSet(tag, timestamp_or_entries)
 		if err != nil {
-			return nil, err
+			return "", nil, nil, err
+		}
+		if len(v) > 2 {
+			option = v[2]
+			recordSet.Trace = traceparentFromOption(option)
 		}
 		retval = []FluentRecordSet{recordSet}
-	case []byte:
-		entries := make([]interface{}, 0)
-		reader := bytes.NewReader(timestamp_or_entries)
-		dec := codec.NewDecoder(reader, c.codec)
-		for reader.Len() > 0 { // codec.Decoder doesn't return EOF.
-			entry := []interface{}{}
-			if err != dec.Decode(&entry) {
-				if err == io.EOF { // in case codec.Decoder changes its behavior
-					break
-				}
-				return nil, err
+	default:
+		return "", nil, nil, errors.New(fmt.Sprintf("Unknown type: %t", timestamp_or_entries))
+	}
+	return mode, retval, option, nil
+}
+
+// decodeMsgpackMessage decodes the records of a message in msgpack read by
+// the reader straight into the records, and returns them along with the
+// mode and the option of the message; the mode is returned on the error as
+// well if known.  The entries of a packed forward message are decoded by
+// entries once the option telling whether they are compressed is read.
+func decodeMsgpackMessage(reader *msgpackReader, entries *msgpackReader, recordSize *Histogram) (string, []FluentRecordSet, interface{}, error) {
+	n, err := reader.readArrayLength()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if n < 2 {
+		return "", nil, nil, errors.New("Unexpected payload format")
+	}
+	v, err := reader.readValue(1)
+	if err != nil {
+		return "", nil, nil, unexpectedEOF(err)
+	}
+	tag, ok := v.(string)
+	if !ok {
+		return "", nil, nil, errors.New("Failed to decode tag field")
+	}
+	b, err := reader.peekByte()
+	if err != nil {
+		return "", nil, nil, unexpectedEOF(err)
+	}
+	mode := ""
+	recordSet := FluentRecordSet{Tag: tag}
+	packed := ([]byte)(nil)
+	// the option of the forward modes
+	option := interface{}(nil)
+	read := 2
+	switch {
+	case (b >= 0x90 && b <= 0x9f) || b == 0xdc || b == 0xdd:
+		mode = ProtocolModeForward
+		entries, err := reader.readArrayLength()
+		if err != nil {
+			return mode, nil, nil, unexpectedEOF(err)
+		}
+		recordSet.Records = getRecords(minInt(entries, msgpackMaxPrealloc))
+		for i := 0; i < entries; i += 1 {
+			record, err := reader.readEntry()
+			if err != nil {
+				return mode, nil, nil, unexpectedEOF(err)
 			}
-			entries = append(entries, entry)
+			recordSet.Records = append(recordSet.Records, record)
 		}
-		recordSet, err := c.decodeRecordSet(tag, entries)
+	case (b >= 0xa0 && b <= 0xbf) || (b >= 0xc4 && b <= 0xc6) || (b >= 0xd9 && b <= 0xdb):
+		mode = ProtocolModePackedForward
+		size, err := reader.readBytesLength()
 		if err != nil {
-			return nil, err
+			return mode, nil, nil, unexpectedEOF(err)
+		}
+		packed, err = reader.next(size)
+		if err != nil {
+			return mode, nil, nil, unexpectedEOF(err)
 		}
-		retval = []FluentRecordSet{recordSet}
 	default:
-		return nil, errors.New(fmt.Sprintf("Unknown type: %t", timestamp_or_entries))
+		if n < 3 {
+			return "", nil, nil, errors.New("Failed to decode data field")
+		}
+		mode = ProtocolModeMessage
+		v, err := reader.readValue(1)
+		if err != nil {
+			return mode, nil, nil, unexpectedEOF(err)
+		}
+		timestamp, ok := eventTime(v)
+		if !ok {
+			return mode, nil, nil, errors.New(fmt.Sprintf("Unknown type: %t", v))
+		}
+		b, err := reader.peekByte()
+		if err != nil {
+			return mode, nil, nil, unexpectedEOF(err)
+		}
+		if !isMsgpackMap(b) {
+			return mode, nil, nil, errors.New("Failed to decode data field")
+		}
+		data, err := reader.readMap(1)
+		if err != nil {
+			return mode, nil, nil, unexpectedEOF(err)
+		}
+		recordSet.Records = append(getRecords(1), TinyFluentRecord{Timestamp: timestamp, Data: data})
+		read = 3
+	}
+	for ; read < n; read += 1 {
+		v, err := reader.readValue(1)
+		if err != nil {
+			return mode, nil, nil, unexpectedEOF(err)
+		}
+		// the message mode takes no option
+		if read == 2 {
+			option = v
+		}
+	}
+	if mode == ProtocolModePackedForward {
+		if m, ok := option.(map[string]interface{}); ok && m["compressed"] != nil {
+			return ProtocolModeCompressedPackedForward, nil, nil, errors.New("Compressed entries are not supported")
+		}
+		entries.reset(packed)
+		recordSet.Records = getRecords(0)
+		for entries.remaining() > 0 {
+			n := entries.remaining()
+			record, err := entries.readEntry()
+			if err != nil {
+				return mode, nil, nil, err
+			}
+			recordSize.Observe(float64(n - entries.remaining()))
+			recordSet.Records = append(recordSet.Records, record)
+		}
+	}
+	if mode != ProtocolModeMessage {
+		recordSet.Trace = traceparentFromOption(option)
+	}
+	return mode, append(getRecordSets(1), recordSet), option, nil
+}
+
+// readMessage reads the next message of the connection.  The one in
+// msgpack is handed to the decode pool as it is read, and the one in JSON
+// is decoded at once; the error is the one of reading it, or of decoding
+// it in JSON.
+func (c *forwardClient) readMessage() (*decodeJob, error) {
+	job := &decodeJob{done: make(chan struct{}), recordSize: c.input.metrics.recordSize}
+	err := c.detectProtocol()
+	if err == nil && c.protocol == ForwardProtocolJSON {
+		job.mode, job.recordSets, job.option, job.err = c.decodeJSONEntries()
+	} else if err == nil {
+		job.frame, err = c.msgpack.readFrame(getFrame())
+	}
+	if err != nil {
+		job.err = err
+	}
+	job.size = c.offset() - c.consumed
+	c.consumed += job.size
+	if job.frame == nil || job.err != nil {
+		putFrame(job.frame)
+		job.frame = nil
+		close(job.done)
+		return job, job.err
+	}
+	c.input.decodePool.decode(job)
+	return job, nil
+}
+
+// readMessages reads the messages of the connection ahead of the ones
+// being emitted, and passes them on in the order they are read until it
+// fails to read one.
+func (c *forwardClient) readMessages() {
+	c.input.wg.Add(1)
+	go func() {
+		defer func() {
+			close(c.messages)
+			c.input.wg.Done()
+		}()
+		for {
+			job, err := c.readMessage()
+			select {
+			case c.messages <- job:
+			case <-c.handled:
+				return
+			}
+			if err_, ok := err.(net.Error); err != nil && !(ok && err_.Temporary()) {
+				return
+			}
+		}
+	}()
+}
+
+// decodeEntries returns the records of the next message and the bytes the
+// message takes.
+func (c *forwardClient) decodeEntries() ([]FluentRecordSet, int64, error) {
+	job, ok := <-c.messages
+	if !ok {
+		return nil, 0, io.EOF
+	}
+	<-job.done
+	c.observeMode(job.mode)
+	if job.err != nil {
+		return nil, 0, job.err
+	}
+	retval := job.recordSets
+	size := job.size
+	c.observeSize(job.mode, size, recordCount(retval))
+	if sender := accountingSender(job.option); sender != "" {
+		retval = c.input.accounting.received(sender, retval)
+	}
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+	for _, recordSet := range retval {
+		atomic.AddInt64(&c.records, int64(len(recordSet.Records)))
+		c.input.metrics.records.AddShard(c.shard, float64(len(recordSet.Records)))
+		c.modeRecords.AddShard(c.shard, float64(len(recordSet.Records)))
+		c.input.tagMetrics.ObserveShard(c.shard, recordSet.Tag, len(recordSet.Records), size)
+	}
+	return retval, size, nil
+}
+
+// observeMode counts the connection by the mode of its first message, and
+// prepares the counter of the records for the mode of the message.
+func (c *forwardClient) observeMode(mode string) {
+	if mode == "" || mode == c.lastMode {
+		return
+	}
+	if c.lastMode == "" {
+		c.mode.Store(mode)
+		inputModeConns.With(c.input.bind, mode).Inc()
+	}
+	c.lastMode = mode
+	c.modeRecords = inputModeRecords.With(c.input.bind, mode)
+}
+
+// observeSize observes the size of the message and of its records.  The
+// records of a packed forward message are observed as they are decoded, and
+// those of a forward message, which are decoded at once, are observed by
+// their mean size.
+func (c *forwardClient) observeSize(mode string, size int64, records int) {
+	c.input.metrics.chunkSize.Observe(float64(size))
+	switch mode {
+	case ProtocolModeMessage:
+		c.input.metrics.recordSize.Observe(float64(size))
+	case ProtocolModeForward:
+		if records > 0 {
+			c.input.metrics.recordSize.ObserveN(float64(size)/float64(records), records)
+		}
 	}
-	atomic.AddInt64(&c.input.entries, int64(len(retval)))
-	return retval, nil
 }
 
 func (c *forwardClient) startHandling() {
 	c.input.wg.Add(1)
 	go func() {
+		reason := ""
 		defer func() {
 			err := c.conn.Close()
 			if err != nil {
-				c.logger.Debugf("Close: %s", err.Error())
+				c.logger.Debugf("Close: %s", LogError(err))
 			}
 			c.input.markDischarged(c)
+			if c.release != nil {
+				c.release()
+			}
+			if closeReason, ok := c.closeReason.Load().(string); ok {
+				reason = closeReason
+			}
+			c.audit(AuditClose, reason)
 			c.input.wg.Done()
 		}()
-		c.input.logger.Infof("Started handling connection from %s", c.conn.RemoteAddr().String())
+		c.input.logger.Infof("Started handling connection from %s", LogRemoteAddr(c.conn.RemoteAddr()))
+		c.audit(AuditAccept, "")
+		c.readMessages()
+		defer close(c.handled)
 		for {
-			recordSets, err := c.decodeEntries()
+			recordSets, size, err := c.decodeEntries()
 			if err != nil {
 				err_, ok := err.(net.Error)
 				if ok {
@@ -205,40 +627,148 @@ func (c *forwardClient) startHandling() {
 					}
 				}
 				if err == io.EOF {
-					c.logger.Infof("Client %s closed the connection", c.conn.RemoteAddr().String())
+					c.logger.Infof("Client %s closed the connection", LogRemoteAddr(c.conn.RemoteAddr()))
+					reason = "closed by the client"
 				} else {
-					c.logger.Error(err.Error())
+					if !ok {
+						atomic.AddInt64(&c.decodeErrors, 1)
+						droppedMessages.With(DropDecodeError).Inc()
+						reason = "decode error: " + err.Error()
+					} else {
+						reason = "read error: " + err.Error()
+					}
+					c.logger.Error(LogError(err))
 				}
 				break
 			}
 
 			if len(recordSets) > 0 {
-				err_ := c.input.port.Emit(recordSets)
+				c.traceRecords(recordSets)
+				c.input.metrics.emits.Inc()
+				spans := c.startReceiveSpans(recordSets)
+				err_ := c.input.emit(recordSets, size)
+				now := time.Now()
+				for _, span := range spans {
+					span.Finish(now)
+				}
 				if err_ != nil {
+					c.input.metrics.emitErrors.Inc()
+					// the batch failed is counted by the port
+					if c.input.batching == nil {
+						countDropped(DropEmitError, recordCount(recordSets))
+					}
 					c.logger.Error(err_.Error())
+					reason = "emit error: " + err_.Error()
 					break
 				}
+				// the ports keep none of the record sets past Emit
+				releaseRecordSets(recordSets)
 			}
 		}
-		c.input.logger.Infof("Ended handling connection from %s", c.conn.RemoteAddr().String())
+		c.input.logger.Infof("Ended handling connection from %s", LogRemoteAddr(c.conn.RemoteAddr()))
 	}()
 }
 
-func (c *forwardClient) shutdown() {
+// traceRecords logs the records received if they are being traced.
+func (c *forwardClient) traceRecords(recordSets []FluentRecordSet) {
+	for _, recordSet := range recordSets {
+		if !DefaultRecordTracer.Matches(recordSet.Tag) {
+			continue
+		}
+		for _, record := range recordSet.Records {
+			DefaultRecordTracer.Tracef(recordSet.Tag, "received by %s from %s: %v", c.input.String(), c.conn.RemoteAddr().String(), record.Data)
+		}
+	}
+}
+
+// startReceiveSpans starts the spans of the receipt of the record sets,
+// which the records carry on to the outputs.
+func (c *forwardClient) startReceiveSpans(recordSets []FluentRecordSet) []*Span {
+	if DefaultTracer == nil {
+		return nil
+	}
+	now := time.Now()
+	spans := make([]*Span, 0, len(recordSets))
+	for i, recordSet := range recordSets {
+		span := DefaultTracer.StartSpan("receive", recordSet.Trace, now)
+		if span == nil {
+			continue
+		}
+		span.Attributes["tag"] = recordSet.Tag
+		span.Attributes["records"] = strconv.Itoa(len(recordSet.Records))
+		span.Attributes["remote_addr"] = c.conn.RemoteAddr().String()
+		recordSets[i].Trace = span.Context
+		spans = append(spans, span)
+	}
+	return spans
+}
+
+// audit records the event of the connection to the audit log.
+func (c *forwardClient) audit(event string, reason string) {
+	auditEvent := AuditEvent{
+		Time:       time.Now(),
+		Event:      event,
+		Listener:   c.input.bind,
+		RemoteAddr: c.conn.RemoteAddr().String(),
+		Auth:       "none",
+		Reason:     reason,
+	}
+	if event == AuditClose {
+		auditEvent.Records = atomic.LoadInt64(&c.records)
+		auditEvent.Bytes = atomic.LoadInt64(&c.reader.n)
+	}
+	err := DefaultAuditLog.Record(auditEvent)
+	if err != nil {
+		c.logger.Errorf("Failed to write the audit log: %s", LogError(err))
+	}
+}
+
+// shutdown closes the connection for the reason.
+func (c *forwardClient) shutdown(reason string) {
+	c.closeReason.Store(reason)
 	err := c.conn.Close()
 	if err != nil {
-		c.input.logger.Infof("Error during closing connection: %s", err.Error())
+		c.input.logger.Infof("Error during closing connection: %s", LogError(err))
+	}
+}
+
+func (c *forwardClient) stats() ConnectionStats {
+	mode, _ := c.mode.Load().(string)
+	return ConnectionStats{
+		Listener:     c.input.bind,
+		RemoteAddr:   c.conn.RemoteAddr().String(),
+		ConnectedAt:  c.connectedAt,
+		LastActivity: time.Unix(0, atomic.LoadInt64(&c.lastActivity)),
+		Records:      atomic.LoadInt64(&c.records),
+		Bytes:        atomic.LoadInt64(&c.reader.n),
+		DecodeErrors: atomic.LoadInt64(&c.decodeErrors),
+		Mode:         mode,
 	}
 }
 
-func newForwardClient(input *ForwardInput, logger *logging.Logger, conn *net.TCPConn, _codec *codec.MsgpackHandle) *forwardClient {
+func newForwardClient(input *ForwardInput, logger *logging.Logger, conn *net.TCPConn) *forwardClient {
+	shard := atomic.AddUint32(&input.nextShard, 1)
+	reader := &countingReader{0, conn, input.metrics.bytes, shard}
+	buffer := bufio.NewReaderSize(reader, input.socketOptions.ReadBufferSize)
+	now := time.Now()
 	c := &forwardClient{
-		input:  input,
-		logger: logger,
-		conn:   conn,
-		codec:  _codec,
-		dec:    codec.NewDecoder(bufio.NewReader(conn), _codec),
+		records:      0,
+		decodeErrors: 0,
+		lastActivity: now.UnixNano(),
+		connectedAt:  now,
+		input:        input,
+		logger:       logger,
+		conn:         conn,
+		shard:        shard,
+		protocol:     input.protocol,
+		reader:       reader,
+		buffer:       buffer,
+		consumed:     0,
 	}
+	c.msgpack = newMsgpackStreamReader(buffer)
+	c.msgpack.maxFrameSize = input.maxMessageSize
+	c.messages = make(chan *decodeJob, forwardReadAhead)
+	c.handled = make(chan struct{})
 	input.markCharged(c)
 	return c
 }
@@ -248,6 +778,7 @@ func (input *ForwardInput) spawnAcceptor() {
 	input.wg.Add(1)
 	go func() {
 		defer func() {
+			atomic.StoreUintptr(&input.isListening, 0)
 			close(input.acceptChan)
 			input.wg.Done()
 		}()
@@ -255,11 +786,11 @@ func (input *ForwardInput) spawnAcceptor() {
 		for {
 			conn, err := input.listener.AcceptTCP()
 			if err != nil {
-				input.logger.Notice(err.Error())
+				input.logger.Notice(LogError(err))
 				break
 			}
 			if conn != nil {
-				input.logger.Noticef("Connected from %s", conn.RemoteAddr().String())
+				input.logger.Noticef("Connected from %s", LogRemoteAddr(conn.RemoteAddr()))
 				input.acceptChan <- conn
 			} else {
 				input.logger.Notice("AcceptTCP returned nil; something went wrong")
@@ -285,13 +816,26 @@ func (input *ForwardInput) spawnDaemon() {
 			case conn := <-input.acceptChan:
 				if conn != nil {
 					input.logger.Notice("Got conn from acceptChan")
-					newForwardClient(input, input.logger, conn, input.codec).startHandling()
+					release, ok := input.admitConnection()
+					if !ok {
+						input.logger.Warningf("Rejected the connection from %s, as its pipeline has reached max-connections", LogRemoteAddr(conn.RemoteAddr()))
+						conn.Close()
+						continue
+					}
+					err := input.socketOptions.apply(conn)
+					if err != nil {
+						input.logger.Warningf("Failed to set the socket options of the connection from %s: %s", LogRemoteAddr(conn.RemoteAddr()), LogError(err))
+					}
+					c := newForwardClient(input, input.logger, conn)
+					c.release = release
+					c.startHandling()
 				}
 			case <-input.shutdownChan:
 				input.listener.Close()
-				for _, client := range input.clients {
-					client.shutdown()
-				}
+				input.clients.Range(func(_, c interface{}) bool {
+					c.(*forwardClient).shutdown("shutting down")
+					return true
+				})
 				break loop
 			}
 		}
@@ -299,22 +843,85 @@ func (input *ForwardInput) spawnDaemon() {
 	}()
 }
 
+// admitConnection asks the port whether it takes another connection.
+func (input *ForwardInput) admitConnection() (func(), bool) {
+	if port, ok := input.port.(ConnectionAdmittingPort); ok {
+		return port.AdmitConnection()
+	}
+	return nil, true
+}
+
+// emit passes the record sets of the message of the size on to the port,
+// in a batch if coalescing.
+func (input *ForwardInput) emit(recordSets []FluentRecordSet, size int64) error {
+	if input.batching != nil {
+		return input.batching.EmitBatched(recordSets, size)
+	}
+	return input.port.Emit(recordSets)
+}
+
 func (input *ForwardInput) markCharged(c *forwardClient) {
-	input.clientsMtx.Lock()
-	defer input.clientsMtx.Unlock()
-	input.clients[c.conn] = c
+	input.clients.Store(c.conn, c)
+	input.metrics.connections.Inc()
+	input.metrics.openConns.Inc()
 }
 
 func (input *ForwardInput) markDischarged(c *forwardClient) {
-	input.clientsMtx.Lock()
-	defer input.clientsMtx.Unlock()
-	delete(input.clients, c.conn)
+	input.clients.Delete(c.conn)
+	input.metrics.openConns.Dec()
+}
+
+func (input *ForwardInput) Connections() []ConnectionStats {
+	retval := make([]ConnectionStats, 0)
+	input.clients.Range(func(_, c interface{}) bool {
+		retval = append(retval, c.(*forwardClient).stats())
+		return true
+	})
+	return retval
+}
+
+func (input *ForwardInput) CloseConnection(remoteAddr string) bool {
+	closed := false
+	input.clients.Range(func(_, c_ interface{}) bool {
+		c := c_.(*forwardClient)
+		if c.conn.RemoteAddr().String() == remoteAddr {
+			input.logger.Noticef("Closing the connection from %s", LogRemoteAddr(c.conn.RemoteAddr()))
+			c.shutdown("closed by the administrator")
+			closed = true
+			return false
+		}
+		return true
+	})
+	return closed
 }
 
 func (input *ForwardInput) String() string {
 	return "input"
 }
 
+func (input *ForwardInput) PluginInfo() PluginInfo {
+	return PluginInfo{
+		Category:    "input",
+		Type:        "forward",
+		EmitRecords: int64(input.metrics.records.Value()),
+		EmitCount:   int64(input.metrics.emits.Value()),
+	}
+}
+
+func (input *ForwardInput) IsListening() bool {
+	return atomic.LoadUintptr(&input.isListening) != 0
+}
+
+// ListenerFile returns the address the input binds to and a duplicate of
+// its listening socket, to be handed over to another process.
+func (input *ForwardInput) ListenerFile() (string, *os.File, error) {
+	file, err := input.listener.File()
+	if err != nil {
+		return "", nil, err
+	}
+	return input.bind, file, nil
+}
+
 func (input *ForwardInput) Start() {
 	input.spawnAcceptor()
 	input.spawnDaemon()
@@ -322,6 +929,9 @@ func (input *ForwardInput) Start() {
 
 func (input *ForwardInput) WaitForShutdown() {
 	input.wg.Wait()
+	if input.batching != nil {
+		input.batching.Flush()
+	}
 }
 
 func (input *ForwardInput) Stop() {
@@ -330,18 +940,40 @@ func (input *ForwardInput) Stop() {
 	}
 }
 
+// SetProtocol sets the protocol in which the messages are taken, which is
+// ForwardProtocolAuto by default.  It must be called before the input is
+// started.
+func (input *ForwardInput) SetProtocol(protocol string) {
+	input.protocol = protocol
+}
+
+// SetSocketOptions sets the options of the connections accepted, which are
+// DefaultSocketOptions by default.  It must be called before the input is
+// started.
+func (input *ForwardInput) SetSocketOptions(options SocketOptions) {
+	input.socketOptions = options
+}
+
+// SetMaxMessageSize sets the size in bytes of a message in msgpack taken
+// at most, beyond which the connection is closed; unlimited if 0.  It is
+// DefaultMaxMessageSize by default, and must be set before the input is
+// started.
+func (input *ForwardInput) SetMaxMessageSize(size int) {
+	input.maxMessageSize = size
+}
+
+// SetCoalescing makes the input coalesce the record sets received into
+// batches of the size in bytes, each passed on once it reaches the size or
+// the interval passes since the first record set in it was received.  It
+// must be called before the input is started.
+func (input *ForwardInput) SetCoalescing(interval time.Duration, size int64) {
+	input.batching = NewCoalescingPort(input.logger, input.bind, input.port, interval, size)
+}
+
 func NewForwardInput(logger *logging.Logger, bind string, port Port) (*ForwardInput, error) {
-	_codec := codec.MsgpackHandle{}
-	_codec.MapType = reflect.TypeOf(map[string]interface{}(nil))
-	_codec.RawToString = false
-	addr, err := net.ResolveTCPAddr("tcp", bind)
-	if err != nil {
-		logger.Error(err.Error())
-		return nil, err
-	}
-	listener, err := net.ListenTCP("tcp", addr)
+	listener, err := ListenTCP(bind)
 	if err != nil {
-		logger.Error(err.Error())
+		logger.Error(LogError(err))
 		return nil, err
 	}
 	return &ForwardInput{
@@ -349,13 +981,27 @@ func NewForwardInput(logger *logging.Logger, bind string, port Port) (*ForwardIn
 		logger:         logger,
 		bind:           bind,
 		listener:       listener,
-		codec:          &_codec,
-		clients:        make(map[*net.TCPConn]*forwardClient),
-		clientsMtx:     sync.Mutex{},
-		entries:        0,
+		protocol:       ForwardProtocolAuto,
+		socketOptions:  DefaultSocketOptions,
+		maxMessageSize: DefaultMaxMessageSize,
+		clients:        sync.Map{},
+		tagMetrics:     DefaultTagMetrics,
+		accounting:     newLossAccounting(logger, bind),
+		decodePool:     DefaultDecodePool,
+		metrics: forwardInputMetrics{
+			records:     inputRecords.With(bind),
+			bytes:       inputBytes.With(bind),
+			connections: inputConnections.With(bind),
+			openConns:   inputOpenConns.With(bind),
+			emits:       inputEmits.With(bind),
+			emitErrors:  inputEmitErrors.With(bind),
+			recordSize:  inputRecordSize.With(bind),
+			chunkSize:   inputChunkSize.With(bind),
+		},
 		wg:             sync.WaitGroup{},
 		acceptChan:     make(chan *net.TCPConn),
 		shutdownChan:   make(chan struct{}),
 		isShuttingDown: uintptr(0),
+		isListening:    uintptr(1),
 	}, nil
 }
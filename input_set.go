@@ -0,0 +1,226 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type inputSetEntry struct {
+	section *ConfigElement
+	input   Worker
+}
+
+// InputSet runs the inputs of the input sections, each of which emits to
+// the label named by its "label" parameter.  On reloading, the inputs whose
+// sections are unchanged keep running along with their connections, and the
+// others are stopped, created again or added.
+type InputSet struct {
+	logger    *logging.Logger
+	label     func(name string) (Port, error)
+	mtx       sync.Mutex
+	entries   map[string]inputSetEntry
+	isStarted bool
+	isStopped bool
+}
+
+func (set *InputSet) String() string {
+	return "inputs"
+}
+
+// Inputs returns the inputs currently running.
+func (set *InputSet) Inputs() []Worker {
+	set.mtx.Lock()
+	defer set.mtx.Unlock()
+	retval := make([]Worker, 0, len(set.entries))
+	for _, key := range set.keys() {
+		retval = append(retval, set.entries[key].input)
+	}
+	return retval
+}
+
+func (set *InputSet) keys() []string {
+	keys := make([]string, 0, len(set.entries))
+	for key := range set.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (set *InputSet) newInput(section *ConfigElement) (Worker, error) {
+	label, err := set.label(section.Get("label", ""))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", section.String(), err.Error()))
+	}
+	return NewInput(inputLogger(set.logger, section), section, label)
+}
+
+// inputLogger returns the logger of the input of the section, which also
+// logs the address it listens on, if any.
+func inputLogger(logger *logging.Logger, section *ConfigElement) *logging.Logger {
+	name := componentName(section)
+	fields := []LogField{{Key: "input", Value: name}}
+	if section.Has("listen-on") {
+		fields = append(fields, LogField{Key: "listener", Value: section.Get("listen-on", "")})
+	}
+	return NewComponentLogger(logger, name, fields...)
+}
+
+func (set *InputSet) Start() {
+	set.mtx.Lock()
+	defer set.mtx.Unlock()
+	set.isStarted = true
+	for _, entry := range set.entries {
+		entry.input.Start()
+	}
+}
+
+func (set *InputSet) Stop() {
+	set.mtx.Lock()
+	defer set.mtx.Unlock()
+	set.isStopped = true
+	for _, entry := range set.entries {
+		entry.input.Stop()
+	}
+}
+
+func (set *InputSet) WaitForShutdown() {
+	for _, worker := range set.Inputs() {
+		worker.WaitForShutdown()
+	}
+}
+
+// sameSection tells whether the sections have the same parameters.
+func sameSection(a *ConfigElement, b *ConfigElement) bool {
+	if len(a.Params) != len(b.Params) {
+		return false
+	}
+	for key, va := range a.Params {
+		vb := b.Params[key]
+		if len(va) != len(vb) {
+			return false
+		}
+		for i := range va {
+			if va[i] != vb[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// inputKeys identifies the input sections by their names and the numbers
+// of the ones of the same names before them.
+func inputKeys(sections []*ConfigElement) map[string]*ConfigElement {
+	retval := make(map[string]*ConfigElement)
+	for i, section := range sections {
+		if section.Name == "input" {
+			retval[outputKey(sections, i)] = section
+		}
+	}
+	return retval
+}
+
+// Reload applies the input sections.  The inputs removed or changed are
+// stopped first so that the new ones can listen on the same addresses.  An
+// input that fails to be created with the new settings is created again
+// with the previous ones, and the errors are returned together once all of
+// the sections have been tried.
+func (set *InputSet) Reload(sections []*ConfigElement) error {
+	set.mtx.Lock()
+	defer set.mtx.Unlock()
+	if set.isStopped {
+		return errors.New("inputs have been stopped")
+	}
+	newSections := inputKeys(sections)
+	stopped := make(map[string]*ConfigElement)
+	for _, key := range set.keys() {
+		entry := set.entries[key]
+		if section, ok := newSections[key]; ok && sameSection(entry.section, section) {
+			continue
+		}
+		entry.input.Stop()
+		entry.input.WaitForShutdown()
+		delete(set.entries, key)
+		stopped[key] = entry.section
+		set.logger.Noticef("%s: stopped", entry.section.String())
+	}
+	errs := make([]string, 0)
+	keys := make([]string, 0, len(newSections))
+	for key := range newSections {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, ok := set.entries[key]; ok {
+			continue
+		}
+		section := newSections[key]
+		input, err := set.newInput(section)
+		if err != nil {
+			errs = append(errs, err.Error())
+			previous, ok := stopped[key]
+			if !ok {
+				continue
+			}
+			section = previous
+			input, err = set.newInput(section)
+			if err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+		}
+		if set.isStarted {
+			input.Start()
+		}
+		set.entries[key] = inputSetEntry{section: section, input: input}
+		set.logger.Noticef("%s: started", section.String())
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// NewInputSet creates the inputs of the input sections; label returns the
+// port to the label an input emits to.
+func NewInputSet(logger *logging.Logger, sections []*ConfigElement, label func(name string) (Port, error)) (*InputSet, error) {
+	set := &InputSet{
+		logger:    logger,
+		label:     label,
+		mtx:       sync.Mutex{},
+		entries:   make(map[string]inputSetEntry),
+		isStarted: false,
+		isStopped: false,
+	}
+	for key, section := range inputKeys(sections) {
+		input, err := set.newInput(section)
+		if err != nil {
+			return nil, err
+		}
+		set.entries[key] = inputSetEntry{section: section, input: input}
+	}
+	return set, nil
+}
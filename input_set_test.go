@@ -0,0 +1,164 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	logging "github.com/op/go-logging"
+	"testing"
+)
+
+type testInput struct {
+	name      string
+	port      Port
+	isStarted bool
+	isStopped bool
+}
+
+func (input *testInput) String() string   { return "input:" + input.name }
+func (input *testInput) Start()           { input.isStarted = true }
+func (input *testInput) Stop()            { input.isStopped = true }
+func (input *testInput) WaitForShutdown() {}
+
+func init() {
+	RegisterInput("test-input", func(logger *logging.Logger, config *ConfigElement, port Port) (Worker, error) {
+		if config.Get("fail", "") != "" {
+			return nil, errors.New("failed")
+		}
+		return &testInput{name: config.Arg, port: port}, nil
+	})
+}
+
+func Test_InputSet(t *testing.T) {
+	logger := logging.MustGetLogger("fluentd-forwarder")
+	ports := map[string]Port{"": &recordingPort{}, "other": &recordingPort{}}
+	label := func(name string) (Port, error) {
+		port, ok := ports[name]
+		if !ok {
+			return nil, errors.New("label " + name + " is not defined")
+		}
+		return port, nil
+	}
+	read := func(src string) []*ConfigElement {
+		sections, err := ReadConfig("test.conf", []byte(src))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return sections
+	}
+	names := func(workers []Worker) []string {
+		retval := make([]string, 0)
+		for _, worker := range workers {
+			retval = append(retval, worker.String())
+		}
+		return retval
+	}
+
+	set, err := NewInputSet(logger, read(`
+[input "kept"]
+type = test-input
+[input "changed"]
+type = test-input
+[input "removed"]
+type = test-input
+`), label)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	set.Start()
+	initial := make(map[string]*testInput)
+	for _, worker := range set.Inputs() {
+		input := worker.(*testInput)
+		if !input.isStarted {
+			t.Fatalf("%s is not started", input.String())
+		}
+		initial[input.name] = input
+	}
+	if got := names(set.Inputs()); len(got) != 3 {
+		t.Fatalf("unexpected inputs: %v", got)
+	}
+
+	err = set.Reload(read(`
+[input "kept"]
+type = test-input
+[input "changed"]
+type = test-input
+label = other
+[input "added"]
+type = test-input
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	current := make(map[string]*testInput)
+	for _, worker := range set.Inputs() {
+		current[worker.(*testInput).name] = worker.(*testInput)
+	}
+	if len(current) != 3 || current["removed"] != nil {
+		t.Fatalf("unexpected inputs: %v", names(set.Inputs()))
+	}
+	if current["kept"] != initial["kept"] || initial["kept"].isStopped {
+		t.Fatal("the unchanged input is not kept")
+	}
+	if !initial["changed"].isStopped || !initial["removed"].isStopped {
+		t.Fatal("the changed or removed input is not stopped")
+	}
+	if current["changed"] == initial["changed"] || current["changed"].port != ports["other"] || !current["changed"].isStarted {
+		t.Fatal("the changed input is not recreated")
+	}
+	if !current["added"].isStarted {
+		t.Fatal("the added input is not started")
+	}
+
+	// an input failing with the new settings is recreated with the old ones
+	err = set.Reload(read(`
+[input "kept"]
+type = test-input
+[input "changed"]
+type = test-input
+fail = yes
+[input "added"]
+type = test-input
+label = nowhere
+`))
+	if err == nil {
+		t.Fatal("no error reported")
+	}
+	recovered := make(map[string]*testInput)
+	for _, worker := range set.Inputs() {
+		recovered[worker.(*testInput).name] = worker.(*testInput)
+	}
+	if len(recovered) != 3 || recovered["changed"] == current["changed"] || recovered["changed"].port != ports["other"] || !recovered["changed"].isStarted {
+		t.Fatalf("the failed input is not recreated with the previous settings: %v", names(set.Inputs()))
+	}
+	if recovered["added"].port != ports[""] {
+		t.Fatal("the input to an undefined label is not recreated with the previous settings")
+	}
+
+	set.Stop()
+	set.WaitForShutdown()
+	for _, worker := range set.Inputs() {
+		if !worker.(*testInput).isStopped {
+			t.Fatalf("%s is not stopped", worker.String())
+		}
+	}
+	if set.Reload(read("")) == nil {
+		t.Fatal("reloading the stopped inputs did not fail")
+	}
+}
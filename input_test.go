@@ -0,0 +1,339 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	logging "github.com/op/go-logging"
+	"github.com/ugorji/go/codec"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_ForwardInput_SizeMetrics(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("input")
+	// labeled apart from the inputs of the other tests
+	input, err := NewForwardInput(logger, "localhost:0", &syncRecordingPort{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	input.Start()
+	defer func() {
+		input.Stop()
+		input.WaitForShutdown()
+	}()
+	conn, err := net.Dial("tcp", input.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	handle := &codec.MsgpackHandle{}
+	message := bytes.Buffer{}
+	codec.NewEncoder(&message, handle).Encode([]interface{}{[]byte("a"), uint64(1388534400), map[string]interface{}{"message": "hello"}})
+	entries := bytes.Buffer{}
+	codec.NewEncoder(&entries, handle).Encode([]interface{}{uint64(1388534400), map[string]interface{}{"message": "hello"}})
+	entrySize := entries.Len()
+	codec.NewEncoder(&entries, handle).Encode([]interface{}{uint64(1388534400), map[string]interface{}{"message": string(make([]byte, 2000))}})
+	packed := bytes.Buffer{}
+	codec.NewEncoder(&packed, handle).Encode([]interface{}{[]byte("a"), entries.Bytes()})
+	_, err = conn.Write(append(message.Bytes(), packed.Bytes()...))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for deadline := time.Now().Add(5 * time.Second); input.metrics.records.Value() < 3; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the records did not arrive")
+		}
+	}
+	recordSize := input.metrics.recordSize.m
+	recordSize.mtx.Lock()
+	defer recordSize.mtx.Unlock()
+	// the message, a small entry and a large one
+	if recordSize.count != 3 || recordSize.sum != float64(message.Len()+entries.Len()) || recordSize.counts[0] != 2 || recordSize.counts[3] != 1 {
+		t.Errorf("%+v", recordSize)
+	}
+	if entrySize > 64 {
+		t.Errorf("the small entry takes %d bytes", entrySize)
+	}
+	chunkSize := input.metrics.chunkSize.m
+	chunkSize.mtx.Lock()
+	defer chunkSize.mtx.Unlock()
+	if chunkSize.count != 2 || chunkSize.sum != float64(message.Len()+packed.Len()) {
+		t.Errorf("%+v", chunkSize)
+	}
+}
+
+func Test_ForwardInput_Protocol(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("input")
+	msgpack := bytes.Buffer{}
+	codec.NewEncoder(&msgpack, &codec.MsgpackHandle{}).Encode([]interface{}{[]byte("app.msgpack"), uint64(1388534400), map[string]interface{}{"n": 1}})
+	json := []byte(`["app.json",1388534400,{"n":1,"neg":-1,"f":1.5,"s":"x"}]
+["app.json",[[1388534400,{"n":2}],[1388534401,{"n":3}]]]`)
+	for _, protocol := range []string{ForwardProtocolAuto, ForwardProtocolMsgpack, ForwardProtocolJSON} {
+		port := &syncRecordingPort{}
+		input, err := NewForwardInput(logger, "127.0.0.1:0", port)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		input.SetProtocol(protocol)
+		input.Start()
+		expected := 0
+		for _, payload := range [][]byte{msgpack.Bytes(), json} {
+			accepted := protocol == ForwardProtocolAuto || (protocol == ForwardProtocolJSON) == (payload[0] == '[')
+			conn, err := net.Dial("tcp", input.listener.Addr().String())
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			_, err = conn.Write(payload)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if !accepted {
+				// closed by the input for the decode error
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+					t.Errorf("%s: %s: %v", protocol, payload, err)
+				}
+				conn.Close()
+				continue
+			}
+			if payload[0] == '[' {
+				expected += 3
+			} else {
+				expected += 1
+			}
+			for deadline := time.Now().Add(5 * time.Second); recordCount(port.recordSets) < expected; time.Sleep(10 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatalf("%s: the records did not arrive", protocol)
+				}
+			}
+			conn.Close()
+		}
+		input.Stop()
+		input.WaitForShutdown()
+		port.mtx.Lock()
+		if recordCount(port.recordSets) != expected {
+			t.Errorf("%s: %+v", protocol, port.recordSets)
+		}
+		for _, recordSet := range port.recordSets {
+			if recordSet.Tag != "app.json" {
+				continue
+			}
+			// the numbers are taken as they are from msgpack
+			record := recordSet.Records[0]
+			if record.Timestamp != 1388534400 || record.Data["n"] != uint64(1) || record.Data["neg"] != int64(-1) || record.Data["f"] != 1.5 || record.Data["s"] != "x" {
+				t.Errorf("%s: %+v", protocol, record)
+			}
+			break
+		}
+		port.mtx.Unlock()
+	}
+}
+
+func Test_ForwardInput_DecodePool(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("input")
+	port := &syncRecordingPort{}
+	input, err := NewForwardInput(logger, "127.0.0.1:0", port)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	input.decodePool = NewDecodePool(1)
+	input.Start()
+	defer func() {
+		input.Stop()
+		input.WaitForShutdown()
+	}()
+	handle := &codec.MsgpackHandle{}
+	payload := bytes.Buffer{}
+	encoder := codec.NewEncoder(&payload, handle)
+	for i := 0; i < 100; i += 1 {
+		entries := bytes.Buffer{}
+		codec.NewEncoder(&entries, handle).Encode([]interface{}{uint64(1388534400), map[string]interface{}{"n": i}})
+		switch i % 3 {
+		case 0:
+			encoder.Encode([]interface{}{"app", uint64(1388534400), map[string]interface{}{"n": i}})
+		case 1:
+			encoder.Encode([]interface{}{"app", []interface{}{[]interface{}{uint64(1388534400), map[string]interface{}{"n": i}}}})
+		case 2:
+			encoder.Encode([]interface{}{"app", entries.Bytes()})
+		}
+	}
+	// a message failing to be decoded, after which the rest are not taken
+	encoder.Encode([]interface{}{"app", "not entries"})
+	encoder.Encode([]interface{}{"app", uint64(1388534400), map[string]interface{}{"n": 100}})
+	conn, err := net.Dial("tcp", input.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	_, err = conn.Write(payload.Bytes())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("%v", err)
+	}
+	port.mtx.Lock()
+	defer port.mtx.Unlock()
+	// passed on in the order received
+	n := uint64(0)
+	for _, recordSet := range port.recordSets {
+		for _, record := range recordSet.Records {
+			if record.Data["n"] != n {
+				t.Fatalf("%d: %+v", n, record)
+			}
+			n += 1
+		}
+	}
+	if n != 100 {
+		t.Errorf("%d records", n)
+	}
+}
+
+func Test_ForwardInput_Connections(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("input")
+	input, err := NewForwardInput(logger, "127.0.0.1:0", &syncRecordingPort{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	input.Start()
+	conns := make([]net.Conn, 0, 20)
+	for i := 0; i < 20; i += 1 {
+		conn, err := net.Dial("tcp", input.listener.Addr().String())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(input.Connections()) < len(conns); {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections", len(input.Connections()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !input.CloseConnection(conns[0].LocalAddr().String()) {
+		t.Fatal("the connection was not found")
+	}
+	if input.CloseConnection("127.0.0.1:1") {
+		t.Error("an unknown connection was closed")
+	}
+	conns[0].SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conns[0].Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("%v", err)
+	}
+	// the connections closing on either side as the input shuts down
+	for _, conn := range conns[1:10] {
+		conn.Close()
+	}
+	input.Stop()
+	input.WaitForShutdown()
+	for _, conn := range conns[10:] {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("%v", err)
+		}
+	}
+	if n := len(input.Connections()); n != 0 {
+		t.Errorf("%d connections left", n)
+	}
+}
+
+func Test_ForwardInput_MaxMessageSize(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("input")
+	port := &syncRecordingPort{}
+	input, err := NewForwardInput(logger, "127.0.0.1:0", port)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	input.SetMaxMessageSize(1024)
+	input.Start()
+	defer func() {
+		input.Stop()
+		input.WaitForShutdown()
+	}()
+	conn, err := net.Dial("tcp", input.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	// a binary claiming 2GB, which is refused without waiting for it
+	_, err = conn.Write([]byte{0x92, 0xa3, 't', 'a', 'g', 0xc6, 0x7f, 0xff, 0xff, 0xff})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("%v", err)
+	}
+}
+
+// BenchmarkForwardInputDecode decodes a message of the forward mode on every
+// CPU as the workers of the decode pool do, each with a reader of its own,
+// against the codec.Decoder over a handle shared by all the connections the
+// forward input used to decode by.
+func BenchmarkForwardInputDecode(b *testing.B) {
+	handle := &codec.MsgpackHandle{}
+	entries := make([]interface{}, 0, 100)
+	for i := 0; i < 100; i += 1 {
+		entries = append(entries, []interface{}{uint64(1388534400), map[string]interface{}{"n": i, "message": "hello", "host": "app-1"}})
+	}
+	message := bytes.Buffer{}
+	codec.NewEncoder(&message, handle).Encode([]interface{}{"app", entries})
+	b.Run("reader", func(b *testing.B) {
+		b.SetBytes(int64(message.Len()))
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			reader := newMsgpackDataReader()
+			entries := reader.entriesReader()
+			for pb.Next() {
+				reader.reset(message.Bytes())
+				_, recordSets, _, err := decodeMsgpackMessage(reader, entries, nil)
+				if err != nil {
+					b.Fatal(err.Error())
+				}
+				putRecords(recordSets[0].Records)
+			}
+		})
+	})
+	b.Run("shared-handle", func(b *testing.B) {
+		shared := codec.MsgpackHandle{}
+		shared.MapType = reflect.TypeOf(map[string]interface{}(nil))
+		b.SetBytes(int64(message.Len()))
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				v := []interface{}(nil)
+				err := codec.NewDecoderBytes(message.Bytes(), &shared).Decode(&v)
+				if err != nil {
+					b.Fatal(err.Error())
+				}
+			}
+		})
+	})
+}
@@ -0,0 +1,154 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// InternalEventTagPrefix is the prefix of the tags of the internal events,
+// followed by the level as in fluentd: fluent.warn, fluent.error and so on.
+const InternalEventTagPrefix = "fluent."
+
+var internalEventLevels = map[logging.Level]string{
+	logging.CRITICAL: "fatal",
+	logging.ERROR:    "error",
+	logging.WARNING:  "warn",
+	logging.NOTICE:   "info",
+	logging.INFO:     "info",
+	logging.DEBUG:    "debug",
+}
+
+// InternalEventEmitter is a log backend that passes the records to the next
+// backend and also emits the ones at the level or above into the pipeline
+// as records tagged fluent.LEVEL, in the background so that logging never
+// blocks.  What is logged while the events are being emitted is not turned
+// into events, so that an event failing in the pipeline cannot loop.  The
+// events are dropped if they come faster than the pipeline takes them.
+type InternalEventEmitter struct {
+	next           logging.Backend
+	level          logging.Level
+	port           atomic.Value // Port
+	queue          chan FluentRecordSet
+	isEmitting     uint32
+	wg             sync.WaitGroup
+	shutdownChan   chan struct{}
+	isShuttingDown uintptr
+}
+
+func (emitter *InternalEventEmitter) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	err := emitter.next.Log(level, calldepth+1, rec)
+	if level > emitter.level || atomic.LoadUint32(&emitter.isEmitting) != 0 {
+		return err
+	}
+	recordSet := FluentRecordSet{
+		Tag: InternalEventTagPrefix + internalEventLevels[level],
+		Records: []TinyFluentRecord{
+			{
+				Timestamp: uint64(rec.Time.Unix()),
+				Data: map[string]interface{}{
+					"message": rec.Message(),
+					"module":  rec.Module,
+				},
+			},
+		},
+	}
+	select {
+	case emitter.queue <- recordSet:
+	default:
+	}
+	return err
+}
+
+// SetPort sets the port the events are emitted to.  The events logged
+// before are kept in the queue until then.
+func (emitter *InternalEventEmitter) SetPort(port Port) {
+	emitter.port.Store(&port)
+}
+
+// emit emits the events queued so far.
+func (emitter *InternalEventEmitter) emit() {
+	port, _ := emitter.port.Load().(*Port)
+	if port == nil {
+		return
+	}
+	recordSets := make([]FluentRecordSet, 0)
+outer:
+	for len(recordSets) < cap(emitter.queue) {
+		select {
+		case recordSet := <-emitter.queue:
+			recordSets = append(recordSets, recordSet)
+		default:
+			break outer
+		}
+	}
+	if len(recordSets) == 0 {
+		return
+	}
+	atomic.StoreUint32(&emitter.isEmitting, 1)
+	defer atomic.StoreUint32(&emitter.isEmitting, 0)
+	(*port).Emit(recordSets)
+}
+
+func (emitter *InternalEventEmitter) String() string {
+	return "internal_events"
+}
+
+func (emitter *InternalEventEmitter) Start() {
+	emitter.wg.Add(1)
+	go func() {
+		defer emitter.wg.Done()
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				emitter.emit()
+			case <-emitter.shutdownChan:
+				emitter.emit()
+				return
+			}
+		}
+	}()
+}
+
+func (emitter *InternalEventEmitter) Stop() {
+	if atomic.CompareAndSwapUintptr(&emitter.isShuttingDown, 0, 1) {
+		emitter.shutdownChan <- struct{}{}
+	}
+}
+
+func (emitter *InternalEventEmitter) WaitForShutdown() {
+	emitter.wg.Wait()
+}
+
+func NewInternalEventEmitter(next logging.Backend, level logging.Level) *InternalEventEmitter {
+	return &InternalEventEmitter{
+		next:           next,
+		level:          level,
+		queue:          make(chan FluentRecordSet, 1024),
+		isEmitting:     0,
+		wg:             sync.WaitGroup{},
+		shutdownChan:   make(chan struct{}, 1),
+		isShuttingDown: 0,
+	}
+}
@@ -0,0 +1,71 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"testing"
+	"time"
+)
+
+type countingBackend struct {
+	n int
+}
+
+func (backend *countingBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	backend.n += 1
+	return nil
+}
+
+// loggingPort logs an error on every emission, as a pipeline failing on the
+// internal events would.
+type loggingPort struct {
+	recordingPort
+	emitter *InternalEventEmitter
+}
+
+func (port *loggingPort) Emit(recordSets []FluentRecordSet) error {
+	port.emitter.Log(logging.ERROR, 0, &logging.Record{Time: time.Now(), Module: "test", Args: []interface{}{"failed"}})
+	return port.recordingPort.Emit(recordSets)
+}
+
+func Test_InternalEventEmitter(t *testing.T) {
+	next := &countingBackend{}
+	emitter := NewInternalEventEmitter(next, logging.WARNING)
+	emitter.Log(logging.INFO, 0, &logging.Record{Time: time.Now(), Module: "test", Args: []interface{}{"started"}})
+	emitter.Log(logging.WARNING, 0, &logging.Record{Time: time.Unix(1400000000, 0), Module: "test", Args: []interface{}{"retrying"}})
+	port := &loggingPort{emitter: emitter}
+	emitter.SetPort(port)
+	emitter.emit()
+	if len(port.recordSets) != 1 {
+		t.Fatalf("%d record sets emitted", len(port.recordSets))
+	}
+	recordSet := port.recordSets[0]
+	if recordSet.Tag != "fluent.warn" || recordSet.Records[0].Timestamp != 1400000000 || recordSet.Records[0].Data["message"] != "retrying" || recordSet.Records[0].Data["module"] != "test" {
+		t.Fail()
+	}
+	// the error logged while emitting is not emitted
+	emitter.emit()
+	if len(port.recordSets) != 1 {
+		t.Fail()
+	}
+	if next.n != 3 {
+		t.Fail()
+	}
+}
@@ -0,0 +1,82 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+// inheritedListeners are the sockets handed over by the parent process,
+// by the addresses the inputs bind to.
+var inheritedListeners = struct {
+	sync.Mutex
+	files map[string]*os.File
+}{files: make(map[string]*os.File)}
+
+// InheritListener makes the inputs binding to the address accept on the
+// listening socket of the file, handed over by the parent process, instead
+// of listening by themselves.  The file is kept open, so that the inputs
+// created again by reloading take the same socket.
+func InheritListener(bind string, file *os.File) {
+	inheritedListeners.Lock()
+	defer inheritedListeners.Unlock()
+	inheritedListeners.files[bind] = file
+}
+
+// InheritedListener returns the file given to InheritListener for the
+// address, or nil.
+func InheritedListener(bind string) *os.File {
+	inheritedListeners.Lock()
+	defer inheritedListeners.Unlock()
+	return inheritedListeners.files[bind]
+}
+
+// ListenTCP listens on the address, or takes the socket inherited for it.
+func ListenTCP(bind string) (*net.TCPListener, error) {
+	if file := InheritedListener(bind); file != nil {
+		listener, err := net.FileListener(file)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to take the listener inherited for %s: %s", bind, err.Error()))
+		}
+		tcpListener, ok := listener.(*net.TCPListener)
+		if !ok {
+			listener.Close()
+			return nil, errors.New(fmt.Sprintf("the listener inherited for %s is not of TCP", bind))
+		}
+		return tcpListener, nil
+	}
+	addr, err := net.ResolveTCPAddr("tcp", bind)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenTCP("tcp", addr)
+}
+
+// InputListenAddress returns the address the input of the section listens
+// on, if it is of a type listening on one.
+func InputListenAddress(section *ConfigElement) (string, bool) {
+	if section.Name != "input" || section.Get("type", "") != "forward" {
+		return "", false
+	}
+	return section.Get("listen-on", DefaultForwardListenOn), true
+}
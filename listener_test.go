@@ -0,0 +1,111 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"net"
+	"testing"
+)
+
+func Test_ListenTCP_Inherited(t *testing.T) {
+	listener, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	file, err := listener.File()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	listener.Close()
+	InheritListener("inherited.test:24224", file)
+	defer InheritListener("inherited.test:24224", nil)
+	// each input takes the socket for itself, so that it can be taken
+	// again after the one taking it first is closed
+	for i := 0; i < 2; i++ {
+		inherited, err := ListenTCP("inherited.test:24224")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		go func() {
+			conn, err := net.Dial("tcp", inherited.Addr().String())
+			if err == nil {
+				conn.Close()
+			}
+		}()
+		conn, err := inherited.Accept()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		conn.Close()
+		inherited.Close()
+	}
+}
+
+func Test_ForwardInput_ListenerFile(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("input")
+	input, err := NewForwardInput(logger, "127.0.0.1:0", &recordingPort{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	input.Start()
+	bind, file, err := input.ListenerFile()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if bind != "127.0.0.1:0" {
+		t.Errorf("unexpected address: %s", bind)
+	}
+	addr := input.listener.Addr().String()
+	input.Stop()
+	input.WaitForShutdown()
+	// the socket handed over outlives the input
+	InheritListener("handover.test:24224", file)
+	defer InheritListener("handover.test:24224", nil)
+	listener, err := ListenTCP("handover.test:24224")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer listener.Close()
+	if listener.Addr().String() != addr {
+		t.Errorf("%s is not %s", listener.Addr().String(), addr)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	conn.Close()
+}
+
+func Test_InputListenAddress(t *testing.T) {
+	section := NewConfigElement("input", "in")
+	section.Set("type", "forward")
+	if addr, ok := InputListenAddress(section); !ok || addr != DefaultForwardListenOn {
+		t.Errorf("unexpected address: %s", addr)
+	}
+	section.Set("listen-on", "0.0.0.0:24225")
+	if addr, _ := InputListenAddress(section); addr != "0.0.0.0:24225" {
+		t.Errorf("unexpected address: %s", addr)
+	}
+	section.Set("type", "other")
+	if _, ok := InputListenAddress(section); ok {
+		t.Error("an input of an unknown type listens")
+	}
+}
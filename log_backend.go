@@ -0,0 +1,131 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"encoding/json"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// LogField is an argument of a log message that the JSON log backend also
+// stores under Key; it is formatted as the value alone in the message.
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+func (field LogField) String() string {
+	return fmt.Sprint(field.Value)
+}
+
+// LogComponent names the component, such as a filter, the message is about.
+func LogComponent(name string) LogField {
+	return LogField{Key: "component", Value: name}
+}
+
+func LogRemoteAddr(addr net.Addr) LogField {
+	return LogField{Key: "remote_addr", Value: addr.String()}
+}
+
+func LogTag(tag string) LogField {
+	return LogField{Key: "tag", Value: tag}
+}
+
+func LogError(err error) LogField {
+	return LogField{Key: "error", Value: err.Error()}
+}
+
+// componentLogFields holds the fields of the messages of the component
+// loggers by their modules.
+var componentLogFields = struct {
+	mtx    sync.RWMutex
+	fields map[string][]LogField
+}{
+	mtx:    sync.RWMutex{},
+	fields: make(map[string][]LogField),
+}
+
+// NewComponentLogger returns the logger of a component, such as an output,
+// whose module is the one of parent followed by name, like
+// "fluentd-forwarder.pipeline" and "output.kafka", so that its level can be
+// set apart from the others.  The JSON log backend stores the fields, such
+// as the name of the output, with each of its messages.
+func NewComponentLogger(parent *logging.Logger, name string, fields ...LogField) *logging.Logger {
+	module := name
+	if parent.Module != "" {
+		module = parent.Module + "." + name
+	}
+	componentLogFields.mtx.Lock()
+	defer componentLogFields.mtx.Unlock()
+	componentLogFields.fields[module] = fields
+	return logging.MustGetLogger(module)
+}
+
+func componentFields(module string) []LogField {
+	componentLogFields.mtx.RLock()
+	defer componentLogFields.mtx.RUnlock()
+	return componentLogFields.fields[module]
+}
+
+// JSONLogBackend writes each log message as a line of a JSON object with
+// time, level, module (the name of the logger), message and the LogFields
+// among the arguments, after the ones of the component logger if it is one.
+// The component defaults to the module.
+type JSONLogBackend struct {
+	mtx    sync.Mutex
+	writer io.Writer
+}
+
+func (backend *JSONLogBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	entry := map[string]interface{}{
+		"time":      rec.Time.Format(time.RFC3339Nano),
+		"level":     level.String(),
+		"module":    rec.Module,
+		"component": rec.Module,
+		"message":   rec.Message(),
+	}
+	for _, field := range componentFields(rec.Module) {
+		entry[field.Key] = field.Value
+	}
+	for _, arg := range rec.Args {
+		if field, ok := arg.(LogField); ok {
+			entry[field.Key] = field.Value
+		}
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	backend.mtx.Lock()
+	defer backend.mtx.Unlock()
+	_, err = backend.writer.Write(append(line, '\n'))
+	return err
+}
+
+func NewJSONLogBackend(writer io.Writer) *JSONLogBackend {
+	return &JSONLogBackend{
+		mtx:    sync.Mutex{},
+		writer: writer,
+	}
+}
@@ -0,0 +1,85 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	logging "github.com/op/go-logging"
+	"testing"
+)
+
+func Test_JSONLogBackend(t *testing.T) {
+	buf := bytes.Buffer{}
+	logger := logging.MustGetLogger("test")
+	logger.SetBackend(logging.AddModuleLevel(NewJSONLogBackend(&buf)))
+	logger.Errorf("%s: failed to process a record with tag %s: %s", LogComponent("filter:cast"), LogTag("test.tag"), LogError(errors.New("oops")))
+	entry := map[string]interface{}{}
+	err := json.Unmarshal(buf.Bytes(), &entry)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := map[string]interface{}{
+		"level":     "ERROR",
+		"module":    "test",
+		"component": "filter:cast",
+		"tag":       "test.tag",
+		"error":     "oops",
+		"message":   "filter:cast: failed to process a record with tag test.tag: oops",
+	}
+	for key, value := range expected {
+		if entry[key] != value {
+			t.Logf("%s: expected %v, got %v", key, value, entry[key])
+			t.Fail()
+		}
+	}
+	if _, ok := entry["time"]; !ok {
+		t.Fail()
+	}
+	buf.Reset()
+	logger.Notice("started")
+	entry = map[string]interface{}{}
+	err = json.Unmarshal(buf.Bytes(), &entry)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if entry["component"] != "test" || entry["message"] != "started" {
+		t.Fail()
+	}
+}
+
+func Test_NewComponentLogger(t *testing.T) {
+	buf := bytes.Buffer{}
+	parent := logging.MustGetLogger("test.pipeline")
+	logger := NewComponentLogger(parent, "output.kafka", LogField{Key: "output", Value: "kafka"})
+	if logger.Module != "test.pipeline.output.kafka" {
+		t.Fatalf("unexpected module: %s", logger.Module)
+	}
+	logger.SetBackend(logging.AddModuleLevel(NewJSONLogBackend(&buf)))
+	logger.Warningf("%s: connection refused", LogComponent("output:kafka"))
+	entry := map[string]interface{}{}
+	err := json.Unmarshal(buf.Bytes(), &entry)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if entry["module"] != "test.pipeline.output.kafka" || entry["output"] != "kafka" || entry["component"] != "output:kafka" {
+		t.Fail()
+	}
+}
@@ -0,0 +1,319 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatedLogSuffixFormat is the format of the time appended to the names of
+// the rotated log files.
+const rotatedLogSuffixFormat = "20060102-150405"
+
+// RotatingFile is a log file that is rotated by its size or by time.  A
+// rotated file is renamed with the time of the rotation appended, like
+// fluentd_forwarder.log.20141015-120000, compressed with gzip if compress is
+// set, and removed once more than keep of them are left.  The file can also
+// be reopened after it is renamed by an external tool such as logrotate.
+type RotatingFile struct {
+	mtx  sync.Mutex
+	path string
+	// the size above which the file is rotated; not rotated by the size if 0
+	maxSize int64
+	// the interval in which the file is rotated, aligned to its multiples
+	// since the zero time in UTC; not rotated by time if 0
+	interval time.Duration
+	// the number of the rotated files kept; all of them are kept if 0
+	keep     int
+	compress bool
+	now      func() time.Time
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	// serializes the compression and the removal of the rotated files
+	cleanupMtx sync.Mutex
+	wg         sync.WaitGroup
+}
+
+func (rotatingFile *RotatingFile) open() error {
+	dir, _ := filepath.Split(rotatingFile.path)
+	if dir != "" {
+		err := os.MkdirAll(dir, os.FileMode(0777))
+		if err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(rotatingFile.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, os.FileMode(0666))
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rotatingFile.file = file
+	rotatingFile.size = info.Size()
+	rotatingFile.openedAt = rotatingFile.now()
+	return nil
+}
+
+func (rotatingFile *RotatingFile) closeFile() error {
+	if rotatingFile.file == nil {
+		return nil
+	}
+	err := rotatingFile.file.Close()
+	rotatingFile.file = nil
+	return err
+}
+
+func (rotatingFile *RotatingFile) shouldRotate(n int, now time.Time) bool {
+	if rotatingFile.size == 0 {
+		// nothing to rotate yet; the file starts the current interval
+		rotatingFile.openedAt = now
+		return false
+	}
+	if rotatingFile.maxSize > 0 && rotatingFile.size+int64(n) > rotatingFile.maxSize {
+		return true
+	}
+	if rotatingFile.interval > 0 && !now.Truncate(rotatingFile.interval).Equal(rotatingFile.openedAt.Truncate(rotatingFile.interval)) {
+		return true
+	}
+	return false
+}
+
+// rotatedPath returns the name the file is renamed to, which no file
+// rotated earlier has.
+func (rotatingFile *RotatingFile) rotatedPath(now time.Time) string {
+	base := rotatingFile.path + "." + now.Format(rotatedLogSuffixFormat)
+	path := base
+	for i := 1; ; i++ {
+		_, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			_, err = os.Lstat(path + ".gz")
+			if os.IsNotExist(err) {
+				return path
+			}
+		}
+		path = fmt.Sprintf("%s.%d", base, i)
+	}
+}
+
+func (rotatingFile *RotatingFile) rotate(now time.Time) error {
+	err := rotatingFile.closeFile()
+	if err != nil {
+		return err
+	}
+	rotatedPath := rotatingFile.rotatedPath(now)
+	err = os.Rename(rotatingFile.path, rotatedPath)
+	if err != nil {
+		return err
+	}
+	rotatingFile.wg.Add(1)
+	go func() {
+		defer rotatingFile.wg.Done()
+		rotatingFile.cleanup()
+	}()
+	return rotatingFile.open()
+}
+
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dest, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(0666))
+	if err != nil {
+		return err
+	}
+	gzipWriter := gzip.NewWriter(dest)
+	_, err = io.Copy(gzipWriter, src)
+	if err == nil {
+		err = gzipWriter.Close()
+	}
+	err_ := dest.Close()
+	if err == nil {
+		err = err_
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// rotatedFiles returns the rotated files, the oldest first by the times of
+// the rotations in their names.
+func (rotatingFile *RotatingFile) rotatedFiles() ([]string, error) {
+	paths, err := filepath.Glob(rotatingFile.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	type rotated struct {
+		path      string
+		rotatedAt time.Time
+		// distinguishes the files rotated within the same second
+		seq int
+	}
+	files := make([]rotated, 0, len(paths))
+	for _, path := range paths {
+		suffix := strings.TrimPrefix(path, rotatingFile.path+".")
+		if len(suffix) < len(rotatedLogSuffixFormat) {
+			continue
+		}
+		rotatedAt, err := time.Parse(rotatedLogSuffixFormat, suffix[:len(rotatedLogSuffixFormat)])
+		if err != nil {
+			continue
+		}
+		seq := 0
+		rest := strings.TrimSuffix(suffix[len(rotatedLogSuffixFormat):], ".gz")
+		if rest != "" {
+			seq, err = strconv.Atoi(strings.TrimPrefix(rest, "."))
+			if err != nil {
+				continue
+			}
+		}
+		files = append(files, rotated{path, rotatedAt, seq})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].rotatedAt.Equal(files[j].rotatedAt) {
+			return files[i].seq < files[j].seq
+		}
+		return files[i].rotatedAt.Before(files[j].rotatedAt)
+	})
+	retval := make([]string, len(files))
+	for i, file := range files {
+		retval[i] = file.path
+	}
+	return retval, nil
+}
+
+// cleanup compresses the rotated files not compressed yet and removes those
+// beyond keep.  The failures are reported to the standard error, as the log
+// is the file being rotated.
+func (rotatingFile *RotatingFile) cleanup() {
+	rotatingFile.cleanupMtx.Lock()
+	defer rotatingFile.cleanupMtx.Unlock()
+	files, err := rotatingFile.rotatedFiles()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to list the rotated log files: %s\n", err.Error())
+		return
+	}
+	if rotatingFile.compress {
+		for i, path := range files {
+			if strings.HasSuffix(path, ".gz") {
+				continue
+			}
+			err := compressFile(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to compress %s: %s\n", path, err.Error())
+				continue
+			}
+			files[i] = path + ".gz"
+		}
+	}
+	if rotatingFile.keep <= 0 {
+		return
+	}
+	for len(files) > rotatingFile.keep {
+		err := os.Remove(files[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to remove %s: %s\n", files[0], err.Error())
+		}
+		files = files[1:]
+	}
+}
+
+func (rotatingFile *RotatingFile) Write(p []byte) (int, error) {
+	rotatingFile.mtx.Lock()
+	defer rotatingFile.mtx.Unlock()
+	now := rotatingFile.now()
+	if rotatingFile.file != nil && rotatingFile.shouldRotate(len(p), now) {
+		err := rotatingFile.rotate(now)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if rotatingFile.file == nil {
+		// retried on every write after a failure to open
+		err := rotatingFile.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := rotatingFile.file.Write(p)
+	rotatingFile.size += int64(n)
+	return n, err
+}
+
+// Reopen closes the file and opens it again by the path, which is to be
+// done after the file is renamed by an external tool.
+func (rotatingFile *RotatingFile) Reopen() error {
+	rotatingFile.mtx.Lock()
+	defer rotatingFile.mtx.Unlock()
+	err := rotatingFile.closeFile()
+	if err != nil {
+		return err
+	}
+	return rotatingFile.open()
+}
+
+// Close closes the file and waits for the rotated files to be cleaned up.
+func (rotatingFile *RotatingFile) Close() error {
+	rotatingFile.mtx.Lock()
+	err := rotatingFile.closeFile()
+	rotatingFile.mtx.Unlock()
+	rotatingFile.wg.Wait()
+	return err
+}
+
+// NewRotatingFile opens the log file at path, rotated when it grows beyond
+// maxSize bytes or in every interval if either is positive.
+func NewRotatingFile(path string, maxSize int64, interval time.Duration, keep int, compress bool) (*RotatingFile, error) {
+	if maxSize < 0 || interval < 0 || keep < 0 {
+		return nil, errors.New("log rotation settings may not be negative")
+	}
+	rotatingFile := &RotatingFile{
+		mtx:        sync.Mutex{},
+		path:       path,
+		maxSize:    maxSize,
+		interval:   interval,
+		keep:       keep,
+		compress:   compress,
+		now:        time.Now,
+		cleanupMtx: sync.Mutex{},
+		wg:         sync.WaitGroup{},
+	}
+	err := rotatingFile.open()
+	if err != nil {
+		return nil, err
+	}
+	return rotatingFile, nil
+}
@@ -0,0 +1,113 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_RotatingFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "log")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, "forwarder.log")
+	rotatingFile, err := NewRotatingFile(path, 10, 0, 2, true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	now := time.Date(2014, 10, 15, 12, 0, 0, 0, time.UTC)
+	rotatingFile.now = func() time.Time { return now }
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := rotatingFile.Write([]byte(line))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		now = now.Add(time.Second)
+	}
+	err = rotatingFile.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// the first of the three rotated is removed
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) != 2 || rotated[0] != path+".20141015-120002.gz" || rotated[1] != path+".20141015-120003.gz" {
+		t.Logf("%+v", rotated)
+		t.FailNow()
+	}
+	f, _ := os.Open(rotated[1])
+	defer f.Close()
+	gzipReader, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	content, _ := ioutil.ReadAll(gzipReader)
+	if string(content) != "third\n" {
+		t.Fail()
+	}
+	content, _ = ioutil.ReadFile(path)
+	if string(content) != "fourth\n" {
+		t.Fail()
+	}
+}
+
+func Test_RotatingFile_Interval(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "log")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, "forwarder.log")
+	rotatingFile, err := NewRotatingFile(path, 0, time.Hour, 0, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer rotatingFile.Close()
+	now := time.Date(2014, 10, 15, 12, 59, 0, 0, time.UTC)
+	rotatingFile.now = func() time.Time { return now }
+	rotatingFile.Write([]byte("before\n"))
+	now = now.Add(30 * time.Second)
+	rotatingFile.Write([]byte("still before\n"))
+	now = now.Add(time.Minute)
+	rotatingFile.Write([]byte("after\n"))
+	content, _ := ioutil.ReadFile(path + ".20141015-130030")
+	if string(content) != "before\nstill before\n" {
+		t.Logf("%q", content)
+		t.Fail()
+	}
+
+	// reopened after renamed by an external tool
+	os.Rename(path, path+".old")
+	err = rotatingFile.Reopen()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rotatingFile.Write([]byte("reopened\n"))
+	content, _ = ioutil.ReadFile(path)
+	if string(content) != "reopened\n" {
+		t.Logf("%q", content)
+		t.Fail()
+	}
+}
@@ -0,0 +1,167 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// LogLevels is a leveled log backend whose levels can be changed while
+// logging, which the one of go-logging does not allow.  The modules
+// without their own level take the one of the closest parent, named by the
+// part before the last dot, such as "fluentd-forwarder.pipeline" for
+// "fluentd-forwarder.pipeline.output.kafka", and then of the module "".
+type LogLevels struct {
+	mtx sync.RWMutex
+	// wrapped only to have the records formatted; it lets everything through
+	backend logging.LeveledBackend
+	levels  map[string]logging.Level
+	// the levels to restore when the debug logging is toggled off
+	saved map[string]logging.Level
+}
+
+func (levels *LogLevels) GetLevel(module string) logging.Level {
+	levels.mtx.RLock()
+	defer levels.mtx.RUnlock()
+	return levels.getLevel(module)
+}
+
+func (levels *LogLevels) getLevel(module string) logging.Level {
+	for {
+		level, ok := levels.levels[module]
+		if ok {
+			return level
+		}
+		if module == "" {
+			return logging.DEBUG
+		}
+		i := strings.LastIndex(module, ".")
+		if i < 0 {
+			module = ""
+		} else {
+			module = module[:i]
+		}
+	}
+}
+
+func (levels *LogLevels) SetLevel(level logging.Level, module string) {
+	levels.mtx.Lock()
+	defer levels.mtx.Unlock()
+	levels.levels[module] = level
+	levels.saved = nil
+}
+
+func (levels *LogLevels) IsEnabledFor(level logging.Level, module string) bool {
+	return level <= levels.GetLevel(module)
+}
+
+func (levels *LogLevels) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	if !levels.IsEnabledFor(level, rec.Module) {
+		return nil
+	}
+	return levels.backend.Log(level, calldepth+1, rec)
+}
+
+// Levels returns the names of the levels by the modules that have one set.
+func (levels *LogLevels) Levels() map[string]string {
+	levels.mtx.RLock()
+	defer levels.mtx.RUnlock()
+	retval := make(map[string]string, len(levels.levels))
+	for module, level := range levels.levels {
+		retval[module] = level.String()
+	}
+	return retval
+}
+
+// ToggleDebug sets all the modules to DEBUG, or restores the levels they
+// had if called again.  It returns whether the debug logging is on.
+func (levels *LogLevels) ToggleDebug() bool {
+	levels.mtx.Lock()
+	defer levels.mtx.Unlock()
+	if levels.saved != nil {
+		levels.levels = levels.saved
+		levels.saved = nil
+		return false
+	}
+	levels.saved = levels.levels
+	levels.levels = make(map[string]logging.Level, len(levels.saved))
+	for module := range levels.saved {
+		levels.levels[module] = logging.DEBUG
+	}
+	levels.levels[""] = logging.DEBUG
+	return true
+}
+
+// ServeHTTP shows the levels on GET.  On PUT or POST, it sets the level
+// given by the "level" parameter to the module given by "module", or to all
+// of them if not given.
+func (levels *LogLevels) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "PUT", "POST":
+		err := levels.set(r.FormValue("module"), r.FormValue("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(levels.Levels())
+}
+
+func (levels *LogLevels) set(module string, name string) error {
+	if name == "" {
+		return errors.New("level is not specified")
+	}
+	level, err := logging.LogLevel(name)
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid level: %s", name))
+	}
+	if module != "" {
+		levels.SetLevel(level, module)
+		return nil
+	}
+	levels.mtx.Lock()
+	defer levels.mtx.Unlock()
+	for module := range levels.levels {
+		levels.levels[module] = level
+	}
+	levels.levels[""] = level
+	levels.saved = nil
+	return nil
+}
+
+func NewLogLevels(backend logging.Backend) *LogLevels {
+	return &LogLevels{
+		mtx:     sync.RWMutex{},
+		backend: logging.AddModuleLevel(backend),
+		levels:  make(map[string]logging.Level),
+		saved:   nil,
+	}
+}
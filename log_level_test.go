@@ -0,0 +1,119 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"encoding/json"
+	logging "github.com/op/go-logging"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_LogLevels(t *testing.T) {
+	levels := NewLogLevels(NewJSONLogBackend(&bytes.Buffer{}))
+	levels.SetLevel(logging.INFO, "a")
+	levels.SetLevel(logging.WARNING, "b")
+	if !levels.IsEnabledFor(logging.INFO, "a") || levels.IsEnabledFor(logging.DEBUG, "a") {
+		t.Fail()
+	}
+	if levels.IsEnabledFor(logging.INFO, "b") {
+		t.Fail()
+	}
+	// the modules without a level fall back to ""
+	if !levels.IsEnabledFor(logging.DEBUG, "c") {
+		t.Fail()
+	}
+	if !levels.ToggleDebug() {
+		t.Fail()
+	}
+	if !levels.IsEnabledFor(logging.DEBUG, "a") || !levels.IsEnabledFor(logging.DEBUG, "b") {
+		t.Fail()
+	}
+	if levels.ToggleDebug() {
+		t.Fail()
+	}
+	if levels.IsEnabledFor(logging.DEBUG, "a") || levels.IsEnabledFor(logging.INFO, "b") {
+		t.Fail()
+	}
+}
+
+func Test_LogLevels_Parent(t *testing.T) {
+	levels := NewLogLevels(NewJSONLogBackend(&bytes.Buffer{}))
+	levels.SetLevel(logging.ERROR, "")
+	levels.SetLevel(logging.INFO, "a.b")
+	levels.SetLevel(logging.DEBUG, "a.b.c.d")
+	if levels.GetLevel("a.b.c") != logging.INFO || levels.GetLevel("a.b.c.d.e") != logging.DEBUG {
+		t.Fail()
+	}
+	// neither a prefix that is not a parent nor the children count
+	if levels.GetLevel("a.bc") != logging.ERROR || levels.GetLevel("a") != logging.ERROR {
+		t.Fail()
+	}
+}
+
+func Test_LogLevels_ServeHTTP(t *testing.T) {
+	levels := NewLogLevels(NewJSONLogBackend(&bytes.Buffer{}))
+	levels.SetLevel(logging.INFO, "a")
+	levels.SetLevel(logging.INFO, "b")
+	server := httptest.NewServer(levels)
+	defer server.Close()
+	put := func(query string) int {
+		req, err := http.NewRequest("PUT", server.URL+"?"+query, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if put("module=a&level=DEBUG") != http.StatusOK {
+		t.Fail()
+	}
+	if levels.GetLevel("a") != logging.DEBUG || levels.GetLevel("b") != logging.INFO {
+		t.Fail()
+	}
+	if put("level=ERROR") != http.StatusOK {
+		t.Fail()
+	}
+	if levels.GetLevel("a") != logging.ERROR || levels.GetLevel("b") != logging.ERROR || levels.GetLevel("c") != logging.ERROR {
+		t.Fail()
+	}
+	if put("level=LOUD") != http.StatusBadRequest {
+		t.Fail()
+	}
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	result := map[string]string{}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if result["a"] != "ERROR" || result[""] != "ERROR" {
+		t.Logf("%v", result)
+		t.Fail()
+	}
+}
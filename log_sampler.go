@@ -0,0 +1,164 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	logging "github.com/op/go-logging"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// logSamplerMaxKeys bounds the number of the distinct messages counted in
+// an interval; the messages beyond are passed on unsampled.
+const logSamplerMaxKeys = 1024
+
+type logSampleKey struct {
+	level   logging.Level
+	module  string
+	message string
+}
+
+type logSample struct {
+	passed     int
+	suppressed int
+}
+
+// LogSampler is a log backend that passes at most burst of the warnings and
+// the errors with the same level, module and message on to the next backend
+// in every interval, and logs how many more of them were suppressed at the
+// end of the interval, so that a message repeated thousands of times a
+// second, as by a client sending garbage, doesn't bury the rest of the log.
+// The messages at the lower levels are passed on as they are.
+type LogSampler struct {
+	next     logging.Backend
+	interval time.Duration
+	burst    int
+	mtx      sync.Mutex
+	samples  map[logSampleKey]*logSample
+	// set while the suppressed messages are reported, which are not sampled
+	isReporting    uint32
+	wg             sync.WaitGroup
+	shutdownChan   chan struct{}
+	isShuttingDown uintptr
+}
+
+func (sampler *LogSampler) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	if level > logging.WARNING || atomic.LoadUint32(&sampler.isReporting) != 0 {
+		return sampler.next.Log(level, calldepth+1, rec)
+	}
+	key := logSampleKey{level: level, module: rec.Module, message: rec.Message()}
+	sampler.mtx.Lock()
+	sample, ok := sampler.samples[key]
+	if !ok && len(sampler.samples) < logSamplerMaxKeys {
+		sample = &logSample{}
+		sampler.samples[key] = sample
+	}
+	if sample != nil && sample.passed >= sampler.burst {
+		sample.suppressed += 1
+		sampler.mtx.Unlock()
+		return nil
+	}
+	if sample != nil {
+		sample.passed += 1
+	}
+	sampler.mtx.Unlock()
+	return sampler.next.Log(level, calldepth+1, rec)
+}
+
+// report logs how many times each message was suppressed in the interval
+// and starts the next interval.
+func (sampler *LogSampler) report() {
+	sampler.mtx.Lock()
+	samples := sampler.samples
+	sampler.samples = make(map[logSampleKey]*logSample)
+	sampler.mtx.Unlock()
+	atomic.StoreUint32(&sampler.isReporting, 1)
+	defer atomic.StoreUint32(&sampler.isReporting, 0)
+	for key, sample := range samples {
+		if sample.suppressed == 0 {
+			continue
+		}
+		logger := logging.MustGetLogger(key.module)
+		format := "%s (suppressed %d more times in %s)"
+		switch key.level {
+		case logging.CRITICAL:
+			logger.Criticalf(format, key.message, sample.suppressed, sampler.interval.String())
+		case logging.ERROR:
+			logger.Errorf(format, key.message, sample.suppressed, sampler.interval.String())
+		default:
+			logger.Warningf(format, key.message, sample.suppressed, sampler.interval.String())
+		}
+	}
+}
+
+func (sampler *LogSampler) String() string {
+	return "log_sampler"
+}
+
+func (sampler *LogSampler) Start() {
+	sampler.wg.Add(1)
+	go func() {
+		defer sampler.wg.Done()
+		ticker := time.NewTicker(sampler.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sampler.report()
+			case <-sampler.shutdownChan:
+				sampler.report()
+				return
+			}
+		}
+	}()
+}
+
+func (sampler *LogSampler) Stop() {
+	if atomic.CompareAndSwapUintptr(&sampler.isShuttingDown, 0, 1) {
+		sampler.shutdownChan <- struct{}{}
+	}
+}
+
+func (sampler *LogSampler) WaitForShutdown() {
+	sampler.wg.Wait()
+}
+
+// NewLogSampler creates a LogSampler passing at most burst of the same
+// message in every interval on to next.
+func NewLogSampler(next logging.Backend, interval time.Duration, burst int) (*LogSampler, error) {
+	if interval <= 0 {
+		return nil, errors.New("log sample interval must be positive")
+	}
+	if burst <= 0 {
+		return nil, errors.New("log sample burst must be positive")
+	}
+	return &LogSampler{
+		next:           next,
+		interval:       interval,
+		burst:          burst,
+		mtx:            sync.Mutex{},
+		samples:        make(map[logSampleKey]*logSample),
+		isReporting:    0,
+		wg:             sync.WaitGroup{},
+		shutdownChan:   make(chan struct{}, 1),
+		isShuttingDown: 0,
+	}, nil
+}
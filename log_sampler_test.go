@@ -0,0 +1,71 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"testing"
+	"time"
+)
+
+func memoryBackendMessages(backend *logging.MemoryBackend) []string {
+	messages := make([]string, 0)
+	for node := backend.Head(); node != nil; node = node.Next() {
+		messages = append(messages, node.Record.Message())
+	}
+	return messages
+}
+
+func Test_LogSampler(t *testing.T) {
+	defer logging.InitForTesting(logging.NOTICE)
+	memory := logging.NewMemoryBackend(100)
+	sampler, err := NewLogSampler(memory, time.Minute, 2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	logging.SetBackend(sampler)
+	logger := logging.MustGetLogger("sampler")
+	for i := 0; i < 5; i++ {
+		logger.Error("Failed to decode data field")
+		logger.Notice("Started handling connection")
+	}
+	logger.Warning("Failed to decode data field")
+	messages := memoryBackendMessages(memory)
+	// 2 errors, 5 notices and a warning
+	if len(messages) != 8 {
+		t.Logf("%+v", messages)
+		t.FailNow()
+	}
+	sampler.report()
+	messages = memoryBackendMessages(memory)
+	if len(messages) != 9 || messages[8] != "Failed to decode data field (suppressed 3 more times in 1m0s)" {
+		t.Logf("%+v", messages)
+		t.FailNow()
+	}
+	// counted afresh in the next interval
+	logger.Error("Failed to decode data field")
+	sampler.report()
+	if len(memoryBackendMessages(memory)) != 10 {
+		t.Fail()
+	}
+
+	if _, err := NewLogSampler(memory, time.Minute, 0); err == nil {
+		t.Fail()
+	}
+}
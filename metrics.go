@@ -0,0 +1,942 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+var metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// SanitizeMetricLabelName turns a string such as the name of a field into a
+// valid label name by replacing the characters not allowed with _.
+func SanitizeMetricLabelName(name string) string {
+	retval := []byte(name)
+	for i, c := range retval {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			retval[i] = '_'
+		}
+	}
+	return string(retval)
+}
+
+type metric struct {
+	labelValues []string
+	bits        uint64 // the value of a counter or a gauge as float64
+	// the values added to a counter by AddShard, summed up with bits;
+	// allocated on the first AddShard as most counters are only added to
+	shards *counterShardSet
+	mtx    sync.Mutex
+	counts []uint64 // the number of the observations in each bucket
+	count  uint64
+	sum    float64
+	// the last exemplar of each bucket including +Inf; nil if none
+	exemplars []*Exemplar
+}
+
+// Exemplar is an observation of a histogram with the labels that identify
+// where it came from, such as a trace.
+type Exemplar struct {
+	Labels map[string]string
+	Value  float64
+	Time   time.Time
+}
+
+// counterShard is a part of the value of a counter, padded to a cache line
+// of its own so that the shards added to at once do not contend.
+type counterShard struct {
+	bits uint64
+	_    [56]byte
+}
+
+type counterShardSet struct {
+	shards []counterShard
+}
+
+// counterShards returns the number of the shards of a counter: the power of
+// two at or above GOMAXPROCS, up to 64.
+func counterShards() int {
+	n := 1
+	for n < runtime.GOMAXPROCS(0) && n < 64 {
+		n <<= 1
+	}
+	return n
+}
+
+func addBits(bits *uint64, v float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		if atomic.CompareAndSwapUint64(bits, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (m *metric) add(v float64) {
+	addBits(&m.bits, v)
+}
+
+// loadShards returns the shards of the counter, or nil if none has been
+// added to yet.
+func (m *metric) loadShards() []counterShard {
+	set := (*counterShardSet)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&m.shards))))
+	if set == nil {
+		return nil
+	}
+	return set.shards
+}
+
+func (m *metric) addShard(shard uint32, v float64) {
+	shards := m.loadShards()
+	if shards == nil {
+		// the one allocated first is taken by all the adders
+		set := &counterShardSet{shards: make([]counterShard, counterShards())}
+		atomic.CompareAndSwapPointer((*unsafe.Pointer)(unsafe.Pointer(&m.shards)), nil, unsafe.Pointer(set))
+		shards = m.loadShards()
+	}
+	addBits(&shards[shard&uint32(len(shards)-1)].bits, v)
+}
+
+func (m *metric) value() float64 {
+	retval := math.Float64frombits(atomic.LoadUint64(&m.bits))
+	shards := m.loadShards()
+	for i := range shards {
+		retval += math.Float64frombits(atomic.LoadUint64(&shards[i].bits))
+	}
+	return retval
+}
+
+type metricFamily struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	buckets    []float64
+	mtx        sync.Mutex
+	metrics    map[string]*metric
+}
+
+func (family *metricFamily) with(labelValues []string) *metric {
+	if len(labelValues) != len(family.labelNames) {
+		panic(fmt.Sprintf("%s takes %d labels, got %d", family.name, len(family.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\x00")
+	family.mtx.Lock()
+	defer family.mtx.Unlock()
+	m, ok := family.metrics[key]
+	if !ok {
+		m = &metric{
+			labelValues: append([]string{}, labelValues...),
+			counts:      make([]uint64, len(family.buckets)),
+		}
+		if family.kind == metricHistogram {
+			m.exemplars = make([]*Exemplar, len(family.buckets)+1)
+		}
+		family.metrics[key] = m
+	}
+	return m
+}
+
+func (family *metricFamily) delete(labelValues []string) {
+	family.mtx.Lock()
+	defer family.mtx.Unlock()
+	delete(family.metrics, strings.Join(labelValues, "\x00"))
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	m *metric
+}
+
+func (counter *Counter) Inc() {
+	counter.m.add(1)
+}
+
+func (counter *Counter) Add(v float64) {
+	counter.m.add(v)
+}
+
+// AddShard adds to the shard of the counter, so that the adders given
+// shards of their own, such as the connections of an input, do not contend
+// with each other.  The shards are summed up on read.
+func (counter *Counter) AddShard(shard uint32, v float64) {
+	counter.m.addShard(shard, v)
+}
+
+func (counter *Counter) Value() float64 {
+	return counter.m.value()
+}
+
+// Gauge is a value that goes up and down.
+type Gauge struct {
+	m *metric
+}
+
+func (gauge *Gauge) Set(v float64) {
+	atomic.StoreUint64(&gauge.m.bits, math.Float64bits(v))
+}
+
+func (gauge *Gauge) Add(v float64) {
+	gauge.m.add(v)
+}
+
+func (gauge *Gauge) Inc() {
+	gauge.m.add(1)
+}
+
+func (gauge *Gauge) Dec() {
+	gauge.m.add(-1)
+}
+
+func (gauge *Gauge) Value() float64 {
+	return gauge.m.value()
+}
+
+// Histogram counts the observations in the buckets by their upper bounds.
+type Histogram struct {
+	m       *metric
+	buckets []float64
+}
+
+func (histogram *Histogram) Observe(v float64) {
+	histogram.ObserveN(v, 1)
+}
+
+// ObserveN observes the value n times.
+func (histogram *Histogram) ObserveN(v float64, n int) {
+	histogram.observe(v, n, nil)
+}
+
+// ObserveExemplar observes the value n times and keeps the exemplar, whose
+// value is v, as the last one of the bucket.
+func (histogram *Histogram) ObserveExemplar(v float64, n int, labels map[string]string, t time.Time) {
+	histogram.observe(v, n, &Exemplar{Labels: labels, Value: v, Time: t})
+}
+
+func (histogram *Histogram) observe(v float64, n int, exemplar *Exemplar) {
+	histogram.m.mtx.Lock()
+	defer histogram.m.mtx.Unlock()
+	i := 0
+	for i < len(histogram.buckets) && v > histogram.buckets[i] {
+		i += 1
+	}
+	if i < len(histogram.buckets) {
+		histogram.m.counts[i] += uint64(n)
+	}
+	if exemplar != nil {
+		histogram.m.exemplars[i] = exemplar
+	}
+	histogram.m.count += uint64(n)
+	histogram.m.sum += v * float64(n)
+}
+
+// CounterVec is a family of counters distinguished by the label values.
+type CounterVec struct {
+	family *metricFamily
+}
+
+// With returns the counter of the label values, given in the order of the
+// label names; the components look it up once and keep it.
+func (vec *CounterVec) With(labelValues ...string) *Counter {
+	return &Counter{m: vec.family.with(labelValues)}
+}
+
+func (vec *CounterVec) Delete(labelValues ...string) {
+	vec.family.delete(labelValues)
+}
+
+type GaugeVec struct {
+	family *metricFamily
+}
+
+func (vec *GaugeVec) With(labelValues ...string) *Gauge {
+	return &Gauge{m: vec.family.with(labelValues)}
+}
+
+func (vec *GaugeVec) Delete(labelValues ...string) {
+	vec.family.delete(labelValues)
+}
+
+type HistogramVec struct {
+	family *metricFamily
+}
+
+func (vec *HistogramVec) With(labelValues ...string) *Histogram {
+	return &Histogram{m: vec.family.with(labelValues), buckets: vec.family.buckets}
+}
+
+func (vec *HistogramVec) Delete(labelValues ...string) {
+	vec.family.delete(labelValues)
+}
+
+// MetricsRegistry holds the metrics and serves them in the Prometheus text
+// exposition format, or in the OpenMetrics format, which carries the
+// exemplars of the histograms, if the client accepts it.
+type MetricsRegistry struct {
+	mtx      sync.Mutex
+	families map[string]*metricFamily
+}
+
+// DefaultMetrics is the registry the built-in components report to.
+var DefaultMetrics = NewMetricsRegistry()
+
+// register returns the family of the name, which may have been registered
+// before with the same kind and labels, e.g. by the filter of the same
+// section before reloading.
+func (registry *MetricsRegistry) register(name string, help string, kind string, labelNames []string, buckets []float64) (*metricFamily, error) {
+	if !metricNameRegexp.MatchString(name) {
+		return nil, errors.New(fmt.Sprintf("invalid metric name: %s", name))
+	}
+	for _, labelName := range labelNames {
+		if !labelNameRegexp.MatchString(labelName) || labelName == "le" {
+			return nil, errors.New(fmt.Sprintf("%s: invalid label name: %s", name, labelName))
+		}
+	}
+	registry.mtx.Lock()
+	defer registry.mtx.Unlock()
+	if family, ok := registry.families[name]; ok {
+		same := family.kind == kind && len(family.labelNames) == len(labelNames) && len(family.buckets) == len(buckets)
+		for i := 0; same && i < len(labelNames); i += 1 {
+			same = family.labelNames[i] == labelNames[i]
+		}
+		for i := 0; same && i < len(buckets); i += 1 {
+			same = family.buckets[i] == buckets[i]
+		}
+		if !same {
+			return nil, errors.New(fmt.Sprintf("metric %s is already registered differently", name))
+		}
+		return family, nil
+	}
+	family := &metricFamily{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		buckets:    buckets,
+		mtx:        sync.Mutex{},
+		metrics:    make(map[string]*metric),
+	}
+	registry.families[name] = family
+	return family, nil
+}
+
+func (registry *MetricsRegistry) NewCounterVec(name string, help string, labelNames ...string) (*CounterVec, error) {
+	family, err := registry.register(name, help, metricCounter, labelNames, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &CounterVec{family: family}, nil
+}
+
+func (registry *MetricsRegistry) NewGaugeVec(name string, help string, labelNames ...string) (*GaugeVec, error) {
+	family, err := registry.register(name, help, metricGauge, labelNames, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &GaugeVec{family: family}, nil
+}
+
+// NewHistogramVec registers a histogram with the upper bounds of the
+// buckets in ascending order, not including +Inf.
+func (registry *MetricsRegistry) NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) (*HistogramVec, error) {
+	if !sort.Float64sAreSorted(buckets) {
+		return nil, errors.New(fmt.Sprintf("%s: buckets must be in ascending order", name))
+	}
+	family, err := registry.register(name, help, metricHistogram, labelNames, buckets)
+	if err != nil {
+		return nil, err
+	}
+	return &HistogramVec{family: family}, nil
+}
+
+func mustCounterVec(vec *CounterVec, err error) *CounterVec {
+	if err != nil {
+		panic(err.Error())
+	}
+	return vec
+}
+
+func mustHistogramVec(vec *HistogramVec, err error) *HistogramVec {
+	if err != nil {
+		panic(err.Error())
+	}
+	return vec
+}
+
+func mustGaugeVec(vec *GaugeVec, err error) *GaugeVec {
+	if err != nil {
+		panic(err.Error())
+	}
+	return vec
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		parts = append(parts, name+`="`+labelValueReplacer.Replace(values[i])+`"`)
+	}
+	if len(extra) == 2 {
+		parts = append(parts, extra[0]+`="`+extra[1]+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// formatExemplar formats the exemplar to follow a sample in the OpenMetrics
+// format.
+func formatExemplar(exemplar *Exemplar) string {
+	if exemplar == nil {
+		return ""
+	}
+	names := make([]string, 0, len(exemplar.Labels))
+	for name := range exemplar.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = exemplar.Labels[name]
+	}
+	labels := formatLabels(names, values)
+	if labels == "" {
+		labels = "{}"
+	}
+	return fmt.Sprintf(" # %s %s %s", labels, formatMetricValue(exemplar.Value), strconv.FormatFloat(float64(exemplar.Time.UnixNano())/1e9, 'f', 3, 64))
+}
+
+// write writes the family in the Prometheus text format, or in the
+// OpenMetrics format with the exemplars if openMetrics is set.
+func (family *metricFamily) write(w *bufio.Writer, openMetrics bool) {
+	family.mtx.Lock()
+	metrics := make([]*metric, 0, len(family.metrics))
+	for _, m := range family.metrics {
+		metrics = append(metrics, m)
+	}
+	family.mtx.Unlock()
+	if len(metrics) == 0 {
+		return
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		return strings.Join(metrics[i].labelValues, "\x00") < strings.Join(metrics[j].labelValues, "\x00")
+	})
+	name, kind := family.name, family.kind
+	if openMetrics && kind == metricCounter {
+		// the samples of a counter are suffixed by _total in OpenMetrics
+		if strings.HasSuffix(name, "_total") {
+			name = strings.TrimSuffix(name, "_total")
+		} else {
+			kind = "unknown"
+		}
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.Replace(family.help, "\n", " ", -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+	for _, m := range metrics {
+		if family.kind != metricHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", family.name, formatLabels(family.labelNames, m.labelValues), formatMetricValue(m.value()))
+			continue
+		}
+		m.mtx.Lock()
+		cumulative := uint64(0)
+		exemplar := func(i int) string {
+			if !openMetrics {
+				return ""
+			}
+			return formatExemplar(m.exemplars[i])
+		}
+		for i, bound := range family.buckets {
+			cumulative += m.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d%s\n", family.name, formatLabels(family.labelNames, m.labelValues, "le", formatMetricValue(bound)), cumulative, exemplar(i))
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d%s\n", family.name, formatLabels(family.labelNames, m.labelValues, "le", "+Inf"), m.count, exemplar(len(family.buckets)))
+		fmt.Fprintf(w, "%s_sum%s %s\n", family.name, formatLabels(family.labelNames, m.labelValues), formatMetricValue(m.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", family.name, formatLabels(family.labelNames, m.labelValues), m.count)
+		m.mtx.Unlock()
+	}
+}
+
+// WriteText writes the metrics in the Prometheus text exposition format.
+func (registry *MetricsRegistry) WriteText(w *bufio.Writer) error {
+	registry.write(w, false)
+	return w.Flush()
+}
+
+// WriteOpenMetrics writes the metrics in the OpenMetrics text format with
+// the exemplars of the histograms.
+func (registry *MetricsRegistry) WriteOpenMetrics(w *bufio.Writer) error {
+	registry.write(w, true)
+	w.WriteString("# EOF\n")
+	return w.Flush()
+}
+
+func (registry *MetricsRegistry) write(w *bufio.Writer, openMetrics bool) {
+	registry.mtx.Lock()
+	families := make([]*metricFamily, 0, len(registry.families))
+	for _, family := range registry.families {
+		families = append(families, family)
+	}
+	registry.mtx.Unlock()
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+	for _, family := range families {
+		family.write(w, openMetrics)
+	}
+}
+
+// Snapshot returns the current values by the metric names and then by the
+// labels formatted as in the text format; histograms are represented by
+// their counts and sums.
+func (registry *MetricsRegistry) Snapshot() map[string]map[string]float64 {
+	registry.mtx.Lock()
+	families := make([]*metricFamily, 0, len(registry.families))
+	for _, family := range registry.families {
+		families = append(families, family)
+	}
+	registry.mtx.Unlock()
+	retval := make(map[string]map[string]float64, len(families))
+	for _, family := range families {
+		family.mtx.Lock()
+		for _, m := range family.metrics {
+			labels := formatLabels(family.labelNames, m.labelValues)
+			names := []string{family.name}
+			values := []float64{m.value()}
+			if family.kind == metricHistogram {
+				m.mtx.Lock()
+				names = []string{family.name + "_count", family.name + "_sum"}
+				values = []float64{float64(m.count), m.sum}
+				m.mtx.Unlock()
+			}
+			for i, name := range names {
+				if retval[name] == nil {
+					retval[name] = make(map[string]float64)
+				}
+				retval[name][labels] = values[i]
+			}
+		}
+		family.mtx.Unlock()
+	}
+	return retval
+}
+
+// metricSample is the value of a metric at a time; histograms have the
+// count and the sum of the observations instead.
+type metricSample struct {
+	name        string
+	kind        string
+	labelNames  []string
+	labelValues []string
+	value       float64
+	count       uint64
+	sum         float64
+}
+
+// samples returns the current values of the metrics ordered by the names.
+func (registry *MetricsRegistry) samples() []metricSample {
+	registry.mtx.Lock()
+	families := make([]*metricFamily, 0, len(registry.families))
+	for _, family := range registry.families {
+		families = append(families, family)
+	}
+	registry.mtx.Unlock()
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+	retval := make([]metricSample, 0, len(families))
+	for _, family := range families {
+		family.mtx.Lock()
+		for _, m := range family.metrics {
+			sample := metricSample{
+				name:        family.name,
+				kind:        family.kind,
+				labelNames:  family.labelNames,
+				labelValues: m.labelValues,
+				value:       m.value(),
+			}
+			if family.kind == metricHistogram {
+				m.mtx.Lock()
+				sample.count = m.count
+				sample.sum = m.sum
+				m.mtx.Unlock()
+			}
+			retval = append(retval, sample)
+		}
+		family.mtx.Unlock()
+	}
+	return retval
+}
+
+func (registry *MetricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text") {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		registry.WriteOpenMetrics(bufio.NewWriter(w))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	registry.WriteText(bufio.NewWriter(w))
+}
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{
+		mtx:      sync.Mutex{},
+		families: make(map[string]*metricFamily),
+	}
+}
+
+// The metrics of the built-in components, named
+// fluentd_forwarder_SUBSYSTEM_NAME[_UNIT][_total] by the subsystem they
+// belong to: input for the receipt of the records, buffer for the records
+// buffered by the outputs, output for the delivery to the destinations, and
+// error and dropped for the records lost on the way.
+var (
+	inputRecords        = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_input_records_total", "Number of the records received.", "listener"))
+	inputBytes          = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_input_bytes_total", "Number of the bytes received.", "listener"))
+	inputConnections    = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_input_connections_total", "Number of the connections accepted.", "listener"))
+	inputOpenConns      = mustGaugeVec(DefaultMetrics.NewGaugeVec("fluentd_forwarder_input_open_connections", "Number of the connections currently open.", "listener"))
+	inputModeConns      = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_input_mode_connections_total", "Number of the connections by the protocol mode of their first message.", "listener", "mode"))
+	inputModeRecords    = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_input_mode_records_total", "Number of the records received by the protocol mode of their message.", "listener", "mode"))
+	inputRecordSize     = mustHistogramVec(DefaultMetrics.NewHistogramVec("fluentd_forwarder_input_record_size_bytes", "Size of the records received.", SizeBuckets, "listener"))
+	inputChunkSize      = mustHistogramVec(DefaultMetrics.NewHistogramVec("fluentd_forwarder_input_chunk_size_bytes", "Size of the messages received, each of which carries a chunk of the records.", SizeBuckets, "listener"))
+	inputEmits          = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_input_emits_total", "Number of the batches of records passed on.", "listener"))
+	inputEmitErrors     = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_input_emit_errors_total", "Number of the batches of records that failed to be passed on.", "listener"))
+	outputRecords       = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_buffer_records_total", "Number of the records written to the buffer.", "output"))
+	outputEmits         = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_buffer_emits_total", "Number of the record sets written to the buffer.", "output"))
+	outputBytes         = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_output_bytes_total", "Number of the bytes sent to the destination.", "output"))
+	outputRetries       = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_output_retries_total", "Number of the failed attempts to send to the destination.", "output"))
+	outputBufferBytes   = mustGaugeVec(DefaultMetrics.NewGaugeVec("fluentd_forwarder_buffer_bytes", "Size of the buffered chunks.", "output"))
+	outputBufferChunks  = mustGaugeVec(DefaultMetrics.NewGaugeVec("fluentd_forwarder_buffer_chunks", "Number of the buffered chunks.", "output"))
+	outputUp            = mustGaugeVec(DefaultMetrics.NewGaugeVec("fluentd_forwarder_output_up", "Whether the last attempt to send to the destination succeeded.", "output"))
+	outputLatency       = mustHistogramVec(DefaultMetrics.NewHistogramVec("fluentd_forwarder_output_latency_seconds", "Time from the receipt of the records by the output to their delivery to the destination.", DeliveryLatencyBuckets, "output"))
+	outputFlushes       = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_output_flushes_total", "Number of the chunks delivered to the destination.", "output"))
+	outputFailures      = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_output_failures_total", "Number of the failed attempts to send to the destination by the class of the error.", "output", "class"))
+	outputFlushTimeouts = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_output_flush_timeouts_total", "Number of the flushes of the chunks abandoned for taking too long.", "output"))
+	errorRecords        = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_error_records_total", "Number of the records that failed in a filter or an output.", "stage"))
+	droppedRecords      = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_dropped_records_total", "Number of the records dropped without being delivered.", "reason"))
+	droppedMessages     = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_dropped_messages_total", "Number of the messages from the clients dropped before their records were known.", "reason"))
+)
+
+// The reasons the records are dropped for, which label
+// fluentd_forwarder_dropped_records_total and
+// fluentd_forwarder_dropped_messages_total.
+const (
+	// the message from the client could not be decoded
+	DropDecodeError = "decode_error"
+	// the input failed to pass the records on
+	DropEmitError = "emit_error"
+	// no output matched the records
+	DropUnmatched = "unmatched"
+	// the records failed in a filter or an output and no @ERROR label took
+	// them
+	DropError = "error"
+	// the output failed to write the records to its buffer
+	DropBufferError = "buffer_error"
+	// the records arrived at an output already shut down
+	DropShutdown = "shutdown"
+)
+
+// countDropped counts the records dropped for the reason.
+func countDropped(reason string, records int) {
+	if records > 0 {
+		droppedRecords.With(reason).Add(float64(records))
+	}
+}
+
+// recordCount returns the number of the records in the record sets.
+func recordCount(recordSets []FluentRecordSet) int {
+	n := 0
+	for _, recordSet := range recordSets {
+		n += len(recordSet.Records)
+	}
+	return n
+}
+
+// outputMetrics are the metrics of an output, labeled with its destination.
+type outputMetrics struct {
+	name         string
+	records      *Counter
+	emits        *Counter
+	bytes        *Counter
+	retries      *Counter
+	bufferBytes  *Gauge
+	bufferChunks *Gauge
+	up           *Gauge
+	latency      *Histogram
+	delivery     *deliveryTracker
+	// the flushes abandoned for the hard timeout
+	flushTimeouts *Counter
+	flushes       *Counter
+}
+
+// The classes of the errors by which the failures of the outputs are
+// counted.
+const (
+	// the destination could not be resolved
+	ErrorClassDNS = "dns"
+	// the connection to the destination could not be established
+	ErrorClassConnect = "connect"
+	// an operation on the connection timed out
+	ErrorClassTimeout = "timeout"
+	// the flush of a chunk was abandoned for taking too long
+	ErrorClassFlushTimeout = "flush_timeout"
+	// the connection failed otherwise
+	ErrorClassNetwork = "network"
+	ErrorClassOther   = "other"
+)
+
+// errorClass classifies the error an output failed with.
+func errorClass(err error) string {
+	flushTimeoutErr := (*FlushTimeoutError)(nil)
+	if errors.As(err, &flushTimeoutErr) {
+		return ErrorClassFlushTimeout
+	}
+	dnsErr := (*net.DNSError)(nil)
+	if errors.As(err, &dnsErr) {
+		return ErrorClassDNS
+	}
+	opErr := (*net.OpError)(nil)
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return ErrorClassConnect
+	}
+	netErr := (net.Error)(nil)
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return ErrorClassTimeout
+		}
+		return ErrorClassNetwork
+	}
+	return ErrorClassOther
+}
+
+// failed counts a failed attempt to send to the destination.
+func (metrics *outputMetrics) failed(err error) {
+	metrics.up.Set(0)
+	metrics.retries.Inc()
+	outputFailures.With(metrics.name, errorClass(err)).Inc()
+}
+
+// SizeBuckets are the buckets of the sizes of the records and the chunks in
+// bytes.
+var SizeBuckets = []float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216, 67108864}
+
+// DeliveryLatencyBuckets are the buckets of the delivery latency in seconds.
+var DeliveryLatencyBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}
+
+type deliveryMark struct {
+	time    time.Time
+	tag     string
+	records int
+	trace   SpanContext
+}
+
+// deliveryTracker measures the latency of the delivery of the records
+// written to a journal.  As a flush sends everything written before it
+// started, the records are observed as delivered once a flush succeeds.
+// The flush is also traced for the traced records.
+type deliveryTracker struct {
+	output    string
+	mtx       sync.Mutex
+	marks     []deliveryMark
+	histogram *Histogram
+	now       func() time.Time
+	// when the flush in progress started; zero if none is
+	flushStartedAt time.Time
+	// when the last successful flush completed; zero if none has
+	lastFlushedAt time.Time
+}
+
+// received marks the records as written to the journal.
+func (tracker *deliveryTracker) received(tag string, records int, trace SpanContext) {
+	if records <= 0 {
+		return
+	}
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+	tracker.marks = append(tracker.marks, deliveryMark{time: tracker.now(), tag: tag, records: records, trace: trace})
+}
+
+// startFlush marks the start of a flush and returns the number of the marks
+// to be delivered by it.
+func (tracker *deliveryTracker) startFlush() int {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+	tracker.flushStartedAt = tracker.now()
+	return len(tracker.marks)
+}
+
+// endFlush marks the end of the flush, which delivered the first n marks
+// if it succeeded.  The latencies are observed with the exemplars of the ID
+// of the last chunk flushed and the trace of the records, if any.
+func (tracker *deliveryTracker) endFlush(n int, chunkId string, err error) {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+	flushStart := tracker.flushStartedAt
+	tracker.flushStartedAt = time.Time{}
+	if err != nil {
+		for _, mark := range tracker.marks[:n] {
+			DefaultRecordTracer.Tracef(mark.tag, "%s: failed to flush %d records; will be retried: %s", tracker.output, mark.records, err.Error())
+		}
+		return
+	}
+	now := tracker.now()
+	tracker.lastFlushedAt = now
+	for _, mark := range tracker.marks[:n] {
+		DefaultRecordTracer.Tracef(mark.tag, "%s: flushed %d records", tracker.output, mark.records)
+		exemplar := make(map[string]string, 2)
+		if chunkId != "" {
+			exemplar["chunk_id"] = chunkId
+		}
+		if mark.trace.IsValid() {
+			exemplar["trace_id"] = hex.EncodeToString(mark.trace.TraceID[:])
+		}
+		tracker.histogram.ObserveExemplar(now.Sub(mark.time).Seconds(), mark.records, exemplar, now)
+		if mark.trace.IsValid() {
+			span := DefaultTracer.StartSpan("flush", mark.trace, flushStart)
+			if span != nil {
+				span.Attributes["output"] = tracker.output
+				span.Attributes["records"] = strconv.Itoa(mark.records)
+				span.Finish(now)
+			}
+		}
+	}
+	tracker.marks = append(tracker.marks[:0], tracker.marks[n:]...)
+}
+
+// progress returns when the flush in progress started and when the oldest
+// of the records not delivered yet were received, either of which is zero
+// if there is none.
+func (tracker *deliveryTracker) progress() (time.Time, time.Time) {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+	if len(tracker.marks) == 0 {
+		return tracker.flushStartedAt, time.Time{}
+	}
+	return tracker.flushStartedAt, tracker.marks[0].time
+}
+
+// lastFlushed returns when the last successful flush completed, or zero if
+// none has.
+func (tracker *deliveryTracker) lastFlushed() time.Time {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+	return tracker.lastFlushedAt
+}
+
+func newDeliveryTracker(output string, histogram *Histogram) *deliveryTracker {
+	return &deliveryTracker{
+		output:    output,
+		mtx:       sync.Mutex{},
+		marks:     make([]deliveryMark, 0),
+		histogram: histogram,
+		now:       time.Now,
+	}
+}
+
+func newOutputMetrics(name string) outputMetrics {
+	metrics := outputMetrics{
+		name:          name,
+		records:       outputRecords.With(name),
+		emits:         outputEmits.With(name),
+		bytes:         outputBytes.With(name),
+		retries:       outputRetries.With(name),
+		bufferBytes:   outputBufferBytes.With(name),
+		bufferChunks:  outputBufferChunks.With(name),
+		up:            outputUp.With(name),
+		latency:       outputLatency.With(name),
+		flushTimeouts: outputFlushTimeouts.With(name),
+		flushes:       outputFlushes.With(name),
+	}
+	metrics.delivery = newDeliveryTracker(name, metrics.latency)
+	// the destination is assumed to be reachable until it turns out not
+	metrics.up.Set(1)
+	return metrics
+}
+
+func (metrics *outputMetrics) pluginInfo(_type string) PluginInfo {
+	return PluginInfo{
+		Category:              "output",
+		Type:                  _type,
+		EmitRecords:           int64(metrics.records.Value()),
+		EmitCount:             int64(metrics.emits.Value()),
+		RetryCount:            int64(metrics.retries.Value()),
+		BufferQueueLength:     int64(metrics.bufferChunks.Value()),
+		BufferTotalQueuedSize: int64(metrics.bufferBytes.Value()),
+	}
+}
+
+func (metrics *outputMetrics) health() OutputHealth {
+	flushStartedAt, oldestBufferedAt := metrics.delivery.progress()
+	return OutputHealth{
+		Name:             metrics.name,
+		IsUpstreamUp:     metrics.up.Value() != 0,
+		BufferedBytes:    int64(metrics.bufferBytes.Value()),
+		FlushStartedAt:   flushStartedAt,
+		OldestBufferedAt: oldestBufferedAt,
+		LastFlushedAt:    metrics.delivery.lastFlushed(),
+	}
+}
+
+// observeBuffer updates the buffer usage by the journals of the group.
+func (metrics *outputMetrics) observeBuffer(journalGroup JournalGroup) {
+	chunks, size := 0, int64(0)
+	for _, key := range journalGroup.GetJournalKeys() {
+		n, s := journalGroup.GetJournal(key).Usage()
+		chunks += n
+		size += s
+	}
+	metrics.bufferChunks.Set(float64(chunks))
+	metrics.bufferBytes.Set(float64(size))
+}
@@ -0,0 +1,250 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_MetricsRegistry(t *testing.T) {
+	registry := NewMetricsRegistry()
+	counter, err := registry.NewCounterVec("records_total", "Number of the records.", "listener")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	counter.With("127.0.0.1:24224").Add(3)
+	counter.With(`a"b`).Inc()
+	gauge, _ := registry.NewGaugeVec("open_connections", "Number of the connections.")
+	gauge.With().Inc()
+	gauge.With().Inc()
+	gauge.With().Dec()
+	histogram, _ := registry.NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1})
+	for _, v := range []float64{0.05, 0.5, 0.7, 3} {
+		histogram.With().Observe(v)
+	}
+	// registered again by the same name
+	if again, err := registry.NewCounterVec("records_total", "Number of the records.", "listener"); err != nil || again.With("127.0.0.1:24224").Value() != 3 {
+		t.Fail()
+	}
+	for _, args := range [][]string{{"records_total", "other"}, {"bad-name"}, {"ok", "bad.label"}} {
+		if _, err := registry.NewCounterVec(args[0], "", args[1:]...); err == nil {
+			t.Logf("%+v", args)
+			t.Fail()
+		}
+	}
+	buffer := bytes.Buffer{}
+	err = registry.WriteText(bufio.NewWriter(&buffer))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum 4.25
+latency_seconds_count 4
+# HELP open_connections Number of the connections.
+# TYPE open_connections gauge
+open_connections 1
+# HELP records_total Number of the records.
+# TYPE records_total counter
+records_total{listener="127.0.0.1:24224"} 3
+records_total{listener="a\"b"} 1
+`
+	if buffer.String() != expected {
+		t.Logf("%s", buffer.String())
+		t.Fail()
+	}
+	snapshot := registry.Snapshot()
+	if snapshot["records_total"][`{listener="127.0.0.1:24224"}`] != 3 || snapshot["open_connections"][""] != 1 || snapshot["latency_seconds_count"][""] != 4 {
+		t.Logf("%+v", snapshot)
+		t.Fail()
+	}
+	if SanitizeMetricLabelName("kubernetes.pod-name") != "kubernetes_pod_name" || SanitizeMetricLabelName("1a") != "_a" {
+		t.Fail()
+	}
+}
+
+func Test_Counter_AddShard(t *testing.T) {
+	registry := NewMetricsRegistry()
+	counter, _ := registry.NewCounterVec("records_total", "Number of the records.")
+	counter.With().Add(0)
+	if counter.With().m.loadShards() != nil {
+		t.Error("the shards are allocated before AddShard")
+	}
+	wg := sync.WaitGroup{}
+	for shard := uint32(0); shard < 100; shard++ {
+		wg.Add(1)
+		go func(shard uint32) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				counter.With().AddShard(shard, 1)
+			}
+		}(shard)
+	}
+	wg.Wait()
+	counter.With().Add(0.5)
+	if counter.With().Value() != 100000.5 {
+		t.Errorf("unexpected value: %f", counter.With().Value())
+	}
+	if snapshot := registry.Snapshot(); snapshot["records_total"][""] != 100000.5 {
+		t.Errorf("%+v", snapshot)
+	}
+}
+
+func Test_DeliveryTracker(t *testing.T) {
+	registry := NewMetricsRegistry()
+	vec, _ := registry.NewHistogramVec("latency_seconds", "Latency.", []float64{1, 10})
+	now := time.Unix(1000, 0)
+	tracker := newDeliveryTracker("test", vec.With())
+	tracker.now = func() time.Time { return now }
+	tracker.received("app", 3, SpanContext{})
+	now = now.Add(5 * time.Second)
+	tracker.received("app", 2, SpanContext{})
+	tracker.received("app", 0, SpanContext{})
+	pending := tracker.startFlush()
+	// written while flushing; left to the next flush
+	tracker.received("app", 1, SpanContext{})
+	now = now.Add(500 * time.Millisecond)
+	if flushStartedAt, oldestAt := tracker.progress(); flushStartedAt != time.Unix(1005, 0) || oldestAt != time.Unix(1000, 0) {
+		t.Fail()
+	}
+	tracker.endFlush(pending, "", nil)
+	snapshot := registry.Snapshot()
+	if snapshot["latency_seconds_count"][""] != 5 || snapshot["latency_seconds_sum"][""] != 3*5.5+2*0.5 {
+		t.Logf("%+v", snapshot)
+		t.Fail()
+	}
+	if flushStartedAt, oldestAt := tracker.progress(); !flushStartedAt.IsZero() || oldestAt != time.Unix(1005, 0) {
+		t.Fail()
+	}
+	// nothing is delivered by a failed flush
+	tracker.endFlush(tracker.startFlush(), "", errors.New("failed"))
+	if _, oldestAt := tracker.progress(); oldestAt != time.Unix(1005, 0) {
+		t.Fail()
+	}
+}
+
+func Test_ErrorClass(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// nothing listens on the address once closed
+	addr := listener.Addr().String()
+	listener.Close()
+	_, dialErr := net.Dial("tcp", addr)
+	cases := []struct {
+		err   error
+		class string
+	}{
+		{dialErr, ErrorClassConnect},
+		{&net.DNSError{Err: "no such host", Name: "upstream.invalid"}, ErrorClassDNS},
+		{&net.OpError{Op: "write", Net: "tcp", Err: os.ErrDeadlineExceeded}, ErrorClassTimeout},
+		{&net.OpError{Op: "write", Net: "tcp", Err: errors.New("broken pipe")}, ErrorClassNetwork},
+		{fmt.Errorf("flush failed: %w", &FlushTimeoutError{Message: "timed out"}), ErrorClassFlushTimeout},
+		{errors.New("Failed to decode data field"), ErrorClassOther},
+	}
+	for _, c := range cases {
+		if class := errorClass(c.err); class != c.class {
+			t.Errorf("%v: %s, expected %s", c.err, class, c.class)
+		}
+	}
+}
+
+func Test_MetricsRegistry_OpenMetrics(t *testing.T) {
+	registry := NewMetricsRegistry()
+	counter, _ := registry.NewCounterVec("records_total", "Number of the records.")
+	counter.With().Add(3)
+	histogram, _ := registry.NewHistogramVec("latency_seconds", "Latency.", []float64{1, 10})
+	histogram.With().ObserveExemplar(0.5, 2, map[string]string{"chunk_id": "0123abcd", "trace_id": "4bf92f3577b34da6a3ce929d0e0e4736"}, time.Unix(1000, 0))
+	histogram.With().Observe(20)
+	buf := bytes.Buffer{}
+	err := registry.WriteOpenMetrics(bufio.NewWriter(&buf))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="1"} 2 # {chunk_id="0123abcd",trace_id="4bf92f3577b34da6a3ce929d0e0e4736"} 0.5 1000.000
+latency_seconds_bucket{le="10"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 21
+latency_seconds_count 3
+# HELP records Number of the records.
+# TYPE records counter
+records_total 3
+# EOF
+`
+	if buf.String() != expected {
+		t.Log(buf.String())
+		t.Fail()
+	}
+
+	// the exemplars are left out of the Prometheus text format
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(recorder.Body.String(), "chunk_id") || strings.Contains(recorder.Body.String(), "# EOF") {
+		t.Fail()
+	}
+	recorder = httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/metrics", nil)
+	request.Header.Set("Accept", "application/openmetrics-text; version=1.0.0,text/plain;q=0.5")
+	registry.ServeHTTP(recorder, request)
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "application/openmetrics-text") || recorder.Body.String() != expected {
+		t.Fail()
+	}
+}
+
+// BenchmarkCounter adds to a counter on every CPU, by Add to the one value
+// and by AddShard to the shard of each adder.
+func BenchmarkCounter(b *testing.B) {
+	registry := NewMetricsRegistry()
+	vec, _ := registry.NewCounterVec("records_total", "Number of the records.", "method")
+	b.Run("Add", func(b *testing.B) {
+		counter := vec.With("add")
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				counter.Add(1)
+			}
+		})
+	})
+	b.Run("AddShard", func(b *testing.B) {
+		counter := vec.With("add-shard")
+		next := uint32(0)
+		b.RunParallel(func(pb *testing.PB) {
+			shard := atomic.AddUint32(&next, 1)
+			for pb.Next() {
+				counter.AddShard(shard, 1)
+			}
+		})
+	})
+}
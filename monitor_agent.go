@@ -0,0 +1,91 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+)
+
+// PluginInfo is what the monitor agent API shows about an input or an
+// output.  The counts are of the records and the record sets passed on by
+// an input or buffered by an output.
+type PluginInfo struct {
+	Category    string
+	Type        string
+	EmitRecords int64
+	EmitCount   int64
+	// of the outputs only
+	RetryCount            int64
+	BufferQueueLength     int64
+	BufferTotalQueuedSize int64
+}
+
+type PluginInfoReporter interface {
+	PluginInfo() PluginInfo
+}
+
+// MonitorAgent serves the list of the inputs and the outputs in the format
+// of /api/plugins.json of in_monitor_agent of fluentd, so that the tools
+// watching fluentd can be used as they are.  The workers that do not
+// implement PluginInfoReporter are left out.
+type MonitorAgent struct {
+	workers func() []Worker
+}
+
+func (agent *MonitorAgent) Plugins() []map[string]interface{} {
+	retval := make([]map[string]interface{}, 0)
+	for _, worker := range agent.workers() {
+		reporter, ok := worker.(PluginInfoReporter)
+		if !ok {
+			continue
+		}
+		info := reporter.PluginInfo()
+		plugin := map[string]interface{}{
+			"plugin_id":       fmt.Sprintf("object:%x", reflect.ValueOf(worker).Pointer()),
+			"plugin_category": info.Category,
+			"type":            info.Type,
+			"config":          map[string]interface{}{"@type": info.Type},
+			"output_plugin":   info.Category == "output",
+			"retry_count":     nil,
+			"emit_records":    info.EmitRecords,
+			"emit_count":      info.EmitCount,
+		}
+		if info.Category == "output" {
+			plugin["retry_count"] = info.RetryCount
+			plugin["buffer_queue_length"] = info.BufferQueueLength
+			plugin["buffer_total_queued_size"] = info.BufferTotalQueuedSize
+		}
+		retval = append(retval, plugin)
+	}
+	return retval
+}
+
+func (agent *MonitorAgent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"plugins": agent.Plugins()})
+}
+
+// NewMonitorAgent creates a MonitorAgent; workers returns the components to
+// list, which may change by reloading.
+func NewMonitorAgent(workers func() []Worker) *MonitorAgent {
+	return &MonitorAgent{workers: workers}
+}
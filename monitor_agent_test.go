@@ -0,0 +1,67 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+type pluginInfoWorker struct {
+	info PluginInfo
+}
+
+func (worker *pluginInfoWorker) String() string         { return "worker" }
+func (worker *pluginInfoWorker) Start()                 {}
+func (worker *pluginInfoWorker) Stop()                  {}
+func (worker *pluginInfoWorker) WaitForShutdown()       {}
+func (worker *pluginInfoWorker) PluginInfo() PluginInfo { return worker.info }
+
+func Test_MonitorAgent(t *testing.T) {
+	input := &pluginInfoWorker{info: PluginInfo{Category: "input", Type: "forward", EmitRecords: 10, EmitCount: 2}}
+	output := &pluginInfoWorker{info: PluginInfo{Category: "output", Type: "forward", EmitRecords: 10, EmitCount: 3, RetryCount: 1, BufferQueueLength: 2, BufferTotalQueuedSize: 1024}}
+	agent := NewMonitorAgent(func() []Worker { return []Worker{input, output} })
+	recorder := httptest.NewRecorder()
+	agent.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/plugins.json", nil))
+	result := struct {
+		Plugins []map[string]interface{} `json:"plugins"`
+	}{}
+	err := json.Unmarshal(recorder.Body.Bytes(), &result)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(result.Plugins) != 2 {
+		t.Fatalf("expected 2 plugins, got %d", len(result.Plugins))
+	}
+	if result.Plugins[0]["plugin_category"] != "input" || result.Plugins[0]["retry_count"] != nil || result.Plugins[0]["emit_records"] != float64(10) {
+		t.Logf("%v", result.Plugins[0])
+		t.Fail()
+	}
+	if _, ok := result.Plugins[0]["buffer_queue_length"]; ok {
+		t.Fail()
+	}
+	if result.Plugins[1]["output_plugin"] != true || result.Plugins[1]["retry_count"] != float64(1) || result.Plugins[1]["buffer_queue_length"] != float64(2) || result.Plugins[1]["buffer_total_queued_size"] != float64(1024) {
+		t.Logf("%v", result.Plugins[1])
+		t.Fail()
+	}
+	if result.Plugins[0]["plugin_id"] == result.Plugins[1]["plugin_id"] {
+		t.Fail()
+	}
+}
@@ -0,0 +1,723 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ugorji/go/codec"
+	"io"
+	"math"
+)
+
+// the depth of the nested arrays and maps msgpackReader decodes at most
+const msgpackMaxDepth = 256
+
+// the elements preallocated at most for an array or a map, as the length
+// given by the sender cannot be trusted until they are read
+const msgpackMaxPrealloc = 1024
+
+// the map keys interned at most by a msgpackReader
+const msgpackMaxInternedKeys = 4096
+
+// the extension type of the EventTime of fluentd
+const msgpackEventTimeExt = 0
+
+// the bytes a value read from the stream is grown by at most at a time, as
+// the length given by the sender cannot be trusted until they arrive
+const msgpackReadChunk = 65536
+
+// msgpackReader decodes the msgpack values of the forward protocol by hand,
+// either from a stream or from the bytes of a packed forward message, into
+// the types the pipeline takes without the reflection of the codec: the
+// strings and the binaries into string, the non-negative integers into
+// uint64 and the negative ones into int64 as the numbers in JSON are, the
+// floats into float64, the arrays into []interface{}, the maps into
+// map[string]interface{} and the extensions into codec.RawExt.  The keys
+// of the maps are interned, as the records sent together mostly share
+// them.
+//
+// The types differ from the ones the codec decoded the records into before:
+// it took the positive fixints and the integers of the signed formats as
+// int64 whatever their values, and the strings and the binaries as []byte,
+// of which only the values of the maps were turned into string afterwards.
+type msgpackReader struct {
+	// nil when reading data
+	stream *bufio.Reader
+	data   []byte
+	pos    int
+	// the bytes of the values longer than the buffer of the stream
+	scratch []byte
+	keys    map[string]string
+	// the size of a frame read at most; unlimited if 0
+	maxFrameSize int
+}
+
+func newMsgpackStreamReader(stream *bufio.Reader) *msgpackReader {
+	return &msgpackReader{stream: stream, keys: make(map[string]string)}
+}
+
+// newMsgpackDataReader returns a reader of the bytes given by reset.
+func newMsgpackDataReader() *msgpackReader {
+	return &msgpackReader{keys: make(map[string]string)}
+}
+
+// entriesReader returns a reader of the entries of the packed forward
+// messages, which shares the keys interned.
+func (reader *msgpackReader) entriesReader() *msgpackReader {
+	return &msgpackReader{keys: reader.keys}
+}
+
+// reset lets the reader decode the bytes, keeping the keys interned so far.
+func (reader *msgpackReader) reset(data []byte) {
+	reader.stream = nil
+	reader.data = data
+	reader.pos = 0
+}
+
+// remaining returns the number of the bytes left of the data.
+func (reader *msgpackReader) remaining() int {
+	return len(reader.data) - reader.pos
+}
+
+// next returns the next n bytes, which are valid until the next read.
+func (reader *msgpackReader) next(n int) ([]byte, error) {
+	if reader.stream == nil {
+		if n > reader.remaining() {
+			return nil, io.ErrUnexpectedEOF
+		}
+		b := reader.data[reader.pos : reader.pos+n]
+		reader.pos += n
+		return b, nil
+	}
+	if n <= reader.stream.Size() {
+		b, err := reader.stream.Peek(n)
+		if err != nil {
+			if err == io.EOF && len(b) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		reader.stream.Discard(n)
+		return b, nil
+	}
+	b, err := readChunked(reader.stream, reader.scratch[:0], n)
+	reader.scratch = b[:0]
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// readChunked appends the next n bytes of the stream to dst, growing dst
+// by msgpackReadChunk at most ahead of the bytes read.
+func readChunked(stream io.Reader, dst []byte, n int) ([]byte, error) {
+	for n > 0 {
+		m := minInt(n, msgpackReadChunk)
+		l := len(dst)
+		if cap(dst)-l < m {
+			grown := make([]byte, l, 2*cap(dst)+m)
+			copy(grown, dst)
+			dst = grown
+		}
+		dst = dst[:l+m]
+		_, err := io.ReadFull(stream, dst[l:])
+		if err != nil {
+			return dst[:l], err
+		}
+		n -= m
+	}
+	return dst, nil
+}
+
+func (reader *msgpackReader) readByte() (byte, error) {
+	if reader.stream == nil {
+		if reader.pos >= len(reader.data) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		reader.pos += 1
+		return reader.data[reader.pos-1], nil
+	}
+	return reader.stream.ReadByte()
+}
+
+// peekByte returns the descriptor of the next value without reading it.
+func (reader *msgpackReader) peekByte() (byte, error) {
+	if reader.stream == nil {
+		if reader.pos >= len(reader.data) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return reader.data[reader.pos], nil
+	}
+	b, err := reader.stream.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// readLength reads the big-endian length of the size given.
+func (reader *msgpackReader) readLength(size int) (int, error) {
+	b, err := reader.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return int(b[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(b)), nil
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint64(n) > math.MaxInt32 {
+		return 0, errors.New(fmt.Sprintf("msgpack: length too large: %d", n))
+	}
+	return int(n), nil
+}
+
+// unexpectedEOF turns the end of the input in the middle of a value into
+// io.ErrUnexpectedEOF, leaving io.EOF for the end between the messages.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readArrayLength reads the header of an array.
+func (reader *msgpackReader) readArrayLength() (int, error) {
+	b, err := reader.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case b >= 0x90 && b <= 0x9f:
+		return int(b & 0x0f), nil
+	case b == 0xdc:
+		n, err := reader.readLength(2)
+		return n, unexpectedEOF(err)
+	case b == 0xdd:
+		n, err := reader.readLength(4)
+		return n, unexpectedEOF(err)
+	}
+	return 0, errors.New(fmt.Sprintf("msgpack: expected an array, got 0x%02x", b))
+}
+
+// readBytesLength reads the header of a string or a binary.
+func (reader *msgpackReader) readBytesLength() (int, error) {
+	b, err := reader.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case b >= 0xa0 && b <= 0xbf:
+		return int(b & 0x1f), nil
+	case b == 0xc4 || b == 0xd9:
+		return reader.readLength(1)
+	case b == 0xc5 || b == 0xda:
+		return reader.readLength(2)
+	case b == 0xc6 || b == 0xdb:
+		return reader.readLength(4)
+	}
+	return 0, errors.New(fmt.Sprintf("msgpack: expected a string, got 0x%02x", b))
+}
+
+// readKey reads a key of a map, which has to be a string.
+func (reader *msgpackReader) readKey() (string, error) {
+	n, err := reader.readBytesLength()
+	if err != nil {
+		return "", unexpectedEOF(err)
+	}
+	b, err := reader.next(n)
+	if err != nil {
+		return "", unexpectedEOF(err)
+	}
+	// the lookup by the bytes converted doesn't allocate
+	if key, ok := reader.keys[string(b)]; ok {
+		return key, nil
+	}
+	key := string(b)
+	if len(reader.keys) < msgpackMaxInternedKeys {
+		reader.keys[key] = key
+	}
+	return key, nil
+}
+
+func isMsgpackMap(b byte) bool {
+	return (b >= 0x80 && b <= 0x8f) || b == 0xde || b == 0xdf
+}
+
+// readMap reads a map whose keys are strings.
+func (reader *msgpackReader) readMap(depth int) (map[string]interface{}, error) {
+	b, err := reader.readByte()
+	if err != nil {
+		return nil, err
+	}
+	n := 0
+	switch {
+	case b >= 0x80 && b <= 0x8f:
+		n = int(b & 0x0f)
+	case b == 0xde:
+		n, err = reader.readLength(2)
+	case b == 0xdf:
+		n, err = reader.readLength(4)
+	default:
+		return nil, errors.New(fmt.Sprintf("msgpack: expected a map, got 0x%02x", b))
+	}
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return reader.readMapEntries(n, depth)
+}
+
+func (reader *msgpackReader) readMapEntries(n int, depth int) (map[string]interface{}, error) {
+	if depth > msgpackMaxDepth {
+		return nil, errors.New("msgpack: nested too deeply")
+	}
+	m := make(map[string]interface{}, minInt(n, msgpackMaxPrealloc))
+	for i := 0; i < n; i += 1 {
+		key, err := reader.readKey()
+		if err != nil {
+			return nil, err
+		}
+		value, err := reader.readValue(depth + 1)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		m[key] = value
+	}
+	return m, nil
+}
+
+func (reader *msgpackReader) readArrayElements(n int, depth int) ([]interface{}, error) {
+	if depth > msgpackMaxDepth {
+		return nil, errors.New("msgpack: nested too deeply")
+	}
+	a := make([]interface{}, 0, minInt(n, msgpackMaxPrealloc))
+	for i := 0; i < n; i += 1 {
+		value, err := reader.readValue(depth + 1)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		a = append(a, value)
+	}
+	return a, nil
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// readValue reads a value of any type.
+func (reader *msgpackReader) readValue(depth int) (interface{}, error) {
+	b, err := reader.readByte()
+	if err != nil {
+		return nil, err
+	}
+	v, err := reader.value(b, depth)
+	return v, unexpectedEOF(err)
+}
+
+// value reads the rest of the value of the descriptor.
+func (reader *msgpackReader) value(b byte, depth int) (interface{}, error) {
+	switch {
+	case b <= 0x7f:
+		return uint64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b >= 0x80 && b <= 0x8f:
+		return reader.readMapEntries(int(b&0x0f), depth)
+	case b >= 0x90 && b <= 0x9f:
+		return reader.readArrayElements(int(b&0x0f), depth)
+	case b >= 0xa0 && b <= 0xbf:
+		return reader.readString(int(b & 0x1f))
+	}
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xd9:
+		return reader.readStringOf(1)
+	case 0xc5, 0xda:
+		return reader.readStringOf(2)
+	case 0xc6, 0xdb:
+		return reader.readStringOf(4)
+	case 0xc7:
+		return reader.readExtOf(1)
+	case 0xc8:
+		return reader.readExtOf(2)
+	case 0xc9:
+		return reader.readExtOf(4)
+	case 0xca:
+		v, err := reader.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(v))), nil
+	case 0xcb:
+		v, err := reader.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(v)), nil
+	case 0xcc:
+		v, err := reader.next(1)
+		if err != nil {
+			return nil, err
+		}
+		return uint64(v[0]), nil
+	case 0xcd:
+		v, err := reader.next(2)
+		if err != nil {
+			return nil, err
+		}
+		return uint64(binary.BigEndian.Uint16(v)), nil
+	case 0xce:
+		v, err := reader.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return uint64(binary.BigEndian.Uint32(v)), nil
+	case 0xcf:
+		v, err := reader.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.Uint64(v), nil
+	case 0xd0:
+		v, err := reader.next(1)
+		if err != nil {
+			return nil, err
+		}
+		return signedInteger(int64(int8(v[0]))), nil
+	case 0xd1:
+		v, err := reader.next(2)
+		if err != nil {
+			return nil, err
+		}
+		return signedInteger(int64(int16(binary.BigEndian.Uint16(v)))), nil
+	case 0xd2:
+		v, err := reader.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return signedInteger(int64(int32(binary.BigEndian.Uint32(v)))), nil
+	case 0xd3:
+		v, err := reader.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return signedInteger(int64(binary.BigEndian.Uint64(v))), nil
+	case 0xd4:
+		return reader.readExt(1)
+	case 0xd5:
+		return reader.readExt(2)
+	case 0xd6:
+		return reader.readExt(4)
+	case 0xd7:
+		return reader.readExt(8)
+	case 0xd8:
+		return reader.readExt(16)
+	case 0xdc:
+		n, err := reader.readLength(2)
+		if err != nil {
+			return nil, err
+		}
+		return reader.readArrayElements(n, depth)
+	case 0xdd:
+		n, err := reader.readLength(4)
+		if err != nil {
+			return nil, err
+		}
+		return reader.readArrayElements(n, depth)
+	case 0xde:
+		n, err := reader.readLength(2)
+		if err != nil {
+			return nil, err
+		}
+		return reader.readMapEntries(n, depth)
+	case 0xdf:
+		n, err := reader.readLength(4)
+		if err != nil {
+			return nil, err
+		}
+		return reader.readMapEntries(n, depth)
+	}
+	return nil, errors.New(fmt.Sprintf("msgpack: invalid descriptor 0x%02x", b))
+}
+
+// signedInteger returns the integer as uint64 if non-negative.
+func signedInteger(v int64) interface{} {
+	if v >= 0 {
+		return uint64(v)
+	}
+	return v
+}
+
+func (reader *msgpackReader) readString(n int) (interface{}, error) {
+	b, err := reader.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// readStringOf reads a string or a binary whose length is of the size.
+func (reader *msgpackReader) readStringOf(size int) (interface{}, error) {
+	n, err := reader.readLength(size)
+	if err != nil {
+		return nil, err
+	}
+	return reader.readString(n)
+}
+
+// readExt reads an extension of the length.
+func (reader *msgpackReader) readExt(n int) (interface{}, error) {
+	b, err := reader.next(n + 1)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, n)
+	copy(data, b[1:])
+	return codec.RawExt{Tag: uint64(b[0]), Data: data}, nil
+}
+
+func (reader *msgpackReader) readExtOf(size int) (interface{}, error) {
+	n, err := reader.readLength(size)
+	if err != nil {
+		return nil, err
+	}
+	return reader.readExt(n)
+}
+
+// eventTime returns the seconds of the value taken as the time of a
+// record: an integer, a float or an EventTime of fluentd.
+func eventTime(v interface{}) (uint64, bool) {
+	switch v_ := v.(type) {
+	case uint64:
+		return v_, true
+	case int64:
+		return uint64(v_), v_ >= 0
+	case float64:
+		return uint64(v_), v_ >= 0
+	case codec.RawExt:
+		if v_.Tag == msgpackEventTimeExt && len(v_.Data) == 8 {
+			return uint64(binary.BigEndian.Uint32(v_.Data)), true
+		}
+	}
+	return 0, false
+}
+
+// readEntry reads an entry of a forward message, [time, record].
+func (reader *msgpackReader) readEntry() (TinyFluentRecord, error) {
+	n, err := reader.readArrayLength()
+	if err != nil {
+		return TinyFluentRecord{}, err
+	}
+	if n < 2 {
+		return TinyFluentRecord{}, errors.New("Failed to decode recordSet")
+	}
+	v, err := reader.readValue(1)
+	if err != nil {
+		return TinyFluentRecord{}, unexpectedEOF(err)
+	}
+	timestamp, ok := eventTime(v)
+	if !ok {
+		return TinyFluentRecord{}, errors.New("Failed to decode timestamp field")
+	}
+	b, err := reader.peekByte()
+	if err != nil {
+		return TinyFluentRecord{}, unexpectedEOF(err)
+	}
+	if !isMsgpackMap(b) {
+		return TinyFluentRecord{}, errors.New("Failed to decode data field")
+	}
+	data, err := reader.readMap(1)
+	if err != nil {
+		return TinyFluentRecord{}, err
+	}
+	for i := 2; i < n; i += 1 {
+		if _, err := reader.readValue(1); err != nil {
+			return TinyFluentRecord{}, unexpectedEOF(err)
+		}
+	}
+	return TinyFluentRecord{Timestamp: timestamp, Data: data}, nil
+}
+
+// msgpackValueSize returns the size of the value of the descriptor that
+// follows it and the number of the values it contains.  The size is -1 if
+// given by the length of lengthSize bytes, and -2 if the length is the one
+// of an array or a map.  lengthSize is -1 for an invalid descriptor.
+func msgpackValueSize(b byte) (size int, lengthSize int, elements int) {
+	switch {
+	case b <= 0x7f || b >= 0xe0 || b == 0xc0 || b == 0xc2 || b == 0xc3:
+		return 0, 0, 0
+	case b >= 0x80 && b <= 0x8f:
+		return 0, 0, 2 * int(b&0x0f)
+	case b >= 0x90 && b <= 0x9f:
+		return 0, 0, int(b & 0x0f)
+	case b >= 0xa0 && b <= 0xbf:
+		return int(b & 0x1f), 0, 0
+	}
+	switch b {
+	case 0xc4, 0xd9:
+		return -1, 1, 0
+	case 0xc5, 0xda:
+		return -1, 2, 0
+	case 0xc6, 0xdb:
+		return -1, 4, 0
+	case 0xc7:
+		return -1, 1, 0
+	case 0xc8:
+		return -1, 2, 0
+	case 0xc9:
+		return -1, 4, 0
+	case 0xcc, 0xd0:
+		return 1, 0, 0
+	case 0xcd, 0xd1:
+		return 2, 0, 0
+	case 0xca, 0xce, 0xd2:
+		return 4, 0, 0
+	case 0xcb, 0xcf, 0xd3:
+		return 8, 0, 0
+	case 0xd4:
+		return 2, 0, 0
+	case 0xd5:
+		return 3, 0, 0
+	case 0xd6:
+		return 5, 0, 0
+	case 0xd7:
+		return 9, 0, 0
+	case 0xd8:
+		return 17, 0, 0
+	case 0xdc, 0xde:
+		return -2, 2, 0
+	case 0xdd, 0xdf:
+		return -2, 4, 0
+	}
+	return 0, -1, 0
+}
+
+// appendN appends the next n bytes to dst.
+func (reader *msgpackReader) appendN(dst []byte, n int) ([]byte, error) {
+	if reader.stream == nil {
+		b, err := reader.next(n)
+		if err != nil {
+			return dst, err
+		}
+		return append(dst, b...), nil
+	}
+	dst, err := readChunked(reader.stream, dst, n)
+	if err != nil {
+		return dst, unexpectedEOF(err)
+	}
+	return dst, nil
+}
+
+// checkFrameSize fails if a frame would be larger than maxFrameSize.
+func (reader *msgpackReader) checkFrameSize(size int) error {
+	if reader.maxFrameSize > 0 && size > reader.maxFrameSize {
+		return &FrameTooLargeError{Limit: reader.maxFrameSize}
+	}
+	return nil
+}
+
+// FrameTooLargeError is the error of a message larger than the input takes.
+type FrameTooLargeError struct {
+	Limit int
+}
+
+func (err *FrameTooLargeError) Error() string {
+	return fmt.Sprintf("message larger than %d bytes", err.Limit)
+}
+
+// readFrame appends the bytes of the next value to dst without decoding
+// it, only following the lengths of its elements, so that it can be
+// decoded apart from the stream.  The value is refused without reading
+// the rest of it once it is known to be larger than maxFrameSize.
+func (reader *msgpackReader) readFrame(dst []byte) ([]byte, error) {
+	for pending := 1; pending > 0; pending -= 1 {
+		b, err := reader.readByte()
+		if err != nil {
+			if len(dst) > 0 {
+				err = unexpectedEOF(err)
+			}
+			return dst, err
+		}
+		dst = append(dst, b)
+		size, lengthSize, elements := msgpackValueSize(b)
+		if lengthSize < 0 {
+			return dst, errors.New(fmt.Sprintf("msgpack: invalid descriptor 0x%02x", b))
+		}
+		if err := reader.checkFrameSize(len(dst) + lengthSize); err != nil {
+			return dst, err
+		}
+		if size < 0 {
+			l := len(dst)
+			dst, err = reader.appendN(dst, lengthSize)
+			if err != nil {
+				return dst, unexpectedEOF(err)
+			}
+			n := 0
+			switch lengthSize {
+			case 1:
+				n = int(dst[l])
+			case 2:
+				n = int(binary.BigEndian.Uint16(dst[l:]))
+			default:
+				n = int(binary.BigEndian.Uint32(dst[l:]))
+			}
+			if size == -2 {
+				// the elements of an array, or the keys and the values of a map
+				if b == 0xde || b == 0xdf {
+					n *= 2
+				}
+				pending += n
+				continue
+			}
+			size = n
+			// the extensions are followed by their types
+			if b >= 0xc7 && b <= 0xc9 {
+				size += 1
+			}
+		}
+		pending += elements
+		if err := reader.checkFrameSize(len(dst) + size); err != nil {
+			return dst, err
+		}
+		if size > 0 {
+			dst, err = reader.appendN(dst, size)
+			if err != nil {
+				return dst, unexpectedEOF(err)
+			}
+		}
+	}
+	return dst, nil
+}
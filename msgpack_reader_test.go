@@ -0,0 +1,314 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/ugorji/go/codec"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func Test_MsgpackReader(t *testing.T) {
+	long := strings.Repeat("x", 10000)
+	b := bytes.Buffer{}
+	codec.NewEncoder(&b, &codec.MsgpackHandle{}).Encode(map[string]interface{}{
+		"fix":    5,
+		"uint16": 300,
+		"uint64": uint64(1) << 63,
+		"neg":    -1,
+		"int16":  -300,
+		"float":  1.5,
+		"bool":   true,
+		"nil":    nil,
+		"str":    "hello",
+		"bytes":  []byte("raw"),
+		"long":   long,
+		"array":  []interface{}{1, "a", []interface{}{}},
+		"map":    map[string]interface{}{"k": map[string]interface{}{"k": "v"}},
+	})
+	// an EventTime of 2014-01-01 00:00:00.5
+	eventTimeExt := []byte{0xd7, 0x00, 0x52, 0xc3, 0x5a, 0x80, 0x1d, 0xcd, 0x65, 0x00}
+	encoded := append(b.Bytes(), eventTimeExt...)
+	expected := map[string]interface{}{
+		"fix":    uint64(5),
+		"uint16": uint64(300),
+		"uint64": uint64(1) << 63,
+		"neg":    int64(-1),
+		"int16":  int64(-300),
+		"float":  1.5,
+		"bool":   true,
+		"nil":    nil,
+		"str":    "hello",
+		"bytes":  "raw",
+		"long":   long,
+		"array":  []interface{}{uint64(1), "a", []interface{}{}},
+		"map":    map[string]interface{}{"k": map[string]interface{}{"k": "v"}},
+	}
+
+	entries := newMsgpackStreamReader(nil).entriesReader()
+	entries.reset(encoded)
+	for _, reader := range []*msgpackReader{
+		// the long string doesn't fit in the buffer of the stream
+		newMsgpackStreamReader(bufio.NewReaderSize(bytes.NewReader(encoded), 16)),
+		entries,
+	} {
+		v, err := reader.readValue(0)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !reflect.DeepEqual(v, expected) {
+			t.Errorf("%#v", v)
+		}
+		v, err = reader.readValue(0)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if timestamp, ok := eventTime(v); !ok || timestamp != 1388534400 {
+			t.Errorf("%#v", v)
+		}
+		if _, err := reader.readValue(0); err != io.EOF && err != io.ErrUnexpectedEOF {
+			t.Errorf("%v", err)
+		}
+		// the keys are shared by the records
+		if len(reader.keys) != 14 {
+			t.Errorf("%d keys", len(reader.keys))
+		}
+	}
+}
+
+func Test_MsgpackReader_Errors(t *testing.T) {
+	b := bytes.Buffer{}
+	codec.NewEncoder(&b, &codec.MsgpackHandle{}).Encode([]interface{}{"tag", uint64(1388534400), map[string]interface{}{"message": "hello"}})
+	encoded := b.Bytes()
+	// the end of the input is io.EOF only between the values
+	for i := 0; i < len(encoded); i += 1 {
+		reader := newMsgpackStreamReader(bufio.NewReader(bytes.NewReader(encoded[:i])))
+		_, err := reader.readValue(0)
+		if (i == 0 && err != io.EOF) || (i > 0 && err != io.ErrUnexpectedEOF) {
+			t.Errorf("%d: %v", i, err)
+		}
+	}
+
+	nested := append(bytes.Repeat([]byte{0x91}, msgpackMaxDepth+2), 0xc0)
+	reader := newMsgpackStreamReader(bufio.NewReader(bytes.NewReader(nested)))
+	if _, err := reader.readValue(0); err == nil || !strings.Contains(err.Error(), "nested too deeply") {
+		t.Errorf("%v", err)
+	}
+
+	// the length is not trusted before the elements are read
+	huge := []byte{0xdd, 0xff, 0xff, 0xff, 0xff}
+	reader = newMsgpackStreamReader(bufio.NewReader(bytes.NewReader(huge)))
+	if _, err := reader.readValue(0); err == nil {
+		t.Fail()
+	}
+
+	// nor is the length of a string or a binary, which is read as its bytes
+	// arrive
+	stats := runtime.MemStats{}
+	runtime.ReadMemStats(&stats)
+	allocated := stats.TotalAlloc
+	for _, huge := range [][]byte{{0xc6, 0x7f, 0xff, 0xff, 0xff, 0x01}, {0xdb, 0xff, 0xff, 0xff, 0xff, 0x01}} {
+		reader = newMsgpackStreamReader(bufio.NewReader(bytes.NewReader(huge)))
+		if _, err := reader.readValue(0); err == nil {
+			t.Errorf("%x: decoded", huge)
+		}
+	}
+	runtime.ReadMemStats(&stats)
+	if stats.TotalAlloc-allocated > 1048576 {
+		t.Errorf("%d bytes allocated", stats.TotalAlloc-allocated)
+	}
+
+	// the keys of the maps are strings
+	reader = newMsgpackStreamReader(bufio.NewReader(bytes.NewReader([]byte{0x81, 0x01, 0x01})))
+	if _, err := reader.readValue(0); err == nil {
+		t.Fail()
+	}
+}
+
+func Test_MsgpackReader_Frame(t *testing.T) {
+	b := bytes.Buffer{}
+	encoder := codec.NewEncoder(&b, &codec.MsgpackHandle{})
+	encoder.Encode([]interface{}{"tag", uint64(1388534400), map[string]interface{}{"message": "hello", "n": -300}})
+	first := b.Len()
+	encoder.Encode([]interface{}{"tag", []interface{}{[]interface{}{1.5, map[string]interface{}{"long": strings.Repeat("x", 70000)}}}, map[string]interface{}{"chunk": "abc"}})
+	second := b.Len()
+	b.Write([]byte{0x92, 0xd7, 0x00, 0x52, 0xc3, 0x5a, 0x80, 0x1d, 0xcd, 0x65, 0x00, 0xc7, 0x01, 0x05, 0xff})
+	encoded := b.Bytes()
+
+	reader := newMsgpackStreamReader(bufio.NewReaderSize(bytes.NewReader(encoded), 16))
+	start := 0
+	for _, end := range []int{first, second, len(encoded)} {
+		frame, err := reader.readFrame(nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !bytes.Equal(frame, encoded[start:end]) {
+			t.Errorf("%x", frame)
+		}
+		start = end
+	}
+	if _, err := reader.readFrame(nil); err != io.EOF {
+		t.Errorf("%v", err)
+	}
+
+	for i := 1; i < first; i += 1 {
+		reader := newMsgpackStreamReader(bufio.NewReader(bytes.NewReader(encoded[:i])))
+		if _, err := reader.readFrame(nil); err != io.ErrUnexpectedEOF {
+			t.Errorf("%d: %v", i, err)
+		}
+	}
+	reader = newMsgpackStreamReader(bufio.NewReader(bytes.NewReader([]byte{0xc1})))
+	if _, err := reader.readFrame(nil); err == nil {
+		t.Fail()
+	}
+}
+
+func Test_MsgpackReader_FrameSize(t *testing.T) {
+	// binaries claiming 2GB and 4GB with a few bytes of them sent
+	for _, message := range [][]byte{
+		{0xc6, 0x7f, 0xff, 0xff, 0xff, 0x01, 0x02},
+		{0xdb, 0xff, 0xff, 0xff, 0xff, 0x01, 0x02},
+		{0x92, 0xa3, 't', 'a', 'g', 0xc9, 0x7f, 0xff, 0xff, 0xff, 0x00, 0x01},
+	} {
+		stats := runtime.MemStats{}
+		runtime.ReadMemStats(&stats)
+		allocated := stats.TotalAlloc
+		reader := newMsgpackStreamReader(bufio.NewReader(bytes.NewReader(message)))
+		if _, err := reader.readFrame(nil); err != io.ErrUnexpectedEOF {
+			t.Errorf("%x: %v", message, err)
+		}
+		runtime.ReadMemStats(&stats)
+		if stats.TotalAlloc-allocated > 1048576 {
+			t.Errorf("%x: %d bytes allocated", message, stats.TotalAlloc-allocated)
+		}
+
+		reader = newMsgpackStreamReader(bufio.NewReader(bytes.NewReader(message)))
+		reader.maxFrameSize = 1024
+		_, err := reader.readFrame(nil)
+		if _, ok := err.(*FrameTooLargeError); !ok {
+			t.Errorf("%x: %v", message, err)
+		}
+	}
+
+	// the frames up to the limit are taken, and the elements count to it
+	// as they arrive
+	b := bytes.Buffer{}
+	codec.NewEncoder(&b, &codec.MsgpackHandle{}).Encode([]interface{}{"tag", uint64(1388534400), map[string]interface{}{"message": strings.Repeat("x", 1000)}})
+	reader := newMsgpackStreamReader(bufio.NewReader(bytes.NewReader(b.Bytes())))
+	reader.maxFrameSize = b.Len()
+	if frame, err := reader.readFrame(nil); err != nil || !bytes.Equal(frame, b.Bytes()) {
+		t.Errorf("%v", err)
+	}
+	reader = newMsgpackStreamReader(bufio.NewReader(bytes.NewReader(b.Bytes())))
+	reader.maxFrameSize = b.Len() - 1
+	if _, err := reader.readFrame(nil); err == nil {
+		t.Error("a frame over the limit was taken")
+	}
+	many := append([]byte{0xdd, 0xff, 0xff, 0xff, 0xff}, bytes.Repeat([]byte{0x01}, 2048)...)
+	reader = newMsgpackStreamReader(bufio.NewReader(bytes.NewReader(many)))
+	reader.maxFrameSize = 1024
+	if _, err := reader.readFrame(nil); err == nil {
+		t.Error("an array over the limit was taken")
+	}
+}
+
+// Test_MsgpackReader_Types pins the types each format is decoded into,
+// which are the same whatever format the sender chose for a value.
+func Test_MsgpackReader_Types(t *testing.T) {
+	reader := newMsgpackDataReader()
+	for _, c := range []struct {
+		encoded  []byte
+		expected interface{}
+	}{
+		{[]byte{0x05}, uint64(5)},
+		{[]byte{0xcc, 0x05}, uint64(5)},
+		{[]byte{0xcf, 0, 0, 0, 0, 0, 0, 0, 0x05}, uint64(5)},
+		// the signed formats of the non-negative values as well
+		{[]byte{0xd0, 0x05}, uint64(5)},
+		{[]byte{0xd1, 0, 0x05}, uint64(5)},
+		{[]byte{0xd2, 0, 0, 0, 0x05}, uint64(5)},
+		{[]byte{0xd3, 0, 0, 0, 0, 0, 0, 0, 0x05}, uint64(5)},
+		{[]byte{0xfb}, int64(-5)},
+		{[]byte{0xd0, 0xfb}, int64(-5)},
+		{[]byte{0xd3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfb}, int64(-5)},
+		{[]byte{0xca, 0x3f, 0xc0, 0, 0}, 1.5},
+		{[]byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, 1.5},
+		{[]byte{0xa1, 'a'}, "a"},
+		{[]byte{0xd9, 0x01, 'a'}, "a"},
+		// the binaries as strings
+		{[]byte{0xc4, 0x01, 'a'}, "a"},
+		{[]byte{0x91, 0xc4, 0x01, 'a'}, []interface{}{"a"}},
+		{[]byte{0xc0}, nil},
+		{[]byte{0xc3}, true},
+		{[]byte{0xd4, 0x01, 0x02}, codec.RawExt{Tag: 1, Data: []byte{0x02}}},
+	} {
+		reader.reset(c.encoded)
+		v, err := reader.readValue(0)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !reflect.DeepEqual(v, c.expected) {
+			t.Errorf("% x: %#v", c.encoded, v)
+		}
+	}
+}
+
+// BenchmarkMsgpackReader decodes a record by the reader and by the codec
+// with the handle the forward input decoded by before.
+func BenchmarkMsgpackReader(b *testing.B) {
+	encoded := bytes.Buffer{}
+	codec.NewEncoder(&encoded, &codec.MsgpackHandle{}).Encode(map[string]interface{}{
+		"host":    "app-1",
+		"level":   "INFO",
+		"message": strings.Repeat("x", 100),
+		"pid":     1234,
+		"elapsed": 0.25,
+		"http":    map[string]interface{}{"method": "GET", "status": 200, "path": "/index.html"},
+		"tags":    []interface{}{"a", "b"},
+	})
+	b.Run("reader", func(b *testing.B) {
+		reader := newMsgpackDataReader()
+		b.SetBytes(int64(encoded.Len()))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i += 1 {
+			reader.reset(encoded.Bytes())
+			if _, err := reader.readValue(0); err != nil {
+				b.Fatal(err.Error())
+			}
+		}
+	})
+	b.Run("codec", func(b *testing.B) {
+		handle := codec.MsgpackHandle{}
+		handle.MapType = reflect.TypeOf(map[string]interface{}(nil))
+		b.SetBytes(int64(encoded.Len()))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i += 1 {
+			v := map[string]interface{}(nil)
+			if err := codec.NewDecoderBytes(encoded.Bytes(), &handle).Decode(&v); err != nil {
+				b.Fatal(err.Error())
+			}
+			coerceInPlace(v)
+		}
+	})
+}
@@ -20,6 +20,8 @@ package fluentd_forwarder
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	logging "github.com/op/go-logging"
 	"github.com/ugorji/go/codec"
 	"io"
@@ -27,6 +29,7 @@ import (
 	"net"
 	"os"
 	"reflect"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -41,22 +44,40 @@ type ForwardOutput struct {
 	retryInterval        time.Duration
 	connectionTimeout    time.Duration
 	writeTimeout         time.Duration
+	socketOptions        SocketOptions
 	enc                  *codec.Encoder
 	conn                 net.Conn
 	flushInterval        time.Duration
+	flushTimeout         time.Duration
 	wg                   sync.WaitGroup
 	journalGroup         JournalGroup
 	journal              Journal
 	emitterChan          chan FluentRecordSet
 	spoolerShutdownChan  chan struct{}
+	flushChan            chan struct{}
 	isShuttingDown       uintptr
 	completion           sync.Cond
 	hasShutdownCompleted bool
 	metadata             string
+	errorPort            atomic.Value // *ErrorPort
+	metrics              outputMetrics
+	// counts the records sent for the next forwarder to check; nil if not
+	accountant *deliveryAccountant
 }
 
-func encodeRecordSet(encoder *codec.Encoder, recordSet FluentRecordSet) error {
+// encodeRecordSet encodes the record set as a forward message, with the
+// option added, if not nil, to the trace context.
+func encodeRecordSet(encoder *codec.Encoder, recordSet FluentRecordSet, option map[string]interface{}) error {
 	v := []interface{}{recordSet.Tag, recordSet.Records}
+	if recordSet.Trace.IsValid() {
+		if option == nil {
+			option = make(map[string]interface{}, 1)
+		}
+		option[TraceparentKey] = recordSet.Trace.Traceparent()
+	}
+	if option != nil {
+		v = append(v, option)
+	}
 	err := encoder.Encode(v)
 	if err != nil {
 		return err
@@ -69,51 +90,230 @@ func (output *ForwardOutput) ensureConnected() error {
 		output.logger.Noticef("Connecting to %s...", output.bind)
 		conn, err := net.DialTimeout("tcp", output.bind, output.connectionTimeout)
 		if err != nil {
-			output.logger.Errorf("Failed to connect to %s (reason: %s)", output.bind, err.Error())
+			output.logger.Errorf("Failed to connect to %s (reason: %s)", output.bind, LogError(err))
 			return err
 		} else {
+			err = output.socketOptions.apply(conn.(*net.TCPConn))
+			if err != nil {
+				output.logger.Warningf("Failed to set the socket options of the connection to %s: %s", output.bind, LogError(err))
+			}
 			output.conn = conn
 		}
 	}
 	return nil
 }
 
-func (output *ForwardOutput) sendBuffer(buf []byte) error {
-	for len(buf) > 0 {
+// SetSocketOptions sets the options of the connections to the destination,
+// which are DefaultSocketOptions by default.  It must be called before the
+// output is started.
+func (output *ForwardOutput) SetSocketOptions(options SocketOptions) {
+	output.socketOptions = options
+}
+
+// sendBuffer sends the buffer, retrying until it succeeds or the deadline,
+// if not zero, passes.  The connection is discarded on the deadline, as it
+// may have been blackholed.  The chunk being sent is left in the buffer if
+// the output is shut down meanwhile.
+func (output *ForwardOutput) sendBuffer(buf []byte, deadline time.Time) error {
+	return output.sendBuffers(net.Buffers{buf}, deadline)
+}
+
+// sendBuffers sends the buffers as sendBuffer does, by a single writev
+// where the platform has one.
+func (output *ForwardOutput) sendBuffers(bufs net.Buffers, deadline time.Time) error {
+	left := int64(0)
+	for _, buf := range bufs {
+		left += int64(len(buf))
+	}
+	for left > 0 {
 		if atomic.LoadUintptr(&output.isShuttingDown) != 0 {
-			break
+			return errors.New("Flush aborted")
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			if output.conn != nil {
+				output.conn.Close()
+				output.conn = nil
+			}
+			output.metrics.flushTimeouts.Inc()
+			outputFailures.With(output.metrics.name, ErrorClassFlushTimeout).Inc()
+			return &FlushTimeoutError{Message: fmt.Sprintf("flush timed out after %s with %d bytes left", output.flushTimeout.String(), left)}
 		}
 		err := output.ensureConnected()
 		if err != nil {
-			output.logger.Infof("Will be retried in %s", output.retryInterval.String())
-			time.Sleep(output.retryInterval)
+			output.metrics.failed(err)
+			output.logger.Warningf("Will be retried in %s", output.retryInterval.String())
+			interval := output.retryInterval
+			if !deadline.IsZero() && deadline.Sub(time.Now()) < interval {
+				interval = deadline.Sub(time.Now())
+			}
+			time.Sleep(interval)
 			continue
 		}
 		startTime := time.Now()
-		if output.writeTimeout == 0 {
-			output.conn.SetWriteDeadline(time.Time{})
-		} else {
-			output.conn.SetWriteDeadline(startTime.Add(output.writeTimeout))
+		writeDeadline := time.Time{}
+		if output.writeTimeout != 0 {
+			writeDeadline = startTime.Add(output.writeTimeout)
+		}
+		if !deadline.IsZero() && (writeDeadline.IsZero() || deadline.Before(writeDeadline)) {
+			writeDeadline = deadline
 		}
-		n, err := output.conn.Write(buf)
-		buf = buf[n:]
+		output.conn.SetWriteDeadline(writeDeadline)
+		// consumes the bytes written from bufs
+		n, err := bufs.WriteTo(output.conn)
+		left -= n
+		output.metrics.bytes.Add(float64(n))
 		if err != nil {
-			output.logger.Errorf("Failed to flush buffer (reason: %s, left: %d bytes)", err.Error(), len(buf))
+			output.metrics.failed(err)
+			output.logger.Errorf("Failed to flush buffer (reason: %s, left: %d bytes)", LogError(err), left)
 			err_, ok := err.(net.Error)
 			if !ok || (!err_.Timeout() && !err_.Temporary()) {
 				output.conn.Close()
 				output.conn = nil
 				continue
 			}
+		} else {
+			output.metrics.up.Set(1)
 		}
 		if n > 0 {
 			elapsed := time.Now().Sub(startTime)
-			output.logger.Infof("Forwarded %d bytes in %f seconds (%d bytes left)\n", n, elapsed.Seconds(), len(buf))
+			output.logger.Infof("Forwarded %d bytes in %f seconds (%d bytes left)\n", n, elapsed.Seconds(), left)
 		}
 	}
 	return nil
 }
 
+// forwardFlushBatchSize is the size up to which the chunks of the buffer are
+// sent together by sendBuffers; a larger chunk is sent by itself as it is
+// read.
+const forwardFlushBatchSize = 16777216
+
+// flushDeadline returns the time by which a flush starting now has to
+// complete, or zero if there is no flush timeout.
+func (output *ForwardOutput) flushDeadline() time.Time {
+	if output.flushTimeout > 0 {
+		return time.Now().Add(output.flushTimeout)
+	}
+	return time.Time{}
+}
+
+// sendChunk sends the chunk as it is read.
+func (output *ForwardOutput) sendChunk(chunk JournalChunk, deadline time.Time) error {
+	reader, err := chunk.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	buf := make([]byte, forwardFlushBatchSize)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			err_ := output.sendBuffer(buf[:n], deadline)
+			if err_ != nil {
+				return err_
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			} else {
+				return err
+			}
+		}
+	}
+}
+
+// readChunk reads the whole of the chunk.
+func readChunk(chunk JournalChunk, size int64) ([]byte, error) {
+	reader, err := chunk.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	buffer := bytes.NewBuffer(make([]byte, 0, size))
+	_, err = buffer.ReadFrom(reader)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// flush sends the chunks of the buffer, and returns the number of the
+// chunks sent.  The chunks are read into a batch of up to
+// forwardFlushBatchSize bytes, which is sent at once, so that the many
+// small chunks left by an outage take few writes; each chunk is left in the
+// buffer to be sent again if its batch is not sent within the flush timeout.
+func (output *ForwardOutput) flush() int {
+	flushed := 0
+	output.logger.Notice("Flushing...")
+	pending := output.metrics.delivery.startFlush()
+	// every chunk has been sent if the flush succeeds
+	lastChunkId := ""
+	batch := net.Buffers{}
+	batchSize := int64(0)
+	// the results of the chunks in the batch, which the journal waits for
+	// to dispose of them
+	results := []chan error{}
+	sendBatch := func() {
+		err := output.sendBuffers(batch, output.flushDeadline())
+		for _, result := range results {
+			result <- err
+		}
+		if err == nil {
+			output.metrics.flushes.Add(float64(len(results)))
+			flushed += len(results)
+		}
+		batch = net.Buffers{}
+		batchSize = 0
+		results = []chan error{}
+	}
+	err := output.journal.Flush(func(chunk JournalChunk) interface{} {
+		defer chunk.Dispose()
+		lastChunkId = chunk.Id()
+		output.logger.Infof("Flushing chunk %s", chunk.String())
+		isLast := true
+		if next := chunk.NextChunk(); next != nil {
+			isLast = false
+			next.Dispose()
+		}
+		size, err := chunk.Size()
+		if err == nil && size > forwardFlushBatchSize {
+			if len(results) > 0 {
+				sendBatch()
+			}
+			err = output.sendChunk(chunk, output.flushDeadline())
+			if err == nil {
+				output.metrics.flushes.Inc()
+				flushed += 1
+			}
+			return err
+		}
+		result := make(chan error, 1)
+		data := ([]byte)(nil)
+		if err == nil {
+			data, err = readChunk(chunk, size)
+		}
+		if err == nil {
+			batch = append(batch, data)
+			batchSize += int64(len(data))
+			results = append(results, result)
+		}
+		// the journal waits for the results after the last chunk
+		if len(results) > 0 && (isLast || batchSize >= forwardFlushBatchSize) {
+			sendBatch()
+		}
+		if err != nil {
+			return err
+		}
+		return (<-chan error)(result)
+	})
+	if err != nil {
+		output.logger.Errorf("Error during reading from the journal: %s", LogError(err))
+	}
+	output.metrics.delivery.endFlush(pending, lastChunkId, err)
+	output.metrics.observeBuffer(output.journalGroup)
+	return flushed
+}
+
 func (output *ForwardOutput) spawnSpooler() {
 	output.logger.Notice("Spawning spooler")
 	output.wg.Add(1)
@@ -133,37 +333,9 @@ func (output *ForwardOutput) spawnSpooler() {
 		for {
 			select {
 			case <-ticker.C:
-				buf := make([]byte, 16777216)
-				output.logger.Notice("Flushing...")
-				err := output.journal.Flush(func(chunk JournalChunk) interface{} {
-					defer chunk.Dispose()
-					output.logger.Infof("Flushing chunk %s", chunk.String())
-					reader, err := chunk.Reader()
-					defer reader.Close()
-					if err != nil {
-						return err
-					}
-					for {
-						n, err := reader.Read(buf)
-						if n > 0 {
-							err_ := output.sendBuffer(buf[:n])
-							if err_ != nil {
-								return err
-							}
-						}
-						if err != nil {
-							if err == io.EOF {
-								break
-							} else {
-								return err
-							}
-						}
-					}
-					return nil
-				})
-				if err != nil {
-					output.logger.Errorf("Error during reading from the journal: %s", err.Error())
-				}
+				output.flush()
+			case <-output.flushChan:
+				output.logger.Noticef("Flushed %d chunks on request", output.flush())
 			case <-output.spoolerShutdownChan:
 				break outer
 			}
@@ -186,28 +358,129 @@ func (output *ForwardOutput) spawnEmitter() {
 			buffer.Reset()
 			encoder := codec.NewEncoder(&buffer, output.codec)
 			addMetadata(&recordSet, output.metadata)
-			err := encodeRecordSet(encoder, recordSet)
+			span := startBufferSpan(&recordSet, output.bind)
+			err := encodeRecordSet(encoder, recordSet, output.accountingOption())
+			errs := make(RecordErrors, 0)
 			if err != nil {
-				output.logger.Error(err.Error())
-				continue
+				// encode the records one by one to sort out the bad ones
+				buffer.Reset()
+				for _, record := range recordSet.Records {
+					n := buffer.Len()
+					err := encodeRecordSet(codec.NewEncoder(&buffer, output.codec), FluentRecordSet{Tag: recordSet.Tag, Records: []TinyFluentRecord{record}}, output.accountingOption())
+					if err != nil {
+						buffer.Truncate(n)
+						errs = append(errs, RecordError{Tag: recordSet.Tag, Record: record, Err: err})
+					}
+				}
+				output.reportErrors(errs)
+				if buffer.Len() == 0 {
+					putRecords(recordSet.Records)
+					continue
+				}
 			}
 			output.logger.Debugf("Emitter processed %d entries", len(recordSet.Records))
-			output.journal.Write(buffer.Bytes())
+			err = output.journal.Write(buffer.Bytes())
+			if err != nil {
+				output.logger.Error(LogError(err))
+				countDropped(DropBufferError, len(recordSet.Records)-len(errs))
+				span.Finish(time.Now())
+				putRecords(recordSet.Records)
+				continue
+			}
+			output.metrics.delivery.received(recordSet.Tag, len(recordSet.Records)-len(errs), recordSet.Trace)
+			DefaultRecordTracer.Tracef(recordSet.Tag, "%s: buffered %d records", output.metrics.name, len(recordSet.Records)-len(errs))
+			span.Finish(time.Now())
+			output.metrics.records.Add(float64(len(recordSet.Records) - len(errs)))
+			output.metrics.emits.Inc()
+			output.metrics.observeBuffer(output.journalGroup)
+			output.account(recordSet.Tag, len(recordSet.Records)-len(errs))
+			putRecords(recordSet.Records)
 		}
 		output.logger.Notice("Emitter ended")
 	}()
 }
 
 func (output *ForwardOutput) Emit(recordSets []FluentRecordSet) error {
+	i := 0
 	defer func() {
-		recover()
+		// the emitter channel is closed once the output is shut down
+		if recover() != nil {
+			countDropped(DropShutdown, recordCount(recordSets[i:]))
+		}
 	}()
-	for _, recordSet := range recordSets {
-		output.emitterChan <- recordSet
+	for ; i < len(recordSets); i++ {
+		// the emitter puts back the records once buffered
+		output.emitterChan <- copyRecordSet(recordSets[i])
 	}
 	return nil
 }
 
+func (output *ForwardOutput) SetErrorPort(port *ErrorPort) {
+	output.errorPort.Store(port)
+}
+
+// EnableAccounting makes the output send, in every interval, a control
+// record telling the next forwarder how many records it has sent with each
+// tag.  It must be called before the output is started, and only if the
+// next hop is a fluentd-forwarder, as fluentd would take the control records
+// for events.
+func (output *ForwardOutput) EnableAccounting(interval time.Duration) {
+	output.accountant = newDeliveryAccountant(interval)
+}
+
+func (output *ForwardOutput) accountingOption() map[string]interface{} {
+	if output.accountant == nil {
+		return nil
+	}
+	return output.accountant.option()
+}
+
+// account counts the records buffered, and buffers the control record after
+// them when it is due.
+func (output *ForwardOutput) account(tag string, records int) {
+	if output.accountant == nil {
+		return
+	}
+	output.accountant.count(tag, records)
+	control, ok := output.accountant.control()
+	if !ok {
+		return
+	}
+	buffer := bytes.Buffer{}
+	err := encodeRecordSet(codec.NewEncoder(&buffer, output.codec), control, output.accountant.option())
+	if err == nil {
+		err = output.journal.Write(buffer.Bytes())
+	}
+	if err != nil {
+		output.logger.Error(LogError(err))
+	}
+}
+
+func (output *ForwardOutput) reportErrors(errs RecordErrors) {
+	port, _ := output.errorPort.Load().(*ErrorPort)
+	if port == nil {
+		port = NewErrorPort(output.logger, nil)
+	}
+	port.Report(output.String(), errs)
+}
+
+func (output *ForwardOutput) PluginInfo() PluginInfo {
+	return output.metrics.pluginInfo("forward")
+}
+
+func (output *ForwardOutput) Health() OutputHealth {
+	return output.metrics.health()
+}
+
+// FlushNow makes the spooler flush the buffer without waiting for the flush
+// interval.  A flush already requested is not requested again.
+func (output *ForwardOutput) FlushNow() {
+	select {
+	case output.flushChan <- struct{}{}:
+	default:
+	}
+}
+
 func (output *ForwardOutput) String() string {
 	return "output"
 }
@@ -233,7 +506,7 @@ func (output *ForwardOutput) Start() {
 		output.wg.Wait()
 		err := output.journalGroup.Dispose()
 		if err != nil {
-			output.logger.Error(err.Error())
+			output.logger.Error(LogError(err))
 		}
 		output.completion.L.Lock()
 		output.hasShutdownCompleted = true
@@ -245,7 +518,7 @@ func (output *ForwardOutput) Start() {
 	syncCh <- struct{}{}
 }
 
-func NewForwardOutput(logger *logging.Logger, bind string, retryInterval time.Duration, connectionTimeout time.Duration, writeTimeout time.Duration, flushInterval time.Duration, journalGroupPath string, maxJournalChunkSize int64, metadata string) (*ForwardOutput, error) {
+func NewForwardOutput(logger *logging.Logger, bind string, retryInterval time.Duration, connectionTimeout time.Duration, writeTimeout time.Duration, flushInterval time.Duration, flushTimeout time.Duration, journalGroupPath string, maxJournalChunkSize int64, metadata string) (*ForwardOutput, error) {
 	_codec := codec.MsgpackHandle{}
 	_codec.MapType = reflect.TypeOf(map[string]interface{}(nil))
 	_codec.RawToString = false
@@ -266,14 +539,18 @@ func NewForwardOutput(logger *logging.Logger, bind string, retryInterval time.Du
 		retryInterval:        retryInterval,
 		connectionTimeout:    connectionTimeout,
 		writeTimeout:         writeTimeout,
+		socketOptions:        DefaultSocketOptions,
 		wg:                   sync.WaitGroup{},
 		flushInterval:        flushInterval,
+		flushTimeout:         flushTimeout,
 		emitterChan:          make(chan FluentRecordSet),
 		spoolerShutdownChan:  make(chan struct{}),
+		flushChan:            make(chan struct{}, 1),
 		isShuttingDown:       0,
 		completion:           sync.Cond{L: &sync.Mutex{}},
 		hasShutdownCompleted: false,
 		metadata:             metadata,
+		metrics:              newOutputMetrics(bind),
 	}
 	journalGroup, err := journalFactory.GetJournalGroup(journalGroupPath, output)
 	if err != nil {
@@ -281,5 +558,95 @@ func NewForwardOutput(logger *logging.Logger, bind string, retryInterval time.Du
 	}
 	output.journalGroup = journalGroup
 	output.journal = journalGroup.GetJournal("output")
+	// the chunks recovered from the buffer
+	output.metrics.observeBuffer(journalGroup)
 	return output, nil
 }
+
+func newForwardOutputFromConfig(logger *logging.Logger, config *ConfigElement) (Output, error) {
+	bind := config.Get("to", "")
+	if i := strings.Index(bind, "//"); i >= 0 {
+		bind = bind[i+2:]
+	}
+	if bind == "" {
+		return nil, errors.New(fmt.Sprintf("%s: to is not specified", config.String()))
+	}
+	if !strings.ContainsRune(bind, ':') {
+		bind += ":24224"
+	}
+	journalGroupPath := config.Get("buffer-path", "")
+	if journalGroupPath == "" {
+		return nil, errors.New(fmt.Sprintf("%s: buffer-path is not specified", config.String()))
+	}
+	retryInterval, err := config.GetDuration("retry-interval", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	connectionTimeout, err := config.GetDuration("conn-timeout", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	writeTimeout, err := config.GetDuration("write-timeout", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	flushInterval, err := config.GetDuration("flush-interval", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	flushTimeout, err := config.GetDuration("flush-timeout", 0)
+	if err != nil {
+		return nil, err
+	}
+	maxJournalChunkSize, err := config.GetInt64("buffer-chunk-limit", 16777216)
+	if err != nil {
+		return nil, err
+	}
+	accountingInterval, err := config.GetDuration("accounting-interval", 0)
+	if err != nil {
+		return nil, err
+	}
+	socketOptions, err := socketOptionsFromConfig(config, DefaultSocketOptions)
+	if err != nil {
+		return nil, err
+	}
+	output, err := NewForwardOutput(
+		logger,
+		bind,
+		retryInterval,
+		connectionTimeout,
+		writeTimeout,
+		flushInterval,
+		flushTimeout,
+		journalGroupPath,
+		maxJournalChunkSize,
+		config.Get("metadata", ""),
+	)
+	if err != nil {
+		return nil, err
+	}
+	output.SetSocketOptions(socketOptions)
+	if accountingInterval > 0 {
+		output.EnableAccounting(accountingInterval)
+	}
+	return output, nil
+}
+
+func init() {
+	RegisterOutput("forward", newForwardOutputFromConfig)
+	RegisterOutputParams("forward",
+		ParamSchema{Name: "to", Type: ParamString, Description: "host:port of the destination"},
+		ParamSchema{Name: "buffer-path", Type: ParamString, Description: "path of the buffer"},
+		ParamSchema{Name: "buffer-chunk-limit", Type: ParamInteger, Description: "size of a chunk in bytes", Default: "16777216"},
+		ParamSchema{Name: "flush-interval", Type: ParamDuration, Description: "interval in which the buffer is flushed", Default: "5s"},
+		ParamSchema{Name: "flush-timeout", Type: ParamDuration, Description: "time within which the flush of a chunk has to complete; unlimited if 0", Default: "0"},
+		ParamSchema{Name: "retry-interval", Type: ParamDuration, Description: "interval in which a failed flush is retried", Default: "5s"},
+		ParamSchema{Name: "conn-timeout", Type: ParamDuration, Description: "timeout of connecting", Default: "10s"},
+		ParamSchema{Name: "write-timeout", Type: ParamDuration, Description: "timeout of writing", Default: "10s"},
+		ParamSchema{Name: "socket-receive-buffer", Type: ParamInteger, Description: "SO_RCVBUF of the connection in bytes; the one of the system if 0", Default: "0"},
+		ParamSchema{Name: "socket-send-buffer", Type: ParamInteger, Description: "SO_SNDBUF of the connection in bytes; the one of the system if 0", Default: "0"},
+		ParamSchema{Name: "tcp-nodelay", Type: ParamBoolean, Description: "whether TCP_NODELAY is set to the connection", Default: "true"},
+		ParamSchema{Name: "accounting-interval", Type: ParamDuration, Description: "interval in which the control events of the loss accounting are sent; not sent if 0", Default: "0"},
+		ParamSchema{Name: "metadata", Type: ParamString, Description: "additional data set into the records"},
+	)
+}
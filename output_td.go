@@ -23,11 +23,14 @@ import (
 	"compress/gzip"
 	"crypto/x509"
 	"errors"
+	"fmt"
 	ioextras "github.com/moriyoshi/go-ioextras"
 	logging "github.com/op/go-logging"
 	td_client "github.com/treasure-data/td-client-go"
 	"github.com/ugorji/go/codec"
+	"io/ioutil"
 	"net"
+	"net/url"
 	"os"
 	"reflect"
 	"strings"
@@ -45,8 +48,10 @@ type tdOutputSpooler struct {
 	key            string
 	journal        Journal
 	shutdownChan   chan struct{}
+	flushChan      chan struct{}
 	isShuttingDown uintptr
 	client         *td_client.TDClient
+	delivery       *deliveryTracker
 }
 
 type tdOutputSpoolerDaemon struct {
@@ -68,6 +73,7 @@ type TDOutput struct {
 	enc                  *codec.Encoder
 	conn                 net.Conn
 	flushInterval        time.Duration
+	flushTimeout         time.Duration
 	wg                   sync.WaitGroup
 	journalGroup         JournalGroup
 	emitterChan          chan FluentRecordSet
@@ -79,20 +85,27 @@ type TDOutput struct {
 	completion           sync.Cond
 	hasShutdownCompleted bool
 	metadata             string
+	errorPort            atomic.Value // *ErrorPort
+	metrics              outputMetrics
 }
 
-func encodeRecords(encoder *codec.Encoder, records []TinyFluentRecord) error {
+// encodeRecords appends the records to the buffer, leaving out the ones that
+// cannot be encoded.
+func encodeRecords(buffer *bytes.Buffer, handle *codec.MsgpackHandle, tag string, records []TinyFluentRecord) RecordErrors {
+	errs := make(RecordErrors, 0)
 	for _, record := range records {
 		e := map[string]interface{}{"time": record.Timestamp}
 		for k, v := range record.Data {
 			e[k] = v
 		}
-		err := encoder.Encode(e)
+		n := buffer.Len()
+		err := codec.NewEncoder(buffer, handle).Encode(e)
 		if err != nil {
-			return err
+			buffer.Truncate(n)
+			errs = append(errs, RecordError{Tag: tag, Record: record, Err: err})
 		}
 	}
-	return nil
+	return errs
 }
 
 func (spooler *tdOutputSpooler) cleanup() {
@@ -101,6 +114,96 @@ func (spooler *tdOutputSpooler) cleanup() {
 	spooler.daemon.wg.Done()
 }
 
+// flush imports the chunks of the journal, and returns the number of the
+// chunks imported.
+func (spooler *tdOutputSpooler) flush() int {
+	flushed := int64(0)
+	spooler.daemon.output.logger.Notice("Flushing...")
+	pending := spooler.delivery.startFlush()
+	// every chunk has been imported if the flush succeeds
+	lastChunkId := ""
+	err := spooler.journal.Flush(func(chunk JournalChunk) interface{} {
+		defer chunk.Dispose()
+		lastChunkId = chunk.Id()
+		if atomic.LoadUintptr(&spooler.isShuttingDown) != 0 {
+			return errors.New("Flush aborted")
+		}
+		spooler.daemon.output.logger.Infof("Flushing chunk %s", chunk.String())
+		size, err := chunk.Size()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return nil
+		}
+		futureErr := make(chan error, 1)
+		sem := spooler.daemon.output.sem
+		sem <- struct{}{}
+		go func(size int64, chunk JournalChunk, futureErr chan error) {
+			err := (error)(nil)
+			defer func() {
+				if err != nil {
+					spooler.daemon.output.metrics.failed(err)
+					spooler.daemon.output.logger.Warningf("Failed to flush chunk %s (reason: %s); will be retried", chunk.String(), LogError(err))
+				} else {
+					spooler.daemon.output.metrics.up.Set(1)
+					spooler.daemon.output.metrics.bytes.Add(float64(size))
+					spooler.daemon.output.metrics.flushes.Inc()
+					atomic.AddInt64(&flushed, 1)
+					spooler.daemon.output.logger.Infof("Completed flushing chunk %s", chunk.String())
+				}
+				<-sem
+				// disposal must be done before notifying the initiator
+				chunk.Dispose()
+				futureErr <- err
+			}()
+			// the import is abandoned, leaving the chunk to be sent
+			// again, if it doesn't complete in time
+			importErr := make(chan error, 1)
+			go func(chunk JournalChunk) {
+				defer chunk.Dispose()
+				compressingBlob := NewCompressingBlob(
+					chunk,
+					maxInt(4096, int(size/4)),
+					gzip.BestSpeed,
+					&spooler.daemon.tempFactory,
+				)
+				defer compressingBlob.Dispose()
+				_, err := spooler.client.Import(
+					spooler.databaseName,
+					spooler.tableName,
+					"msgpack.gz",
+					td_client.NewBufferingBlobSize(
+						compressingBlob,
+						maxInt(4096, int(size/16)),
+					),
+					chunk.Id(),
+				)
+				importErr <- err
+			}(chunk.Dup())
+			timeout := (<-chan time.Time)(nil)
+			if spooler.daemon.output.flushTimeout > 0 {
+				timer := time.NewTimer(spooler.daemon.output.flushTimeout)
+				defer timer.Stop()
+				timeout = timer.C
+			}
+			select {
+			case err = <-importErr:
+			case <-timeout:
+				spooler.daemon.output.metrics.flushTimeouts.Inc()
+				err = &FlushTimeoutError{Message: fmt.Sprintf("import timed out after %s", spooler.daemon.output.flushTimeout.String())}
+			}
+		}(size, chunk.Dup(), futureErr)
+		return (<-chan error)(futureErr)
+	})
+	if err != nil {
+		spooler.daemon.output.logger.Errorf("Error during reading from the journal: %s", LogError(err))
+	}
+	spooler.delivery.endFlush(pending, lastChunkId, err)
+	spooler.daemon.output.metrics.observeBuffer(spooler.daemon.output.journalGroup)
+	return int(atomic.LoadInt64(&flushed))
+}
+
 func (spooler *tdOutputSpooler) handle() {
 	defer spooler.cleanup()
 	spooler.daemon.output.logger.Notice("Spooler started")
@@ -108,62 +211,9 @@ outer:
 	for {
 		select {
 		case <-spooler.ticker.C:
-			spooler.daemon.output.logger.Notice("Flushing...")
-			err := spooler.journal.Flush(func(chunk JournalChunk) interface{} {
-				defer chunk.Dispose()
-				if atomic.LoadUintptr(&spooler.isShuttingDown) != 0 {
-					return errors.New("Flush aborted")
-				}
-				spooler.daemon.output.logger.Infof("Flushing chunk %s", chunk.String())
-				size, err := chunk.Size()
-				if err != nil {
-					return err
-				}
-				if size == 0 {
-					return nil
-				}
-				futureErr := make(chan error, 1)
-				sem := spooler.daemon.output.sem
-				sem <- struct{}{}
-				go func(size int64, chunk JournalChunk, futureErr chan error) {
-					err := (error)(nil)
-					defer func() {
-						if err != nil {
-							spooler.daemon.output.logger.Infof("Failed to flush chunk %s (reason: %s)", chunk.String(), err.Error())
-						} else {
-							spooler.daemon.output.logger.Infof("Completed flushing chunk %s", chunk.String())
-						}
-						<-sem
-						// disposal must be done before notifying the initiator
-						chunk.Dispose()
-						futureErr <- err
-					}()
-					err = func() error {
-						compressingBlob := NewCompressingBlob(
-							chunk,
-							maxInt(4096, int(size/4)),
-							gzip.BestSpeed,
-							&spooler.daemon.tempFactory,
-						)
-						defer compressingBlob.Dispose()
-						_, err := spooler.client.Import(
-							spooler.databaseName,
-							spooler.tableName,
-							"msgpack.gz",
-							td_client.NewBufferingBlobSize(
-								compressingBlob,
-								maxInt(4096, int(size/16)),
-							),
-							chunk.Id(),
-						)
-						return err
-					}()
-				}(size, chunk.Dup(), futureErr)
-				return (<-chan error)(futureErr)
-			})
-			if err != nil {
-				spooler.daemon.output.logger.Errorf("Error during reading from the journal: %s", err.Error())
-			}
+			spooler.flush()
+		case <-spooler.flushChan:
+			spooler.daemon.output.logger.Noticef("Flushed %d chunks of %s on request", spooler.flush(), spooler.key)
 		case <-spooler.shutdownChan:
 			break outer
 		}
@@ -206,8 +256,10 @@ func newTDOutputSpooler(daemon *tdOutputSpoolerDaemon, databaseName, tableName,
 		key:            key,
 		journal:        journal,
 		shutdownChan:   make(chan struct{}, 1),
+		flushChan:      make(chan struct{}, 1),
 		isShuttingDown: 0,
 		client:         daemon.output.client,
+		delivery:       newDeliveryTracker(daemon.output.String(), daemon.output.metrics.latency),
 	}
 }
 
@@ -329,22 +381,36 @@ func (output *TDOutput) spawnEmitter() {
 		buffer := bytes.Buffer{}
 		for recordSet := range output.emitterChan {
 			buffer.Reset()
-			encoder := codec.NewEncoder(&buffer, output.codec)
 			err := func() error {
 				spooler, err := output.spoolerDaemon.getSpooler(recordSet.Tag)
 				if err != nil {
+					countDropped(DropBufferError, len(recordSet.Records))
 					return err
 				}
 				addMetadata(&recordSet, output.metadata)
-				err = encodeRecords(encoder, recordSet.Records)
+				span := startBufferSpan(&recordSet, output.String())
+				defer func() { span.Finish(time.Now()) }()
+				errs := encodeRecords(&buffer, output.codec, recordSet.Tag, recordSet.Records)
+				output.reportErrors(errs)
+				if buffer.Len() == 0 {
+					return nil
+				}
+				output.logger.Debugf("Emitter processed %d entries", len(recordSet.Records))
+				err = spooler.journal.Write(buffer.Bytes())
 				if err != nil {
+					countDropped(DropBufferError, len(recordSet.Records)-len(errs))
 					return err
 				}
-				output.logger.Debugf("Emitter processed %d entries", len(recordSet.Records))
-				return spooler.journal.Write(buffer.Bytes())
+				spooler.delivery.received(recordSet.Tag, len(recordSet.Records)-len(errs), recordSet.Trace)
+				DefaultRecordTracer.Tracef(recordSet.Tag, "%s: buffered %d records", output.metrics.name, len(recordSet.Records)-len(errs))
+				output.metrics.records.Add(float64(len(recordSet.Records) - len(errs)))
+				output.metrics.emits.Inc()
+				output.metrics.observeBuffer(output.journalGroup)
+				return nil
 			}()
+			putRecords(recordSet.Records)
 			if err != nil {
-				output.logger.Error(err.Error())
+				output.logger.Error(LogError(err))
 				continue
 			}
 		}
@@ -363,7 +429,7 @@ func (output *TDOutput) spawnTempFileCollector() {
 			output.logger.Debugf("Deleting %s...", f.Name())
 			err := os.Remove(f.Name())
 			if err != nil {
-				output.logger.Warningf("Failed to delete %s: %s", f.Name(), err.Error())
+				output.logger.Warningf("Failed to delete %s: %s", f.Name(), LogError(err))
 			}
 		}
 		output.logger.Debug("temporary file collector ended")
@@ -371,15 +437,78 @@ func (output *TDOutput) spawnTempFileCollector() {
 }
 
 func (output *TDOutput) Emit(recordSets []FluentRecordSet) error {
+	i := 0
 	defer func() {
-		recover()
+		// the emitter channel is closed once the output is shut down
+		if recover() != nil {
+			countDropped(DropShutdown, recordCount(recordSets[i:]))
+		}
 	}()
-	for _, recordSet := range recordSets {
-		output.emitterChan <- recordSet
+	for ; i < len(recordSets); i++ {
+		// the emitter puts back the records once buffered
+		output.emitterChan <- copyRecordSet(recordSets[i])
 	}
 	return nil
 }
 
+func (output *TDOutput) SetErrorPort(port *ErrorPort) {
+	output.errorPort.Store(port)
+}
+
+func (output *TDOutput) reportErrors(errs RecordErrors) {
+	port, _ := output.errorPort.Load().(*ErrorPort)
+	if port == nil {
+		port = NewErrorPort(output.logger, nil)
+	}
+	port.Report(output.String(), errs)
+}
+
+func (output *TDOutput) PluginInfo() PluginInfo {
+	return output.metrics.pluginInfo("tdlog")
+}
+
+// Health reports the earliest of the flushes in progress and the oldest of
+// the records buffered among the spoolers.
+func (output *TDOutput) Health() OutputHealth {
+	health := output.metrics.health()
+	daemon := output.spoolerDaemon
+	if daemon == nil {
+		return health
+	}
+	daemon.spoolersMtx.Lock()
+	defer daemon.spoolersMtx.Unlock()
+	for _, spooler := range daemon.spoolers {
+		flushStartedAt, oldestBufferedAt := spooler.delivery.progress()
+		if !flushStartedAt.IsZero() && (health.FlushStartedAt.IsZero() || flushStartedAt.Before(health.FlushStartedAt)) {
+			health.FlushStartedAt = flushStartedAt
+		}
+		if !oldestBufferedAt.IsZero() && (health.OldestBufferedAt.IsZero() || oldestBufferedAt.Before(health.OldestBufferedAt)) {
+			health.OldestBufferedAt = oldestBufferedAt
+		}
+		if lastFlushedAt := spooler.delivery.lastFlushed(); lastFlushedAt.After(health.LastFlushedAt) {
+			health.LastFlushedAt = lastFlushedAt
+		}
+	}
+	return health
+}
+
+// FlushNow makes every spooler flush its journal without waiting for the
+// flush interval.
+func (output *TDOutput) FlushNow() {
+	daemon := output.spoolerDaemon
+	if daemon == nil {
+		return
+	}
+	daemon.spoolersMtx.Lock()
+	defer daemon.spoolersMtx.Unlock()
+	for _, spooler := range daemon.spoolers {
+		select {
+		case spooler.flushChan <- struct{}{}:
+		default:
+		}
+	}
+}
+
 func (output *TDOutput) String() string {
 	return "output"
 }
@@ -405,7 +534,7 @@ func (output *TDOutput) Start() {
 		output.wg.Wait()
 		err := output.journalGroup.Dispose()
 		if err != nil {
-			output.logger.Error(err.Error())
+			output.logger.Error(LogError(err))
 		}
 		output.completion.L.Lock()
 		output.hasShutdownCompleted = true
@@ -424,6 +553,7 @@ func NewTDOutput(
 	connectionTimeout time.Duration,
 	writeTimeout time.Duration,
 	flushInterval time.Duration,
+	flushTimeout time.Duration,
 	parallelism int,
 	journalGroupPath string,
 	maxJournalChunkSize int64,
@@ -475,6 +605,7 @@ func NewTDOutput(
 		codec:                &_codec,
 		wg:                   sync.WaitGroup{},
 		flushInterval:        flushInterval,
+		flushTimeout:         flushTimeout,
 		emitterChan:          make(chan FluentRecordSet),
 		isShuttingDown:       0,
 		client:               client,
@@ -486,11 +617,114 @@ func NewTDOutput(
 		completion:           sync.Cond{L: &sync.Mutex{}},
 		hasShutdownCompleted: false,
 		metadata:             metadata,
+		metrics:              newOutputMetrics("td:" + databaseName + "." + tableName),
 	}
 	journalGroup, err := journalFactory.GetJournalGroup(journalGroupPath, output)
 	if err != nil {
 		return nil, err
 	}
 	output.journalGroup = journalGroup
+	// the chunks recovered from the buffer
+	output.metrics.observeBuffer(journalGroup)
 	return output, nil
 }
+
+// newTDOutputFromConfig takes the destination as
+// td+https://APIKEY@api.treasuredata.com/DATABASE/TABLE in "to", where the
+// database and the table default to the ones derived from the tag.
+func newTDOutputFromConfig(logger *logging.Logger, config *ConfigElement) (Output, error) {
+	u, err := url.Parse(config.Get("to", ""))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", config.String(), err.Error()))
+	}
+	if u.Scheme != "td+http" && u.Scheme != "td+https" {
+		return nil, errors.New(fmt.Sprintf("%s: to must be either a td+http or td+https URL", config.String()))
+	}
+	apiKey := config.Get("api-key", "")
+	if u.User != nil {
+		apiKey = u.User.Username()
+	}
+	databaseName, tableName := "*", "*"
+	p := strings.Split(u.Path, "/")
+	if len(p) > 1 && p[1] != "" {
+		databaseName = p[1]
+	}
+	if len(p) > 2 && p[2] != "" {
+		tableName = p[2]
+	}
+	journalGroupPath := config.Get("buffer-path", "")
+	if journalGroupPath == "" {
+		return nil, errors.New(fmt.Sprintf("%s: buffer-path is not specified", config.String()))
+	}
+	connectionTimeout, err := config.GetDuration("conn-timeout", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	writeTimeout, err := config.GetDuration("write-timeout", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	flushInterval, err := config.GetDuration("flush-interval", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	flushTimeout, err := config.GetDuration("flush-timeout", 0)
+	if err != nil {
+		return nil, err
+	}
+	parallelism, err := config.GetInt("parallelism", 1)
+	if err != nil {
+		return nil, err
+	}
+	maxJournalChunkSize, err := config.GetInt64("buffer-chunk-limit", 16777216)
+	if err != nil {
+		return nil, err
+	}
+	rootCAs := (*x509.CertPool)(nil)
+	if path := config.Get("ca-certs", ""); path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: failed to read CA bundle file: %s", config.String(), err.Error()))
+		}
+		rootCAs = x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(b) {
+			return nil, errors.New(fmt.Sprintf("%s: no valid certificate found in %s", config.String(), path))
+		}
+	}
+	return NewTDOutput(
+		logger,
+		u.Host,
+		connectionTimeout,
+		writeTimeout,
+		flushInterval,
+		flushTimeout,
+		parallelism,
+		journalGroupPath,
+		maxJournalChunkSize,
+		apiKey,
+		databaseName,
+		tableName,
+		"",
+		u.Scheme == "td+https",
+		rootCAs,
+		"",
+		config.Get("metadata", ""),
+	)
+}
+
+func init() {
+	RegisterOutput("td", newTDOutputFromConfig)
+	RegisterOutputParams("td",
+		ParamSchema{Name: "to", Type: ParamString, Description: "td+http:// or td+https:// URL of the API with the API key, the database and the table"},
+		ParamSchema{Name: "api-key", Type: ParamString, Description: "API key"},
+		ParamSchema{Name: "buffer-path", Type: ParamString, Description: "path of the buffer"},
+		ParamSchema{Name: "buffer-chunk-limit", Type: ParamInteger, Description: "size of a chunk in bytes", Default: "16777216"},
+		ParamSchema{Name: "flush-interval", Type: ParamDuration, Description: "interval in which the buffer is flushed", Default: "5s"},
+		ParamSchema{Name: "flush-timeout", Type: ParamDuration, Description: "time within which the import of a chunk has to complete; unlimited if 0", Default: "0"},
+		ParamSchema{Name: "conn-timeout", Type: ParamDuration, Description: "timeout of connecting", Default: "10s"},
+		ParamSchema{Name: "write-timeout", Type: ParamDuration, Description: "timeout of writing", Default: "10s"},
+		ParamSchema{Name: "parallelism", Type: ParamInteger, Description: "number of the chunks imported at once", Default: "1"},
+		ParamSchema{Name: "ca-certs", Type: ParamString, Description: "CA certificate bundle"},
+		ParamSchema{Name: "metadata", Type: ParamString, Description: "additional data set into the records"},
+	)
+}
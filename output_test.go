@@ -0,0 +1,133 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_ForwardOutput_FlushTimeout(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("output")
+	tempDir, err := ioutil.TempDir("", "output")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+	// accepts the connections but never reads from them
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer listener.Close()
+	conns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conns <- conn
+		}
+	}()
+	output, err := NewForwardOutput(logger, listener.Addr().String(), 10*time.Millisecond, time.Second, 10*time.Millisecond, time.Second, 200*time.Millisecond, tempDir+"/*.buf", 16777216, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer output.journalGroup.Dispose()
+	start := time.Now()
+	err = output.sendBuffer(make([]byte, 64*1024*1024), start.Add(output.flushTimeout))
+	if err == nil {
+		t.Fatal("the flush to the blackholed connection succeeded")
+	}
+	if elapsed := time.Now().Sub(start); elapsed > 5*time.Second {
+		t.Errorf("the flush took %s", elapsed.String())
+	}
+	if output.conn != nil || output.metrics.flushTimeouts.Value() != 1 {
+		t.Fail()
+	}
+	if errorClass(err) != ErrorClassFlushTimeout || outputFailures.With(output.metrics.name, ErrorClassFlushTimeout).Value() != 1 {
+		t.Fail()
+	}
+	select {
+	case conn := <-conns:
+		conn.Close()
+	default:
+	}
+}
+
+func Test_ForwardOutput_FlushBatch(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("output")
+	tempDir, err := ioutil.TempDir("", "output")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer listener.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := ioutil.ReadAll(conn)
+		received <- data
+	}()
+	// every write takes a chunk of its own
+	output, err := NewForwardOutput(logger, listener.Addr().String(), 10*time.Millisecond, time.Second, time.Second, time.Second, 10*time.Second, tempDir+"/*.buf", 100, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer output.journalGroup.Dispose()
+	expected := []byte{}
+	for i := 0; i < 50; i++ {
+		data := []byte(fmt.Sprintf("%064d", i))
+		err = output.journal.Write(data)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		expected = append(expected, data...)
+	}
+	flushed := output.flush()
+	if flushed != 50 {
+		t.Errorf("%d chunks flushed", flushed)
+	}
+	if count, size := output.journal.Usage(); count != 1 || size != 0 {
+		t.Errorf("%d chunks of %d bytes left", count, size)
+	}
+	output.conn.Close()
+	select {
+	case data := <-received:
+		if !bytes.Equal(data, expected) {
+			t.Errorf("received %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing received")
+	}
+}
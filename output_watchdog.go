@@ -0,0 +1,147 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"fmt"
+	logging "github.com/op/go-logging"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	outputStuck  = mustGaugeVec(DefaultMetrics.NewGaugeVec("fluentd_forwarder_output_stuck", "Whether the output is considered stuck.", "output"))
+	outputStalls = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_output_stalls_total", "Number of the times the output has been found stuck.", "output"))
+)
+
+// OutputWatchdog checks periodically that the outputs are making progress.
+// An output is considered stuck while its flush has not completed within
+// flushDeadline, or while the oldest of its records not delivered yet were
+// received more than bufferAgeDeadline ago; a deadline of 0 disables the
+// check.  A warning is logged when an output gets stuck, which is also
+// emitted as fluent.warn with the internal events enabled, and a notice
+// when it recovers.
+type OutputWatchdog struct {
+	logger            *logging.Logger
+	outputs           func() []Output
+	flushDeadline     time.Duration
+	bufferAgeDeadline time.Duration
+	interval          time.Duration
+	now               func() time.Time
+	// the reasons the outputs are stuck for, by the names
+	stuck          map[string]string
+	wg             sync.WaitGroup
+	shutdownChan   chan struct{}
+	isShuttingDown uintptr
+}
+
+// diagnose returns why the output is stuck, or "" if it is not.
+func (watchdog *OutputWatchdog) diagnose(health OutputHealth) string {
+	now := watchdog.now()
+	if watchdog.flushDeadline > 0 && !health.FlushStartedAt.IsZero() {
+		elapsed := now.Sub(health.FlushStartedAt)
+		if elapsed > watchdog.flushDeadline {
+			return fmt.Sprintf("the flush has not completed in %s", elapsed.String())
+		}
+	}
+	if watchdog.bufferAgeDeadline > 0 && !health.OldestBufferedAt.IsZero() {
+		age := now.Sub(health.OldestBufferedAt)
+		if age > watchdog.bufferAgeDeadline {
+			return fmt.Sprintf("the oldest records buffered were received %s ago", age.String())
+		}
+	}
+	return ""
+}
+
+func (watchdog *OutputWatchdog) check() {
+	stuck := make(map[string]string)
+	for _, output := range watchdog.outputs() {
+		output, ok := output.(HealthReportingOutput)
+		if !ok {
+			continue
+		}
+		health := output.Health()
+		reason := watchdog.diagnose(health)
+		if reason == "" {
+			continue
+		}
+		stuck[health.Name] = reason
+		if _, ok := watchdog.stuck[health.Name]; !ok {
+			watchdog.logger.Warningf("%s: output %s is stuck: %s", LogComponent(watchdog.String()), health.Name, reason)
+			outputStuck.With(health.Name).Set(1)
+			outputStalls.With(health.Name).Inc()
+		}
+	}
+	for name := range watchdog.stuck {
+		if _, ok := stuck[name]; !ok {
+			watchdog.logger.Noticef("%s: output %s has recovered", LogComponent(watchdog.String()), name)
+			outputStuck.With(name).Set(0)
+		}
+	}
+	watchdog.stuck = stuck
+}
+
+func (watchdog *OutputWatchdog) String() string {
+	return "watchdog"
+}
+
+func (watchdog *OutputWatchdog) Start() {
+	watchdog.wg.Add(1)
+	go func() {
+		defer watchdog.wg.Done()
+		ticker := time.NewTicker(watchdog.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				watchdog.check()
+			case <-watchdog.shutdownChan:
+				return
+			}
+		}
+	}()
+}
+
+func (watchdog *OutputWatchdog) Stop() {
+	if atomic.CompareAndSwapUintptr(&watchdog.isShuttingDown, 0, 1) {
+		watchdog.shutdownChan <- struct{}{}
+	}
+}
+
+func (watchdog *OutputWatchdog) WaitForShutdown() {
+	watchdog.wg.Wait()
+}
+
+// NewOutputWatchdog creates an OutputWatchdog; outputs returns the outputs
+// to check, which may change by reloading.
+func NewOutputWatchdog(logger *logging.Logger, outputs func() []Output, flushDeadline time.Duration, bufferAgeDeadline time.Duration, interval time.Duration) *OutputWatchdog {
+	return &OutputWatchdog{
+		logger:            logger,
+		outputs:           outputs,
+		flushDeadline:     flushDeadline,
+		bufferAgeDeadline: bufferAgeDeadline,
+		interval:          interval,
+		now:               time.Now,
+		stuck:             make(map[string]string),
+		wg:                sync.WaitGroup{},
+		shutdownChan:      make(chan struct{}, 1),
+		isShuttingDown:    0,
+	}
+}
@@ -0,0 +1,58 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"testing"
+	"time"
+)
+
+func Test_OutputWatchdog(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("watchdog")
+	now := time.Unix(1000, 0)
+	a := &healthReportingOutput{health: OutputHealth{Name: "watchdog-a", FlushStartedAt: now}}
+	b := &healthReportingOutput{health: OutputHealth{Name: "watchdog-b", OldestBufferedAt: now}}
+	watchdog := NewOutputWatchdog(logger, func() []Output { return []Output{a, b} }, time.Minute, time.Hour, time.Second)
+	watchdog.now = func() time.Time { return now }
+	stuck := func(name string) float64 {
+		return DefaultMetrics.Snapshot()["fluentd_forwarder_output_stuck"][`{output="`+name+`"}`]
+	}
+	watchdog.check()
+	if len(watchdog.stuck) != 0 {
+		t.Fail()
+	}
+	now = now.Add(2 * time.Minute)
+	watchdog.check()
+	watchdog.check()
+	if len(watchdog.stuck) != 1 || stuck("watchdog-a") != 1 {
+		t.Fail()
+	}
+	if DefaultMetrics.Snapshot()["fluentd_forwarder_output_stalls_total"][`{output="watchdog-a"}`] != 1 {
+		t.Fail()
+	}
+	// the flush has completed while the records keep aging
+	a.health.FlushStartedAt = time.Time{}
+	now = now.Add(time.Hour)
+	watchdog.check()
+	if len(watchdog.stuck) != 1 || stuck("watchdog-a") != 0 || stuck("watchdog-b") != 1 {
+		t.Fail()
+	}
+}
@@ -0,0 +1,503 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"strings"
+)
+
+// LabelPort is the entry of a label, a named chain of filters ending in
+// outputs that inputs and relabel filters can send the records to.  The
+// default label has the empty name.
+type LabelPort struct {
+	name string
+	port Port
+}
+
+func (port *LabelPort) Emit(recordSets []FluentRecordSet) error {
+	if port.port == nil {
+		return errors.New(fmt.Sprintf("label %s is not ready", port.name))
+	}
+	return port.port.Emit(recordSets)
+}
+
+func (port *LabelPort) String() string {
+	if port.name == "" {
+		return "label:default"
+	}
+	return "label:" + port.name
+}
+
+type OutputRoute struct {
+	Matcher *RecordMatcher
+	Port    Port
+}
+
+// OutputRouter passes each record to the first of the routes whose matcher
+// selects it, like the <match> directives of fluentd.  The records no route
+// matches are discarded.
+type OutputRouter struct {
+	logger *logging.Logger
+	name   string
+	routes []OutputRoute
+}
+
+func (router *OutputRouter) route(tag string, data map[string]interface{}) int {
+	for i, route := range router.routes {
+		if route.Matcher.MatchTag(tag) && route.Matcher.MatchRecord(data) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (router *OutputRouter) Emit(recordSets []FluentRecordSet) error {
+	batches := make([][]FluentRecordSet, len(router.routes))
+	discarded := 0
+outer:
+	for _, recordSet := range recordSets {
+		for i, route := range router.routes {
+			if route.Matcher.MatchTag(recordSet.Tag) && !route.Matcher.HasPredicates() {
+				batches[i] = append(batches[i], recordSet)
+				continue outer
+			}
+			if route.Matcher.MatchTag(recordSet.Tag) {
+				break
+			}
+		}
+		// some of the routes have to look into the records
+		for _, record := range recordSet.Records {
+			i := router.route(recordSet.Tag, record.Data)
+			if i < 0 {
+				DefaultRecordTracer.Tracef(recordSet.Tag, "%s: no output matches; discarded: %v", router.name, record.Data)
+				discarded += 1
+				continue
+			}
+			batches[i] = appendRecord(batches[i], recordSet.Tag, record)
+		}
+	}
+	if discarded > 0 {
+		countDropped(DropUnmatched, discarded)
+		router.logger.Debugf("%s: no output matches; discarding %d records", router.name, discarded)
+	}
+	retval := (error)(nil)
+	for i, batch := range batches {
+		if len(batch) == 0 {
+			continue
+		}
+		inheritTrace(batch, recordSets)
+		DefaultRecordTracer.TraceRecordSets(batch, "%s: routed to %v", router.name, router.routes[i].Port)
+		err := router.routes[i].Port.Emit(batch)
+		if err != nil && retval == nil {
+			retval = err
+		}
+	}
+	return retval
+}
+
+func NewOutputRouter(logger *logging.Logger, name string, routes []OutputRoute) *OutputRouter {
+	return &OutputRouter{
+		logger: logger,
+		name:   name,
+		routes: routes,
+	}
+}
+
+// RelabelFilter sends the records to another label instead of passing them
+// on.
+type RelabelFilter struct {
+	name  string
+	label *LabelPort
+}
+
+func (filter *RelabelFilter) Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error) {
+	return nil, filter.label.Emit(recordSets)
+}
+
+func (filter *RelabelFilter) String() string {
+	return "filter:" + filter.name
+}
+
+func NewRelabelFilter(name string, label *LabelPort) *RelabelFilter {
+	return &RelabelFilter{
+		name:  name,
+		label: label,
+	}
+}
+
+func init() {
+	RegisterFilterParams("relabel",
+		ParamSchema{Name: "to-label", Type: ParamString, Description: "label the events are sent to", Required: true},
+	)
+}
+
+// Pipeline holds the labels built from the filter and output sections of
+// the configuration.  Each section belongs to the label named by its
+// "label" parameter, or to the default label if not given.  The records
+// that fail in the filters or the outputs go to the label named ErrorLabel
+// if defined.  The pipeline sections set apart the labels of the pipelines
+// they define, which have limits of their own.
+type Pipeline struct {
+	labels  map[string]*LabelPort
+	Outputs []Output
+	Workers []Worker
+	// the outputs by outputKey, along with the sections they were built from
+	outputs       map[string]pipelineOutput
+	defaultOutput Output
+	// the pipelines defined by the pipeline sections by their labels
+	isolations map[string]*pipelineIsolation
+}
+
+type pipelineOutput struct {
+	section *ConfigElement
+	output  Output
+}
+
+// outputFactory creates the output of a section; key identifies the section
+// among the ones of the same configuration.
+type outputFactory func(logger *logging.Logger, key string, section *ConfigElement) (Output, error)
+
+func newOutputFromSection(logger *logging.Logger, key string, section *ConfigElement) (Output, error) {
+	return NewOutput(logger, section)
+}
+
+// Label returns the entry of the label, or of the default label if the name
+// is empty.
+func (pipeline *Pipeline) Label(name string) (*LabelPort, error) {
+	label, ok := pipeline.labels[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("label %s is not defined", name))
+	}
+	return label, nil
+}
+
+func (pipeline *Pipeline) Head() Port {
+	return pipeline.labels[""]
+}
+
+// newFilter creates a filter, which may refer to the labels.
+func (pipeline *Pipeline) newFilter(logger *logging.Logger, section *ConfigElement, next Port) (Filter, error) {
+	switch section.Get("type", "") {
+	case "relabel":
+		target, err := pipeline.Label(section.Get("to-label", ""))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s", section.String(), err.Error()))
+		}
+		return NewRelabelFilter(section.Arg, target), nil
+	case "tap":
+		target, err := pipeline.optionalLabel(section, "to-label")
+		if err != nil {
+			return nil, err
+		}
+		return newTapFilterFromConfig(logger, section, target)
+	case "copy":
+		target, err := pipeline.optionalLabel(section, "to-label")
+		if err != nil {
+			return nil, err
+		}
+		return newCopyFilterFromConfig(logger, section, target)
+	case "truncate":
+		overflow, err := pipeline.optionalLabel(section, "overflow-label")
+		if err != nil {
+			return nil, err
+		}
+		return newTruncateFilterFromConfig(logger, section, overflow)
+	}
+	return NewFilter(logger, section, next)
+}
+
+// errorPort returns the port the records failing in the label are reported
+// to.  The failures in the error label itself are only logged so as not to
+// loop.
+func (pipeline *Pipeline) errorPort(logger *logging.Logger, name string) *ErrorPort {
+	if label, ok := pipeline.labels[ErrorLabel]; ok && name != ErrorLabel {
+		return NewErrorPort(logger, label)
+	}
+	return NewErrorPort(logger, nil)
+}
+
+// attachErrorPorts lets the outputs report the records they fail to
+// serialize.  It is done once the pipeline is ready to take them, as the
+// outputs may be carried over from another pipeline.
+func (pipeline *Pipeline) attachErrorPorts(logger *logging.Logger) {
+	for _, entry := range pipeline.outputs {
+		if output, ok := entry.output.(ErrorReportingOutput); ok {
+			output.SetErrorPort(pipeline.errorPort(logger, entry.section.Get("label", "")))
+		}
+	}
+	if output, ok := pipeline.defaultOutput.(ErrorReportingOutput); ok {
+		output.SetErrorPort(pipeline.errorPort(logger, ""))
+	}
+}
+
+// optionalLabel returns the label named by the parameter, or nil if it is
+// not given.
+func (pipeline *Pipeline) optionalLabel(section *ConfigElement, key string) (Port, error) {
+	if !section.Has(key) {
+		return nil, nil
+	}
+	label, err := pipeline.Label(section.Get(key, ""))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", section.String(), err.Error()))
+	}
+	return label, nil
+}
+
+func (pipeline *Pipeline) buildLabel(logger *logging.Logger, label *LabelPort, sections []*ConfigElement, defaultOutput Output, newOutput outputFactory) error {
+	routes := make([]OutputRoute, 0)
+	for i, section := range sections {
+		if section.Name != "output" || section.Get("label", "") != label.name {
+			continue
+		}
+		matcher, err := newRecordMatcherFromConfig(section)
+		if err != nil {
+			return err
+		}
+		rewriter, err := newTagRewriterFromConfig(section)
+		if err != nil {
+			return err
+		}
+		formatter, err := newTimeFormatterFromConfig(section)
+		if err != nil {
+			return err
+		}
+		key := outputKey(sections, i)
+		output, err := newOutput(outputLogger(logger, section), key, section)
+		if err != nil {
+			return err
+		}
+		pipeline.Outputs = append(pipeline.Outputs, output)
+		pipeline.outputs[key] = pipelineOutput{section: section, output: output}
+		port := (Port)(output)
+		if formatter != nil {
+			port = NewTimeFormattingPort(formatter, port)
+		}
+		if rewriter != nil {
+			port = NewTagRewritingPort(rewriter, port)
+		}
+		routes = append(routes, OutputRoute{Matcher: matcher, Port: port})
+	}
+	if label.name == "" && defaultOutput != nil {
+		pipeline.defaultOutput = defaultOutput
+		matcher, _ := NewRecordMatcher("**", nil)
+		routes = append(routes, OutputRoute{Matcher: matcher, Port: defaultOutput})
+	}
+	// without the default output, the records sent to the default label with
+	// no output are discarded, as fluentd does
+	if len(routes) == 0 && (label.name != "" || defaultOutput != nil) {
+		return errors.New(fmt.Sprintf("%s has no output", label.String()))
+	}
+	port := (Port)(NewOutputRouter(logger, label.String(), routes))
+	if len(routes) == 1 && routes[0].Matcher.String() == "**" {
+		port = routes[0].Port
+	}
+	errorPort := pipeline.errorPort(logger, label.name)
+	filterSections := make([]*ConfigElement, 0)
+	for _, section := range sections {
+		if section.Name == "filter" && section.Get("label", "") == label.name {
+			filterSections = append(filterSections, section)
+		}
+	}
+	for i := len(filterSections) - 1; i >= 0; i -= 1 {
+		section := filterSections[i]
+		matcher, err := newRecordMatcherFromConfig(section)
+		if err != nil {
+			return err
+		}
+		filter, err := pipeline.newFilter(filterLogger(logger, section), section, port)
+		if err != nil {
+			return err
+		}
+		if worker, ok := filter.(Worker); ok {
+			pipeline.Workers = append(pipeline.Workers, worker)
+		}
+		port = NewFilterPort(filter, matcher, port, errorPort)
+	}
+	label.port = port
+	return nil
+}
+
+// outputKey identifies the i-th section by its name and the number of the
+// output sections of the same name before it.
+func outputKey(sections []*ConfigElement, i int) string {
+	n := 0
+	for _, section := range sections[:i] {
+		if section.Name == "output" && section.Arg == sections[i].Arg {
+			n += 1
+		}
+	}
+	return fmt.Sprintf("%s#%d", sections[i].Arg, n)
+}
+
+// componentName names the component of the section after the section, or
+// its type if the section is unnamed.
+func componentName(section *ConfigElement) string {
+	if section.Arg != "" {
+		return section.Arg
+	}
+	return section.Get("type", section.Name)
+}
+
+// outputLogger returns the logger of the output of the section.
+func outputLogger(logger *logging.Logger, section *ConfigElement) *logging.Logger {
+	name := componentName(section)
+	return NewComponentLogger(logger, "output."+name, LogField{Key: "output", Value: name})
+}
+
+// filterLogger returns the logger of the filter of the section.
+func filterLogger(logger *logging.Logger, section *ConfigElement) *logging.Logger {
+	name := componentName(section)
+	return NewComponentLogger(logger, "filter."+name, LogField{Key: "filter", Value: name})
+}
+
+// labelNames returns the names of the labels the sections define, starting
+// with the default one.
+func labelNames(sections []*ConfigElement) []string {
+	names := []string{""}
+	seen := map[string]struct{}{"": struct{}{}}
+	for _, section := range sections {
+		if section.Name != "filter" && section.Name != "output" {
+			continue
+		}
+		name := section.Get("label", "")
+		if _, ok := seen[name]; !ok {
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// checkLabelCycles fails if the records can be sent around the labels in a
+// loop, which would recurse until the stack overflows, as the labels are
+// emitted to synchronously.  A label sends the records to the labels given
+// by to-label and overflow-label of its filters, and every label but the
+// error label sends the records failing in it to the error label if
+// defined.
+func checkLabelCycles(sections []*ConfigElement) error {
+	names := labelNames(sections)
+	edges := make(map[string][]string)
+	hasErrorLabel := false
+	for _, name := range names {
+		if name == ErrorLabel {
+			hasErrorLabel = true
+		}
+	}
+	for _, name := range names {
+		for _, section := range sections {
+			if section.Name != "filter" || section.Get("label", "") != name {
+				continue
+			}
+			for _, key := range []string{"to-label", "overflow-label"} {
+				if section.Has(key) {
+					edges[name] = append(edges[name], section.Get(key, ""))
+				}
+			}
+		}
+		if hasErrorLabel && name != ErrorLabel {
+			edges[name] = append(edges[name], ErrorLabel)
+		}
+	}
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	states := make(map[string]int)
+	path := make([]string, 0)
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch states[name] {
+		case visiting:
+			loop := make([]string, 0)
+			for i := len(path) - 1; i >= 0; i -= 1 {
+				if path[i] == name {
+					for _, name_ := range append(path[i:], name) {
+						loop = append(loop, (&LabelPort{name: name_}).String())
+					}
+					break
+				}
+			}
+			return errors.New(fmt.Sprintf("the records would be sent around the labels in a loop: %s", strings.Join(loop, " -> ")))
+		case visited:
+			return nil
+		}
+		states[name] = visiting
+		path = append(path, name)
+		for _, target := range edges[name] {
+			if err := visit(target); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		states[name] = visited
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildPipeline returns what has been built so far along with the error, if
+// any, so that the outputs already created can be disposed of.
+func buildPipeline(logger *logging.Logger, sections []*ConfigElement, defaultOutput Output, newOutput outputFactory) (*Pipeline, error) {
+	pipeline := &Pipeline{
+		labels:  make(map[string]*LabelPort),
+		Outputs: make([]Output, 0),
+		Workers: make([]Worker, 0),
+		outputs: make(map[string]pipelineOutput),
+	}
+	isolations, err := isolatePipelines(sections)
+	if err != nil {
+		return pipeline, err
+	}
+	pipeline.isolations = isolations
+	err = checkLabelCycles(sections)
+	if err != nil {
+		return pipeline, err
+	}
+	names := labelNames(sections)
+	for _, name := range names {
+		pipeline.labels[name] = &LabelPort{name: name, port: nil}
+	}
+	for _, name := range names {
+		err := pipeline.buildLabel(logger, pipeline.labels[name], sections, defaultOutput, newOutput)
+		if err != nil {
+			return pipeline, err
+		}
+	}
+	return pipeline, nil
+}
+
+// BuildPipeline builds the labels; the default one ends in the outputs
+// without a label followed by defaultOutput, which takes all the rest.
+func BuildPipeline(logger *logging.Logger, sections []*ConfigElement, defaultOutput Output) (*Pipeline, error) {
+	pipeline, err := buildPipeline(logger, sections, defaultOutput, newOutputFromSection)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.attachErrorPorts(logger)
+	return pipeline, nil
+}
@@ -0,0 +1,257 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// the parameters of the pipeline sections
+var pipelineParams = []ParamSchema{
+	{Name: "label", Type: ParamString, Description: "label the pipeline starts at; the name of the pipeline if not given"},
+	{Name: "buffer-limit", Type: ParamInteger, Description: "bytes buffered by the outputs of the pipeline above which its inputs stop reading; unlimited if 0", Default: "0"},
+	{Name: "max-connections", Type: ParamInteger, Description: "connections the forward inputs of the pipeline take at once; unlimited if 0", Default: "0"},
+}
+
+// the interval in which the buffers of a pipeline held back are checked
+var pipelineHoldInterval = 100 * time.Millisecond
+
+var (
+	pipelineBufferBytes         = mustGaugeVec(DefaultMetrics.NewGaugeVec("fluentd_forwarder_pipeline_buffer_bytes", "Bytes buffered by the outputs of the pipeline.", "pipeline"))
+	pipelineBlockedSeconds      = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_pipeline_blocked_seconds_total", "Seconds the inputs of the pipeline have been held back for by its buffer-limit.", "pipeline"))
+	pipelineRejectedConnections = mustCounterVec(DefaultMetrics.NewCounterVec("fluentd_forwarder_pipeline_rejected_connections_total", "Number of the connections rejected by the max-connections of the pipeline.", "pipeline"))
+)
+
+// pipelineState is what a pipeline keeps across the reloads.
+type pipelineState struct {
+	connections int64   // accessed atomically
+	isHeld      uintptr // accessed atomically
+}
+
+// pipelineIsolation is a pipeline defined by a pipeline section: the label
+// it starts at and the ones its filters send the records to, which no
+// other pipeline sends any records to, with the limits of its own.
+type pipelineIsolation struct {
+	name           string
+	labels         []string
+	bufferLimit    int64
+	maxConnections int64
+	state          *pipelineState
+}
+
+// labelTargets returns the labels the filters of the label send the
+// records to, but for the error label, which all the pipelines share.
+func labelTargets(sections []*ConfigElement, name string) []string {
+	retval := make([]string, 0)
+	for _, section := range sections {
+		if section.Name != "filter" || section.Get("label", "") != name {
+			continue
+		}
+		for _, key := range []string{"to-label", "overflow-label"} {
+			if target := section.Get(key, ""); section.Has(key) && target != ErrorLabel {
+				retval = append(retval, target)
+			}
+		}
+	}
+	return retval
+}
+
+func pipelineLimit(section *ConfigElement, key string) (int64, error) {
+	value := section.Get(key, "0")
+	retval, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || retval < 0 {
+		return 0, errors.New(fmt.Sprintf("%s: %s: invalid value: %s", section.String(), key, value))
+	}
+	return retval, nil
+}
+
+// isolatePipelines returns the pipelines the pipeline sections define by
+// the labels belonging to them.  A label cannot belong to more than one
+// pipeline, nor can the records be sent to a pipeline from a label outside
+// it.
+func isolatePipelines(sections []*ConfigElement) (map[string]*pipelineIsolation, error) {
+	defined := make(map[string]struct{})
+	for _, name := range labelNames(sections) {
+		defined[name] = struct{}{}
+	}
+	retval := make(map[string]*pipelineIsolation)
+	names := make(map[string]struct{})
+	for _, section := range sections {
+		if section.Name != "pipeline" {
+			continue
+		}
+		if section.Arg == "" {
+			return nil, errors.New(fmt.Sprintf("%s: the pipeline has to be named", section.String()))
+		}
+		if _, ok := names[section.Arg]; ok {
+			return nil, errors.New(fmt.Sprintf("%s: duplicate pipeline", section.String()))
+		}
+		names[section.Arg] = struct{}{}
+		bufferLimit, err := pipelineLimit(section, "buffer-limit")
+		if err != nil {
+			return nil, err
+		}
+		maxConnections, err := pipelineLimit(section, "max-connections")
+		if err != nil {
+			return nil, err
+		}
+		start := section.Get("label", section.Arg)
+		if start == ErrorLabel {
+			return nil, errors.New(fmt.Sprintf("%s: %s is shared by the pipelines and cannot start one", section.String(), ErrorLabel))
+		}
+		if _, ok := defined[start]; !ok {
+			return nil, errors.New(fmt.Sprintf("%s: label %s is not defined", section.String(), start))
+		}
+		isolation := &pipelineIsolation{
+			name:           section.Arg,
+			labels:         make([]string, 0),
+			bufferLimit:    bufferLimit,
+			maxConnections: maxConnections,
+			state:          &pipelineState{},
+		}
+		queue := []string{start}
+		for len(queue) > 0 {
+			name := queue[0]
+			queue = queue[1:]
+			if other, ok := retval[name]; ok {
+				if other == isolation {
+					continue
+				}
+				return nil, errors.New(fmt.Sprintf("%s: label %s already belongs to pipeline %s", section.String(), name, other.name))
+			}
+			retval[name] = isolation
+			isolation.labels = append(isolation.labels, name)
+			queue = append(queue, labelTargets(sections, name)...)
+		}
+		sort.Strings(isolation.labels)
+	}
+	for _, section := range sections {
+		if section.Name != "filter" {
+			continue
+		}
+		from := retval[section.Get("label", "")]
+		for _, target := range labelTargets([]*ConfigElement{section}, section.Get("label", "")) {
+			if isolation, ok := retval[target]; ok && isolation != from {
+				return nil, errors.New(fmt.Sprintf("%s: label %s belongs to pipeline %s, which takes no records from outside it", section.String(), target, isolation.name))
+			}
+		}
+	}
+	return retval, nil
+}
+
+// bufferedBytes returns the bytes buffered by the outputs of the labels of
+// the pipeline.
+func (pipeline *Pipeline) bufferedBytes(isolation *pipelineIsolation) int64 {
+	retval := int64(0)
+	for _, entry := range pipeline.outputs {
+		if pipeline.isolations[entry.section.Get("label", "")] != isolation {
+			continue
+		}
+		if output, ok := entry.output.(HealthReportingOutput); ok {
+			retval += output.Health().BufferedBytes
+		}
+	}
+	if isolation == pipeline.isolations[""] {
+		if output, ok := pipeline.defaultOutput.(HealthReportingOutput); ok {
+			retval += output.Health().BufferedBytes
+		}
+	}
+	return retval
+}
+
+// carryOverIsolations lets the pipelines of the same names keep the
+// connections they have taken so far.
+func carryOverIsolations(old *Pipeline, built *Pipeline) {
+	states := make(map[string]*pipelineState)
+	for _, isolation := range old.isolations {
+		states[isolation.name] = isolation.state
+	}
+	for _, isolation := range built.isolations {
+		if state, ok := states[isolation.name]; ok {
+			isolation.state = state
+		}
+	}
+}
+
+// hold blocks while the outputs of the pipeline the label belongs to buffer
+// more than its buffer-limit, until the gates are opened.  The limit is
+// taken again from the current pipeline each time, as it may be reloaded.
+func (pipeline *ReloadablePipeline) hold(name string) {
+	heldAt := time.Time{}
+	for {
+		current := pipeline.current.Load().(*Pipeline)
+		isolation, ok := current.isolations[name]
+		if !ok || isolation.bufferLimit <= 0 {
+			return
+		}
+		buffered := current.bufferedBytes(isolation)
+		pipelineBufferBytes.With(isolation.name).Set(float64(buffered))
+		if !heldAt.IsZero() {
+			pipelineBlockedSeconds.With(isolation.name).Add(time.Since(heldAt).Seconds())
+		}
+		if buffered <= isolation.bufferLimit {
+			if atomic.CompareAndSwapUintptr(&isolation.state.isHeld, 1, 0) {
+				pipeline.logger.Noticef("pipeline %s: %d bytes buffered; resumed taking the records", isolation.name, buffered)
+			}
+			return
+		}
+		if atomic.CompareAndSwapUintptr(&isolation.state.isHeld, 0, 1) {
+			pipeline.logger.Warningf("pipeline %s: %d bytes buffered, more than buffer-limit of %d; holding back the inputs", isolation.name, buffered, isolation.bufferLimit)
+		}
+		heldAt = time.Now()
+		select {
+		case <-time.After(pipelineHoldInterval):
+		case <-pipeline.opened:
+			pipelineBlockedSeconds.With(isolation.name).Add(time.Since(heldAt).Seconds())
+			return
+		}
+	}
+}
+
+// OpenGates lets the records held back by the buffer-limit of the pipelines
+// through from then on, so that the inputs can stop.
+func (pipeline *ReloadablePipeline) OpenGates() {
+	pipeline.openOnce.Do(func() {
+		close(pipeline.opened)
+	})
+}
+
+// admitConnection counts a connection to an input sending to the label
+// against the max-connections of the pipeline it belongs to.
+func (pipeline *ReloadablePipeline) admitConnection(name string) (func(), bool) {
+	isolation, ok := pipeline.current.Load().(*Pipeline).isolations[name]
+	if !ok {
+		return func() {}, true
+	}
+	state := isolation.state
+	connections := atomic.AddInt64(&state.connections, 1)
+	if isolation.maxConnections > 0 && connections > isolation.maxConnections {
+		atomic.AddInt64(&state.connections, -1)
+		pipelineRejectedConnections.With(isolation.name).Inc()
+		return nil, false
+	}
+	return func() {
+		atomic.AddInt64(&state.connections, -1)
+	}, true
+}
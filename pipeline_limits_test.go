@@ -0,0 +1,232 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type bufferingOutput struct {
+	recordingOutput
+	buffered int64 // accessed atomically
+}
+
+func (output *bufferingOutput) Emit(recordSets []FluentRecordSet) error { return nil }
+func (output *bufferingOutput) Health() OutputHealth {
+	return OutputHealth{Name: output.name, BufferedBytes: atomic.LoadInt64(&output.buffered)}
+}
+
+var bufferingOutputs = make(map[string]*bufferingOutput)
+
+func init() {
+	RegisterOutput("test-buffering", func(logger *logging.Logger, config *ConfigElement) (Output, error) {
+		output := &bufferingOutput{recordingOutput: recordingOutput{name: config.Arg}}
+		bufferingOutputs[config.Arg] = output
+		return output, nil
+	})
+}
+
+const twoPipelines = `
+[pipeline "metrics"]
+buffer-limit = 100
+max-connections = 2
+
+[pipeline "logs"]
+label = app
+
+[output "metrics"]
+type = test-buffering
+label = metrics
+
+[filter "errors"]
+type = relabel
+label = app
+match = app.error
+to-label = errors
+
+[output "logs"]
+type = test-buffering
+label = app
+
+[output "errors"]
+type = test-buffering
+label = errors
+`
+
+func Test_IsolatePipelines(t *testing.T) {
+	sections, err := ReadConfig("test.conf", []byte(twoPipelines))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	isolations, err := isolatePipelines(sections)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(isolations["app"].labels, []string{"app", "errors"}) || isolations["errors"] != isolations["app"] {
+		t.Errorf("%v", isolations["app"].labels)
+	}
+	if isolations["metrics"].bufferLimit != 100 || isolations["metrics"].maxConnections != 2 {
+		t.Fail()
+	}
+	if _, ok := isolations[""]; ok {
+		t.Fail()
+	}
+
+	for _, c := range []struct {
+		src string
+		msg string
+	}{
+		// the label the other pipeline sends the records to
+		{twoPipelines + `
+[pipeline "errors"]
+`, "label errors already belongs to pipeline logs"},
+		{twoPipelines + `
+[filter "stray"]
+type = relabel
+to-label = metrics
+`, "label metrics belongs to pipeline metrics"},
+		{twoPipelines + `
+[pipeline "x"]
+label = nowhere
+`, "label nowhere is not defined"},
+		{twoPipelines + `
+[pipeline "x"]
+label = @ERROR
+`, "is shared by the pipelines"},
+		{`
+[pipeline "default"]
+label =
+buffer-limit = -1
+`, "buffer-limit: invalid value: -1"},
+	} {
+		sections, err := ReadConfig("test.conf", []byte(c.src))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_, err = isolatePipelines(sections)
+		if err == nil || !strings.Contains(err.Error(), c.msg) {
+			t.Errorf("%v", err)
+		}
+	}
+}
+
+func Test_ReloadablePipeline_BufferLimit(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("pipeline")
+	defer func(interval time.Duration) { pipelineHoldInterval = interval }(pipelineHoldInterval)
+	pipelineHoldInterval = 10 * time.Millisecond
+	sections, err := ReadConfig("test.conf", []byte(twoPipelines))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pipeline, err := NewReloadablePipeline(logger, sections, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	metrics, _ := pipeline.Label("metrics")
+	logs, _ := pipeline.Label("app")
+	recordSets := []FluentRecordSet{{Tag: "app.error", Records: []TinyFluentRecord{{Timestamp: 0, Data: map[string]interface{}{}}}}}
+	emitted := func(port Port) chan error {
+		retval := make(chan error, 1)
+		go func() { retval <- port.Emit(recordSets) }()
+		return retval
+	}
+
+	// the backlog of the metrics holds back only its own inputs
+	atomic.StoreInt64(&bufferingOutputs["metrics"].buffered, 101)
+	atomic.StoreInt64(&bufferingOutputs["errors"].buffered, 1000)
+	held := emitted(metrics)
+	select {
+	case err := <-emitted(logs):
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the logs are held back")
+	}
+	select {
+	case <-held:
+		t.Fatal("the metrics are not held back")
+	case <-time.After(50 * time.Millisecond):
+	}
+	atomic.StoreInt64(&bufferingOutputs["metrics"].buffered, 100)
+	select {
+	case <-held:
+	case <-time.After(time.Second):
+		t.Fatal("the metrics are not let through")
+	}
+
+	atomic.StoreInt64(&bufferingOutputs["metrics"].buffered, 101)
+	held = emitted(metrics)
+	pipeline.Stop()
+	select {
+	case <-held:
+	case <-time.After(time.Second):
+		t.Fatal("the metrics are not let through on stopping")
+	}
+}
+
+func Test_ReloadablePipeline_MaxConnections(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("pipeline")
+	sections, err := ReadConfig("test.conf", []byte(twoPipelines))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pipeline, err := NewReloadablePipeline(logger, sections, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	label, _ := pipeline.Label("metrics")
+	port := label.(ConnectionAdmittingPort)
+	first, ok := port.AdmitConnection()
+	if !ok {
+		t.Fatal()
+	}
+	if _, ok := port.AdmitConnection(); !ok {
+		t.Fatal()
+	}
+	if _, ok := port.AdmitConnection(); ok {
+		t.Fatal("more than max-connections admitted")
+	}
+	// the connections are counted across the reloads
+	err = pipeline.Reload(sections)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, ok := port.AdmitConnection(); ok {
+		t.Fatal("more than max-connections admitted after reloading")
+	}
+	first()
+	if _, ok := port.AdmitConnection(); !ok {
+		t.Fatal("the connection closed is not released")
+	}
+	// the ones outside the pipelines are not limited
+	head := pipeline.Head().(ConnectionAdmittingPort)
+	for i := 0; i < 3; i += 1 {
+		if _, ok := head.AdmitConnection(); !ok {
+			t.Fatal()
+		}
+	}
+}
@@ -0,0 +1,366 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"sync"
+	"sync/atomic"
+)
+
+// reloadableLabelPort sends the records to the label of whichever pipeline
+// is current.
+type reloadableLabelPort struct {
+	pipeline *ReloadablePipeline
+	name     string
+}
+
+func (port *reloadableLabelPort) Emit(recordSets []FluentRecordSet) error {
+	port.pipeline.hold(port.name)
+	label, err := port.pipeline.current.Load().(*Pipeline).Label(port.name)
+	if err != nil {
+		return err
+	}
+	return label.Emit(recordSets)
+}
+
+// AdmitConnection counts the connection against the max-connections of the
+// pipeline the label belongs to, if any.
+func (port *reloadableLabelPort) AdmitConnection() (func(), bool) {
+	return port.pipeline.admitConnection(port.name)
+}
+
+func (port *reloadableLabelPort) String() string {
+	if port.name == "" {
+		return "label:default"
+	}
+	return "label:" + port.name
+}
+
+// outputSlot stands for an output being replaced with the one of the new
+// settings, holding the records routed to it until the new one is ready.
+type outputSlot struct {
+	mtx    sync.RWMutex
+	output Output
+}
+
+func (slot *outputSlot) Emit(recordSets []FluentRecordSet) error {
+	slot.mtx.RLock()
+	defer slot.mtx.RUnlock()
+	return slot.output.Emit(recordSets)
+}
+
+func (slot *outputSlot) String() string {
+	slot.mtx.RLock()
+	defer slot.mtx.RUnlock()
+	return slot.output.String()
+}
+
+func (slot *outputSlot) Start() {}
+
+func (slot *outputSlot) Stop() {
+	slot.mtx.RLock()
+	defer slot.mtx.RUnlock()
+	slot.output.Stop()
+}
+
+func (slot *outputSlot) WaitForShutdown() {
+	slot.mtx.RLock()
+	defer slot.mtx.RUnlock()
+	slot.output.WaitForShutdown()
+}
+
+// outputHandover is the replacement of an output whose settings have been
+// changed.
+type outputHandover struct {
+	key      string
+	slot     *outputSlot
+	previous pipelineOutput
+	section  *ConfigElement
+}
+
+// ReloadablePipeline is a Pipeline that can be replaced with the one built
+// from a new configuration while the inputs keep emitting to its labels.
+// The outputs whose sections are unchanged but for the routing parameters
+// (match, where, label and the tag rewriting) are carried over along with
+// their buffers.  The ones whose other settings have been changed are
+// stopped once the new pipeline is in place and created again with the new
+// settings, taking over the buffers left behind.  The inputs are held back
+// while the outputs of their pipeline buffer more than its buffer-limit.
+type ReloadablePipeline struct {
+	logger        *logging.Logger
+	defaultOutput Output
+	mtx           sync.Mutex
+	current       atomic.Value // *Pipeline
+	labelNames    map[string]struct{}
+	retired       []Worker
+	isStarted     bool
+	isStopped     bool
+	// closed by OpenGates
+	opened   chan struct{}
+	openOnce sync.Once
+}
+
+func (pipeline *ReloadablePipeline) String() string {
+	return "pipeline"
+}
+
+// Label returns the port to the label, which has to remain defined by the
+// configurations reloaded afterwards.
+func (pipeline *ReloadablePipeline) Label(name string) (Port, error) {
+	pipeline.mtx.Lock()
+	defer pipeline.mtx.Unlock()
+	_, err := pipeline.current.Load().(*Pipeline).Label(name)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.labelNames[name] = struct{}{}
+	return &reloadableLabelPort{pipeline: pipeline, name: name}, nil
+}
+
+func (pipeline *ReloadablePipeline) Head() Port {
+	port, _ := pipeline.Label("")
+	return port
+}
+
+// Outputs returns the outputs of the current pipeline.
+func (pipeline *ReloadablePipeline) Outputs() []Output {
+	return pipeline.current.Load().(*Pipeline).Outputs
+}
+
+func workersOf(pipeline *Pipeline) []Worker {
+	retval := make([]Worker, 0, len(pipeline.Workers)+len(pipeline.Outputs))
+	retval = append(retval, pipeline.Workers...)
+	for _, output := range pipeline.Outputs {
+		retval = append(retval, output)
+	}
+	return retval
+}
+
+func (pipeline *ReloadablePipeline) Start() {
+	pipeline.mtx.Lock()
+	defer pipeline.mtx.Unlock()
+	pipeline.isStarted = true
+	for _, worker := range workersOf(pipeline.current.Load().(*Pipeline)) {
+		worker.Start()
+	}
+}
+
+func (pipeline *ReloadablePipeline) Stop() {
+	pipeline.mtx.Lock()
+	defer pipeline.mtx.Unlock()
+	pipeline.isStopped = true
+	pipeline.OpenGates()
+	for _, worker := range workersOf(pipeline.current.Load().(*Pipeline)) {
+		worker.Stop()
+	}
+}
+
+func (pipeline *ReloadablePipeline) WaitForShutdown() {
+	pipeline.mtx.Lock()
+	workers := append(workersOf(pipeline.current.Load().(*Pipeline)), pipeline.retired...)
+	pipeline.mtx.Unlock()
+	for _, worker := range workers {
+		worker.WaitForShutdown()
+	}
+}
+
+// sameOutputSection tells whether the sections build the same output,
+// ignoring the parameters that only affect which records it receives and
+// how they are handed to it.
+func sameOutputSection(a *ConfigElement, b *ConfigElement) bool {
+	keys := make(map[string]struct{})
+	for _, key := range append(append([]string{}, a.Keys...), b.Keys...) {
+		keys[key] = struct{}{}
+	}
+	for key := range keys {
+		switch key {
+		case "match", "where", "label", "remove-tag-prefix", "tag-substitute", "add-tag-prefix", "time-key", "time-format", "timezone":
+			continue
+		}
+		va, vb := a.GetAll(key), b.GetAll(key)
+		if len(va) != len(vb) {
+			return false
+		}
+		for i := range va {
+			if va[i] != vb[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// discardOutputs disposes of the outputs created for a pipeline that is not
+// going to be used.  They are started so as to release their buffers.
+func discardOutputs(old *Pipeline, built *Pipeline) {
+	for key, entry := range built.outputs {
+		if previous, ok := old.outputs[key]; ok && previous.output == entry.output {
+			continue
+		}
+		if _, ok := entry.output.(*outputSlot); ok {
+			continue
+		}
+		entry.output.Start()
+		entry.output.Stop()
+		entry.output.WaitForShutdown()
+	}
+}
+
+// Reload builds the pipeline from the sections and, only if it succeeds,
+// switches the labels over to it and stops the filters and the outputs
+// that are no longer used.  The current pipeline is kept on error.
+func (pipeline *ReloadablePipeline) Reload(sections []*ConfigElement) error {
+	pipeline.mtx.Lock()
+	defer pipeline.mtx.Unlock()
+	if pipeline.isStopped {
+		return errors.New("pipeline has been stopped")
+	}
+	old := pipeline.current.Load().(*Pipeline)
+	names := make(map[string]struct{})
+	for _, name := range labelNames(sections) {
+		names[name] = struct{}{}
+	}
+	for name := range pipeline.labelNames {
+		if _, ok := names[name]; !ok {
+			return errors.New(fmt.Sprintf("label %s is used by an input and cannot be removed", name))
+		}
+	}
+	reused := make(map[Output]struct{})
+	carriedOver := 0
+	handovers := make([]*outputHandover, 0)
+	newOutput := func(logger *logging.Logger, key string, section *ConfigElement) (Output, error) {
+		previous, ok := old.outputs[key]
+		if !ok {
+			return NewOutput(logger, section)
+		}
+		reused[previous.output] = struct{}{}
+		if !sameOutputSection(previous.section, section) {
+			// the previous output keeps receiving the records until it is
+			// replaced, as the new one cannot take its buffer before
+			slot := &outputSlot{output: previous.output}
+			reused[slot] = struct{}{}
+			handovers = append(handovers, &outputHandover{key: key, slot: slot, previous: previous, section: section})
+			return slot, nil
+		}
+		carriedOver += 1
+		return previous.output, nil
+	}
+	built, err := buildPipeline(pipeline.logger, sections, pipeline.defaultOutput, newOutput)
+	if err != nil {
+		discardOutputs(old, built)
+		return err
+	}
+	if pipeline.isStarted {
+		for _, worker := range built.Workers {
+			worker.Start()
+		}
+		for _, output := range built.Outputs {
+			if _, ok := reused[output]; !ok {
+				output.Start()
+			}
+		}
+	}
+	carryOverIsolations(old, built)
+	pipeline.current.Store(built)
+	built.attachErrorPorts(pipeline.logger)
+
+	// the filters may flush what they hold to the outputs on stopping
+	for _, worker := range old.Workers {
+		worker.Stop()
+		worker.WaitForShutdown()
+	}
+	for _, output := range old.Outputs {
+		if _, ok := reused[output]; !ok {
+			output.Stop()
+			pipeline.retired = append(pipeline.retired, output)
+		}
+	}
+	for _, handover := range handovers {
+		built = pipeline.handOver(built, handover)
+	}
+	pipeline.logger.Noticef("%s: reloaded; %d of %d outputs carried over and %d reconfigured", LogComponent(pipeline.String()), carriedOver, len(built.Outputs), len(handovers))
+	return nil
+}
+
+// handOver stops the output whose settings have been changed and creates
+// it again, holding the records routed to it in the meantime, and returns
+// the pipeline with the new one.  If the new settings don't work, the
+// previous ones are kept.
+func (pipeline *ReloadablePipeline) handOver(built *Pipeline, handover *outputHandover) *Pipeline {
+	slot := handover.slot
+	slot.mtx.Lock()
+	defer slot.mtx.Unlock()
+	slot.output.Stop()
+	slot.output.WaitForShutdown()
+	section := handover.section
+	output, err := NewOutput(outputLogger(pipeline.logger, section), section)
+	if err != nil {
+		pipeline.logger.Errorf("%s: failed to apply the new settings; keeping the previous ones: %s", section.String(), err.Error())
+		section = handover.previous.section
+		output, err = NewOutput(outputLogger(pipeline.logger, section), section)
+		if err != nil {
+			// the records routed to it are dropped until the next reload
+			pipeline.logger.Errorf("%s: failed to recreate the output: %s", section.String(), err.Error())
+			return built
+		}
+	}
+	if pipeline.isStarted {
+		output.Start()
+	}
+	slot.output = output
+	replaced := *built
+	replaced.Outputs = make([]Output, 0, len(built.Outputs))
+	for _, output_ := range built.Outputs {
+		if output_ == Output(slot) {
+			output_ = output
+		}
+		replaced.Outputs = append(replaced.Outputs, output_)
+	}
+	replaced.outputs = make(map[string]pipelineOutput, len(built.outputs))
+	for key, entry := range built.outputs {
+		replaced.outputs[key] = entry
+	}
+	replaced.outputs[handover.key] = pipelineOutput{section: section, output: output}
+	pipeline.current.Store(&replaced)
+	replaced.attachErrorPorts(pipeline.logger)
+	pipeline.logger.Noticef("%s: reconfigured", section.String())
+	return &replaced
+}
+
+func NewReloadablePipeline(logger *logging.Logger, sections []*ConfigElement, defaultOutput Output) (*ReloadablePipeline, error) {
+	built, err := BuildPipeline(logger, sections, defaultOutput)
+	if err != nil {
+		return nil, err
+	}
+	pipeline := &ReloadablePipeline{
+		logger:        logger,
+		defaultOutput: defaultOutput,
+		mtx:           sync.Mutex{},
+		labelNames:    make(map[string]struct{}),
+		retired:       make([]Worker, 0),
+		isStarted:     false,
+		isStopped:     false,
+		opened:        make(chan struct{}),
+	}
+	pipeline.current.Store(built)
+	return pipeline, nil
+}
@@ -0,0 +1,446 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	logging "github.com/op/go-logging"
+	"strings"
+	"testing"
+)
+
+type recordingOutput struct {
+	recordingPort
+	name string
+}
+
+func (output *recordingOutput) String() string   { return "output:" + output.name }
+func (output *recordingOutput) Start()           {}
+func (output *recordingOutput) Stop()            {}
+func (output *recordingOutput) WaitForShutdown() {}
+
+var recordingOutputs = make(map[string]*recordingOutput)
+
+func init() {
+	RegisterOutput("test-recording", func(logger *logging.Logger, config *ConfigElement) (Output, error) {
+		output := &recordingOutput{name: config.Arg}
+		recordingOutputs[config.Arg] = output
+		return output, nil
+	})
+}
+
+func tagsOf(recordSets []FluentRecordSet) []string {
+	retval := make([]string, 0)
+	for _, recordSet := range recordSets {
+		for range recordSet.Records {
+			retval = append(retval, recordSet.Tag)
+		}
+	}
+	return retval
+}
+
+func Test_BuildPipeline(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("pipeline")
+	sections, err := ReadConfig("test.conf", []byte(`
+[filter "errors"]
+type = relabel
+match = app.error
+to-label = errors
+
+[output "audit"]
+type = test-recording
+match = audit.**
+
+[filter "strip"]
+type = fields
+label = errors
+remove = debug
+
+[output "pager"]
+type = test-recording
+label = errors
+match = app.**
+where = severity >= 3
+
+[output "ticket"]
+type = test-recording
+label = errors
+match = app.**
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defaultOutput := &recordingOutput{name: "default"}
+	pipeline, err := BuildPipeline(logger, sections, defaultOutput)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(pipeline.Outputs) != 3 {
+		t.Logf("%+v", pipeline.Outputs)
+		t.Fail()
+	}
+	record := func() TinyFluentRecord {
+		return TinyFluentRecord{Timestamp: 0, Data: map[string]interface{}{"debug": "x", "severity": int64(3)}}
+	}
+	err = pipeline.Head().Emit([]FluentRecordSet{
+		{Tag: "app.info", Records: []TinyFluentRecord{record()}},
+		{Tag: "app.error", Records: []TinyFluentRecord{record(), record(), {Timestamp: 0, Data: map[string]interface{}{"severity": int64(1)}}}},
+		{Tag: "audit.login", Records: []TinyFluentRecord{record()}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if tags := tagsOf(defaultOutput.recordSets); len(tags) != 1 || tags[0] != "app.info" {
+		t.Logf("%+v", tags)
+		t.Fail()
+	}
+	if tags := tagsOf(recordingOutputs["audit"].recordSets); len(tags) != 1 || tags[0] != "audit.login" {
+		t.Logf("%+v", tags)
+		t.Fail()
+	}
+	pager := recordingOutputs["pager"].recordSets
+	if tags := tagsOf(pager); len(tags) != 2 || tags[0] != "app.error" {
+		t.Logf("%+v", tags)
+		t.Fail()
+	}
+	if _, ok := pager[0].Records[0].Data["debug"]; ok {
+		t.Logf("%+v", pager)
+		t.Fail()
+	}
+	if tags := tagsOf(recordingOutputs["ticket"].recordSets); len(tags) != 1 || tags[0] != "app.error" {
+		t.Logf("%+v", tags)
+		t.Fail()
+	}
+	label, err := pipeline.Label("errors")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// discarded as no output matches
+	err = label.Emit([]FluentRecordSet{{Tag: "other", Records: []TinyFluentRecord{record()}}})
+	if err != nil || len(recordingOutputs["pager"].recordSets) != 1 {
+		t.Fail()
+	}
+	if _, err := pipeline.Label("missing"); err == nil {
+		t.Fail()
+	}
+}
+
+func Test_BuildPipeline_UndefinedLabel(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("pipeline")
+	sections, _ := ReadConfig("test.conf", []byte(`
+[filter "x"]
+type = relabel
+to-label = nowhere
+`))
+	if _, err := BuildPipeline(logger, sections, &recordingOutput{name: "default"}); err == nil {
+		t.Fail()
+	}
+}
+
+func Test_BuildPipeline_LabelCycle(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("pipeline")
+	for src, loop := range map[string]string{
+		// a label relabeling to itself
+		`
+[filter "x"]
+type = relabel
+label = a
+to-label = a
+
+[output "out"]
+type = test-recording
+label = a
+`: "label:a -> label:a",
+		// through another label
+		`
+[filter "to-a"]
+type = relabel
+to-label = a
+
+[filter "to-b"]
+type = relabel
+label = a
+to-label = b
+
+[filter "back"]
+type = copy
+label = b
+to-label = a
+
+[output "out"]
+type = test-recording
+label = b
+`: "label:a -> label:b -> label:a",
+		// the failures of a label sent back into it from the error label
+		`
+[filter "limit"]
+type = truncate
+label = a
+max-size = 40
+
+[output "out"]
+type = test-recording
+label = a
+
+[filter "retry"]
+type = relabel
+label = @ERROR
+to-label = a
+`: "label:@ERROR -> label:a -> label:@ERROR",
+	} {
+		sections, err := ReadConfig("test.conf", []byte(src))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_, err = BuildPipeline(logger, sections, &recordingOutput{name: "default"})
+		if err == nil || !strings.Contains(err.Error(), loop) {
+			t.Errorf("%s: %v", loop, err)
+		}
+		check := CheckConfig(logger, "test.conf", sections, true)
+		if check.OK() {
+			t.Errorf("%s: passed the check", loop)
+		}
+	}
+
+	// the labels sending the records on without coming back to themselves
+	sections, _ := ReadConfig("test.conf", []byte(`
+[filter "to-a"]
+type = relabel
+to-label = a
+
+[filter "to-b"]
+type = copy
+label = a
+to-label = b
+
+[output "a"]
+type = test-recording
+label = a
+
+[output "b"]
+type = test-recording
+label = b
+
+[filter "limit"]
+type = truncate
+label = @ERROR
+max-size = 40
+
+[output "errors"]
+type = test-recording
+label = @ERROR
+`))
+	if _, err := BuildPipeline(logger, sections, &recordingOutput{name: "default"}); err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func Test_ReloadablePipeline(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("pipeline")
+	read := func(src string) []*ConfigElement {
+		sections, err := ReadConfig("test.conf", []byte(src))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return sections
+	}
+	defaultOutput := &recordingOutput{name: "default"}
+	pipeline, err := NewReloadablePipeline(logger, read(`
+[output "kept"]
+type = test-recording
+match = a.**
+`), defaultOutput)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	kept := recordingOutputs["kept"]
+	head := pipeline.Head()
+	pipeline.Start()
+	emit := func(tag string) {
+		err := head.Emit([]FluentRecordSet{{Tag: tag, Records: []TinyFluentRecord{{Timestamp: 0, Data: map[string]interface{}{"debug": "x"}}}}})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	emit("b.x")
+
+	// the output is carried over while the routing changes
+	err = pipeline.Reload(read(`
+[filter "strip"]
+type = fields
+remove = debug
+
+[output "kept"]
+type = test-recording
+match = b.**
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if recordingOutputs["kept"] != kept {
+		t.Fail()
+	}
+	emit("b.x")
+	if len(kept.recordSets) != 1 || len(defaultOutput.recordSets) != 1 {
+		t.Logf("%+v %+v", kept.recordSets, defaultOutput.recordSets)
+		t.Fail()
+	}
+	if _, ok := kept.recordSets[0].Records[0].Data["debug"]; ok {
+		t.Fail()
+	}
+
+	// invalid configurations are rejected and the current one stays
+	for _, src := range []string{`
+[filter "x"]
+type = nonexistent
+`, `
+[filter "x"]
+type = relabel
+to-label = nowhere
+`} {
+		if err := pipeline.Reload(read(src)); err == nil {
+			t.Logf("%s", src)
+			t.Fail()
+		}
+	}
+	emit("b.y")
+	if len(kept.recordSets) != 2 {
+		t.Fail()
+	}
+
+	// the output whose settings have been changed is created again
+	err = pipeline.Reload(read(`
+[output "kept"]
+type = test-recording
+match = b.**
+extra = changed
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	replaced := recordingOutputs["kept"]
+	if replaced == kept || len(pipeline.Outputs()) != 1 || pipeline.Outputs()[0] != Output(replaced) {
+		t.Fail()
+	}
+	emit("b.z")
+	if len(kept.recordSets) != 2 || len(replaced.recordSets) != 1 {
+		t.Fail()
+	}
+}
+
+func Test_BuildPipeline_ErrorLabel(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("pipeline")
+	build := func(src string) *Pipeline {
+		sections, err := ReadConfig("test.conf", []byte(src))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		pipeline, err := BuildPipeline(logger, sections, &recordingOutput{name: "default"})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return pipeline
+	}
+	emit := func(pipeline *Pipeline) {
+		err := pipeline.Head().Emit([]FluentRecordSet{{Tag: "app", Records: []TinyFluentRecord{
+			{Timestamp: 0, Data: map[string]interface{}{"message": "short"}},
+			{Timestamp: 0, Data: map[string]interface{}{"message": "far too long to be forwarded"}},
+		}}})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	emit(build(`
+[filter "limit"]
+type = truncate
+max-size = 40
+
+[output "errors"]
+type = test-recording
+label = @ERROR
+`))
+	errors := recordingOutputs["errors"].recordSets
+	if tags := tagsOf(errors); len(tags) != 1 || tags[0] != "app" {
+		t.Logf("%+v", errors)
+		t.Fatal()
+	}
+	info, _ := errors[0].Records[0].Data[ErrorKey].(map[string]interface{})
+	if info["stage"] != "filter:limit" || info["message"] != "record exceeds 40 bytes" {
+		t.Logf("%+v", errors)
+		t.Fail()
+	}
+
+	// the failures in the error label are not sent back to it
+	emit(build(`
+[filter "limit"]
+type = truncate
+max-size = 40
+
+[filter "limit-errors"]
+type = truncate
+label = @ERROR
+max-size = 10
+
+[output "dropped-errors"]
+type = test-recording
+label = @ERROR
+`))
+	if tags := tagsOf(recordingOutputs["dropped-errors"].recordSets); len(tags) != 0 {
+		t.Logf("%+v", tags)
+		t.Fail()
+	}
+}
+
+func Test_DroppedRecords(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("pipeline")
+	unmatched := droppedRecords.With(DropUnmatched).Value()
+	dropped := droppedRecords.With(DropError).Value()
+
+	matcher, _ := NewRecordMatcher("app.**", []string{`level == "ERROR"`})
+	output := &recordingOutput{name: "errors-only"}
+	router := NewOutputRouter(logger, "label:default", []OutputRoute{{Matcher: matcher, Port: output}})
+	err := router.Emit([]FluentRecordSet{
+		{Tag: "app.web", Records: []TinyFluentRecord{
+			{Timestamp: 0, Data: map[string]interface{}{"level": "ERROR"}},
+			{Timestamp: 0, Data: map[string]interface{}{"level": "INFO"}},
+		}},
+		{Tag: "other", Records: []TinyFluentRecord{
+			{Timestamp: 0, Data: map[string]interface{}{"level": "ERROR"}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(tagsOf(output.recordSets)) != 1 || droppedRecords.With(DropUnmatched).Value()-unmatched != 2 {
+		t.Fail()
+	}
+
+	NewErrorPort(logger, nil).ReportAll("filter:test", []FluentRecordSet{{Tag: "app", Records: []TinyFluentRecord{
+		{Timestamp: 0, Data: map[string]interface{}{}},
+	}}}, errors.New("failed"))
+	if droppedRecords.With(DropError).Value()-dropped != 1 {
+		t.Fail()
+	}
+}
@@ -0,0 +1,287 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"plugin"
+	"sort"
+	"sync"
+)
+
+// Components are looked up by the "type" parameter of their configuration
+// section. Both the components compiled into the binary and the ones loaded
+// from Go plugins register themselves from their init() function:
+//
+//	func init() {
+//	    fluentd_forwarder.RegisterOutput("kafka", newKafkaOutput)
+//	}
+type InputFactory func(logger *logging.Logger, config *ConfigElement, port Port) (Worker, error)
+
+type OutputFactory func(logger *logging.Logger, config *ConfigElement) (Output, error)
+
+type FilterFactory func(logger *logging.Logger, config *ConfigElement, next Port) (Filter, error)
+
+type pluginRegistry struct {
+	mtx     sync.Mutex
+	inputs  map[string]InputFactory
+	outputs map[string]OutputFactory
+	filters map[string]FilterFactory
+	loaded  map[string]struct{}
+	// the parameters of the components by the kind and the name, for
+	// ConfigSchema
+	params map[string]map[string][]ParamSchema
+}
+
+var registry = &pluginRegistry{
+	mtx:     sync.Mutex{},
+	inputs:  make(map[string]InputFactory),
+	outputs: make(map[string]OutputFactory),
+	filters: make(map[string]FilterFactory),
+	loaded:  make(map[string]struct{}),
+	params: map[string]map[string][]ParamSchema{
+		"input":  make(map[string][]ParamSchema),
+		"output": make(map[string][]ParamSchema),
+		"filter": make(map[string][]ParamSchema),
+	},
+}
+
+func RegisterInput(name string, factory InputFactory) {
+	registry.mtx.Lock()
+	defer registry.mtx.Unlock()
+	if _, exists := registry.inputs[name]; exists {
+		panic(fmt.Sprintf("input type %s is registered twice", name))
+	}
+	registry.inputs[name] = factory
+}
+
+func RegisterOutput(name string, factory OutputFactory) {
+	registry.mtx.Lock()
+	defer registry.mtx.Unlock()
+	if _, exists := registry.outputs[name]; exists {
+		panic(fmt.Sprintf("output type %s is registered twice", name))
+	}
+	registry.outputs[name] = factory
+}
+
+func RegisterFilter(name string, factory FilterFactory) {
+	registry.mtx.Lock()
+	defer registry.mtx.Unlock()
+	if _, exists := registry.filters[name]; exists {
+		panic(fmt.Sprintf("filter type %s is registered twice", name))
+	}
+	registry.filters[name] = factory
+}
+
+func (registry *pluginRegistry) registerParams(kind string, name string, params []ParamSchema) {
+	registry.mtx.Lock()
+	defer registry.mtx.Unlock()
+	if _, exists := registry.params[kind][name]; exists {
+		panic(fmt.Sprintf("the parameters of %s type %s are registered twice", kind, name))
+	}
+	registry.params[kind][name] = params
+}
+
+// RegisterInputParams, RegisterOutputParams and RegisterFilterParams
+// describe the parameters a component takes, by which ConfigSchema
+// validates its sections.  The parameters of a component registered without
+// them are not validated.
+func RegisterInputParams(name string, params ...ParamSchema) {
+	registry.registerParams("input", name, params)
+}
+
+func RegisterOutputParams(name string, params ...ParamSchema) {
+	registry.registerParams("output", name, params)
+}
+
+func RegisterFilterParams(name string, params ...ParamSchema) {
+	registry.registerParams("filter", name, params)
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	retval := make([]string, 0, len(m))
+	for k := range m {
+		retval = append(retval, k)
+	}
+	sort.Strings(retval)
+	return retval
+}
+
+// RegisteredPlugins returns the names of the registered components by kind
+// ("input", "output" and "filter").
+func RegisteredPlugins() map[string][]string {
+	registry.mtx.Lock()
+	defer registry.mtx.Unlock()
+	inputs := make(map[string]struct{})
+	for k := range registry.inputs {
+		inputs[k] = struct{}{}
+	}
+	outputs := make(map[string]struct{})
+	for k := range registry.outputs {
+		outputs[k] = struct{}{}
+	}
+	filters := make(map[string]struct{})
+	for k := range registry.filters {
+		filters[k] = struct{}{}
+	}
+	return map[string][]string{
+		"input":  sortedKeys(inputs),
+		"output": sortedKeys(outputs),
+		"filter": sortedKeys(filters),
+	}
+}
+
+func HasOutput(name string) bool {
+	registry.mtx.Lock()
+	defer registry.mtx.Unlock()
+	_, ok := registry.outputs[name]
+	return ok
+}
+
+func pluginType(config *ConfigElement) (string, error) {
+	typ := config.Get("type", "")
+	if typ == "" {
+		return "", errors.New(fmt.Sprintf("%s: type is not specified", config.String()))
+	}
+	return typ, nil
+}
+
+func NewInput(logger *logging.Logger, config *ConfigElement, port Port) (Worker, error) {
+	typ, err := pluginType(config)
+	if err != nil {
+		return nil, err
+	}
+	registry.mtx.Lock()
+	factory, ok := registry.inputs[typ]
+	registry.mtx.Unlock()
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%s: unknown input type: %s", config.String(), typ))
+	}
+	return factory(logger, config, port)
+}
+
+func NewOutput(logger *logging.Logger, config *ConfigElement) (Output, error) {
+	typ, err := pluginType(config)
+	if err != nil {
+		return nil, err
+	}
+	registry.mtx.Lock()
+	factory, ok := registry.outputs[typ]
+	registry.mtx.Unlock()
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%s: unknown output type: %s", config.String(), typ))
+	}
+	return factory(logger, config)
+}
+
+func NewFilter(logger *logging.Logger, config *ConfigElement, next Port) (Filter, error) {
+	typ, err := pluginType(config)
+	if err != nil {
+		return nil, err
+	}
+	registry.mtx.Lock()
+	factory, ok := registry.filters[typ]
+	registry.mtx.Unlock()
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%s: unknown filter type: %s", config.String(), typ))
+	}
+	return factory(logger, config, next)
+}
+
+// LoadPlugin opens a Go plugin (built with -buildmode=plugin), which in turn
+// registers its components from its init() function.
+func LoadPlugin(logger *logging.Logger, path string) error {
+	registry.mtx.Lock()
+	_, loaded := registry.loaded[path]
+	registry.mtx.Unlock()
+	if loaded {
+		return nil
+	}
+	_, err := plugin.Open(path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to load plugin %s: %s", path, err.Error()))
+	}
+	registry.mtx.Lock()
+	registry.loaded[path] = struct{}{}
+	registry.mtx.Unlock()
+	logger.Infof("Loaded plugin %s", path)
+	return nil
+}
+
+// DefaultForwardListenOn is the address the forward inputs listen on unless
+// listen-on is given.
+const DefaultForwardListenOn = "127.0.0.1:24224"
+
+func newForwardInputFromConfig(logger *logging.Logger, config *ConfigElement, port Port) (Worker, error) {
+	protocol := config.Get("protocol", ForwardProtocolAuto)
+	err := CheckForwardProtocol(protocol)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", config.String(), err.Error()))
+	}
+	coalesceInterval, err := config.GetDuration("coalesce-interval", 0)
+	if err != nil {
+		return nil, err
+	}
+	coalesceSize, err := config.GetInt64("coalesce-size", DefaultCoalesceSize)
+	if err != nil {
+		return nil, err
+	}
+	if coalesceSize <= 0 {
+		return nil, errors.New(fmt.Sprintf("%s: coalesce-size must be positive", config.String()))
+	}
+	socketOptions, err := socketOptionsFromConfig(config, DefaultSocketOptions)
+	if err != nil {
+		return nil, err
+	}
+	maxMessageSize, err := config.GetInt("max-message-size", DefaultMaxMessageSize)
+	if err != nil {
+		return nil, err
+	}
+	if maxMessageSize < 0 {
+		return nil, errors.New(fmt.Sprintf("%s: max-message-size may not be negative", config.String()))
+	}
+	input, err := NewForwardInput(logger, config.Get("listen-on", DefaultForwardListenOn), port)
+	if err != nil {
+		return nil, err
+	}
+	input.SetProtocol(protocol)
+	input.SetSocketOptions(socketOptions)
+	input.SetMaxMessageSize(maxMessageSize)
+	if coalesceInterval > 0 {
+		input.SetCoalescing(coalesceInterval, coalesceSize)
+	}
+	return input, nil
+}
+
+func init() {
+	RegisterInput("forward", newForwardInputFromConfig)
+	RegisterInputParams("forward",
+		ParamSchema{Name: "listen-on", Type: ParamString, Description: "address to listen on", Default: DefaultForwardListenOn},
+		ParamSchema{Name: "protocol", Type: ParamString, Description: "protocol in which the messages are taken", Default: ForwardProtocolAuto, Enum: []string{ForwardProtocolAuto, ForwardProtocolMsgpack, ForwardProtocolJSON}},
+		ParamSchema{Name: "coalesce-interval", Type: ParamDuration, Description: "time for which the record sets received are coalesced into a batch. not coalesced if 0", Default: "0"},
+		ParamSchema{Name: "coalesce-size", Type: ParamInteger, Description: "size in bytes of the record sets in a batch, at which the batch is passed on", Default: "1048576"},
+		ParamSchema{Name: "max-message-size", Type: ParamInteger, Description: "size in bytes of a message in msgpack taken at most, beyond which the connection is closed; unlimited if 0", Default: "33554432"},
+		ParamSchema{Name: "read-buffer-size", Type: ParamInteger, Description: "size in bytes of the buffer through which a connection is read", Default: "65536"},
+		ParamSchema{Name: "socket-receive-buffer", Type: ParamInteger, Description: "SO_RCVBUF of the connections in bytes; the one of the system if 0", Default: "0"},
+		ParamSchema{Name: "socket-send-buffer", Type: ParamInteger, Description: "SO_SNDBUF of the connections in bytes; the one of the system if 0", Default: "0"},
+		ParamSchema{Name: "tcp-nodelay", Type: ParamBoolean, Description: "whether TCP_NODELAY is set to the connections", Default: "true"},
+	)
+}
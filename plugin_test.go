@@ -0,0 +1,132 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"fmt"
+	logging "github.com/op/go-logging"
+	"strings"
+	"testing"
+)
+
+func Test_Register_Twice(t *testing.T) {
+	for kind, register := range map[string]func(){
+		"input": func() {
+			RegisterInput("forward", newForwardInputFromConfig)
+		},
+		"output": func() {
+			RegisterOutput("test-recording", func(logger *logging.Logger, config *ConfigElement) (Output, error) {
+				return nil, nil
+			})
+		},
+		"filter": func() {
+			RegisterFilter("concat", newConcatFilterFromConfig)
+		},
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), kind+" type") || !strings.Contains(fmt.Sprint(r), "registered twice") {
+					t.Errorf("%s: %v", kind, r)
+				}
+			}()
+			register()
+		}()
+	}
+	// the first one is kept
+	if !HasOutput("test-recording") {
+		t.Fail()
+	}
+	if _, err := NewOutput(logging.MustGetLogger("plugin"), testSection("output", "test-recording")); err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func testSection(name string, typ string) *ConfigElement {
+	section := NewConfigElement(name, "test")
+	if typ != "" {
+		section.Set("type", typ)
+	}
+	return section
+}
+
+func Test_NewPlugin_UnknownType(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("plugin")
+	for _, typ := range []string{"", "nonexistent"} {
+		message := "unknown"
+		if typ == "" {
+			message = "type is not specified"
+		}
+		if _, err := NewInput(logger, testSection("input", typ), nil); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("input %q: %v", typ, err)
+		}
+		if _, err := NewOutput(logger, testSection("output", typ)); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("output %q: %v", typ, err)
+		}
+		if _, err := NewFilter(logger, testSection("filter", typ), nil); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("filter %q: %v", typ, err)
+		}
+	}
+	plugins := RegisteredPlugins()
+	for kind, name := range map[string]string{"input": "forward", "output": "forward", "filter": "concat"} {
+		found := false
+		for _, name_ := range plugins[kind] {
+			found = found || name_ == name
+		}
+		if !found {
+			t.Errorf("%s %s: %+v", kind, name, plugins[kind])
+		}
+	}
+}
+
+// Test_NewPlugin_RequiredParams makes every component refuse a section
+// lacking the parameters it registered as required.
+func Test_NewPlugin_RequiredParams(t *testing.T) {
+	logging.InitForTesting(logging.CRITICAL)
+	logger := logging.MustGetLogger("plugin")
+	n := 0
+	for kind, params := range registry.params {
+		for typ, params_ := range params {
+			required := false
+			for _, param := range params_ {
+				required = required || param.Required
+			}
+			if !required {
+				continue
+			}
+			n += 1
+			section := testSection(kind, typ)
+			err := (error)(nil)
+			switch kind {
+			case "input":
+				_, err = NewInput(logger, section, nil)
+			case "output":
+				_, err = NewOutput(logger, section)
+			case "filter":
+				_, err = NewFilter(logger, section, nil)
+			}
+			if err == nil {
+				t.Errorf("%s %s took a section without the required parameters", kind, typ)
+			}
+		}
+	}
+	if n == 0 {
+		t.Fail()
+	}
+}
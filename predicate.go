@@ -0,0 +1,255 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// FieldPredicate is a condition on a field of the record, written as
+// "FIELD OP VALUE" where OP is one of ==, !=, =~, !~, <, <=, > and >=, or as
+// "exists FIELD" / "!exists FIELD".  FIELD is a record accessor, in which
+// dots separate the keys even without "$".  VALUE is a number, a
+// double-quoted string, or a regexp enclosed in slashes for =~ and !~;
+// anything else is taken as a string.
+type FieldPredicate struct {
+	expr  string
+	field *RecordAccessor
+	op    string
+	str   string
+	num   float64
+	isNum bool
+	re    *regexp.Regexp
+}
+
+var predicateOperators = []string{"==", "!=", "=~", "!~", "<=", ">=", "<", ">"}
+
+// fieldEnd returns the index of the first character that cannot be a part
+// of the field, which may appear in the quoted keys of a record accessor.
+func fieldEnd(s string) int {
+	quote := byte(0)
+	for i := 0; i < len(s); i += 1 {
+		c := s[i]
+		switch {
+		case quote != 0 && c == '\\':
+			i += 1
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case strings.IndexByte(" =!<>~", c) >= 0:
+			return i
+		}
+	}
+	return len(s)
+}
+
+func ParseFieldPredicate(expr string) (*FieldPredicate, error) {
+	trimmed := strings.TrimSpace(expr)
+	for _, op := range []string{"exists", "!exists"} {
+		if strings.HasPrefix(trimmed, op+" ") {
+			field := strings.TrimSpace(trimmed[len(op):])
+			if field == "" || fieldEnd(field) != len(field) {
+				break
+			}
+			accessor, err := NewDottedRecordAccessor(field)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid predicate: %s: %s", expr, err.Error()))
+			}
+			return &FieldPredicate{expr: expr, field: accessor, op: op}, nil
+		}
+	}
+	i := fieldEnd(trimmed)
+	if i <= 0 || i == len(trimmed) {
+		return nil, errors.New(fmt.Sprintf("invalid predicate: %s", expr))
+	}
+	accessor, err := NewDottedRecordAccessor(trimmed[:i])
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid predicate: %s: %s", expr, err.Error()))
+	}
+	predicate := &FieldPredicate{expr: expr, field: accessor}
+	rest := strings.TrimLeft(trimmed[i:], " ")
+	for _, op := range predicateOperators {
+		if strings.HasPrefix(rest, op) {
+			predicate.op = op
+			rest = strings.TrimSpace(rest[len(op):])
+			break
+		}
+	}
+	if predicate.op == "" || rest == "" {
+		return nil, errors.New(fmt.Sprintf("invalid predicate: %s", expr))
+	}
+	switch predicate.op {
+	case "=~", "!~":
+		pattern := rest
+		if len(rest) >= 2 && rest[0] == '/' && rest[len(rest)-1] == '/' {
+			pattern = rest[1 : len(rest)-1]
+		} else if s, err := strconv.Unquote(rest); err == nil {
+			pattern = s
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid predicate: %s: %s", expr, err.Error()))
+		}
+		predicate.re = re
+	default:
+		if s, err := strconv.Unquote(rest); err == nil && rest[0] == '"' {
+			predicate.str = s
+		} else if f, err := strconv.ParseFloat(rest, 64); err == nil {
+			predicate.str = rest
+			predicate.num = f
+			predicate.isNum = true
+		} else {
+			predicate.str = rest
+		}
+		switch predicate.op {
+		case "<", "<=", ">", ">=":
+			if !predicate.isNum {
+				return nil, errors.New(fmt.Sprintf("invalid predicate: %s: %s requires a number", expr, predicate.op))
+			}
+		}
+	}
+	return predicate, nil
+}
+
+func (predicate *FieldPredicate) equals(v interface{}) bool {
+	if predicate.isNum {
+		if f, ok := toFloat64(v); ok {
+			return f == predicate.num
+		}
+	}
+	switch v.(type) {
+	case string, []byte:
+		return groupValueString(v) == predicate.str
+	case nil, map[string]interface{}, []interface{}:
+		return false
+	}
+	return fmt.Sprint(v) == predicate.str
+}
+
+func (predicate *FieldPredicate) Match(data map[string]interface{}) bool {
+	v, ok := predicate.field.Get(data)
+	switch predicate.op {
+	case "exists":
+		return ok
+	case "!exists":
+		return !ok
+	case "==":
+		return ok && predicate.equals(v)
+	case "!=":
+		return !ok || !predicate.equals(v)
+	case "=~", "!~":
+		matched := false
+		switch v.(type) {
+		case string, []byte:
+			matched = predicate.re.MatchString(groupValueString(v))
+		}
+		return matched == (predicate.op == "=~")
+	}
+	f, isNum := toFloat64(v)
+	if !ok || !isNum {
+		return false
+	}
+	switch predicate.op {
+	case "<":
+		return f < predicate.num
+	case "<=":
+		return f <= predicate.num
+	case ">":
+		return f > predicate.num
+	case ">=":
+		return f >= predicate.num
+	}
+	return false
+}
+
+func (predicate *FieldPredicate) String() string {
+	return predicate.expr
+}
+
+// RecordMatcher selects the records by the tag and, optionally, by the
+// predicates on the fields, all of which have to hold.
+type RecordMatcher struct {
+	tag        *TagMatcher
+	predicates []*FieldPredicate
+}
+
+func (matcher *RecordMatcher) MatchTag(tag string) bool {
+	return matcher.tag == nil || matcher.tag.Match(tag)
+}
+
+func (matcher *RecordMatcher) HasPredicates() bool {
+	return len(matcher.predicates) > 0
+}
+
+// MatchRecord checks the predicates; the tag is supposed to be checked by
+// MatchTag beforehand.
+func (matcher *RecordMatcher) MatchRecord(data map[string]interface{}) bool {
+	for _, predicate := range matcher.predicates {
+		if !predicate.Match(data) {
+			return false
+		}
+	}
+	return true
+}
+
+func (matcher *RecordMatcher) String() string {
+	retval := "**"
+	if matcher.tag != nil {
+		retval = matcher.tag.String()
+	}
+	for _, predicate := range matcher.predicates {
+		retval += " where " + predicate.String()
+	}
+	return retval
+}
+
+func NewRecordMatcher(pattern string, predicates []string) (*RecordMatcher, error) {
+	tag, err := NewTagMatcher(pattern)
+	if err != nil {
+		return nil, err
+	}
+	matcher := &RecordMatcher{
+		tag:        tag,
+		predicates: make([]*FieldPredicate, 0, len(predicates)),
+	}
+	for _, expr := range predicates {
+		predicate, err := ParseFieldPredicate(expr)
+		if err != nil {
+			return nil, err
+		}
+		matcher.predicates = append(matcher.predicates, predicate)
+	}
+	return matcher, nil
+}
+
+// newRecordMatcherFromConfig reads the "match" and "where" parameters.
+func newRecordMatcherFromConfig(config *ConfigElement) (*RecordMatcher, error) {
+	matcher, err := NewRecordMatcher(config.Get("match", "**"), config.GetAll("where"))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", config.String(), err.Error()))
+	}
+	return matcher, nil
+}
@@ -0,0 +1,116 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"testing"
+)
+
+func Test_FieldPredicate(t *testing.T) {
+	data := map[string]interface{}{
+		"level":   []byte("ERROR"),
+		"status":  int64(503),
+		"latency": "0.25",
+		"http":    map[string]interface{}{"method": "GET"},
+		"empty":   nil,
+		"a.b":     "dotted",
+	}
+	cases := []struct {
+		expr     string
+		expected bool
+	}{
+		{`level == "ERROR"`, true},
+		{`level == ERROR`, true},
+		{`level==WARN`, false},
+		{`level != "WARN"`, true},
+		{`missing != "WARN"`, true},
+		{`status == 503`, true},
+		{`status >= 500`, true},
+		{`status < 500`, false},
+		{`latency > 0.1`, true},
+		{`level > 1`, false},
+		{`http.method =~ /^(GET|HEAD)$/`, true},
+		{`http.method !~ "^GET"`, false},
+		{`status =~ /5/`, false},
+		{`exists http.method`, true},
+		{`exists empty`, true},
+		{`!exists missing`, true},
+		{`!exists level`, false},
+		{`$.http.method == GET`, true},
+		{`$['a.b'] == dotted`, true},
+		{`$["http"]['method']!=GET`, false},
+		{`exists $['a.b']`, true},
+		{`exists a.b`, false},
+	}
+	for _, c := range cases {
+		predicate, err := ParseFieldPredicate(c.expr)
+		if err != nil {
+			t.Logf("%s: %s", c.expr, err.Error())
+			t.Fail()
+			continue
+		}
+		if predicate.Match(data) != c.expected {
+			t.Logf("%s", c.expr)
+			t.Fail()
+		}
+	}
+	for _, expr := range []string{"level", "== 1", "status > high", "level =~ /(/", "exists "} {
+		if _, err := ParseFieldPredicate(expr); err == nil {
+			t.Logf("%s", expr)
+			t.Fail()
+		}
+	}
+}
+
+func Test_FilterPort_Predicates(t *testing.T) {
+	matcher, err := NewRecordMatcher("app.**", []string{`level == "ERROR"`})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	next := &recordingPort{}
+	port := NewFilterPort(NewFieldsFilter(nil, "test", nil, mustRecordAccessors("debug")), matcher, next, nil)
+	record := func(level string) TinyFluentRecord {
+		return TinyFluentRecord{Timestamp: 0, Data: map[string]interface{}{"level": level, "debug": "x"}}
+	}
+	err = port.Emit([]FluentRecordSet{
+		{Tag: "app.a", Records: []TinyFluentRecord{record("INFO"), record("ERROR"), record("INFO")}},
+		{Tag: "other", Records: []TinyFluentRecord{record("ERROR")}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := []struct {
+		tag   string
+		debug bool
+	}{{"app.a", true}, {"app.a", false}, {"app.a", true}, {"other", true}}
+	i := 0
+	for _, recordSet := range next.recordSets {
+		for _, record := range recordSet.Records {
+			_, debug := record.Data["debug"]
+			if i >= len(expected) || recordSet.Tag != expected[i].tag || debug != expected[i].debug {
+				t.Logf("%d: %+v", i, next.recordSets)
+				t.Fail()
+			}
+			i += 1
+		}
+	}
+	if i != len(expected) {
+		t.Fail()
+	}
+}
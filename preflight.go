@@ -0,0 +1,152 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The file descriptors taken besides those of the listeners and the
+// outputs, such as the standard streams, the log files and the poller.
+const preflightBaseFileDescriptors = 32
+
+// The file descriptors that should be left for the connections to the
+// inputs, which take one each.
+const preflightConnectionHeadroom = 1024
+
+// The free space of a directory of the buffers is warned about unless it
+// has room for this many chunks of each output buffered in it.
+const preflightBufferChunks = 10
+
+// SystemRequirements are the file descriptors and the disk space the
+// forwarder is estimated to need, checked against the limits of the system
+// before it starts.
+type SystemRequirements struct {
+	// without the connections to the inputs
+	FileDescriptors int
+	// the bytes of a chunk of each of the outputs buffered in the
+	// directory
+	BufferSpace map[string]int64
+}
+
+// AddListener counts a listening socket.
+func (requirements *SystemRequirements) AddListener() {
+	requirements.FileDescriptors += 1
+}
+
+// AddOutput counts an output of the type buffering in the path: the chunk
+// being written, the ones being read and the connections; as many of the
+// latter two as the parallelism for the td outputs, and one each for the
+// others.  The td outputs write a chunk for each table, only one of which
+// is counted.
+func (requirements *SystemRequirements) AddOutput(typ string, bufferPath string, chunkLimit int64, parallelism int) {
+	if typ != "td" || parallelism < 1 {
+		parallelism = 1
+	}
+	requirements.FileDescriptors += 1 + 2*parallelism
+	if bufferPath == "" {
+		return
+	}
+	if i := strings.Index(bufferPath, "*"); i >= 0 {
+		bufferPath = bufferPath[:i]
+	}
+	requirements.BufferSpace[filepath.Dir(bufferPath)] += chunkLimit
+}
+
+// EstimateSystemRequirements estimates what the inputs and the outputs of
+// the sections need.
+func EstimateSystemRequirements(sections []*ConfigElement) *SystemRequirements {
+	requirements := &SystemRequirements{
+		FileDescriptors: preflightBaseFileDescriptors,
+		BufferSpace:     make(map[string]int64),
+	}
+	for _, section := range sections {
+		switch section.Name {
+		case "input":
+			if _, ok := InputListenAddress(section); ok {
+				requirements.AddListener()
+			}
+		case "output":
+			chunkLimit, err := section.GetInt64("buffer-chunk-limit", 16777216)
+			if err != nil {
+				continue
+			}
+			parallelism, err := section.GetInt("parallelism", 1)
+			if err != nil {
+				continue
+			}
+			requirements.AddOutput(section.Get("type", ""), section.Get("buffer-path", ""), chunkLimit, parallelism)
+		}
+	}
+	return requirements
+}
+
+// nearestDirectory returns the path or its nearest ancestor that exists,
+// as the directories of the buffers are created on demand.
+func nearestDirectory(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+// CheckSystemLimits checks the limit of the file descriptors and the free
+// space of the directories of the buffers against the requirements.  The
+// limits the platform doesn't tell are not checked.
+func CheckSystemLimits(requirements *SystemRequirements) *ConfigCheck {
+	check := &ConfigCheck{Errors: make([]string, 0), Warnings: make([]string, 0)}
+	limit, err := fileDescriptorLimit()
+	if err == nil {
+		left := int64(limit) - int64(requirements.FileDescriptors)
+		switch {
+		case left <= 0:
+			check.errorf(nil, "the limit of the open files (RLIMIT_NOFILE) is %d, whereas the listeners and the buffers of the outputs may take %d; raise it with ulimit -n, or LimitNOFILE= of the systemd unit", limit, requirements.FileDescriptors)
+		case left < preflightConnectionHeadroom:
+			check.warnf(nil, "the limit of the open files (RLIMIT_NOFILE) is %d, which leaves only %d for the connections to the inputs after the listeners and the buffers of the outputs; raise it with ulimit -n, or LimitNOFILE= of the systemd unit", limit, left)
+		}
+	}
+	dirs := make([]string, 0, len(requirements.BufferSpace))
+	for dir := range requirements.BufferSpace {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		needed := requirements.BufferSpace[dir]
+		free, err := freeDiskSpace(nearestDirectory(dir))
+		if err != nil || needed <= 0 {
+			continue
+		}
+		switch {
+		case free < uint64(needed):
+			check.errorf(nil, "%s has %d bytes free, less than a chunk of each output buffered in it (%d bytes); free up the disk or move the buffers", dir, free, needed)
+		case free < uint64(needed)*preflightBufferChunks:
+			check.warnf(nil, "%s has %d bytes free, in which the outputs can buffer only %d chunks each; the events are lost once it is full", dir, free, free/uint64(needed))
+		}
+	}
+	return check
+}
@@ -0,0 +1,84 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_EstimateSystemRequirements(t *testing.T) {
+	sections, err := ReadConfig("test.conf", []byte(`
+[input "a"]
+type = forward
+listen-on = 127.0.0.1:24230
+
+[output "forward"]
+type = forward
+buffer-path = /var/lib/a/forward
+buffer-chunk-limit = 1048576
+
+[output "td"]
+type = td
+buffer-path = /var/lib/a/td.*
+buffer-chunk-limit = 2097152
+parallelism = 4
+
+[output "other"]
+type = stdout
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	requirements := EstimateSystemRequirements(sections)
+	// a listener, 3 for the forward output, 9 for the td one and 3 for the
+	// other
+	if requirements.FileDescriptors != preflightBaseFileDescriptors+1+3+9+3 {
+		t.Errorf("%d", requirements.FileDescriptors)
+	}
+	if len(requirements.BufferSpace) != 1 || requirements.BufferSpace["/var/lib/a"] != 3145728 {
+		t.Errorf("%+v", requirements.BufferSpace)
+	}
+}
+
+func Test_CheckSystemLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "preflight")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	requirements := &SystemRequirements{
+		FileDescriptors: preflightBaseFileDescriptors,
+		// the directories are created on demand
+		BufferSpace: map[string]int64{filepath.Join(dir, "not", "yet"): 1},
+	}
+	check := CheckSystemLimits(requirements)
+	if !check.OK() {
+		t.Errorf("%+v", check)
+	}
+	requirements.FileDescriptors = 1 << 40
+	requirements.BufferSpace[dir] = 1 << 62
+	check = CheckSystemLimits(requirements)
+	if len(check.Errors) != 2 || !strings.Contains(check.Errors[0], "RLIMIT_NOFILE") || !strings.Contains(check.Errors[1], dir) {
+		t.Errorf("%+v", check)
+	}
+}
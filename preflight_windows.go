@@ -0,0 +1,33 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+)
+
+// Windows has no limit of the handles to check, and the free space is not
+// checked on it.
+func fileDescriptorLimit() (uint64, error) {
+	return 0, errors.New("not supported on Windows")
+}
+
+func freeDiskSpace(path string) (uint64, error) {
+	return 0, errors.New("not supported on Windows")
+}
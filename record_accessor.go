@@ -0,0 +1,172 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RecordAccessor designates a field of the records, which may be nested in
+// maps and arrays.  It is written either as a plain key of the top-level
+// map, or in the form of "$.kubernetes.labels.app" or
+// "$['kubernetes']['labels']['app']", where the bracket notation allows the
+// keys containing dots and the notations may be mixed.  An element of an
+// array is designated by its index, as in "$.items[0].name" or
+// "$.items.0.name".
+type RecordAccessor struct {
+	expr string
+	path []string
+}
+
+func (accessor *RecordAccessor) Get(data map[string]interface{}) (interface{}, bool) {
+	return lookupPath(data, accessor.path)
+}
+
+// Set stores the value, creating the intermediate maps as needed.  It fails
+// if a value on the way is not a map.
+func (accessor *RecordAccessor) Set(data map[string]interface{}, value interface{}) bool {
+	return setPath(data, accessor.path, value)
+}
+
+func (accessor *RecordAccessor) Delete(data map[string]interface{}) (interface{}, bool) {
+	return deletePath(data, accessor.path)
+}
+
+// Name returns the keys joined with dots, for naming the values derived
+// from the field.
+func (accessor *RecordAccessor) Name() string {
+	return strings.Join(accessor.path, ".")
+}
+
+func (accessor *RecordAccessor) String() string {
+	return accessor.expr
+}
+
+func parseAccessorPath(expr string) ([]string, error) {
+	path := make([]string, 0)
+	rest := expr[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			i := strings.IndexAny(rest[1:], ".[")
+			if i < 0 {
+				i = len(rest) - 1
+			}
+			if i == 0 {
+				return nil, errors.New(fmt.Sprintf("empty key in %s", expr))
+			}
+			path = append(path, rest[1:i+1])
+			rest = rest[i+1:]
+		case '[':
+			if len(rest) >= 2 && rest[1] >= '0' && rest[1] <= '9' {
+				i := strings.IndexByte(rest, ']')
+				if i < 0 {
+					return nil, errors.New(fmt.Sprintf("unterminated bracket in %s", expr))
+				}
+				if _, err := strconv.Atoi(rest[1:i]); err != nil {
+					return nil, errors.New(fmt.Sprintf("invalid index %s in %s", rest[1:i], expr))
+				}
+				path = append(path, rest[1:i])
+				rest = rest[i+1:]
+				continue
+			}
+			if len(rest) < 2 || (rest[1] != '\'' && rest[1] != '"') {
+				return nil, errors.New(fmt.Sprintf("a quoted key or an index is expected after [ in %s", expr))
+			}
+			quote := rest[1]
+			key := make([]byte, 0)
+			i := 2
+			for ; i < len(rest) && rest[i] != quote; i += 1 {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i += 1
+				}
+				key = append(key, rest[i])
+			}
+			if i+1 >= len(rest) || rest[i+1] != ']' {
+				return nil, errors.New(fmt.Sprintf("unterminated bracket in %s", expr))
+			}
+			path = append(path, string(key))
+			rest = rest[i+2:]
+		default:
+			return nil, errors.New(fmt.Sprintf(". or [ is expected at %s in %s", rest, expr))
+		}
+	}
+	if len(path) == 0 {
+		return nil, errors.New(fmt.Sprintf("no key in %s", expr))
+	}
+	return path, nil
+}
+
+// NewRecordAccessor parses the expression; one not starting with "$" is
+// taken as a key of the top-level map as is.
+func NewRecordAccessor(expr string) (*RecordAccessor, error) {
+	if !strings.HasPrefix(expr, "$") {
+		if expr == "" {
+			return nil, errors.New("empty field name")
+		}
+		return &RecordAccessor{expr: expr, path: []string{expr}}, nil
+	}
+	path, err := parseAccessorPath(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &RecordAccessor{expr: expr, path: path}, nil
+}
+
+// NewDottedRecordAccessor is like NewRecordAccessor except that dots in a
+// plain expression separate the keys, as in the predicates and the
+// templates written before the "$" notation was introduced; "\." stands
+// for a dot in a key.
+func NewDottedRecordAccessor(expr string) (*RecordAccessor, error) {
+	if !strings.HasPrefix(expr, "$") {
+		path := splitPath(expr)
+		for _, key := range path {
+			if key == "" {
+				return nil, errors.New(fmt.Sprintf("empty key in %s", expr))
+			}
+		}
+		return &RecordAccessor{expr: expr, path: path}, nil
+	}
+	return NewRecordAccessor(expr)
+}
+
+// recordAccessorFromConfig reads a field parameter.
+func recordAccessorFromConfig(config *ConfigElement, key string, defaultValue string) (*RecordAccessor, error) {
+	accessor, err := NewRecordAccessor(config.Get(key, defaultValue))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s: %s", config.String(), key, err.Error()))
+	}
+	return accessor, nil
+}
+
+// recordAccessorsFromConfig reads a comma-separated list of fields.
+func recordAccessorsFromConfig(config *ConfigElement, key string) ([]*RecordAccessor, error) {
+	retval := make([]*RecordAccessor, 0)
+	for _, expr := range config.GetList(key) {
+		accessor, err := NewRecordAccessor(expr)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s: %s", config.String(), key, err.Error()))
+		}
+		retval = append(retval, accessor)
+	}
+	return retval, nil
+}
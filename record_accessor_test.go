@@ -0,0 +1,87 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"reflect"
+	"testing"
+)
+
+func mustRecordAccessor(expr string) *RecordAccessor {
+	accessor, err := NewRecordAccessor(expr)
+	if err != nil {
+		panic(err.Error())
+	}
+	return accessor
+}
+
+func mustRecordAccessors(exprs ...string) []*RecordAccessor {
+	retval := make([]*RecordAccessor, 0, len(exprs))
+	for _, expr := range exprs {
+		retval = append(retval, mustRecordAccessor(expr))
+	}
+	return retval
+}
+
+func Test_RecordAccessor(t *testing.T) {
+	cases := []struct {
+		expr   string
+		dotted bool
+		path   []string
+	}{
+		{"message", false, []string{"message"}},
+		{"a.b", false, []string{"a.b"}},
+		{"a.b", true, []string{"a", "b"}},
+		{"$.kubernetes.labels.app", false, []string{"kubernetes", "labels", "app"}},
+		{"$['kubernetes']['labels']", false, []string{"kubernetes", "labels"}},
+		{`$["a.b"].c['d\'e']`, true, []string{"a.b", "c", "d'e"}},
+	}
+	for _, c := range cases {
+		accessor, err := NewRecordAccessor(c.expr)
+		if c.dotted {
+			accessor, err = NewDottedRecordAccessor(c.expr)
+		}
+		if err != nil || !reflect.DeepEqual(accessor.path, c.path) {
+			t.Logf("%s: %+v %v", c.expr, accessor, err)
+			t.Fail()
+		}
+	}
+	for _, expr := range []string{"", "$", "$.", "$.a..b", "$a", "$['a'", "$[a]", "a..b"} {
+		if _, err := NewDottedRecordAccessor(expr); err == nil {
+			t.Logf("%s", expr)
+			t.Fail()
+		}
+	}
+
+	data := map[string]interface{}{"a.b": int64(1)}
+	accessor := mustRecordAccessor("$.x['a.b']")
+	if !accessor.Set(data, "v") || data["x"].(map[string]interface{})["a.b"] != "v" {
+		t.Logf("%+v", data)
+		t.Fail()
+	}
+	if v, ok := accessor.Get(data); !ok || v != "v" || accessor.Name() != "x.a.b" {
+		t.Fail()
+	}
+	if _, ok := accessor.Delete(data); !ok || len(data["x"].(map[string]interface{})) != 0 {
+		t.Fail()
+	}
+	if mustRecordAccessor("$['a.b']['c']").Set(data, 0) {
+		t.Fail()
+	}
+}
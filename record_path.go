@@ -0,0 +1,199 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"strconv"
+	"strings"
+)
+
+// A path designates a value in nested maps and arrays by the keys leading
+// to it, of which the ones in an array are the indices of the elements
+// starting from 0.
+
+// splitPath splits a dot-separated path into the keys, where "\." stands
+// for a dot in a key and "\\" for a backslash.
+func splitPath(s string) []string {
+	path := make([]string, 0)
+	key := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i += 1 {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && (s[i+1] == '.' || s[i+1] == '\\'):
+			i += 1
+			key = append(key, s[i])
+		case s[i] == '.':
+			path = append(path, string(key))
+			key = key[:0]
+		default:
+			key = append(key, s[i])
+		}
+	}
+	return append(path, string(key))
+}
+
+// escapePathKey escapes the dots and the backslashes of the key for
+// splitPath.
+func escapePathKey(key string) string {
+	if !strings.ContainsAny(key, ".\\") {
+		return key
+	}
+	return strings.NewReplacer("\\", "\\\\", ".", "\\.").Replace(key)
+}
+
+// unescapePath undoes escapePathKey on the whole path, returning along with
+// it where each of its bytes starts in the path, and the length of the path
+// at the end.
+func unescapePath(path string) (string, []int) {
+	retval := make([]byte, 0, len(path))
+	starts := make([]int, 0, len(path)+1)
+	for i := 0; i < len(path); i += 1 {
+		starts = append(starts, i)
+		if path[i] == '\\' && i+1 < len(path) && (path[i+1] == '.' || path[i+1] == '\\') {
+			i += 1
+		}
+		retval = append(retval, path[i])
+	}
+	return string(retval), append(starts, len(path))
+}
+
+// pathIndex returns the index of the element of the array the key
+// designates, if any.
+func pathIndex(array []interface{}, key string) (int, bool) {
+	i, err := strconv.Atoi(key)
+	if err != nil || i < 0 || i >= len(array) {
+		return 0, false
+	}
+	return i, true
+}
+
+// pathChild returns the value of the key in the map or the array.
+func pathChild(container interface{}, key string) (interface{}, bool) {
+	switch container_ := container.(type) {
+	case map[string]interface{}:
+		v, ok := container_[key]
+		return v, ok
+	case []interface{}:
+		i, ok := pathIndex(container_, key)
+		if !ok {
+			return nil, false
+		}
+		return container_[i], true
+	}
+	return nil, false
+}
+
+func lookupPath(data map[string]interface{}, path []string) (interface{}, bool) {
+	if len(path) == 0 {
+		return nil, false
+	}
+	v := interface{}(data)
+	for _, key := range path {
+		var ok bool
+		v, ok = pathChild(v, key)
+		if !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// setPath stores the value, creating the intermediate maps as needed, or
+// replaces an element of an array.  It fails if a value on the way is
+// neither a map nor an array, or an index is out of the array.
+func setPath(data map[string]interface{}, path []string, value interface{}) bool {
+	container := interface{}(data)
+	for i, key := range path {
+		if i == len(path)-1 {
+			switch container_ := container.(type) {
+			case map[string]interface{}:
+				container_[key] = value
+				return true
+			case []interface{}:
+				j, ok := pathIndex(container_, key)
+				if ok {
+					container_[j] = value
+				}
+				return ok
+			}
+			return false
+		}
+		v, ok := pathChild(container, key)
+		if !ok {
+			m, isMap := container.(map[string]interface{})
+			if !isMap {
+				return false
+			}
+			v = make(map[string]interface{})
+			m[key] = v
+		}
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			container = v
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// deletePath removes the value from its map; the elements of an array are
+// not removed.
+func deletePath(data map[string]interface{}, path []string) (interface{}, bool) {
+	if len(path) == 0 {
+		return nil, false
+	}
+	container := interface{}(data)
+	if len(path) > 1 {
+		var ok bool
+		container, ok = lookupPath(data, path[:len(path)-1])
+		if !ok {
+			return nil, false
+		}
+	}
+	m, ok := container.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	key := path[len(path)-1]
+	v, ok := m[key]
+	if ok {
+		delete(m, key)
+	}
+	return v, ok
+}
+
+// copyValue makes a deep copy of the maps and the arrays in a record, so
+// that the copy can be modified independently.
+func copyValue(v interface{}) interface{} {
+	switch v_ := v.(type) {
+	case map[string]interface{}:
+		retval := make(map[string]interface{}, len(v_))
+		for k, e := range v_ {
+			retval[k] = copyValue(e)
+		}
+		return retval
+	case []interface{}:
+		retval := make([]interface{}, len(v_))
+		for i, e := range v_ {
+			retval[i] = copyValue(e)
+		}
+		return retval
+	}
+	return v
+}
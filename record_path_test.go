@@ -0,0 +1,140 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_SplitPath(t *testing.T) {
+	for s, expected := range map[string][]string{
+		"a":            {"a"},
+		"a.b.c":        {"a", "b", "c"},
+		`a\.b.c`:       {"a.b", "c"},
+		`a\\.b`:        {`a\`, "b"},
+		`a\b`:          {`a\b`},
+		"items.0.name": {"items", "0", "name"},
+		"a..b":         {"a", "", "b"},
+	} {
+		if path := splitPath(s); !reflect.DeepEqual(path, expected) {
+			t.Errorf("%s: %#v", s, path)
+		}
+	}
+	for _, key := range []string{"a", "a.b", `a\b`, `a\.b.`, `\`} {
+		if path := splitPath(escapePathKey(key)); len(path) != 1 || path[0] != key {
+			t.Errorf("%s: %#v", key, path)
+		}
+		if name, starts := unescapePath(escapePathKey(key)); name != key || len(starts) != len(key)+1 || starts[len(key)] != len(escapePathKey(key)) {
+			t.Errorf("%s: %s %v", key, name, starts)
+		}
+	}
+}
+
+func Test_RecordPath_Arrays(t *testing.T) {
+	data := map[string]interface{}{
+		"items": []interface{}{
+			map[string]interface{}{"name": "a"},
+			"b",
+			[]interface{}{"c"},
+		},
+		"map": map[string]interface{}{"0": "zero"},
+	}
+	for path, expected := range map[string]interface{}{
+		"items.0.name": "a",
+		"items.1":      "b",
+		"items.2.0":    "c",
+		// a key of a map even if it looks like an index
+		"map.0": "zero",
+	} {
+		if v, ok := lookupPath(data, splitPath(path)); !ok || v != expected {
+			t.Errorf("%s: %v %v", path, v, ok)
+		}
+	}
+	for _, path := range []string{"items.3", "items.-1", "items.x", "items.1.name", "items.0.name.x"} {
+		if v, ok := lookupPath(data, splitPath(path)); ok {
+			t.Errorf("%s: %v", path, v)
+		}
+	}
+
+	// the elements are replaced in place, and the maps are created only in
+	// the maps
+	if !setPath(data, splitPath("items.0.name"), "A") || !setPath(data, splitPath("items.1"), "B") || !setPath(data, splitPath("items.0.new.key"), "x") {
+		t.Fatalf("%+v", data)
+	}
+	expected := []interface{}{
+		map[string]interface{}{"name": "A", "new": map[string]interface{}{"key": "x"}},
+		"B",
+		[]interface{}{"c"},
+	}
+	if !reflect.DeepEqual(data["items"], expected) {
+		t.Errorf("%+v", data["items"])
+	}
+	for _, path := range []string{"items.3", "items.3.name", "items.1.name"} {
+		if setPath(data, splitPath(path), "x") {
+			t.Errorf("%s: %+v", path, data)
+		}
+	}
+
+	// the elements are not removed from the arrays
+	if v, ok := deletePath(data, splitPath("items.0.name")); !ok || v != "A" {
+		t.Errorf("%v %v", v, ok)
+	}
+	if _, ok := deletePath(data, splitPath("items.1")); ok {
+		t.Errorf("%+v", data["items"])
+	}
+	if len(data["items"].([]interface{})) != 3 {
+		t.Errorf("%+v", data["items"])
+	}
+}
+
+func Test_RecordAccessor_Escaping(t *testing.T) {
+	data := map[string]interface{}{
+		"kubernetes": map[string]interface{}{
+			"labels": map[string]interface{}{"app.kubernetes.io/name": "web"},
+		},
+		"items": []interface{}{map[string]interface{}{"name": "a"}},
+	}
+	for _, expr := range []string{
+		`kubernetes.labels.app\.kubernetes\.io/name`,
+		`$.kubernetes.labels['app.kubernetes.io/name']`,
+	} {
+		accessor, err := NewDottedRecordAccessor(expr)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if v, ok := accessor.Get(data); !ok || v != "web" {
+			t.Errorf("%s: %v %v", expr, v, ok)
+		}
+	}
+	for _, expr := range []string{"items.0.name", "$.items[0].name", "$.items.0.name", "$['items'][0]['name']"} {
+		accessor, err := NewDottedRecordAccessor(expr)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if v, ok := accessor.Get(data); !ok || v != "a" {
+			t.Errorf("%s: %v %v", expr, v, ok)
+		}
+	}
+	for _, expr := range []string{"$.items[0", "$.items[0x]", "$.items[-1]"} {
+		if _, err := NewRecordAccessor(expr); err == nil {
+			t.Errorf("%s", expr)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"sync"
+)
+
+// The records, the record sets and the frames of the messages received are
+// taken from the pools and put back once passed on, as the ports keep none
+// of them past Emit; see Port.  The ones larger than the limits are left to
+// the garbage collector, so that a burst of large messages does not keep
+// as much memory for good.
+const (
+	maxPooledRecords    = 16384
+	maxPooledRecordSets = 1024
+	maxPooledFrameSize  = 1048576
+)
+
+var (
+	recordsPool    = sync.Pool{}
+	recordSetsPool = sync.Pool{}
+	framePool      = sync.Pool{}
+)
+
+// getRecords returns an empty slice of the records with room for n.
+func getRecords(n int) []TinyFluentRecord {
+	if v, ok := recordsPool.Get().(*[]TinyFluentRecord); ok && cap(*v) >= n {
+		return (*v)[:0]
+	}
+	return make([]TinyFluentRecord, 0, n)
+}
+
+// putRecords puts the records back to the pool, letting go of their data.
+func putRecords(records []TinyFluentRecord) {
+	if cap(records) == 0 || cap(records) > maxPooledRecords {
+		return
+	}
+	records = records[:cap(records)]
+	for i := range records {
+		records[i] = TinyFluentRecord{}
+	}
+	records = records[:0]
+	recordsPool.Put(&records)
+}
+
+// getRecordSets returns an empty slice of the record sets with room for n.
+func getRecordSets(n int) []FluentRecordSet {
+	if v, ok := recordSetsPool.Get().(*[]FluentRecordSet); ok && cap(*v) >= n {
+		return (*v)[:0]
+	}
+	return make([]FluentRecordSet, 0, n)
+}
+
+// releaseRecordSets puts the record sets and their records back to the
+// pools once they are passed on.
+func releaseRecordSets(recordSets []FluentRecordSet) {
+	for _, recordSet := range recordSets {
+		putRecords(recordSet.Records)
+	}
+	if cap(recordSets) == 0 || cap(recordSets) > maxPooledRecordSets {
+		return
+	}
+	recordSets = recordSets[:cap(recordSets)]
+	for i := range recordSets {
+		recordSets[i] = FluentRecordSet{}
+	}
+	recordSets = recordSets[:0]
+	recordSetsPool.Put(&recordSets)
+}
+
+// getFrame returns an empty buffer for the bytes of a message.
+func getFrame() []byte {
+	if v, ok := framePool.Get().(*[]byte); ok {
+		return (*v)[:0]
+	}
+	return nil
+}
+
+// putFrame puts the buffer of a message back to the pool.
+func putFrame(frame []byte) {
+	if cap(frame) == 0 || cap(frame) > maxPooledFrameSize {
+		return
+	}
+	frame = frame[:0]
+	framePool.Put(&frame)
+}
+
+// CopyRecordSets returns a copy of the record sets sharing the data of the
+// records, for a Port to keep them past Emit.
+func CopyRecordSets(recordSets []FluentRecordSet) []FluentRecordSet {
+	retval := make([]FluentRecordSet, len(recordSets))
+	for i, recordSet := range recordSets {
+		retval[i] = copyRecordSet(recordSet)
+	}
+	return retval
+}
+
+// copyRecordSet returns a copy of the record set whose records are taken
+// from the pool, to be put back by putRecords once done with.
+func copyRecordSet(recordSet FluentRecordSet) FluentRecordSet {
+	recordSet.Records = append(getRecords(len(recordSet.Records)), recordSet.Records...)
+	return recordSet
+}
@@ -0,0 +1,53 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"testing"
+)
+
+func Test_RecordPool(t *testing.T) {
+	data := map[string]interface{}{"message": "hello"}
+	recordSets := append(getRecordSets(1), FluentRecordSet{
+		Tag:     "a",
+		Records: append(getRecords(2), TinyFluentRecord{Timestamp: 1388534400, Data: data}, TinyFluentRecord{Timestamp: 1388534401, Data: data}),
+	})
+	// kept past Emit by a copy sharing the data
+	kept := CopyRecordSets(recordSets)
+	records := recordSets[0].Records
+	releaseRecordSets(recordSets)
+	// the records put back let go of their data
+	if records[:2][0].Data != nil || recordSets[:1][0].Records != nil {
+		t.Errorf("%+v %+v", records[:2], recordSets[:1])
+	}
+	if len(kept) != 1 || kept[0].Tag != "a" || len(kept[0].Records) != 2 || kept[0].Records[1].Timestamp != 1388534401 || kept[0].Records[0].Data["message"] != "hello" {
+		t.Errorf("%+v", kept)
+	}
+	if records := getRecords(4); len(records) != 0 || cap(records) < 4 {
+		t.Errorf("%d %d", len(records), cap(records))
+	}
+
+	// too large to be kept in the pool
+	putRecords(make([]TinyFluentRecord, maxPooledRecords+1))
+	putFrame(make([]byte, 10, maxPooledFrameSize+1))
+	frame := getFrame()
+	if len(frame) != 0 || cap(frame) > maxPooledFrameSize {
+		t.Errorf("%d", cap(frame))
+	}
+}
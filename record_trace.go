@@ -0,0 +1,167 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// MaxRecordTraceDuration bounds how long the records are traced for.
+const MaxRecordTraceDuration = time.Hour
+
+type recordTraceState struct {
+	pattern string
+	matcher *TagMatcher
+	until   time.Time
+}
+
+// RecordTracer logs the journey of the records with the tags matching a
+// pattern through the forwarder at DEBUG, for a limited time: the receipt
+// of each record, the filters applied, the output chosen, the buffering and
+// the result of the flush, so as to find out where the records went.  The
+// methods are safe to call on nil, which traces nothing.
+type RecordTracer struct {
+	logger *logging.Logger
+	levels *LogLevels
+	state  atomic.Value // *recordTraceState
+	now    func() time.Time
+}
+
+// DefaultRecordTracer is the RecordTracer the forwarder traces with, which
+// is nil until set.
+var DefaultRecordTracer *RecordTracer
+
+func (tracer *RecordTracer) current() *recordTraceState {
+	if tracer == nil {
+		return nil
+	}
+	state, _ := tracer.state.Load().(*recordTraceState)
+	if state == nil || !tracer.now().Before(state.until) {
+		return nil
+	}
+	return state
+}
+
+// Matches returns whether the records with the tag are being traced.
+func (tracer *RecordTracer) Matches(tag string) bool {
+	state := tracer.current()
+	return state != nil && state.matcher.Match(tag)
+}
+
+// Tracef logs the message about the records with the tag if they are being
+// traced.
+func (tracer *RecordTracer) Tracef(tag string, format string, args ...interface{}) {
+	if !tracer.Matches(tag) {
+		return
+	}
+	tracer.logger.Debugf("trace: tag %s: %s", LogTag(tag), fmt.Sprintf(format, args...))
+}
+
+// TraceRecordSets logs the message, followed by the number of the records,
+// about each of the record sets being traced.
+func (tracer *RecordTracer) TraceRecordSets(recordSets []FluentRecordSet, format string, args ...interface{}) {
+	if tracer.current() == nil {
+		return
+	}
+	message := fmt.Sprintf(format, args...)
+	for _, recordSet := range recordSets {
+		tracer.Tracef(recordSet.Tag, "%s: %d records", message, len(recordSet.Records))
+	}
+}
+
+// Enable starts tracing the records with the tags matching the pattern for
+// the duration, replacing the pattern traced so far.
+func (tracer *RecordTracer) Enable(pattern string, duration time.Duration) error {
+	if duration <= 0 || duration > MaxRecordTraceDuration {
+		return errors.New(fmt.Sprintf("trace duration must be positive and at most %s", MaxRecordTraceDuration.String()))
+	}
+	matcher, err := NewTagMatcher(pattern)
+	if err != nil {
+		return err
+	}
+	if tracer.levels != nil {
+		tracer.levels.SetLevel(logging.DEBUG, tracer.logger.Module)
+	}
+	tracer.state.Store(&recordTraceState{pattern: pattern, matcher: matcher, until: tracer.now().Add(duration)})
+	tracer.logger.Noticef("Tracing the records tagged %s until %s", pattern, tracer.now().Add(duration).Format(time.RFC3339))
+	return nil
+}
+
+// Disable stops tracing.
+func (tracer *RecordTracer) Disable() {
+	tracer.state.Store((*recordTraceState)(nil))
+}
+
+// ServeHTTP shows the pattern being traced and until when on GET.  On PUT
+// or POST, it starts tracing the records with the tags matching the "tag"
+// parameter for the "duration" parameter, 5 minutes by default.  DELETE
+// stops tracing.
+func (tracer *RecordTracer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "PUT", "POST":
+		duration := 5 * time.Minute
+		if value := r.FormValue("duration"); value != "" {
+			err := (error)(nil)
+			duration, err = time.ParseDuration(value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid duration: %s", value), http.StatusBadRequest)
+				return
+			}
+		}
+		if r.FormValue("tag") == "" {
+			http.Error(w, "tag is not specified", http.StatusBadRequest)
+			return
+		}
+		err := tracer.Enable(r.FormValue("tag"), duration)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "DELETE":
+		tracer.Disable()
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status := map[string]string{}
+	if state := tracer.current(); state != nil {
+		status["tag"] = state.pattern
+		status["until"] = state.until.Format(time.RFC3339)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// NewRecordTracer creates a RecordTracer logging to the logger, whose
+// module is set to DEBUG in levels, if not nil, when the tracing starts.
+func NewRecordTracer(logger *logging.Logger, levels *LogLevels) *RecordTracer {
+	return &RecordTracer{
+		logger: logger,
+		levels: levels,
+		now:    time.Now,
+	}
+}
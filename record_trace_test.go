@@ -0,0 +1,89 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_RecordTracer(t *testing.T) {
+	defer logging.InitForTesting(logging.NOTICE)
+	memory := logging.NewMemoryBackend(100)
+	levels := NewLogLevels(memory)
+	levels.SetLevel(logging.INFO, "")
+	logging.SetBackend(levels)
+	tracer := NewRecordTracer(logging.MustGetLogger("trace"), levels)
+	now := time.Unix(1000, 0)
+	tracer.now = func() time.Time { return now }
+	DefaultRecordTracer = tracer
+	defer func() { DefaultRecordTracer = nil }()
+
+	if tracer.Matches("app.web") || tracer.Enable("app.**", 2*time.Hour) == nil {
+		t.Fail()
+	}
+	err := tracer.Enable("app.**", time.Minute)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	router := NewOutputRouter(logging.MustGetLogger("pipeline"), "label:default", []OutputRoute{{Matcher: mustRecordMatcher(t, "**"), Port: &recordingOutput{name: "traced"}}})
+	router.Emit([]FluentRecordSet{
+		{Tag: "app.web", Records: []TinyFluentRecord{{Timestamp: 0, Data: map[string]interface{}{"message": "hello"}}}},
+		{Tag: "other", Records: []TinyFluentRecord{{Timestamp: 0, Data: map[string]interface{}{"message": "hello"}}}},
+	})
+	traced := make([]string, 0)
+	for node := memory.Head(); node != nil; node = node.Next() {
+		if strings.HasPrefix(node.Record.Message(), "trace:") {
+			traced = append(traced, node.Record.Message())
+		}
+	}
+	if len(traced) != 1 || traced[0] != "trace: tag app.web: label:default: routed to output:traced: 1 records" {
+		t.Logf("%+v", traced)
+		t.Fail()
+	}
+
+	// expires after the duration
+	now = now.Add(time.Minute)
+	if tracer.Matches("app.web") {
+		t.Fail()
+	}
+
+	w := httptest.NewRecorder()
+	tracer.ServeHTTP(w, httptest.NewRequest("PUT", "/api/trace?tag=app.**&duration=10m", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"tag":"app.**"`) || !tracer.Matches("app.web") {
+		t.Logf("%d %s", w.Code, w.Body.String())
+		t.Fail()
+	}
+	w = httptest.NewRecorder()
+	tracer.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/trace", nil))
+	if w.Code != 200 || tracer.Matches("app.web") {
+		t.Fail()
+	}
+}
+
+func mustRecordMatcher(t *testing.T, pattern string) *RecordMatcher {
+	matcher, err := NewRecordMatcher(pattern, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return matcher
+}
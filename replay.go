@@ -0,0 +1,289 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"github.com/ugorji/go/codec"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ReplayChunkFile is a chunk file of the buffer of an output to replay.
+type ReplayChunkFile struct {
+	Path string
+	// the key of the journal, which is the tag of the records in the
+	// chunks of the td outputs
+	Key       string
+	Timestamp int64
+}
+
+// FindReplayChunkFiles returns the chunk file at the path, or the chunk
+// files of the buffer at the path given as the buffer_path of an output,
+// the oldest first.
+func FindReplayChunkFiles(logger *logging.Logger, path string) ([]ReplayChunkFile, error) {
+	info, err := os.Stat(path)
+	if err == nil && info.Mode().IsRegular() {
+		name := filepath.Base(path)
+		pathInfo, err := DecodeJournalPath(strings.TrimSuffix(name, filepath.Ext(name)))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s is not a chunk file of a buffer", path))
+		}
+		return []ReplayChunkFile{{Path: path, Key: pathInfo.Key, Timestamp: pathInfo.Timestamp}}, nil
+	}
+	pathPrefix, pathSuffix := path+".", ".log"
+	if pos := strings.Index(path, "*"); pos >= 0 {
+		pathPrefix, pathSuffix = path[0:pos], path[pos+1:]
+	}
+	journals, err := scanJournals(logger, pathPrefix, pathSuffix)
+	if err != nil {
+		return nil, err
+	}
+	retval := make([]ReplayChunkFile, 0)
+	for key, journal := range journals {
+		for chunk := journal.chunks.first; chunk != nil; chunk = chunk.head.next {
+			retval = append(retval, ReplayChunkFile{Path: chunk.Path, Key: key, Timestamp: chunk.Timestamp})
+		}
+	}
+	if len(retval) == 0 {
+		return nil, errors.New(fmt.Sprintf("no chunk found in the buffer %s", path))
+	}
+	sort.SliceStable(retval, func(i, j int) bool { return retval[i].Timestamp < retval[j].Timestamp })
+	return retval, nil
+}
+
+// replayTimestamp returns the timestamp decoded as any of the numbers.
+func replayTimestamp(v interface{}) (uint64, bool) {
+	switch v_ := v.(type) {
+	case uint64:
+		return v_, true
+	case int64:
+		return uint64(v_), true
+	case float64:
+		return uint64(v_), true
+	}
+	return 0, false
+}
+
+// decodeReplayEntries decodes the [time, record] entries of a forward
+// message.
+func decodeReplayEntries(tag string, entries []interface{}) (FluentRecordSet, error) {
+	records := make([]TinyFluentRecord, 0, len(entries))
+	for _, _entry := range entries {
+		entry, ok := _entry.([]interface{})
+		if !ok || len(entry) < 2 {
+			return FluentRecordSet{}, errors.New("malformed entry")
+		}
+		timestamp, ok := replayTimestamp(entry[0])
+		if !ok {
+			return FluentRecordSet{}, errors.New("malformed timestamp")
+		}
+		data, ok := entry[1].(map[string]interface{})
+		if !ok {
+			return FluentRecordSet{}, errors.New("malformed record")
+		}
+		coerceInPlace(data)
+		records = append(records, TinyFluentRecord{Timestamp: timestamp, Data: data})
+	}
+	return FluentRecordSet{Tag: tag, Records: records}, nil
+}
+
+// ReadReplayChunk reads the records of a chunk, which is of the forward
+// messages buffered by a forward output or of the records with "time"
+// buffered by a td output, tagged with the key of the chunk.  The control
+// records of the delivery accounting are left out, as the counts they
+// carry are of the original delivery.
+func ReadReplayChunk(chunk ReplayChunkFile) ([]FluentRecordSet, error) {
+	data, err := ioutil.ReadFile(chunk.Path)
+	if err != nil {
+		return nil, err
+	}
+	handle := &codec.MsgpackHandle{}
+	handle.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	handle.RawToString = false
+	reader := bytes.NewReader(data)
+	dec := codec.NewDecoder(reader, handle)
+	retval := make([]FluentRecordSet, 0)
+	tdRecords := []TinyFluentRecord(nil)
+	for reader.Len() > 0 { // codec.Decoder doesn't return EOF.
+		offset := len(data) - reader.Len()
+		v := interface{}(nil)
+		err := dec.Decode(&v)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s at %d: %s", chunk.Path, offset, err.Error()))
+		}
+		switch v_ := v.(type) {
+		case []interface{}:
+			// [tag, [[time, record], ...], option] or [tag, time, record]
+			if len(v_) < 2 {
+				return nil, errors.New(fmt.Sprintf("%s at %d: malformed message", chunk.Path, offset))
+			}
+			tag, ok := v_[0].([]byte)
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("%s at %d: malformed tag", chunk.Path, offset))
+			}
+			if string(tag) == AccountingTag {
+				continue
+			}
+			entries, ok := v_[1].([]interface{})
+			if !ok {
+				if len(v_) < 3 {
+					return nil, errors.New(fmt.Sprintf("%s at %d: malformed message", chunk.Path, offset))
+				}
+				entries = []interface{}{[]interface{}{v_[1], v_[2]}}
+			}
+			recordSet, err := decodeReplayEntries(string(tag), entries)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("%s at %d: %s", chunk.Path, offset, err.Error()))
+			}
+			retval = append(retval, recordSet)
+		case map[string]interface{}:
+			timestamp, ok := replayTimestamp(v_["time"])
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("%s at %d: the record has no time", chunk.Path, offset))
+			}
+			delete(v_, "time")
+			coerceInPlace(v_)
+			tdRecords = append(tdRecords, TinyFluentRecord{Timestamp: timestamp, Data: v_})
+		default:
+			return nil, errors.New(fmt.Sprintf("%s at %d: neither a message nor a record", chunk.Path, offset))
+		}
+	}
+	if len(tdRecords) > 0 {
+		retval = append(retval, FluentRecordSet{Tag: chunk.Key, Records: tdRecords})
+	}
+	return retval, nil
+}
+
+// Replayer sends the records of the chunks to a forward input, with the
+// tags rewritten by the rewriter unless nil, at the rate of records per
+// second unless it is 0.
+type Replayer struct {
+	address   string
+	rewriter  *TagRewriter
+	rate      int
+	batchSize int
+	timeout   time.Duration
+	codec     *codec.MsgpackHandle
+	conn      net.Conn
+	startTime time.Time
+	sent      int64
+}
+
+// Replay sends the records, and returns the number of the records sent.
+// The records sent before an error are not sent again, so the chunk may be
+// partially replayed if it fails.
+func (replayer *Replayer) Replay(recordSets []FluentRecordSet) (int, error) {
+	if replayer.startTime.IsZero() {
+		replayer.startTime = time.Now()
+	}
+	batchSize := replayer.batchSize
+	if batchSize < 1 {
+		batchSize = 1000
+	}
+	sent := 0
+	buffer := bytes.Buffer{}
+	for _, recordSet := range recordSets {
+		tag := recordSet.Tag
+		if replayer.rewriter != nil {
+			tag = replayer.rewriter.Rewrite(tag)
+		}
+		for i := 0; i < len(recordSet.Records); i += batchSize {
+			records := recordSet.Records[i:]
+			if len(records) > batchSize {
+				records = records[:batchSize]
+			}
+			replayer.wait()
+			buffer.Reset()
+			err := encodeRecordSet(codec.NewEncoder(&buffer, replayer.codec), FluentRecordSet{Tag: tag, Records: records}, nil)
+			if err != nil {
+				return sent, err
+			}
+			err = replayer.write(buffer.Bytes())
+			if err != nil {
+				return sent, err
+			}
+			sent += len(records)
+			replayer.sent += int64(len(records))
+		}
+	}
+	return sent, nil
+}
+
+// wait waits until more records can be sent without exceeding the rate.
+func (replayer *Replayer) wait() {
+	if replayer.rate <= 0 {
+		return
+	}
+	next := replayer.startTime.Add(time.Duration(float64(replayer.sent) / float64(replayer.rate) * float64(time.Second)))
+	if d := next.Sub(time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (replayer *Replayer) write(buf []byte) error {
+	if replayer.conn == nil {
+		conn, err := net.DialTimeout("tcp", replayer.address, replayer.timeout)
+		if err != nil {
+			return err
+		}
+		replayer.conn = conn
+	}
+	if replayer.timeout > 0 {
+		replayer.conn.SetWriteDeadline(time.Now().Add(replayer.timeout))
+	}
+	_, err := replayer.conn.Write(buf)
+	if err != nil {
+		replayer.Close()
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection.
+func (replayer *Replayer) Close() {
+	if replayer.conn != nil {
+		replayer.conn.Close()
+		replayer.conn = nil
+	}
+}
+
+func NewReplayer(address string, rewriter *TagRewriter, rate int, batchSize int, timeout time.Duration) *Replayer {
+	_codec := codec.MsgpackHandle{}
+	_codec.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	_codec.RawToString = false
+	_codec.StructToArray = true
+	return &Replayer{
+		address:   address,
+		rewriter:  rewriter,
+		rate:      rate,
+		batchSize: batchSize,
+		timeout:   timeout,
+		codec:     &_codec,
+	}
+}
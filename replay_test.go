@@ -0,0 +1,165 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	logging "github.com/op/go-logging"
+	"github.com/ugorji/go/codec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeReplayChunks writes the chunks of a forward output and of a td
+// output to the buffer at the path.
+func writeReplayChunks(t *testing.T, path string) {
+	handle := &codec.MsgpackHandle{}
+	handle.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	handle.StructToArray = true
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	write := func(key string, bq JournalFileType, at time.Time, data []byte) {
+		info := BuildJournalPath(key, bq, at, 0)
+		err := ioutil.WriteFile(path+"."+info.VariablePortion+".log", data, 0600)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	older := bytes.Buffer{}
+	encodeRecordSet(codec.NewEncoder(&older, handle), FluentRecordSet{Tag: "app.a", Records: []TinyFluentRecord{
+		{Timestamp: 1388534400, Data: map[string]interface{}{"message": "a1"}},
+		{Timestamp: 1388534401, Data: map[string]interface{}{"message": "a2"}},
+	}}, nil)
+	encodeRecordSet(codec.NewEncoder(&older, handle), accountingControl(1, map[string]interface{}{"app.a": 2}), nil)
+	write("output", Rest, now, older.Bytes())
+	newer := bytes.Buffer{}
+	encodeRecordSet(codec.NewEncoder(&newer, handle), FluentRecordSet{Tag: "app.b", Records: []TinyFluentRecord{
+		{Timestamp: 1388534402, Data: map[string]interface{}{"message": "b1"}},
+	}}, nil)
+	write("output", Head, now.Add(2*time.Second), newer.Bytes())
+	td := bytes.Buffer{}
+	encodeRecords(&td, handle, "db.table", []TinyFluentRecord{
+		{Timestamp: 1388534403, Data: map[string]interface{}{"message": "c1"}},
+	})
+	write("db.table", Head, now.Add(time.Second), td.Bytes())
+}
+
+func Test_ReadReplayChunk(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("replay")
+	tempDir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, "buffer")
+	writeReplayChunks(t, path)
+	chunks, err := FindReplayChunkFiles(logger, path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(chunks) != 3 || chunks[0].Key != "output" || chunks[1].Key != "db.table" || chunks[2].Key != "output" {
+		t.Fatalf("%+v", chunks)
+	}
+	tags := []string{}
+	messages := []string{}
+	for _, chunk := range chunks {
+		recordSets, err := ReadReplayChunk(chunk)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, recordSet := range recordSets {
+			tags = append(tags, recordSet.Tag)
+			for _, record := range recordSet.Records {
+				messages = append(messages, record.Data["message"].(string))
+			}
+		}
+	}
+	// without the control record of the accounting
+	if !reflect.DeepEqual(tags, []string{"app.a", "db.table", "app.b"}) || !reflect.DeepEqual(messages, []string{"a1", "a2", "c1", "b1"}) {
+		t.Errorf("%v %v", tags, messages)
+	}
+	// a chunk given by itself
+	single, err := FindReplayChunkFiles(logger, chunks[1].Path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(single) != 1 || single[0].Key != "buffer.db.table" {
+		t.Errorf("%+v", single)
+	}
+	_, err = FindReplayChunkFiles(logger, filepath.Join(tempDir, "none"))
+	if err == nil {
+		t.Error("no error")
+	}
+	ioutil.WriteFile(chunks[1].Path, []byte{0x01}, 0600)
+	_, err = ReadReplayChunk(chunks[1])
+	if err == nil {
+		t.Error("no error")
+	}
+}
+
+func Test_Replayer(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("input")
+	port := &syncRecordingPort{}
+	input, err := NewForwardInput(logger, "127.0.0.1:0", port)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	input.Start()
+	defer func() {
+		input.Stop()
+		input.WaitForShutdown()
+	}()
+	replayer := NewReplayer(input.listener.Addr().String(), &TagRewriter{AddPrefix: "replayed"}, 20, 2, time.Second)
+	defer replayer.Close()
+	startTime := time.Now()
+	sent, err := replayer.Replay([]FluentRecordSet{
+		{Tag: "app.a", Records: []TinyFluentRecord{
+			{Timestamp: 1388534400, Data: map[string]interface{}{"message": "a1"}},
+			{Timestamp: 1388534401, Data: map[string]interface{}{"message": "a2"}},
+			{Timestamp: 1388534402, Data: map[string]interface{}{"message": "a3"}},
+		}},
+	})
+	if err != nil || sent != 3 {
+		t.Fatalf("%d %v", sent, err)
+	}
+	// the second message of the two records waits for 0.1 seconds at 20
+	// records per second
+	if elapsed := time.Now().Sub(startTime); elapsed < 100*time.Millisecond {
+		t.Errorf("sent in %s", elapsed)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		port.mtx.Lock()
+		n := len(port.recordSets)
+		port.mtx.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages arrived", n)
+		}
+	}
+	if port.recordSets[0].Tag != "replayed.app.a" || len(port.recordSets[0].Records) != 2 || port.recordSets[1].Records[0].Data["message"] != "a3" {
+		t.Errorf("%+v", port.recordSets)
+	}
+}
@@ -0,0 +1,132 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+)
+
+// TagRouteStep is a filter or an output the records of a tag reach.
+type TagRouteStep struct {
+	// the label of the step, like "label:default"
+	Label string
+	// the section of the filter or the output, or "default output" for the
+	// output given by the command line
+	Section string
+	// the pattern the tag matches, followed by the where predicates if any
+	Match string
+	// whether the records have to satisfy the where predicates too, in
+	// which case the rest go on to the next step
+	Conditional bool
+	// whether the step is an output
+	IsOutput bool
+}
+
+func (step TagRouteStep) String() string {
+	return fmt.Sprintf("%s: %s (match %s)", step.Label, step.Section, step.Match)
+}
+
+// tagRouter follows the tag through the labels of the sections.
+type tagRouter struct {
+	sections         []*ConfigElement
+	hasDefaultOutput bool
+	steps            []TagRouteStep
+	visited          map[string]bool
+}
+
+func (router *tagRouter) follow(name string, tag string) error {
+	if router.visited[name] {
+		return nil
+	}
+	router.visited[name] = true
+	label := (&LabelPort{name: name}).String()
+	for _, section := range router.sections {
+		if section.Name != "filter" || section.Get("label", "") != name {
+			continue
+		}
+		matcher, err := newRecordMatcherFromConfig(section)
+		if err != nil {
+			return err
+		}
+		if !matcher.MatchTag(tag) {
+			continue
+		}
+		router.steps = append(router.steps, TagRouteStep{Label: label, Section: section.String(), Match: matcher.String(), Conditional: matcher.HasPredicates()})
+		if section.Get("type", "") == "relabel" {
+			err := router.follow(section.Get("to-label", ""), tag)
+			if err != nil {
+				return err
+			}
+			if !matcher.HasPredicates() {
+				return nil
+			}
+		}
+	}
+	for _, section := range router.sections {
+		if section.Name != "output" || section.Get("label", "") != name {
+			continue
+		}
+		matcher, err := newRecordMatcherFromConfig(section)
+		if err != nil {
+			return err
+		}
+		if !matcher.MatchTag(tag) {
+			continue
+		}
+		router.steps = append(router.steps, TagRouteStep{Label: label, Section: section.String(), Match: matcher.String(), Conditional: matcher.HasPredicates(), IsOutput: true})
+		if !matcher.HasPredicates() {
+			return nil
+		}
+	}
+	if name == "" && router.hasDefaultOutput {
+		router.steps = append(router.steps, TagRouteStep{Label: label, Section: "default output", Match: "**", IsOutput: true})
+	}
+	return nil
+}
+
+// RouteTag returns the filters and the outputs the records of the tag reach
+// from the label, in the order they pass them, as the pipeline built from
+// the sections would route them; hasDefaultOutput tells whether the default
+// label ends in the output given by the command line.  The records relabeled
+// are followed into the other labels, while the tags rewritten by the
+// filters are not.  The records of the tag are discarded where the last step
+// is not an unconditional output.
+func RouteTag(sections []*ConfigElement, hasDefaultOutput bool, label string, tag string) ([]TagRouteStep, error) {
+	found := false
+	for _, name := range labelNames(sections) {
+		if name == label {
+			found = true
+		}
+	}
+	if !found {
+		return nil, errors.New(fmt.Sprintf("label %s is not defined", label))
+	}
+	router := &tagRouter{
+		sections:         sections,
+		hasDefaultOutput: hasDefaultOutput,
+		steps:            make([]TagRouteStep, 0),
+		visited:          make(map[string]bool),
+	}
+	err := router.follow(label, tag)
+	if err != nil {
+		return nil, err
+	}
+	return router.steps, nil
+}
@@ -0,0 +1,88 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_RouteTag(t *testing.T) {
+	sections, err := ReadConfig("test.conf", []byte(`
+[filter "errors"]
+type = relabel
+match = app.error
+to-label = errors
+
+[output "audit"]
+type = forward
+match = audit.**
+
+[filter "strip"]
+type = fields
+label = errors
+remove = debug
+
+[output "pager"]
+type = forward
+label = errors
+match = app.**
+where = severity >= 3
+
+[output "ticket"]
+type = forward
+label = errors
+match = app.**
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	route := func(label string, tag string, hasDefaultOutput bool) string {
+		steps, err := RouteTag(sections, hasDefaultOutput, label, tag)
+		if err != nil {
+			return err.Error()
+		}
+		retval := make([]string, 0, len(steps))
+		for _, step := range steps {
+			retval = append(retval, step.String())
+		}
+		return strings.Join(retval, "\n")
+	}
+	cases := []struct {
+		label            string
+		tag              string
+		hasDefaultOutput bool
+		expected         string
+	}{
+		{"", "audit.login", true, `label:default: output "audit" (match audit.**)`},
+		{"", "app.info", true, `label:default: default output (match **)`},
+		{"", "app.info", false, ``},
+		{"", "app.error", true, `label:default: filter "errors" (match app.error)
+label:errors: filter "strip" (match **)
+label:errors: output "pager" (match app.** where severity >= 3)
+label:errors: output "ticket" (match app.**)`},
+		{"errors", "other", true, `label:errors: filter "strip" (match **)`},
+		{"missing", "app.info", true, `label missing is not defined`},
+	}
+	for _, c := range cases {
+		if actual := route(c.label, c.tag, c.hasDefaultOutput); actual != c.expected {
+			t.Errorf("%s %s: expected %q, got %q", c.label, c.tag, c.expected, actual)
+		}
+	}
+}
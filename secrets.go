@@ -0,0 +1,576 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The sources of the secrets referred to by ${SOURCE:REFERENCE} in the
+// configuration values.
+const (
+	SecretSourceFile  = "file"
+	SecretSourceVault = "vault"
+	SecretSourceAWS   = "aws-sm"
+	SecretSourceGCP   = "gcp-sm"
+	// the values decrypted by the configuration key, which are not
+	// referred to by ${enc:...} but written as enc:CIPHERTEXT
+	SecretSourceEncrypted = "enc"
+)
+
+var secretReferenceRegexp = regexp.MustCompile(`\$\$\{|\$\{(file|vault|aws-sm|gcp-sm):([^}]+)\}`)
+
+// the endpoint of Google Cloud Secret Manager; replaced in the tests
+var gcpSecretManagerURL = "https://secretmanager.googleapis.com/v1/"
+
+var secretsClient = &http.Client{Timeout: 10 * time.Second}
+
+// secretField takes the field of the secret if the reference ends in
+// "#FIELD", in which case the secret has to be a JSON object.
+func secretField(ref string, secret string) (string, error) {
+	i := strings.LastIndex(ref, "#")
+	if i < 0 {
+		return secret, nil
+	}
+	fields := make(map[string]interface{})
+	err := json.Unmarshal([]byte(secret), &fields)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("%s is not a JSON object", ref[:i]))
+	}
+	v, ok := fields[ref[i+1:]]
+	if !ok {
+		return "", errors.New(fmt.Sprintf("%s has no field %s", ref[:i], ref[i+1:]))
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	b, _ := json.Marshal(v)
+	return string(b), nil
+}
+
+func secretRequest(req *http.Request, v interface{}) error {
+	resp, err := secretsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(body))))
+	}
+	return json.Unmarshal(body, v)
+}
+
+// fetchFileSecret reads the file, without the trailing newline.
+func fetchFileSecret(ref string) (string, error) {
+	b, err := ioutil.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// fetchVaultSecret reads PATH#FIELD from the KV secrets engine of Vault at
+// VAULT_ADDR with VAULT_TOKEN, or the token in ~/.vault-token.
+func fetchVaultSecret(ref string) (string, error) {
+	i := strings.LastIndex(ref, "#")
+	if i < 0 {
+		return "", errors.New("the field is not specified like PATH#FIELD")
+	}
+	addr, _ := lookupEnv("VAULT_ADDR")
+	if addr == "" {
+		return "", errors.New("VAULT_ADDR is not set")
+	}
+	token, _ := lookupEnv("VAULT_TOKEN")
+	if token == "" {
+		home, _ := lookupEnv("HOME")
+		b, err := ioutil.ReadFile(filepath.Join(home, ".vault-token"))
+		if err != nil {
+			return "", errors.New("VAULT_TOKEN is not set")
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	req, err := http.NewRequest("GET", strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(ref[:i], "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if namespace, _ := lookupEnv("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+	resp := struct {
+		Data map[string]interface{} `json:"data"`
+	}{}
+	err = secretRequest(req, &resp)
+	if err != nil {
+		return "", err
+	}
+	data := resp.Data
+	// version 2 of the engine nests the secret with the metadata
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+	b, _ := json.Marshal(data)
+	return secretField(ref, string(b))
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// awsCredentials returns AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+func awsCredentials() (string, string, error) {
+	accessKey, _ := lookupEnv("AWS_ACCESS_KEY_ID")
+	secretKey, _ := lookupEnv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return "", "", errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are not set")
+	}
+	return accessKey, secretKey, nil
+}
+
+// signAWSRequest signs the request with the signature version 4 of AWS,
+// covering the host and the headers set on the request.
+func signAWSRequest(req *http.Request, body []byte, service string, region string, accessKey string, secretKey string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{req.Method, path, req.URL.RawQuery, canonicalHeaders, signedHeaders, hex.EncodeToString(bodyHash[:])}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	for _, s := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+// fetchAWSSecret reads the secret named by the name or the ARN, optionally
+// followed by #FIELD, from AWS Secrets Manager with the credentials in
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.  The region
+// is taken from the ARN, or from AWS_REGION or AWS_DEFAULT_REGION.
+func fetchAWSSecret(ref string) (string, error) {
+	id := ref
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		id = ref[:i]
+	}
+	region := ""
+	if arn := strings.Split(id, ":"); len(arn) > 3 && arn[0] == "arn" {
+		region = arn[3]
+	}
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region == "" {
+			region, _ = lookupEnv(name)
+		}
+	}
+	if region == "" {
+		return "", errors.New("the region is not known; set AWS_REGION")
+	}
+	accessKey, secretKey, err := awsCredentials()
+	if err != nil {
+		return "", err
+	}
+	endpoint, _ := lookupEnv("AWS_ENDPOINT_URL_SECRETS_MANAGER")
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + region + ".amazonaws.com/"
+	}
+	body, _ := json.Marshal(map[string]string{"SecretId": id})
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if token, _ := lookupEnv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	signAWSRequest(req, body, "secretsmanager", region, accessKey, secretKey, time.Now())
+	resp := struct {
+		SecretString string `json:"SecretString"`
+		SecretBinary []byte `json:"SecretBinary"`
+	}{}
+	err = secretRequest(req, &resp)
+	if err != nil {
+		return "", err
+	}
+	secret := resp.SecretString
+	if secret == "" {
+		secret = string(resp.SecretBinary)
+	}
+	return secretField(ref, secret)
+}
+
+// gcpAccessToken returns GOOGLE_OAUTH_ACCESS_TOKEN, or the token of the
+// service account of the instance from the metadata server.
+func gcpAccessToken() (string, error) {
+	if token, _ := lookupEnv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+	host, _ := lookupEnv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	req, err := http.NewRequest("GET", "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	err = secretRequest(req, &resp)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("failed to get the access token: %s", err.Error()))
+	}
+	return resp.AccessToken, nil
+}
+
+// fetchGCPSecret reads projects/PROJECT/secrets/SECRET, of the latest
+// version unless followed by /versions/VERSION, and optionally followed by
+// #FIELD, from Google Cloud Secret Manager.
+func fetchGCPSecret(ref string) (string, error) {
+	name := ref
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		name = ref[:i]
+	}
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+	token, err := gcpAccessToken()
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("GET", gcpSecretManagerURL+name+":access", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp := struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}{}
+	err = secretRequest(req, &resp)
+	if err != nil {
+		return "", err
+	}
+	secret, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return "", err
+	}
+	return secretField(ref, string(secret))
+}
+
+// Secrets resolves the references to the secrets and keeps their values,
+// so that the configuration read again on reloading gets the same ones
+// until they are refreshed.
+type Secrets struct {
+	mtx       sync.Mutex
+	fetch     map[string]func(ref string) (string, error)
+	values    map[string]string
+	redacts   []string
+	configKey []byte
+}
+
+func secretKey(source string, ref string) string {
+	return source + ":" + ref
+}
+
+func (secrets *Secrets) fetchSecret(source string, ref string) (string, error) {
+	fetch, ok := secrets.fetch[source]
+	if !ok {
+		return "", errors.New(fmt.Sprintf("unknown source of secrets: %s", source))
+	}
+	v, err := fetch(ref)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("failed to read the secret %s from %s: %s", ref, source, err.Error()))
+	}
+	return v, nil
+}
+
+// Resolve returns the value of the secret, which is fetched if not yet.
+func (secrets *Secrets) Resolve(source string, ref string) (string, error) {
+	key := secretKey(source, ref)
+	secrets.mtx.Lock()
+	v, ok := secrets.values[key]
+	secrets.mtx.Unlock()
+	if ok {
+		return v, nil
+	}
+	v, err := secrets.fetchSecret(source, ref)
+	if err != nil {
+		return "", err
+	}
+	secrets.mtx.Lock()
+	secrets.values[key] = v
+	secrets.mtx.Unlock()
+	return v, nil
+}
+
+// Expand replaces ${SOURCE:REFERENCE} in the value with the secret; "$${"
+// is left for ExpandEnv.
+func (secrets *Secrets) Expand(value string) (string, error) {
+	err := (error)(nil)
+	retval := secretReferenceRegexp.ReplaceAllStringFunc(value, func(ref string) string {
+		if ref == "$${" || err != nil {
+			return ref
+		}
+		m := secretReferenceRegexp.FindStringSubmatch(ref)
+		v, err_ := secrets.Resolve(m[1], m[2])
+		if err_ != nil {
+			err = err_
+			return ref
+		}
+		// the dollars in the secret are not taken for the variables
+		return strings.Replace(v, "${", "$${", -1)
+	})
+	if err != nil {
+		return "", err
+	}
+	return retval, nil
+}
+
+// SetConfigKey sets the key by which the values prefixed with
+// EncryptedValuePrefix are decrypted.
+func (secrets *Secrets) SetConfigKey(key []byte) error {
+	_, err := configKeyCipher(key)
+	if err != nil {
+		return err
+	}
+	secrets.mtx.Lock()
+	secrets.configKey = key
+	secrets.mtx.Unlock()
+	return nil
+}
+
+func (secrets *Secrets) decrypt(ciphertext string) (string, error) {
+	secrets.mtx.Lock()
+	key := secrets.configKey
+	secrets.mtx.Unlock()
+	if key == nil {
+		return "", errors.New("no configuration key is given to decrypt the value")
+	}
+	return DecryptConfigValue(key, ciphertext)
+}
+
+// Decrypt decrypts the value prefixed with EncryptedValuePrefix by the
+// configuration key, keeping the result to be redacted as the secrets are.
+func (secrets *Secrets) Decrypt(value string) (string, error) {
+	ciphertext := strings.TrimPrefix(value, EncryptedValuePrefix)
+	key := secretKey(SecretSourceEncrypted, ciphertext)
+	secrets.mtx.Lock()
+	v, ok := secrets.values[key]
+	secrets.mtx.Unlock()
+	if ok {
+		return v, nil
+	}
+	v, err := secrets.decrypt(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	secrets.mtx.Lock()
+	secrets.values[key] = v
+	secrets.mtx.Unlock()
+	return v, nil
+}
+
+// Refresh fetches all the secrets resolved so far again, and tells whether
+// any of them has changed.  The ones failing to be fetched keep the values.
+func (secrets *Secrets) Refresh() (bool, error) {
+	secrets.mtx.Lock()
+	keys := make([]string, 0, len(secrets.values))
+	for key := range secrets.values {
+		keys = append(keys, key)
+	}
+	secrets.mtx.Unlock()
+	sort.Strings(keys)
+	changed := false
+	errs := make([]string, 0)
+	for _, key := range keys {
+		i := strings.Index(key, ":")
+		v, err := secrets.fetchSecret(key[:i], key[i+1:])
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		secrets.mtx.Lock()
+		if secrets.values[key] != v {
+			changed = true
+			secrets.redacts = append(secrets.redacts, secrets.values[key])
+			secrets.values[key] = v
+		}
+		secrets.mtx.Unlock()
+	}
+	if len(errs) > 0 {
+		return changed, errors.New(strings.Join(errs, "; "))
+	}
+	return changed, nil
+}
+
+// Redact replaces the secrets in the value, including the ones replaced by
+// refreshing, with xxxxx.
+func (secrets *Secrets) Redact(value string) string {
+	secrets.mtx.Lock()
+	defer secrets.mtx.Unlock()
+	for _, v := range secrets.values {
+		if v != "" {
+			value = strings.Replace(value, v, "xxxxx", -1)
+		}
+	}
+	for _, v := range secrets.redacts {
+		if v != "" {
+			value = strings.Replace(value, v, "xxxxx", -1)
+		}
+	}
+	return value
+}
+
+func NewSecrets() *Secrets {
+	secrets := &Secrets{
+		mtx: sync.Mutex{},
+		fetch: map[string]func(ref string) (string, error){
+			SecretSourceFile:  fetchFileSecret,
+			SecretSourceVault: fetchVaultSecret,
+			SecretSourceAWS:   fetchAWSSecret,
+			SecretSourceGCP:   fetchGCPSecret,
+		},
+		values:    make(map[string]string),
+		redacts:   make([]string, 0),
+		configKey: nil,
+	}
+	// the decrypted values are kept with the secrets to be redacted
+	secrets.fetch[SecretSourceEncrypted] = secrets.decrypt
+	return secrets
+}
+
+// DefaultSecrets resolves the secrets referred to by the configuration.
+var DefaultSecrets = NewSecrets()
+
+// SecretRefresher refreshes the secrets periodically, calling changed when
+// any of them has changed so that the configuration is read again.
+type SecretRefresher struct {
+	logger         *logging.Logger
+	secrets        *Secrets
+	interval       time.Duration
+	changed        func()
+	wg             sync.WaitGroup
+	shutdownChan   chan struct{}
+	isShuttingDown uintptr
+}
+
+func (refresher *SecretRefresher) String() string {
+	return "secret-refresher"
+}
+
+func (refresher *SecretRefresher) refresh() {
+	changed, err := refresher.secrets.Refresh()
+	if err != nil {
+		refresher.logger.Errorf("%s: %s", LogComponent(refresher.String()), LogError(err))
+	}
+	if changed {
+		refresher.logger.Notice("Secrets have changed; reloading the configuration")
+		refresher.changed()
+	}
+}
+
+func (refresher *SecretRefresher) Start() {
+	refresher.wg.Add(1)
+	go func() {
+		defer refresher.wg.Done()
+		ticker := time.NewTicker(refresher.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				refresher.refresh()
+			case <-refresher.shutdownChan:
+				return
+			}
+		}
+	}()
+}
+
+func (refresher *SecretRefresher) Stop() {
+	if atomic.CompareAndSwapUintptr(&refresher.isShuttingDown, 0, 1) {
+		refresher.shutdownChan <- struct{}{}
+	}
+}
+
+func (refresher *SecretRefresher) WaitForShutdown() {
+	refresher.wg.Wait()
+}
+
+func NewSecretRefresher(logger *logging.Logger, secrets *Secrets, interval time.Duration, changed func()) (*SecretRefresher, error) {
+	if interval <= 0 {
+		return nil, errors.New("secret refresh interval must be positive")
+	}
+	return &SecretRefresher{
+		logger:         logger,
+		secrets:        secrets,
+		interval:       interval,
+		changed:        changed,
+		wg:             sync.WaitGroup{},
+		shutdownChan:   make(chan struct{}, 1),
+		isShuttingDown: 0,
+	}, nil
+}
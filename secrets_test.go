@@ -0,0 +1,160 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_SignAWSRequest(t *testing.T) {
+	// the example of the signature version 4 in the documentation of AWS
+	req, _ := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSRequest(req, []byte{}, "iam", "us-east-1", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if actual := req.Header.Get("Authorization"); actual != expected {
+		t.Errorf("unexpected authorization: %s", actual)
+	}
+}
+
+func Test_Secrets(t *testing.T) {
+	defer func(f func(string) (string, bool)) { lookupEnv = f }(lookupEnv)
+	defer func(u string) { gcpSecretManagerURL = u }(gcpSecretManagerURL)
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key")
+	ioutil.WriteFile(keyFile, []byte("from-file\n"), 0600)
+
+	vaultValue := "from-vault"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/secret/data/app":
+			if r.Header.Get("X-Vault-Token") != "vault-token" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"data":     map[string]interface{}{"api_key": vaultValue},
+				"metadata": map[string]interface{}{"version": 1},
+			}})
+		case r.Header.Get("X-Amz-Target") == "secretsmanager.GetSecretValue":
+			body, _ := ioutil.ReadAll(r.Body)
+			if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/secretsmanager/aws4_request") || string(body) != `{"SecretId":"app"}` {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"SecretString": `{"shared_key":"from-aws"}`})
+		case r.URL.Path == "/computeMetadata/v1/instance/service-accounts/default/token":
+			json.NewEncoder(w).Encode(map[string]string{"access_token": "gcp-token"})
+		case r.URL.Path == "/gcp/projects/p/secrets/app/versions/latest:access":
+			if r.Header.Get("Authorization") != "Bearer gcp-token" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"payload": map[string]string{"data": base64.StdEncoding.EncodeToString([]byte("from-gcp"))}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	env := map[string]string{
+		"VAULT_ADDR":                       server.URL,
+		"VAULT_TOKEN":                      "vault-token",
+		"AWS_REGION":                       "eu-west-1",
+		"AWS_ACCESS_KEY_ID":                "AKID",
+		"AWS_SECRET_ACCESS_KEY":            "secret",
+		"AWS_ENDPOINT_URL_SECRETS_MANAGER": server.URL + "/",
+		"GCE_METADATA_HOST":                strings.TrimPrefix(server.URL, "http://"),
+	}
+	lookupEnv = func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	gcpSecretManagerURL = server.URL + "/gcp/"
+
+	secrets := NewSecrets()
+	value, err := secrets.Expand("${file:" + keyFile + "} ${vault:secret/data/app#api_key} ${aws-sm:app#shared_key} ${gcp-sm:projects/p/secrets/app} $${file:x}")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if value != "from-file from-vault from-aws from-gcp $${file:x}" {
+		t.Fatalf("unexpected value: %s", value)
+	}
+	for _, ref := range []string{"${vault:secret/data/app#missing}", "${vault:secret/data/other#key}", "${aws-sm:app#missing}", "${file:" + filepath.Join(dir, "missing") + "}"} {
+		if _, err := secrets.Expand(ref); err == nil {
+			t.Errorf("%s: no error reported", ref)
+		}
+	}
+	if redacted := secrets.Redact("key=from-vault"); redacted != "key=xxxxx" {
+		t.Errorf("unexpected redaction: %s", redacted)
+	}
+
+	// the values are kept until refreshed
+	vaultValue = "refreshed"
+	if value, _ := secrets.Expand("${vault:secret/data/app#api_key}"); value != "from-vault" {
+		t.Errorf("unexpected value: %s", value)
+	}
+	changed, err := secrets.Refresh()
+	if err != nil || !changed {
+		t.Fatalf("unexpected refresh: %v, %v", changed, err)
+	}
+	if value, _ := secrets.Expand("${vault:secret/data/app#api_key}"); value != "refreshed" {
+		t.Errorf("unexpected value: %s", value)
+	}
+	if redacted := secrets.Redact("from-vault refreshed"); redacted != "xxxxx xxxxx" {
+		t.Errorf("unexpected redaction: %s", redacted)
+	}
+	changed, err = secrets.Refresh()
+	if err != nil || changed {
+		t.Fatalf("unexpected refresh: %v, %v", changed, err)
+	}
+}
+
+func Test_ParseConfig_Secrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key")
+	ioutil.WriteFile(keyFile, []byte("a${b}\n"), 0600)
+	sections, err := ParseConfig("test.conf", []byte("[output \"td\"]\napi-key = ${file:"+keyFile+"}\n"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if v := sections[0].Get("api-key", ""); v != "a${b}" {
+		t.Errorf("unexpected value: %s", v)
+	}
+	_, err = ParseConfig("test.conf", []byte("[output \"td\"]\napi-key = ${file:"+filepath.Join(dir, "missing")+"}\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), `test.conf: output "td": api-key: failed to read the secret `) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// DefaultReadBufferSize is the size of the buffer through which the
+// connections of the forward inputs are read unless read-buffer-size is
+// given, large enough for a few reads to take a chunk of PackedForward.
+const DefaultReadBufferSize = 65536
+
+// SocketOptions are the options of the TCP connections of the forward
+// inputs and outputs.
+type SocketOptions struct {
+	// the size of the buffer through which a connection of an input is
+	// read
+	ReadBufferSize int
+	// SO_RCVBUF and SO_SNDBUF; those of the system if 0
+	ReceiveBufferSize int
+	SendBufferSize    int
+	// TCP_NODELAY, which disables Nagle's algorithm
+	NoDelay bool
+}
+
+// DefaultSocketOptions are the options of the forward inputs and outputs,
+// which their parameters override.
+var DefaultSocketOptions = SocketOptions{
+	ReadBufferSize: DefaultReadBufferSize,
+	NoDelay:        true,
+}
+
+// Check checks the sizes.
+func (options SocketOptions) Check() error {
+	if options.ReadBufferSize <= 0 {
+		return errors.New("read-buffer-size must be positive")
+	}
+	if options.ReceiveBufferSize < 0 {
+		return errors.New("socket-receive-buffer may not be negative")
+	}
+	if options.SendBufferSize < 0 {
+		return errors.New("socket-send-buffer may not be negative")
+	}
+	return nil
+}
+
+// apply sets the options of the socket to the connection.
+func (options SocketOptions) apply(conn *net.TCPConn) error {
+	err := conn.SetNoDelay(options.NoDelay)
+	if err != nil {
+		return err
+	}
+	if options.ReceiveBufferSize > 0 {
+		err = conn.SetReadBuffer(options.ReceiveBufferSize)
+		if err != nil {
+			return err
+		}
+	}
+	if options.SendBufferSize > 0 {
+		err = conn.SetWriteBuffer(options.SendBufferSize)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// socketOptionsFromConfig returns the options given by read-buffer-size,
+// socket-receive-buffer, socket-send-buffer and tcp-nodelay of the
+// section, and the rest from defaults.
+func socketOptionsFromConfig(config *ConfigElement, defaults SocketOptions) (SocketOptions, error) {
+	options := defaults
+	err := (error)(nil)
+	options.ReadBufferSize, err = config.GetInt("read-buffer-size", defaults.ReadBufferSize)
+	if err != nil {
+		return options, err
+	}
+	options.ReceiveBufferSize, err = config.GetInt("socket-receive-buffer", defaults.ReceiveBufferSize)
+	if err != nil {
+		return options, err
+	}
+	options.SendBufferSize, err = config.GetInt("socket-send-buffer", defaults.SendBufferSize)
+	if err != nil {
+		return options, err
+	}
+	options.NoDelay, err = config.GetBool("tcp-nodelay", defaults.NoDelay)
+	if err != nil {
+		return options, err
+	}
+	err = options.Check()
+	if err != nil {
+		return options, errors.New(fmt.Sprintf("%s: %s", config.String(), err.Error()))
+	}
+	return options, nil
+}
@@ -0,0 +1,72 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"net"
+	"testing"
+)
+
+func Test_SocketOptionsFromConfig(t *testing.T) {
+	section := NewConfigElement("input", "in")
+	options, err := socketOptionsFromConfig(section, DefaultSocketOptions)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if options != DefaultSocketOptions {
+		t.Errorf("unexpected options: %+v", options)
+	}
+	section.Set("read-buffer-size", "1048576")
+	section.Set("socket-receive-buffer", "262144")
+	section.Set("tcp-nodelay", "false")
+	options, err = socketOptionsFromConfig(section, DefaultSocketOptions)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if options != (SocketOptions{ReadBufferSize: 1048576, ReceiveBufferSize: 262144, NoDelay: false}) {
+		t.Errorf("unexpected options: %+v", options)
+	}
+	section.Set("read-buffer-size", "0")
+	if _, err := socketOptionsFromConfig(section, DefaultSocketOptions); err == nil {
+		t.Error("read-buffer-size of 0 was taken")
+	}
+	section.Set("read-buffer-size", "1024")
+	section.Set("socket-send-buffer", "-1")
+	if _, err := socketOptionsFromConfig(section, DefaultSocketOptions); err == nil {
+		t.Error("negative socket-send-buffer was taken")
+	}
+}
+
+func Test_SocketOptions_Apply(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	options := SocketOptions{ReadBufferSize: DefaultReadBufferSize, ReceiveBufferSize: 65536, SendBufferSize: 65536, NoDelay: false}
+	err = options.apply(conn.(*net.TCPConn))
+	if err != nil {
+		t.Error(err.Error())
+	}
+}
@@ -0,0 +1,221 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// statsDMaxPacketSize keeps a packet within the MTU of the usual networks.
+const statsDMaxPacketSize = 1432
+
+var statsDNameRegexp = regexp.MustCompile(`[^a-zA-Z0-9_\-]`)
+
+var statsDTagReplacer = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+// StatsDEmitter pushes the metrics of a registry to a StatsD server over
+// UDP periodically: the increments of the counters as counters, the gauges
+// as gauges and the observations of the histograms since the last push as
+// timers of their mean, in milliseconds if the histogram is in seconds.
+// The labels become the parts of the name for StatsD, and the tags for
+// DogStatsD.
+type StatsDEmitter struct {
+	logger         *logging.Logger
+	registry       *MetricsRegistry
+	address        string
+	conn           net.Conn
+	dogStatsD      bool
+	prefix         string
+	interval       time.Duration
+	previous       map[string]metricSample
+	wg             sync.WaitGroup
+	shutdownChan   chan struct{}
+	isShuttingDown uintptr
+}
+
+func formatStatsDValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func (emitter *StatsDEmitter) formatName(sample metricSample) (string, string) {
+	name := emitter.prefix + sample.name
+	if emitter.dogStatsD {
+		if len(sample.labelNames) == 0 {
+			return name, ""
+		}
+		tags := make([]string, len(sample.labelNames))
+		for i, labelName := range sample.labelNames {
+			tags[i] = labelName + ":" + statsDTagReplacer.Replace(sample.labelValues[i])
+		}
+		return name, "|#" + strings.Join(tags, ",")
+	}
+	for _, labelValue := range sample.labelValues {
+		name += "." + statsDNameRegexp.ReplaceAllString(labelValue, "_")
+	}
+	return name, ""
+}
+
+// lines returns the lines of the metrics to push, remembering the values
+// to take the differences from in the next push.
+func (emitter *StatsDEmitter) lines() []string {
+	retval := make([]string, 0)
+	previous := make(map[string]metricSample)
+	for _, sample := range emitter.registry.samples() {
+		key := sample.name + "\x00" + strings.Join(sample.labelValues, "\x00")
+		previous[key] = sample
+		last := emitter.previous[key]
+		name, tags := emitter.formatName(sample)
+		switch sample.kind {
+		case metricCounter:
+			delta := sample.value - last.value
+			if delta < 0 {
+				// the counter has been reset
+				delta = sample.value
+			}
+			if delta != 0 {
+				retval = append(retval, name+":"+formatStatsDValue(delta)+"|c"+tags)
+			}
+		case metricGauge:
+			retval = append(retval, name+":"+formatStatsDValue(sample.value)+"|g"+tags)
+		case metricHistogram:
+			if sample.count < last.count {
+				last = metricSample{}
+			}
+			count := sample.count - last.count
+			if count == 0 {
+				continue
+			}
+			mean := (sample.sum - last.sum) / float64(count)
+			if strings.HasSuffix(sample.name, "_seconds") {
+				mean *= 1000
+			}
+			rate := ""
+			if count > 1 {
+				// lets the server count all the observations
+				rate = "|@" + formatStatsDValue(1/float64(count))
+			}
+			retval = append(retval, name+":"+formatStatsDValue(mean)+"|ms"+rate+tags)
+		}
+	}
+	emitter.previous = previous
+	return retval
+}
+
+// push sends the lines in as few packets as possible.
+func (emitter *StatsDEmitter) push() {
+	packet := bytes.Buffer{}
+	send := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		_, err := emitter.conn.Write(packet.Bytes())
+		if err != nil {
+			emitter.logger.Errorf("%s: %s", LogComponent(emitter.String()), LogError(err))
+		}
+		packet.Reset()
+	}
+	for _, line := range emitter.lines() {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsDMaxPacketSize {
+			send()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	send()
+}
+
+func (emitter *StatsDEmitter) String() string {
+	return "statsd:" + emitter.address
+}
+
+func (emitter *StatsDEmitter) Start() {
+	emitter.wg.Add(1)
+	go func() {
+		defer func() {
+			emitter.conn.Close()
+			emitter.wg.Done()
+		}()
+		ticker := time.NewTicker(emitter.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				emitter.push()
+			case <-emitter.shutdownChan:
+				emitter.push()
+				return
+			}
+		}
+	}()
+}
+
+func (emitter *StatsDEmitter) Stop() {
+	if atomic.CompareAndSwapUintptr(&emitter.isShuttingDown, 0, 1) {
+		emitter.shutdownChan <- struct{}{}
+	}
+}
+
+func (emitter *StatsDEmitter) WaitForShutdown() {
+	emitter.wg.Wait()
+}
+
+// NewStatsDEmitter creates the emitter pushing to the address in the format,
+// either "statsd" or "dogstatsd", with the names prefixed by prefix.
+func NewStatsDEmitter(logger *logging.Logger, registry *MetricsRegistry, address string, format string, prefix string, interval time.Duration) (*StatsDEmitter, error) {
+	dogStatsD := false
+	switch format {
+	case "statsd":
+	case "dogstatsd":
+		dogStatsD = true
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown statsd format: %s", format))
+	}
+	if interval <= 0 {
+		return nil, errors.New("statsd interval must be positive")
+	}
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsDEmitter{
+		logger:         logger,
+		registry:       registry,
+		address:        address,
+		conn:           conn,
+		dogStatsD:      dogStatsD,
+		prefix:         prefix,
+		interval:       interval,
+		previous:       make(map[string]metricSample),
+		wg:             sync.WaitGroup{},
+		shutdownChan:   make(chan struct{}, 1),
+		isShuttingDown: 0,
+	}, nil
+}
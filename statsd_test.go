@@ -0,0 +1,95 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func receiveStatsD(t *testing.T, conn net.PacketConn) []string {
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return strings.Split(string(buf[:n]), "\n")
+}
+
+func Test_StatsDEmitter(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("statsd")
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	registry := NewMetricsRegistry()
+	counter := mustCounterVec(registry.NewCounterVec("records_total", "", "tag"))
+	gauge := mustGaugeVec(registry.NewGaugeVec("buffered_bytes", ""))
+	histogram := mustHistogramVec(registry.NewHistogramVec("latency_seconds", "", []float64{1}))
+	counter.With("app.web").Add(3)
+	gauge.With().Set(100)
+	histogram.With().Observe(0.5)
+	histogram.With().Observe(1.5)
+
+	emitter, err := NewStatsDEmitter(logger, registry, conn.LocalAddr().String(), "statsd", "ff.", time.Hour)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	emitter.push()
+	expected := []string{"ff.buffered_bytes:100|g", "ff.latency_seconds:1000|ms|@0.5", "ff.records_total.app_web:3|c"}
+	lines := receiveStatsD(t, conn)
+	if strings.Join(lines, " ") != strings.Join(expected, " ") {
+		t.Errorf("unexpected lines: %v", lines)
+	}
+	// only the increments are pushed
+	counter.With("app.web").Add(2)
+	emitter.push()
+	expected = []string{"ff.buffered_bytes:100|g", "ff.records_total.app_web:2|c"}
+	lines = receiveStatsD(t, conn)
+	if strings.Join(lines, " ") != strings.Join(expected, " ") {
+		t.Errorf("unexpected lines: %v", lines)
+	}
+	emitter.Start()
+	emitter.Stop()
+	emitter.WaitForShutdown()
+	// pushed on shutdown
+	lines = receiveStatsD(t, conn)
+	if strings.Join(lines, " ") != "ff.buffered_bytes:100|g" {
+		t.Errorf("unexpected lines: %v", lines)
+	}
+
+	emitter, err = NewStatsDEmitter(logger, registry, conn.LocalAddr().String(), "dogstatsd", "", time.Hour)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	emitter.push()
+	lines = receiveStatsD(t, conn)
+	if lines[2] != "records_total:5|c|#tag:app.web" {
+		t.Errorf("unexpected lines: %v", lines)
+	}
+	if _, err := NewStatsDEmitter(logger, registry, conn.LocalAddr().String(), "graphite", "", time.Hour); err == nil {
+		t.Fail()
+	}
+}
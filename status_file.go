@@ -0,0 +1,184 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"encoding/json"
+	"errors"
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StatusFileOutput is the state of an output written to the status file.
+type StatusFileOutput struct {
+	Name          string `json:"name"`
+	IsUpstreamUp  bool   `json:"upstream_up"`
+	BufferedBytes int64  `json:"buffered_bytes"`
+	// in RFC 3339; empty if no flush has succeeded
+	LastFlushedAt string `json:"last_flushed_at"`
+}
+
+// Status is the content of the status file.
+type Status struct {
+	Pid       int                `json:"pid"`
+	StartedAt string             `json:"started_at"`
+	UpdatedAt string             `json:"updated_at"`
+	Uptime    float64            `json:"uptime_seconds"`
+	Outputs   []StatusFileOutput `json:"outputs"`
+}
+
+// StatusFile writes the status of the forwarder to a file periodically, so
+// that the monitoring looking at the files can tell the forwarder is alive
+// by updated_at and that the outputs are delivering by last_flushed_at.
+// The file is replaced atomically by renaming a temporary file next to it.
+type StatusFile struct {
+	logger         *logging.Logger
+	path           string
+	outputs        func() []Output
+	interval       time.Duration
+	startedAt      time.Time
+	now            func() time.Time
+	wg             sync.WaitGroup
+	shutdownChan   chan struct{}
+	isShuttingDown uintptr
+}
+
+func formatStatusTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (statusFile *StatusFile) status() Status {
+	now := statusFile.now()
+	outputs := make([]StatusFileOutput, 0)
+	for _, output := range statusFile.outputs() {
+		output, ok := output.(HealthReportingOutput)
+		if !ok {
+			continue
+		}
+		health := output.Health()
+		outputs = append(outputs, StatusFileOutput{
+			Name:          health.Name,
+			IsUpstreamUp:  health.IsUpstreamUp,
+			BufferedBytes: health.BufferedBytes,
+			LastFlushedAt: formatStatusTime(health.LastFlushedAt),
+		})
+	}
+	return Status{
+		Pid:       os.Getpid(),
+		StartedAt: formatStatusTime(statusFile.startedAt),
+		UpdatedAt: formatStatusTime(now),
+		Uptime:    now.Sub(statusFile.startedAt).Seconds(),
+		Outputs:   outputs,
+	}
+}
+
+// Write writes the current status to the file.
+func (statusFile *StatusFile) Write() error {
+	dir, name := filepath.Split(statusFile.path)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, "."+name+".*")
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(statusFile.status())
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	err_ := f.Close()
+	if err == nil {
+		err = err_
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), statusFile.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (statusFile *StatusFile) write() {
+	err := statusFile.Write()
+	if err != nil {
+		statusFile.logger.Errorf("%s: failed to write the status: %s", LogComponent(statusFile.String()), LogError(err))
+	}
+}
+
+func (statusFile *StatusFile) String() string {
+	return "status-file:" + statusFile.path
+}
+
+func (statusFile *StatusFile) Start() {
+	statusFile.wg.Add(1)
+	go func() {
+		defer statusFile.wg.Done()
+		statusFile.write()
+		ticker := time.NewTicker(statusFile.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				statusFile.write()
+			case <-statusFile.shutdownChan:
+				statusFile.write()
+				return
+			}
+		}
+	}()
+}
+
+func (statusFile *StatusFile) Stop() {
+	if atomic.CompareAndSwapUintptr(&statusFile.isShuttingDown, 0, 1) {
+		statusFile.shutdownChan <- struct{}{}
+	}
+}
+
+func (statusFile *StatusFile) WaitForShutdown() {
+	statusFile.wg.Wait()
+}
+
+// NewStatusFile creates a StatusFile writing to path every interval;
+// outputs returns the outputs to report, which may change by reloading.
+func NewStatusFile(logger *logging.Logger, path string, outputs func() []Output, interval time.Duration) (*StatusFile, error) {
+	if interval <= 0 {
+		return nil, errors.New("status interval must be positive")
+	}
+	return &StatusFile{
+		logger:         logger,
+		path:           path,
+		outputs:        outputs,
+		interval:       interval,
+		startedAt:      time.Now(),
+		now:            time.Now,
+		wg:             sync.WaitGroup{},
+		shutdownChan:   make(chan struct{}, 1),
+		isShuttingDown: 0,
+	}, nil
+}
@@ -0,0 +1,77 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"encoding/json"
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_StatusFile(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("status")
+	tempDir, err := ioutil.TempDir("", "status")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, "status.json")
+	output := &healthReportingOutput{health: OutputHealth{Name: "127.0.0.1:24224", IsUpstreamUp: true, BufferedBytes: 100, LastFlushedAt: time.Unix(1005, 0).UTC()}}
+	statusFile, err := NewStatusFile(logger, path, func() []Output { return []Output{output} }, time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	statusFile.startedAt = time.Unix(1000, 0).UTC()
+	statusFile.now = func() time.Time { return time.Unix(1010, 0).UTC() }
+	err = statusFile.Write()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	status := Status{}
+	err = json.Unmarshal(content, &status)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if status.Pid != os.Getpid() || status.UpdatedAt != "1970-01-01T00:16:50Z" || status.Uptime != 10 || len(status.Outputs) != 1 {
+		t.Logf("%s", content)
+		t.FailNow()
+	}
+	if status.Outputs[0].LastFlushedAt != "1970-01-01T00:16:45Z" || status.Outputs[0].BufferedBytes != 100 || !status.Outputs[0].IsUpstreamUp {
+		t.Logf("%s", content)
+		t.Fail()
+	}
+	// no temporary file is left behind
+	entries, _ := ioutil.ReadDir(tempDir)
+	if len(entries) != 1 {
+		t.Fail()
+	}
+
+	if _, err := NewStatusFile(logger, path, nil, 0); err == nil {
+		t.Fail()
+	}
+}
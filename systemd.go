@@ -0,0 +1,146 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"fmt"
+	logging "github.com/op/go-logging"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SystemdNotifier tells systemd the state of the forwarder through the
+// notification socket of a service of Type=notify, and pings the watchdog
+// of WatchdogSec= while the forwarder is live, so that systemd restarts
+// the forwarder once it has hung.
+type SystemdNotifier struct {
+	logger           *logging.Logger
+	socket           string
+	watchdogInterval time.Duration
+	live             func() error
+	wg               sync.WaitGroup
+	shutdownChan     chan struct{}
+	isShuttingDown   uintptr
+}
+
+// SystemdWatchdogInterval returns the interval in which the watchdog of
+// the service is to be pinged, half its timeout, or 0 if it is not
+// enabled for this process.
+func SystemdWatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// Notify sends the state, like "READY=1", to systemd.
+func (notifier *SystemdNotifier) Notify(state string) error {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: notifier.socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+func (notifier *SystemdNotifier) notify(state string) {
+	err := notifier.Notify(state)
+	if err != nil {
+		notifier.logger.Warningf("%s: failed to notify %s: %s", LogComponent(notifier.String()), state, LogError(err))
+	}
+}
+
+// Ready tells that the forwarder has started up.
+func (notifier *SystemdNotifier) Ready() {
+	notifier.notify("READY=1")
+}
+
+// MainPID tells the process taking over the service, which systemd follows
+// after this one exits.
+func (notifier *SystemdNotifier) MainPID(pid int) {
+	notifier.notify(fmt.Sprintf("MAINPID=%d", pid))
+}
+
+func (notifier *SystemdNotifier) String() string {
+	return "systemd-notifier"
+}
+
+func (notifier *SystemdNotifier) Start() {
+	notifier.wg.Add(1)
+	go func() {
+		defer notifier.wg.Done()
+		tick := (<-chan time.Time)(nil)
+		if notifier.watchdogInterval > 0 {
+			ticker := time.NewTicker(notifier.watchdogInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-tick:
+				err := notifier.live()
+				if err != nil {
+					notifier.logger.Warningf("%s: not pinging the watchdog: %s", LogComponent(notifier.String()), LogError(err))
+					continue
+				}
+				notifier.notify("WATCHDOG=1")
+			case <-notifier.shutdownChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop tells that the forwarder is stopping, as it drains, and stops
+// pinging the watchdog.
+func (notifier *SystemdNotifier) Stop() {
+	if atomic.CompareAndSwapUintptr(&notifier.isShuttingDown, 0, 1) {
+		notifier.notify("STOPPING=1")
+		notifier.shutdownChan <- struct{}{}
+	}
+}
+
+func (notifier *SystemdNotifier) WaitForShutdown() {
+	notifier.wg.Wait()
+}
+
+// NewSystemdNotifier creates a SystemdNotifier sending to the socket, given
+// by $NOTIFY_SOCKET, and pinging the watchdog every watchdogInterval while
+// live returns no error.  The watchdog is not pinged if watchdogInterval
+// is 0.
+func NewSystemdNotifier(logger *logging.Logger, socket string, watchdogInterval time.Duration, live func() error) *SystemdNotifier {
+	return &SystemdNotifier{
+		logger:           logger,
+		socket:           socket,
+		watchdogInterval: watchdogInterval,
+		live:             live,
+		wg:               sync.WaitGroup{},
+		shutdownChan:     make(chan struct{}, 1),
+		isShuttingDown:   0,
+	}
+}
@@ -0,0 +1,112 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_SystemdNotifier(t *testing.T) {
+	logging.InitForTesting(logging.CRITICAL)
+	logger := logging.MustGetLogger("systemd")
+	dir, err := ioutil.TempDir("", "systemd")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	receive := func() string {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 256)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return string(buf[:n])
+	}
+
+	isLive := uintptr(0)
+	notifier := NewSystemdNotifier(logger, socket, 10*time.Millisecond, func() error {
+		if atomic.LoadUintptr(&isLive) == 0 {
+			return errors.New("hung")
+		}
+		return nil
+	})
+	notifier.Start()
+	notifier.Ready()
+	if state := receive(); state != "READY=1" {
+		t.Errorf("unexpected state: %s", state)
+	}
+	// not pinged until live
+	time.Sleep(50 * time.Millisecond)
+	atomic.StoreUintptr(&isLive, 1)
+	if state := receive(); state != "WATCHDOG=1" {
+		t.Errorf("unexpected state: %s", state)
+	}
+	notifier.MainPID(1234)
+	for state := receive(); state != "MAINPID=1234"; state = receive() {
+		if state != "WATCHDOG=1" {
+			t.Errorf("unexpected state: %s", state)
+		}
+	}
+	notifier.Stop()
+	notifier.WaitForShutdown()
+	for state := receive(); state != "STOPPING=1"; state = receive() {
+		if state != "WATCHDOG=1" {
+			t.Errorf("unexpected state: %s", state)
+		}
+	}
+}
+
+func Test_SystemdWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+	os.Unsetenv("WATCHDOG_PID")
+	os.Unsetenv("WATCHDOG_USEC")
+	if interval := SystemdWatchdogInterval(); interval != 0 {
+		t.Errorf("unexpected interval: %s", interval)
+	}
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	if interval := SystemdWatchdogInterval(); interval != 15*time.Second {
+		t.Errorf("unexpected interval: %s", interval)
+	}
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if interval := SystemdWatchdogInterval(); interval != 15*time.Second {
+		t.Errorf("unexpected interval: %s", interval)
+	}
+	// meant for another process
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if interval := SystemdWatchdogInterval(); interval != 0 {
+		t.Errorf("unexpected interval: %s", interval)
+	}
+}
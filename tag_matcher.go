@@ -0,0 +1,105 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// TagMatcher matches tags against fluentd-style patterns. "*" matches a
+// single tag part (a.* matches a.b but not a.b.c), "**" matches zero or more
+// tag parts (a.** matches a, a.b and a.b.c) and "{x,y}" matches either x or y.
+// Multiple patterns may be given separated by whitespace.
+type TagMatcher struct {
+	pattern string
+	regexp  *regexp.Regexp
+}
+
+func compileTagPattern(pattern string) (string, error) {
+	buf := []byte{}
+	depth := 0
+	for i := 0; i < len(pattern); {
+		c := pattern[i]
+		switch {
+		case c == '.' && strings.HasPrefix(pattern[i:], ".**") && (i+3 == len(pattern) || pattern[i+3] == '.' || pattern[i+3] == '}' || pattern[i+3] == ','):
+			buf = append(buf, `(?:\..*)?`...)
+			i += 3
+		case c == '*' && strings.HasPrefix(pattern[i:], "**.") && (i == 0 || pattern[i-1] == '{' || pattern[i-1] == ','):
+			buf = append(buf, `(?:.*\.)?`...)
+			i += 3
+		case c == '*' && strings.HasPrefix(pattern[i:], "**"):
+			buf = append(buf, `.*`...)
+			i += 2
+		case c == '*':
+			buf = append(buf, `[^.]*`...)
+			i += 1
+		case c == '{':
+			buf = append(buf, `(?:`...)
+			depth += 1
+			i += 1
+		case c == ',' && depth > 0:
+			buf = append(buf, '|')
+			i += 1
+		case c == '}' && depth > 0:
+			buf = append(buf, ')')
+			depth -= 1
+			i += 1
+		default:
+			buf = append(buf, regexp.QuoteMeta(pattern[i:i+1])...)
+			i += 1
+		}
+	}
+	if depth != 0 {
+		return "", errors.New(fmt.Sprintf("unbalanced braces in tag pattern: %s", pattern))
+	}
+	return string(buf), nil
+}
+
+func (matcher *TagMatcher) Match(tag string) bool {
+	return matcher.regexp.MatchString(tag)
+}
+
+func (matcher *TagMatcher) String() string {
+	return matcher.pattern
+}
+
+func NewTagMatcher(pattern string) (*TagMatcher, error) {
+	alternatives := strings.Fields(pattern)
+	if len(alternatives) == 0 {
+		return nil, errors.New("empty tag pattern")
+	}
+	for i, alternative := range alternatives {
+		re, err := compileTagPattern(alternative)
+		if err != nil {
+			return nil, err
+		}
+		alternatives[i] = re
+	}
+	re, err := regexp.Compile(`\A(?:` + strings.Join(alternatives, "|") + `)\z`)
+	if err != nil {
+		return nil, err
+	}
+	return &TagMatcher{
+		pattern: pattern,
+		regexp:  re,
+	}, nil
+}
@@ -0,0 +1,69 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import "testing"
+
+func Test_TagMatcher(t *testing.T) {
+	cases := []struct {
+		pattern string
+		tag     string
+		result  bool
+	}{
+		{"a", "a", true},
+		{"a", "b", false},
+		{"a.*", "a.b", true},
+		{"a.*", "a.b.c", false},
+		{"a.*", "a", false},
+		{"a.**", "a", true},
+		{"a.**", "a.b", true},
+		{"a.**", "a.b.c", true},
+		{"a.**", "ab", false},
+		{"**.c", "c", true},
+		{"**.c", "a.b.c", true},
+		{"**.c", "a.bc", false},
+		{"a.**.c", "a.c", true},
+		{"a.**.c", "a.b.c", true},
+		{"a.**.c", "a.b.b.c", true},
+		{"a.**.c", "a.bc", false},
+		{"**", "a.b.c", true},
+		{"a.{b,c}", "a.b", true},
+		{"a.{b,c}", "a.c", true},
+		{"a.{b,c}", "a.d", false},
+		{"a.{b,c.**}", "a.c.d", true},
+		{"a b.*", "a", true},
+		{"a b.*", "b.c", true},
+		{"a b.*", "c", false},
+	}
+	for _, c := range cases {
+		matcher, err := NewTagMatcher(c.pattern)
+		if err != nil {
+			t.Logf("%s: %s", c.pattern, err.Error())
+			t.FailNow()
+		}
+		if matcher.Match(c.tag) != c.result {
+			t.Logf("pattern=%s, tag=%s, expected=%v", c.pattern, c.tag, c.result)
+			t.Fail()
+		}
+	}
+	_, err := NewTagMatcher("a.{b,c")
+	if err == nil {
+		t.Fail()
+	}
+}
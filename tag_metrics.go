@@ -0,0 +1,158 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"strings"
+	"sync"
+)
+
+// OtherTag is the tag the records are counted under once TagMetrics has
+// reached its limit.
+const OtherTag = "__other__"
+
+// TagMetrics counts the records and the bytes received by tag.  To keep the
+// number of the series bounded, the tags are cut down to their first depth
+// parts if depth is positive, and the tags beyond the first limit ones are
+// counted as OtherTag.  A limit of 0 disables the counting.
+type TagMetrics struct {
+	mtx     sync.RWMutex
+	limit   int
+	depth   int
+	series  map[string]*tagSeries
+	records *CounterVec
+	bytes   *CounterVec
+}
+
+type tagSeries struct {
+	records *Counter
+	bytes   *Counter
+}
+
+func (metrics *TagMetrics) label(tag string) string {
+	if metrics.depth > 0 {
+		parts := strings.SplitN(tag, ".", metrics.depth+1)
+		if len(parts) > metrics.depth {
+			tag = strings.Join(parts[:metrics.depth], ".")
+		}
+	}
+	return tag
+}
+
+func (metrics *TagMetrics) getSeries(tag string) *tagSeries {
+	// the series of the tags seen so far are looked up without blocking
+	// each other
+	metrics.mtx.RLock()
+	if metrics.limit <= 0 {
+		metrics.mtx.RUnlock()
+		return nil
+	}
+	label := metrics.label(tag)
+	series, ok := metrics.series[label]
+	if !ok && len(metrics.series) >= metrics.limit {
+		series, ok = metrics.series[OtherTag]
+	}
+	metrics.mtx.RUnlock()
+	if ok {
+		return series
+	}
+	metrics.mtx.Lock()
+	defer metrics.mtx.Unlock()
+	if metrics.limit <= 0 {
+		return nil
+	}
+	label = metrics.label(tag)
+	series, ok = metrics.series[label]
+	if ok {
+		return series
+	}
+	if len(metrics.series) >= metrics.limit {
+		label = OtherTag
+		series, ok = metrics.series[label]
+		if ok {
+			return series
+		}
+	}
+	series = &tagSeries{
+		records: metrics.records.With(label),
+		bytes:   metrics.bytes.With(label),
+	}
+	metrics.series[label] = series
+	return series
+}
+
+// Observe counts the records with the tag received in the bytes.
+func (metrics *TagMetrics) Observe(tag string, records int, bytes int64) {
+	metrics.ObserveShard(0, tag, records, bytes)
+}
+
+// ObserveShard counts as Observe does into the shard of the counters, as
+// Counter.AddShard does.
+func (metrics *TagMetrics) ObserveShard(shard uint32, tag string, records int, bytes int64) {
+	series := metrics.getSeries(tag)
+	if series == nil {
+		return
+	}
+	series.records.AddShard(shard, float64(records))
+	series.bytes.AddShard(shard, float64(bytes))
+}
+
+// SetLimits changes the limit and the depth, dropping the series counted so
+// far.
+func (metrics *TagMetrics) SetLimits(limit int, depth int) {
+	metrics.mtx.Lock()
+	defer metrics.mtx.Unlock()
+	for label := range metrics.series {
+		metrics.records.Delete(label)
+		metrics.bytes.Delete(label)
+	}
+	metrics.limit = limit
+	metrics.depth = depth
+	metrics.series = make(map[string]*tagSeries)
+}
+
+func NewTagMetrics(registry *MetricsRegistry, limit int, depth int) (*TagMetrics, error) {
+	records, err := registry.NewCounterVec("fluentd_forwarder_tag_records_total", "Number of the records received by tag.", "tag")
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := registry.NewCounterVec("fluentd_forwarder_tag_bytes_total", "Number of the bytes received by tag.", "tag")
+	if err != nil {
+		return nil, err
+	}
+	return &TagMetrics{
+		mtx:     sync.RWMutex{},
+		limit:   limit,
+		depth:   depth,
+		series:  make(map[string]*tagSeries),
+		records: records,
+		bytes:   bytes,
+	}, nil
+}
+
+// DefaultTagMetrics counts what the built-in inputs receive into
+// DefaultMetrics.
+var DefaultTagMetrics = mustTagMetrics(NewTagMetrics(DefaultMetrics, 100, 0))
+
+func mustTagMetrics(metrics *TagMetrics, err error) *TagMetrics {
+	if err != nil {
+		panic(err.Error())
+	}
+	return metrics
+}
@@ -0,0 +1,101 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	logging "github.com/op/go-logging"
+	"github.com/ugorji/go/codec"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_TagMetrics(t *testing.T) {
+	metrics, err := NewTagMetrics(NewMetricsRegistry(), 2, 2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	metrics.Observe("app.web.access", 1, 10)
+	metrics.Observe("app.web.error", 2, 20)
+	metrics.Observe("app.db", 1, 5)
+	metrics.Observe("system", 1, 1)
+	metrics.Observe("kernel", 1, 1)
+	expected := map[string]float64{"app.web": 3, "app.db": 1, OtherTag: 2}
+	for label, value := range expected {
+		if v := metrics.records.With(label).Value(); v != value {
+			t.Logf("%s: expected %v, got %v", label, value, v)
+			t.Fail()
+		}
+	}
+	if metrics.bytes.With("app.web").Value() != 30 {
+		t.Fail()
+	}
+	metrics.SetLimits(0, 0)
+	metrics.Observe("app", 1, 1)
+	if len(metrics.series) != 0 {
+		t.Fail()
+	}
+}
+
+func Test_TagMetrics_ForwardInput(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("tag_metrics")
+	port := &recordingPort{}
+	input, err := NewForwardInput(logger, "127.0.0.1:0", port)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	input.tagMetrics, err = NewTagMetrics(NewMetricsRegistry(), 10, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	input.Start()
+	defer func() {
+		input.Stop()
+		input.WaitForShutdown()
+	}()
+	buffer := bytes.Buffer{}
+	handle := &codec.MsgpackHandle{}
+	encoder := codec.NewEncoder(&buffer, handle)
+	encoder.Encode([]interface{}{[]byte("a"), float64(1), map[string]interface{}{"message": "hello"}})
+	sizeOfA := buffer.Len()
+	encoder.Encode([]interface{}{[]byte("b"), float64(2), map[string]interface{}{"message": "hello, world"}})
+	conn, err := net.Dial("tcp", input.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	_, err = conn.Write(buffer.Bytes())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	records := input.tagMetrics.records.With("b")
+	for i := 0; i < 100 && records.Value() == 0; i += 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v := input.tagMetrics.bytes.With("a").Value(); v != float64(sizeOfA) {
+		t.Logf("expected %d, got %v", sizeOfA, v)
+		t.Fail()
+	}
+	if v := input.tagMetrics.bytes.With("b").Value(); v != float64(buffer.Len()-sizeOfA) {
+		t.Logf("expected %d, got %v", buffer.Len()-sizeOfA, v)
+		t.Fail()
+	}
+}
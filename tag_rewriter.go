@@ -0,0 +1,123 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// TagRewriter changes the tag by removing a prefix, then substituting the
+// matches of the regexps in order, and finally adding a prefix.  The
+// prefixes are separated from the rest of the tag by a dot.
+type TagRewriter struct {
+	RemovePrefix  string
+	Substitutions []ReplaceRule
+	AddPrefix     string
+}
+
+func (rewriter *TagRewriter) Rewrite(tag string) string {
+	if rewriter.RemovePrefix != "" {
+		if tag == rewriter.RemovePrefix {
+			tag = ""
+		} else if strings.HasPrefix(tag, rewriter.RemovePrefix+".") {
+			tag = tag[len(rewriter.RemovePrefix)+1:]
+		}
+	}
+	for _, substitution := range rewriter.Substitutions {
+		tag = substitution.Regexp.ReplaceAllString(tag, substitution.Replacement)
+	}
+	if rewriter.AddPrefix != "" {
+		if tag == "" {
+			tag = rewriter.AddPrefix
+		} else {
+			tag = rewriter.AddPrefix + "." + tag
+		}
+	}
+	return tag
+}
+
+// TagRewritingPort rewrites the tags of the records before passing them on.
+type TagRewritingPort struct {
+	rewriter *TagRewriter
+	next     Port
+}
+
+func (port *TagRewritingPort) Emit(recordSets []FluentRecordSet) error {
+	rewritten := make([]FluentRecordSet, 0, len(recordSets))
+	for _, recordSet := range recordSets {
+		rewritten = append(rewritten, FluentRecordSet{
+			Tag:     port.rewriter.Rewrite(recordSet.Tag),
+			Records: recordSet.Records,
+			Trace:   recordSet.Trace,
+		})
+	}
+	return port.next.Emit(rewritten)
+}
+
+func NewTagRewritingPort(rewriter *TagRewriter, next Port) *TagRewritingPort {
+	return &TagRewritingPort{
+		rewriter: rewriter,
+		next:     next,
+	}
+}
+
+// NewTagRewriter returns the rewriter removing and adding the prefixes,
+// which may be empty, and substituting the matches of the regexps, each
+// given as a regexp optionally followed by the replacement, or nil if it
+// would change nothing.
+func NewTagRewriter(removePrefix string, substitutions []string, addPrefix string) (*TagRewriter, error) {
+	rewriter := &TagRewriter{
+		RemovePrefix:  strings.TrimSuffix(removePrefix, "."),
+		Substitutions: make([]ReplaceRule, 0),
+		AddPrefix:     strings.TrimSuffix(addPrefix, "."),
+	}
+	for _, value := range substitutions {
+		// the replacement may be omitted to remove the matches
+		fields := strings.Fields(value)
+		if len(fields) < 1 || len(fields) > 2 {
+			return nil, errors.New(fmt.Sprintf("tag-substitute must be a regexp optionally followed by the replacement: %s", value))
+		}
+		re, err := regexp.Compile(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		replacement := ""
+		if len(fields) == 2 {
+			replacement = fields[1]
+		}
+		rewriter.Substitutions = append(rewriter.Substitutions, ReplaceRule{Regexp: re, Replacement: replacement})
+	}
+	if rewriter.RemovePrefix == "" && rewriter.AddPrefix == "" && len(rewriter.Substitutions) == 0 {
+		return nil, nil
+	}
+	return rewriter, nil
+}
+
+// newTagRewriterFromConfig reads remove-tag-prefix, tag-substitute and
+// add-tag-prefix, returning nil if none of them is given.
+func newTagRewriterFromConfig(config *ConfigElement) (*TagRewriter, error) {
+	rewriter, err := NewTagRewriter(config.Get("remove-tag-prefix", ""), config.GetAll("tag-substitute"), config.Get("add-tag-prefix", ""))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", config.String(), err.Error()))
+	}
+	return rewriter, nil
+}
@@ -0,0 +1,56 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"testing"
+)
+
+func Test_TagRewriter(t *testing.T) {
+	config := NewConfigElement("output", "test")
+	config.Add("remove-tag-prefix", "kube.")
+	config.Add("tag-substitute", `^var\.log\.containers\. containers.`)
+	config.Add("tag-substitute", `\.log$`)
+	config.Add("add-tag-prefix", "dc1")
+	rewriter, err := newTagRewriterFromConfig(config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cases := [][2]string{
+		{"kube.var.log.containers.app.log", "dc1.containers.app"},
+		{"kubernetes.app", "dc1.kubernetes.app"},
+		{"kube", "dc1"},
+	}
+	for _, c := range cases {
+		if tag := rewriter.Rewrite(c[0]); tag != c[1] {
+			t.Logf("%s: %s", c[0], tag)
+			t.Fail()
+		}
+	}
+	next := &recordingPort{}
+	input := []FluentRecordSet{{Tag: "kube.a", Records: []TinyFluentRecord{{Timestamp: 0, Data: map[string]interface{}{}}}}}
+	NewTagRewritingPort(rewriter, next).Emit(input)
+	if input[0].Tag != "kube.a" || next.recordSets[0].Tag != "dc1.a" {
+		t.Logf("%+v", next.recordSets)
+		t.Fail()
+	}
+	if rewriter, err := newTagRewriterFromConfig(NewConfigElement("output", "none")); rewriter != nil || err != nil {
+		t.Fail()
+	}
+}
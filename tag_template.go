@@ -0,0 +1,143 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tagTemplatePart struct {
+	literal string
+	// one of "", "tag", "tag_parts" and "fields"
+	kind  string
+	index int
+	field *RecordAccessor
+}
+
+// TagTemplate expands placeholders in a string with the tag and the values
+// of the record: ${tag}, ${tag_parts[N]} (negative N counts from the end)
+// and ${fields.KEY}, where KEY may be a dot-separated path to a nested value,
+// or ${$.KEY} with a record accessor.
+type TagTemplate struct {
+	template string
+	parts    []tagTemplatePart
+}
+
+func parseTagPlaceholder(placeholder string) (tagTemplatePart, error) {
+	switch {
+	case placeholder == "tag":
+		return tagTemplatePart{kind: "tag"}, nil
+	case strings.HasPrefix(placeholder, "tag_parts[") && strings.HasSuffix(placeholder, "]"):
+		index, err := strconv.Atoi(placeholder[len("tag_parts[") : len(placeholder)-1])
+		if err != nil {
+			return tagTemplatePart{}, errors.New(fmt.Sprintf("invalid index in ${%s}", placeholder))
+		}
+		return tagTemplatePart{kind: "tag_parts", index: index}, nil
+	case strings.HasPrefix(placeholder, "fields.") && len(placeholder) > len("fields."):
+		accessor, err := NewDottedRecordAccessor(placeholder[len("fields."):])
+		if err != nil {
+			return tagTemplatePart{}, errors.New(fmt.Sprintf("invalid field in ${%s}: %s", placeholder, err.Error()))
+		}
+		return tagTemplatePart{kind: "fields", field: accessor}, nil
+	case strings.HasPrefix(placeholder, "$"):
+		accessor, err := NewRecordAccessor(placeholder)
+		if err != nil {
+			return tagTemplatePart{}, errors.New(fmt.Sprintf("invalid field in ${%s}: %s", placeholder, err.Error()))
+		}
+		return tagTemplatePart{kind: "fields", field: accessor}, nil
+	}
+	return tagTemplatePart{}, errors.New(fmt.Sprintf("unknown placeholder ${%s}", placeholder))
+}
+
+// Expand returns the expanded string and whether all the placeholders
+// have been resolved; the unresolved ones are replaced with missing.
+func (template *TagTemplate) Expand(tag string, data map[string]interface{}, missing string) (string, bool) {
+	buf := make([]byte, 0, len(template.template))
+	resolved := true
+	tagParts := []string(nil)
+	for _, part := range template.parts {
+		value := ""
+		switch part.kind {
+		case "":
+			buf = append(buf, part.literal...)
+			continue
+		case "tag":
+			value = tag
+		case "tag_parts":
+			if tagParts == nil {
+				tagParts = strings.Split(tag, ".")
+			}
+			i := part.index
+			if i < 0 {
+				i += len(tagParts)
+			}
+			if i >= 0 && i < len(tagParts) {
+				value = tagParts[i]
+			}
+		case "fields":
+			if v, ok := part.field.Get(data); ok && v != nil {
+				value = groupValueString(v)
+			}
+		}
+		if value == "" {
+			value = missing
+			resolved = false
+		}
+		buf = append(buf, value...)
+	}
+	return string(buf), resolved
+}
+
+func (template *TagTemplate) String() string {
+	return template.template
+}
+
+func NewTagTemplate(template string) (*TagTemplate, error) {
+	parts := make([]tagTemplatePart, 0)
+	rest := template
+	for {
+		i := strings.Index(rest, "${")
+		if i < 0 {
+			break
+		}
+		j := strings.Index(rest[i:], "}")
+		if j < 0 {
+			return nil, errors.New(fmt.Sprintf("unterminated placeholder in %s", template))
+		}
+		if i > 0 {
+			parts = append(parts, tagTemplatePart{literal: rest[:i]})
+		}
+		part, err := parseTagPlaceholder(rest[i+2 : i+j])
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+		rest = rest[i+j+1:]
+	}
+	if rest != "" {
+		parts = append(parts, tagTemplatePart{literal: rest})
+	}
+	return &TagTemplate{
+		template: template,
+		parts:    parts,
+	}, nil
+}
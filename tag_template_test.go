@@ -0,0 +1,60 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"testing"
+)
+
+func Test_TagTemplate(t *testing.T) {
+	data := map[string]interface{}{
+		"service": []byte("web"),
+		"level":   "error",
+		"http":    map[string]interface{}{"status": int64(500)},
+	}
+	cases := []struct {
+		template string
+		expected string
+		resolved bool
+	}{
+		{"app.${fields.service}.${fields.level}", "app.web.error", true},
+		{"${tag}.${fields.http.status}", "docker.app.500", true},
+		{"${tag}.${$['http'].status}", "docker.app.500", true},
+		{"${tag_parts[0]}-${tag_parts[-1]}", "docker-app", true},
+		{"x.${fields.missing}.${tag_parts[5]}", "x.unknown.unknown", false},
+		{"static", "static", true},
+	}
+	for _, c := range cases {
+		template, err := NewTagTemplate(c.template)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		result, resolved := template.Expand("docker.app", data, "unknown")
+		if result != c.expected || resolved != c.resolved {
+			t.Logf("%s: %s %v", c.template, result, resolved)
+			t.Fail()
+		}
+	}
+	for _, template := range []string{"${fields.a", "${nothing}", "${tag_parts[x]}"} {
+		if _, err := NewTagTemplate(template); err == nil {
+			t.Logf("%s", template)
+			t.Fail()
+		}
+	}
+}
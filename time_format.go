@@ -0,0 +1,173 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	strftime "github.com/jehiah/go-strftime"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The formats of the time taken by NewTimeFormatter besides the strftime
+// patterns, which contain %, and the layouts of Go.
+const (
+	// the seconds since the epoch as an integer
+	TimeFormatEpoch = "epoch"
+	// the milliseconds since the epoch as an integer
+	TimeFormatEpochMillis = "epoch-millis"
+	// the string like 2014-10-15T21:00:00+09:00
+	TimeFormatRFC3339 = "rfc3339"
+)
+
+var timezoneOffsetRegexp = regexp.MustCompile(`^([+-])(\d\d):?(\d\d)$`)
+
+// TimeFormatter stores the time of the records in a field in a format and
+// a timezone, for the destinations that expect other than the seconds since
+// the epoch the forward protocol carries.
+type TimeFormatter struct {
+	key      *RecordAccessor
+	format   string
+	location *time.Location
+}
+
+// Format returns the time as a value of the field.
+func (formatter *TimeFormatter) Format(timestamp uint64) interface{} {
+	switch formatter.format {
+	case TimeFormatEpoch:
+		return timestamp
+	case TimeFormatEpochMillis:
+		return timestamp * 1000
+	}
+	t := time.Unix(int64(timestamp), 0).In(formatter.location)
+	if formatter.format == TimeFormatRFC3339 {
+		return t.Format(time.RFC3339)
+	}
+	if strings.ContainsRune(formatter.format, '%') {
+		return strftime.Format(formatter.format, t)
+	}
+	return t.Format(formatter.format)
+}
+
+// TimeFormattingPort stores the time of the records before passing them on.
+// The records are copied, as they may be passed to the other outputs too.
+type TimeFormattingPort struct {
+	formatter *TimeFormatter
+	next      Port
+}
+
+func (port *TimeFormattingPort) Emit(recordSets []FluentRecordSet) error {
+	formatted := make([]FluentRecordSet, 0, len(recordSets))
+	for _, recordSet := range recordSets {
+		records := make([]TinyFluentRecord, 0, len(recordSet.Records))
+		for _, record := range recordSet.Records {
+			data := (map[string]interface{})(nil)
+			if len(port.formatter.key.path) == 1 {
+				data = make(map[string]interface{}, len(record.Data)+1)
+				for k, v := range record.Data {
+					data[k] = v
+				}
+			} else {
+				data = copyValue(record.Data).(map[string]interface{})
+			}
+			port.formatter.key.Set(data, port.formatter.Format(record.Timestamp))
+			records = append(records, TinyFluentRecord{Timestamp: record.Timestamp, Data: data})
+		}
+		formatted = append(formatted, FluentRecordSet{
+			Tag:     recordSet.Tag,
+			Records: records,
+			Trace:   recordSet.Trace,
+		})
+	}
+	return port.next.Emit(formatted)
+}
+
+func NewTimeFormattingPort(formatter *TimeFormatter, next Port) *TimeFormattingPort {
+	return &TimeFormattingPort{
+		formatter: formatter,
+		next:      next,
+	}
+}
+
+// LoadTimezone returns the location of the timezone given by the name in
+// the tz database such as "Asia/Tokyo", "UTC", "Local" or the offset from
+// UTC such as "+09:00".  The empty name is UTC.
+func LoadTimezone(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	if m := timezoneOffsetRegexp.FindStringSubmatch(name); m != nil {
+		hours, _ := strconv.Atoi(m[2])
+		minutes, _ := strconv.Atoi(m[3])
+		offset := hours*3600 + minutes*60
+		if m[1] == "-" {
+			offset = -offset
+		}
+		return time.FixedZone(name, offset), nil
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("unknown timezone: %s", name))
+	}
+	return location, nil
+}
+
+// NewTimeFormatter returns the formatter storing the time in the field in
+// the format, which is one of the TimeFormat constants, a strftime pattern
+// such as "%Y-%m-%d %H:%M:%S" or a layout of Go, in the timezone given as
+// LoadTimezone takes it.
+func NewTimeFormatter(key *RecordAccessor, format string, timezone string) (*TimeFormatter, error) {
+	if format == "" {
+		return nil, errors.New("time format is empty")
+	}
+	location, err := LoadTimezone(timezone)
+	if err != nil {
+		return nil, err
+	}
+	return &TimeFormatter{
+		key:      key,
+		format:   format,
+		location: location,
+	}, nil
+}
+
+// newTimeFormatterFromConfig reads time-key, time-format and timezone,
+// returning nil if time-key is not given.
+func newTimeFormatterFromConfig(config *ConfigElement) (*TimeFormatter, error) {
+	if !config.Has("time-key") {
+		for _, key := range []string{"time-format", "timezone"} {
+			if config.Has(key) {
+				return nil, errors.New(fmt.Sprintf("%s: %s is given without time-key", config.String(), key))
+			}
+		}
+		return nil, nil
+	}
+	key, err := recordAccessorFromConfig(config, "time-key", "")
+	if err != nil {
+		return nil, err
+	}
+	formatter, err := NewTimeFormatter(key, config.Get("time-format", TimeFormatRFC3339), config.Get("timezone", ""))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", config.String(), err.Error()))
+	}
+	return formatter, nil
+}
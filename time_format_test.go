@@ -0,0 +1,85 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"testing"
+)
+
+func Test_TimeFormatter(t *testing.T) {
+	key, _ := NewRecordAccessor("time")
+	// 2014-10-15T12:00:00Z
+	timestamp := uint64(1413374400)
+	cases := []struct {
+		format   string
+		timezone string
+		expected interface{}
+	}{
+		{"epoch", "", uint64(1413374400)},
+		{"epoch-millis", "", uint64(1413374400000)},
+		{"rfc3339", "", "2014-10-15T12:00:00Z"},
+		{"rfc3339", "Asia/Tokyo", "2014-10-15T21:00:00+09:00"},
+		{"rfc3339", "-05:30", "2014-10-15T06:30:00-05:30"},
+		{"%Y/%m/%d %H:%M:%S %z", "+0900", "2014/10/15 21:00:00 +0900"},
+		{"02/Jan/2006:15:04:05 -0700", "America/New_York", "15/Oct/2014:08:00:00 -0400"},
+	}
+	for _, c := range cases {
+		formatter, err := NewTimeFormatter(key, c.format, c.timezone)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if v := formatter.Format(timestamp); v != c.expected {
+			t.Logf("%s in %s: %v", c.format, c.timezone, v)
+			t.Fail()
+		}
+	}
+	if _, err := NewTimeFormatter(key, "rfc3339", "Mars/Olympus_Mons"); err == nil {
+		t.Fail()
+	}
+}
+
+func Test_TimeFormattingPort(t *testing.T) {
+	config := NewConfigElement("output", "test")
+	config.Add("time-key", "$.meta.time")
+	config.Add("timezone", "+09:00")
+	formatter, err := newTimeFormatterFromConfig(config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	next := &recordingPort{}
+	input := []FluentRecordSet{{Tag: "a", Records: []TinyFluentRecord{{Timestamp: 1413374400, Data: map[string]interface{}{"meta": map[string]interface{}{"host": "h"}}}}}}
+	NewTimeFormattingPort(formatter, next).Emit(input)
+	meta := next.recordSets[0].Records[0].Data["meta"].(map[string]interface{})
+	if meta["time"] != "2014-10-15T21:00:00+09:00" || meta["host"] != "h" {
+		t.Logf("%+v", next.recordSets)
+		t.Fail()
+	}
+	// the records given are left as they are for the other outputs
+	if _, ok := input[0].Records[0].Data["meta"].(map[string]interface{})["time"]; ok {
+		t.Fail()
+	}
+	if formatter, err := newTimeFormatterFromConfig(NewConfigElement("output", "none")); formatter != nil || err != nil {
+		t.Fail()
+	}
+	config = NewConfigElement("output", "test")
+	config.Add("time-format", "epoch")
+	if _, err := newTimeFormatterFromConfig(config); err == nil {
+		t.Fail()
+	}
+}
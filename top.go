@@ -0,0 +1,271 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ParseMetricsText reads the metrics in the Prometheus text format into the
+// same shape as Snapshot: the values by the metric names and then by the
+// labels as formatted.
+func ParseMetricsText(r io.Reader) (map[string]map[string]float64, error) {
+	retval := make(map[string]map[string]float64)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 65536), 1048576)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		name, labels, rest := line, "", ""
+		if i := strings.IndexAny(line, "{ "); i >= 0 {
+			name, rest = line[:i], line[i:]
+		}
+		if strings.HasPrefix(rest, "{") {
+			end := labelsEnd(rest)
+			if end < 0 {
+				return nil, errors.New(fmt.Sprintf("malformed labels: %s", line))
+			}
+			labels, rest = rest[:end+1], rest[end+1:]
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return nil, errors.New(fmt.Sprintf("no value: %s", line))
+		}
+		v, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("malformed value: %s", line))
+		}
+		if retval[name] == nil {
+			retval[name] = make(map[string]float64)
+		}
+		retval[name][labels] = v
+	}
+	return retval, scanner.Err()
+}
+
+// labelsEnd returns the index of the brace closing the labels.
+func labelsEnd(s string) int {
+	quoted, escaped := false, false
+	for i, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == '}' && !quoted:
+			return i
+		}
+	}
+	return -1
+}
+
+// labelValue returns the value of the label in the labels as formatted.
+func labelValue(labels string, name string) string {
+	prefix := name + `="`
+	i := strings.Index(labels, prefix)
+	if i < 0 || (i > 0 && labels[i-1] != '{' && labels[i-1] != ',') {
+		return ""
+	}
+	s := labels[i+len(prefix):]
+	value := make([]byte, 0, len(s))
+	for j := 0; j < len(s); j += 1 {
+		switch s[j] {
+		case '\\':
+			j += 1
+			if j < len(s) {
+				if s[j] == 'n' {
+					value = append(value, '\n')
+				} else {
+					value = append(value, s[j])
+				}
+			}
+		case '"':
+			return string(value)
+		default:
+			value = append(value, s[j])
+		}
+	}
+	return string(value)
+}
+
+// Top shows the throughput of the tags and the state of the outputs of a
+// running forwarder in the terminal, refreshed at the interval, from the
+// metrics served at the URL.
+type Top struct {
+	url      string
+	interval time.Duration
+	maxTags  int
+	writer   io.Writer
+	client   *http.Client
+}
+
+func (top *Top) fetch() (map[string]map[string]float64, error) {
+	resp, err := top.client.Get(top.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("%s responded with %s", top.url, resp.Status))
+	}
+	return ParseMetricsText(resp.Body)
+}
+
+type topRow struct {
+	name   string
+	values []string
+	key    float64
+}
+
+// topRate returns the increase of the counter per second.
+func topRate(prev map[string]map[string]float64, cur map[string]map[string]float64, name string, labels string, elapsed float64) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	delta := cur[name][labels] - prev[name][labels]
+	if delta < 0 {
+		delta = cur[name][labels]
+	}
+	return delta / elapsed
+}
+
+func formatTopRate(v float64) string {
+	return strconv.FormatFloat(v, 'f', 1, 64)
+}
+
+// render writes the screen from the metrics fetched elapsed seconds apart.
+func (top *Top) render(w io.Writer, prev map[string]map[string]float64, cur map[string]map[string]float64, elapsed float64, now time.Time) {
+	fmt.Fprintf(w, "fluentd-forwarder top - %s - %s\n\n", top.url, now.Format("15:04:05"))
+
+	tabs := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tabs, "OUTPUT\tUP\tRECORDS/S\tBYTES/S\tBUFFERED\tCHUNKS\tRETRIES/S\tSTUCK\t")
+	outputs := make([]topRow, 0)
+	for labels := range cur["fluentd_forwarder_output_up"] {
+		stuck := "-"
+		if cur["fluentd_forwarder_output_stuck"][labels] != 0 {
+			stuck = "STUCK"
+		}
+		up := "yes"
+		if cur["fluentd_forwarder_output_up"][labels] == 0 {
+			up = "NO"
+		}
+		outputs = append(outputs, topRow{
+			name: labelValue(labels, "output"),
+			values: []string{
+				up,
+				formatTopRate(topRate(prev, cur, "fluentd_forwarder_buffer_records_total", labels, elapsed)),
+				formatTopRate(topRate(prev, cur, "fluentd_forwarder_output_bytes_total", labels, elapsed)),
+				strconv.FormatFloat(cur["fluentd_forwarder_buffer_bytes"][labels], 'f', 0, 64),
+				strconv.FormatFloat(cur["fluentd_forwarder_buffer_chunks"][labels], 'f', 0, 64),
+				formatTopRate(topRate(prev, cur, "fluentd_forwarder_output_retries_total", labels, elapsed)),
+				stuck,
+			},
+		})
+	}
+	sort.Slice(outputs, func(i, j int) bool { return outputs[i].name < outputs[j].name })
+	for _, row := range outputs {
+		fmt.Fprintf(tabs, "%s\t%s\t\n", row.name, strings.Join(row.values, "\t"))
+	}
+	tabs.Flush()
+	fmt.Fprintln(w)
+
+	tabs = tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tabs, "TAG\tRECORDS/S\tBYTES/S\tRECORDS\t")
+	tags := make([]topRow, 0)
+	for labels, records := range cur["fluentd_forwarder_tag_records_total"] {
+		recordsRate := topRate(prev, cur, "fluentd_forwarder_tag_records_total", labels, elapsed)
+		tags = append(tags, topRow{
+			name: labelValue(labels, "tag"),
+			values: []string{
+				formatTopRate(recordsRate),
+				formatTopRate(topRate(prev, cur, "fluentd_forwarder_tag_bytes_total", labels, elapsed)),
+				strconv.FormatFloat(records, 'f', 0, 64),
+			},
+			key: recordsRate,
+		})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].key != tags[j].key {
+			return tags[i].key > tags[j].key
+		}
+		return tags[i].name < tags[j].name
+	})
+	if len(tags) > top.maxTags {
+		tags = tags[:top.maxTags]
+	}
+	for _, row := range tags {
+		fmt.Fprintf(tabs, "%s\t%s\t\n", row.name, strings.Join(row.values, "\t"))
+	}
+	tabs.Flush()
+}
+
+// Run refreshes the screen until stopChan is closed.
+func (top *Top) Run(stopChan <-chan struct{}) error {
+	prev, err := top.fetch()
+	if err != nil {
+		return err
+	}
+	prevTime := time.Now()
+	ticker := time.NewTicker(top.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stopChan:
+			return nil
+		}
+		cur, err := top.fetch()
+		now := time.Now()
+		screen := bufio.NewWriter(top.writer)
+		// clear the screen
+		screen.WriteString("\x1b[H\x1b[2J")
+		if err != nil {
+			fmt.Fprintf(screen, "%s\n", err.Error())
+		} else {
+			top.render(screen, prev, cur, now.Sub(prevTime).Seconds(), now)
+			prev, prevTime = cur, now
+		}
+		screen.Flush()
+	}
+}
+
+// NewTop creates a Top showing the metrics at the URL, listing up to
+// maxTags of the busiest tags.
+func NewTop(url string, interval time.Duration, maxTags int, writer io.Writer) *Top {
+	return &Top{
+		url:      url,
+		interval: interval,
+		maxTags:  maxTags,
+		writer:   writer,
+		client:   &http.Client{Timeout: interval},
+	}
+}
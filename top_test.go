@@ -0,0 +1,84 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ParseMetricsText(t *testing.T) {
+	registry := NewMetricsRegistry()
+	counter := mustCounterVec(registry.NewCounterVec("records_total", "Number of the records.", "tag"))
+	counter.With(`a "quoted" } tag`).Add(3)
+	counter.With("b").Add(1.5)
+	histogram := mustHistogramVec(registry.NewHistogramVec("latency_seconds", "Latency.", []float64{1}))
+	histogram.With().Observe(2)
+	buf := bytes.Buffer{}
+	registry.WriteText(bufio.NewWriter(&buf))
+	metrics, err := ParseMetricsText(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	snapshot := registry.Snapshot()
+	for name, values := range snapshot {
+		for labels, v := range values {
+			if metrics[name][labels] != v {
+				t.Errorf("%s%s: expected %g, got %g", name, labels, v, metrics[name][labels])
+			}
+		}
+	}
+	if metrics["latency_seconds_bucket"][`{le="+Inf"}`] != 1 {
+		t.Fail()
+	}
+	for labels := range metrics["records_total"] {
+		if v := labelValue(labels, "tag"); v != `a "quoted" } tag` && v != "b" {
+			t.Errorf("unexpected label value: %s", v)
+		}
+	}
+}
+
+func Test_Top_Render(t *testing.T) {
+	prev := map[string]map[string]float64{
+		"fluentd_forwarder_buffer_records_total": {`{output="127.0.0.1:24224"}`: 100},
+		"fluentd_forwarder_tag_records_total":    {`{tag="app.web"}`: 10, `{tag="app.db"}`: 10},
+	}
+	cur := map[string]map[string]float64{
+		"fluentd_forwarder_output_up":            {`{output="127.0.0.1:24224"}`: 0},
+		"fluentd_forwarder_buffer_records_total": {`{output="127.0.0.1:24224"}`: 300},
+		"fluentd_forwarder_buffer_bytes":         {`{output="127.0.0.1:24224"}`: 4096},
+		"fluentd_forwarder_tag_records_total":    {`{tag="app.web"}`: 30, `{tag="app.db"}`: 50, `{tag="app.batch"}`: 1},
+	}
+	buf := bytes.Buffer{}
+	NewTop("http://127.0.0.1:24231/metrics", time.Second, 2, &buf).render(&buf, prev, cur, 2, time.Unix(0, 0))
+	lines := strings.Split(buf.String(), "\n")
+	fields := func(line string) string {
+		return strings.Join(strings.Fields(line), " ")
+	}
+	if fields(lines[3]) != "127.0.0.1:24224 NO 100.0 0.0 4096 0 0.0 -" {
+		t.Errorf("unexpected output row: %s", lines[3])
+	}
+	// the busiest tags first
+	if fields(lines[6]) != "app.db 20.0 0.0 50" || fields(lines[7]) != "app.web 10.0 0.0 30" || len(lines) != 9 {
+		t.Errorf("unexpected tag rows: %q", lines[5:])
+	}
+}
@@ -0,0 +1,368 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceparentKey is the key of the option of the forward protocol by which
+// the trace is propagated to the next forwarder, in the format of the W3C
+// traceparent header.
+const TraceparentKey = "traceparent"
+
+// SpanContext identifies a span of a trace.  The zero value is no span.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+func (ctx SpanContext) IsValid() bool {
+	return ctx != SpanContext{}
+}
+
+func (ctx SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(ctx.TraceID[:]), hex.EncodeToString(ctx.SpanID[:]))
+}
+
+func ParseTraceparent(s string) (SpanContext, error) {
+	ctx := SpanContext{}
+	if len(s) != 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return ctx, errors.New(fmt.Sprintf("invalid traceparent: %s", s))
+	}
+	_, err := hex.Decode(ctx.TraceID[:], []byte(s[3:35]))
+	if err != nil {
+		return ctx, errors.New(fmt.Sprintf("invalid traceparent: %s", s))
+	}
+	_, err = hex.Decode(ctx.SpanID[:], []byte(s[36:52]))
+	if err != nil || !ctx.IsValid() {
+		return ctx, errors.New(fmt.Sprintf("invalid traceparent: %s", s))
+	}
+	return ctx, nil
+}
+
+// traceparentFromOption returns the span given in the option of a message
+// of the forward protocol, if any.
+func traceparentFromOption(option interface{}) SpanContext {
+	m, ok := option.(map[string]interface{})
+	if !ok {
+		return SpanContext{}
+	}
+	v := m[TraceparentKey]
+	if b, ok := v.([]byte); ok {
+		v = string(b)
+	}
+	s, ok := v.(string)
+	if !ok {
+		return SpanContext{}
+	}
+	ctx, _ := ParseTraceparent(s)
+	return ctx
+}
+
+// inheritTrace lets the record sets without a trace take over the one of
+// the record set of the same tag among the ones they were derived from.
+func inheritTrace(derived []FluentRecordSet, origins []FluentRecordSet) {
+	traces := map[string]SpanContext(nil)
+	for _, origin := range origins {
+		if origin.Trace.IsValid() {
+			if traces == nil {
+				traces = make(map[string]SpanContext)
+			}
+			traces[origin.Tag] = origin.Trace
+		}
+	}
+	if traces == nil {
+		return
+	}
+	for i := range derived {
+		if !derived[i].Trace.IsValid() {
+			derived[i].Trace = traces[derived[i].Tag]
+		}
+	}
+}
+
+// startBufferSpan starts the span of writing the record set to the buffer
+// of the output if the record set is traced, and makes it carry the span
+// on.  No trace is started here.
+func startBufferSpan(recordSet *FluentRecordSet, output string) *Span {
+	if !recordSet.Trace.IsValid() {
+		return nil
+	}
+	span := DefaultTracer.StartSpan("buffer", recordSet.Trace, time.Now())
+	if span == nil {
+		return nil
+	}
+	span.Attributes["tag"] = recordSet.Tag
+	span.Attributes["records"] = strconv.Itoa(len(recordSet.Records))
+	span.Attributes["output"] = output
+	recordSet.Trace = span.Context
+	return span
+}
+
+type Span struct {
+	Context    SpanContext
+	Parent     SpanContext
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	tracer     *Tracer
+}
+
+// Finish ends the span at the time and queues it for the export.  It does
+// nothing to a nil span, so that the spans not sampled need no care.
+func (span *Span) Finish(end time.Time) {
+	if span == nil {
+		return
+	}
+	span.End = end
+	span.tracer.enqueue(span)
+}
+
+// SpanContext returns the context of the span, or the zero value for a nil
+// span.
+func (span *Span) SpanContext() SpanContext {
+	if span == nil {
+		return SpanContext{}
+	}
+	return span.Context
+}
+
+type SpanExporter interface {
+	ExportSpans(spans []*Span) error
+}
+
+// Tracer records the spans of the lifecycle of the records, from their
+// receipt through the buffer to the flush, and hands them to the exporter
+// periodically.  The traces are continued from the ones propagated by the
+// previous forwarder, or started for sampleRatio of the messages otherwise.
+type Tracer struct {
+	logger         *logging.Logger
+	exporter       SpanExporter
+	sampleRatio    float64
+	interval       time.Duration
+	maxQueueSize   int
+	mtx            sync.Mutex
+	spans          []*Span
+	rand           *mathrand.Rand
+	wg             sync.WaitGroup
+	shutdownChan   chan struct{}
+	isShuttingDown uintptr
+}
+
+// DefaultTracer is the tracer of the built-in components; nil disables the
+// tracing.
+var DefaultTracer *Tracer
+
+// StartSpan starts a span in the trace of the parent, or in a new trace if
+// the parent is not valid and the trace is sampled.  It returns nil if the
+// tracer is nil or the trace is not sampled.
+func (tracer *Tracer) StartSpan(name string, parent SpanContext, start time.Time) *Span {
+	if tracer == nil {
+		return nil
+	}
+	ctx := SpanContext{TraceID: parent.TraceID}
+	if !parent.IsValid() {
+		tracer.mtx.Lock()
+		sampled := tracer.rand.Float64() < tracer.sampleRatio
+		tracer.mtx.Unlock()
+		if !sampled {
+			return nil
+		}
+		rand.Read(ctx.TraceID[:])
+	}
+	rand.Read(ctx.SpanID[:])
+	return &Span{
+		Context:    ctx,
+		Parent:     parent,
+		Name:       name,
+		Start:      start,
+		Attributes: make(map[string]string),
+		tracer:     tracer,
+	}
+}
+
+func (tracer *Tracer) enqueue(span *Span) {
+	tracer.mtx.Lock()
+	defer tracer.mtx.Unlock()
+	if len(tracer.spans) >= tracer.maxQueueSize {
+		return
+	}
+	tracer.spans = append(tracer.spans, span)
+}
+
+func (tracer *Tracer) export() {
+	tracer.mtx.Lock()
+	spans := tracer.spans
+	tracer.spans = make([]*Span, 0)
+	tracer.mtx.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	err := tracer.exporter.ExportSpans(spans)
+	if err != nil {
+		tracer.logger.Errorf("%s: failed to export %d spans: %s", LogComponent(tracer.String()), len(spans), LogError(err))
+	}
+}
+
+func (tracer *Tracer) String() string {
+	return "tracer"
+}
+
+func (tracer *Tracer) Start() {
+	tracer.wg.Add(1)
+	go func() {
+		defer tracer.wg.Done()
+		ticker := time.NewTicker(tracer.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				tracer.export()
+			case <-tracer.shutdownChan:
+				tracer.export()
+				return
+			}
+		}
+	}()
+}
+
+func (tracer *Tracer) Stop() {
+	if atomic.CompareAndSwapUintptr(&tracer.isShuttingDown, 0, 1) {
+		tracer.shutdownChan <- struct{}{}
+	}
+}
+
+func (tracer *Tracer) WaitForShutdown() {
+	tracer.wg.Wait()
+}
+
+func NewTracer(logger *logging.Logger, exporter SpanExporter, sampleRatio float64, interval time.Duration) *Tracer {
+	return &Tracer{
+		logger:         logger,
+		exporter:       exporter,
+		sampleRatio:    sampleRatio,
+		interval:       interval,
+		maxQueueSize:   65536,
+		mtx:            sync.Mutex{},
+		spans:          make([]*Span, 0),
+		rand:           mathrand.New(mathrand.NewSource(time.Now().UnixNano())),
+		wg:             sync.WaitGroup{},
+		shutdownChan:   make(chan struct{}, 1),
+		isShuttingDown: 0,
+	}
+}
+
+// OTLPExporter sends the spans to an OpenTelemetry collector by OTLP over
+// HTTP in the JSON encoding.
+type OTLPExporter struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+}
+
+type otlpKeyValue struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes"`
+}
+
+func otlpAttributes(attributes map[string]string) []otlpKeyValue {
+	retval := make([]otlpKeyValue, 0, len(attributes))
+	for k, v := range attributes {
+		retval = append(retval, otlpKeyValue{Key: k, Value: map[string]string{"stringValue": v}})
+	}
+	return retval
+}
+
+func (exporter *OTLPExporter) ExportSpans(spans []*Span) error {
+	otlpSpans := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		otlpSpans[i] = otlpSpan{
+			TraceID:           hex.EncodeToString(span.Context.TraceID[:]),
+			SpanID:            hex.EncodeToString(span.Context.SpanID[:]),
+			Name:              span.Name,
+			Kind:              1, // internal
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+		}
+		if span.Parent.IsValid() {
+			otlpSpans[i].ParentSpanID = hex.EncodeToString(span.Parent.SpanID[:])
+		}
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]string{"service.name": exporter.serviceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "fluentd-forwarder"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := exporter.client.Post(exporter.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New(fmt.Sprintf("%s responded with %s", exporter.endpoint, resp.Status))
+	}
+	return nil
+}
+
+func NewOTLPExporter(endpoint string, serviceName string, timeout time.Duration) *OTLPExporter {
+	return &OTLPExporter{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: timeout},
+	}
+}
@@ -0,0 +1,151 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"encoding/json"
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingExporter struct {
+	mtx   sync.Mutex
+	spans []*Span
+}
+
+func (exporter *recordingExporter) ExportSpans(spans []*Span) error {
+	exporter.mtx.Lock()
+	defer exporter.mtx.Unlock()
+	exporter.spans = append(exporter.spans, spans...)
+	return nil
+}
+
+func Test_Traceparent(t *testing.T) {
+	s := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	ctx, err := ParseTraceparent(s)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ctx.Traceparent() != s {
+		t.Fail()
+	}
+	for _, s := range []string{
+		"",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331",
+		"00-0af7651916cd43dd8448eb211c80319x-b7ad6b7169203331-01",
+		"00-00000000000000000000000000000000-0000000000000000-01",
+	} {
+		_, err := ParseTraceparent(s)
+		if err == nil {
+			t.Errorf("%s should be rejected", s)
+		}
+	}
+	if traceparentFromOption(map[string]interface{}{TraceparentKey: []byte(s)}) != ctx {
+		t.Fail()
+	}
+	if traceparentFromOption(map[string]interface{}{"size": 1}).IsValid() {
+		t.Fail()
+	}
+}
+
+func Test_InheritTrace(t *testing.T) {
+	ctx, _ := ParseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	origins := []FluentRecordSet{{Tag: "a", Trace: ctx}, {Tag: "b"}}
+	derived := []FluentRecordSet{{Tag: "a"}, {Tag: "b"}, {Tag: "c"}}
+	inheritTrace(derived, origins)
+	if derived[0].Trace != ctx || derived[1].Trace.IsValid() || derived[2].Trace.IsValid() {
+		t.Fail()
+	}
+}
+
+func Test_Tracer(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("tracer")
+	exporter := &recordingExporter{}
+	tracer := NewTracer(logger, exporter, 0, time.Hour)
+	if tracer.StartSpan("receive", SpanContext{}, time.Now()) != nil {
+		t.Fatal("an unsampled trace was started")
+	}
+	parent, _ := ParseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	span := tracer.StartSpan("receive", parent, time.Now())
+	if span == nil || span.Context.TraceID != parent.TraceID || span.Context.SpanID == parent.SpanID {
+		t.Fatal("the propagated trace was not continued")
+	}
+	tracer.Start()
+	span.Finish(time.Now())
+	tracer.Stop()
+	tracer.WaitForShutdown()
+	if len(exporter.spans) != 1 || exporter.spans[0] != span {
+		t.Fail()
+	}
+	tracer = NewTracer(logger, exporter, 1, time.Hour)
+	if !tracer.StartSpan("receive", SpanContext{}, time.Now()).SpanContext().IsValid() {
+		t.Fail()
+	}
+	if (*Tracer)(nil).StartSpan("receive", parent, time.Now()) != nil {
+		t.Fail()
+	}
+}
+
+func Test_OTLPExporter(t *testing.T) {
+	body := []byte(nil)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		body, _ = ioutil.ReadAll(req.Body)
+	}))
+	defer server.Close()
+	parent, _ := ParseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	span := &Span{
+		Context:    SpanContext{TraceID: parent.TraceID, SpanID: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}},
+		Parent:     parent,
+		Name:       "flush",
+		Start:      time.Unix(1, 0),
+		End:        time.Unix(2, 0),
+		Attributes: map[string]string{"output": "127.0.0.1:24224"},
+	}
+	err := NewOTLPExporter(server.URL, "test", time.Second).ExportSpans([]*Span{span})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	v := struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}{}
+	err = json.Unmarshal(body, &v)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	spans := v.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 {
+		t.Fatal()
+	}
+	if spans[0].TraceID != "0af7651916cd43dd8448eb211c80319c" || spans[0].SpanID != "0102030405060708" || spans[0].ParentSpanID != "b7ad6b7169203331" {
+		t.Fail()
+	}
+	if spans[0].StartTimeUnixNano != "1000000000" || spans[0].Attributes[0].Value["stringValue"] != "127.0.0.1:24224" {
+		t.Fail()
+	}
+}
@@ -18,6 +18,10 @@
 
 package fluentd_forwarder
 
+import (
+	"strconv"
+)
+
 func maxInt(a, b int) int {
 	if a >= b {
 		return a
@@ -33,3 +37,27 @@ func addMetadata(recordSet *FluentRecordSet, metadata string) {
 		}
 	}
 }
+
+// toFloat64 converts a numeric value, or a string representing a number, in
+// a record to float64.
+func toFloat64(v interface{}) (float64, bool) {
+	switch v_ := v.(type) {
+	case int64:
+		return float64(v_), true
+	case uint64:
+		return float64(v_), true
+	case float64:
+		return v_, true
+	case float32:
+		return float64(v_), true
+	case int:
+		return float64(v_), true
+	case string:
+		f, err := strconv.ParseFloat(v_, 64)
+		return f, err == nil
+	case []byte:
+		f, err := strconv.ParseFloat(string(v_), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
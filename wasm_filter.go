@@ -0,0 +1,342 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/ugorji/go/codec"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// The ABI between the forwarder and a WebAssembly filter module.  The module
+// must export its memory and the following functions:
+//
+//	fluentd_alloc(size i32) i32
+//	fluentd_filter(ptr i32, size i32) i64
+//
+// and may export fluentd_free(ptr i32, size i32) to release the buffers.
+//
+// fluentd_filter receives a msgpack-encoded [tag, time, record] and returns
+// the location of a msgpack-encoded array of [tag, time, record] entries as
+// (ptr << 32 | size); zero entries (or a return value of 0) drop the record.
+// Modules built for WASI are given an environment without any file system,
+// environment variables or clock access beyond what WASI mandates.
+const (
+	wasmAllocFuncName  = "fluentd_alloc"
+	wasmFreeFuncName   = "fluentd_free"
+	wasmFilterFuncName = "fluentd_filter"
+)
+
+type WasmFilter struct {
+	logger      *logging.Logger
+	name        string
+	path        string
+	codec       *codec.MsgpackHandle
+	timeout     time.Duration
+	dropOnError bool
+	runtime     wazero.Runtime
+	compiled    wazero.CompiledModule
+	mtx         sync.Mutex
+	module      api.Module
+	allocFunc   api.Function
+	freeFunc    api.Function
+	filterFunc  api.Function
+	isShutDown  bool
+}
+
+func (filter *WasmFilter) instantiate(ctx context.Context) error {
+	module, err := filter.runtime.InstantiateModule(ctx, filter.compiled, wazero.NewModuleConfig().WithName("").WithStartFunctions())
+	if err != nil {
+		return err
+	}
+	initialize := module.ExportedFunction("_initialize")
+	if initialize != nil {
+		_, err := initialize.Call(ctx)
+		if err != nil {
+			module.Close(ctx)
+			return err
+		}
+	}
+	allocFunc := module.ExportedFunction(wasmAllocFuncName)
+	filterFunc := module.ExportedFunction(wasmFilterFuncName)
+	if allocFunc == nil || filterFunc == nil || module.Memory() == nil {
+		module.Close(ctx)
+		return errors.New(fmt.Sprintf("%s does not export %s, %s and memory", filter.path, wasmAllocFuncName, wasmFilterFuncName))
+	}
+	filter.module = module
+	filter.allocFunc = allocFunc
+	filter.freeFunc = module.ExportedFunction(wasmFreeFuncName)
+	filter.filterFunc = filterFunc
+	return nil
+}
+
+func (filter *WasmFilter) discardModule(ctx context.Context) {
+	if filter.module != nil {
+		filter.module.Close(ctx)
+		filter.module = nil
+	}
+}
+
+func (filter *WasmFilter) call(input []byte) ([]byte, error) {
+	filter.mtx.Lock()
+	defer filter.mtx.Unlock()
+	if filter.isShutDown {
+		return nil, errors.New("filter has been stopped")
+	}
+	ctx := context.Background()
+	if filter.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, filter.timeout)
+		defer cancel()
+	}
+	if filter.module == nil {
+		err := filter.instantiate(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	output, err := func() ([]byte, error) {
+		results, err := filter.allocFunc.Call(ctx, uint64(len(input)))
+		if err != nil {
+			return nil, err
+		}
+		ptr := uint32(results[0])
+		if !filter.module.Memory().Write(ptr, input) {
+			return nil, errors.New("fluentd_alloc returned an out-of-range buffer")
+		}
+		results, err = filter.filterFunc.Call(ctx, uint64(ptr), uint64(len(input)))
+		if err != nil {
+			return nil, err
+		}
+		if filter.freeFunc != nil {
+			filter.freeFunc.Call(ctx, uint64(ptr), uint64(len(input)))
+		}
+		if results[0] == 0 {
+			return nil, nil
+		}
+		resultPtr, resultSize := uint32(results[0]>>32), uint32(results[0])
+		view, ok := filter.module.Memory().Read(resultPtr, resultSize)
+		if !ok {
+			return nil, errors.New("fluentd_filter returned an out-of-range buffer")
+		}
+		output := make([]byte, len(view))
+		copy(output, view)
+		if filter.freeFunc != nil {
+			filter.freeFunc.Call(ctx, uint64(resultPtr), uint64(resultSize))
+		}
+		return output, nil
+	}()
+	if err != nil {
+		// the instance may be left in an inconsistent state after a trap
+		filter.discardModule(context.Background())
+		return nil, err
+	}
+	return output, nil
+}
+
+func wasmToUint64(v interface{}) (uint64, bool) {
+	switch v_ := v.(type) {
+	case uint64:
+		return v_, true
+	case int64:
+		return uint64(v_), v_ >= 0
+	case float64:
+		return uint64(v_), v_ >= 0
+	}
+	return 0, false
+}
+
+func (filter *WasmFilter) decodeOutput(output []byte) ([]FluentRecordSet, error) {
+	entries := []interface{}{}
+	err := codec.NewDecoder(bytes.NewReader(output), filter.codec).Decode(&entries)
+	if err != nil {
+		return nil, err
+	}
+	retval := make([]FluentRecordSet, 0, len(entries))
+	for _, _entry := range entries {
+		entry, ok := _entry.([]interface{})
+		if !ok || len(entry) != 3 {
+			return nil, errors.New("Failed to decode filter result")
+		}
+		tag, ok := entry[0].(string)
+		if !ok {
+			return nil, errors.New("Failed to decode tag field")
+		}
+		timestamp, ok := wasmToUint64(entry[1])
+		if !ok {
+			return nil, errors.New("Failed to decode timestamp field")
+		}
+		data, ok := entry[2].(map[string]interface{})
+		if !ok {
+			return nil, errors.New("Failed to decode data field")
+		}
+		retval = appendRecord(retval, tag, TinyFluentRecord{Timestamp: timestamp, Data: data})
+	}
+	return retval, nil
+}
+
+func (filter *WasmFilter) Filter(recordSets []FluentRecordSet) ([]FluentRecordSet, error) {
+	retval := make([]FluentRecordSet, 0, len(recordSets))
+	errs := make(RecordErrors, 0)
+	buffer := bytes.Buffer{}
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			buffer.Reset()
+			err := codec.NewEncoder(&buffer, filter.codec).Encode([]interface{}{recordSet.Tag, record.Timestamp, record.Data})
+			if err != nil {
+				return nil, err
+			}
+			output, err := filter.call(buffer.Bytes())
+			if err == nil && output != nil {
+				filtered, err_ := filter.decodeOutput(output)
+				if err_ == nil {
+					for _, recordSet_ := range filtered {
+						for _, record_ := range recordSet_.Records {
+							retval = appendRecord(retval, recordSet_.Tag, record_)
+						}
+					}
+					continue
+				}
+				err = err_
+			}
+			if err != nil {
+				if filter.dropOnError {
+					errs = append(errs, RecordError{Tag: recordSet.Tag, Record: record, Err: err})
+					continue
+				}
+				filter.logger.Errorf("%s: failed to process a record with tag %s: %s", LogComponent(filter.String()), LogTag(recordSet.Tag), LogError(err))
+				retval = appendRecord(retval, recordSet.Tag, record)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return retval, errs
+	}
+	return retval, nil
+}
+
+func (filter *WasmFilter) String() string {
+	return "filter:" + filter.name
+}
+
+func (filter *WasmFilter) Start() {}
+
+func (filter *WasmFilter) Stop() {
+	filter.mtx.Lock()
+	defer filter.mtx.Unlock()
+	if filter.isShutDown {
+		return
+	}
+	filter.isShutDown = true
+	filter.discardModule(context.Background())
+	filter.runtime.Close(context.Background())
+}
+
+func (filter *WasmFilter) WaitForShutdown() {}
+
+func NewWasmFilter(logger *logging.Logger, name string, path string, timeout time.Duration, memoryLimitPages int, dropOnError bool) (*WasmFilter, error) {
+	wasm, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	_codec := codec.MsgpackHandle{}
+	_codec.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	_codec.RawToString = true
+	_codec.WriteExt = true
+
+	ctx := context.Background()
+	runtimeConfig := wazero.NewRuntimeConfig().WithCloseOnContextDone(true)
+	if memoryLimitPages > 0 {
+		runtimeConfig = runtimeConfig.WithMemoryLimitPages(uint32(memoryLimitPages))
+	}
+	runtime := wazero.NewRuntimeWithConfig(ctx, runtimeConfig)
+	_, err = wasi_snapshot_preview1.Instantiate(ctx, runtime)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+	compiled, err := runtime.CompileModule(ctx, wasm)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, errors.New(fmt.Sprintf("Failed to compile %s: %s", path, err.Error()))
+	}
+	filter := &WasmFilter{
+		logger:      logger,
+		name:        name,
+		path:        path,
+		codec:       &_codec,
+		timeout:     timeout,
+		dropOnError: dropOnError,
+		runtime:     runtime,
+		compiled:    compiled,
+		mtx:         sync.Mutex{},
+	}
+	// instantiate once up front so that a module not following the ABI is
+	// reported at startup
+	err = filter.instantiate(ctx)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+	return filter, nil
+}
+
+func newWasmFilterFromConfig(logger *logging.Logger, config *ConfigElement, next Port) (Filter, error) {
+	path := config.Get("path", "")
+	if path == "" {
+		return nil, errors.New(fmt.Sprintf("%s: path is not specified", config.String()))
+	}
+	timeout, err := config.GetDuration("timeout", time.Second)
+	if err != nil {
+		return nil, err
+	}
+	memoryLimitPages, err := config.GetInt("memory-limit-pages", 256)
+	if err != nil {
+		return nil, err
+	}
+	dropOnError := false
+	switch config.Get("on-error", "pass") {
+	case "pass":
+	case "drop":
+		dropOnError = true
+	default:
+		return nil, errors.New(fmt.Sprintf("%s: on-error must be either pass or drop", config.String()))
+	}
+	return NewWasmFilter(logger, config.Arg, path, timeout, memoryLimitPages, dropOnError)
+}
+
+func init() {
+	RegisterFilter("wasm", newWasmFilterFromConfig)
+	RegisterFilterParams("wasm",
+		ParamSchema{Name: "path", Type: ParamString, Description: "WebAssembly module", Required: true},
+		ParamSchema{Name: "timeout", Type: ParamDuration, Description: "maximum time a single record may take", Default: "1s"},
+		ParamSchema{Name: "memory-limit-pages", Type: ParamInteger, Description: "maximum size of the memory of the module in 64KiB pages", Default: "256"},
+		ParamSchema{Name: "on-error", Type: ParamString, Description: "whether a record the module failed on is passed unmodified or sent to @ERROR", Default: "pass", Enum: []string{"pass", "drop"}},
+	)
+}
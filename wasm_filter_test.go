@@ -0,0 +1,219 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The bodies of fluentd_filter of the test modules, each of which is
+//
+//	(module
+//	  (memory (export "memory") 1)
+//	  (func (export "fluentd_alloc") (param i32) (result i32) (i32.const 1024))
+//	  (func (export "fluentd_filter") (param $ptr i32) (param $size i32) (result i64) ...))
+var (
+	// wraps the entry in an array of one just before it, and returns it:
+	//	(i32.store8 (i32.sub (local.get $ptr) (i32.const 1)) (i32.const 0x91))
+	//	(i64.or
+	//	  (i64.shl (i64.extend_i32_u (i32.sub (local.get $ptr) (i32.const 1))) (i64.const 32))
+	//	  (i64.extend_i32_u (i32.add (local.get $size) (i32.const 1))))
+	wasmPassBody = []byte{
+		0x20, 0x00, 0x41, 0x01, 0x6b, 0x41, 0x91, 0x01, 0x3a, 0x00, 0x00,
+		0x20, 0x00, 0x41, 0x01, 0x6b, 0xad, 0x42, 0x20, 0x86,
+		0x20, 0x01, 0x41, 0x01, 0x6a, 0xad, 0x84,
+	}
+	// (i64.const 0)
+	wasmDropBody = []byte{0x42, 0x00}
+	// (unreachable)
+	wasmTrapBody = []byte{0x00}
+	// (loop (br 0)) (unreachable)
+	wasmLoopBody = []byte{0x03, 0x40, 0x0c, 0x00, 0x0b, 0x00}
+	// 16 bytes at the end of the memory:
+	//	(i64.or (i64.shl (i64.const 65536) (i64.const 32)) (i64.const 16))
+	wasmOutOfBoundsBody = []byte{0x42, 0x80, 0x80, 0x04, 0x42, 0x20, 0x86, 0x42, 0x10, 0x84}
+)
+
+func wasmSection(id byte, contents ...byte) []byte {
+	return append([]byte{id, byte(len(contents))}, contents...)
+}
+
+func wasmName(name string) []byte {
+	return append([]byte{byte(len(name))}, name...)
+}
+
+// wasmTestModule assembles a module of the filter body, leaving out the
+// export of fluentd_filter if exportFilter is false.
+func wasmTestModule(filterBody []byte, exportFilter bool) []byte {
+	module := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	// (i32) -> i32, (i32, i32) -> i64
+	module = append(module, wasmSection(1, 0x02, 0x60, 0x01, 0x7f, 0x01, 0x7f, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e)...)
+	module = append(module, wasmSection(3, 0x02, 0x00, 0x01)...)
+	module = append(module, wasmSection(5, 0x01, 0x00, 0x01)...)
+	exports := []byte{0x02}
+	exports = append(append(exports, wasmName("memory")...), 0x02, 0x00)
+	exports = append(append(exports, wasmName(wasmAllocFuncName)...), 0x00, 0x00)
+	if exportFilter {
+		exports[0] += 1
+		exports = append(append(exports, wasmName(wasmFilterFuncName)...), 0x00, 0x01)
+	}
+	module = append(module, wasmSection(7, exports...)...)
+	allocBody := []byte{0x00, 0x41, 0x80, 0x08, 0x0b}
+	filterBody = append(append([]byte{0x00}, filterBody...), 0x0b)
+	code := []byte{0x02, byte(len(allocBody))}
+	code = append(append(code, allocBody...), byte(len(filterBody)))
+	code = append(code, filterBody...)
+	return append(module, wasmSection(10, code...)...)
+}
+
+func writeWasmTestModule(t *testing.T, dir string, name string, filterBody []byte, exportFilter bool) string {
+	path := filepath.Join(dir, name+".wasm")
+	err := ioutil.WriteFile(path, wasmTestModule(filterBody, exportFilter), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return path
+}
+
+func newWasmTestFilter(t *testing.T, logger *logging.Logger, path string, timeout time.Duration, dropOnError bool) *WasmFilter {
+	filter, err := NewWasmFilter(logger, "wasm", path, timeout, 0, dropOnError)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return filter
+}
+
+func Test_WasmFilter(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("wasm")
+	dir, err := ioutil.TempDir("", "wasm")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	records := []FluentRecordSet{{Tag: "app", Records: []TinyFluentRecord{
+		{Timestamp: 1, Data: map[string]interface{}{"message": "hello"}},
+		{Timestamp: 2, Data: map[string]interface{}{"message": "world"}},
+	}}}
+
+	filter := newWasmTestFilter(t, logger, writeWasmTestModule(t, dir, "pass", wasmPassBody, true), time.Second, false)
+	defer filter.Stop()
+	result, err := filter.Filter(records)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(result) != 1 || result[0].Tag != "app" || len(result[0].Records) != 2 {
+		t.Fatalf("%+v", result)
+	}
+	for i, record := range result[0].Records {
+		if record.Timestamp != records[0].Records[i].Timestamp || record.Data["message"] != records[0].Records[i].Data["message"] {
+			t.Errorf("%d: %+v", i, record)
+		}
+	}
+
+	filter = newWasmTestFilter(t, logger, writeWasmTestModule(t, dir, "drop", wasmDropBody, true), time.Second, false)
+	defer filter.Stop()
+	result, err = filter.Filter(records)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(result) != 0 {
+		t.Errorf("%+v", result)
+	}
+}
+
+// Test_WasmFilter_Errors runs the modules failing on every record under both
+// of on-error: pass lets the records through unmodified, and drop returns
+// them as the errors of the records.
+func Test_WasmFilter_Errors(t *testing.T) {
+	logging.InitForTesting(logging.CRITICAL)
+	logger := logging.MustGetLogger("wasm")
+	dir, err := ioutil.TempDir("", "wasm")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	records := []FluentRecordSet{{Tag: "app", Records: []TinyFluentRecord{
+		{Timestamp: 1, Data: map[string]interface{}{"message": "hello"}},
+		{Timestamp: 2, Data: map[string]interface{}{"message": "world"}},
+	}}}
+	for _, module := range []struct {
+		name string
+		body []byte
+		// a part of the message of the error
+		message string
+	}{
+		{"trap", wasmTrapBody, "unreachable"},
+		{"timeout", wasmLoopBody, "deadline exceeded"},
+		{"out-of-bounds", wasmOutOfBoundsBody, "fluentd_filter returned an out-of-range buffer"},
+	} {
+		path := writeWasmTestModule(t, dir, module.name, module.body, true)
+
+		filter := newWasmTestFilter(t, logger, path, 100*time.Millisecond, false)
+		start := time.Now()
+		result, err := filter.Filter(records)
+		if err != nil {
+			t.Errorf("%s: %s", module.name, err.Error())
+		}
+		if len(result) != 1 || len(result[0].Records) != 2 || result[0].Records[1].Data["message"] != "world" {
+			t.Errorf("%s: %+v", module.name, result)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: took %s", module.name, elapsed)
+		}
+		filter.Stop()
+
+		filter = newWasmTestFilter(t, logger, path, 100*time.Millisecond, true)
+		result, err = filter.Filter(records)
+		if len(result) != 0 {
+			t.Errorf("%s: %+v", module.name, result)
+		}
+		errs, ok := err.(RecordErrors)
+		if !ok || len(errs) != 2 {
+			t.Fatalf("%s: %v", module.name, err)
+		}
+		if errs[0].Tag != "app" || errs[1].Record.Data["message"] != "world" || !strings.Contains(errs[0].Err.Error(), module.message) {
+			t.Errorf("%s: %+v", module.name, errs)
+		}
+		filter.Stop()
+	}
+}
+
+func Test_WasmFilter_MissingExport(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("wasm")
+	dir, err := ioutil.TempDir("", "wasm")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	config := NewConfigElement("filter", "wasm")
+	config.Set("type", "wasm")
+	config.Set("path", writeWasmTestModule(t, dir, "no-filter", wasmPassBody, false))
+	_, err = newWasmFilterFromConfig(logger, config, nil)
+	if err == nil || !strings.Contains(err.Error(), wasmFilterFuncName) {
+		t.Errorf("%v", err)
+	}
+}
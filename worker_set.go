@@ -20,6 +20,7 @@ package fluentd_forwarder
 
 import (
 	"sync"
+	"time"
 )
 
 type WorkerSet struct {
@@ -51,6 +52,44 @@ func (set *WorkerSet) Slice() []Worker {
 	return retval
 }
 
+// WaitForShutdown waits for the workers to shut down until the deadline, or
+// indefinitely if it is zero, and returns the ones that have not.
+func (set *WorkerSet) WaitForShutdown(deadline time.Time) []Worker {
+	workers := set.Slice()
+	done := make([]chan struct{}, len(workers))
+	for i, worker := range workers {
+		done[i] = make(chan struct{})
+		go func(worker Worker, done chan struct{}) {
+			worker.WaitForShutdown()
+			close(done)
+		}(worker, done[i])
+	}
+	timeout := (<-chan time.Time)(nil)
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	running := make([]Worker, 0)
+	expired := false
+	for i, worker := range workers {
+		if !expired {
+			select {
+			case <-done[i]:
+				continue
+			case <-timeout:
+				expired = true
+			}
+		}
+		select {
+		case <-done[i]:
+		default:
+			running = append(running, worker)
+		}
+	}
+	return running
+}
+
 func NewWorkerSet() *WorkerSet {
 	return &WorkerSet{
 		workers: make(map[Worker]struct{}),
@@ -0,0 +1,54 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"testing"
+	"time"
+)
+
+type stoppingWorker struct {
+	stopped chan struct{}
+}
+
+func (worker *stoppingWorker) String() string   { return "stopping" }
+func (worker *stoppingWorker) Start()           {}
+func (worker *stoppingWorker) Stop()            { close(worker.stopped) }
+func (worker *stoppingWorker) WaitForShutdown() { <-worker.stopped }
+
+func Test_WorkerSet_WaitForShutdown(t *testing.T) {
+	set := NewWorkerSet()
+	stopped := &stoppingWorker{stopped: make(chan struct{})}
+	hung := &stoppingWorker{stopped: make(chan struct{})}
+	set.Add(stopped)
+	set.Add(hung)
+	stopped.Stop()
+	startedAt := time.Now()
+	running := set.WaitForShutdown(startedAt.Add(50 * time.Millisecond))
+	if len(running) != 1 || running[0] != hung {
+		t.Fail()
+	}
+	if time.Since(startedAt) < 50*time.Millisecond {
+		t.Fail()
+	}
+	hung.Stop()
+	if running := set.WaitForShutdown(time.Time{}); len(running) != 0 {
+		t.Fail()
+	}
+}